@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageA11yCheck = `A11y-check:
+  novfmt a11y-check [options] <book.epub>
+
+  Audits the book for common accessibility problems and scores it out of
+  100. Each issue costs points, up to a cap per check:
+    pkg-lang        the package has no dc:language (error)
+    doc-lang        a document's <html> has no lang attribute (error)
+    img-alt         an image has no alt attribute; alt="" marks a
+                    decorative image and is fine (error)
+    empty-heading   a heading has no text (error)
+    heading-order   a heading skips a level, e.g. h1 then h3 (warning)
+    bold-heading    a short, fully bold paragraph stands in for a
+                    heading (warning)
+    landmarks       no landmarks nav, or no bodymatter entry (warning)
+    a11y-metadata   schema.org accessibility metadata is missing; see
+                    edit-meta -a11y-preset (warning)
+  Options may also follow the file name.
+
+  -min-score <n>        fail (exit status 1) when the score is below n
+  -max-issues <n>       issues to list per check (default: 10; 0 lists all)
+  -json                 print the report as JSON
+`
+
+func runA11yCheck(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("a11y-check", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageA11yCheck) }
+
+	minScore := fs.Int("min-score", 0, "")
+	maxIssues := fs.Int("max-issues", 10, "")
+	asJSON := g.jsonFlag(fs)
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 1 {
+		return usageErrorf("a11y-check requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc([]string{epub.StageRewrite}, []float64{1})
+	report, err := epub.A11yCheck(ctx, paths[0], epub.A11yCheckOptions{
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err := g.printJSON(report); err != nil {
+			return err
+		}
+	} else if !g.quiet {
+		for _, rule := range epub.A11yRules() {
+			n := report.Counts[rule.ID]
+			if n == 0 {
+				continue
+			}
+			fmt.Printf("%s (%s): %d\n", rule.ID, rule.Severity, n)
+			shown := 0
+			for _, issue := range report.Issues {
+				if issue.Rule != rule.ID {
+					continue
+				}
+				if *maxIssues > 0 && shown == *maxIssues {
+					fmt.Printf("  … and %d more\n", n-shown)
+					break
+				}
+				shown++
+				switch {
+				case issue.Href == "":
+					fmt.Printf("  %s\n", issue.Message)
+				case issue.Line > 0:
+					fmt.Printf("  %s:%d: %s\n", issue.Href, issue.Line, issue.Message)
+				default:
+					fmt.Printf("  %s: %s\n", issue.Href, issue.Message)
+				}
+			}
+		}
+		fmt.Printf("score: %d/100 (%d errors, %d warnings in %d documents)\n", report.Score, report.Errors, report.Warnings, report.Files)
+	}
+
+	if report.Score < *minScore {
+		return checkFailedf("a11y-check failed: score %d is below %d", report.Score, *minScore)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+var usageBanner = `Banner:
+  novfmt banner [options] <book.epub>
+
+  Adds a header and/or footer to every chapter, such as a translator's
+  credit or a series banner; the cover and the navigation document are
+  left alone. Each is text or an XHTML fragment; text without markup is put
+  in a paragraph. Placeholders are filled in for each chapter:
+  {` + strings.Join(epub.BannerPlaceholders, "}, {") + `}.
+  A header or footer added before is replaced, and -remove takes them out.
+  Without -out the input file is modified in place.
+
+  -header <text>        header to add
+  -header-file <file>   read the header from a file
+  -footer <text>        footer to add
+  -footer-file <file>   read the footer from a file
+  -at <where>           where the header goes: start (default), first in the
+                        body, or after-heading, after the chapter's first
+                        heading; the footer always ends the body
+  -remove               remove the headers and footers added before
+  -dry-run              list affected files without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runBanner(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("banner", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageBanner) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	header := fs.String("header", "", "")
+	headerFile := fs.String("header-file", "", "")
+	footer := fs.String("footer", "", "")
+	footerFile := fs.String("footer-file", "", "")
+	at := fs.String("at", "", "")
+	remove := fs.Bool("remove", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("banner requires exactly one EPUB path")
+	}
+	if *header != "" && *headerFile != "" {
+		return usageErrorf("-header and -header-file cannot be combined")
+	}
+	if *footer != "" && *footerFile != "" {
+		return usageErrorf("-footer and -footer-file cannot be combined")
+	}
+	for _, f := range []struct {
+		path string
+		text *string
+	}{{*headerFile, header}, {*footerFile, footer}} {
+		if f.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		*f.text = string(data)
+	}
+	adding := *header != "" || *footer != ""
+	switch {
+	case *remove && adding:
+		return usageErrorf("-remove cannot be combined with -header or -footer")
+	case !*remove && !adding:
+		return usageErrorf("banner requires -header, -footer or -remove")
+	case *at != "" && *header == "":
+		return usageErrorf("-at requires -header")
+	}
+	if _, err := epub.ParseBannerPosition(*at); err != nil {
+		return usageErrorf("-at: %v", err)
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.5, 0.5},
+	)
+	stats, err := epub.InjectBanners(ctx, fs.Arg(0), epub.BannerOptions{
+		Header:   *header,
+		Footer:   *footer,
+		HeaderAt: *at,
+		Remove:   *remove,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Println(f.Href)
+		}
+	}
+	if !g.quiet {
+		verb := "updated"
+		if *remove {
+			verb = "removed from"
+		}
+		fmt.Fprintf(os.Stderr, "banner: %s %d chapters; %s\n", verb, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
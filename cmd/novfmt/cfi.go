@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageCFI = `CFI:
+  novfmt cfi anchors [options] <book.epub>
+  novfmt cfi resolve [options] <book.epub> <cfi>
+
+  Helpers for reading positions stored as EPUB CFIs by sync services.
+
+  anchors gives every block element (p, div, h1-h6, li, blockquote, ...)
+  without an id a stable id based on its position in the document, so CFIs
+  carrying id assertions keep pointing at the same paragraph after the book
+  is rebuilt. Without -out the input file is modified in place.
+  -prefix <str>         id prefix (default nf-)
+  -dry-run              list affected files without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+
+  resolve maps a CFI such as "epubcfi(/6/4[ch02]!/4/10[nf-5]/1:12)" to the
+  content document, element path, nearest id and character offset, and
+  prints the surrounding text. Range CFIs resolve to their start.
+  -json                 print the location as JSON
+`
+
+func runCFI(ctx context.Context, g *globalFlags, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usageCFI)
+		return usageErrorf("cfi requires a subcommand (anchors, resolve)")
+	}
+	switch args[0] {
+	case "anchors":
+		return runCFIAnchors(ctx, g, args[1:])
+	case "resolve":
+		return runCFIResolve(ctx, g, args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, usageCFI)
+		return nil
+	default:
+		return usageErrorf("unknown cfi subcommand %q (want anchors, resolve)", args[0])
+	}
+}
+
+func newCFIFlagSet(g *globalFlags, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cfi "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageCFI) }
+	return fs
+}
+
+func runCFIAnchors(ctx context.Context, g *globalFlags, args []string) error {
+	fs := newCFIFlagSet(g, "anchors")
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	prefix := fs.String("prefix", "nf-", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("cfi anchors requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.AddCFIAnchors(ctx, fs.Arg(0), epub.CFIAnchorOptions{
+		Prefix:   *prefix,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Printf("%s  %d anchors\n", f.Href, f.Matches)
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "cfi anchors: %d ids added across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
+
+func runCFIResolve(ctx context.Context, g *globalFlags, args []string) error {
+	fs := newCFIFlagSet(g, "resolve")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usageErrorf("cfi resolve requires an EPUB path and a CFI")
+	}
+
+	loc, err := epub.ResolveCFI(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return g.printJSON(loc)
+	}
+	fmt.Printf("file:     %s (%s)\n", loc.Href, loc.ItemID)
+	fmt.Printf("path:     %s\n", loc.Path)
+	if loc.ElementID != "" {
+		fmt.Printf("id:       %s\n", loc.ElementID)
+	}
+	if loc.Offset >= 0 {
+		fmt.Printf("offset:   %d\n", loc.Offset)
+	}
+	if loc.Excerpt != "" {
+		fmt.Printf("text:     %s\n", loc.Excerpt)
+	}
+	return nil
+}
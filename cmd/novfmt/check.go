@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageCheck = `Check:
+  novfmt check -profile <device> [options] <book.epub>
+
+  Answers "will this book behave on my reader?" by running the checks that
+  matter for a device profile:
+    kobo     Kobo e-readers: 300KB per XHTML document (sideloaded .epub
+             files use Adobe's renderer), no WebP or AVIF without a
+             fallback, no flex or grid layout; hints at KEPUB
+    kindle   Send to Kindle: 200MB books, 5MB images, no WebP or AVIF
+             without a fallback, no grid layout or fixed positioning
+    ade      Adobe Digital Editions: needs an NCX, 300KB per XHTML
+             document, no flex or grid layout
+    apple    Apple Books: 2GB books, images up to 4 million pixels; hints
+             at the display options file embedded fonts need
+  Every profile also needs a navigation document or NCX, and warns about
+  scripts where they don't run. Errors make the command fail; warnings
+  are things that render badly or slowly; info lines are suggestions.
+  Options may also follow the file name.
+
+  -profile <name>       device profile; repeatable or comma-separated
+  -strict               also fail on warnings
+  -json                 print the reports as JSON
+`
+
+func runCheck(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageCheck) }
+
+	var profileNames multiValue
+	fs.Var(&profileNames, "profile", "")
+	strict := fs.Bool("strict", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 1 {
+		return usageErrorf("check requires exactly one EPUB path")
+	}
+	if paths, err = g.fetchInputs(ctx, paths); err != nil {
+		return err
+	}
+	g.inputs = paths
+	names := *splitValues(profileNames)
+	if len(names) == 0 {
+		return usageErrorf("check requires -profile")
+	}
+	var profiles []epub.DeviceProfile
+	for _, name := range names {
+		p, err := epub.LookupDeviceProfile(name)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, p)
+	}
+
+	var reports []epub.CheckReport
+	for _, p := range profiles {
+		progress, done := g.progressFunc([]string{epub.StageRewrite}, []float64{1})
+		report, err := epub.CheckDevice(ctx, paths[0], epub.CheckOptions{
+			Profile:  p,
+			Logger:   g.logger(os.Stderr),
+			Progress: progress,
+		})
+		done()
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+	}
+
+	if *asJSON {
+		if err := g.printJSON(reports); err != nil {
+			return err
+		}
+	} else if !g.quiet {
+		for _, r := range reports {
+			for _, issue := range r.Issues {
+				where := ""
+				if issue.Href != "" {
+					where = issue.Href + ": "
+				}
+				fmt.Printf("%s: %s %s: %s%s\n", r.Profile, issue.Severity, issue.Check, where, issue.Message)
+			}
+			verdict := "ok"
+			if !r.Passed() || (*strict && r.Warnings > 0) {
+				verdict = "FAIL"
+			}
+			fmt.Printf("%s: %s (%d errors, %d warnings, %d suggestions)\n", r.Profile, verdict, r.Errors, r.Warnings, r.Hints)
+		}
+	}
+
+	var failed []string
+	for _, r := range reports {
+		if !r.Passed() || (*strict && r.Warnings > 0) {
+			failed = append(failed, r.Profile)
+		}
+	}
+	if len(failed) > 0 {
+		return checkFailedf("check failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
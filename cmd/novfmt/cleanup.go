@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageCleanup = `Cleanup:
+  novfmt cleanup [options] <book.epub>
+
+  Removes blank-paragraph clutter left by EPUB generators: runs of empty or
+  <br/>-only paragraphs longer than -max-blank, runs of <br/> inside a
+  paragraph with more than -max-blank blank lines, and paragraphs holding
+  only non-breaking spaces. Blank paragraphs with an id or centered ones
+  (often scene breaks) are kept. Without -out the input file is modified
+  in place.
+
+  -max-blank <n>        blank paragraphs / blank lines to keep in a row
+                        (default: 1; 0 removes them all)
+  -keep-nbsp            treat &nbsp;-only paragraphs like other blank ones
+                        instead of always removing them
+  -dry-run              list removals without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runCleanup(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageCleanup) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	maxBlank := fs.Int("max-blank", 1, "")
+	keepNBSP := fs.Bool("keep-nbsp", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("cleanup requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.CleanupParagraphs(ctx, fs.Arg(0), epub.CleanupOptions{
+		MaxBlank: *maxBlank,
+		KeepNBSP: *keepNBSP,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Printf("%s  %d removals\n", f.Href, f.Matches)
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "cleanup: %d removals across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageDuration = `Duration:
+  novfmt duration [options] <book.epub>
+
+  Estimates how long each chapter, and the whole book, takes to narrate:
+  words at -wpm plus Chinese and Japanese characters at -cpm. A chapter
+  starts at each spine document with a heading (see the global -headings
+  option); documents without one belong to the chapter before. With -embed
+  the estimates are written to the package as novfmt:narration-duration
+  metas (H:MM:SS), per chapter refining its first document as
+  media:duration does; without -out the input file is modified in place.
+
+  -wpm <n>              words per minute (default: 155)
+  -cpm <n>              CJK characters per minute (default: 300)
+  -embed                write the estimates into the package metadata
+  -dry-run              with -embed, report without writing anything
+  -json                 print the estimates and whether the book was written
+                        as JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runDuration(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("duration", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageDuration) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	wpm := fs.Int("wpm", epub.DefaultWordsPerMinute, "")
+	cpm := fs.Int("cpm", epub.DefaultCharsPerMinute, "")
+	embed := fs.Bool("embed", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("duration requires exactly one EPUB path")
+	}
+	if *wpm <= 0 || *cpm <= 0 {
+		return usageErrorf("-wpm and -cpm must be positive")
+	}
+	headings, err := g.headingDetector()
+	if err != nil {
+		return err
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.8, 0.2},
+	)
+	report, err := epub.EstimateNarration(ctx, fs.Arg(0), epub.DurationOptions{
+		WordsPerMinute: *wpm,
+		CharsPerMinute: *cpm,
+		Headings:       headings,
+		Embed:          *embed,
+		OutPath:        *out,
+		DryRun:         *dryRun,
+		Logger:         g.logger(os.Stderr),
+		Progress:       progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(report)
+	}
+	for _, ch := range report.Chapters {
+		fmt.Printf("%9s  %s  (%s)\n", ch.Duration, ch.Title, ch.Hrefs[0])
+	}
+	fmt.Printf("%9s  total\n", report.Duration)
+	if !g.quiet {
+		summary := fmt.Sprintf("duration: %d chapters, %d words, %d CJK characters", len(report.Chapters), report.Words, report.CJKChars)
+		if *embed {
+			summary += "; " + describeChangeset(report.Changeset)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// eventStream writes the events of -output json to stdout as JSON Lines:
+// one object per line, told apart by its "event" field. Log records go
+// through it too, so it serializes writes.
+type eventStream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type progressEvent struct {
+	Event string `json:"event"`
+	Stage string `json:"stage"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	Item  string `json:"item,omitempty"`
+}
+
+// resultEvent carries what a command prints with -json.
+type resultEvent struct {
+	Event   string `json:"event"`
+	Command string `json:"command"`
+	Result  any    `json:"result"`
+}
+
+// fileEvent is one file of the result's changeset.
+type fileEvent struct {
+	Event   string `json:"event"`
+	Command string `json:"command"`
+	Href    string `json:"href"`
+	Kind    string `json:"kind"`
+}
+
+// doneEvent is always the last event: whether the command succeeded.
+type doneEvent struct {
+	Event   string `json:"event"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// ErrorClass and ExitCode classify a failure as -errors json does.
+	ErrorClass string `json:"error_class,omitempty"`
+	ExitCode   int    `json:"exit_code,omitempty"`
+}
+
+// Write takes one line already encoded, as slog handlers produce.
+func (s *eventStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *eventStream) emit(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(append(data, '\n'))
+	return err
+}
+
+func (s *eventStream) progress(ev epub.ProgressEvent) {
+	s.emit(progressEvent{Event: "progress", Stage: ev.Stage, Done: ev.Done, Total: ev.Total, Item: ev.Item})
+}
+
+// result emits v and then a file event for each file of its changeset,
+// when it has one.
+func (s *eventStream) result(command string, v any) error {
+	if err := s.emit(resultEvent{Event: "result", Command: command, Result: v}); err != nil {
+		return err
+	}
+	cs, ok := v.(epub.Changeset)
+	if !ok {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var holder struct {
+			Changeset epub.Changeset `json:"changeset"`
+		}
+		if json.Unmarshal(data, &holder) != nil {
+			return nil
+		}
+		cs = holder.Changeset
+	}
+	for _, f := range cs.Files {
+		if err := s.emit(fileEvent{Event: "file", Command: command, Href: f.Href, Kind: f.Kind}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// Exit statuses, one per class of failure, so that wrapper scripts can
+// react to each differently.
+const (
+	exitFailure  = 1 // a failure not classified below
+	exitUsage    = 2 // bad flags, arguments or option combinations
+	exitBadInput = 3 // an input is not a readable EPUB
+	exitDRM      = 4 // an input is DRM-protected
+	exitCheck    = 5 // a check (validate, verify, gate, ...) found problems
+	exitIO       = 6 // reading or writing a file failed
+	// exitCanceled follows SIGINT or SIGTERM, as shells report a process
+	// killed by SIGINT.
+	exitCanceled = 130
+)
+
+// usageError is a mistake in how a command was invoked.
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// checkError is a check command's verdict that the book failed.
+type checkError struct{ err error }
+
+func (e checkError) Error() string { return e.err.Error() }
+func (e checkError) Unwrap() error { return e.err }
+
+func checkFailedf(format string, args ...any) error {
+	return checkError{fmt.Errorf(format, args...)}
+}
+
+// parseFlags parses a command's arguments; a bad flag is a usage error.
+// -h returns flag.ErrHelp, which ends the command successfully.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return usageError{err}
+	}
+	return err
+}
+
+// errorInfo is a failure as -errors json reports it.
+type errorInfo struct {
+	// Class is one of usage, invalid-input, drm, check-failed, io,
+	// canceled and error.
+	Class    string `json:"class"`
+	ExitCode int    `json:"exit_code"`
+	Message  string `json:"message"`
+	// Path is the file an io error is about.
+	Path string `json:"path,omitempty"`
+}
+
+func classifyError(err error) errorInfo {
+	info := errorInfo{Class: "error", ExitCode: exitFailure, Message: err.Error()}
+	var (
+		usage   usageError
+		check   checkError
+		pathErr *fs.PathError
+		linkErr *os.LinkError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		info.Class, info.ExitCode, info.Message = "canceled", exitCanceled, "canceled"
+	case errors.As(err, &usage), errors.Is(err, errUnknownCommand):
+		info.Class, info.ExitCode = "usage", exitUsage
+	case errors.Is(err, epub.ErrDRM):
+		info.Class, info.ExitCode = "drm", exitDRM
+	case errors.Is(err, epub.ErrInvalidEPUB):
+		info.Class, info.ExitCode = "invalid-input", exitBadInput
+	case errors.As(err, &check):
+		info.Class, info.ExitCode = "check-failed", exitCheck
+	case errors.As(err, &pathErr):
+		info.Class, info.ExitCode, info.Path = "io", exitIO, pathErr.Path
+	case errors.As(err, &linkErr):
+		info.Class, info.ExitCode, info.Path = "io", exitIO, linkErr.New
+	}
+	return info
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+func TestClassifyError(t *testing.T) {
+	_, notExist := os.Open("/nonexistent/book.epub")
+	tests := []struct {
+		err   error
+		class string
+		code  int
+	}{
+		{errors.New("boom"), "error", exitFailure},
+		{usageErrorf("toc requires exactly one EPUB path"), "usage", exitUsage},
+		{fmt.Errorf("%w %q", errUnknownCommand, "frob"), "usage", exitUsage},
+		{fmt.Errorf("book.epub: %w", epub.ErrDRM), "drm", exitDRM},
+		{fmt.Errorf("extract: %w", epub.ErrInvalidEPUB), "invalid-input", exitBadInput},
+		{checkFailedf("validate failed: %d errors", 2), "check-failed", exitCheck},
+		{fmt.Errorf("read rules: %w", notExist), "io", exitIO},
+		{fmt.Errorf("step 1: %w", context.Canceled), "canceled", exitCanceled},
+	}
+	for _, tt := range tests {
+		got := classifyError(tt.err)
+		if got.Class != tt.class || got.ExitCode != tt.code {
+			t.Errorf("%v: got %s/%d, want %s/%d", tt.err, got.Class, got.ExitCode, tt.class, tt.code)
+		}
+	}
+	if got := classifyError(fmt.Errorf("x: %w", notExist)); got.Path != "/nonexistent/book.epub" {
+		t.Errorf("io error path = %q", got.Path)
+	}
+}
+
+func TestParseFlagsUsageErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Bool("x", false, "")
+	var usage usageError
+	if err := parseFlags(fs, []string{"-y"}); !errors.As(err, &usage) {
+		t.Fatalf("unknown flag: err = %v, want a usage error", err)
+	}
+	if err := parseFlags(fs, []string{"-h"}); err != flag.ErrHelp {
+		t.Fatalf("-h: err = %v, want flag.ErrHelp", err)
+	}
+}
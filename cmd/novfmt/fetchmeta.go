@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageFetchMeta = `Fetch-meta:
+  novfmt fetch-meta [options] <book.epub>
+
+  Looks the book up in online catalogues and lists candidate records. The
+  query defaults to the book's ISBN, or its title and first author. With
+  -pick, or by answering the prompt on a terminal, the chosen record's
+  title, authors, description and language are written into the book; the
+  identifier is left alone. Without -out the input file is modified in place.
+
+  -isbn <isbn>          search by ISBN
+  -title <str>          search by title
+  -author <str>         search by author
+  -provider <name>      openlibrary or google; repeatable (default: both)
+  -google-key <key>     Google Books API key (optional)
+  -pick <n>             apply candidate n without asking
+  -json                 print the candidates as JSON and exit
+  -o, -out <path>       write result to a new file instead of editing in place
+  -no-touch-modified    don't update the last-modified timestamp (dcterms:modified)
+`
+
+func runFetchMeta(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("fetch-meta", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageFetchMeta) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	isbn := fs.String("isbn", "", "")
+	title := fs.String("title", "", "")
+	author := fs.String("author", "", "")
+	var providerNames multiValue
+	fs.Var(&providerNames, "provider", "")
+	googleKey := fs.String("google-key", "", "")
+	pick := fs.Int("pick", 0, "")
+	asJSON := g.jsonFlag(fs)
+	noTouch := fs.Bool("no-touch-modified", false, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("fetch-meta requires exactly one EPUB path")
+	}
+	input := fs.Arg(0)
+
+	var providers []epub.MetadataProvider
+	for _, name := range providerNames {
+		p, err := epub.MetadataProviderByName(name)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, p)
+	}
+	if len(providers) == 0 {
+		providers = epub.DefaultMetadataProviders()
+	}
+	for _, p := range providers {
+		if gb, ok := p.(*epub.GoogleBooksProvider); ok {
+			gb.APIKey = *googleKey
+		}
+	}
+
+	q := epub.MetadataQuery{ISBN: *isbn, Title: *title, Author: *author}
+	if q.IsZero() {
+		var err error
+		if q, err = epub.MetadataQueryFromBook(ctx, input); err != nil {
+			return err
+		}
+	}
+	candidates, err := epub.SearchMetadata(ctx, providers, q)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return g.printJSON(candidates)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no matches for %s", describeQuery(q))
+	}
+	printCandidates(os.Stdout, candidates)
+
+	choice := *pick
+	if choice == 0 {
+		if !isTerminal(os.Stdin) {
+			return nil
+		}
+		if choice, err = promptCandidate(os.Stdin, os.Stderr, len(candidates)); err != nil || choice == 0 {
+			return err
+		}
+	}
+	if choice < 1 || choice > len(candidates) {
+		return usageErrorf("-pick %d: there are %d candidates", choice, len(candidates))
+	}
+
+	cs, err := epub.EditEPUB(ctx, input, epub.EditOptions{
+		OutPath:       *out,
+		MetadataPatch: candidates[choice-1].Patch(),
+		TouchModified: !*noTouch,
+		Logger:        g.logger(os.Stderr),
+	})
+	if err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "fetch-meta: applied candidate %d; %s\n", choice, describeChangeset(cs))
+	}
+	return nil
+}
+
+func describeQuery(q epub.MetadataQuery) string {
+	if q.ISBN != "" {
+		return "ISBN " + q.ISBN
+	}
+	var parts []string
+	if q.Title != "" {
+		parts = append(parts, strconv.Quote(q.Title))
+	}
+	if q.Author != "" {
+		parts = append(parts, "by "+q.Author)
+	}
+	return strings.Join(parts, " ")
+}
+
+func printCandidates(w io.Writer, candidates []epub.MetadataCandidate) {
+	for i, c := range candidates {
+		fmt.Fprintf(w, "%2d. [%s] %s", i+1, c.Provider, c.Title)
+		if len(c.Authors) > 0 {
+			fmt.Fprintf(w, " / %s", strings.Join(c.Authors, ", "))
+		}
+		var details []string
+		for _, s := range []string{c.Published, c.Publisher, c.Language} {
+			if s != "" {
+				details = append(details, s)
+			}
+		}
+		if c.ISBN != "" {
+			details = append(details, "ISBN "+c.ISBN)
+		}
+		if len(details) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(details, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// promptCandidate asks which candidate to apply; 0 means none.
+func promptCandidate(r io.Reader, w io.Writer, n int) (int, error) {
+	in := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "apply which candidate? [1-%d, empty to skip] ", n)
+		if !in.Scan() {
+			return 0, in.Err()
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			return 0, nil
+		}
+		if choice, err := strconv.Atoi(line); err == nil && choice >= 1 && choice <= n {
+			return choice, nil
+		}
+	}
+}
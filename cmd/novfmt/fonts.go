@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageFonts = `Fonts:
+  novfmt fonts [options] <book.epub>
+
+  Reports chapters that use characters not covered by any embedded font
+  (TrueType, OpenType, WOFF; IDPF-obfuscated fonts are handled).
+
+  -json                 print the report as JSON
+  -inject-fallback      append fallback font-family chains (language-appropriate
+                        CJK fonts, then serif/sans-serif) to rules that use
+                        embedded fonts; modifies the book
+  -o, -out <path>       with -inject-fallback, write to a new file instead of
+                        editing in place
+`
+
+func runFonts(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("fonts", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageFonts) }
+
+	asJSON := g.jsonFlag(fs)
+	inject := fs.Bool("inject-fallback", false, "")
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("fonts requires exactly one EPUB path")
+	}
+
+	report, err := epub.AnalyzeFonts(ctx, fs.Arg(0), epub.FontOptions{
+		InjectFallback: *inject,
+		OutPath:        *out,
+		Logger:         g.logger(os.Stderr),
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	if len(report.Fonts) == 0 {
+		fmt.Println("no embedded fonts")
+		return nil
+	}
+	fmt.Println("Fonts:")
+	for _, f := range report.Fonts {
+		if f.Error != "" {
+			fmt.Printf("  %s  unreadable: %s\n", f.Href, f.Error)
+			continue
+		}
+		fmt.Printf("  %s  %d code points\n", f.Href, f.Glyphs)
+	}
+	if len(report.Chapters) == 0 {
+		fmt.Println("all chapter text is covered by embedded fonts")
+	} else {
+		fmt.Println("Chapters with uncovered characters:")
+		for _, c := range report.Chapters {
+			fmt.Printf("  %s  %d missing: %s\n", c.Href, utf8.RuneCountInString(c.Missing), c.Missing)
+		}
+	}
+	for _, href := range report.FallbackCSS {
+		fmt.Printf("injected fallback fonts into %s\n", href)
+	}
+	if *inject && !g.quiet {
+		fmt.Fprintf(os.Stderr, "fonts: %s\n", describeChangeset(report.Changeset))
+	}
+	return nil
+}
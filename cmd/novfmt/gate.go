@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageGate = `Gate:
+  novfmt gate [options] <old.epub> <new.epub>
+
+  Compares the visible text of a previously published build with a new one
+  and fails (exit status 1) when the difference exceeds a threshold. Use it
+  in publishing pipelines to catch a rule that silently rewrote too much.
+  Thresholds take a count (500) or a percentage of the old book (2%).
+  Options may also follow the file names.
+
+  -max-changed-words <n|p%>
+                        maximum number of changed words
+  -max-changed-chapters <n|p%>
+                        maximum number of spine documents with any change
+  -top <n>              chapters to list, most changed first (default: 5)
+  -json                 print the report as JSON
+`
+
+func runGate(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("gate", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageGate) }
+
+	maxWords := fs.String("max-changed-words", "", "")
+	maxChapters := fs.String("max-changed-chapters", "", "")
+	top := fs.Int("top", 5, "")
+	asJSON := g.jsonFlag(fs)
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		return usageErrorf("gate requires an old and a new EPUB path")
+	}
+
+	var opts epub.GateOptions
+	if opts.MaxChangedWords, err = epub.ParseThreshold(*maxWords); err != nil {
+		return usageErrorf("-max-changed-words: %w", err)
+	}
+	if opts.MaxChangedChapters, err = epub.ParseThreshold(*maxChapters); err != nil {
+		return usageErrorf("-max-changed-chapters: %w", err)
+	}
+	if !opts.MaxChangedWords.Set && !opts.MaxChangedChapters.Set {
+		return usageErrorf("gate requires -max-changed-words or -max-changed-chapters")
+	}
+	opts.Logger = g.logger(os.Stderr)
+
+	report, err := epub.CompareBooks(ctx, paths[0], paths[1], opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if !g.quiet {
+		fmt.Printf("words:    %d → %d, %d changed (%.2f%%)\n", report.OldWords, report.NewWords, report.ChangedWords, report.ChangedWordsPercent())
+		fmt.Printf("chapters: %d of %d changed\n", report.ChangedChapters, report.OldChapters)
+		for i, c := range report.Chapters {
+			if i == *top {
+				break
+			}
+			fmt.Printf("  %6d  %s\n", c.ChangedWords, c.Href)
+		}
+	}
+
+	if !report.Passed() {
+		return checkFailedf("gate failed: %s", strings.Join(report.Failures, "; "))
+	}
+	if !g.quiet && !*asJSON {
+		fmt.Println("gate passed")
+	}
+	return nil
+}
+
+// parseInterspersed parses fs while allowing flags after positional
+// arguments, which the flag package otherwise stops at.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageGen = `Gen:
+  novfmt gen [options] -o <out.epub>
+
+  Writes a synthetic book for benchmarks and bug reports. The same options
+  and -seed always give the same file.
+
+  -chapters <n>         number of chapters (default: 10)
+  -words-per-chapter <n>
+                        words of filler text per chapter (default: 1000)
+  -images <n>           PNG illustrations spread over the chapters; the first
+                        one is the cover (default: 0)
+  -lang <code>          language of the filler text, en or ja (default: en)
+  -title <str>          book title (default: "Synthetic Book")
+  -seed <n>             random seed (default: 0)
+  -nesting <n>          wrap every paragraph in n nested divs
+  -huge-chapter <n>     add a chapter of n words in a single paragraph
+  -weird-namespaces     write chapters with a prefixed XHTML namespace and
+                        attributes from a foreign namespace
+  -o, -out <path>       output file (required)
+`
+
+func runGen(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageGen) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	chapters := fs.Int("chapters", 0, "")
+	words := fs.Int("words-per-chapter", 0, "")
+	images := fs.Int("images", 0, "")
+	lang := fs.String("lang", "", "")
+	title := fs.String("title", "", "")
+	seed := fs.Uint64("seed", 0, "")
+	nesting := fs.Int("nesting", 0, "")
+	huge := fs.Int("huge-chapter", 0, "")
+	weird := fs.Bool("weird-namespaces", false, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("gen takes no positional arguments")
+	}
+	if *out == "" {
+		return usageErrorf("gen requires -o")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.7, 0.3},
+	)
+	err := epub.GenerateEPUB(ctx, epub.GenerateOptions{
+		Title:            *title,
+		Language:         *lang,
+		Chapters:         *chapters,
+		WordsPerChapter:  *words,
+		Images:           *images,
+		Seed:             *seed,
+		NestingDepth:     *nesting,
+		HugeChapterWords: *huge,
+		WeirdNamespaces:  *weird,
+		OutPath:          *out,
+		Logger:           g.logger(os.Stderr),
+		Progress:         progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "gen: wrote %s\n", *out)
+	}
+	return nil
+}
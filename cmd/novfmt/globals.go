@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+type globalFlags struct {
+	verbose     bool
+	veryVerbose bool
+	quiet       bool
+	logJSON     bool
+	// headings is the chapter heading detector file shared by every
+	// command that looks for chapters.
+	headings string
+	// output is "json" for JSON Lines events on stdout, "text" otherwise.
+	output string
+	// errorsJSON reports a failure as a JSON object on stderr.
+	errorsJSON bool
+	// maxMemory is the -max-mem limit in bytes, or 0.
+	maxMemory int64
+	// json backs every command's -json flag; -output json sets it too.
+	json bool
+	// command is the command running, for events.
+	command string
+	events  *eventStream
+	// library is the index file that records every book a command reads
+	// or writes; empty turns recording off.
+	library string
+	// flags is the flag set of the top-level command, whose arguments and
+	// -out name the books to record.
+	flags *flag.FlagSet
+	// inputs, when set, replaces the positional arguments as the books a
+	// command read, for commands that also take them from -dir or -list.
+	inputs []string
+	// cacheDir holds downloaded URL inputs; empty means the default under
+	// the user's cache directory.
+	cacheDir string
+	// offline serves URL inputs from the cache without contacting the
+	// server.
+	offline bool
+	// limits are the -max-extract, -max-files and -max-ratio limits on
+	// unpacking books. The Env main builds points at them, so flags given
+	// after the command name apply too.
+	limits epub.ExtractLimits
+}
+
+// register adds the global flags to fs so they can also be given after the
+// command name. Current values are used as defaults so flags parsed before
+// the command are not reset.
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&g.verbose, "v", g.verbose, "")
+	fs.BoolVar(&g.veryVerbose, "vv", g.veryVerbose, "")
+	fs.BoolVar(&g.quiet, "quiet", g.quiet, "")
+	fs.BoolVar(&g.logJSON, "log-json", g.logJSON, "")
+	fs.StringVar(&g.headings, "headings", g.headings, "")
+	fs.StringVar(&g.library, "library", g.library, "")
+	fs.StringVar(&g.cacheDir, "cache-dir", g.cacheDir, "")
+	fs.BoolVar(&g.offline, "offline", g.offline, "")
+	if g.flags == nil {
+		g.flags = fs
+	}
+	fs.Func("output", "", func(s string) error {
+		switch s {
+		case "text":
+		case "json":
+			g.json = true
+		default:
+			return fmt.Errorf("-output must be text or json, not %q", s)
+		}
+		g.output = s
+		return nil
+	})
+	fs.Func("errors", "", func(s string) error {
+		switch s {
+		case "text", "json":
+		default:
+			return fmt.Errorf("-errors must be text or json, not %q", s)
+		}
+		g.errorsJSON = s == "json"
+		return nil
+	})
+	fs.Func("max-mem", "", func(s string) error {
+		n, err := epub.ParseByteSize(s)
+		if err != nil {
+			return err
+		}
+		g.maxMemory = n
+		debug.SetMemoryLimit(n)
+		return nil
+	})
+	fs.Func("max-extract", "", func(s string) error {
+		n, err := epub.ParseByteSize(s)
+		if err != nil {
+			return err
+		}
+		g.limits.MaxSize = n
+		return nil
+	})
+	fs.Func("max-files", "", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("-max-files must be a count, not %q", s)
+		}
+		g.limits.MaxFiles = n
+		return nil
+	})
+	fs.Func("max-ratio", "", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("-max-ratio must be a whole number, not %q", s)
+		}
+		g.limits.MaxRatio = n
+		return nil
+	})
+}
+
+// jsonFlag registers a command's -json flag. -output json turns it on for
+// every command, so each prints its result the way -json does.
+func (g *globalFlags) jsonFlag(fs *flag.FlagSet) *bool {
+	fs.BoolVar(&g.json, "json", g.json, "")
+	return &g.json
+}
+
+// jsonLines reports whether -output json is in effect.
+func (g *globalFlags) jsonLines() bool { return g.output == "json" }
+
+func (g *globalFlags) stream() *eventStream {
+	if g.events == nil {
+		g.events = &eventStream{w: os.Stdout}
+	}
+	return g.events
+}
+
+// printJSON prints a command's result: indented on stdout, or as a result
+// event followed by one event per changed file with -output json.
+func (g *globalFlags) printJSON(v any) error {
+	if g.jsonLines() {
+		return g.stream().result(g.command, v)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// headingDetector loads the -headings file, or returns the default
+// detector when none was given.
+func (g *globalFlags) headingDetector() (epub.HeadingDetector, error) {
+	if g.headings == "" {
+		return epub.HeadingDetector{}, nil
+	}
+	return epub.LoadHeadingDetector(g.headings)
+}
+
+// parseGlobalFlags consumes global flags that precede the command name and
+// returns the remaining arguments.
+func parseGlobalFlags(args []string) (*globalFlags, []string, error) {
+	g := &globalFlags{library: os.Getenv("NOVFMT_LIBRARY"), limits: epub.DefaultExtractLimits}
+	fs := flag.NewFlagSet("novfmt", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	g.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	return g, fs.Args(), nil
+}
+
+func (g *globalFlags) level() slog.Level {
+	switch {
+	case g.quiet:
+		return slog.LevelError
+	case g.veryVerbose:
+		return slog.LevelDebug
+	case g.verbose:
+		return slog.LevelInfo
+	default:
+		return slog.LevelWarn
+	}
+}
+
+func (g *globalFlags) logger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: g.level()}
+	if g.jsonLines() {
+		return slog.New(slog.NewJSONHandler(g.stream(), opts)).With("event", "log")
+	}
+	if g.logJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageHashes = `Hashes:
+  novfmt hashes [options] <book.epub>
+  novfmt hashes [options] <old.epub> <new.epub>
+
+  Per-chapter SHA-256 hashes of the spine documents. With one book, prints
+  its hashes (embedded ones when present). With two, lists the chapters
+  added, removed or changed between them. Once a book carries embedded
+  hashes, every novfmt command that saves it refreshes them.
+
+  -embed                write the hashes into the book (META-INF sidecar)
+  -verify               fail if the embedded hashes don't match the content
+  -o, -out <path>       with -embed, write to a new file instead of in place
+  -json                 print hashes or changes as JSON
+`
+
+func runHashes(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("hashes", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageHashes) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	embed := fs.Bool("embed", false, "")
+	verify := fs.Bool("verify", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case fs.NArg() == 2:
+		if *embed || *verify {
+			return usageErrorf("-embed and -verify take a single EPUB path")
+		}
+		return diffHashes(ctx, g, fs.Arg(0), fs.Arg(1))
+	case fs.NArg() != 1:
+		return usageErrorf("hashes requires one EPUB path, or two to compare")
+	case *embed && *verify:
+		return usageErrorf("-embed and -verify cannot be combined")
+	case *out != "" && !*embed:
+		return usageErrorf("-out requires -embed")
+	}
+
+	if *embed {
+		progress, done := g.progressFunc([]string{epub.StageZip}, []float64{1})
+		hashes, cs, err := epub.EmbedChapterHashes(ctx, fs.Arg(0), epub.ChapterHashOptions{
+			OutPath:  *out,
+			Logger:   g.logger(os.Stderr),
+			Progress: progress,
+		})
+		done()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return g.printJSON(struct {
+				*epub.ChapterHashes
+				Changeset epub.Changeset `json:"changeset"`
+			}{hashes, cs})
+		}
+		if !g.quiet {
+			fmt.Fprintf(os.Stderr, "hashes: embedded %d chapter hashes; %s\n", len(hashes.Chapters), describeChangeset(cs))
+		}
+		return nil
+	}
+
+	embedded, actual, err := epub.BookChapterHashes(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *verify {
+		if embedded == nil {
+			return checkError{epub.ErrNoChapterHashes}
+		}
+		changes := epub.DiffChapterHashes(embedded, actual)
+		if err := printHashChanges(g, changes); err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			return checkFailedf("hashes: %d chapters do not match the embedded hashes", len(changes))
+		}
+		if !g.quiet {
+			fmt.Fprintf(os.Stderr, "hashes: %d chapters verified\n", len(actual.Chapters))
+		}
+		return nil
+	}
+
+	hashes := actual
+	if embedded != nil {
+		hashes = embedded
+	} else if !g.quiet {
+		fmt.Fprintln(os.Stderr, "hashes: book has no embedded hashes; showing computed ones")
+	}
+	if *asJSON {
+		return g.printJSON(hashes)
+	}
+	for _, c := range hashes.Chapters {
+		fmt.Printf("%s  %s\n", c.SHA256, c.Href)
+	}
+	return nil
+}
+
+// diffHashes compares two books by their embedded hashes, falling back to
+// hashes computed from content for a book without them.
+func diffHashes(ctx context.Context, g *globalFlags, oldPath, newPath string) error {
+	load := func(path string) (*epub.ChapterHashes, error) {
+		embedded, actual, err := epub.BookChapterHashes(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if embedded != nil {
+			return embedded, nil
+		}
+		return actual, nil
+	}
+	oldHashes, err := load(oldPath)
+	if err != nil {
+		return err
+	}
+	newHashes, err := load(newPath)
+	if err != nil {
+		return err
+	}
+	return printHashChanges(g, epub.DiffChapterHashes(oldHashes, newHashes))
+}
+
+func printHashChanges(g *globalFlags, changes []epub.ChapterHashChange) error {
+	if g.json {
+		if changes == nil {
+			changes = []epub.ChapterHashChange{}
+		}
+		return g.printJSON(changes)
+	}
+	for _, c := range changes {
+		fmt.Printf("%-8s %s\n", c.Status, c.Href)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageImages = `Images:
+  novfmt images [options] <book.epub>
+
+  Re-encodes PNG and JPEG images as WebP or AVIF to make the book smaller
+  and updates every reference to them. Images that would not get smaller
+  are left alone. Encoding uses the cwebp and avifenc tools, which must be
+  on PATH. -compat decides what happens to the originals:
+    modern   WebP replaces them (a core EPUB 3.3 format); AVIF keeps them
+             as manifest fallbacks
+    kobo     keeps every original as a fallback and leaves the cover alone
+    kindle   converts nothing, since Kindle rejects WebP and AVIF, and
+             lists images already in those formats without a fallback
+  Without -out the input file is modified in place.
+
+  -format <webp|avif>   target format (default: webp)
+  -compat <target>      modern, kobo or kindle (default: modern)
+  -quality <1-100>      encoder quality (default: 80)
+  -json                 print the per-image report as JSON
+  -dry-run              report sizes without writing anything
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runImages(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("images", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageImages) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	format := fs.String("format", epub.ImageWebP, "")
+	compat := fs.String("compat", epub.CompatModern, "")
+	quality := fs.Int("quality", 0, "")
+	asJSON := g.jsonFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("images requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.8, 0.2},
+	)
+	report, err := epub.ConvertImages(ctx, fs.Arg(0), epub.ImageConvertOptions{
+		Format:   *format,
+		Compat:   *compat,
+		Quality:  *quality,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(report)
+	}
+	if *dryRun || g.verbose || g.veryVerbose || *compat == epub.CompatKindle {
+		for _, img := range report.Images {
+			switch {
+			case img.Skipped != "":
+				fmt.Printf("skip  %s: %s\n", img.Href, img.Skipped)
+			case img.Fallback:
+				fmt.Printf("add   %s -> %s (%d -> %d bytes, original kept)\n", img.Href, img.NewHref, img.Before, img.After)
+			default:
+				fmt.Printf("conv  %s -> %s (%d -> %d bytes)\n", img.Href, img.NewHref, img.Before, img.After)
+			}
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "images: converted %d images, %d -> %d bytes; %s\n", report.Converted, report.BytesBefore, report.BytesAfter, describeChangeset(report.Changeset))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageInvisible = `Invisible:
+  novfmt invisible [options] <book.epub>
+
+  Counts characters that show nothing but break search, text-to-speech
+  and line breaking when they leak from source documents, per file:
+    shy                  soft hyphen (U+00AD)
+    zwsp, zwnj, zwj, wj  zero-width space, non-joiner, joiner, word joiner
+    bom                  byte order mark inside the text
+    bidi                 directional marks: lrm, rlm, alm, lre, rle, pdf,
+                         lro, rlo, lri, rli, fsi, pdi
+  Character references such as &shy; and &#x200B; count too. Scripts,
+  styles and the nav document are left alone, as is a joiner between two
+  emoji. With -strip the characters are removed; without -out the input
+  file is then modified in place.
+
+  -strip                remove the characters instead of only counting them
+  -keep <name>          leave a character alone: a name above, bidi, or a
+                        code point such as U+200C; repeatable or
+                        comma-separated
+  -dry-run              with -strip, report without writing anything
+  -json                 print the counts and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runInvisible(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("invisible", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageInvisible) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	strip := fs.Bool("strip", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	var keep multiValue
+	fs.Var(&keep, "keep", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("invisible requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	report, err := epub.AuditInvisible(ctx, fs.Arg(0), epub.InvisibleOptions{
+		Strip:    *strip,
+		Keep:     *splitValues(keep),
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(report)
+	}
+	for _, f := range report.Files {
+		fmt.Printf("%s\t%d\t%s\n", f.Href, f.Total, epub.FormatInvisibleCounts(f.Counts))
+	}
+	if !g.quiet {
+		verb := "found"
+		if *strip {
+			verb = "stripped"
+		}
+		summary := fmt.Sprintf("invisible: %s %d characters across %d files", verb, report.Total, len(report.Files))
+		if report.Total > 0 {
+			summary += " (" + epub.FormatInvisibleCounts(report.Counts) + ")"
+		}
+		if *strip {
+			summary += "; " + describeChangeset(report.Changeset)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	return nil
+}
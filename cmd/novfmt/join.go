@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageJoinChapters = `Join-chapters:
+  novfmt join-chapters [options] <book.epub>
+
+  Merges runs of small spine documents into one file per table of contents
+  entry, for books converted one page per file: readers turn pages much
+  faster within a file than between files. A run starts at a document the
+  table of contents (the nav, or the NCX in EPUB 2 books) points at and
+  takes the documents after it up to the next one. Documents before the
+  first entry are left alone. The first document of a run keeps its name;
+  links and table of contents entries pointing at the others are updated.
+  Without -out the input file is modified in place.
+
+  -depth <n>            table of contents levels that start a chapter
+                        (default: 1, top-level entries only)
+  -max-size <size>      start a new file instead of growing a chapter past
+                        this size (default: 300KiB)
+  -dry-run              list the chapters without writing anything
+  -json                 print the chapters and which files changed as JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runJoinChapters(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("join-chapters", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageJoinChapters) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	depth := fs.Int("depth", 1, "")
+	maxSize := fs.String("max-size", "300KiB", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("join-chapters requires exactly one EPUB path")
+	}
+	limit, err := epub.ParseByteSize(*maxSize)
+	if err != nil {
+		return usageErrorf("-max-size: %w", err)
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	res, err := epub.JoinChapters(ctx, fs.Arg(0), epub.JoinOptions{
+		Depth:    *depth,
+		MaxSize:  limit,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(res)
+	}
+	if *dryRun {
+		for _, j := range res.Joins {
+			fmt.Printf("%s  %d files, %s\n", j.Href, len(j.Parts), epub.FormatByteSize(j.Size))
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "join-chapters: %d spine items -> %d; %s\n", res.SpineBefore, res.SpineAfter, describeChangeset(res.Changeset))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageLang = `Lang:
+  novfmt lang [options] <book.epub>
+
+  Detects the language of every paragraph in the spine and tags those that
+  differ from the language they inherit (the document's, or the book's
+  dc:language) with xml:lang and lang, e.g. Japanese poems in an English
+  novel. Reading systems use the tags to pick dictionaries, hyphenation and
+  text-to-speech voices. Blocks that already carry a language are left
+  alone. Without -out the input file is modified in place.
+
+  Detection is by script (kana, Hangul, Cyrillic, ...) and, for Latin text,
+  by common words of en, fr, de, es, it, pt and nl. Han text without kana
+  could be Chinese or Japanese and only gets half the confidence.
+
+  The book's dominant language is always reported. -fix also corrects
+  declared languages the text contradicts: dc:language and the package's
+  xml:lang are set to the dominant language, each document's html element
+  to its own, and blocks with a wrong lang (lang="en" on Japanese text) are
+  retagged.
+
+  -threshold <0-1>      confidence needed to tag a block (default: 0.8)
+  -fix                  also correct wrongly declared languages
+  -report               list every detected block, tagged or not
+  -json                 print the report as JSON
+  -dry-run              report without writing anything
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runLang(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("lang", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageLang) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	threshold := fs.Float64("threshold", 0, "")
+	report := fs.Bool("report", false, "")
+	asJSON := g.jsonFlag(fs)
+	fix := fs.Bool("fix", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("lang requires exactly one EPUB path")
+	}
+	if *threshold < 0 || *threshold > 1 {
+		return usageErrorf("-threshold must be between 0 and 1")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	res, err := epub.TagLanguages(ctx, fs.Arg(0), epub.LanguageTagOptions{
+		Threshold: *threshold,
+		Fix:       *fix,
+		OutPath:   *out,
+		DryRun:    *dryRun,
+		Logger:    g.logger(os.Stderr),
+		Progress:  progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *asJSON:
+		if err := g.printJSON(res); err != nil {
+			return err
+		}
+	case *report || *dryRun:
+		for _, s := range res.Segments {
+			mark := "skip"
+			if s.Tagged {
+				mark = "tag "
+			}
+			fmt.Printf("%s %-5s %s  %s  %s\n", mark, s.Lang, strconv.FormatFloat(s.Confidence, 'f', 2, 64), s.Href, s.Excerpt)
+		}
+		for _, f := range res.Fixes {
+			where := f.Href
+			if where == "" {
+				where = "(package)"
+			}
+			fmt.Printf("fix  %-5s %s <%s> was %q\n", f.To, where, f.Element, f.From)
+		}
+	}
+	if !g.quiet {
+		dominant := res.Dominant
+		if dominant == "" {
+			dominant = "mixed"
+		}
+		fmt.Fprintf(os.Stderr, "lang: mostly %s (%.0f%%); tagged %d blocks across %d files (%d below threshold), fixed %d declarations; %s\n",
+			dominant, res.DominantShare*100, res.Tagged, res.FilesChanged, len(res.Segments)-res.Tagged, len(res.Fixes), describeChangeset(res.Changeset))
+	}
+	return nil
+}
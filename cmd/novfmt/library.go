@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageLibrary = `Ls / find:
+  novfmt -library <file> ls [options]
+  novfmt -library <file> find [options]
+
+  With the global -library option (or $NOVFMT_LIBRARY), every command
+  records the books it reads and writes in an index file: their metadata,
+  SHA-256 and size, and a history of which command read or wrote them and
+  from which books. ls lists every book in the index; find lists those
+  matching all the given filters. Text filters match case-insensitively
+  anywhere in the value. Books that are no longer on disk are marked
+  "missing".
+
+  -title <text>         find: title contains text
+  -author <name>        find: an author contains name
+  -series <name>        find: the series, or the series of a book it was
+                        made from (so an omnibus shows up), contains name
+  -id <text>            find: identifier contains text
+  -sha256 <hex>         find: checksum starts with hex
+  -made-by <command>    find: written by this command (e.g. merge)
+  -read-by <command>    find: read by this command
+  -json                 print the matching books and their history as JSON
+`
+
+func runLs(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageLibrary) }
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("ls takes no arguments")
+	}
+	return listLibrary(g, epub.LibraryQuery{}, *asJSON)
+}
+
+func runFind(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageLibrary) }
+
+	var q epub.LibraryQuery
+	fs.StringVar(&q.Title, "title", "", "")
+	fs.StringVar(&q.Author, "author", "", "")
+	fs.StringVar(&q.Series, "series", "", "")
+	fs.StringVar(&q.Identifier, "id", "", "")
+	fs.StringVar(&q.SHA256, "sha256", "", "")
+	fs.StringVar(&q.MadeBy, "made-by", "", "")
+	fs.StringVar(&q.ReadBy, "read-by", "", "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("find takes no arguments; use -title, -series and the other filters")
+	}
+	if q == (epub.LibraryQuery{}) {
+		return usageErrorf("find requires at least one filter (use ls to list everything)")
+	}
+	return listLibrary(g, q, *asJSON)
+}
+
+func listLibrary(g *globalFlags, q epub.LibraryQuery, asJSON bool) error {
+	if g.library == "" {
+		return usageErrorf("%s requires the global -library option or $NOVFMT_LIBRARY", g.command)
+	}
+	lib, err := epub.OpenLibrary(g.library)
+	if err != nil {
+		return err
+	}
+	books := lib.Find(q)
+	if asJSON {
+		return g.printJSON(books)
+	}
+	for _, b := range books {
+		line := b.Title
+		if len(b.Authors) > 0 {
+			line += " — " + strings.Join(b.Authors, ", ")
+		}
+		if b.Series != "" {
+			line += fmt.Sprintf("  [%s", b.Series)
+			if b.SeriesIndex != "" {
+				line += " #" + b.SeriesIndex
+			}
+			line += "]"
+		}
+		fmt.Println(line)
+		state := epub.FormatByteSize(b.Size)
+		if sum := b.SHA256; sum != "" {
+			state += ", " + sum[:min(len(sum), 12)]
+		}
+		if _, err := os.Stat(b.Path); err != nil {
+			state += ", missing"
+		}
+		fmt.Printf("    %s  (%s)\n", b.Path, state)
+		if n := len(b.History); n > 0 {
+			last := b.History[n-1]
+			fmt.Printf("    last %s by %s, %s\n", last.Role, last.Command, last.Time.Local().Format("2006-01-02 15:04"))
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "%s: %d of %d books\n", g.command, len(books), len(lib.Books))
+	}
+	return nil
+}
+
+// bookState is a book named on the command line as it was before the
+// command ran.
+type bookState struct {
+	size int64
+	mod  time.Time
+	sum  string
+}
+
+// snapshotBooks records the EPUB files among args, so that books the
+// command edits in place are told apart from those it only reads.
+func snapshotBooks(ctx context.Context, args []string) map[string]bookState {
+	states := map[string]bookState{}
+	for _, a := range args {
+		if !isEPUBPath(a) {
+			continue
+		}
+		abs, err := filepath.Abs(a)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(abs)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		sum, err := epub.HashFile(ctx, abs)
+		if err != nil {
+			continue
+		}
+		states[abs] = bookState{size: info.Size(), mod: info.ModTime(), sum: sum}
+	}
+	return states
+}
+
+// recordLibrary adds the books the command just ran on to the -library
+// index. The command read its positional EPUB arguments (or g.inputs) and
+// wrote -out along with any of them that changed on disk.
+func (g *globalFlags) recordLibrary(ctx context.Context, before map[string]bookState, start time.Time) error {
+	if g.flags == nil {
+		return nil
+	}
+	inputs := g.inputs
+	if inputs == nil {
+		for _, a := range g.flags.Args() {
+			if isEPUBPath(a) {
+				inputs = append(inputs, a)
+			}
+		}
+	}
+	run := epub.LibraryRun{Command: g.command, Inputs: inputs, Before: map[string]string{}}
+	for _, p := range inputs {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if st, ok := before[abs]; ok && changedSince(abs, st) {
+			run.Outputs = append(run.Outputs, p)
+			run.Before[abs] = st.sum
+		}
+	}
+	if f := g.flags.Lookup("out"); f != nil && isEPUBPath(f.Value.String()) {
+		out := f.Value.String()
+		abs, err := filepath.Abs(out)
+		if err != nil {
+			return err
+		}
+		st, ok := before[abs]
+		info, err := os.Stat(abs)
+		switch {
+		case err != nil:
+		case ok && changedSince(abs, st):
+			run.Outputs = append(run.Outputs, out)
+		case !ok && !info.ModTime().Before(start.Truncate(time.Second)):
+			run.Outputs = append(run.Outputs, out)
+		}
+	}
+	if len(run.Inputs) == 0 && len(run.Outputs) == 0 {
+		return nil
+	}
+
+	return epub.UpdateLibrary(ctx, g.library, func(lib *epub.Library) error {
+		return lib.Record(ctx, run)
+	})
+}
+
+func changedSince(abs string, st bookState) bool {
+	info, err := os.Stat(abs)
+	return err == nil && (info.Size() != st.size || !info.ModTime().Equal(st.mod))
+}
+
+func isEPUBPath(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".epub")
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -14,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/kototok903/novfmt/internal/epub"
 )
@@ -21,115 +24,632 @@ import (
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	// The first signal cancels the command, which then removes its temp
+	// files and partial output; a second one kills novfmt outright.
+	context.AfterFunc(ctx, cancel)
 
-	if len(os.Args) < 2 {
+	g, args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		if err == flag.ErrHelp {
+			printUsage()
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
+	ctx = epub.WithEnv(ctx, epub.Env{
+		Storages: map[string]epub.Storage{
+			"s3": epub.NewS3Storage(epub.S3ConfigFromEnv()),
+		},
+		Limits: &g.limits,
+	})
 
-	var err error
-	switch os.Args[1] {
-	case "merge":
-		err = runMerge(ctx, os.Args[2:])
-	case "edit-meta":
-		err = runEditMeta(ctx, os.Args[2:])
-	case "rewrite":
-		err = runRewrite(ctx, os.Args[2:])
+	if len(args) < 1 {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	switch args[0] {
 	case "help", "-h", "--help":
 		printUsage()
 		return
-	default:
-		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
-		printUsage()
-		os.Exit(1)
 	}
-
+	err = runCommand(ctx, g, args[0], args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		err = nil
+	}
+	var info errorInfo
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		info = classifyError(err)
 	}
+	if g.jsonLines() {
+		ev := doneEvent{Event: "done", Command: args[0], OK: err == nil}
+		if err != nil {
+			ev.Error, ev.ErrorClass, ev.ExitCode = err.Error(), info.Class, info.ExitCode
+		}
+		g.stream().emit(ev)
+	}
+	if err == nil {
+		return
+	}
+	if g.errorsJSON {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Error errorInfo `json:"error"`
+		}{info})
+	} else {
+		fmt.Fprintln(os.Stderr, info.Message)
+		if errors.Is(err, errUnknownCommand) {
+			printUsage()
+		}
+	}
+	os.Exit(info.ExitCode)
+}
+
+var errUnknownCommand = errors.New("unknown command")
+
+// runCommand runs one subcommand; name is the command and args follow it.
+func runCommand(ctx context.Context, g *globalFlags, name string, args []string) error {
+	outer := g.command
+	g.command = name
+	defer func() { g.command = outer }()
+	record := outer == "" && g.library != "" && name != "ls" && name != "find"
+	var before map[string]bookState
+	if record {
+		g.flags, g.inputs = nil, nil
+		before = snapshotBooks(ctx, args)
+	}
+	start := time.Now()
+	err := dispatchCommand(ctx, g, name, args)
+	if record && err == nil {
+		if rerr := g.recordLibrary(ctx, before, start); rerr != nil {
+			g.logger(os.Stderr).Warn("library not updated", "path", g.library, "err", rerr)
+		}
+	}
+	return err
+}
+
+func dispatchCommand(ctx context.Context, g *globalFlags, name string, args []string) error {
+	switch name {
+	case "merge":
+		return runMerge(ctx, g, args)
+	case "edit-meta":
+		return runEditMeta(ctx, g, args)
+	case "fetch-meta":
+		return runFetchMeta(ctx, g, args)
+	case "rewrite":
+		return runRewrite(ctx, g, args)
+	case "fonts":
+		return runFonts(ctx, g, args)
+	case "toc":
+		return runTOC(ctx, g, args)
+	case "rules":
+		return runRules(ctx, g, args)
+	case "typo":
+		return runTypo(ctx, g, args)
+	case "quotes":
+		return runQuotes(ctx, g, args)
+	case "cleanup":
+		return runCleanup(ctx, g, args)
+	case "notes":
+		return runNotes(ctx, g, args)
+	case "invisible":
+		return runInvisible(ctx, g, args)
+	case "duration":
+		return runDuration(ctx, g, args)
+	case "gate":
+		return runGate(ctx, g, args)
+	case "hashes":
+		return runHashes(ctx, g, args)
+	case "verify":
+		return runVerify(ctx, g, args)
+	case "images":
+		return runImages(ctx, g, args)
+	case "banner":
+		return runBanner(ctx, g, args)
+	case "restyle":
+		return runRestyle(ctx, g, args)
+	case "writing-mode":
+		return runWritingMode(ctx, g, args)
+	case "cfi":
+		return runCFI(ctx, g, args)
+	case "text":
+		return runText(ctx, g, args)
+	case "transform":
+		return runTransform(ctx, g, args)
+	case "lang":
+		return runLang(ctx, g, args)
+	case "test":
+		return runTest(ctx, g, args)
+	case "gen":
+		return runGen(ctx, g, args)
+	case "gen-cover":
+		return runGenCover(ctx, g, args)
+	case "a11y-check":
+		return runA11yCheck(ctx, g, args)
+	case "check":
+		return runCheck(ctx, g, args)
+	case "validate":
+		return runValidate(ctx, g, args)
+	case "unpack":
+		return runUnpack(ctx, g, args)
+	case "pack":
+		return runPack(ctx, g, args)
+	case "split-chapters":
+		return runSplitChapters(ctx, g, args)
+	case "join-chapters":
+		return runJoinChapters(ctx, g, args)
+	case "opds":
+		return runOPDS(ctx, g, args)
+	case "ls":
+		return runLs(ctx, g, args)
+	case "find":
+		return runFind(ctx, g, args)
+	}
+	return fmt.Errorf("%w %q", errUnknownCommand, name)
 }
 
 const usageHeader = `novfmt — lightweight CLI for EPUB maintenance
 
 Usage:
-  novfmt <command> [options] <file(s)>
+  novfmt [global options] <command> [options] <file(s)>
   novfmt <command> -h        show help for a command
 
+Global options (also accepted after the command name):
+  -v                    verbose: log per-stage progress
+  -vv                   very verbose: also log per-file details
+  -quiet                only log errors; suppress summaries and progress bars
+  -log-json             emit log records as JSON lines on stderr
+  -output <text|json>   json: write events as JSON Lines on stdout (log
+                        records, progress, the command's result as -json
+                        gives it, one event per changed file, and a final
+                        done event); human-readable text stays on stderr
+  -errors <text|json>   json: report a failure on stderr as one JSON object,
+                        {"error": {"class", "exit_code", "message", "path"}}
+  -max-mem <size>       soft memory limit (e.g. 512MiB): the garbage collector
+                        works harder as it nears, and rewrite processes fewer
+                        documents at once so that they fit
+  -max-extract <size>   refuse a book that unpacks to more than this
+                        (default 4GiB; 0 for no limit)
+  -max-files <n>        refuse a book with more entries (default 50000)
+  -max-ratio <n>        refuse a book with an entry over 1MiB that expands
+                        more than n times its compressed size (default 200)
+  -library <file>       record every book read or written (metadata,
+                        checksum, and which command read or wrote it) in this
+                        index file, for ls and find (default: $NOVFMT_LIBRARY)
+  -cache-dir <dir>      where http(s) URL inputs of merge, edit-meta, check
+                        and validate are downloaded (default: novfmt/remote
+                        in the user cache directory); a cached book is
+                        downloaded again only when its ETag or modification
+                        time changed
+  -offline              use cached downloads of URL inputs without
+                        contacting the server; fail for one never downloaded
+  -headings <file>      chapter heading detector (JSON) used by every command
+                        that looks for chapters, such as toc:
+                          {"selectors": ["h1", "p.chapter-title"],
+                           "match": "^(Chapter|Prologue|Epilogue)",
+                           "exclude": "^Contents$",
+                           "max_length": 80,
+                           "max_leading_text": 200,
+                           "first_per_document": true}
+                        selectors default to h1–h6; other elements count as
+                        top-level headings. max_length drops longer text;
+                        max_leading_text drops candidates with more body
+                        text before them in their document
+
 Commands:
   merge       combine multiple EPUB volumes into one
   edit-meta   view or modify EPUB metadata and navigation
+  fetch-meta  look a book up online and apply the chosen record
   rewrite     search/replace text inside an EPUB
+  fonts       report characters not covered by embedded fonts
+  toc         regenerate the table of contents from headings
+  rules       pack, unpack, or inspect shareable rewrite rule packs
+  typo        normalize quotes, dashes, ellipses and punctuation spacing
+  quotes      convert quotes and dashes between locale conventions
+  cleanup     remove runs of empty and &nbsp;-only paragraphs
+  notes       make footnotes pop-up notes or gather them as endnotes
+  invisible   audit or strip soft hyphens, zero-width and directional marks
+  duration    estimate narration time per chapter, optionally as metadata
+  gate        fail when a new build's text differs too much from the old one
+  hashes      embed, verify, or compare per-chapter content hashes
+  verify      check every file against an embedded checksum manifest
+  images      convert images to WebP or AVIF, keeping fallbacks as needed
+  restyle     strip publisher CSS and/or inject your own stylesheet
+  banner      add a header or footer, e.g. a credit line, to every chapter
+  writing-mode
+              convert between vertical and horizontal presentation
+  cfi         add stable block ids and resolve reading-position CFIs
+  text        export the book's text, with a choice of ruby handling
+  transform   run typo, ruby, scene-break and cleanup fixes as one chain
+  lang        tag paragraphs written in another language with xml:lang
+  test        run a pipeline over fixture EPUBs and compare with golden output
+  gen         write a synthetic EPUB for benchmarks and bug reports
+  gen-cover   render a title/author cover for a book that has none
+  a11y-check  audit alt text, languages, headings and landmarks, with a score
+  check       check a book against a reader's limits (kobo, kindle, ade, apple)
+  validate    check the book's structure; -fix repairs what it can
+  unpack      extract a book into a directory to edit by hand
+  pack        zip an unpacked book back up and validate it
+  split-chapters
+              split oversized chapter files for readers with size limits
+  join-chapters
+              merge page-sized files into one file per chapter
+  opds        write a static OPDS catalog of a directory of books
+  ls          list the books in the -library index
+  find        search the -library index by title, author, series and more
+
+Exit status:
+  0    success
+  1    any other failure
+  2    usage error: bad flags, arguments or option combinations
+  3    an input is not a valid EPUB (not a zip, no container or package)
+  4    an input is DRM-protected
+  5    a check failed (validate, pack, verify, gate, check, a11y-check,
+       hashes -verify, test)
+  6    reading or writing a file failed
+  130  canceled by Ctrl-C or SIGTERM
 `
 
 const usageMerge = `Merge:
   novfmt merge [options] <vol1.epub> <vol2.epub> [...]
 
   Requires at least 2 input volumes (from any combination of positional
-  args, -list, and -dir). Volumes are appended in the order given.
+  args, -list, and -dir), or 1 with -append. Volumes are appended in the
+  order given.
+  Every local link is checked afterwards. Links to a volume's own table of
+  contents, to matter -strip-matter dropped, or to a file with different
+  case are pointed at the file that replaces it; the rest are logged as
+  warnings.
 
   -o, -out <path>       output file path (default: merged.epub)
-  -t, -title <str>      title for the merged book (default: first volume's title)
+  -t, -title <str>      title for the merged book; may be a template using
+                        {series}, {first}, {last}, {count}, {title} and
+                        {author} (default: "{series} Vol. {first}-{last}" for a
+                        recognisable series, else the first volume's title)
   -lang <code>          language code, e.g. "en" (default: first volume's language)
   -c, -creator <name>   author credit; repeatable; replaces original creator lists
   -list <file>          text file with one volume path per line; blank lines and
                         lines starting with # are ignored; repeatable
   -dir <path>           directory to scan for .epub files, sorted numerically
-                        when filenames contain numbers; repeatable
+                        when filenames contain numbers; repeatable; an
+                        s3://bucket/prefix/ lists objects in S3 storage
+  -layout <template>    where each volume's files go (default:
+                        Volumes/v{v:04}/{orig}); placeholders: {v} (volume
+                        number, {v:02} zero-pads it), {orig} (path in the
+                        volume), {dir}, {name}, {base}, {ext}, and {type}
+                        (text, styles, images, fonts, audio, video, misc).
+                        E.g. vol{v:02}/{orig}, or v{v}/{name} to flatten
+                        each volume; links are rewritten to match
+  -title-pages          start each volume with a generated title page (title,
+                        publication date, cover thumbnail) linked from the nav
+  -insert-page <file.xhtml:position>
+                        add a page of your own, such as a dedication or a
+                        translator's credit, with the stylesheets and images
+                        it uses; position is front, after-cover,
+                        before-volume-N or end; repeatable
+  -strip-matter         drop title, half-title, copyright, imprint and colophon
+                        pages (by epub:type) from every volume but the first
+  -strip-type <type>    also drop pages with this epub:type (e.g. afterword);
+                        repeatable
+  -strip-file <regex>   also drop documents whose href matches; repeatable
+  -strip-nav <regex>    also drop documents whose table of contents entry
+                        matches (e.g. "^(Afterword|あとがき)$"); repeatable
+  -illustrations        gather colour plates and inserts (by file name and
+                        epub:type) under one "Illustrations" nav entry
+  -illustration-type <type>
+                        also gather pages with this epub:type; repeatable
+  -illustration-file <regex>
+                        also gather documents whose href matches; repeatable
+  -illustration-nav <regex>
+                        also gather documents whose table of contents entry
+                        matches (e.g. "^(Colour|口絵)"); repeatable
+  -illustrations-at <where>
+                        book (one section at the end of the book, default)
+                        or volume (at the start of each volume, after its
+                        cover)
+  -mixed-layout         allow merging fixed-layout (pre-paginated) volumes with
+                        reflowable ones: the book is reflowable and the
+                        fixed-layout pages keep their layout through spine
+                        overrides, which not every reader supports
+  -non-linear <policy>  what to do with spine items marked linear="no" (pages
+                        readers skip, such as inserts or advertisements): keep
+                        (default), linear (make them part of the reading
+                        order) or drop
+  -share-resources      store stylesheets, images and fonts that volumes keep at
+                        the same path only once
+  -on-conflict <action> what -share-resources does when those files differ:
+                        rename (keep both, default), keep-first, or fail
+  -dedupe-css           keep one copy of stylesheets identical across volumes
+                        and warn about selectors the rest style differently
+  -stylesheet <file>    replace every volume's stylesheets with this CSS file
+  -strip-css            strip publisher CSS except allowlisted properties
+  -keep-css <prop>      property that survives -strip-css; repeatable
+                        (see restyle for the default list)
+  -user-css <file>      reading stylesheet linked from every chapter
+  -writing-mode <mode>  convert all volumes to vertical or horizontal
+                        presentation (see writing-mode)
+  -ruby <mode>          normalize ruby (furigana) across volumes: strip,
+                        paren or keep (see rewrite -ruby)
+  -chapter-hashes       embed per-chapter content hashes (see hashes)
+  -checksums            embed a SHA-256 manifest of every file (see verify)
+  -max-size <size>      fail when the output is larger (e.g. 300MB, 512MiB),
+                        listing its largest files; the output is removed
+  -shrink-to-fit        with -max-size, first store identical resources once,
+                        then re-encode JPEGs (and, at last, opaque PNGs) at
+                        falling quality until the book fits
+  -append <book>        add the volumes to <book>, an earlier merge, instead of
+                        merging everything again: their files are laid out
+                        after the existing ones (renamed where a path is
+                        taken), and the spine, table of contents, creators
+                        and sources are extended; without -out <book> is
+                        modified in place. -share-resources, -dedupe-css,
+                        -stylesheet, -strip-css, -user-css and -max-size
+                        need every volume and cannot be used
+  -incremental          skip the merge when the inputs, the options and the
+                        output are unchanged since the last -incremental
+                        merge to the same output, as recorded in
+                        <out>.novfmt-merge.json; adding, removing or editing
+                        a volume merges again; the output and the record
+                        must be local files
+  -state <file>         with -incremental, keep the record here instead
+  -dry-run              write nothing; print the volumes in merge order with
+                        their detected titles, the planned TOC, the resources
+                        stored once or renamed, the links fixed or left
+                        broken, and the projected output size
+  -json                 with -dry-run, print the plan as JSON
 `
 
 const usageEditMeta = `Edit-meta:
   novfmt edit-meta [options] <book.epub>
+  novfmt edit-meta -template <file> [-pattern <regex>] [options] <book.epub>... | -dir <path>
 
-  Without -out the input file is modified in place.
-  Can run in dump-only mode (just -dump-meta / -dump-nav, no edits).
+  Without -out the input file is modified in place. A book path of - reads
+  the book from stdin and writes it to stdout; -out - writes to stdout.
+  Can run in dump-only mode (just -dump-meta / -dump-nav / -dump-toc, no edits).
 
-  -title <str>          set primary title
+  -title <str>          set primary title (the main title when titles are typed)
+  -subtitle <str>       set the subtitle; "" removes it
   -lang <code>          set language code
-  -identifier <str>     set primary identifier (e.g. ISBN, UUID)
+  -identifier <str>     set the unique identifier (e.g. ISBN, UUID); a bare ISBN
+                        or UUID is written as a urn:isbn: or urn:uuid: URN
+  -new-uuid             give the book a fresh urn:uuid unique identifier
+  -add-identifier <id>  add a further dc:identifier; repeatable
+  -remove-identifier <scheme|id>
+                        remove the identifiers of a scheme (isbn, issn, uuid,
+                        doi, urn, uri) or one identifier; repeatable
   -description <str>    set description text
-  -creator <name>       author credit; repeatable; replaces existing creator list
+  -pubdate <date>       set the publication date (dc:date), e.g. 2023-05-01 or
+                        2023; "" removes it. In EPUB 2 books only the date with
+                        opf:event="publication" changes
+  -creator <name>       creator credit; repeatable; replaces existing creator list;
+                        "Name|role|File-as" adds a MARC relator role (aut, ill,
+                        trl, ...) and sort name, e.g. "Jane Doe|ill|Doe, Jane"
+  -add-source <id>      append a dc:source (the identifier of a book this one was
+                        made from); repeatable
+  -remove-source <id>   remove a dc:source; repeatable
+  -list-sources         print the book's dc:source values and exit
+  -list-volumes         print the volumes a merged book was made from, with their
+                        source files and spine ranges, and exit (JSON with -json)
+  -a11y-preset <name>   fill in accessibility metadata for a kind of book:
+                        text-only (prose without images, audio or video)
+  -access-mode <mode>   schema:accessMode (e.g. textual, visual); repeatable
+  -access-mode-sufficient <modes>
+                        comma-separated set of modes that suffices to read the
+                        book (e.g. textual); repeatable
+  -a11y-feature <name>  schema:accessibilityFeature (e.g. tableOfContents);
+                        repeatable
+  -a11y-hazard <name>   schema:accessibilityHazard (e.g. none); repeatable
+  -a11y-summary <str>   schema:accessibilitySummary text
+  -rendition-layout <layout>
+                        reflowable or pre-paginated (fixed layout); "" removes
+                        the setting. EPUB 3 only, like the three below
+  -rendition-orientation <orientation>
+                        auto, landscape or portrait
+  -rendition-spread <spread>
+                        when to show two pages side by side: auto, both,
+                        landscape or none
+  -rendition-flow <flow>
+                        auto, paginated, scrolled-continuous or scrolled-doc
   -meta <file>          apply metadata patch from a JSON file
-                        (format: {"title":"...", "language":"...", "creators":["..."]})
+                        (format: {"title":"...", "language":"...", "creators":["..."],
+                        "pubdate":"...", "series":"...", "series_index":"..."})
+  -template <file>      apply a -meta style patch to each book given or found with
+                        -dir, filling in {file} (the file name without .epub),
+                        {dir} (its folder) and the named groups of -pattern
+  -pattern <regex>      match each file name without .epub with a regexp whose
+                        named groups, e.g. (?P<vol>\d+), fill in the template;
+                        books whose names do not match are skipped
+  -dir <path>           with -template, edit every .epub in a directory, or
+                        under an s3://bucket/prefix/; repeatable
   -dump-meta <file>     export current metadata snapshot as JSON to <file>
+  -import-meta <file>   apply title, authors, series, tags, comments, language
+                        and publisher from a Calibre metadata.opf; only the
+                        OPF is read, not metadata.db, so edits Calibre has not
+                        backed up to it yet and custom columns are missed
+  -export-meta <file>   write the same fields as a Calibre metadata.opf
   -nav <file>           replace the entire nav document from an XHTML file
   -dump-nav <file>      export current nav document (XHTML) to <file>
+  -dump-toc <file>      export the table of contents as JSON: a nested list of
+                        {"title", "href", "children"} entries, hrefs relative to
+                        the package document
+  -apply-toc <file>     replace the table of contents from such a JSON file,
+                        keeping the nav's landmarks and page-list; an NCX is
+                        rewritten to match
+  -drop-spine <idref>   remove a document from the spine, the manifest and the
+                        table of contents; repeatable
+  -move-spine <idref:position>
+                        move a spine item to position (1-based, start or end);
+                        repeatable
+  -insert-xhtml <file[:position]>
+                        add an XHTML file to the book and the spine (default:
+                        at the end); repeatable
+  -start <href|idref>   open the book at a spine document (href relative to the
+                        package document, optionally with #fragment): sets the
+                        bodymatter landmark and the EPUB 2 guide's text reference
+  -json                 print which files changed and whether the book was
+                        written as JSON
   -o, -out <path>       write result to a new file instead of editing in place
   -no-touch-modified    don't update the last-modified timestamp (dcterms:modified)
-
-  CLI flags override values from -meta when both are given.
+  -modified <time>      set dcterms:modified to a time such as 2023-05-01T00:00:00Z
+                        instead of now, even when nothing else changes
+
+  Each accessibility flag replaces all existing values of its property;
+  values are checked against the schema.org vocabularies. -a11y-preset
+  applies before the other accessibility flags, so they can adjust it.
+  CLI flags override values from -meta and -import-meta when both are
+  given; -export-meta sees the book before any edits. Calibre's metadata.db
+  is SQLite and cannot be read; use the metadata.opf Calibre keeps in each
+  book's folder instead. Spine edits
+  apply in command-line order; positions count the spine as it is then.
+  With -template each book is edited in place; the other metadata flags
+  apply to every book on top of the template.
 `
 
 const usageRewrite = `Rewrite:
   novfmt rewrite [options] <book.epub>
+  novfmt rewrite -test [options] [-sample <text>]... [-samples <file>]
 
   Without -out the input file is modified in place.
-  At least one of -find or -rules is required.
+  At least one of -find, -rules, -preset, -pack, -scene-breaks or -ruby is
+  required.
 
   -find <str>           literal string to search for (see -regex)
   -replace <str>        replacement text (default: empty string, i.e. delete matches)
-  -regex                treat -find as a Go regular expression
+  -regex                treat -find as a Go regular expression; -replace may
+                        use $1 and ${name}, and transform a group with
+                        ${name|upper}, ${name|lower}, ${name|title} or
+                        ${name|kana2romaji}
   -i, -ignore-case      make matching case-insensitive (default: case-sensitive)
-  -scope <s>            body, meta, or all — limit where rewrites apply (default: body)
+  -scope <s>            body, meta, all (body and meta), css (stylesheet
+                        declaration values) or svg (text of SVG images) —
+                        limit where rewrites apply (default: body)
   -selector <sel>       CSS-like selector to target elements (e.g. p, .note, p.chapter);
                         repeatable; applies to the -find/-replace rule
   -rules <file>         JSON file with an array of rule objects, each with:
-                        find, replace, regex, ignore_case, selectors
+                        id, find, replace, regex, ignore_case, selectors,
+                        scope (body, meta, all, css, svg or a comma-separated
+                        list; overrides -scope),
+                        files and exclude (globs of the files it applies
+                        to), chapters and skip_chapters (regexps of the
+                        table-of-contents labels of the chapters it applies
+                        to), priority (higher runs first) and stop (later
+                        rules leave the text it wrote alone); a rule with
+                        an action changes the elements its selectors match
+                        instead: remove, unwrap, wrap (in element, e.g.
+                        <div class="box"/>) or set-attribute (attribute,
+                        value), optionally only bare (attribute-less) or
+                        nested (inside the same element) ones
+  -preset <name>        apply built-in rules; repeatable. honorifics-strip
+                        drops -san, -kun, -sama and the like after names;
+                        honorifics-localize makes -san and -sama Mr./Ms. and
+                        Lord/Lady for the -names with a gender and drops the
+                        rest; names-eastern and names-western put the -names
+                        family name first or last; ellipsis turns ... into …;
+                        dashes turns --, ― and spaced em dashes into —
+  -names <file>         JSON array of {"given", "family", "gender"} names
+                        (gender m or f) for the name presets
+  -pack <file>          apply the rules, glossary and skip-selectors of a rule
+                        pack (see "novfmt rules")
+  -pack-version <x.y.z> fail unless the pack has exactly this version
+  -skip-selector <sel>  never rewrite text inside matching elements (e.g. rt,
+                        .no-edit); repeatable; added to the pack's list
+  -across-tags          let rules match text split by inline elements (em,
+                        span, a, ...) within a paragraph; a replacement goes
+                        into the text where its match starts, and an inline
+                        element left empty is dropped unless it has an id
+  -scene-breaks         replace scene separators (hr, *** / ◇◇◇ paragraphs,
+                        empty centered paragraphs) with one canonical marker;
+                        adjacent separators collapse into one
+  -scene-break-marker <xhtml>
+                        marker snippet (default: <hr class="scene-break"/>);
+                        implies -scene-breaks
+  -scene-break-pattern <regex>
+                        also treat paragraphs whose text matches as separators;
+                        repeatable; implies -scene-breaks
+  -ruby <mode>          convert ruby (furigana) before the rules run: strip
+                        (base text only), paren (漢字（かんじ）) or keep
+  -repair-html          parse documents that are not well-formed XHTML (bare
+                        &, unclosed tags) as HTML and write them back as
+                        XHTML instead of failing; the repaired files are
+                        listed
+  -test                 run the rules over sample text instead of a book and
+                        print what each rule did; with -test no EPUB is given
+  -sample <text>        sample text for -test; repeatable
+  -samples <file>       file of samples for -test: one per line, or a JSON
+                        array of {"text", "element", "file", "chapter",
+                        "expect"} objects, where element (e.g. p.note), file
+                        (e.g. ch01.xhtml) and chapter (a table-of-contents
+                        label) let selector, file and chapter rules apply and
+                        expect makes the command fail unless the rules
+                        produce exactly that text
   -dry-run              report match counts without writing any changes
+  -watch                dry-run, print each change and every rule's match
+                        count, then run again whenever the -rules file, the
+                        -pack or the book changes; stops on Ctrl-C
+  -report <file>        write a JSON report of every changed text run and the
+                        rules (id, pack, version, author) that changed it
+  -preview-web <addr>   serve a local web page (e.g. :8080, on 127.0.0.1 unless
+                        a host is given) showing proposed changes per file;
+                        only files approved there are written. Open the URL
+                        it prints: the page needs its session token
+  -json                 print the match counts and changeset as JSON
   -o, -out <path>       write result to a new file instead of editing in place
 `
 
 const usageExamples = `Examples:
   novfmt merge -o combined.epub vol1.epub vol2.epub vol3.epub
   novfmt merge -title "Full Series" -dir ./volumes -o series.epub
+  novfmt merge -dedupe-css -dir ./volumes -o series.epub
+  novfmt merge -dry-run -share-resources -dir ./volumes -o series.epub
+  novfmt merge -max-size 300MB -shrink-to-fit -dir ./volumes -o series.epub
+  novfmt merge -incremental -dir ./volumes -o series.epub
+  novfmt merge -append series.epub vol41.epub
+  novfmt merge -strip-matter -strip-nav "^Afterword$" -dir ./volumes -o series.epub
   novfmt edit-meta -title "New Title" -creator "Author" book.epub
   novfmt edit-meta -dump-meta meta.json book.epub
+  novfmt edit-meta -drop-spine tl-note -move-spine afterword:end book.epub
+  novfmt edit-meta -import-meta "Calibre Library/Author/Book (12)/metadata.opf" book.epub
+  novfmt edit-meta -template series.json -pattern '(?P<series>.+) v(?P<vol>\d+)' -dir ./volumes
+  novfmt fetch-meta -isbn 9781975300319 book.epub
   novfmt rewrite -find "oldname" -replace "newname" book.epub
   novfmt rewrite -rules fixes.json -dry-run book.epub
+  novfmt rewrite -scene-breaks -dry-run merged.epub
+  novfmt rules pack -version 1.2.0 ./series-rules
+  novfmt rewrite -pack series-rules-1.2.0.novrules -pack-version 1.2.0 book.epub
+  novfmt fonts -inject-fallback -o fixed.epub book.epub
+  novfmt typo -dry-run book.epub
+  novfmt quotes -from ja -to en -selector p.dialogue book.epub
+  novfmt transform -enable typo,ruby:strip,scene-breaks -o fixed.epub book.epub
+  novfmt lang -dry-run book.epub
+  novfmt test -spec pipeline.json -corpus ./fixtures -golden ./expected
+  novfmt gen -chapters 500 -words-per-chapter 2000 -images 50 -o synthetic.epub
+  novfmt gen-cover -bg "#1d2b53" -bg2 "#7e2553" book.epub
+  novfmt a11y-check -min-score 80 book.epub
+  novfmt check -profile kobo,kindle omnibus.epub
+  novfmt validate -fix book.epub
+  novfmt split-chapters -max-size 250KB webnovel.epub
+  novfmt join-chapters -depth 2 scanned.epub
+  novfmt opds -dir ~/books -title "Light novels"
+  novfmt -library ~/books/index.json merge -dir ./volumes -o series.epub
+  novfmt -library ~/books/index.json find -series "Saga" -made-by merge
+  novfmt cleanup -max-blank 0 book.epub
+  novfmt notes -endnotes -translator-notes book.epub
+  novfmt invisible -strip -keep shy,bidi book.epub
+  novfmt duration -wpm 150 -embed omnibus.epub
+  novfmt images -format webp -compat kobo book.epub
+  novfmt restyle -strip-css -user-css reading.css book.epub
+  novfmt writing-mode -mode vertical book.epub
+  novfmt toc -depth 2 -exclude "^(Contents|Copyright)$" book.epub
+  novfmt gate published.epub build.epub -max-changed-words 2%
+  novfmt hashes published.epub build.epub
+  novfmt text -ruby paren -o book.txt book.epub
+  novfmt cfi resolve book.epub "epubcfi(/6/4!/4/10/1:12)"
+  novfmt -v merge -dir ./volumes -o series.epub
 `
 
 func printUsage() {
-	fmt.Fprint(os.Stderr, usageHeader+"\n"+usageMerge+"\n"+usageEditMeta+"\n"+usageRewrite+"\n"+usageExamples)
+	fmt.Fprint(os.Stderr, usageHeader+"\n"+usageMerge+"\n"+usageEditMeta+"\n"+usageFetchMeta+"\n"+usageRewrite+"\n"+usageFonts+"\n"+usageTOC+"\n"+usageRules+"\n"+usageTypo+"\n"+usageQuotes+"\n"+usageCleanup+"\n"+usageNotes+"\n"+usageInvisible+"\n"+usageDuration+"\n"+usageGate+"\n"+usageHashes+"\n"+usageVerify+"\n"+usageImages+"\n"+usageRestyle+"\n"+usageWritingMode+"\n"+usageCFI+"\n"+usageText+"\n"+usageTransform+"\n"+usageLang+"\n"+usageTest+"\n"+usageGen+"\n"+usageGenCover+"\n"+usageA11yCheck+"\n"+usageCheck+"\n"+usageValidate+"\n"+usageSplitChapters+"\n"+usageJoinChapters+"\n"+usageOPDS+"\n"+usageLibrary+"\n"+usageExamples)
 }
 
 type multiValue []string
@@ -143,6 +663,26 @@ func (m *multiValue) Set(value string) error {
 	return nil
 }
 
+// describeChangeset completes a command's summary line with what happened
+// to the book.
+func describeChangeset(cs epub.Changeset) string {
+	switch cs.Outcome {
+	case epub.OutcomeWritten:
+		return "wrote " + cs.OutPath
+	case epub.OutcomeDryRun:
+		return "dry run, nothing written"
+	}
+	return "nothing written (no changes)"
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
 func expandListFiles(paths []string) ([]string, error) {
 	var volumes []string
 	for _, p := range paths {
@@ -167,10 +707,10 @@ func expandListFiles(paths []string) ([]string, error) {
 	return volumes, nil
 }
 
-func expandDirectories(dirs []string) ([]string, error) {
+func expandDirectories(ctx context.Context, dirs []string) ([]string, error) {
 	var volumes []string
 	for _, dir := range dirs {
-		entries, err := os.ReadDir(dir)
+		entries, err := epub.ReadDir(ctx, dir)
 		if err != nil {
 			return nil, fmt.Errorf("dir %s: %w", dir, err)
 		}
@@ -185,7 +725,7 @@ func expandDirectories(dirs []string) ([]string, error) {
 			}
 			num, hasNum := extractVolumeNumber(name)
 			candidates = append(candidates, dirEntry{
-				path:      filepath.Join(dir, name),
+				path:      epub.JoinPath(ctx, dir, name),
 				name:      name,
 				number:    num,
 				hasNumber: hasNum,
@@ -239,9 +779,10 @@ func extractVolumeNumber(name string) (int, bool) {
 	return num, true
 }
 
-func runMerge(ctx context.Context, args []string) error {
+func runMerge(ctx context.Context, g *globalFlags, args []string) error {
 	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
+	g.register(fs)
 	fs.Usage = func() { fmt.Fprint(os.Stderr, usageMerge) }
 
 	out := fs.String("out", "merged.epub", "")
@@ -262,9 +803,132 @@ func runMerge(ctx context.Context, args []string) error {
 	var dirInputs multiValue
 	fs.Var(&dirInputs, "dir", "")
 
-	if err := fs.Parse(args); err != nil {
+	layout := fs.String("layout", "", "")
+	titlePages := fs.Bool("title-pages", false, "")
+	var insertPageVals multiValue
+	fs.Var(&insertPageVals, "insert-page", "")
+	stripMatter := fs.Bool("strip-matter", false, "")
+	var stripTypes, stripFiles, stripNav multiValue
+	fs.Var(&stripTypes, "strip-type", "")
+	fs.Var(&stripFiles, "strip-file", "")
+	fs.Var(&stripNav, "strip-nav", "")
+	gatherIllustrations := fs.Bool("illustrations", false, "")
+	var illustrationTypes, illustrationFiles, illustrationNav multiValue
+	fs.Var(&illustrationTypes, "illustration-type", "")
+	fs.Var(&illustrationFiles, "illustration-file", "")
+	fs.Var(&illustrationNav, "illustration-nav", "")
+	illustrationsAt := fs.String("illustrations-at", "", "")
+	nonLinear := fs.String("non-linear", "", "")
+	mixedLayout := fs.Bool("mixed-layout", false, "")
+	shareResources := fs.Bool("share-resources", false, "")
+	onConflict := fs.String("on-conflict", "", "")
+	dedupeCSS := fs.Bool("dedupe-css", false, "")
+	stylesheet := fs.String("stylesheet", "", "")
+	stripCSS := fs.Bool("strip-css", false, "")
+	userCSS := fs.String("user-css", "", "")
+	var keepCSS multiValue
+	fs.Var(&keepCSS, "keep-css", "")
+	writingMode := fs.String("writing-mode", "", "")
+	ruby := fs.String("ruby", "", "")
+	chapterHashes := fs.Bool("chapter-hashes", false, "")
+	checksums := fs.Bool("checksums", false, "")
+	maxSizeStr := fs.String("max-size", "", "")
+	shrink := fs.Bool("shrink-to-fit", false, "")
+	appendTo := fs.String("append", "", "")
+	incremental := fs.Bool("incremental", false, "")
+	statePath := fs.String("state", "", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *statePath != "" && !*incremental {
+		return usageErrorf("-state requires -incremental")
+	}
+	if *incremental && *dryRun {
+		return usageErrorf("-incremental cannot be combined with -dry-run")
+	}
+	if *incremental && *out == "-" {
+		return usageErrorf("-incremental cannot write to stdout")
+	}
+	if *appendTo != "" && (*incremental || *dryRun) {
+		return usageErrorf("-append cannot be combined with -incremental or -dry-run")
+	}
+	var maxSize int64
+	if *maxSizeStr != "" {
+		var err error
+		if maxSize, err = epub.ParseByteSize(*maxSizeStr); err != nil {
+			return usageErrorf("-max-size: %w", err)
+		}
+	}
+	if *shrink && maxSize == 0 {
+		return usageErrorf("-shrink-to-fit requires -max-size")
+	}
+	if *asJSON && !*dryRun && !g.jsonLines() {
+		return usageErrorf("-json requires -dry-run")
+	}
+	var matter *epub.MatterFilter
+	if *stripMatter || len(stripTypes) > 0 || len(stripFiles) > 0 || len(stripNav) > 0 {
+		matter = &epub.MatterFilter{Files: stripFiles, NavTitles: stripNav}
+		if *stripMatter {
+			matter.Types = append(matter.Types, epub.DefaultMatterTypes...)
+		}
+		matter.Types = append(matter.Types, stripTypes...)
+	}
+	var illustrations *epub.MatterFilter
+	if *gatherIllustrations || len(illustrationTypes) > 0 || len(illustrationFiles) > 0 || len(illustrationNav) > 0 {
+		illustrations = &epub.MatterFilter{Files: illustrationFiles, NavTitles: illustrationNav}
+		if *gatherIllustrations {
+			illustrations.Files = append(illustrations.Files, epub.DefaultIllustrationFiles...)
+			illustrations.Types = append(illustrations.Types, epub.DefaultIllustrationTypes...)
+		}
+		illustrations.Types = append(illustrations.Types, illustrationTypes...)
+	}
+	if *illustrationsAt != "" {
+		if illustrations == nil {
+			return usageErrorf("-illustrations-at requires -illustrations or an -illustration-* filter")
+		}
+		if _, err := epub.ParseIllustrationsAt(*illustrationsAt); err != nil {
+			return err
+		}
+	}
+	if _, err := epub.ParseNonLinearPolicy(*nonLinear); err != nil {
 		return err
 	}
+	var resolver epub.ConflictResolver
+	if *onConflict != "" {
+		if !*shareResources {
+			return usageErrorf("-on-conflict requires -share-resources")
+		}
+		action, err := epub.ParseConflictAction(*onConflict)
+		if err != nil {
+			return err
+		}
+		resolver = action
+	}
+	if *stylesheet != "" && (*dedupeCSS || *stripCSS || *userCSS != "") {
+		return usageErrorf("-stylesheet cannot be combined with -dedupe-css, -strip-css or -user-css")
+	}
+	if len(keepCSS) > 0 && !*stripCSS {
+		return usageErrorf("-keep-css requires -strip-css")
+	}
+	if *writingMode != "" {
+		if _, err := epub.ParseWritingMode(*writingMode); err != nil {
+			return err
+		}
+	}
+	if _, err := epub.ParseRubyMode(*ruby); err != nil {
+		return err
+	}
+	var insertPages []epub.InsertPage
+	for _, v := range insertPageVals {
+		page, err := epub.ParseInsertPage(v)
+		if err != nil {
+			return usageErrorf("-insert-page: %v", err)
+		}
+		insertPages = append(insertPages, page)
+	}
 
 	files := fs.Args()
 
@@ -277,30 +941,146 @@ func runMerge(ctx context.Context, args []string) error {
 	}
 
 	if len(dirInputs) > 0 {
-		fromDirs, err := expandDirectories(dirInputs)
+		fromDirs, err := expandDirectories(ctx, dirInputs)
 		if err != nil {
 			return err
 		}
 		files = append(files, fromDirs...)
 	}
 
-	if len(files) < 2 {
-		return fmt.Errorf("need at least two EPUB files to merge")
+	files, err := g.fetchInputs(ctx, files)
+	if err != nil {
+		return err
+	}
+
+	if *appendTo != "" {
+		if len(files) == 0 {
+			return usageErrorf("-append needs at least one EPUB file to add")
+		}
+		g.inputs = append([]string{*appendTo}, files...)
+	} else if len(files) < 2 {
+		return usageErrorf("need at least two EPUB files to merge")
+	} else {
+		g.inputs = files
 	}
 
+	progress, done := g.progressFunc(
+		[]string{epub.StageLoad, epub.StageCopy, epub.StageZip},
+		[]float64{0.2, 0.3, 0.5},
+	)
+	defer done()
+
 	opts := epub.MergeOptions{
-		Title:    *title,
-		Language: *lang,
-		Creators: creatorVals,
-		OutPath:  *out,
+		Title:            *title,
+		Language:         *lang,
+		Creators:         creatorVals,
+		Layout:           *layout,
+		VolumeTitlePages: *titlePages,
+		InsertPages:      insertPages,
+		StripMatter:      matter,
+		Illustrations:    illustrations,
+		IllustrationsAt:  *illustrationsAt,
+		NonLinear:        *nonLinear,
+		MixedLayout:      *mixedLayout,
+		ShareResources:   *shareResources,
+		ConflictResolver: resolver,
+		DedupeCSS:        *dedupeCSS,
+		Stylesheet:       *stylesheet,
+		StripCSS:         *stripCSS,
+		KeepCSS:          keepCSS,
+		UserCSS:          *userCSS,
+		WritingMode:      *writingMode,
+		Ruby:             *ruby,
+		ChapterHashes:    *chapterHashes,
+		Checksums:        *checksums,
+		MaxSize:          maxSize,
+		ShrinkToFit:      *shrink,
+		StatePath:        *statePath,
+		OutPath:          *out,
+		Logger:           g.logger(os.Stderr),
+		Progress:         progress,
 	}
 
-	return epub.MergeEPUBs(ctx, files, opts)
+	if *appendTo != "" {
+		// -o defaults to merged.epub for merges; appending edits in place.
+		outSet := false
+		fs.Visit(func(f *flag.Flag) { outSet = outSet || f.Name == "o" || f.Name == "out" })
+		if !outSet {
+			opts.OutPath = ""
+		}
+		err = epub.AppendEPUBs(ctx, *appendTo, files, opts)
+	} else if *dryRun {
+		var plan epub.MergePlan
+		plan, err = epub.PlanMerge(ctx, files, opts)
+		done()
+		if err == nil {
+			if *asJSON {
+				return g.printJSON(plan)
+			}
+			printMergePlan(os.Stdout, plan)
+			return nil
+		}
+	} else if *incremental {
+		var merged bool
+		merged, err = epub.MergeIfChanged(ctx, files, opts)
+		done()
+		if err == nil && !merged && !g.quiet {
+			fmt.Fprintf(os.Stderr, "merge: %s is up to date; inputs and options unchanged\n", *out)
+		}
+	} else {
+		err = epub.MergeEPUBs(ctx, files, opts)
+	}
+	var budget *epub.SizeBudgetError
+	if errors.As(err, &budget) {
+		done()
+		fmt.Fprintln(os.Stderr, "largest files:")
+		for _, f := range budget.Largest {
+			fmt.Fprintf(os.Stderr, "  %9s  %s\n", epub.FormatByteSize(f.Bytes), f.Path)
+		}
+	}
+	return err
+}
+
+func printMergePlan(w io.Writer, plan epub.MergePlan) {
+	fmt.Fprintf(w, "%s: %q (%s) by %s\n", plan.OutPath, plan.Title, plan.Language, strings.Join(plan.Creators, ", "))
+	fmt.Fprintln(w, "\nvolumes:")
+	for _, v := range plan.Volumes {
+		fmt.Fprintf(w, "  %2d. %s  (%s, %d chapters)\n", v.Index+1, v.Title, v.SourcePath, v.Chapters)
+		for _, href := range v.Dropped {
+			fmt.Fprintf(w, "        drop %s\n", href)
+		}
+		if v.NonLinear > 0 {
+			fmt.Fprintf(w, "        %d non-linear spine items\n", v.NonLinear)
+		}
+		for _, href := range v.Illustrations {
+			fmt.Fprintf(w, "        illustration %s\n", href)
+		}
+	}
+	fmt.Fprintln(w, "\ntoc:")
+	printNavTree(w, plan.TOC, 1)
+	if len(plan.Resources) > 0 {
+		fmt.Fprintln(w, "\nresources:")
+		for _, r := range plan.Resources {
+			if r.Target != "" {
+				fmt.Fprintf(w, "  %-12s %s -> %s\n", r.Action, r.Href, r.Target)
+			} else {
+				fmt.Fprintf(w, "  %-12s %s\n", r.Action, r.Href)
+			}
+		}
+	}
+	if plan.FixedLinks > 0 || len(plan.BrokenLinks) > 0 {
+		fmt.Fprintf(w, "\nlinks: %d fixed, %d broken\n", plan.FixedLinks, len(plan.BrokenLinks))
+		for _, b := range plan.BrokenLinks {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", b.Href, b.Link, b.Reason)
+		}
+	}
+	fmt.Fprintf(w, "\n%d files, %s\n", plan.Files, epub.FormatByteSize(plan.Size))
 }
 
-func runRewrite(ctx context.Context, args []string) error {
+func runRewrite(ctx context.Context, g *globalFlags, args []string) error {
 	fs := flag.NewFlagSet("rewrite", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
+	g.register(fs)
 	fs.Usage = func() { fmt.Fprint(os.Stderr, usageRewrite) }
 
 	out := fs.String("out", "", "")
@@ -316,92 +1096,333 @@ func runRewrite(ctx context.Context, args []string) error {
 	fs.Var(&selectors, "selector", "")
 
 	rulesPath := fs.String("rules", "", "")
+	var presets multiValue
+	fs.Var(&presets, "preset", "")
+	namesPath := fs.String("names", "", "")
+	packPath := fs.String("pack", "", "")
+	packVersion := fs.String("pack-version", "", "")
+
+	var skipSelectors multiValue
+	fs.Var(&skipSelectors, "skip-selector", "")
+	acrossTags := fs.Bool("across-tags", false, "")
+
+	sceneBreaks := fs.Bool("scene-breaks", false, "")
+	sceneBreakMarker := fs.String("scene-break-marker", "", "")
+	var sceneBreakPatterns multiValue
+	fs.Var(&sceneBreakPatterns, "scene-break-pattern", "")
+	ruby := fs.String("ruby", "", "")
+	repairHTML := fs.Bool("repair-html", false, "")
+
+	test := fs.Bool("test", false, "")
+	var samples multiValue
+	fs.Var(&samples, "sample", "")
+	samplesPath := fs.String("samples", "", "")
+
 	dryRun := fs.Bool("dry-run", false, "")
+	watch := fs.Bool("watch", false, "")
+	previewAddr := fs.String("preview-web", "", "")
+	reportPath := fs.String("report", "", "")
+	asJSON := g.jsonFlag(fs)
 
-	if err := fs.Parse(args); err != nil {
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	}
 
-	if fs.NArg() != 1 {
-		return fmt.Errorf("rewrite requires exactly one EPUB path")
+	switch {
+	case *test && fs.NArg() != 0:
+		return usageErrorf("rewrite -test takes samples, not an EPUB")
+	case !*test && (len(samples) > 0 || *samplesPath != ""):
+		return usageErrorf("-sample and -samples require -test")
+	case !*test && fs.NArg() != 1:
+		return usageErrorf("rewrite requires exactly one EPUB path")
 	}
 	input := fs.Arg(0)
 
-	var rules []epub.RewriteRule
-	if *rulesPath != "" {
-		fileRules, err := epub.LoadRewriteRulesJSON(*rulesPath)
+	if *packVersion != "" && *packPath == "" {
+		return usageErrorf("-pack-version requires -pack")
+	}
+	if _, err := epub.ParseRubyMode(*ruby); err != nil {
+		return err
+	}
+
+	// load builds the options from the rule files as they are now; -watch
+	// calls it again after every change.
+	load := func() (epub.RewriteOptions, error) {
+		var rules []epub.RewriteRule
+		var skip []string
+		var sceneBreak *epub.SceneBreakRule
+		var names []epub.NameEntry
+		if *namesPath != "" {
+			var err error
+			if names, err = epub.LoadNameList(*namesPath); err != nil {
+				return epub.RewriteOptions{}, fmt.Errorf("read names: %w", err)
+			}
+		}
+		for _, name := range presets {
+			presetRules, err := epub.RewritePreset(name, names)
+			if err != nil {
+				return epub.RewriteOptions{}, usageErrorf("%w", err)
+			}
+			rules = append(rules, presetRules...)
+		}
+		if *packPath != "" {
+			pack, err := loadRewritePack(*packPath, *packVersion)
+			if err != nil {
+				return epub.RewriteOptions{}, err
+			}
+			rules = append(rules, pack.RewriteRules()...)
+			skip = append(skip, pack.SkipSelectors...)
+			sceneBreak = pack.SceneBreakRule()
+		}
+		skip = append(skip, skipSelectors...)
+
+		if *sceneBreaks || *sceneBreakMarker != "" || len(sceneBreakPatterns) > 0 {
+			if sceneBreak == nil {
+				sceneBreak = &epub.SceneBreakRule{}
+			}
+			if *sceneBreakMarker != "" {
+				sceneBreak.Marker = *sceneBreakMarker
+			}
+			sceneBreak.Patterns = append(sceneBreak.Patterns, sceneBreakPatterns...)
+		}
+
+		if *rulesPath != "" {
+			fileRules, err := epub.LoadRewriteRulesJSON(*rulesPath)
+			if err != nil {
+				return epub.RewriteOptions{}, fmt.Errorf("read rules: %w", err)
+			}
+			rules = append(rules, fileRules...)
+		}
+
+		if *find != "" {
+			rules = append(rules, epub.RewriteRule{
+				Find:       *find,
+				Replace:    *replace,
+				Regex:      *regex,
+				IgnoreCase: *ignoreCase,
+				Selectors:  selectors,
+			})
+		}
+
+		scope, err := epub.ParseRewriteScope(*scopeStr)
 		if err != nil {
-			return fmt.Errorf("read rules: %w", err)
+			return epub.RewriteOptions{}, usageErrorf("%w", err)
 		}
-		rules = append(rules, fileRules...)
+
+		return epub.RewriteOptions{
+			OutPath:       *out,
+			Scope:         scope,
+			Rules:         rules,
+			SkipSelectors: skip,
+			SceneBreak:    sceneBreak,
+			Ruby:          *ruby,
+			RepairHTML:    *repairHTML,
+			AcrossInline:  *acrossTags,
+			DryRun:        *dryRun || *watch,
+			MaxMemory:     g.maxMemory,
+			Logger:        g.logger(os.Stderr),
+		}, nil
 	}
 
-	if *find != "" {
-		rules = append(rules, epub.RewriteRule{
-			Find:       *find,
-			Replace:    *replace,
-			Regex:      *regex,
-			IgnoreCase: *ignoreCase,
-			Selectors:  selectors,
-		})
+	if *test {
+		switch {
+		case *out != "" || *dryRun || *watch || *previewAddr != "" || *reportPath != "":
+			return usageErrorf("-test cannot be combined with -o, -dry-run, -watch, -preview-web or -report")
+		case *sceneBreaks || *sceneBreakMarker != "" || len(sceneBreakPatterns) > 0 || *ruby != "" || *repairHTML:
+			return usageErrorf("-test runs text rules only; scene breaks, ruby and -repair-html need a book")
+		}
+		return runRewriteTest(g, load, samples, *samplesPath)
 	}
 
-	var scope epub.RewriteScope
-	switch strings.ToLower(*scopeStr) {
-	case "body":
-		scope = epub.RewriteScopeBody
-	case "meta":
-		scope = epub.RewriteScopeMeta
-	case "all":
-		scope = epub.RewriteScopeAll
-	default:
-		return fmt.Errorf("invalid scope %q (want body, meta, all)", *scopeStr)
+	if *watch {
+		switch {
+		case *out != "":
+			return usageErrorf("-watch only reports; it cannot be combined with -out")
+		case *previewAddr != "" || *reportPath != "":
+			return usageErrorf("-watch cannot be combined with -preview-web or -report")
+		}
+		watched := []string{input}
+		for _, p := range []string{*rulesPath, *packPath, *namesPath} {
+			if p != "" {
+				watched = append(watched, p)
+			}
+		}
+		return watchRewrite(ctx, g, input, watched, load)
+	}
+	opts, err := load()
+	if err != nil {
+		return err
 	}
 
-	stats, err := epub.RewriteEPUB(ctx, input, epub.RewriteOptions{
-		OutPath: *out,
-		Scope:   scope,
-		Rules:   rules,
-		DryRun:  *dryRun,
-	})
+	if *previewAddr != "" {
+		if *dryRun {
+			return usageErrorf("-preview-web cannot be combined with -dry-run")
+		}
+		if *reportPath != "" {
+			return usageErrorf("-preview-web cannot be combined with -report")
+		}
+		return runRewritePreview(ctx, g, *previewAddr, input, opts)
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	opts.Progress = progress
+	stats, err := epub.RewriteEPUB(ctx, input, opts)
+	done()
 	if err != nil {
 		return err
 	}
+	if *reportPath != "" {
+		if err := writeJSONFile(*reportPath, stats); err != nil {
+			return fmt.Errorf("write report: %w", err)
+		}
+	}
 
-	fmt.Fprintf(os.Stderr, "rewrite: %d matches across %d files\n", stats.MatchCount, stats.FilesChanged)
+	if *asJSON {
+		if err := g.printJSON(stats); err != nil {
+			return err
+		}
+	}
+	if g.quiet {
+		return nil
+	}
+	printMarkupRepairs("rewrite", stats.RepairedHTML)
+	fmt.Fprintf(os.Stderr, "rewrite: %d matches across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
 	return nil
 }
 
-func runEditMeta(ctx context.Context, args []string) error {
+// printMarkupRepairs lists the documents -repair-html repaired.
+func printMarkupRepairs(cmd string, repairs []epub.MarkupRepair) {
+	for _, r := range repairs {
+		fmt.Fprintf(os.Stderr, "%s: repaired markup in %s (%s)\n", cmd, r.Href, r.Problem)
+	}
+}
+
+func runEditMeta(ctx context.Context, g *globalFlags, args []string) error {
 	fs := flag.NewFlagSet("edit-meta", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
+	g.register(fs)
 	fs.Usage = func() { fmt.Fprint(os.Stderr, usageEditMeta) }
 
 	out := fs.String("out", "", "")
 	fs.StringVar(out, "o", "", "")
 	title := fs.String("title", "", "")
+	subtitle := fs.String("subtitle", "", "")
 	lang := fs.String("lang", "", "")
 	identifier := fs.String("identifier", "", "")
 	description := fs.String("description", "", "")
+	pubdate := fs.String("pubdate", "", "")
 
 	var creators multiValue
 	fs.Var(&creators, "creator", "")
 
+	var addSources, removeSources multiValue
+	fs.Var(&addSources, "add-source", "")
+	fs.Var(&removeSources, "remove-source", "")
+	listSources := fs.Bool("list-sources", false, "")
+	newUUID := fs.Bool("new-uuid", false, "")
+	var addIdentifiers, removeIdentifiers multiValue
+	fs.Var(&addIdentifiers, "add-identifier", "")
+	fs.Var(&removeIdentifiers, "remove-identifier", "")
+	listVolumes := fs.Bool("list-volumes", false, "")
+
+	a11yPreset := fs.String("a11y-preset", "", "")
+	var accessModes, sufficientModes, a11yFeatures, a11yHazards multiValue
+	fs.Var(&accessModes, "access-mode", "")
+	fs.Var(&sufficientModes, "access-mode-sufficient", "")
+	fs.Var(&a11yFeatures, "a11y-feature", "")
+	fs.Var(&a11yHazards, "a11y-hazard", "")
+	a11ySummary := fs.String("a11y-summary", "", "")
+	renditionLayout := fs.String("rendition-layout", "", "")
+	renditionOrientation := fs.String("rendition-orientation", "", "")
+	renditionSpread := fs.String("rendition-spread", "", "")
+	renditionFlow := fs.String("rendition-flow", "", "")
+
 	metaPath := fs.String("meta", "", "")
+	templatePath := fs.String("template", "", "")
+	pattern := fs.String("pattern", "", "")
+	var dirInputs multiValue
+	fs.Var(&dirInputs, "dir", "")
 	dumpMeta := fs.String("dump-meta", "", "")
+	importMeta := fs.String("import-meta", "", "")
+	exportMeta := fs.String("export-meta", "", "")
 	navPath := fs.String("nav", "", "")
 	dumpNav := fs.String("dump-nav", "", "")
+	dumpTOC := fs.String("dump-toc", "", "")
+	applyTOC := fs.String("apply-toc", "", "")
+	start := fs.String("start", "", "")
 	noTouch := fs.Bool("no-touch-modified", false, "")
+	modified := fs.String("modified", "", "")
+	asJSON := g.jsonFlag(fs)
 
-	if err := fs.Parse(args); err != nil {
+	var spineEdits []epub.SpineEdit
+	fs.Var(spineEditFlag{epub.SpineDrop, &spineEdits}, "drop-spine", "")
+	fs.Var(spineEditFlag{epub.SpineMove, &spineEdits}, "move-spine", "")
+	fs.Var(spineEditFlag{epub.SpineInsert, &spineEdits}, "insert-xhtml", "")
+
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	}
 
-	if fs.NArg() != 1 {
-		return fmt.Errorf("edit-meta requires exactly one EPUB path")
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if *templatePath != "" {
+		if err := checkTemplateFlags(setFlags); err != nil {
+			return err
+		}
+	} else if fs.NArg() != 1 || len(dirInputs) > 0 {
+		return usageErrorf("edit-meta requires exactly one EPUB path, or -template")
 	}
 
 	input := fs.Arg(0)
+	if *templatePath == "" && epub.IsRemote(input) {
+		if !*listSources && !*listVolumes {
+			if err := requireOutForRemote("edit-meta", input, *out); err != nil {
+				return err
+			}
+		}
+		fetched, err := g.fetchInputs(ctx, []string{input})
+		if err != nil {
+			return err
+		}
+		input = fetched[0]
+		g.inputs = fetched
+	}
+	if *templatePath == "" && !*listSources && !*listVolumes && toStdout(input, *out) {
+		if err := g.checkStdout("edit-meta"); err != nil {
+			return err
+		}
+	}
+
+	if *listSources {
+		sources, err := epub.ListSources(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			fmt.Println(src)
+		}
+		return nil
+	}
+
+	if *listVolumes {
+		m, err := epub.ReadVolumeManifest(ctx, input)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return g.printJSON(m)
+		}
+		for _, v := range m.Volumes {
+			fmt.Printf("%d\tspine %d-%d\t%s\t%s\n", v.Number, v.SpineStart+1, v.SpineEnd, v.Source, v.Title)
+		}
+		return nil
+	}
 
 	var patch epub.MetadataPatch
 	if *metaPath != "" {
@@ -414,41 +1435,157 @@ func runEditMeta(ctx context.Context, args []string) error {
 		}
 	}
 
-	setFlags := map[string]bool{}
-	fs.Visit(func(f *flag.Flag) {
-		setFlags[f.Name] = true
-	})
+	// applyFlags lays the metadata flags over a patch from -meta or
+	// -template.
+	applyFlags := func(patch *epub.MetadataPatch) error {
+		if setFlags["title"] {
+			patch.Title = stringPtr(*title)
+		}
+		if setFlags["subtitle"] {
+			patch.Subtitle = stringPtr(*subtitle)
+		}
+		if setFlags["lang"] {
+			patch.Language = stringPtr(*lang)
+		}
+		if setFlags["identifier"] {
+			patch.Identifier = stringPtr(*identifier)
+		}
+		if setFlags["description"] {
+			patch.Description = stringPtr(*description)
+		}
+		if setFlags["pubdate"] {
+			patch.PubDate = stringPtr(*pubdate)
+		}
+		if len(creators) > 0 {
+			list := make([]string, len(creators))
+			copy(list, creators)
+			patch.Creators = &list
+		}
 
-	if setFlags["title"] {
-		patch.Title = stringPtr(*title)
+		if *a11yPreset != "" {
+			preset, err := epub.AccessibilityPreset(*a11yPreset)
+			if err != nil {
+				return err
+			}
+			patch.AccessModes = preset.AccessModes
+			patch.AccessModesSufficient = preset.AccessModesSufficient
+			patch.AccessibilityFeatures = preset.AccessibilityFeatures
+			patch.AccessibilityHazards = preset.AccessibilityHazards
+			patch.AccessibilitySummary = preset.AccessibilitySummary
+		}
+		if len(accessModes) > 0 {
+			patch.AccessModes = splitValues(accessModes)
+		}
+		if len(sufficientModes) > 0 {
+			list := make([]string, len(sufficientModes))
+			copy(list, sufficientModes)
+			patch.AccessModesSufficient = &list
+		}
+		if len(a11yFeatures) > 0 {
+			patch.AccessibilityFeatures = splitValues(a11yFeatures)
+		}
+		if len(a11yHazards) > 0 {
+			patch.AccessibilityHazards = splitValues(a11yHazards)
+		}
+		if setFlags["a11y-summary"] {
+			patch.AccessibilitySummary = stringPtr(*a11ySummary)
+		}
+		if setFlags["rendition-layout"] {
+			patch.RenditionLayout = stringPtr(*renditionLayout)
+		}
+		if setFlags["rendition-orientation"] {
+			patch.RenditionOrientation = stringPtr(*renditionOrientation)
+		}
+		if setFlags["rendition-spread"] {
+			patch.RenditionSpread = stringPtr(*renditionSpread)
+		}
+		if setFlags["rendition-flow"] {
+			patch.RenditionFlow = stringPtr(*renditionFlow)
+		}
+		return nil
 	}
-	if setFlags["lang"] {
-		patch.Language = stringPtr(*lang)
+	opts := epub.EditOptions{
+		OutPath:           *out,
+		NavReplacePath:    *navPath,
+		DumpNavPath:       *dumpNav,
+		DumpTOCPath:       *dumpTOC,
+		ApplyTOCPath:      *applyTOC,
+		Start:             *start,
+		DumpMetaPath:      *dumpMeta,
+		ImportCalibrePath: *importMeta,
+		ExportCalibrePath: *exportMeta,
+		MetadataPatch:     patch,
+		AddSources:        addSources,
+		RemoveSources:     removeSources,
+		AddIdentifiers:    addIdentifiers,
+		RemoveIdentifiers: removeIdentifiers,
+		NewUUID:           *newUUID,
+		SpineEdits:        spineEdits,
+		TouchModified:     !*noTouch,
+		Logger:            g.logger(os.Stderr),
 	}
-	if setFlags["identifier"] {
-		patch.Identifier = stringPtr(*identifier)
+	if *modified != "" {
+		if *noTouch {
+			return usageErrorf("edit-meta: -modified and -no-touch-modified cannot be combined")
+		}
+		stamp, err := time.Parse(time.RFC3339, *modified)
+		if err != nil {
+			return usageErrorf("-modified %q: want a UTC time such as 2023-05-01T00:00:00Z", *modified)
+		}
+		opts.Modified = stamp
 	}
-	if setFlags["description"] {
-		patch.Description = stringPtr(*description)
+	if *templatePath != "" {
+		return editMetaTemplate(ctx, g, fs.Args(), dirInputs, *templatePath, *pattern, opts, applyFlags)
 	}
-	if len(creators) > 0 {
-		list := make([]string, len(creators))
-		copy(list, creators)
-		patch.Creators = &list
+	if err := applyFlags(&opts.MetadataPatch); err != nil {
+		return err
 	}
 
-	opts := epub.EditOptions{
-		OutPath:        *out,
-		NavReplacePath: *navPath,
-		DumpNavPath:    *dumpNav,
-		DumpMetaPath:   *dumpMeta,
-		MetadataPatch:  patch,
-		TouchModified:  !*noTouch,
+	cs, err := epub.EditEPUB(ctx, input, opts)
+	if err != nil {
+		return err
 	}
-
-	return epub.EditEPUB(ctx, input, opts)
+	if *asJSON {
+		return g.printJSON(cs)
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "edit-meta: %s\n", describeChangeset(cs))
+	}
+	return nil
 }
 
 func stringPtr(s string) *string {
 	return &s
 }
+
+// splitValues flattens repeated flag values that may also be
+// comma-separated.
+func splitValues(values multiValue) *[]string {
+	var list []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				list = append(list, part)
+			}
+		}
+	}
+	return &list
+}
+
+// spineEditFlag collects spine edits from several flags into one list so
+// they keep their command-line order.
+type spineEditFlag struct {
+	op    string
+	edits *[]epub.SpineEdit
+}
+
+func (f spineEditFlag) String() string { return "" }
+
+func (f spineEditFlag) Set(value string) error {
+	edit, err := epub.ParseSpineEdit(f.op, value)
+	if err != nil {
+		return err
+	}
+	*f.edits = append(*f.edits, edit)
+	return nil
+}
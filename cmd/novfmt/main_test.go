@@ -1,9 +1,21 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/kototok903/novfmt/internal/epub"
 )
 
 func TestExpandListFiles(t *testing.T) {
@@ -57,7 +69,7 @@ func TestExpandDirectoriesOrdering(t *testing.T) {
 		}
 	}
 
-	got, err := expandDirectories([]string{dir})
+	got, err := expandDirectories(context.Background(), []string{dir})
 	if err != nil {
 		t.Fatalf("expand: %v", err)
 	}
@@ -92,7 +104,7 @@ func TestExpandDirectoriesMultipleDirs(t *testing.T) {
 	must(dir1, "Vol 01.epub")
 	must(dir2, "Vol 02.epub")
 
-	paths, err := expandDirectories([]string{dir1, dir2})
+	paths, err := expandDirectories(context.Background(), []string{dir1, dir2})
 	if err != nil {
 		t.Fatalf("expand: %v", err)
 	}
@@ -104,3 +116,236 @@ func TestExpandDirectoriesMultipleDirs(t *testing.T) {
 		t.Fatalf("unexpected order: %v", paths)
 	}
 }
+
+func TestParseGlobalFlags(t *testing.T) {
+	g, rest, err := parseGlobalFlags([]string{"-v", "-log-json", "merge", "-quiet", "a.epub"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !g.verbose || !g.logJSON || g.quiet {
+		t.Fatalf("unexpected flags %+v", g)
+	}
+	if len(rest) != 3 || rest[0] != "merge" {
+		t.Fatalf("unexpected rest %v", rest)
+	}
+	if got := g.level(); got != slog.LevelInfo {
+		t.Fatalf("level = %v", got)
+	}
+	g.quiet = true
+	if got := g.level(); got != slog.LevelError {
+		t.Fatalf("quiet level = %v", got)
+	}
+}
+
+func TestOutputJSONEvents(t *testing.T) {
+	g, _, err := parseGlobalFlags([]string{"-output", "json", "typo"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	fs := flag.NewFlagSet("typo", flag.ContinueOnError)
+	g.register(fs)
+	if asJSON := g.jsonFlag(fs); !*asJSON {
+		t.Fatal("-output json does not imply -json")
+	}
+	var buf strings.Builder
+	g.events = &eventStream{w: &buf}
+	g.command = "typo"
+	g.logger(io.Discard).Warn("odd quote", "href", "a.xhtml")
+	stats := epub.RewriteStats{MatchCount: 2, Changeset: epub.Changeset{Files: []epub.FileChange{{Href: "a.xhtml", Kind: epub.ChangeModified}}}}
+	if err := g.printJSON(stats); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("not a JSON line: %q", line)
+		}
+		events = append(events, ev.Event)
+	}
+	if got := strings.Join(events, " "); got != "log result file" {
+		t.Errorf("events = %s\n%s", got, buf.String())
+	}
+	if _, _, err := parseGlobalFlags([]string{"-output", "yaml"}); err == nil {
+		t.Error("accepted -output yaml")
+	}
+}
+
+func TestPrintRuleTotals(t *testing.T) {
+	rules := []epub.RewriteRule{{ID: "name", Find: "Jon"}, {Find: "zzz"}}
+	files := []epub.RewriteFileResult{{Href: "a.xhtml", Changes: []epub.TextChange{
+		{Rules: []epub.RuleRef{{ID: "name", Find: "Jon", Matches: 2}}},
+		{Rules: []epub.RuleRef{{ID: "name", Find: "Jon", Matches: 1}}},
+	}}}
+	var buf strings.Builder
+	printRuleTotals(&buf, rules, files)
+	want := "rules:\n  name ×3\n  \"zzz\"  no matches\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestStampFilesNoticesChanges(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "rules.json")
+	missing := stampFiles([]string{p})
+	if err := os.WriteFile(p, []byte("[]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	written := stampFiles([]string{p})
+	if written[0] == missing[0] {
+		t.Error("creating the file went unnoticed")
+	}
+	if err := os.WriteFile(p, []byte(`[{"find":"a"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if stampFiles([]string{p})[0] == written[0] {
+		t.Error("rewriting the file went unnoticed")
+	}
+}
+
+func TestProgressBarOverall(t *testing.T) {
+	b := newProgressBar(io.Discard, []string{"load", "zip"}, []float64{0.25, 0.75})
+	if got := b.overall(epub.ProgressEvent{Stage: "load", Done: 2, Total: 4}); got != 0.125 {
+		t.Fatalf("load half = %v", got)
+	}
+	if got := b.overall(epub.ProgressEvent{Stage: "zip", Done: 1, Total: 3}); got != 0.5 {
+		t.Fatalf("zip third = %v", got)
+	}
+	if got := b.overall(epub.ProgressEvent{Stage: "zip", Done: 3, Total: 3}); got != 1 {
+		t.Fatalf("done = %v", got)
+	}
+}
+
+// writeTestEPUB builds a minimal EPUB whose manifest and spine list every
+// .xhtml file in files (paths relative to the container root).
+func writeTestEPUB(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	var manifest, spine strings.Builder
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if !strings.HasSuffix(name, ".xhtml") {
+			continue
+		}
+		href := strings.TrimPrefix(name, "OEBPS/")
+		fmt.Fprintf(&manifest, `<item id="i%d" href="%s" media-type="application/xhtml+xml"/>`, i, href)
+		fmt.Fprintf(&spine, `<itemref idref="i%d"/>`, i)
+	}
+
+	all := map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`,
+		"OEBPS/content.opf": `<?xml version="1.0"?><package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier><dc:title>Test</dc:title></metadata><manifest>` +
+			manifest.String() + `</manifest><spine>` + spine.String() + `</spine></package>`,
+	}
+	for name, data := range files {
+		all[name] = data
+	}
+
+	path := filepath.Join(t.TempDir(), "test.epub")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("mimetype: %v", err)
+	}
+	w.Write([]byte("application/epub+zip"))
+	for name, data := range all {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+	return path
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("gate", flag.ContinueOnError)
+	limit := fs.String("max-changed-words", "", "")
+	jsonOut := fs.Bool("json", false, "")
+	paths, err := parseInterspersed(fs, []string{"old.epub", "-json", "new.epub", "-max-changed-words", "2%"})
+	if err != nil {
+		t.Fatalf("parseInterspersed: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != "old.epub" || paths[1] != "new.epub" || *limit != "2%" || !*jsonOut {
+		t.Fatalf("got paths %q, limit %q, json %v", paths, *limit, *jsonOut)
+	}
+}
+
+func TestLoadPipelineSpec(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	spec, err := loadPipelineSpec(write("ok.yaml", `{"steps": [["typo", "-lang", "en"], ["cleanup"]]}`))
+	if err != nil {
+		t.Fatalf("loadPipelineSpec: %v", err)
+	}
+	if len(spec.Steps) != 2 || spec.Steps[0][2] != "en" {
+		t.Fatalf("spec = %+v", spec)
+	}
+
+	for name, content := range map[string]string{
+		"block.yaml":   "steps:\n  - [typo]\n",
+		"merge.json":   `{"steps": [["merge", "a.epub"]]}`,
+		"out.json":     `{"steps": [["typo", "-o", "x.epub"]]}`,
+		"unknown.json": `{"steps": [["typo"]], "stpes": []}`,
+		"empty.json":   `{"steps": []}`,
+	} {
+		if _, err := loadPipelineSpec(write(name, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// The usage lists every command a step may run.
+	for name := range pipelineCommands {
+		if !regexp.MustCompile(`\b` + name + `\b`).MatchString(usageTest) {
+			t.Errorf("usage does not list the %s step", name)
+		}
+	}
+}
+
+func TestRulesUnpackRefusesPathName(t *testing.T) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	if err := os.Mkdir(work, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(work)
+	pack := filepath.Join(dir, "evil.novrules")
+	err := epub.WriteRulePack(&epub.RulePack{
+		Manifest: epub.RulePackManifest{Name: "../escape", Version: "1.0.0"},
+		Rules:    []epub.RewriteRule{{Find: "a", Replace: "b"}},
+	}, pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &globalFlags{quiet: true}
+	if err := runRulesUnpack(g, []string{pack}); err == nil {
+		t.Fatal("unpacked into a directory named by the pack")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape-1.0.0")); !os.IsNotExist(err) {
+		t.Fatalf("pack escaped the working directory: %v", err)
+	}
+	if err := runRulesUnpack(g, []string{"-o", "mine", pack}); err != nil {
+		t.Fatalf("unpack with -o: %v", err)
+	}
+}
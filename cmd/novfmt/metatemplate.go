@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// templateExclusive are the edit-meta flags that make sense for one book
+// only and so cannot be combined with -template.
+var templateExclusive = []string{
+	"out", "o", "meta", "identifier", "new-uuid", "nav", "dump-meta", "dump-nav",
+	"dump-toc", "apply-toc", "import-meta", "export-meta", "list-sources", "list-volumes",
+	"drop-spine", "move-spine", "insert-xhtml", "start",
+}
+
+func checkTemplateFlags(set map[string]bool) error {
+	var bad []string
+	for _, name := range templateExclusive {
+		if set[name] {
+			bad = append(bad, "-"+name)
+		}
+	}
+	if len(bad) > 0 {
+		return usageErrorf("edit-meta: -template cannot be combined with %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// templateResult is one book's outcome in edit-meta -template -json.
+type templateResult struct {
+	Path    string          `json:"path"`
+	Skipped bool            `json:"skipped,omitempty"`
+	Changes *epub.Changeset `json:"changes,omitempty"`
+}
+
+// editMetaTemplate fills in a metadata template for each book given as an
+// argument or found with -dir and edits the book in place.
+func editMetaTemplate(ctx context.Context, g *globalFlags, args, dirs []string, templatePath, pattern string, opts epub.EditOptions, applyFlags func(*epub.MetadataPatch) error) error {
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return fmt.Errorf("read template: %w", err)
+	}
+	tmpl, err := epub.ParseMetadataTemplate(data, pattern)
+	if err != nil {
+		return err
+	}
+
+	inputs := append([]string(nil), args...)
+	if len(dirs) > 0 {
+		found, err := expandDirectories(ctx, dirs)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, found...)
+	}
+	if len(inputs) == 0 {
+		return usageErrorf("edit-meta -template requires EPUB paths or -dir")
+	}
+	g.inputs = inputs
+
+	log := g.logger(os.Stderr)
+	var results []templateResult
+	edited := 0
+	for _, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		patch, ok, err := tmpl.Patch(input)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Warn("file name does not match -pattern; skipped", "path", input)
+			results = append(results, templateResult{Path: input, Skipped: true})
+			continue
+		}
+		if err := applyFlags(&patch); err != nil {
+			return err
+		}
+		bookOpts := opts
+		bookOpts.MetadataPatch = patch
+		bookOpts.OutPath = ""
+		cs, err := epub.EditEPUB(ctx, input, bookOpts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", input, err)
+		}
+		edited++
+		results = append(results, templateResult{Path: input, Changes: &cs})
+		if !g.quiet && !g.json {
+			fmt.Fprintf(os.Stderr, "edit-meta: %s: %s\n", input, describeChangeset(cs))
+		}
+	}
+	if g.json {
+		return g.printJSON(results)
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "edit-meta: %d of %d books edited\n", edited, len(inputs))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageNotes = `Notes:
+  novfmt notes [options] <book.epub>
+
+  Finds footnotes and endnotes however the source marked them up (numbers
+  in <sup>, [1] and * links, links with a note class) and makes them
+  consistent: references become epub:type="noteref" links and notes become
+  pop-up footnotes that readers show in place. With -endnotes every note
+  moves into one endnotes chapter at the end of the book instead. Links
+  from a note back to its reference are fixed either way. Without -out the
+  input file is modified in place.
+
+  -endnotes             gather all notes into an endnotes chapter
+  -title <text>         heading of the endnotes chapter (default: Notes)
+  -translator-notes     also turn "TL note:" / "T/N:" paragraphs into notes,
+                        referenced from the end of the paragraph before them
+  -dry-run              list the notes without writing anything
+  -json                 print the notes, broken references and whether the
+                        book was written as JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runNotes(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("notes", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageNotes) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	endnotes := fs.Bool("endnotes", false, "")
+	title := fs.String("title", "", "")
+	translator := fs.Bool("translator-notes", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("notes requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	res, err := epub.RestructureNotes(ctx, fs.Arg(0), epub.NotesOptions{
+		Endnotes:        *endnotes,
+		Title:           *title,
+		TranslatorNotes: *translator,
+		OutPath:         *out,
+		DryRun:          *dryRun,
+		Logger:          g.logger(os.Stderr),
+		Progress:        progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(res)
+	}
+	if *dryRun {
+		for _, n := range res.Notes {
+			fmt.Printf("%s -> %s  %s\n", strings.Join(n.Refs, ", "), n.Note, n.Text)
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "notes: %d notes, %d broken references; %s\n", len(res.Notes), len(res.Broken), describeChangeset(res.Changeset))
+	}
+	return nil
+}
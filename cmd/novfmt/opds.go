@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageOPDS = `OPDS:
+  novfmt opds [options] -dir <library>
+
+  Scans a directory (and its subdirectories) for EPUB files and writes a
+  static OPDS catalog of them, ready for any web server: a navigation feed
+  (catalog.xml for OPDS 1.2, catalog.json for OPDS 2.0) leading to every
+  book by title and to the books of each author. Titles, authors, language,
+  publisher, dates, descriptions and subjects come from each book's
+  metadata; covers are copied to covers/. Books that cannot be read are
+  reported and left out.
+
+  -dir <path>           library directory (or give it as the argument)
+  -out <dir>            where to write the catalog (default: the library
+                        directory); serve books and catalog from one root
+  -title <text>         catalog title (default: "novfmt library")
+  -format <f>           1.2, 2.0 or both (default: both)
+  -search-url <url>     OpenSearch template with {searchTerms} for a search
+                        service; a static catalog has no search without one
+  -json                 print the cataloged books and files written as JSON
+`
+
+func runOPDS(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("opds", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageOPDS) }
+
+	dir := fs.String("dir", "", "")
+	out := fs.String("out", "", "")
+	title := fs.String("title", "", "")
+	format := fs.String("format", "both", "")
+	searchURL := fs.String("search-url", "", "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case *dir != "" && fs.NArg() > 0:
+		return usageErrorf("opds takes -dir or a directory argument, not both")
+	case *dir == "" && fs.NArg() == 1:
+		*dir = fs.Arg(0)
+	case *dir == "" || fs.NArg() > 1:
+		return usageErrorf("opds requires exactly one library directory")
+	}
+	var versions []string
+	switch *format {
+	case "both":
+		versions = []string{epub.OPDS12, epub.OPDS20}
+	case epub.OPDS12, epub.OPDS20:
+		versions = []string{*format}
+	default:
+		return usageErrorf("unknown -format %q (want 1.2, 2.0 or both)", *format)
+	}
+
+	progress, done := g.progressFunc([]string{epub.StageLoad}, []float64{1})
+	cat, err := epub.BuildOPDSCatalog(ctx, *dir, epub.OPDSOptions{
+		OutDir:    *out,
+		Title:     *title,
+		Versions:  versions,
+		SearchURL: *searchURL,
+		Logger:    g.logger(os.Stderr),
+		Progress:  progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(cat)
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "opds: %d books cataloged, %d skipped; wrote %d files\n", len(cat.Books), len(cat.Skipped), len(cat.Files))
+	}
+	return nil
+}
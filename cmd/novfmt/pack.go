@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageUnpack = `Unpack:
+  novfmt unpack [options] <book.epub> <dir>
+
+  Extracts a book into a directory for editing by hand, exactly as the
+  archive holds it: nothing is repaired. The directory must be empty or
+  not exist yet. Pack it again with novfmt pack.
+`
+
+const usagePack = `Pack:
+  novfmt pack [options] <dir> <book.epub>
+
+  Zips an unpacked book the way readers require: the mimetype entry first
+  and uncompressed, then the rest. Clutter such as .DS_Store, Thumbs.db,
+  __MACOSX, .git and editor backups (*~, *.swp) is left out. The packed
+  book is then validated as validate would, and the command fails when
+  errors are found; the book is written either way. Packed to stdout
+  ("-"), the book is held in memory and validated before it is written,
+  and the issues go to stderr.
+
+  -no-validate          skip validating the packed book
+  -json                 print the validation report as JSON
+`
+
+func runUnpack(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageUnpack) }
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		return usageErrorf("unpack requires an EPUB path and a directory")
+	}
+	inputs, err := g.fetchInputs(ctx, paths[:1])
+	if err != nil {
+		return err
+	}
+	g.inputs = inputs
+
+	files, err := epub.Unpack(ctx, inputs[0], paths[1], epub.UnpackOptions{Logger: g.logger(os.Stderr)})
+	if err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "unpack: extracted %d files to %s\n", files, paths[1])
+	}
+	return nil
+}
+
+func runPack(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usagePack) }
+
+	noValidate := fs.Bool("no-validate", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		return usageErrorf("pack requires a directory and an EPUB path")
+	}
+	if *asJSON && *noValidate {
+		return usageErrorf("-json prints the validation report; it cannot be combined with -no-validate")
+	}
+	if paths[1] == epub.StreamPath {
+		if err := g.checkStdout("pack"); err != nil {
+			return err
+		}
+	}
+
+	progress, done := g.progressFunc([]string{epub.StageZip}, []float64{1})
+	report, err := epub.Pack(ctx, paths[0], paths[1], epub.PackOptions{
+		NoValidate: *noValidate,
+		Logger:     g.logger(os.Stderr),
+		Progress:   progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err := g.printJSON(report); err != nil {
+			return err
+		}
+	} else if !g.quiet {
+		// The book itself may be on stdout.
+		w := os.Stdout
+		if paths[1] == epub.StreamPath {
+			w = os.Stderr
+		}
+		for _, issue := range report.Issues {
+			where := ""
+			if issue.Href != "" {
+				where = issue.Href + ": "
+			}
+			fmt.Fprintf(w, "%s %s: %s%s\n", issue.Severity, issue.Check, where, issue.Message)
+		}
+		summary := fmt.Sprintf("pack: wrote %s", paths[1])
+		if !*noValidate {
+			summary += fmt.Sprintf("; %d errors, %d warnings", report.Errors, report.Warnings)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	if !report.Valid() {
+		return checkFailedf("pack: the packed book has %d errors", report.Errors)
+	}
+	return nil
+}
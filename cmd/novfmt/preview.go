@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// previewServer serves the proposed changes of a dry-run rewrite and applies
+// the subset of files approved in the browser. Every request must carry
+// the session token from the URL it prints and name a loopback host, so
+// that neither another page in the browser nor a DNS-rebinding site can
+// read the preview or write the book.
+type previewServer struct {
+	ctx     context.Context
+	input   string
+	opts    epub.RewriteOptions
+	preview epub.RewriteStats
+	token   string
+
+	// done receives the outcome once the user applies or cancels.
+	done chan previewResult
+
+	mu       sync.Mutex
+	finished bool
+}
+
+type previewResult struct {
+	stats   epub.RewriteStats
+	applied bool
+	err     error
+}
+
+type previewSpan struct {
+	Prefix, Changed, Suffix string
+}
+
+type previewChange struct {
+	Before, After previewSpan
+	Rules         []string
+}
+
+type previewFile struct {
+	Href    string
+	Matches int
+	Changes []previewChange
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>novfmt rewrite preview</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 70em; }
+section { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0.5em 1em; }
+h2 { font-size: 1.1em; margin: 0.3em 0; }
+table { border-collapse: collapse; width: 100%; }
+td { vertical-align: top; padding: 0.3em; border-top: 1px solid #eee; width: 50%; white-space: pre-wrap; }
+del { background: #fdd; } ins { background: #dfd; text-decoration: none; }
+.rule { color: #666; white-space: normal; }
+.bar { position: sticky; top: 0; background: #fff; padding: 0.5em 0; }
+</style></head>
+<body>
+<h1>{{.Input}}</h1>
+<p>{{.Matches}} matches across {{len .Files}} files. Untick files to leave them unchanged.</p>
+<form method="post" action="/apply">
+<input type="hidden" name="token" value="{{.Token}}">
+{{range .Files}}<section>
+<h2><label><input type="checkbox" name="file" value="{{.Href}}" checked> {{.Href}}</label> ({{.Matches}} matches)</h2>
+<table>{{range .Changes}}<tr>
+<td>{{.Before.Prefix}}<del>{{.Before.Changed}}</del>{{.Before.Suffix}}</td>
+<td>{{.After.Prefix}}<ins>{{.After.Changed}}</ins>{{.After.Suffix}}{{range .Rules}}<br><small class="rule">{{.}}</small>{{end}}</td>
+</tr>{{end}}</table>
+</section>
+{{end}}<div class="bar"><button type="submit">Apply selected</button>
+<button type="submit" formaction="/cancel">Cancel</button></div>
+</form>
+</body></html>
+`))
+
+var previewDoneTemplate = template.Must(template.New("done").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>novfmt rewrite preview</title></head>
+<body><p>{{.}}</p><p>You can close this tab.</p></body></html>
+`))
+
+func newPreviewServer(ctx context.Context, input string, opts epub.RewriteOptions, preview epub.RewriteStats) *previewServer {
+	var token [16]byte
+	rand.Read(token[:])
+	return &previewServer{
+		ctx:     ctx,
+		input:   input,
+		opts:    opts,
+		preview: preview,
+		token:   hex.EncodeToString(token[:]),
+		done:    make(chan previewResult, 1),
+	}
+}
+
+func (s *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/" && r.Method == http.MethodGet:
+		s.serveIndex(w)
+	case r.URL.Path == "/apply" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.finished {
+			http.Error(w, "preview already closed", http.StatusConflict)
+			return
+		}
+		s.serveApply(w, r)
+	case r.URL.Path == "/cancel" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finish(previewResult{})
+		previewDoneTemplate.Execute(w, "Canceled; nothing was written.")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize checks that r comes from the preview page: it is addressed to a
+// loopback host, a form post comes from the same origin, and it carries
+// the session token.
+func (s *previewServer) authorize(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); !strings.EqualFold(host, "localhost") && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("preview is only served on localhost, not %q", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Errorf("cross-origin request from %q", origin)
+		}
+	}
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		token = r.PostFormValue("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return errors.New("missing or wrong preview token; open the URL novfmt printed")
+	}
+	return nil
+}
+
+func (s *previewServer) serveIndex(w http.ResponseWriter) {
+	files := make([]previewFile, 0, len(s.preview.Files))
+	for _, f := range s.preview.Files {
+		pf := previewFile{Href: f.Href, Matches: f.Matches}
+		for _, c := range f.Changes {
+			before, after := splitChange(c.Before, c.After)
+			pc := previewChange{Before: before, After: after}
+			for _, ref := range c.Rules {
+				pc.Rules = append(pc.Rules, ruleLabel(ref))
+			}
+			pf.Changes = append(pf.Changes, pc)
+		}
+		files = append(files, pf)
+	}
+	data := struct {
+		Input   string
+		Matches int
+		Files   []previewFile
+		Token   string
+	}{s.input, s.preview.MatchCount, files, s.token}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := previewTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *previewServer) serveApply(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	approved := map[string]bool{}
+	for _, href := range r.Form["file"] {
+		approved[href] = true
+	}
+	if len(approved) == 0 {
+		s.finish(previewResult{})
+		previewDoneTemplate.Execute(w, "No files selected; nothing was written.")
+		return
+	}
+
+	opts := s.opts
+	opts.DryRun = false
+	opts.FileFilter = func(href string) bool { return approved[href] }
+	stats, err := epub.RewriteEPUB(s.ctx, s.input, opts)
+	s.finish(previewResult{stats: stats, applied: true, err: err})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previewDoneTemplate.Execute(w, fmt.Sprintf("Applied %d matches across %d files.", stats.MatchCount, stats.FilesChanged))
+}
+
+// finish records the outcome; callers hold s.mu.
+func (s *previewServer) finish(res previewResult) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.done <- res
+}
+
+// ruleLabel describes which rule produced a change, e.g.
+// `glossary:Rem ×2 — names 1.2.0 by curator`.
+func ruleLabel(ref epub.RuleRef) string {
+	name := ref.ID
+	if name == "" {
+		name = fmt.Sprintf("%q", ref.Find)
+	}
+	label := fmt.Sprintf("%s ×%d", name, ref.Matches)
+	if ref.RuleSource != nil {
+		label += fmt.Sprintf(" — %s %s", ref.Pack, ref.Version)
+		if ref.Author != "" {
+			label += " by " + ref.Author
+		}
+	}
+	return label
+}
+
+// splitChange trims the common prefix and suffix of before and after so the
+// page can highlight only the part that differs.
+func splitChange(before, after string) (previewSpan, previewSpan) {
+	b, a := []rune(before), []rune(after)
+	p := 0
+	for p < len(b) && p < len(a) && b[p] == a[p] {
+		p++
+	}
+	sfx := 0
+	for sfx < len(b)-p && sfx < len(a)-p && b[len(b)-1-sfx] == a[len(a)-1-sfx] {
+		sfx++
+	}
+	return previewSpan{string(b[:p]), string(b[p : len(b)-sfx]), string(b[len(b)-sfx:])},
+		previewSpan{string(a[:p]), string(a[p : len(a)-sfx]), string(a[len(a)-sfx:])}
+}
+
+// runRewritePreview computes a dry run, serves it on addr and blocks until
+// the user applies or cancels in the browser, or ctx is canceled.
+func runRewritePreview(ctx context.Context, g *globalFlags, addr, input string, opts epub.RewriteOptions) error {
+	dry := opts
+	dry.DryRun = true
+	preview, err := epub.RewriteEPUB(ctx, input, dry)
+	if err != nil {
+		return err
+	}
+	if len(preview.Files) == 0 {
+		if !g.quiet {
+			fmt.Fprintln(os.Stderr, "rewrite: no matches; nothing to preview")
+		}
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", previewListenAddr(addr))
+	if err != nil {
+		return err
+	}
+	srv := newPreviewServer(ctx, input, opts, preview)
+	httpSrv := &http.Server{Handler: srv}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpSrv.Serve(ln) }()
+	fmt.Fprintf(os.Stderr, "rewrite: preview at http://%s/?token=%s (Ctrl-C to abort)\n", previewHost(ln.Addr()), srv.token)
+
+	var res previewResult
+	select {
+	case res = <-srv.done:
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		httpSrv.Close()
+		return ctx.Err()
+	}
+	// Let the handler that delivered the result finish its response.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpSrv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if g.quiet {
+		return nil
+	}
+	if !res.applied {
+		fmt.Fprintln(os.Stderr, "rewrite: no files approved; nothing written")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "rewrite: %d matches across %d files; %s\n", res.stats.MatchCount, res.stats.FilesChanged, describeChangeset(res.stats.Changeset))
+	return nil
+}
+
+// previewListenAddr returns the address to serve the preview on: addr, with
+// 127.0.0.1 for a missing host, so that ":8080" or "8080" does not listen
+// on every interface.
+func previewListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func previewHost(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		return fmt.Sprintf("localhost:%d", tcp.Port)
+	}
+	return addr.String()
+}
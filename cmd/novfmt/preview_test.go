@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+func TestSplitChange(t *testing.T) {
+	b, a := splitChange("Hello Tanaka-san!", "Hello Tanaka!")
+	if b.Prefix != "Hello Tanaka" || b.Changed != "-san" || b.Suffix != "!" {
+		t.Fatalf("before = %+v", b)
+	}
+	if a.Prefix != "Hello Tanaka" || a.Changed != "" || a.Suffix != "!" {
+		t.Fatalf("after = %+v", a)
+	}
+}
+
+func TestPreviewServerAppliesApprovedFiles(t *testing.T) {
+	input := writeTestEPUB(t, map[string]string{
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Foo one</p></body></html>`,
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Foo two</p></body></html>`,
+	})
+	opts := epub.RewriteOptions{Rules: []epub.RewriteRule{{Find: "Foo", Replace: "Bar"}}}
+	dry := opts
+	dry.DryRun = true
+	preview, err := epub.RewriteEPUB(context.Background(), input, dry)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+
+	srv := newPreviewServer(context.Background(), input, opts, preview)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/?token="+srv.token, nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, `value="a.xhtml"`) || !strings.Contains(body, "<del>Foo</del>") {
+		t.Fatalf("unexpected index page (%d):\n%s", rec.Code, body)
+	}
+
+	form := url.Values{"file": {"b.xhtml"}, "token": {srv.token}}
+	req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8080/apply", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://127.0.0.1:8080")
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply status %d: %s", rec.Code, rec.Body.String())
+	}
+	res := <-srv.done
+	if res.err != nil || !res.applied || res.stats.FilesChanged != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	again, err := epub.RewriteEPUB(context.Background(), input, dry)
+	if err != nil {
+		t.Fatalf("second dry run: %v", err)
+	}
+	if len(again.Files) != 1 || again.Files[0].Href != "a.xhtml" {
+		t.Fatalf("only b.xhtml should have been rewritten, remaining %+v", again.Files)
+	}
+}
+
+func TestPreviewServerRefusesForeignRequests(t *testing.T) {
+	srv := newPreviewServer(context.Background(), "book.epub", epub.RewriteOptions{}, epub.RewriteStats{})
+	post := func(target, origin string, form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	withToken := url.Values{"file": {"a.xhtml"}, "token": {srv.token}}
+	cases := []struct {
+		name, target, origin string
+		form                 url.Values
+	}{
+		{"no token", "http://127.0.0.1:8080/apply", "", url.Values{"file": {"a.xhtml"}}},
+		{"wrong token", "http://127.0.0.1:8080/apply", "", url.Values{"file": {"a.xhtml"}, "token": {"guess"}}},
+		{"other origin", "http://127.0.0.1:8080/apply", "http://evil.example", withToken},
+		{"rebound host", "http://evil.example:8080/apply", "http://evil.example:8080", withToken},
+		{"cancel without token", "http://localhost:8080/cancel", "", nil},
+	}
+	for _, c := range cases {
+		if code := post(c.target, c.origin, c.form); code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", c.name, code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("index without token: status %d, want 403", rec.Code)
+	}
+	select {
+	case res := <-srv.done:
+		t.Fatalf("a refused request finished the preview: %+v", res)
+	default:
+	}
+}
+
+func TestPreviewListenAddr(t *testing.T) {
+	for in, want := range map[string]string{":8080": "127.0.0.1:8080", "8080": "127.0.0.1:8080", "0.0.0.0:9000": "0.0.0.0:9000", "[::1]:80": "[::1]:80"} {
+		if got := previewListenAddr(in); got != want {
+			t.Errorf("previewListenAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRuleLabel(t *testing.T) {
+	got := ruleLabel(epub.RuleRef{ID: "glossary:Rem", Find: "Rem", Matches: 2, RuleSource: &epub.RuleSource{Pack: "names", Version: "1.2.0", Author: "curator"}})
+	if got != "glossary:Rem ×2 — names 1.2.0 by curator" {
+		t.Fatalf("pack rule label = %q", got)
+	}
+	if got := ruleLabel(epub.RuleRef{Find: "foo", Matches: 1}); got != `"foo" ×1` {
+		t.Fatalf("ad-hoc rule label = %q", got)
+	}
+}
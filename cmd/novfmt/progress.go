@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const progressWidth = 24
+
+var stageLabels = map[string]string{
+	epub.StageLoad:    "loading volume",
+	epub.StageCopy:    "copying volume",
+	epub.StageRewrite: "rewriting file",
+	epub.StageZip:     "zipping file",
+}
+
+// progressBar renders a single self-overwriting status line. Stages are
+// weighted so the overall percentage advances monotonically across them.
+type progressBar struct {
+	w       io.Writer
+	stages  []string
+	weights []float64
+	last    time.Time
+	drawn   bool
+}
+
+func newProgressBar(w io.Writer, stages []string, weights []float64) *progressBar {
+	return &progressBar{w: w, stages: stages, weights: weights}
+}
+
+// progressFunc returns the callback to hand to the epub package: progress
+// events with -output json, otherwise a progress bar, or nil when an
+// interactive display would garble output.
+func (g *globalFlags) progressFunc(stages []string, weights []float64) (epub.ProgressFunc, func()) {
+	if g.jsonLines() {
+		return g.stream().progress, func() {}
+	}
+	if g.quiet || g.verbose || g.veryVerbose || g.logJSON || !isTerminal(os.Stdout) || !isTerminal(os.Stderr) {
+		return nil, func() {}
+	}
+	bar := newProgressBar(os.Stderr, stages, weights)
+	return bar.update, bar.finish
+}
+
+func (b *progressBar) update(ev epub.ProgressEvent) {
+	now := time.Now()
+	final := ev.Total > 0 && ev.Done >= ev.Total
+	if !final && now.Sub(b.last) < 100*time.Millisecond {
+		return
+	}
+	b.last = now
+
+	overall := b.overall(ev)
+	filled := int(overall * progressWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", progressWidth-filled)
+
+	label := stageLabels[ev.Stage]
+	if label == "" {
+		label = ev.Stage
+	}
+	detail := fmt.Sprintf("%s %d/%d", label, min(ev.Done+1, ev.Total), ev.Total)
+	if final {
+		detail = fmt.Sprintf("%s %d/%d", label, ev.Total, ev.Total)
+	}
+	if ev.Item != "" {
+		detail += " " + truncateLeft(ev.Item, 40)
+	}
+	fmt.Fprintf(b.w, "\r[%s] %3.0f%% %s\x1b[K", bar, overall*100, detail)
+	b.drawn = true
+}
+
+func (b *progressBar) overall(ev epub.ProgressEvent) float64 {
+	var before, weight float64
+	for i, s := range b.stages {
+		if s == ev.Stage {
+			weight = b.weights[i]
+			break
+		}
+		before += b.weights[i]
+	}
+	frac := 0.0
+	if ev.Total > 0 {
+		frac = float64(ev.Done) / float64(ev.Total)
+	}
+	return min(before+weight*frac, 1)
+}
+
+func (b *progressBar) finish() {
+	if b.drawn {
+		fmt.Fprint(b.w, "\r\x1b[K")
+	}
+}
+
+func truncateLeft(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return "…" + string(r[len(r)-n+1:])
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageQuotes = `Quotes:
+  novfmt quotes [options] -to <locale> <book.epub>
+
+  Converts quotation marks and dashes from one locale's conventions to
+  another's, e.g. French « guillemets » to English “quotes”, or Japanese
+  「かぎ括弧」 to English quotes in a translation template:
+    en     “outer” ‘inner’, unspaced — dash
+    en-gb  ‘outer’ “inner”, spaced – dash
+    fr     « outer » “inner”, spaced – dash
+    de     „outer“ ‚inner‘, spaced – dash
+    es, it «outer» “inner”; es uses —, it a spaced –
+    pl     „outer” «inner», spaced – dash
+    ru     «outer» „inner“, spaced — dash
+    ja     「outer」『inner』, ―― dash
+    zh     “outer” ‘inner’, —— dash (zh-Hant: 「」『』)
+  Regional tags fall back to their language (en-US is en). Inner quotes
+  are only converted inside outer ones, and apostrophes are left alone.
+  Quotes must already be typographic; run typo first on straight quotes.
+  Without -out the input file is modified in place.
+
+  -from <locale>        source conventions (default: the book's dc:language)
+  -to <locale>          target conventions (required)
+  -no-dashes            only convert quotes
+  -selector <sel>       only convert inside matching elements (tag, .class or
+                        tag.class); repeatable
+  -dry-run              print each changed text run without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runQuotes(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("quotes", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageQuotes) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	from := fs.String("from", "", "")
+	to := fs.String("to", "", "")
+	noDashes := fs.Bool("no-dashes", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	var selectors multiValue
+	fs.Var(&selectors, "selector", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("quotes requires exactly one EPUB path")
+	}
+	if *to == "" {
+		return usageErrorf("quotes requires -to")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.ConvertQuoteStyle(ctx, fs.Arg(0), epub.QuoteStyleOptions{
+		From:      *from,
+		To:        *to,
+		NoDashes:  *noDashes,
+		Selectors: selectors,
+		OutPath:   *out,
+		DryRun:    *dryRun,
+		Logger:    g.logger(os.Stderr),
+		Progress:  progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		printTextDiff(os.Stdout, stats.Files)
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "quotes: %d conversions across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
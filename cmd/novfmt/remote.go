@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// fetchInputs replaces the http and https URLs among inputs with their
+// downloaded copies, revalidating each against the server unless -offline
+// is set. Other inputs are returned as they are.
+func (g *globalFlags) fetchInputs(ctx context.Context, inputs []string) ([]string, error) {
+	opts := epub.RemoteOptions{CacheDir: g.cacheDir, Offline: g.offline}
+	resolved := make([]string, len(inputs))
+	for i, input := range inputs {
+		if !epub.IsRemote(input) {
+			resolved[i] = input
+			continue
+		}
+		fetch, err := epub.FetchRemote(ctx, input, opts)
+		if err != nil {
+			return nil, err
+		}
+		g.logger(os.Stderr).Info("remote input", "url", input, "status", fetch.Status, "path", fetch.Path)
+		resolved[i] = fetch.Path
+	}
+	return resolved, nil
+}
+
+// requireOutForRemote rejects editing a URL input in place, which would
+// only change the cached download.
+func requireOutForRemote(command, input, out string) error {
+	if epub.IsRemote(input) && out == "" {
+		return usageErrorf("%s: a URL input needs -out; the downloaded copy is only a cache", command)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+var usageRestyle = `Restyle:
+  novfmt restyle [options] <book.epub>
+
+  Replaces publisher styling with your own. -strip-css removes inline style
+  attributes, <style> elements and stylesheet rules except declarations of
+  allowlisted properties and rules styling ruby annotations; stylesheets
+  left empty are removed. -user-css adds a stylesheet linked from every
+  document after the publisher's. Without -out the input file is modified
+  in place.
+
+  -strip-css            strip publisher CSS
+  -keep-css <prop>      property that survives -strip-css; repeatable;
+                        replaces the default list:
+                        ` + strings.Join(epub.DefaultKeepCSS, ", ") + `
+  -user-css <file>      reading stylesheet to inject
+  -dry-run              list affected files without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runRestyle(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("restyle", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageRestyle) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	stripCSS := fs.Bool("strip-css", false, "")
+	userCSS := fs.String("user-css", "", "")
+	var keepCSS multiValue
+	fs.Var(&keepCSS, "keep-css", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("restyle requires exactly one EPUB path")
+	}
+	if !*stripCSS && *userCSS == "" {
+		return usageErrorf("restyle requires -strip-css or -user-css")
+	}
+	if len(keepCSS) > 0 && !*stripCSS {
+		return usageErrorf("-keep-css requires -strip-css")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.RestyleEPUB(ctx, fs.Arg(0), epub.RestyleOptions{
+		StripCSS: *stripCSS,
+		Keep:     keepCSS,
+		UserCSS:  *userCSS,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Printf("%s  %d edits\n", f.Href, f.Matches)
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "restyle: %d edits across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
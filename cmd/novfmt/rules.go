@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageRules = `Rules:
+  novfmt rules pack [options] <dir>
+  novfmt rules unpack [options] <pack.novrules>
+  novfmt rules show [options] <pack.novrules>
+
+  Rule packs bundle rewrite rules, a glossary, skip-selectors and a metadata
+  template with a versioned manifest so they can be shared and pinned. A pack
+  directory holds manifest.json (name, version, series, description, author)
+  and any of rules.json, glossary.json ([{"id","term","replace","ignore_case"}]),
+  skip-selectors.json (["rt", ".no-edit"]), scene-break.json
+  ({"marker": "<hr class=\"scene-break\"/>", "patterns": ["^~+$"]}) and
+  metadata.json (same format as edit-meta -meta).
+
+  pack:
+  -name <str>           override the manifest name
+  -version <x.y.z>      override the manifest version
+  -series <str>         override the target series
+  -o, -out <path>       output file (default: <name>-<version>.novrules)
+
+  unpack:
+  -o, -out <dir>        directory to extract into (default: <name>-<version>,
+                        refused unless it is a plain directory name)
+
+  show prints the manifest, what the pack holds and its metadata template.
+  -json                 print the whole pack as JSON
+
+  Use a pack with: novfmt rewrite -pack <file> [-pack-version <x.y.z>] book.epub
+  Rewrite reports (-report, -preview-web) attribute each change to the rule
+  id, pack name, version and author. Rules without an id are named rule-N
+  (position in rules.json) and glossary:<term>.
+`
+
+func runRules(ctx context.Context, g *globalFlags, args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usageRules)
+		return usageErrorf("rules requires a subcommand (pack, unpack, show)")
+	}
+	switch args[0] {
+	case "pack":
+		return runRulesPack(g, args[1:])
+	case "unpack":
+		return runRulesUnpack(g, args[1:])
+	case "show":
+		return runRulesShow(g, args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, usageRules)
+		return nil
+	default:
+		return usageErrorf("unknown rules subcommand %q (want pack, unpack, show)", args[0])
+	}
+}
+
+func newRulesFlagSet(g *globalFlags, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("rules "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageRules) }
+	return fs
+}
+
+func runRulesPack(g *globalFlags, args []string) error {
+	fs := newRulesFlagSet(g, "pack")
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	name := fs.String("name", "", "")
+	version := fs.String("version", "", "")
+	series := fs.String("series", "", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("rules pack requires exactly one directory")
+	}
+
+	pack, err := epub.LoadRulePackDir(fs.Arg(0), epub.RulePackManifest{
+		Name:    *name,
+		Version: *version,
+		Series:  *series,
+	})
+	if err != nil {
+		return err
+	}
+	dest := *out
+	if dest == "" {
+		dest = pack.Manifest.Name + "-" + pack.Manifest.Version + ".novrules"
+	}
+	if err := epub.WriteRulePack(pack, dest); err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "rules: wrote %s %s to %s\n", pack.Manifest.Name, pack.Manifest.Version, dest)
+	}
+	return nil
+}
+
+func runRulesUnpack(g *globalFlags, args []string) error {
+	fs := newRulesFlagSet(g, "unpack")
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("rules unpack requires exactly one pack file")
+	}
+
+	pack, err := epub.ReadRulePack(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	dir := *out
+	if dir == "" {
+		// The name comes from the pack, which may come from anyone: it
+		// must name a directory here, not a path elsewhere.
+		dir = pack.Manifest.Name + "-" + pack.Manifest.Version
+		if filepath.Base(dir) != dir || strings.ContainsAny(dir, `/\:`) || strings.HasPrefix(dir, ".") {
+			return fmt.Errorf("pack name %q is not a usable directory name; give -o", pack.Manifest.Name)
+		}
+	}
+	if err := epub.WriteRulePackDir(pack, dir); err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "rules: unpacked %s %s to %s\n", pack.Manifest.Name, pack.Manifest.Version, dir)
+	}
+	return nil
+}
+
+func runRulesShow(g *globalFlags, args []string) error {
+	fs := newRulesFlagSet(g, "show")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("rules show requires exactly one pack file")
+	}
+
+	pack, err := epub.ReadRulePack(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(pack)
+	}
+
+	m := pack.Manifest
+	fmt.Printf("%s %s\n", m.Name, m.Version)
+	if m.Series != "" {
+		fmt.Printf("  series:         %s\n", m.Series)
+	}
+	if m.Description != "" {
+		fmt.Printf("  description:    %s\n", m.Description)
+	}
+	if m.Author != "" {
+		fmt.Printf("  author:         %s\n", m.Author)
+	}
+	if m.Created != "" {
+		fmt.Printf("  created:        %s\n", m.Created)
+	}
+	fmt.Printf("  rules:          %d\n", len(pack.Rules))
+	fmt.Printf("  glossary:       %d\n", len(pack.Glossary))
+	fmt.Printf("  skip-selectors: %d\n", len(pack.SkipSelectors))
+	if pack.SceneBreak != nil {
+		fmt.Println("  scene-break:    yes")
+	}
+	if pack.Metadata != nil && !pack.Metadata.IsZero() {
+		data, err := json.MarshalIndent(pack.Metadata, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  metadata:\n    %s\n", data)
+	}
+	return nil
+}
+
+// loadRewritePack reads a rule pack for rewrite, enforcing an exact version
+// pin when one is given.
+func loadRewritePack(path, pin string) (*epub.RulePack, error) {
+	pack, err := epub.ReadRulePack(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pack: %w", err)
+	}
+	if pin != "" && pack.Manifest.Version != pin {
+		return nil, fmt.Errorf("pack %s is version %s, want %s", pack.Manifest.Name, pack.Manifest.Version, pin)
+	}
+	return pack, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// runRewriteTest runs the rewrite rules over sample text and prints each
+// rule that matched with the text before and after it.
+func runRewriteTest(g *globalFlags, load func() (epub.RewriteOptions, error), inline []string, samplesPath string) error {
+	opts, err := load()
+	if err != nil {
+		return err
+	}
+	if len(opts.Rules) == 0 {
+		return usageErrorf("rewrite -test requires -find, -rules, -preset or -pack")
+	}
+	var samples []epub.RuleSample
+	for _, text := range inline {
+		samples = append(samples, epub.RuleSample{Text: text})
+	}
+	if samplesPath != "" {
+		fileSamples, err := epub.LoadRuleSamples(samplesPath)
+		if err != nil {
+			return fmt.Errorf("read samples: %w", err)
+		}
+		samples = append(samples, fileSamples...)
+	}
+	if len(samples) == 0 {
+		return usageErrorf("rewrite -test requires -sample or -samples")
+	}
+
+	results, err := epub.TestRewriteRules(opts.Rules, opts.SkipSelectors, samples)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Failed {
+			failed++
+		}
+	}
+	if g.json {
+		if err := g.printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for i, r := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			where := ""
+			if r.Sample.Element != "" {
+				where = " in " + r.Sample.Element
+			}
+			fmt.Printf("sample %d%s: %q\n", i+1, where, r.Sample.Text)
+			for _, step := range r.Steps {
+				fmt.Printf("  %s: %q → %q\n", ruleLabel(step.Rule), step.Before, step.After)
+			}
+			if len(r.Steps) == 0 {
+				fmt.Println("  no rule matched")
+			}
+			switch {
+			case r.Failed:
+				fmt.Printf("FAIL  got  %q\n      want %q\n", r.Output, *r.Sample.Expect)
+			case r.Sample.Expect != nil:
+				fmt.Printf("ok    %q\n", r.Output)
+			default:
+				fmt.Printf("  =>  %q\n", r.Output)
+			}
+		}
+	}
+	if failed > 0 {
+		return checkFailedf("%d of %d samples differ from their expected output", failed, len(results))
+	}
+	if !g.quiet && !g.json {
+		fmt.Fprintf(os.Stderr, "rewrite: %d samples\n", len(results))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageSplitChapters = `Split-chapters:
+  novfmt split-chapters [options] <book.epub>
+
+  Splits spine documents larger than -max-size into several files, for
+  readers that slow down or fail on big XHTML files (common in web-novel
+  dumps). Documents are cut before chapter headings (h1–h6 unless the
+  global -headings detector says otherwise) where possible and between
+  paragraphs otherwise. The first part keeps the original file name; the
+  rest are added after it in the spine. Links and table of contents entries
+  pointing into a split document are updated to the part holding their
+  target. Without -out the input file is modified in place.
+
+  -max-size <size>      largest document to leave whole, e.g. 300KiB or 250KB
+                        (default: 300KiB)
+  -dry-run              list the splits without writing anything
+  -json                 print the splits and which files changed as JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runSplitChapters(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("split-chapters", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageSplitChapters) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	maxSize := fs.String("max-size", "300KiB", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("split-chapters requires exactly one EPUB path")
+	}
+	limit, err := epub.ParseByteSize(*maxSize)
+	if err != nil {
+		return usageErrorf("-max-size: %w", err)
+	}
+	headings, err := g.headingDetector()
+	if err != nil {
+		return err
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	res, err := epub.SplitChapters(ctx, fs.Arg(0), epub.SplitOptions{
+		MaxSize:  limit,
+		Headings: headings,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(res)
+	}
+	if *dryRun {
+		for _, s := range res.Splits {
+			fmt.Printf("%s  %s -> %s\n", s.Href, epub.FormatByteSize(s.Size), strings.Join(s.Parts, ", "))
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "split-chapters: %d documents split; %s\n", len(res.Splits), describeChangeset(res.Changeset))
+	}
+	return nil
+}
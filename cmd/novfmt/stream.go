@@ -0,0 +1,17 @@
+package main
+
+import "github.com/kototok903/novfmt/internal/epub"
+
+// toStdout reports whether a command editing input writes the book to
+// stdout: with -out -, or when it read the book from stdin and has no -out.
+func toStdout(input, out string) bool {
+	return out == epub.StreamPath || out == "" && input == epub.StreamPath
+}
+
+// checkStdout rejects printing JSON to stdout while the book goes there.
+func (g *globalFlags) checkStdout(command string) error {
+	if g.json {
+		return usageErrorf("%s: -json and -output json need stdout, where the book is written", command)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageTest = `Test:
+  novfmt test [options] -spec <pipeline.json> -corpus <dir> -golden <dir>
+
+  Runs a pipeline over every EPUB in the corpus directory and compares each
+  result with its golden output: the unpacked files in <golden>/<name>,
+  where <name> is the fixture's file name without .epub. Timestamps in
+  dcterms:modified are ignored. Exits non-zero if any fixture differs or a
+  step fails.
+
+  The spec is JSON (which YAML parsers also accept); each step is a novfmt
+  command run on one book, with its flags but without the book or -o.
+  Relative paths in steps are resolved from the spec's directory:
+
+    {"steps": [
+      ["rewrite", "-rules", "fixes.json"],
+      ["typo", "-lang", "en"],
+      ["transform", "-enable", "cleanup:0,scene-breaks"]
+    ]}
+
+  Edit steps change the book in place: edit-meta, rewrite, toc, typo,
+  quotes, cleanup, notes, invisible, duration, restyle, images,
+  writing-mode, transform, lang, cfi, hashes, validate, split-chapters and
+  join-chapters. A verify step is a check: it leaves the book as it is and
+  fails the fixture when the book does not pass, as does a validate step
+  with errors left or hashes -verify. An optional "headings" entry
+  names the chapter heading detector every step uses, as the global
+  -headings flag does:
+
+    {"headings": "headings.json", "steps": [["toc", "-depth", "1"]]}
+
+  -spec <file>          pipeline spec
+  -corpus <dir>         directory of fixture EPUBs
+  -golden <dir>         directory of expected outputs
+  -update               write the current outputs as the new golden files
+  -run <regexp>         only run fixtures whose name matches
+`
+
+// pipelineSpec is the pipeline run by novfmt test.
+type pipelineSpec struct {
+	// Headings is the heading detector file for every step, relative to
+	// the spec.
+	Headings string     `json:"headings,omitempty"`
+	Steps    [][]string `json:"steps"`
+}
+
+// pipelineCommands are the commands a pipeline step may run on the book
+// given as its last argument: each edits it in place, or, like verify,
+// checks it and fails the step when it does not pass.
+var pipelineCommands = map[string]bool{
+	"edit-meta":      true,
+	"rewrite":        true,
+	"toc":            true,
+	"typo":           true,
+	"quotes":         true,
+	"cleanup":        true,
+	"notes":          true,
+	"invisible":      true,
+	"duration":       true,
+	"restyle":        true,
+	"images":         true,
+	"writing-mode":   true,
+	"transform":      true,
+	"lang":           true,
+	"cfi":            true,
+	"hashes":         true,
+	"verify":         true,
+	"validate":       true,
+	"split-chapters": true,
+	"join-chapters":  true,
+}
+
+func loadPipelineSpec(path string) (*pipelineSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, fmt.Errorf("%s: pipeline specs are JSON (which is also valid YAML); block-style YAML is not supported", path)
+	}
+	var spec pipelineSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(spec.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	for i, step := range spec.Steps {
+		if len(step) == 0 || !pipelineCommands[step[0]] {
+			return nil, usageErrorf("%s: step %d: %q cannot run in a pipeline", path, i+1, strings.Join(step, " "))
+		}
+		for _, arg := range step[1:] {
+			if arg == "-o" || arg == "-out" || strings.HasPrefix(arg, "-o=") || strings.HasPrefix(arg, "-out=") {
+				return nil, usageErrorf("%s: step %d: steps edit the book in place and cannot use -o", path, i+1)
+			}
+		}
+	}
+	return &spec, nil
+}
+
+func runTest(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageTest) }
+
+	specPath := fs.String("spec", "", "")
+	corpus := fs.String("corpus", "", "")
+	golden := fs.String("golden", "", "")
+	update := fs.Bool("update", false, "")
+	run := fs.String("run", "", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *specPath == "" || *corpus == "" || *golden == "" {
+		return usageErrorf("test requires -spec, -corpus and -golden")
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("test takes no positional arguments")
+	}
+	var filter *regexp.Regexp
+	if *run != "" {
+		var err error
+		if filter, err = regexp.Compile(*run); err != nil {
+			return usageErrorf("invalid -run: %w", err)
+		}
+	}
+
+	spec, err := loadPipelineSpec(*specPath)
+	if err != nil {
+		return err
+	}
+	specDir, err := filepath.Abs(filepath.Dir(*specPath))
+	if err != nil {
+		return err
+	}
+	goldenDir, err := filepath.Abs(*golden)
+	if err != nil {
+		return err
+	}
+	fixtures, err := filepath.Glob(filepath.Join(*corpus, "*.epub"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(fixtures)
+
+	tmpDir, err := os.MkdirTemp("", "novfmt-test-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Steps run quietly unless more detail was asked for.
+	stepFlags := *g
+	if !g.verbose && !g.veryVerbose {
+		stepFlags.quiet = true
+	}
+
+	ran, failed := 0, 0
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), filepath.Ext(fixture))
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+		ran++
+		work := filepath.Join(tmpDir, filepath.Base(fixture))
+		if err := copyFile(fixture, work); err != nil {
+			return err
+		}
+		if err := runPipeline(ctx, &stepFlags, spec, specDir, work); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			continue
+		}
+		diffs, err := epub.CompareGolden(work, filepath.Join(goldenDir, name), *update)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		switch {
+		case len(diffs) == 0:
+			fmt.Printf("ok    %s\n", name)
+		case *update:
+			fmt.Printf("upd   %s (%d files)\n", name, len(diffs))
+		default:
+			failed++
+			fmt.Printf("FAIL  %s\n", name)
+			for _, d := range diffs {
+				fmt.Printf("  %s %s\n", d.Kind, d.Path)
+				for _, line := range strings.SplitAfter(d.Diff, "\n") {
+					if line != "" {
+						fmt.Print("    " + line)
+					}
+				}
+			}
+		}
+	}
+	if ran == 0 {
+		return fmt.Errorf("no fixtures in %s", *corpus)
+	}
+	if failed > 0 {
+		return checkFailedf("test: %d of %d fixtures failed", failed, ran)
+	}
+	if !g.quiet {
+		if *update {
+			fmt.Fprintf(os.Stderr, "test: golden output for %d fixtures is up to date\n", ran)
+		} else {
+			fmt.Fprintf(os.Stderr, "test: %d fixtures passed\n", ran)
+		}
+	}
+	return nil
+}
+
+// runPipeline runs every step of spec on book from specDir, so that paths
+// in the steps resolve against the spec.
+func runPipeline(ctx context.Context, g *globalFlags, spec *pipelineSpec, specDir, book string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(specDir); err != nil {
+		return err
+	}
+	defer os.Chdir(cwd)
+	if spec.Headings != "" {
+		local := *g
+		local.headings = spec.Headings
+		g = &local
+	}
+	for i, step := range spec.Steps {
+		args := append(append([]string(nil), step[1:]...), book)
+		if err := runCommand(ctx, g, step[0], args); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step[0], err)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
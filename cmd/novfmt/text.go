@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageText = `Text:
+  novfmt text [options] <book.epub>
+
+  Exports the visible text of the book in reading order, one paragraph per
+  line with a blank line between chapters.
+
+  -ruby <mode>          how ruby (furigana) appears: strip (base text only,
+                        the default), paren (漢字（かんじ）) or keep
+  -o, -out <path>       write to a file instead of stdout
+`
+
+func runText(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("text", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageText) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	ruby := fs.String("ruby", epub.RubyStrip, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("text requires exactly one EPUB path")
+	}
+	if _, err := epub.ParseRubyMode(*ruby); err != nil {
+		return err
+	}
+
+	opts := epub.TextExportOptions{Ruby: *ruby, Logger: g.logger(os.Stderr)}
+	if *out == "" {
+		return epub.ExportText(ctx, fs.Arg(0), os.Stdout, opts)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := epub.ExportText(ctx, fs.Arg(0), f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageTOC = `Toc:
+  novfmt toc [options] <book.epub>
+  novfmt toc -edit [-o <path>] <book.epub>
+
+  Regenerates the nav table of contents from the headings in the spine:
+  h1–h6 unless the global -headings detector says otherwise. Without -out
+  the input file is modified in place. Other nav sections (landmarks,
+  page-list) are kept. With -edit the current TOC is listed with numbers
+  and changed with one-letter commands at a prompt (h lists them); w
+  writes the result.
+
+  -depth <n>            number of heading levels to include, counted from the
+                        highest level used in the book (default: 3)
+  -include <regex>      only keep headings whose text matches (overrides the
+                        detector's match)
+  -exclude <regex>      drop headings whose text matches (overrides the
+                        detector's exclude)
+  -edit                 edit the existing TOC from the keyboard instead: rename,
+                        reorder, nest, un-nest and delete entries, then write
+                        the nav (and the NCX, if the book has one)
+  -dry-run              print the generated TOC without writing anything
+  -json                 print the TOC and which files changed as JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runTOC(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("toc", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageTOC) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	depth := fs.Int("depth", 3, "")
+	include := fs.String("include", "", "")
+	exclude := fs.String("exclude", "", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	edit := fs.Bool("edit", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("toc requires exactly one EPUB path")
+	}
+	if *edit {
+		if *dryRun || *asJSON {
+			return usageErrorf("toc: -edit cannot be combined with -dry-run or -json")
+		}
+		return editTOC(ctx, g, fs.Arg(0), *out)
+	}
+
+	headings, err := g.headingDetector()
+	if err != nil {
+		return err
+	}
+	if *include != "" {
+		headings.Match = *include
+	}
+	if *exclude != "" {
+		headings.Exclude = *exclude
+	}
+
+	res, err := epub.RegenerateTOC(ctx, fs.Arg(0), epub.TOCOptions{
+		MaxDepth: *depth,
+		Headings: headings,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(res)
+	}
+	if *dryRun {
+		printNavTree(os.Stdout, res.Items, 0)
+		return nil
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "toc: %d entries; %s\n", countNavItems(res.Items), describeChangeset(res.Changeset))
+	}
+	return nil
+}
+
+// editTOC runs the table of contents editor on the book at input.
+func editTOC(ctx context.Context, g *globalFlags, input, out string) error {
+	items, err := epub.ReadTOC(ctx, input)
+	if err != nil {
+		return err
+	}
+	items, write, err := runTOCEditor(os.Stdin, os.Stdout, items)
+	if err != nil || !write {
+		return err
+	}
+	cs, err := epub.EditEPUB(ctx, input, epub.EditOptions{
+		OutPath:       out,
+		TOC:           items,
+		TouchModified: true,
+		Logger:        g.logger(os.Stderr),
+	})
+	if err != nil {
+		return err
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "toc: %d entries; %s\n", countNavItems(items), describeChangeset(cs))
+	}
+	return nil
+}
+
+func printNavTree(w io.Writer, items []epub.NavItem, depth int) {
+	for _, item := range items {
+		fmt.Fprintf(w, "%s%s  (%s)\n", strings.Repeat("  ", depth), item.Title, item.Href)
+		printNavTree(w, item.Children, depth+1)
+	}
+}
+
+func countNavItems(items []epub.NavItem) int {
+	n := len(items)
+	for _, item := range items {
+		n += countNavItems(item.Children)
+	}
+	return n
+}
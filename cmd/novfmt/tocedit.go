@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const tocEditorHelp = `Commands (N is an entry number from the list):
+  r N <title>   rename entry N
+  u N, d N      move entry N up or down among its siblings
+  i N           nest entry N under the entry before it
+  o N           move entry N out of its parent, to just after it
+  x N           delete entry N and the entries nested under it
+  l             list the entries again
+  w             write the book and quit
+  q             quit without writing
+`
+
+// tocEditor edits a table of contents tree in place.
+type tocEditor struct {
+	items []epub.NavItem
+}
+
+// tocPos is where an entry sits: its index in a list of siblings, and
+// where the entry owning that list sits (nil at the top level).
+type tocPos struct {
+	list   *[]epub.NavItem
+	index  int
+	parent *tocPos
+}
+
+func (p *tocPos) item() *epub.NavItem { return &(*p.list)[p.index] }
+
+// locate finds entry n, counting from 1 in list order.
+func (e *tocEditor) locate(n int) (*tocPos, error) {
+	if n >= 1 {
+		if pos := locateTOCEntry(&e.items, nil, &n); pos != nil {
+			return pos, nil
+		}
+	}
+	return nil, fmt.Errorf("no entry %d", n)
+}
+
+func locateTOCEntry(list *[]epub.NavItem, parent *tocPos, n *int) *tocPos {
+	for i := range *list {
+		pos := &tocPos{list: list, index: i, parent: parent}
+		if *n--; *n == 0 {
+			return pos
+		}
+		if found := locateTOCEntry(&(*list)[i].Children, pos, n); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func removeTOCEntry(pos *tocPos) epub.NavItem {
+	item := *pos.item()
+	*pos.list = append((*pos.list)[:pos.index], (*pos.list)[pos.index+1:]...)
+	return item
+}
+
+// apply runs one editor command. It reports whether the tree changed.
+func (e *tocEditor) apply(cmd string, n int, arg string) (bool, error) {
+	pos, err := e.locate(n)
+	if err != nil {
+		return false, err
+	}
+	list := *pos.list
+	switch cmd {
+	case "r":
+		if arg == "" {
+			return false, fmt.Errorf("r %d needs a title", n)
+		}
+		pos.item().Title = arg
+	case "u":
+		if pos.index == 0 {
+			return false, fmt.Errorf("entry %d is already first", n)
+		}
+		list[pos.index-1], list[pos.index] = list[pos.index], list[pos.index-1]
+	case "d":
+		if pos.index == len(list)-1 {
+			return false, fmt.Errorf("entry %d is already last", n)
+		}
+		list[pos.index+1], list[pos.index] = list[pos.index], list[pos.index+1]
+	case "i":
+		if pos.index == 0 {
+			return false, fmt.Errorf("entry %d has no entry before it to nest under", n)
+		}
+		item := removeTOCEntry(pos)
+		prev := &(*pos.list)[pos.index-1]
+		prev.Children = append(prev.Children, item)
+	case "o":
+		if pos.parent == nil {
+			return false, fmt.Errorf("entry %d is not nested", n)
+		}
+		item := removeTOCEntry(pos)
+		outer := pos.parent
+		at := outer.index + 1
+		*outer.list = append((*outer.list)[:at], append([]epub.NavItem{item}, (*outer.list)[at:]...)...)
+	case "x":
+		removeTOCEntry(pos)
+	default:
+		return false, fmt.Errorf("unknown command %q", cmd)
+	}
+	return true, nil
+}
+
+// print lists the entries numbered as the commands address them.
+func (e *tocEditor) print(w io.Writer) {
+	n := 0
+	var walk func(items []epub.NavItem, depth int)
+	walk = func(items []epub.NavItem, depth int) {
+		for _, item := range items {
+			n++
+			fmt.Fprintf(w, "%3d  %s%s  (%s)\n", n, strings.Repeat("  ", depth), item.Title, item.Href)
+			walk(item.Children, depth+1)
+		}
+	}
+	walk(e.items, 0)
+}
+
+// runTOCEditor lets the user edit items with commands read from r, and
+// returns the edited tree and whether to write it.
+func runTOCEditor(r io.Reader, w io.Writer, items []epub.NavItem) ([]epub.NavItem, bool, error) {
+	e := &tocEditor{items: items}
+	e.print(w)
+	fmt.Fprint(w, "\n"+tocEditorHelp)
+	in := bufio.NewScanner(r)
+	changed := false
+	for {
+		fmt.Fprint(w, "toc> ")
+		if !in.Scan() {
+			if err := in.Err(); err != nil {
+				return nil, false, err
+			}
+			// Input ended without w or q: keep the book as it was.
+			fmt.Fprintln(w)
+			return e.items, false, nil
+		}
+		fields := strings.Fields(in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch cmd := fields[0]; cmd {
+		case "w":
+			if len(e.items) == 0 {
+				fmt.Fprintln(w, "the table of contents cannot be empty")
+				continue
+			}
+			return e.items, changed, nil
+		case "q":
+			return e.items, false, nil
+		case "l":
+			e.print(w)
+		case "h", "?":
+			fmt.Fprint(w, tocEditorHelp)
+		default:
+			if len(fields) < 2 {
+				fmt.Fprintf(w, "%s needs an entry number; h for help\n", cmd)
+				continue
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Fprintf(w, "%q is not an entry number\n", fields[1])
+				continue
+			}
+			ok, err := e.apply(cmd, n, strings.Join(fields[2:], " "))
+			if err != nil {
+				fmt.Fprintln(w, err)
+				continue
+			}
+			changed = changed || ok
+			e.print(w)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+func TestRunTOCEditor(t *testing.T) {
+	items := []epub.NavItem{
+		{Title: "Prologue", Href: "p.xhtml"},
+		{Title: "Chaptr 1", Href: "c1.xhtml"},
+		{Title: "Scene", Href: "c1.xhtml#s", Children: []epub.NavItem{{Title: "Beat", Href: "c1.xhtml#b"}}},
+		{Title: "Ads", Href: "ads.xhtml"},
+	}
+	script := strings.Join([]string{
+		"r 2 Chapter 1", // fix the typo
+		"i 3",           // nest Scene (and Beat) under Chapter 1
+		"o 4",           // move Beat out of Scene
+		"x 5",           // drop Ads
+		"d 1",           // put the prologue after Chapter 1
+		"u 9",           // no such entry: reported, ignored
+		"w",
+	}, "\n")
+	got, write, err := runTOCEditor(strings.NewReader(script), io.Discard, items)
+	if err != nil || !write {
+		t.Fatalf("write = %v, err = %v", write, err)
+	}
+	want := []epub.NavItem{
+		{Title: "Chapter 1", Href: "c1.xhtml", Children: []epub.NavItem{
+			{Title: "Scene", Href: "c1.xhtml#s"},
+			{Title: "Beat", Href: "c1.xhtml#b"},
+		}},
+		{Title: "Prologue", Href: "p.xhtml"},
+	}
+	if !sameNavTree(got, want) {
+		t.Fatalf("tree = %+v", got)
+	}
+
+	if _, write, _ := runTOCEditor(strings.NewReader("x 1\nq\n"), io.Discard, want); write {
+		t.Fatal("q should not write")
+	}
+}
+
+func sameNavTree(a, b []epub.NavItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Title != b[i].Title || a[i].Href != b[i].Href || !sameNavTree(a[i].Children, b[i].Children) {
+			return false
+		}
+	}
+	return true
+}
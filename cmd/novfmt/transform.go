@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageTransform = `Transform:
+  novfmt transform [options] -enable <chain> <book.epub>
+  novfmt transform -list
+
+  Runs several content transforms as one ordered chain: the book is
+  unpacked once, each document is read, passed through every transform in
+  turn, and written once. Without -out the input file is modified in place.
+
+  -enable <chain>       comma-separated transforms, each optionally with an
+                        argument after a colon (e.g. typo,ruby:strip,
+                        scene-breaks,cleanup:0); repeatable, order is kept
+  -list                 list available transforms and their arguments
+  -check-idempotent     check the chain's declared ordering and
+                        postconditions and that a second run would change
+                        nothing; fails without writing if a check does not
+                        hold
+  -repair-html          repair documents that are not well-formed XHTML
+                        first, as rewrite -repair-html does
+  -dry-run              list affected files without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runTransform(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("transform", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageTransform) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	var enable multiValue
+	fs.Var(&enable, "enable", "")
+	list := fs.Bool("list", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+	checkIdempotent := fs.Bool("check-idempotent", false, "")
+	repairHTML := fs.Bool("repair-html", false, "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *list {
+		for _, t := range epub.Transforms() {
+			fmt.Printf("%-14s %s\n", t.Name, t.Description)
+			if t.Arg != "" {
+				fmt.Printf("%-14s argument: %s\n", "", t.Arg)
+			}
+			if len(t.After) > 0 {
+				fmt.Printf("%-14s runs after: %s\n", "", strings.Join(t.After, ", "))
+			}
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("transform requires exactly one EPUB path")
+	}
+	if len(enable) == 0 {
+		return usageErrorf("transform requires -enable (see -list)")
+	}
+	steps, err := epub.ParseTransformChain(enable...)
+	if err != nil {
+		return err
+	}
+	headings, err := g.headingDetector()
+	if err != nil {
+		return err
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.TransformEPUB(ctx, fs.Arg(0), epub.TransformOptions{
+		Steps:           steps,
+		CheckIdempotent: *checkIdempotent,
+		RepairHTML:      *repairHTML,
+		Headings:        headings,
+		OutPath:         *out,
+		DryRun:          *dryRun,
+		Logger:          g.logger(os.Stderr),
+		Progress:        progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Printf("%s  %d edits\n", f.Href, f.Matches)
+		}
+	}
+	if !g.quiet {
+		printMarkupRepairs("transform", stats.RepairedHTML)
+		fmt.Fprintf(os.Stderr, "transform: %d edits across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
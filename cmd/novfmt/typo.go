@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageTypo = `Typo:
+  novfmt typo [options] <book.epub>
+
+  Normalizes typography in the text of every XHTML document: straight quotes
+  become curly ones, -- and --- become en and em dashes, ... becomes an
+  ellipsis, repeated spaces are collapsed and spacing around punctuation is
+  fixed. Conventions follow each element's language (lang/xml:lang, falling
+  back to the book's dc:language):
+    en   “double” ‘single’ quotes, no space before , . ; : ! ?
+    fr   « guillemets » and non-breaking spaces before ; : ! ?
+    ja   「かぎ括弧」, ―― dashes, …… ellipses, full-width ！？, no spaces
+         next to full-width punctuation
+    other languages only get dashes, ellipses and space collapsing.
+  Text inside code, pre, kbd, samp, script and style is never changed.
+  Without -out the input file is modified in place.
+
+  -lang <code>          language to use instead of the book's dc:language
+  -no-quotes            leave quotes alone
+  -no-dashes            leave -- and --- alone
+  -no-ellipsis          leave ... alone
+  -no-spacing           leave spaces alone
+  -skip-selector <sel>  also leave matching elements alone; repeatable
+  -dry-run              print each changed text run without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runTypo(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("typo", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageTypo) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	lang := fs.String("lang", "", "")
+	noQuotes := fs.Bool("no-quotes", false, "")
+	noDashes := fs.Bool("no-dashes", false, "")
+	noEllipsis := fs.Bool("no-ellipsis", false, "")
+	noSpacing := fs.Bool("no-spacing", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	var skipSelectors multiValue
+	fs.Var(&skipSelectors, "skip-selector", "")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("typo requires exactly one EPUB path")
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.NormalizeTypography(ctx, fs.Arg(0), epub.TypoOptions{
+		Language:      *lang,
+		NoQuotes:      *noQuotes,
+		NoDashes:      *noDashes,
+		NoEllipsis:    *noEllipsis,
+		NoSpacing:     *noSpacing,
+		SkipSelectors: skipSelectors,
+		OutPath:       *out,
+		DryRun:        *dryRun,
+		Logger:        g.logger(os.Stderr),
+		Progress:      progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		printTextDiff(os.Stdout, stats.Files)
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "typo: %d fixes across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
+
+// printTextDiff prints changed text runs as -/+ line pairs grouped by file.
+func printTextDiff(w io.Writer, files []epub.RewriteFileResult) {
+	for _, f := range files {
+		fmt.Fprintf(w, "--- %s\n", f.Href)
+		for _, c := range f.Changes {
+			fmt.Fprintf(w, "- %s\n+ %s\n", oneLine(c.Before), oneLine(c.After))
+		}
+	}
+}
+
+// oneLine flattens line breaks but keeps spaces, which may be what changed.
+func oneLine(s string) string {
+	return strings.Trim(strings.NewReplacer("\r", "", "\n", " ", "\t", " ").Replace(s), " ")
+}
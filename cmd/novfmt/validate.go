@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageValidate = `Validate:
+  novfmt validate [options] <book.epub>
+
+  Checks the structure of the book:
+    mimetype    the mimetype entry must come first in the archive, stored
+                uncompressed, with no extra field, and hold exactly
+                application/epub+zip (error; fixable)
+    encoding    a text file is not UTF-8 or has a byte order mark (error;
+                fixable for UTF-16, Windows-1252, ISO-8859-1, and with
+                iconv on PATH Shift_JIS and GBK, declarations included)
+    unicode     a text file is not in Unicode Normalization Form C
+                (warning; fixable)
+    manifest    files listed but missing (error; fixable by dropping the
+                item), files present but not listed (warning; fixable when
+                the media type is known), duplicate ids or hrefs and hrefs
+                differing only by case (warning; fixable)
+    file-name   a file name has spaces, percent-escapes or other characters
+                readers mishandle in links (warning; fixable by renaming it
+                and rewriting the links)
+    media-type  an image or font is declared with the wrong media type
+                (error; fixable from its content)
+    markup      an XHTML document is not well-formed XML, e.g. a bare &
+                or an unclosed tag (error; fixable by parsing it as HTML)
+    nav         an EPUB 3 navigation document lacks the nav property
+                (error; fixable)
+    scripts     <script> elements, on* event handlers, javascript: links
+                and JavaScript files (warning; removed by -strip-scripts),
+                and scripted properties that do not match a document
+                (error when missing, warning when extra; fixable)
+    spine       itemrefs naming no manifest item (error)
+    toc         neither a navigation document nor an NCX (error)
+  With -fix the fixable issues are repaired; without -out the input file is
+  then modified in place. The command fails while errors are left.
+  Options may also follow the file name. A book path of - reads the book
+  from stdin; a repaired book then goes to stdout, as with -out -, and the
+  report to stderr.
+
+  -fix                  repair what can be repaired
+  -strip-scripts        remove every script and JavaScript file, reporting
+                        each removal, e.g. to sanitize a book from an
+                        untrusted source before sideloading it; the book is
+                        saved as with -fix
+  -dry-run              with -fix or -strip-scripts, report without writing
+                        anything
+  -json                 print the report as JSON
+  -o, -out <path>       write report to a new file instead of editing in place
+`
+
+func runValidate(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageValidate) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	fix := fs.Bool("fix", false, "")
+	stripScripts := fs.Bool("strip-scripts", false, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 1 {
+		return usageErrorf("validate requires exactly one EPUB path")
+	}
+	if (*fix || *stripScripts) && !*dryRun {
+		if err := requireOutForRemote("validate", paths[0], *out); err != nil {
+			return err
+		}
+	}
+	if paths, err = g.fetchInputs(ctx, paths); err != nil {
+		return err
+	}
+	g.inputs = paths
+	// Issues move to stderr when the repaired book goes to stdout.
+	issueOut := os.Stdout
+	if (*fix || *stripScripts) && !*dryRun && toStdout(paths[0], *out) {
+		if err := g.checkStdout("validate"); err != nil {
+			return err
+		}
+		issueOut = os.Stderr
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.3, 0.7},
+	)
+	report, err := epub.Validate(ctx, paths[0], epub.ValidateOptions{
+		Fix:          *fix,
+		StripScripts: *stripScripts,
+		OutPath:      *out,
+		DryRun:       *dryRun,
+		Logger:       g.logger(os.Stderr),
+		Progress:     progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err := g.printJSON(report); err != nil {
+			return err
+		}
+	} else if !g.quiet {
+		for _, issue := range report.Issues {
+			where := ""
+			if issue.Href != "" {
+				where = issue.Href + ": "
+			}
+			fixed := ""
+			if issue.Fixed {
+				fixed = " (fixed)"
+			}
+			fmt.Fprintf(issueOut, "%s %s: %s%s%s\n", issue.Severity, issue.Check, where, issue.Message, fixed)
+		}
+		summary := fmt.Sprintf("validate: %d errors, %d warnings", report.Errors, report.Warnings)
+		if *fix || *stripScripts {
+			summary += "; " + describeChangeset(report.Changeset)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+
+	if !report.Valid() {
+		return checkFailedf("validate failed: %d errors", report.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+// watchInterval is how often -watch looks for changed files.
+const watchInterval = 500 * time.Millisecond
+
+// fileStamp is what -watch compares to notice a change: a missing file,
+// mid-save, has the zero stamp.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stampFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			stamps[i] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+	return stamps
+}
+
+// watchRewrite runs a dry-run rewrite of input, prints the report, and
+// runs it again whenever one of paths changes, until ctx is canceled.
+// load builds the options from the current files, so rule errors are
+// reported and the watch goes on.
+func watchRewrite(ctx context.Context, g *globalFlags, input string, paths []string, load func() (epub.RewriteOptions, error)) error {
+	run := func() {
+		opts, err := load()
+		if err == nil {
+			var stats epub.RewriteStats
+			stats, err = epub.RewriteEPUB(ctx, input, opts)
+			if err == nil {
+				if g.json {
+					g.printJSON(stats)
+				} else {
+					printTextDiff(os.Stdout, stats.Files)
+					printRuleTotals(os.Stdout, opts.Rules, stats.Files)
+				}
+				if !g.quiet {
+					fmt.Fprintf(os.Stderr, "rewrite: %s: %d matches across %d files; watching for changes\n", time.Now().Format("15:04:05"), stats.MatchCount, stats.FilesChanged)
+				}
+				return
+			}
+		}
+		if ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "rewrite: %s: %v; watching for changes\n", time.Now().Format("15:04:05"), err)
+		}
+	}
+
+	run()
+	last := stampFiles(paths)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		now := stampFiles(paths)
+		changed := false
+		for i := range now {
+			if now[i] != last[i] {
+				changed = true
+			}
+		}
+		last = now
+		if !changed {
+			continue
+		}
+		// Editors save in steps; wait for the files to settle.
+		time.Sleep(watchInterval / 5)
+		last = stampFiles(paths)
+		if !g.json && isTerminal(os.Stdout) {
+			fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J")
+		}
+		run()
+	}
+}
+
+// printRuleTotals lists each rule with its number of matches, so rules
+// that match nothing stand out.
+func printRuleTotals(w io.Writer, rules []epub.RewriteRule, files []epub.RewriteFileResult) {
+	if len(rules) == 0 {
+		return
+	}
+	type key struct{ id, find string }
+	totals := map[key]int{}
+	for _, f := range files {
+		for _, c := range f.Changes {
+			for _, ref := range c.Rules {
+				totals[key{ref.ID, ref.Find}] += ref.Matches
+			}
+		}
+	}
+	fmt.Fprintln(w, "rules:")
+	for _, r := range rules {
+		name := r.ID
+		if name == "" {
+			name = fmt.Sprintf("%q", r.Summary())
+		}
+		if n := totals[key{r.ID, r.Summary()}]; n > 0 {
+			fmt.Fprintf(w, "  %s ×%d\n", name, n)
+		} else {
+			fmt.Fprintf(w, "  %s  no matches\n", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kototok903/novfmt/internal/epub"
+)
+
+const usageWritingMode = `Writing-mode:
+  novfmt writing-mode [options] -mode <vertical|horizontal> <book.epub>
+
+  Converts a book between vertical (vertical-rl, right-to-left pages) and
+  horizontal (horizontal-tb, left-to-right pages) presentation. Switches
+  writing-mode declarations in stylesheets and style attributes, adds or
+  removes a stylesheet applying vertical writing to every document, and
+  sets the spine page-progression-direction and primary-writing-mode
+  metadata. Without -out the input file is modified in place.
+
+  -mode <mode>          vertical or horizontal (required)
+  -dry-run              list affected files without writing anything
+  -json                 print the changes and whether the book was written as
+                        JSON
+  -o, -out <path>       write result to a new file instead of editing in place
+`
+
+func runWritingMode(ctx context.Context, g *globalFlags, args []string) error {
+	fs := flag.NewFlagSet("writing-mode", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	g.register(fs)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageWritingMode) }
+
+	out := fs.String("out", "", "")
+	fs.StringVar(out, "o", "", "")
+	mode := fs.String("mode", "", "")
+	dryRun := fs.Bool("dry-run", false, "")
+	asJSON := g.jsonFlag(fs)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usageErrorf("writing-mode requires exactly one EPUB path")
+	}
+	if *mode == "" {
+		return usageErrorf("writing-mode requires -mode vertical or -mode horizontal")
+	}
+	if _, err := epub.ParseWritingMode(*mode); err != nil {
+		return err
+	}
+
+	progress, done := g.progressFunc(
+		[]string{epub.StageRewrite, epub.StageZip},
+		[]float64{0.6, 0.4},
+	)
+	stats, err := epub.SetWritingMode(ctx, fs.Arg(0), epub.WritingModeOptions{
+		Mode:     *mode,
+		OutPath:  *out,
+		DryRun:   *dryRun,
+		Logger:   g.logger(os.Stderr),
+		Progress: progress,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return g.printJSON(stats)
+	}
+	if *dryRun {
+		for _, f := range stats.Files {
+			fmt.Printf("%s  %d edits\n", f.Href, f.Matches)
+		}
+	}
+	if !g.quiet {
+		fmt.Fprintf(os.Stderr, "writing-mode: %d edits across %d files; %s\n", stats.MatchCount, stats.FilesChanged, describeChangeset(stats.Changeset))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package epub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema.org accessibility properties, as EPUB Accessibility 1.1 uses
+// them in the package metadata.
+const (
+	propAccessMode           = "schema:accessMode"
+	propAccessModeSufficient = "schema:accessModeSufficient"
+	propA11yFeature          = "schema:accessibilityFeature"
+	propA11yHazard           = "schema:accessibilityHazard"
+	propA11ySummary          = "schema:accessibilitySummary"
+)
+
+var (
+	accessModes = vocabulary("auditory chartOnVisual chemOnVisual colorDependent diagramOnTactile " +
+		"diagramOnVisual mathOnVisual musicOnVisual tactile textOnVisual textual visual")
+	a11yFeatures = vocabulary("alternativeText annotations ARIA audioDescription bookmarks braille " +
+		"captions ChemML describedMath displayTransformability fullRubyAnnotations highContrastAudio " +
+		"highContrastDisplay horizontalWriting index largePrint latex longDescription MathML none " +
+		"openCaptions pageBreakMarkers pageNavigation printPageNumbers readingOrder rubyAnnotations " +
+		"signLanguage structuralNavigation synchronizedAudioText tableOfContents tactileGraphic " +
+		"tactileObject timingControl transcript ttsMarkup unknown unlocked verticalWriting " +
+		"withAdditionalWordSegmentation withoutAdditionalWordSegmentation")
+	a11yHazards = vocabulary("flashing noFlashingHazard motionSimulation noMotionSimulationHazard " +
+		"sound noSoundHazard none unknown")
+)
+
+func vocabulary(words string) map[string]bool {
+	out := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		out[w] = true
+	}
+	return out
+}
+
+// accessibilityPresets fill in the accessibility metadata for common kinds
+// of book.
+var accessibilityPresets = map[string]func() MetadataPatch{
+	// text-only suits prose without images, audio or video whose table of
+	// contents and headings follow the reading order.
+	"text-only": func() MetadataPatch {
+		return MetadataPatch{
+			AccessModes:           &[]string{"textual"},
+			AccessModesSufficient: &[]string{"textual"},
+			AccessibilityFeatures: &[]string{"tableOfContents", "readingOrder", "structuralNavigation", "displayTransformability"},
+			AccessibilityHazards:  &[]string{"none"},
+			AccessibilitySummary: stringPtr("This publication is prose text without images, audio or video. " +
+				"It has a table of contents, headings that mark its structure and a logical reading order, " +
+				"and its text can be restyled by the reading system."),
+		}
+	},
+}
+
+// AccessibilityPreset returns the metadata patch of a named preset.
+func AccessibilityPreset(name string) (MetadataPatch, error) {
+	p, ok := accessibilityPresets[name]
+	if !ok {
+		names := make([]string, 0, len(accessibilityPresets))
+		for n := range accessibilityPresets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return MetadataPatch{}, fmt.Errorf("unknown accessibility preset %q (known: %s)", name, strings.Join(names, ", "))
+	}
+	return p(), nil
+}
+
+func stringPtr(s string) *string { return &s }
+
+// validateAccessibility checks the patch's accessibility values against the
+// schema.org vocabularies, so typos fail instead of ending up in the book.
+func validateAccessibility(p MetadataPatch) error {
+	check := func(field string, values *[]string, vocab map[string]bool, sets bool) error {
+		if values == nil {
+			return nil
+		}
+		for _, v := range *values {
+			parts := []string{v}
+			if sets {
+				parts = strings.Split(v, ",")
+			}
+			for _, part := range parts {
+				if !vocab[strings.TrimSpace(part)] {
+					return fmt.Errorf("%s: unknown value %q", field, strings.TrimSpace(part))
+				}
+			}
+			if (v == "none" || v == "unknown") && len(*values) > 1 {
+				return fmt.Errorf("%s: %q cannot be combined with other values", field, v)
+			}
+		}
+		return nil
+	}
+	if err := check("access mode", p.AccessModes, accessModes, false); err != nil {
+		return err
+	}
+	if err := check("sufficient access mode", p.AccessModesSufficient, accessModes, true); err != nil {
+		return err
+	}
+	if err := check("accessibility feature", p.AccessibilityFeatures, a11yFeatures, false); err != nil {
+		return err
+	}
+	return check("accessibility hazard", p.AccessibilityHazards, a11yHazards, false)
+}
+
+// applyAccessibilityPatch replaces the accessibility metadata the patch
+// sets. EPUB 2 packages get name/content metas, as EPUB Accessibility
+// recommends for them.
+func applyAccessibilityPatch(pkg *PackageDocument, p MetadataPatch) bool {
+	epub2 := strings.HasPrefix(strings.TrimSpace(pkg.Version), "2")
+	changed := false
+	set := func(prop string, values []string) {
+		kept := pkg.Metadata.Meta[:0]
+		for _, m := range pkg.Metadata.Meta {
+			if m.Property != prop && m.Name != prop {
+				kept = append(kept, m)
+			}
+		}
+		pkg.Metadata.Meta = kept
+		for _, v := range values {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if prop == propAccessModeSufficient {
+				v = strings.Join(strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }), ",")
+			}
+			if epub2 {
+				pkg.Metadata.Meta = append(pkg.Metadata.Meta, MetaNode{Name: prop, Content: v})
+			} else {
+				pkg.Metadata.Meta = append(pkg.Metadata.Meta, MetaNode{Property: prop, Value: v})
+			}
+		}
+		changed = true
+	}
+	if p.AccessModes != nil {
+		set(propAccessMode, *p.AccessModes)
+	}
+	if p.AccessModesSufficient != nil {
+		set(propAccessModeSufficient, *p.AccessModesSufficient)
+	}
+	if p.AccessibilityFeatures != nil {
+		set(propA11yFeature, *p.AccessibilityFeatures)
+	}
+	if p.AccessibilityHazards != nil {
+		set(propA11yHazard, *p.AccessibilityHazards)
+	}
+	if p.AccessibilitySummary != nil {
+		set(propA11ySummary, []string{*p.AccessibilitySummary})
+	}
+	return changed
+}
+
+// metaValues returns the values of every meta with the given property, in
+// either the EPUB 3 or the EPUB 2 form.
+func metaValues(meta Metadata, prop string) []string {
+	var out []string
+	for _, m := range meta.Meta {
+		switch {
+		case m.Property == prop:
+			out = append(out, strings.TrimSpace(m.Value))
+		case m.Name == prop:
+			out = append(out, strings.TrimSpace(m.Content))
+		}
+	}
+	return out
+}
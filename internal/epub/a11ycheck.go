@@ -0,0 +1,333 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// A11yRule is one accessibility check. Each issue costs Weight points of
+// the 100-point score, up to Cap points per rule, so that one widespread
+// problem does not hide every other.
+type A11yRule struct {
+	ID          string `json:"id"`
+	Severity    string `json:"severity"`
+	Weight      int    `json:"weight"`
+	Cap         int    `json:"cap"`
+	Description string `json:"description"`
+}
+
+var a11yRules = []A11yRule{
+	{"pkg-lang", SeverityError, 10, 10, "package has no dc:language"},
+	{"doc-lang", SeverityError, 5, 15, "document has no lang attribute"},
+	{"img-alt", SeverityError, 5, 30, "image has no alt text"},
+	{"empty-heading", SeverityError, 3, 15, "heading has no text"},
+	{"heading-order", SeverityWarning, 2, 10, "heading level is skipped"},
+	{"bold-heading", SeverityWarning, 1, 10, "bold paragraph looks like a heading"},
+	{"landmarks", SeverityWarning, 5, 10, "landmarks navigation is missing or incomplete"},
+	{"a11y-metadata", SeverityWarning, 5, 10, "schema.org accessibility metadata is missing"},
+}
+
+// A11yRules returns the checks A11yCheck runs.
+func A11yRules() []A11yRule {
+	return append([]A11yRule(nil), a11yRules...)
+}
+
+func lookupA11yRule(id string) A11yRule {
+	for _, r := range a11yRules {
+		if r.ID == id {
+			return r
+		}
+	}
+	panic("unknown accessibility rule " + id)
+}
+
+type A11yCheckOptions struct {
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+type A11yIssue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	// Href is empty for package-level issues.
+	Href    string `json:"href,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+type A11yReport struct {
+	// Score runs from 0 to 100.
+	Score    int            `json:"score"`
+	Errors   int            `json:"errors"`
+	Warnings int            `json:"warnings"`
+	Counts   map[string]int `json:"counts"`
+	Issues   []A11yIssue    `json:"issues"`
+	Files    int            `json:"files"`
+}
+
+func (r *A11yReport) add(rule, href string, line int, format string, args ...any) {
+	sev := lookupA11yRule(rule).Severity
+	r.Issues = append(r.Issues, A11yIssue{Rule: rule, Severity: sev, Href: href, Line: line, Message: fmt.Sprintf(format, args...)})
+	r.Counts[rule]++
+	if sev == SeverityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+func (r *A11yReport) score() {
+	r.Score = 100
+	for _, rule := range a11yRules {
+		r.Score -= min(rule.Cap, rule.Weight*r.Counts[rule.ID])
+	}
+	r.Score = max(r.Score, 0)
+}
+
+// A11yCheck audits the book for common accessibility problems: images
+// without alt text, missing language declarations, empty headings, skipped
+// heading levels, bold paragraphs standing in for headings, and missing
+// landmarks or accessibility metadata.
+func A11yCheck(ctx context.Context, input string, opts A11yCheckOptions) (A11yReport, error) {
+	report := A11yReport{Counts: map[string]int{}}
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	if firstDCValue(pkg.Metadata.Languages) == "" {
+		report.add("pkg-lang", "", 0, "the package has no dc:language")
+	}
+	var missing []string
+	for _, prop := range []string{propAccessMode, propAccessModeSufficient, propA11yFeature, propA11yHazard, propA11ySummary} {
+		if len(metaValues(pkg.Metadata, prop)) == 0 {
+			missing = append(missing, prop)
+		}
+	}
+	if len(missing) > 0 {
+		report.add("a11y-metadata", "", 0, "missing %s", strings.Join(missing, ", "))
+	}
+	if vol.NavHref == "" {
+		report.add("landmarks", "", 0, "the book has no EPUB 3 navigation document, so no landmarks")
+	} else {
+		landmarks, err := landmarkTypes(vol)
+		if err != nil {
+			return report, err
+		}
+		hasBody := false
+		for _, types := range landmarks {
+			for _, t := range types {
+				hasBody = hasBody || t == "bodymatter"
+			}
+		}
+		switch {
+		case len(landmarks) == 0:
+			report.add("landmarks", vol.NavHref, 0, "the navigation document has no landmarks nav")
+		case !hasBody:
+			report.add("landmarks", vol.NavHref, 0, "the landmarks nav has no bodymatter entry")
+		}
+	}
+
+	hrefs := spineHrefs(pkg)
+	for i, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		opts.Progress.report(StageRewrite, i, len(hrefs), href)
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return report, err
+		}
+		if err := checkDocumentA11y(&report, href, data); err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		report.Files++
+	}
+	opts.Progress.report(StageRewrite, len(hrefs), len(hrefs), "")
+	report.score()
+	return report, nil
+}
+
+// boldHeadingMaxRunes bounds the length of a bold paragraph that is taken
+// for a heading; longer ones are emphasis.
+const boldHeadingMaxRunes = 60
+
+type a11yHeading struct {
+	level int
+	line  int
+	text  strings.Builder
+	depth int
+}
+
+type a11yPara struct {
+	line int
+	text strings.Builder
+	bold strings.Builder
+	// open records, for each element open inside the paragraph, whether it
+	// makes its text bold.
+	open      []bool
+	boldDepth int
+	allBold   bool
+}
+
+func checkDocumentA11y(report *A11yReport, href string, data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+
+	var (
+		heading   *a11yHeading
+		para      *a11yPara
+		prevLevel int
+		hidden    int
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		line, _ := dec.InputPos()
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if heading != nil {
+				heading.depth++
+			}
+			if para != nil {
+				bold := name == "b" || name == "strong" || boldStyle(attrValue(t.Attr, "style"))
+				para.open = append(para.open, bold)
+				if bold {
+					para.boldDepth++
+				}
+			}
+			switch {
+			case name == "html":
+				if attrValue(t.Attr, "lang") == "" {
+					report.add("doc-lang", href, line, "<html> has no lang or xml:lang attribute")
+				}
+			case name == "img":
+				alt, hasAlt := "", false
+				for _, a := range t.Attr {
+					if a.Name.Local == "alt" {
+						alt, hasAlt = a.Value, true
+					}
+				}
+				if !hasAlt && !decorative(t.Attr) {
+					report.add("img-alt", href, line, "image %s has no alt attribute", attrValue(t.Attr, "src"))
+				}
+				if heading != nil {
+					heading.text.WriteString(alt)
+				}
+			case name == "script" || name == "style":
+				hidden++
+			case headingLevel(name) > 0 && heading == nil:
+				heading = &a11yHeading{level: headingLevel(name), line: line}
+			case name == "p" && para == nil:
+				para = &a11yPara{line: line, allBold: boldStyle(attrValue(t.Attr, "style"))}
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			inner := para != nil && len(para.open) > 0
+			if inner {
+				if para.open[len(para.open)-1] {
+					para.boldDepth--
+				}
+				para.open = para.open[:len(para.open)-1]
+			}
+			if name == "script" || name == "style" {
+				hidden--
+			}
+			switch {
+			case heading != nil && heading.depth > 0:
+				heading.depth--
+			case heading != nil:
+				text := normalizeSpace(heading.text.String())
+				switch {
+				case text == "":
+					report.add("empty-heading", href, heading.line, "<h%d> has no text", heading.level)
+				case prevLevel > 0 && heading.level > prevLevel+1:
+					report.add("heading-order", href, heading.line, "<h%d> %q follows <h%d>", heading.level, excerpt(text, 40), prevLevel)
+				}
+				prevLevel = heading.level
+				heading = nil
+			case name == "p" && para != nil && !inner:
+				text := normalizeSpace(para.text.String())
+				if text != "" && (para.allBold || normalizeSpace(para.bold.String()) == text) && looksLikeHeading(text) {
+					report.add("bold-heading", href, para.line, "bold paragraph %q is not marked up as a heading", excerpt(text, 40))
+				}
+				para = nil
+			}
+		case xml.CharData:
+			if hidden > 0 {
+				continue
+			}
+			if heading != nil {
+				heading.text.Write(t)
+			}
+			if para != nil {
+				para.text.Write(t)
+				if para.boldDepth > 0 {
+					para.bold.Write(t)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decorative reports whether an image is hidden from assistive technology,
+// in which case it needs no alt text.
+func decorative(attrs []xml.Attr) bool {
+	role := attrValue(attrs, "role")
+	return role == "presentation" || role == "none" || attrValue(attrs, "aria-hidden") == "true" ||
+		attrValue(attrs, "aria-label") != "" || attrValue(attrs, "aria-labelledby") != ""
+}
+
+func boldStyle(style string) bool {
+	for _, decl := range strings.Split(style, ";") {
+		prop, value, ok := strings.Cut(decl, ":")
+		if !ok || strings.TrimSpace(strings.ToLower(prop)) != "font-weight" {
+			continue
+		}
+		switch strings.TrimSpace(strings.ToLower(value)) {
+		case "bold", "bolder", "600", "700", "800", "900":
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeHeading reports whether a fully bold paragraph reads like a
+// title: short, and not ending like a sentence.
+func looksLikeHeading(text string) bool {
+	if utf8.RuneCountInString(text) > boldHeadingMaxRunes {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(text)
+	return !strings.ContainsRune(`.,;:!?…。、！？」』”"'’)`, last)
+}
@@ -0,0 +1,88 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestA11yCheck(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:a11y</dc:identifier>
+    <dc:title>A11y</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en"><body>
+<nav epub:type="toc"><ol><li><a href="Text/ch1.xhtml">One</a></li></ol></nav>
+<nav epub:type="landmarks"><ol><li><a epub:type="toc" href="nav.xhtml">Contents</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en"><head><title>one</title><style>h1 { color: red }</style></head>
+<body>
+<h1><img src="../Images/title.png" alt="Chapter One"/></h1>
+<p><img src="../Images/a.png"/><img src="../Images/rule.png" alt=""/><img src="../Images/b.png" role="presentation"/></p>
+<h3>Too deep</h3>
+<p><b>A Bold Title</b></p>
+<p><strong>Bold <span>and nested</span></strong> but not all of it</p>
+<p style="font-weight: bold">Styled Heading</p>
+<p><b>“Stop!”</b></p>
+</body></html>
+`,
+		"OEBPS/Text/ch2.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>two</title></head>
+<body><h2> </h2><h2>Fine</h2><p>Text.</p></body></html>
+`,
+	})
+
+	report, err := A11yCheck(context.Background(), input, A11yCheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"a11y-metadata": 1,
+		"landmarks":     1,
+		"img-alt":       1,
+		"heading-order": 1,
+		"bold-heading":  2,
+		"doc-lang":      1,
+		"empty-heading": 1,
+	}
+	if fmt.Sprint(report.Counts) != fmt.Sprint(want) {
+		t.Fatalf("counts = %v, want %v\n%+v", report.Counts, want, report.Issues)
+	}
+	// 5+5 metadata and landmarks, 5 alt, 2 order, 2 bold, 5 lang, 3 empty.
+	if report.Score != 73 || report.Errors != 3 || report.Warnings != 5 || report.Files != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, issue := range report.Issues {
+		if issue.Rule == "img-alt" && (issue.Href != "Text/ch1.xhtml" || issue.Line != 5) {
+			t.Fatalf("img-alt issue = %+v", issue)
+		}
+	}
+
+	patch, _ := AccessibilityPreset("text-only")
+	if _, err := EditEPUB(context.Background(), input, EditOptions{MetadataPatch: patch}); err != nil {
+		t.Fatal(err)
+	}
+	report, err = A11yCheck(context.Background(), input, A11yCheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Counts["a11y-metadata"] != 0 || report.Score != 78 {
+		t.Fatalf("after metadata: %+v", report)
+	}
+}
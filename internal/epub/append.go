@@ -0,0 +1,466 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AppendEPUBs adds sources as further volumes to base, a book made by
+// MergeEPUBs, without merging the earlier volumes again. Each new volume
+// is laid out as merge would have (paths that are taken get a numeric
+// suffix), its chapters follow the existing spine and its table of
+// contents the existing one, and the new volumes' creators and dc:source
+// chains join the book's. The book keeps its identifier. A base that
+// novfmt did not merge becomes volume 1.
+//
+// opts.OutPath defaults to base itself. Title, Language, Creators, Layout,
+// StripMatter, VolumeTitlePages, Ruby, WritingMode, NavBuilder,
+// TextDecoder, ChapterHashes and Checksums apply as in a merge; options
+// that need every volume at once (ShareResources, DedupeCSS, Stylesheet,
+// StripCSS, UserCSS, MaxSize, InsertPages) are rejected.
+func AppendEPUBs(ctx context.Context, base string, sources []string, opts MergeOptions) error {
+	if base == "" {
+		return fmt.Errorf("book to append to is required")
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("need at least one EPUB file to append")
+	}
+	switch {
+	case opts.ShareResources, opts.DedupeCSS, opts.Stylesheet != "":
+		return fmt.Errorf("appending cannot share or consolidate resources with the earlier volumes; merge again instead")
+	case opts.StripCSS, opts.UserCSS != "":
+		return fmt.Errorf("appending cannot restyle the book; run restyle on the result instead")
+	case opts.MaxSize > 0:
+		return fmt.Errorf("appending does not enforce a size budget; merge again instead")
+	case len(opts.InsertPages) > 0:
+		return fmt.Errorf("appending cannot insert pages; merge again instead")
+	case opts.Illustrations != nil && opts.IllustrationsAt != IllustrationsVolume:
+		return fmt.Errorf("appending cannot gather illustrations into one section; keep them at each volume or merge again instead")
+	}
+	if opts.OutPath == "" {
+		opts.OutPath = base
+	}
+	layout, err := parseMergeLayout(opts.Layout)
+	if err != nil {
+		return err
+	}
+	if err := checkTitleTemplate(opts.Title); err != nil {
+		return err
+	}
+	nonLinearPolicy, err := ParseNonLinearPolicy(opts.NonLinear)
+	if err != nil {
+		return err
+	}
+	var matter, illustrations *compiledMatter
+	if opts.StripMatter != nil {
+		if matter, err = compileMatterFilter(opts.StripMatter); err != nil {
+			return err
+		}
+	}
+	if opts.Illustrations != nil {
+		if illustrations, err = compileMatterFilter(opts.Illustrations); err != nil {
+			return err
+		}
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	total := len(sources) + 1
+	log.Info("loading book", "path", base)
+	opts.Progress.report(StageLoad, 0, total, base)
+	book, err := loadVolume(ctx, 0, base)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(book.TempDir)
+	logRepairs(log, book)
+	if err := normalizeVolumeText(ctx, book, opts.TextDecoder, log); err != nil {
+		return err
+	}
+	book.Paths, book.Prefix = map[string]string{}, "."
+	pkg := book.PackageDoc
+
+	count, merged := mergedVolumeCount(pkg)
+	volumes := make([]*Volume, 0, len(sources))
+	defer func() {
+		for _, v := range volumes {
+			os.RemoveAll(v.TempDir)
+		}
+	}()
+	for i, src := range sources {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info(fmt.Sprintf("loading volume %d/%d", i+1, len(sources)), "path", src)
+		opts.Progress.report(StageLoad, i+1, total, src)
+		vol, err := loadVolume(ctx, count+i, src)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, vol)
+		logRepairs(log, vol)
+		if err := normalizeVolumeText(ctx, vol, opts.TextDecoder, log); err != nil {
+			return err
+		}
+	}
+	opts.Progress.report(StageLoad, total, total, "")
+	bookRendition, err := mergedRendition(append([]*Volume{book}, volumes...), opts.MixedLayout, log)
+	if err != nil {
+		return err
+	}
+	setRendition(&pkg.Metadata, bookRendition)
+
+	// Existing files keep their paths; new ones must not land on them.
+	taken := map[string]bool{}
+	if err := filepath.Walk(book.PackageDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(book.PackageDir, p)
+		if err == nil {
+			taken[strings.ToLower(filepath.ToSlash(rel))] = true
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	// existing holds the items of the book before this append, nav aside.
+	existing := map[string]bool{}
+	for _, item := range pkg.Manifest.Items {
+		ids[item.ID] = true
+		if !hasProperty(item.Properties, "nav") {
+			existing[item.ID] = true
+		}
+	}
+	uniqueID := func(id string) string {
+		out := id
+		for n := 2; ids[out]; n++ {
+			out = fmt.Sprintf("%s-%d", id, n)
+		}
+		ids[out] = true
+		return out
+	}
+
+	navHref := normalizeEPUBPath(book.NavHref)
+	if navHref == "" {
+		navHref = uniqueName("nav.xhtml", func(s string) bool { return taken[strings.ToLower(s)] })
+		taken[strings.ToLower(navHref)] = true
+		pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: uniqueID("nav"), Href: navHref, MediaType: "application/xhtml+xml", Properties: "nav"})
+	}
+
+	var added Manifest
+	dropped := make([][]string, len(volumes))
+	for i, vol := range volumes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		before := spineHrefs(vol.PackageDoc)
+		if matter != nil {
+			if err := stripMatter(vol, matter, log); err != nil {
+				return fmt.Errorf("%s: %w", vol.SourcePath, err)
+			}
+		}
+		if _, err := applyNonLinearPolicy(vol, nonLinearPolicy, log); err != nil {
+			return fmt.Errorf("%s: %w", vol.SourcePath, err)
+		}
+		hrefs := spineHrefs(vol.PackageDoc)
+		for _, href := range before {
+			if !containsString(hrefs, href) {
+				dropped[i] = append(dropped[i], href)
+			}
+		}
+		if illustrations != nil {
+			if _, err := gatherIllustrations(vol, illustrations, IllustrationsVolume, log); err != nil {
+				return fmt.Errorf("%s: %w", vol.SourcePath, err)
+			}
+		}
+
+		log.Info(fmt.Sprintf("copying volume %d/%d", i+1, len(volumes)), "title", vol.DisplayName)
+		opts.Progress.report(StageCopy, i, len(volumes), vol.DisplayName)
+		inPlace, err := layoutVolume(vol, layout, taken, log)
+		if err != nil {
+			return fmt.Errorf("%s: %w", vol.SourcePath, err)
+		}
+		if err := copyVolumePayload(vol, book.PackageDir, !inPlace); err != nil {
+			return fmt.Errorf("%s: %w", vol.SourcePath, err)
+		}
+
+		idMap := map[string]string{}
+		for _, item := range vol.PackageDoc.Manifest.Items {
+			if !hasProperty(item.Properties, "nav") {
+				idMap[item.ID] = uniqueID(fmt.Sprintf("v%04d_%s", vol.Index+1, item.ID))
+			}
+		}
+		for _, item := range vol.PackageDoc.Manifest.Items {
+			newID, ok := idMap[item.ID]
+			if !ok {
+				continue
+			}
+			entry := ManifestItem{
+				ID:           newID,
+				Href:         vol.mergedHref(item.Href),
+				MediaType:    item.MediaType,
+				Properties:   removeProperty(item.Properties, "cover-image"),
+				Fallback:     idMap[item.Fallback],
+				MediaOverlay: idMap[item.MediaOverlay],
+			}
+			pkg.Manifest.Items = append(pkg.Manifest.Items, entry)
+			added.Items = append(added.Items, entry)
+		}
+		addMediaOverlayMetas(&pkg.Metadata, vol, func(id string) (string, bool) {
+			newID, ok := idMap[id]
+			return newID, ok
+		}, log)
+
+		if opts.VolumeTitlePages {
+			coverHref := ""
+			for _, item := range vol.PackageDoc.Manifest.Items {
+				if item.ID == vol.CoverID && strings.HasPrefix(item.MediaType, "image/") {
+					coverHref = vol.mergedHref(item.Href)
+				}
+			}
+			href, err := writeVolumeTitlePage(vol, book.PackageDir, coverHref)
+			if err != nil {
+				return fmt.Errorf("%s: title page: %w", vol.SourcePath, err)
+			}
+			id := uniqueID(fmt.Sprintf("v%04d_novfmt-title", vol.Index+1))
+			pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: id, Href: href, MediaType: "application/xhtml+xml"})
+			pkg.Spine.Itemrefs = append(pkg.Spine.Itemrefs, titlePageRef(id, bookRendition))
+			vol.FirstHref = href
+		}
+		for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+			newID, ok := idMap[ref.IDRef]
+			if !ok {
+				log.Warn("spine item not in manifest, skipping", "volume", vol.SourcePath, "idref", ref.IDRef)
+				continue
+			}
+			pkg.Spine.Itemrefs = append(pkg.Spine.Itemrefs, SpineItemRef{IDRef: newID, Linear: ref.Linear, Properties: ref.Properties})
+			if vol.FirstHref == "" {
+				vol.FirstHref = vol.mergedHref(spineHref(vol.PackageDoc, ref.IDRef))
+			}
+		}
+	}
+	opts.Progress.report(StageCopy, len(volumes), len(volumes), "")
+
+	if opts.Ruby != "" {
+		log.Info("converting ruby", "mode", opts.Ruby)
+		if _, err := applyRuby(ctx, book.PackageDir, &added, opts.Ruby, log); err != nil {
+			return err
+		}
+	}
+
+	log.Info("rewriting hrefs and building nav")
+	if err := writeAppendedNav(book, merged, volumes, opts.NavBuilder, navHref); err != nil {
+		return err
+	}
+
+	log.Info("checking links")
+	renames := map[string]string{}
+	for i, vol := range volumes {
+		if vol.NavHref != "" {
+			renames[vol.mergedHref(vol.NavHref)] = navHref
+		}
+		for _, href := range dropped[i] {
+			for _, earlier := range volumes[:i] {
+				if containsString(spineHrefs(earlier.PackageDoc), href) {
+					renames[vol.mergedHref(href)] = earlier.mergedHref(href)
+					break
+				}
+			}
+		}
+	}
+	if _, _, err := verifyLinks(book.PackageDir, pkg.Manifest, renames, log); err != nil {
+		return err
+	}
+
+	appendedMetadata(pkg, volumes, opts, count, appendedTitleSources(book, merged, count, volumes))
+	if opts.WritingMode != "" {
+		log.Info("setting writing mode", "mode", opts.WritingMode)
+		if _, err := applyWritingMode(ctx, book.PackageDir, pkg, opts.WritingMode, nil, log); err != nil {
+			return err
+		}
+	}
+	if err := writePackage(pkg, book.PackagePath); err != nil {
+		return err
+	}
+	if err := appendVolumeManifest(ctx, book, volumes, existing, merged, log); err != nil {
+		return err
+	}
+	if opts.ChapterHashes {
+		if _, err := writeChapterHashes(book.RootDir, book.PackagePath); err != nil {
+			return err
+		}
+	}
+	if opts.Checksums {
+		if _, err := writeChecksums(book.RootDir); err != nil {
+			return err
+		}
+	}
+	log.Info("zipping output", "path", opts.OutPath)
+	return saveVolume(ctx, book, opts.OutPath, opts.Progress)
+}
+
+// mergedVolumeCount returns how many volumes pkg was merged from, and
+// false when novfmt did not merge it.
+func mergedVolumeCount(pkg *PackageDocument) (int, bool) {
+	for _, node := range pkg.Metadata.Meta {
+		if node.Property != "novfmt:source-count" {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(node.Value)); err == nil && n > 0 {
+			return n, true
+		}
+	}
+	return 1, false
+}
+
+func spineHref(pkg *PackageDocument, idref string) string {
+	for _, item := range pkg.Manifest.Items {
+		if item.ID == idref {
+			return item.Href
+		}
+	}
+	return ""
+}
+
+// writeAppendedNav rebuilds the nav of book with the new volumes after the
+// existing entries. The top-level entries of a merged book are its
+// volumes; any other book becomes a single volume.
+func writeAppendedNav(book *Volume, merged bool, volumes []*Volume, builder NavBuilder, navHref string) error {
+	if builder == nil {
+		builder = DefaultNavBuilder{}
+	}
+	var navs []VolumeNav
+	existing := mergedNavItems(book)
+	if merged {
+		for i, item := range existing {
+			navs = append(navs, VolumeNav{Index: i, SourcePath: book.SourcePath, Title: item.Title, Href: item.Href, Items: item.Children})
+		}
+	} else {
+		first := ""
+		if refs := book.PackageDoc.Spine.Itemrefs; len(refs) > 0 {
+			first = normalizeEPUBPath(spineHref(book.PackageDoc, refs[0].IDRef))
+		}
+		navs = append(navs, VolumeNav{SourcePath: book.SourcePath, Title: book.DisplayName, Href: first, Items: existing})
+	}
+	for _, vol := range volumes {
+		navs = append(navs, VolumeNav{
+			Index:      vol.Index,
+			SourcePath: vol.SourcePath,
+			Title:      vol.DisplayName,
+			Href:       vol.FirstHref,
+			Items:      mergedNavItems(vol),
+		})
+	}
+	data, err := builder.BuildNav(navs)
+	if err != nil {
+		return fmt.Errorf("build nav: %w", err)
+	}
+	items, err := parseNavDocument(data)
+	if err != nil {
+		return fmt.Errorf("nav builder returned an invalid document: %w", err)
+	}
+	// Entries point into the package directory; a nav elsewhere needs
+	// them rebased.
+	if dir := path.Dir(navHref); dir != "." {
+		data = RenderNavDocument(rebaseNavItems(items, dir))
+	}
+	return os.WriteFile(filepath.Join(book.PackageDir, filepath.FromSlash(navHref)), data, 0o644)
+}
+
+// appendedTitleSources describes every volume of a book that volumes were
+// appended to for expanding a title template. Earlier volumes come from
+// the book's volume manifest; without one they are known only by
+// position.
+func appendedTitleSources(book *Volume, merged bool, count int, volumes []*Volume) []titleSource {
+	var srcs []titleSource
+	if m, err := readVolumeManifest(book.RootDir); err == nil {
+		for _, v := range m.Volumes {
+			srcs = append(srcs, titleSource{title: v.Title, file: strings.TrimSuffix(v.Source, path.Ext(v.Source)), position: v.Number})
+		}
+	} else if !merged {
+		srcs = append(srcs, titleSourceOf(book))
+	} else {
+		for i := 1; i <= count; i++ {
+			srcs = append(srcs, titleSource{position: i})
+		}
+	}
+	for _, vol := range volumes {
+		srcs = append(srcs, titleSourceOf(vol))
+	}
+	return srcs
+}
+
+// appendedMetadata updates the package of a book that volumes were
+// appended to: the volume count, creators, dc:source chain, modification
+// time and any title or language given in opts. A title template is
+// expanded over srcs.
+func appendedMetadata(pkg *PackageDocument, volumes []*Volume, opts MergeOptions, count int, srcs []titleSource) {
+	meta := &pkg.Metadata
+	if opts.Language != "" {
+		if len(meta.Languages) == 0 {
+			meta.Languages = []DCMeta{{}}
+		}
+		meta.Languages[0].Value = opts.Language
+		pkg.Lang = opts.Language
+	}
+
+	if len(opts.Creators) > 0 {
+		meta.Creators = nil
+		for _, c := range opts.Creators {
+			meta.Creators = append(meta.Creators, DCMeta{Value: c})
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, c := range meta.Creators {
+			seen[strings.TrimSpace(c.Value)] = true
+		}
+		// Unknown stood in for volumes without creators.
+		if len(meta.Creators) == 1 && meta.Creators[0].Value == "Unknown" {
+			meta.Creators, seen = nil, map[string]bool{}
+		}
+		for _, vol := range volumes {
+			for _, c := range vol.PackageDoc.Metadata.Creators {
+				if name := strings.TrimSpace(c.Value); name != "" && !seen[name] {
+					seen[name] = true
+					meta.Creators = append(meta.Creators, DCMeta{Value: name})
+				}
+			}
+		}
+		if len(meta.Creators) == 0 {
+			meta.Creators = []DCMeta{{Value: "Unknown"}}
+		}
+		sort.SliceStable(meta.Creators, func(i, j int) bool { return meta.Creators[i].Value < meta.Creators[j].Value })
+	}
+
+	if opts.Title != "" {
+		if len(meta.Titles) == 0 {
+			meta.Titles = []DCMeta{{}}
+		}
+		meta.Titles[0].Value = mergedTitle(opts.Title, srcs, meta.Creators[0].Value)
+	}
+
+	editSources(meta, nil, mergedSources(volumes), nil)
+
+	countValue := strconv.Itoa(count + len(volumes))
+	found := false
+	for i := range meta.Meta {
+		if meta.Meta[i].Property == "novfmt:source-count" {
+			meta.Meta[i].Value = countValue
+			found = true
+		}
+	}
+	if !found {
+		meta.Meta = append(meta.Meta, MetaNode{Property: "novfmt:source-count", Value: countValue})
+		if !strings.Contains(pkg.Prefix, "novfmt:") {
+			pkg.Prefix = strings.TrimSpace(pkg.Prefix + " " + novfmtVocabPrefix)
+		}
+	}
+	updateModifiedTimestamp(meta)
+}
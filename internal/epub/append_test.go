@@ -0,0 +1,100 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppendEPUBs(t *testing.T) {
+	ctx := context.Background()
+	vol1 := buildCatalogBook(t, "urn:test:v1", "Saga 1", "Ann Author", true)
+	vol2 := buildCatalogBook(t, "urn:test:v2", "Saga 2", "Ann Author", false)
+	vol3 := buildCatalogBook(t, "urn:test:v3", "Saga 3", "Ben Writer", true)
+	omnibus := filepath.Join(t.TempDir(), "saga.epub")
+	if err := MergeEPUBs(ctx, []string{vol1, vol2}, MergeOptions{OutPath: omnibus, Title: "Saga"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := loadVolume(ctx, 0, omnibus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(before.TempDir)
+
+	if err := AppendEPUBs(ctx, omnibus, []string{vol3}, MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, omnibus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	pkg := vol.PackageDoc
+
+	if got, want := primaryIdentifier(pkg), primaryIdentifier(before.PackageDoc); got != want {
+		t.Fatalf("identifier = %q, want %q kept", got, want)
+	}
+	if got := firstDCValue(pkg.Metadata.Titles); got != "Saga" {
+		t.Fatalf("title = %q", got)
+	}
+	if n, merged := mergedVolumeCount(pkg); n != 3 || !merged {
+		t.Fatalf("source count = %d, %v", n, merged)
+	}
+	if got := collectCreators(pkg.Metadata.Creators); len(got) != 2 || got[0] != "Ann Author" || got[1] != "Ben Writer" {
+		t.Fatalf("creators = %v", got)
+	}
+	if got := collectSources(pkg.Metadata); len(got) != 3 || got[2] != "urn:test:v3" {
+		t.Fatalf("sources = %v", got)
+	}
+	hrefs := spineHrefs(pkg)
+	if len(hrefs) != 3 || hrefs[2] != "Volumes/v0003/ch1.xhtml" {
+		t.Fatalf("spine = %v", hrefs)
+	}
+	covers := 0
+	for _, item := range pkg.Manifest.Items {
+		if hasProperty(item.Properties, "cover-image") {
+			covers++
+		}
+		if _, err := os.Stat(filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))); err != nil {
+			t.Fatalf("manifest item %s: %v", item.Href, err)
+		}
+	}
+	if covers != 1 {
+		t.Fatalf("cover images = %d, want the original one", covers)
+	}
+	if len(vol.NavItems) != 3 || vol.NavItems[2].Title != "Saga 3" || vol.NavItems[2].Href != "Volumes/v0003/ch1.xhtml" {
+		t.Fatalf("nav = %+v", vol.NavItems)
+	}
+	if vol.NavItems[0].Title != "Saga 1" || len(vol.NavItems[0].Children) != len(before.NavItems[0].Children) {
+		t.Fatalf("existing nav entry changed: %+v", vol.NavItems[0])
+	}
+}
+
+func TestAppendEPUBsToSingleBook(t *testing.T) {
+	ctx := context.Background()
+	first := buildTestEPUB(t, "Standalone", "en")
+	next := buildTestEPUB(t, "Sequel", "en")
+	out := filepath.Join(t.TempDir(), "both.epub")
+	// The sequel's files sit at the same paths as the first book's.
+	if err := AppendEPUBs(ctx, first, []string{next}, MergeOptions{OutPath: out, Layout: "{orig}"}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if hrefs := spineHrefs(vol.PackageDoc); len(hrefs) != 2 || hrefs[0] != "chapter.xhtml" || hrefs[1] != "chapter-2.xhtml" {
+		t.Fatalf("spine = %v", hrefs)
+	}
+	if len(vol.NavItems) != 2 || vol.NavItems[0].Title != "Standalone" || vol.NavItems[1].Href != "chapter-2.xhtml" {
+		t.Fatalf("nav = %+v", vol.NavItems)
+	}
+	if n, merged := mergedVolumeCount(vol.PackageDoc); n != 2 || !merged {
+		t.Fatalf("source count = %d, %v", n, merged)
+	}
+	if err := AppendEPUBs(ctx, first, []string{next}, MergeOptions{ShareResources: true}); err == nil {
+		t.Fatal("expected -share-resources to be rejected")
+	}
+}
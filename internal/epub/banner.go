@@ -0,0 +1,391 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Where InjectBanners puts a header.
+const (
+	// BannerStart puts it first in the body.
+	BannerStart = "start"
+	// BannerAfterHeading puts it after the chapter's first heading, or
+	// first in the body of a chapter without one.
+	BannerAfterHeading = "after-heading"
+)
+
+// The classes of the elements holding the header and footer InjectBanners
+// adds, by which it finds them again to replace or remove them.
+const (
+	bannerHeaderClass = "novfmt-header"
+	bannerFooterClass = "novfmt-footer"
+)
+
+// BannerPlaceholders lists the placeholders a header or footer may use.
+var BannerPlaceholders = []string{"title", "author", "translator", "series", "index", "language", "publisher", "chapter"}
+
+// headingEndPattern finds the end of a heading in a document.
+var headingEndPattern = regexp.MustCompile(`(?i)</(?:[A-Za-z_][\w.-]*:)?h[1-6]\s*>`)
+
+type BannerOptions struct {
+	// Header and Footer are XHTML fragments added to every chapter, such
+	// as a translator's credit or a series banner; text without markup is
+	// put in a paragraph. Placeholders are filled in for each chapter:
+	// {title}, {author}, {translator}, {publisher} and {language} from the
+	// book's metadata, {series} and {index}, its number in the series, and
+	// {chapter}, the chapter's table of contents label.
+	Header string
+	Footer string
+	// HeaderAt is BannerStart (the default) or BannerAfterHeading. The
+	// footer always ends the body.
+	HeaderAt string
+	// Remove takes out the headers and footers added before.
+	Remove   bool
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ParseBannerPosition checks where a header goes.
+func ParseBannerPosition(s string) (string, error) {
+	switch s {
+	case "", BannerStart:
+		return BannerStart, nil
+	case BannerAfterHeading:
+		return BannerAfterHeading, nil
+	}
+	return "", fmt.Errorf("unknown header position %q (want start or after-heading)", s)
+}
+
+// InjectBanners adds a header and/or footer to every chapter: every spine
+// document except the cover and the navigation document. A header or
+// footer added by an earlier run is replaced, so running it again with new
+// text updates the book. With Remove it takes them out instead. Without
+// OutPath the input is modified in place.
+func InjectBanners(ctx context.Context, input string, opts BannerOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	switch {
+	case opts.Remove && (opts.Header != "" || opts.Footer != ""):
+		return stats, fmt.Errorf("removing banners cannot be combined with a header or footer")
+	case !opts.Remove && opts.Header == "" && opts.Footer == "":
+		return stats, fmt.Errorf("nothing to do: set Header, Footer or Remove")
+	}
+	at, err := ParseBannerPosition(opts.HeaderAt)
+	if err != nil {
+		return stats, err
+	}
+	header, err := parseBannerTemplate("header", opts.Header)
+	if err != nil {
+		return stats, err
+	}
+	footer, err := parseBannerTemplate("footer", opts.Footer)
+	if err != nil {
+		return stats, err
+	}
+	// A new header replaces the old one, and a new footer the old footer.
+	drop := map[string]bool{
+		bannerHeaderClass: opts.Remove || header != "",
+		bannerFooterClass: opts.Remove || footer != "",
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	vars := bannerVars(pkg.Metadata)
+	labels, err := chapterLabels(vol)
+	if err != nil {
+		return stats, err
+	}
+	landmarks, err := landmarkTypes(vol)
+	if err != nil {
+		return stats, err
+	}
+	cover := &compiledMatter{files: []*regexp.Regexp{coverFilePattern}, types: map[string]bool{"cover": true}}
+	items := make(map[string]ManifestItem, len(pkg.Manifest.Items))
+	for _, item := range pkg.Manifest.Items {
+		items[item.ID] = item
+	}
+
+	refs := pkg.Spine.Itemrefs
+	for i, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		item, ok := items[ref.IDRef]
+		opts.Progress.report(StageRewrite, i, len(refs), item.Href)
+		if !ok || item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		if reason, err := cover.match(vol, href, landmarks[href], nil); err != nil {
+			return stats, err
+		} else if reason != "" {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return stats, err
+		}
+
+		out, removed, err := removeBanners(data, drop)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		if header != "" || footer != "" {
+			if chapter := labels[href]; len(chapter) > 0 {
+				vars["chapter"] = chapter[len(chapter)-1]
+			} else {
+				vars["chapter"] = ""
+			}
+			var ok bool
+			out, ok, err = insertBanners(out, expandBanner(header, bannerHeaderClass, vars), expandBanner(footer, bannerFooterClass, vars), at)
+			if err != nil {
+				return stats, fmt.Errorf("%s: %w", item.Href, err)
+			}
+			if !ok {
+				log.Warn("document has no body; no header or footer added", "href", item.Href)
+			}
+		}
+		if bytes.Equal(out, data) {
+			continue
+		}
+		n := removed
+		if header != "" || footer != "" {
+			n = 1
+		}
+		log.Debug("updated header and footer", "href", item.Href, "removed", removed)
+		stats.MatchCount += n
+		stats.FilesChanged++
+		stats.Changeset.modified(item.Href)
+		stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: n})
+		if !opts.DryRun {
+			if err := os.WriteFile(src, out, 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(refs), len(refs), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// parseBannerTemplate checks a header or footer template and returns it as
+// markup: text without any is put in a paragraph.
+func parseBannerTemplate(what, tmpl string) (string, error) {
+	tmpl = strings.TrimSpace(tmpl)
+	if tmpl == "" {
+		return "", nil
+	}
+	if !strings.Contains(tmpl, "<") {
+		tmpl = "<p>" + tmpl + "</p>"
+	}
+	var unknown []string
+	for _, m := range metaPlaceholderRE.FindAllStringSubmatch(tmpl, -1) {
+		if !containsString(BannerPlaceholders, m[1]) && !containsString(unknown, m[1]) {
+			unknown = append(unknown, m[1])
+		}
+	}
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("%s uses {%s}; placeholders are {%s}", what, strings.Join(unknown, "}, {"), strings.Join(BannerPlaceholders, "}, {"))
+	}
+	dec := xml.NewDecoder(strings.NewReader(`<div xmlns="http://www.w3.org/1999/xhtml">` + tmpl + `</div>`))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			return tmpl, nil
+		} else if err != nil {
+			return "", fmt.Errorf("%s is not well-formed XHTML: %w", what, err)
+		}
+	}
+}
+
+// bannerVars returns the values of the placeholders that come from the
+// book's metadata.
+func bannerVars(meta Metadata) map[string]string {
+	c := calibreFromPackage(meta)
+	var authors, translators []string
+	for _, cr := range creatorsOf(meta) {
+		switch cr.Role {
+		case "", "aut":
+			authors = append(authors, cr.Name)
+		case "trl":
+			translators = append(translators, cr.Name)
+		}
+	}
+	return map[string]string{
+		"title":      c.Title,
+		"author":     strings.Join(authors, ", "),
+		"translator": strings.Join(translators, ", "),
+		"series":     c.Series,
+		"index":      c.SeriesIndex,
+		"language":   c.Language,
+		"publisher":  c.Publisher,
+	}
+}
+
+// expandBanner fills in a header or footer template and wraps it in the
+// element that marks it, or returns "" for no template.
+func expandBanner(tmpl, class string, vars map[string]string) string {
+	if tmpl == "" {
+		return ""
+	}
+	body := metaPlaceholderRE.ReplaceAllStringFunc(tmpl, func(m string) string {
+		return html.EscapeString(vars[m[1:len(m)-1]])
+	})
+	return `<div class="` + class + `">` + body + `</div>`
+}
+
+// bannerClass returns the class marking start as a header or footer
+// InjectBanners added, or "".
+func bannerClass(start xml.StartElement) string {
+	for _, a := range start.Attr {
+		if a.Name.Local != "class" {
+			continue
+		}
+		for _, c := range strings.Fields(a.Value) {
+			if c == bannerHeaderClass || c == bannerFooterClass {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// removeBanners drops the headers and footers of the given classes from a
+// document, each with the whitespace before it, so that removing one
+// restores the document it was added to. It returns how many it removed.
+func removeBanners(data []byte, classes map[string]bool) ([]byte, int, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+	var (
+		// space holds whitespace until the next token shows whether a
+		// banner follows it.
+		space          *rawToken
+		depth, removed int
+	)
+	for {
+		rt, err := sp.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if depth > 0 {
+			switch rt.tok.(type) {
+			case xml.StartElement:
+				depth++
+			case xml.EndElement:
+				depth--
+			}
+			continue
+		}
+		if start, ok := rt.tok.(xml.StartElement); ok && classes[bannerClass(start)] {
+			space = nil
+			depth = 1
+			removed++
+			continue
+		}
+		if space != nil {
+			if err := sp.copy(*space); err != nil {
+				return nil, 0, err
+			}
+			space = nil
+		}
+		if text, ok := rt.tok.(xml.CharData); ok && len(bytes.TrimSpace(text)) == 0 {
+			space = &rt
+			continue
+		}
+		if err := sp.copy(rt); err != nil {
+			return nil, 0, err
+		}
+	}
+	if space != nil {
+		if err := sp.copy(*space); err != nil {
+			return nil, 0, err
+		}
+	}
+	if removed == 0 {
+		return data, 0, nil
+	}
+	return out.Bytes(), removed, nil
+}
+
+// insertBanners adds header at the start of the body or after its first
+// heading, and footer at the end of the body; either may be "". It
+// reports false for a document without a body.
+func insertBanners(data []byte, header, footer, at string) ([]byte, bool, error) {
+	if at == BannerAfterHeading && !headingEndPattern.Match(data) {
+		at = BannerStart
+	}
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+	body := false
+	for {
+		rt, err := sp.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		// add is written after the token, and end before it.
+		add, end := "", ""
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			if strings.EqualFold(t.Name.Local, "body") {
+				body = true
+				if at == BannerStart {
+					add, header = header, ""
+				}
+			}
+		case xml.EndElement:
+			switch {
+			case body && strings.EqualFold(t.Name.Local, "body"):
+				end, footer = footer, ""
+			case body && headingLevel(strings.ToLower(t.Name.Local)) > 0:
+				add, header = header, ""
+			}
+		}
+		if end != "" {
+			if err := sp.writeRaw(end + "\n"); err != nil {
+				return nil, false, err
+			}
+		}
+		if err := sp.copy(rt); err != nil {
+			return nil, false, err
+		}
+		if add != "" {
+			if err := sp.writeRaw("\n" + add); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if !body {
+		return data, false, nil
+	}
+	return out.Bytes(), true, nil
+}
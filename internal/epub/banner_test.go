@@ -0,0 +1,96 @@
+package epub
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const bannerChapter = `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head><body>
+<h1>One</h1>
+<p>Text.</p>
+</body></html>`
+
+func buildBannerBook(t *testing.T) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+			`<dc:identifier id="id">urn:test:banner</dc:identifier><dc:title>Saga</dc:title><dc:language>en</dc:language>` +
+			`<dc:creator>Kaito Sato</dc:creator><dc:creator id="t">Ann Lee &amp; Co</dc:creator><meta refines="#t" property="role">trl</meta>` +
+			`</metadata><manifest>` +
+			`<item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>` +
+			`<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` +
+			`<item id="c1" href="c1.xhtml" media-type="application/xhtml+xml"/>` +
+			`<item id="c2" href="c2.xhtml" media-type="application/xhtml+xml"/>` +
+			`</manifest><spine><itemref idref="cover"/><itemref idref="c1"/><itemref idref="c2"/></spine></package>`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol>` +
+			`<li><a href="c1.xhtml">Chapter One</a></li><li><a href="c2.xhtml">Chapter Two</a></li></ol></nav></body></html>`,
+		"OEBPS/cover.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Cover</p></body></html>`,
+		"OEBPS/c1.xhtml":    bannerChapter,
+		"OEBPS/c2.xhtml":    `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>No heading.</p></body></html>`,
+	})
+}
+
+func TestInjectBanners(t *testing.T) {
+	ctx := context.Background()
+	input := buildBannerBook(t)
+
+	stats, err := InjectBanners(ctx, input, BannerOptions{
+		Header:   `<p class="arc">{title}: {chapter}</p>`,
+		Footer:   "Translated by {translator} — do not redistribute",
+		HeaderAt: BannerAfterHeading,
+	})
+	if err != nil {
+		t.Fatalf("InjectBanners: %v", err)
+	}
+	if stats.FilesChanged != 2 {
+		t.Fatalf("changed %d files, want the two chapters: %+v", stats.FilesChanged, stats.Files)
+	}
+	c1 := readNotesFile(t, input, "c1.xhtml")
+	want := `<h1>One</h1>
+<div class="novfmt-header"><p class="arc">Saga: Chapter One</p></div>
+<p>Text.</p>
+<div class="novfmt-footer"><p>Translated by Ann Lee &amp; Co — do not redistribute</p></div>
+</body>`
+	if !strings.Contains(c1, want) {
+		t.Fatalf("c1 =\n%s", c1)
+	}
+	if c2 := readNotesFile(t, input, "c2.xhtml"); !strings.Contains(c2, `<body>
+<div class="novfmt-header"><p class="arc">Saga: Chapter Two</p></div><p>No heading.</p>`) {
+		t.Fatalf("c2 has no header at the start:\n%s", c2)
+	}
+	if cover := readNotesFile(t, input, "cover.xhtml"); strings.Contains(cover, "novfmt-") {
+		t.Fatalf("cover got a banner:\n%s", cover)
+	}
+
+	// A new header replaces the old one and keeps the footer.
+	if _, err := InjectBanners(ctx, input, BannerOptions{Header: "Vol. {index}"}); err != nil {
+		t.Fatalf("InjectBanners again: %v", err)
+	}
+	c1 = readNotesFile(t, input, "c1.xhtml")
+	if strings.Count(c1, "novfmt-header") != 1 || strings.Contains(c1, "arc") || !strings.Contains(c1, "novfmt-footer") {
+		t.Fatalf("header not replaced:\n%s", c1)
+	}
+
+	if _, err := InjectBanners(ctx, input, BannerOptions{Remove: true}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if c1 := readNotesFile(t, input, "c1.xhtml"); c1 != bannerChapter {
+		t.Fatalf("after removal c1 =\n%s", c1)
+	}
+}
+
+func TestInjectBannersBadTemplate(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "unused.epub")
+	for _, opts := range []BannerOptions{
+		{Header: "{volume}"},
+		{Footer: "<p>unclosed"},
+		{Header: "x", Remove: true},
+		{Header: "x", HeaderAt: "middle"},
+	} {
+		if _, err := InjectBanners(context.Background(), input, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+}
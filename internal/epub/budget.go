@@ -0,0 +1,322 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeContributor is one file of an EPUB with its compressed size.
+type SizeContributor struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SizeBudgetError reports an output over MergeOptions.MaxSize.
+type SizeBudgetError struct {
+	Size, Max int64
+	// Largest lists the biggest files in the output, largest first.
+	Largest []SizeContributor
+	// Steps lists the shrinking steps that were tried, if any.
+	Steps []string
+}
+
+func (e *SizeBudgetError) Error() string {
+	msg := fmt.Sprintf("output is %s, over the %s budget", FormatByteSize(e.Size), FormatByteSize(e.Max))
+	if len(e.Steps) > 0 {
+		msg += " after " + strings.Join(e.Steps, ", ")
+	}
+	return msg
+}
+
+// ParseByteSize accepts a plain byte count or one with a unit: KB, MB and
+// GB are powers of 1000, KiB, MiB and GiB powers of 1024.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	num := strings.TrimRightFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	unit := strings.ToLower(strings.TrimSpace(s[len(num):]))
+	mult, ok := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1e3, "kb": 1e3, "m": 1e6, "mb": 1e6, "g": 1e9, "gb": 1e9,
+		"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+	}[unit]
+	v, err := strconv.ParseFloat(num, 64)
+	if !ok || err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q (want e.g. 300MB or 512MiB)", s)
+	}
+	return int64(v * mult), nil
+}
+
+// FormatByteSize renders n in the largest decimal unit that keeps it at
+// least 1.
+func FormatByteSize(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fGB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fMB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fKB", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// largestFiles returns the n biggest entries of a zip by compressed size.
+func largestFiles(zipPath string, n int) ([]SizeContributor, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var out []SizeContributor
+	for _, f := range r.File {
+		out = append(out, SizeContributor{Path: f.Name, Bytes: int64(f.CompressedSize64)})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+// shrinkQualities are the JPEG qualities ShrinkToFit steps down through.
+// Opaque PNGs become JPEGs from pngToJPEGQuality down, since that throws
+// away the losslessness line art relies on.
+var shrinkQualities = []int{85, 70, 55, 40}
+
+const pngToJPEGQuality = 55
+
+// enforceSizeBudget checks the book zipped at zipPath against
+// opts.MaxSize and, with opts.ShrinkToFit, shrinks the staged book and
+// calls finish to re-zip it until it fits. A book still over budget is
+// removed.
+func enforceSizeBudget(ctx context.Context, oebpsDir string, pkg *PackageDocument, zipPath string, opts MergeOptions, finish func() error, log *slog.Logger) error {
+	size := func() (int64, error) {
+		info, err := os.Stat(zipPath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	n, err := size()
+	if err != nil {
+		return err
+	}
+	var steps []string
+	if n > opts.MaxSize && opts.ShrinkToFit {
+		shrinker := &imageShrinker{dir: oebpsDir, pkg: pkg, originals: map[string][]byte{}}
+		try := func(step string, apply func() (bool, error)) error {
+			changed, err := apply()
+			if err != nil || !changed {
+				return err
+			}
+			steps = append(steps, step)
+			if err := finish(); err != nil {
+				return err
+			}
+			before := n
+			if n, err = size(); err != nil {
+				return err
+			}
+			log.Info("shrunk output", "step", step, "before", before, "after", n)
+			return nil
+		}
+		err := try("dropping duplicate resources", func() (bool, error) {
+			removed, err := dropDuplicateResources(oebpsDir, pkg)
+			return removed > 0, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, q := range shrinkQualities {
+			if n <= opts.MaxSize {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			step := fmt.Sprintf("re-encoding images at JPEG quality %d", q)
+			if err := try(step, func() (bool, error) { return shrinker.recompress(q) }); err != nil {
+				return err
+			}
+		}
+	}
+	if n <= opts.MaxSize {
+		return nil
+	}
+	largest, err := largestFiles(zipPath, 10)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(zipPath); err != nil {
+		return err
+	}
+	return &SizeBudgetError{Size: n, Max: opts.MaxSize, Largest: largest, Steps: steps}
+}
+
+// dropDuplicateResources keeps one copy of byte-identical non-document
+// resources, wherever they are stored, and points references to it.
+func dropDuplicateResources(pkgDir string, pkg *PackageDocument) (int, error) {
+	inSpine := map[string]bool{}
+	for _, ref := range pkg.Spine.Itemrefs {
+		inSpine[ref.IDRef] = true
+	}
+	first := map[[sha256.Size]byte]ManifestItem{}
+	replaced := map[string]string{}
+	replacedIDs := map[string]string{}
+	kept := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		if inSpine[item.ID] || item.MediaType == "application/xhtml+xml" || item.MediaType == "application/x-dtbncx+xml" {
+			kept = append(kept, item)
+			continue
+		}
+		p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				kept = append(kept, item)
+				continue
+			}
+			return 0, err
+		}
+		sum := sha256.Sum256(append([]byte(item.MediaType+"\x00"), data...))
+		target, seen := first[sum]
+		if !seen || item.Properties != "" {
+			if !seen {
+				first[sum] = item
+			}
+			kept = append(kept, item)
+			continue
+		}
+		replaced[normalizeEPUBPath(item.Href)] = target.Href
+		replacedIDs[item.ID] = target.ID
+		if err := os.Remove(p); err != nil {
+			return 0, err
+		}
+	}
+	pkg.Manifest.Items = kept
+	if len(replaced) == 0 {
+		return 0, nil
+	}
+	for i := range pkg.Manifest.Items {
+		if id, ok := replacedIDs[pkg.Manifest.Items[i].Fallback]; ok {
+			pkg.Manifest.Items[i].Fallback = id
+		}
+	}
+	_, err := rewriteReferences(pkgDir, pkg, func(target string) (string, bool) {
+		href, ok := replaced[target]
+		return href, ok
+	})
+	return len(replaced), err
+}
+
+// imageShrinker re-encodes a book's images at falling quality, always from
+// the original data so that losses do not compound.
+type imageShrinker struct {
+	dir string
+	pkg *PackageDocument
+	// originals holds the first-seen bytes of every image touched, keyed
+	// by manifest id.
+	originals map[string][]byte
+}
+
+func (s *imageShrinker) recompress(quality int) (bool, error) {
+	changed := false
+	renamed := map[string]string{}
+	for i := range s.pkg.Manifest.Items {
+		item := &s.pkg.Manifest.Items[i]
+		orig, ok := s.originals[item.ID]
+		if !ok {
+			if item.MediaType != "image/jpeg" && item.MediaType != "image/png" {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(item.Href)))
+			if err != nil {
+				return false, err
+			}
+			orig = data
+		}
+		fromPNG := bytes.HasPrefix(orig, []byte("\x89PNG"))
+		if fromPNG && quality > pngToJPEGQuality {
+			continue
+		}
+		var img image.Image
+		var err error
+		if fromPNG {
+			img, err = png.Decode(bytes.NewReader(orig))
+			if err == nil && !opaque(img) {
+				continue
+			}
+		} else {
+			img, err = jpeg.Decode(bytes.NewReader(orig))
+		}
+		if err != nil {
+			// Leave images Go cannot decode (CMYK JPEGs, say) alone.
+			continue
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return false, err
+		}
+		cur := filepath.Join(s.dir, filepath.FromSlash(item.Href))
+		info, err := os.Stat(cur)
+		if err != nil {
+			return false, err
+		}
+		if int64(buf.Len()) >= info.Size() {
+			continue
+		}
+		s.originals[item.ID] = orig
+		if item.MediaType == "image/png" {
+			href := normalizeEPUBPath(item.Href)
+			newHref := strings.TrimSuffix(href, path.Ext(href)) + ".jpg"
+			if hasManifestHref(s.pkg, newHref) {
+				newHref = uniqueName(newHref, func(h string) bool { return hasManifestHref(s.pkg, h) })
+			}
+			if err := os.Remove(cur); err != nil {
+				return false, err
+			}
+			renamed[href] = newHref
+			item.Href, item.MediaType = newHref, "image/jpeg"
+			cur = filepath.Join(s.dir, filepath.FromSlash(newHref))
+		}
+		if err := os.WriteFile(cur, buf.Bytes(), 0o644); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if len(renamed) > 0 {
+		if _, err := rewriteReferences(s.dir, s.pkg, func(target string) (string, bool) {
+			href, ok := renamed[target]
+			return href, ok
+		}); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// opaque reports whether every pixel of img is fully opaque, so that JPEG
+// loses nothing of its transparency.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, img, b.Min, draw.Src)
+	return rgba.Opaque()
+}
@@ -0,0 +1,135 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"300MB": 300e6, "1.5 GB": 1.5e9, "512MiB": 512 << 20, "2048": 2048, "10k": 10e3} {
+		got, err := ParseByteSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "MB", "-3MB", "12 parsecs"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) succeeded", in)
+		}
+	}
+}
+
+func budgetVolume(t *testing.T, photo []byte) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:budget</dc:identifier>
+    <dc:title>Budget</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="photo" href="Images/photo.jpg" media-type="image/jpeg"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Text/ch1.xhtml":   `<html xmlns="http://www.w3.org/1999/xhtml"><body><p><img src="../Images/photo.jpg" alt="Photo"/></p></body></html>`,
+		"OEBPS/Images/photo.jpg": string(photo),
+	})
+}
+
+func TestMergeSizeBudget(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.RGBA{uint8(rng.IntN(256)), uint8(x), uint8(y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	photo := buf.Bytes()
+	vols := []string{budgetVolume(t, photo), budgetVolume(t, photo)}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+
+	// Plain merge for the reference size.
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := info.Size()
+
+	err = MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, MaxSize: full - 100})
+	var budget *SizeBudgetError
+	if !errors.As(err, &budget) || budget.Size <= budget.Max || len(budget.Largest) == 0 ||
+		budget.Largest[0].Path != "OEBPS/Volumes/v0001/Images/photo.jpg" {
+		t.Fatalf("err = %#v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatal("oversized output was kept")
+	}
+
+	// Dropping the second copy of the photo is enough.
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, MaxSize: full - 100, ShrinkToFit: true}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if hasManifestHref(vol.PackageDoc, "Volumes/v0002/Images/photo.jpg") {
+		t.Fatal("duplicate photo kept")
+	}
+	ch, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0002", "Text", "ch1.xhtml"))
+	if !bytes.Contains(ch, []byte(`src="../../v0001/Images/photo.jpg"`)) {
+		t.Fatalf("reference not updated:\n%s", ch)
+	}
+
+	// A tighter budget needs the photo re-encoded.
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, MaxSize: full - int64(len(photo))*3/2, ShrinkToFit: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An impossible one still fails, naming what was tried.
+	err = MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, MaxSize: 1000, ShrinkToFit: true})
+	if !errors.As(err, &budget) || len(budget.Steps) < 2 {
+		t.Fatalf("err = %v", err)
+	}
+
+	// A book bound for a Storage is checked before it is written there.
+	mem := NewMemStorage()
+	ctx = WithEnv(ctx, Env{Storages: map[string]Storage{"mem": mem}})
+	err = MergeEPUBs(ctx, vols, MergeOptions{OutPath: "mem://merged.epub", MaxSize: full - 100})
+	if !errors.As(err, &budget) {
+		t.Fatalf("err = %v", err)
+	}
+	if len(mem.Names()) != 0 {
+		t.Fatalf("oversized output written: %v", mem.Names())
+	}
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: "mem://merged.epub", MaxSize: full - 100, ShrinkToFit: true}); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := mem.Get("merged.epub"); !ok || int64(len(data)) > full-100 {
+		t.Fatalf("stored %d bytes, want at most %d", len(data), full-100)
+	}
+}
@@ -0,0 +1,385 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// CalibreMetadata is the subset of a Calibre book record novfmt carries
+// between an EPUB and Calibre's metadata.opf.
+type CalibreMetadata struct {
+	Title       string
+	Authors     []string
+	Series      string
+	SeriesIndex string
+	Tags        []string
+	Comments    string
+	Language    string
+	Publisher   string
+}
+
+type calibreOPF struct {
+	Metadata struct {
+		Titles       []string         `xml:"http://purl.org/dc/elements/1.1/ title"`
+		Creators     []calibreCreator `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		Subjects     []string         `xml:"http://purl.org/dc/elements/1.1/ subject"`
+		Descriptions []string         `xml:"http://purl.org/dc/elements/1.1/ description"`
+		Languages    []string         `xml:"http://purl.org/dc/elements/1.1/ language"`
+		Publishers   []string         `xml:"http://purl.org/dc/elements/1.1/ publisher"`
+		Meta         []MetaNode       `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+type calibreCreator struct {
+	Role  string `xml:"http://www.idpf.org/2007/opf role,attr"`
+	Value string `xml:",chardata"`
+}
+
+// iso6392Languages maps the ISO 639-2 codes Calibre and Open Library use
+// to the BCP 47 tags EPUB readers expect, for the languages novfmt is
+// mostly used with.
+var iso6392Languages = map[string]string{
+	"jpn": "ja",
+	"eng": "en",
+	"zho": "zh",
+	"chi": "zh",
+	"kor": "ko",
+	"fra": "fr",
+	"fre": "fr",
+	"deu": "de",
+	"ger": "de",
+	"spa": "es",
+	"ita": "it",
+	"rus": "ru",
+	"por": "pt",
+}
+
+// languageTag returns the BCP 47 tag for an ISO 639-2 code it knows, and
+// code unchanged otherwise.
+func languageTag(code string) string {
+	if tag, ok := iso6392Languages[strings.ToLower(code)]; ok {
+		return tag
+	}
+	return code
+}
+
+// ReadCalibreOPF reads a metadata.opf as written by Calibre next to each
+// book in its library. Calibre's metadata.db is a SQLite database; novfmt
+// has no SQLite driver, so it is rejected with a pointer to the OPF. Fields
+// only the database holds, such as custom columns or edits Calibre has not
+// yet backed up to the OPF, are not read.
+func ReadCalibreOPF(path string) (CalibreMetadata, error) {
+	var meta CalibreMetadata
+	if strings.EqualFold(filepath.Ext(path), ".db") {
+		return meta, fmt.Errorf("%s: reading Calibre's metadata.db is not supported; use the metadata.opf Calibre keeps in each book's folder", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	if bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return meta, fmt.Errorf("%s: reading Calibre's metadata.db is not supported; use the metadata.opf Calibre keeps in each book's folder", path)
+	}
+	var doc calibreOPF
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return meta, fmt.Errorf("%s: %w", path, err)
+	}
+	m := doc.Metadata
+	meta.Title = firstString(m.Titles)
+	for _, c := range m.Creators {
+		name := normalizeSpace(c.Value)
+		if name == "" || (c.Role != "" && c.Role != "aut") {
+			continue
+		}
+		meta.Authors = append(meta.Authors, name)
+	}
+	for _, s := range m.Subjects {
+		if s = normalizeSpace(s); s != "" {
+			meta.Tags = append(meta.Tags, s)
+		}
+	}
+	meta.Comments = firstString(m.Descriptions)
+	meta.Language = languageTag(firstString(m.Languages))
+	meta.Publisher = firstString(m.Publishers)
+	for _, node := range m.Meta {
+		switch node.Name {
+		case "calibre:series":
+			meta.Series = strings.TrimSpace(node.Content)
+		case "calibre:series_index":
+			meta.SeriesIndex = strings.TrimSpace(node.Content)
+		}
+	}
+	return meta, nil
+}
+
+// WriteCalibreOPF writes meta as an OPF 2 metadata.opf Calibre can import.
+func WriteCalibreOPF(path string, meta CalibreMetadata) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	buf.WriteString(`<package xmlns="http://www.idpf.org/2007/opf" version="2.0">` + "\n")
+	buf.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + "\n")
+	element := func(tag, attrs, value string) {
+		if value == "" {
+			return
+		}
+		buf.WriteString("    <" + tag + attrs + ">")
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString("</" + tag + ">\n")
+	}
+	element("dc:title", "", meta.Title)
+	for _, a := range meta.Authors {
+		element("dc:creator", ` opf:role="aut"`, a)
+	}
+	element("dc:description", "", meta.Comments)
+	element("dc:publisher", "", meta.Publisher)
+	element("dc:language", "", meta.Language)
+	for _, t := range meta.Tags {
+		element("dc:subject", "", t)
+	}
+	metaTag := func(name, content string) {
+		if content == "" {
+			return
+		}
+		buf.WriteString(`    <meta name="` + name + `" content="`)
+		xml.EscapeText(&buf, []byte(content))
+		buf.WriteString("\"/>\n")
+	}
+	if meta.Series != "" {
+		metaTag("calibre:series", meta.Series)
+		metaTag("calibre:series_index", meta.SeriesIndex)
+	}
+	buf.WriteString("  </metadata>\n</package>\n")
+
+	if err := ensureParentDir(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// calibreFromPackage collects the Calibre fields from an EPUB's metadata.
+// The series comes from calibre:series or, failing that, an EPUB 3
+// belongs-to-collection of collection-type series.
+func calibreFromPackage(meta Metadata) CalibreMetadata {
+	out := CalibreMetadata{
+		Title:     normalizeSpace(mainTitle(meta)),
+		Authors:   collectCreators(meta.Creators),
+		Comments:  strings.TrimSpace(firstDCValue(meta.Descriptions)),
+		Language:  strings.TrimSpace(firstDCValue(meta.Languages)),
+		Publisher: strings.TrimSpace(firstDCValue(meta.Publishers)),
+	}
+	for _, s := range meta.Subjects {
+		if v := normalizeSpace(s.Value); v != "" {
+			out.Tags = append(out.Tags, v)
+		}
+	}
+	for _, node := range meta.Meta {
+		switch node.Name {
+		case "calibre:series":
+			out.Series = strings.TrimSpace(node.Content)
+		case "calibre:series_index":
+			out.SeriesIndex = strings.TrimSpace(node.Content)
+		}
+	}
+	if out.Series != "" {
+		return out
+	}
+	for _, node := range meta.Meta {
+		if node.Property != "belongs-to-collection" {
+			continue
+		}
+		ref := "#" + node.ID
+		isSeries := false
+		index := ""
+		for _, r := range meta.Meta {
+			if node.ID == "" || r.Refines != ref {
+				continue
+			}
+			switch r.Property {
+			case "collection-type":
+				isSeries = strings.TrimSpace(r.Value) == "series"
+			case "group-position":
+				index = strings.TrimSpace(r.Value)
+			}
+		}
+		if isSeries {
+			out.Series, out.SeriesIndex = strings.TrimSpace(node.Value), index
+			break
+		}
+	}
+	return out
+}
+
+// applyCalibreMetadata replaces the EPUB fields Calibre manages with those
+// in c and reports whether any differed. Empty fields in c leave the book
+// alone, and the elements replaced keep their ids so that refinements stay
+// attached. The series is written as Calibre's meta pair and, in EPUB 3,
+// as a collection too.
+func applyCalibreMetadata(meta *Metadata, epub3 bool, c CalibreMetadata) bool {
+	current := calibreFromPackage(*meta)
+	changed := false
+	if c.Title != "" && c.Title != current.Title {
+		setMainTitle(meta, c.Title)
+		changed = true
+	}
+	if len(c.Authors) > 0 && !slices.Equal(c.Authors, current.Authors) {
+		old := map[string]Creator{}
+		for _, cr := range creatorsOf(*meta) {
+			if _, ok := old[cr.Name]; !ok {
+				old[cr.Name] = cr
+			}
+		}
+		creators := make([]Creator, 0, len(c.Authors))
+		for _, a := range c.Authors {
+			cr, ok := old[a]
+			if !ok {
+				cr = Creator{Name: a}
+			}
+			creators = append(creators, cr)
+		}
+		setCreators(meta, epub3, creators)
+		changed = true
+	}
+	if c.Comments != "" && c.Comments != current.Comments {
+		meta.Descriptions = replaceFirstDC(meta.Descriptions, c.Comments)
+		changed = true
+	}
+	if c.Language != "" && c.Language != current.Language {
+		meta.Languages = replaceFirstDC(meta.Languages, c.Language)
+		changed = true
+	}
+	if c.Publisher != "" && c.Publisher != current.Publisher {
+		meta.Publishers = replaceFirstDC(meta.Publishers, c.Publisher)
+		changed = true
+	}
+	if len(c.Tags) > 0 && !slices.Equal(c.Tags, current.Tags) {
+		setSubjects(meta, c.Tags)
+		changed = true
+	}
+	if c.Series != "" && (c.Series != current.Series || c.SeriesIndex != current.SeriesIndex) {
+		setSeries(meta, epub3, c.Series, c.SeriesIndex)
+		changed = true
+	}
+	return changed
+}
+
+// setSubjects replaces the subjects of meta with tags. A subject that was
+// already there keeps its id and refinements; those of subjects dropped go
+// with them.
+func setSubjects(meta *Metadata, tags []string) {
+	old := map[string]DCMeta{}
+	for _, dc := range meta.Subjects {
+		v := normalizeSpace(dc.Value)
+		if _, ok := old[v]; !ok {
+			old[v] = dc
+		}
+	}
+	kept := map[string]bool{}
+	list := make([]DCMeta, 0, len(tags))
+	for _, t := range tags {
+		dc, ok := old[t]
+		if !ok || dc.ID != "" && kept["#"+dc.ID] {
+			dc = DCMeta{}
+		}
+		dc.Value = t
+		if dc.ID != "" {
+			kept["#"+dc.ID] = true
+		}
+		list = append(list, dc)
+	}
+	dropped := map[string]bool{}
+	for _, dc := range meta.Subjects {
+		if dc.ID != "" && !kept["#"+dc.ID] {
+			dropped["#"+dc.ID] = true
+		}
+	}
+	metas := meta.Meta[:0]
+	for _, node := range meta.Meta {
+		if !dropped[node.Refines] {
+			metas = append(metas, node)
+		}
+	}
+	meta.Meta = metas
+	meta.Subjects = list
+}
+
+// seriesCollection returns the index in meta.Meta of the EPUB 3
+// belongs-to-collection of collection-type series, or -1.
+func seriesCollection(meta Metadata) int {
+	for i, node := range meta.Meta {
+		if node.Property != "belongs-to-collection" || node.ID == "" {
+			continue
+		}
+		for _, r := range meta.Meta {
+			if r.Refines == "#"+node.ID && r.Property == "collection-type" && strings.TrimSpace(r.Value) == "series" {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// setSeries replaces the series of meta; an empty series removes it. It is
+// written as Calibre's calibre:series and calibre:series_index metas, and in
+// EPUB 3 also as a belongs-to-collection of collection-type series, which
+// keeps its id and other refinements when it was already there. OPF 2.0
+// has no collections, so there only Calibre's pair is written.
+func setSeries(meta *Metadata, epub3 bool, series, index string) {
+	id := ""
+	if i := seriesCollection(*meta); i >= 0 {
+		id = meta.Meta[i].ID
+	}
+	keepCollection := id != "" && epub3 && series != ""
+	kept := meta.Meta[:0]
+	for _, node := range meta.Meta {
+		switch {
+		case node.Name == "calibre:series", node.Name == "calibre:series_index":
+		case id != "" && node.ID == id:
+			if keepCollection {
+				node.Value = series
+				kept = append(kept, node)
+			}
+		case id != "" && node.Refines == "#"+id:
+			if keepCollection && node.Property != "group-position" {
+				kept = append(kept, node)
+			}
+		default:
+			kept = append(kept, node)
+		}
+	}
+	meta.Meta = kept
+	if series == "" {
+		return
+	}
+
+	meta.Meta = append(meta.Meta, MetaNode{Name: "calibre:series", Content: series})
+	if index != "" {
+		meta.Meta = append(meta.Meta, MetaNode{Name: "calibre:series_index", Content: index})
+	}
+	if !epub3 {
+		return
+	}
+	if !keepCollection {
+		id = newMetadataID(metadataIDs(meta), "series")
+		meta.Meta = append(meta.Meta,
+			MetaNode{ID: id, Property: "belongs-to-collection", Value: series},
+			MetaNode{Refines: "#" + id, Property: "collection-type", Value: "series"},
+		)
+	}
+	if index != "" {
+		meta.Meta = append(meta.Meta, MetaNode{Refines: "#" + id, Property: "group-position", Value: index})
+	}
+}
+
+func firstString(values []string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCalibreImportExport(t *testing.T) {
+	dir := t.TempDir()
+	opf := filepath.Join(dir, "metadata.opf")
+	if err := os.WriteFile(opf, []byte(`<?xml version='1.0' encoding='utf-8'?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="uuid_id" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:identifier opf:scheme="calibre" id="calibre_id">12</dc:identifier>
+    <dc:title>Saga Vol. 3</dc:title>
+    <dc:creator opf:file-as="Doe, Jane" opf:role="aut">Jane Doe</dc:creator>
+    <dc:contributor opf:role="bkp">calibre (7.0)</dc:contributor>
+    <dc:creator opf:role="ill">Some Artist</dc:creator>
+    <dc:description>&lt;p&gt;Third &amp;amp; best.&lt;/p&gt;</dc:description>
+    <dc:language>jpn</dc:language>
+    <dc:subject>Fantasy</dc:subject>
+    <dc:subject>Light Novel</dc:subject>
+    <meta name="calibre:series" content="Saga"/>
+    <meta name="calibre:series_index" content="3.0"/>
+  </metadata>
+</package>
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:calibre</dc:identifier>
+    <dc:title>Old</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="belongs-to-collection" id="c1">Old Saga</meta>
+    <meta refines="#c1" property="collection-type">series</meta>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head><body><p>x</p></body></html>`,
+	})
+
+	ctx := context.Background()
+	before := filepath.Join(dir, "before.opf")
+	if _, err := EditEPUB(ctx, input, EditOptions{ImportCalibrePath: opf, ExportCalibrePath: before}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	old, err := ReadCalibreOPF(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Title != "Old" || old.Series != "Old Saga" {
+		t.Fatalf("export before import = %+v", old)
+	}
+
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	got := calibreFromPackage(meta)
+	want := CalibreMetadata{
+		Title:       "Saga Vol. 3",
+		Authors:     []string{"Jane Doe"},
+		Series:      "Saga",
+		SeriesIndex: "3.0",
+		Tags:        []string{"Fantasy", "Light Novel"},
+		Comments:    "<p>Third &amp; best.</p>",
+		Language:    "ja",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("imported = %+v\nwant %+v", got, want)
+	}
+	// The series collection keeps its id, so its refinements stay attached.
+	var collections []MetaNode
+	position := ""
+	for _, m := range meta.Meta {
+		if m.Property == "belongs-to-collection" {
+			collections = append(collections, m)
+		}
+		if m.Refines == "#c1" && m.Property == "group-position" {
+			position = m.Value
+		}
+	}
+	if len(collections) != 1 || collections[0].ID != "c1" || collections[0].Value != "Saga" || position != "3.0" {
+		t.Fatalf("collections = %+v, position %q", collections, position)
+	}
+
+	// Importing the same metadata again changes nothing.
+	if applyCalibreMetadata(&meta, true, want) {
+		t.Fatal("re-import reported a change")
+	}
+
+	// Round trip through an exported metadata.opf.
+	after := filepath.Join(dir, "after.opf")
+	if err := WriteCalibreOPF(after, got); err != nil {
+		t.Fatal(err)
+	}
+	back, err := ReadCalibreOPF(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, want) {
+		t.Fatalf("round trip = %+v", back)
+	}
+
+	db := filepath.Join(dir, "metadata.db")
+	os.WriteFile(db, []byte("SQLite format 3\x00"), 0o644)
+	if _, err := ReadCalibreOPF(db); err == nil || !strings.Contains(err.Error(), "metadata.opf") {
+		t.Fatalf("metadata.db error = %v", err)
+	}
+}
+
+func TestApplyCalibreMetadataEPUB2(t *testing.T) {
+	meta := Metadata{
+		Titles:   []DCMeta{{Value: "Saga 3"}},
+		Creators: []DCMeta{{ID: "a1", Value: "Jane Doe", FileAs: "Doe, Jane", Role: "aut"}},
+		Subjects: []DCMeta{{ID: "s1", Value: "Fantasy"}},
+	}
+	c := CalibreMetadata{Title: "Saga 3", Authors: []string{"Jane Doe"}, Tags: []string{"Fantasy", "Drama"}, Series: "Saga", SeriesIndex: "3"}
+	if !applyCalibreMetadata(&meta, false, c) {
+		t.Fatal("import reported no change")
+	}
+	if got := meta.Creators[0]; got.ID != "a1" || got.FileAs != "Doe, Jane" || got.Role != "aut" {
+		t.Fatalf("creator = %+v", got)
+	}
+	if meta.Subjects[0].ID != "s1" || len(meta.Subjects) != 2 {
+		t.Fatalf("subjects = %+v", meta.Subjects)
+	}
+	want := []MetaNode{
+		{Name: "calibre:series", Content: "Saga"},
+		{Name: "calibre:series_index", Content: "3"},
+	}
+	if !reflect.DeepEqual(meta.Meta, want) {
+		t.Fatalf("meta = %+v\nwant %+v", meta.Meta, want)
+	}
+	if applyCalibreMetadata(&meta, false, c) {
+		t.Fatal("re-import reported a change")
+	}
+}
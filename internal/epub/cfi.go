@@ -0,0 +1,418 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// cfiBlockTags get anchor ids from AddCFIAnchors.
+var cfiBlockTags = map[string]bool{
+	"p": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "li": true, "blockquote": true, "pre": true,
+	"figure": true, "section": true, "table": true, "dt": true, "dd": true,
+	"hr": true,
+}
+
+var (
+	blockStartPattern = regexp.MustCompile(`(?i)<(p|div|h[1-6]|li|blockquote|pre|figure|section|table|dt|dd|hr)(\s[^<>]*?)?(/?)>`)
+	idAttrPattern     = regexp.MustCompile(`(?i)\sid\s*=\s*("[^"]*"|'[^']*')`)
+	bodyStartPattern  = regexp.MustCompile(`(?i)<body\b[^>]*>`)
+)
+
+type CFIAnchorOptions struct {
+	// Prefix starts every generated id (default "nf-"); the rest is the
+	// position of the block among the document's blocks, so ids stay the
+	// same whenever the structure does.
+	Prefix   string
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// CFILocation is where a CFI points inside a book.
+type CFILocation struct {
+	// Href is the content document, relative to the package document.
+	Href   string `json:"href"`
+	ItemID string `json:"item_id"`
+	// Path names the elements walked, e.g. "html/body/p[5]".
+	Path string `json:"path"`
+	// ElementID is the id of the target element or its nearest ancestor
+	// with one.
+	ElementID string `json:"element_id,omitempty"`
+	// Offset is the character offset (UTF-16 code units, as in the CFI)
+	// into the text of the target, or -1 when the CFI has none.
+	Offset  int    `json:"offset"`
+	Excerpt string `json:"excerpt,omitempty"`
+}
+
+// AddCFIAnchors gives every block element without an id in the spine
+// documents a stable, position-based id, so reading positions expressed as
+// CFIs with id assertions survive regeneration of the book. Documents are
+// edited in place textually; element order and everything else is kept.
+func AddCFIAnchors(ctx context.Context, input string, opts CFIAnchorOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "nf-"
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	hrefs := spineHrefs(vol.PackageDoc)
+	for i, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(hrefs), href)
+		p := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return stats, err
+		}
+		out, n := addBlockIDs(string(data), opts.Prefix)
+		if n == 0 {
+			continue
+		}
+		log.Debug("added anchors", "href", href, "count", n)
+		stats.FilesChanged++
+		stats.Changeset.modified(href)
+		stats.MatchCount += n
+		stats.Files = append(stats.Files, RewriteFileResult{Href: href, Matches: n})
+		if !opts.DryRun {
+			if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(hrefs), len(hrefs), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// addBlockIDs numbers the block start tags in the body of doc and adds
+// prefix+number as id to those without one. Numbers that would clash with
+// an existing id are skipped.
+func addBlockIDs(doc, prefix string) (string, int) {
+	loc := bodyStartPattern.FindStringIndex(doc)
+	if loc == nil {
+		return doc, 0
+	}
+	existing := map[string]bool{}
+	for _, m := range idAttrPattern.FindAllStringSubmatch(doc, -1) {
+		existing[m[1][1:len(m[1])-1]] = true
+	}
+	pos, added := 0, 0
+	body := blockStartPattern.ReplaceAllStringFunc(doc[loc[1]:], func(tag string) string {
+		pos++
+		m := blockStartPattern.FindStringSubmatch(tag)
+		if idAttrPattern.MatchString(m[2]) {
+			return tag
+		}
+		id := prefix + strconv.Itoa(pos)
+		if existing[id] {
+			return tag
+		}
+		added++
+		return "<" + m[1] + m[2] + ` id="` + id + `"` + m[3] + ">"
+	})
+	return doc[:loc[1]] + body, added
+}
+
+// cfiStep is one /N[assertion] step of a CFI path.
+type cfiStep struct {
+	index     int
+	assertion string
+}
+
+type parsedCFI struct {
+	pkgSteps []cfiStep
+	docSteps []cfiStep
+	offset   int
+}
+
+// ResolveCFI maps an EPUB CFI such as
+// epubcfi(/6/4[chap01]!/4/2[p1]/1:10) to a content document and a position
+// inside it. For range CFIs the start of the range is resolved.
+func ResolveCFI(ctx context.Context, input, cfi string) (*CFILocation, error) {
+	parsed, err := parseCFI(cfi)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	pkg := vol.PackageDoc
+	if len(parsed.pkgSteps) != 2 || parsed.pkgSteps[0].index != 6 {
+		return nil, fmt.Errorf("cfi must start with /6/<itemref> (the spine)")
+	}
+	ref := parsed.pkgSteps[1]
+	idx := ref.index/2 - 1
+	var itemID string
+	switch {
+	case ref.index%2 == 0 && idx >= 0 && idx < len(pkg.Spine.Itemrefs) &&
+		(ref.assertion == "" || pkg.Spine.Itemrefs[idx].IDRef == ref.assertion):
+		itemID = pkg.Spine.Itemrefs[idx].IDRef
+	case ref.assertion != "":
+		// The index is stale; trust the id assertion as CFI processors may.
+		itemID = ref.assertion
+	default:
+		return nil, fmt.Errorf("spine step /%d is out of range (%d items)", ref.index, len(pkg.Spine.Itemrefs))
+	}
+	href := ""
+	for _, item := range pkg.Manifest.Items {
+		if item.ID == itemID {
+			href = item.Href
+		}
+	}
+	if href == "" {
+		return nil, fmt.Errorf("spine item %q is not in the manifest", itemID)
+	}
+
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseCFIDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", href, err)
+	}
+	loc, err := walkCFI(root, parsed.docSteps, parsed.offset)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", href, err)
+	}
+	loc.Href = href
+	loc.ItemID = itemID
+	return loc, nil
+}
+
+var cfiStepPattern = regexp.MustCompile(`^/(\d+)(?:\[([^\]]*)\])?`)
+
+func parseCFI(s string) (*parsedCFI, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "epubcfi(") && strings.HasSuffix(s, ")") {
+		s = s[len("epubcfi(") : len(s)-1]
+	}
+	// Range: parent,start,end — resolve parent+start.
+	if parts := strings.Split(s, ","); len(parts) == 3 {
+		s = parts[0] + parts[1]
+	}
+	pkgPart, docPart, ok := strings.Cut(s, "!")
+	if !ok {
+		return nil, fmt.Errorf("cfi %q has no '!' step into a content document", s)
+	}
+	out := &parsedCFI{offset: -1}
+	var err error
+	if out.pkgSteps, _, err = parseCFISteps(pkgPart); err != nil {
+		return nil, err
+	}
+	var rest string
+	if out.docSteps, rest, err = parseCFISteps(docPart); err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		if !strings.HasPrefix(rest, ":") {
+			return nil, fmt.Errorf("unexpected %q in cfi", rest)
+		}
+		num := strings.TrimPrefix(rest, ":")
+		if i := strings.IndexAny(num, "[~@"); i >= 0 {
+			num = num[:i]
+		}
+		if out.offset, err = strconv.Atoi(num); err != nil {
+			return nil, fmt.Errorf("invalid character offset %q", rest)
+		}
+	}
+	if len(out.docSteps) == 0 {
+		return nil, fmt.Errorf("cfi has no steps inside the content document")
+	}
+	return out, nil
+}
+
+func parseCFISteps(s string) ([]cfiStep, string, error) {
+	var steps []cfiStep
+	for strings.HasPrefix(s, "/") {
+		m := cfiStepPattern.FindStringSubmatch(s)
+		if m == nil {
+			return nil, "", fmt.Errorf("invalid cfi step at %q", s)
+		}
+		n, _ := strconv.Atoi(m[1])
+		assertion, _, _ := strings.Cut(m[2], ";")
+		steps = append(steps, cfiStep{index: n, assertion: assertion})
+		s = s[len(m[0]):]
+	}
+	return steps, s, nil
+}
+
+// cfiNode is an element of a parsed content document; text holds the
+// character data before each child element and after the last one, so
+// len(text) == len(children)+1.
+type cfiNode struct {
+	name     string
+	id       string
+	children []*cfiNode
+	text     []string
+}
+
+func parseCFIDocument(data []byte) (*cfiNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	var (
+		root  *cfiNode
+		stack []*cfiNode
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &cfiNode{name: strings.ToLower(t.Name.Local), id: attrValue(t.Attr, "id"), text: []string{""}}
+			if len(stack) == 0 {
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+				parent.text = append(parent.text, "")
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				n := stack[len(stack)-1]
+				n.text[len(n.text)-1] += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	return root, nil
+}
+
+// textContent is all character data under n.
+func (n *cfiNode) textContent() string {
+	var b strings.Builder
+	for i, t := range n.text {
+		b.WriteString(t)
+		if i < len(n.children) {
+			b.WriteString(n.children[i].textContent())
+		}
+	}
+	return b.String()
+}
+
+func walkCFI(root *cfiNode, steps []cfiStep, offset int) (*CFILocation, error) {
+	loc := &CFILocation{Offset: offset}
+	path := []string{root.name}
+	node := root
+	text := ""
+	isText := false
+	elementID := root.id
+	for i, step := range steps {
+		if isText {
+			return nil, fmt.Errorf("step %d goes below a text position", i+1)
+		}
+		if step.index%2 == 1 {
+			chunk := (step.index - 1) / 2
+			if chunk >= len(node.text) {
+				return nil, fmt.Errorf("text step /%d is out of range in %s", step.index, strings.Join(path, "/"))
+			}
+			text = node.text[chunk]
+			isText = true
+			continue
+		}
+		child := step.index/2 - 1
+		if child < 0 || child >= len(node.children) {
+			if step.assertion == "" {
+				return nil, fmt.Errorf("step /%d is out of range in %s (%d elements)", step.index, strings.Join(path, "/"), len(node.children))
+			}
+			child = -1
+		} else if step.assertion != "" && node.children[child].id != step.assertion {
+			child = -1
+		}
+		if child < 0 {
+			// Index and id assertion disagree: follow the id.
+			for j, c := range node.children {
+				if c.id == step.assertion {
+					child = j
+				}
+			}
+			if child < 0 {
+				return nil, fmt.Errorf("no element with id %q in %s", step.assertion, strings.Join(path, "/"))
+			}
+		}
+		node = node.children[child]
+		path = append(path, fmt.Sprintf("%s[%d]", node.name, child+1))
+		if node.id != "" {
+			elementID = node.id
+		}
+	}
+	if !isText {
+		text = node.textContent()
+	}
+	loc.Path = strings.Join(path, "/")
+	loc.ElementID = elementID
+	loc.Excerpt = cfiExcerpt(text, offset)
+	return loc, nil
+}
+
+// cfiExcerpt returns up to 30 characters either side of offset (UTF-16
+// units), marking the position with ‸.
+func cfiExcerpt(text string, offset int) string {
+	units := utf16.Encode([]rune(text))
+	if offset < 0 {
+		return truncateRunes(normalizeSpace(text), 60)
+	}
+	if offset > len(units) {
+		offset = len(units)
+	}
+	before := []rune(string(utf16.Decode(units[:offset])))
+	after := []rune(string(utf16.Decode(units[offset:])))
+	if len(before) > 30 {
+		before = before[len(before)-30:]
+	}
+	if len(after) > 30 {
+		after = after[:30]
+	}
+	return strings.Join(strings.Fields(string(before)), " ") + "‸" + strings.Join(strings.Fields(string(after)), " ")
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
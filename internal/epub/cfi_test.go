@@ -0,0 +1,89 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddCFIAnchorsAndResolve(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:cfi</dc:identifier>
+    <dc:title>CFI</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>one</title></head><body><p>一</p></body></html>
+`,
+		"OEBPS/Text/ch2.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>two</title></head>
+<body><h1 id="top">Chapter</h1><p>First line.</p><p class="x">Second <em>line</em> here.</p><hr/></body></html>
+`,
+	})
+	ctx := context.Background()
+
+	stats, err := AddCFIAnchors(ctx, input, CFIAnchorOptions{})
+	if err != nil {
+		t.Fatalf("AddCFIAnchors: %v", err)
+	}
+	if stats.FilesChanged != 2 || stats.MatchCount != 4 {
+		t.Fatalf("stats = %+v, want 2 files / 4 anchors", stats)
+	}
+
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	doc, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch2.xhtml"))
+	for _, want := range []string{`<h1 id="top">`, `<p id="nf-2">`, `<p class="x" id="nf-3">`, `<hr id="nf-4"/>`} {
+		if !strings.Contains(string(doc), want) {
+			t.Fatalf("missing %s in:\n%s", want, doc)
+		}
+	}
+
+	// Anchoring again finds nothing to do.
+	stats, err = AddCFIAnchors(ctx, input, CFIAnchorOptions{DryRun: true})
+	if err != nil || stats.FilesChanged != 0 {
+		t.Fatalf("second run changed %d files (%v)", stats.FilesChanged, err)
+	}
+
+	loc, err := ResolveCFI(ctx, input, "epubcfi(/6/4[ch2]!/4/6[nf-3]/1:3)")
+	if err != nil {
+		t.Fatalf("ResolveCFI: %v", err)
+	}
+	if loc.Href != "Text/ch2.xhtml" || loc.ElementID != "nf-3" || loc.Path != "html/body[2]/p[3]" {
+		t.Fatalf("unexpected location %+v", loc)
+	}
+	if loc.Offset != 3 || loc.Excerpt != "Sec‸ond" {
+		t.Fatalf("offset/excerpt = %d %q", loc.Offset, loc.Excerpt)
+	}
+
+	// A stale index is corrected by the id assertion.
+	loc, err = ResolveCFI(ctx, input, "epubcfi(/6/4!/4/2[nf-2])")
+	if err != nil {
+		t.Fatalf("ResolveCFI: %v", err)
+	}
+	if loc.ElementID != "nf-2" || loc.Offset != -1 || loc.Excerpt != "First line." {
+		t.Fatalf("unexpected location %+v", loc)
+	}
+
+	if _, err := ResolveCFI(ctx, input, "epubcfi(/6/10!/4/2)"); err == nil {
+		t.Fatalf("expected out-of-range spine step to fail")
+	}
+}
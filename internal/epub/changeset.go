@@ -0,0 +1,150 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+)
+
+// Kinds of FileChange.
+const (
+	ChangeModified = "modified"
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+)
+
+// Outcomes of a Changeset.
+const (
+	// OutcomeWritten means the book was saved to OutPath.
+	OutcomeWritten = "written"
+	// OutcomeDryRun means nothing was written because of a dry run; Files
+	// lists what would have changed.
+	OutcomeDryRun = "dry-run"
+	// OutcomeUnchanged means nothing was written because nothing changed.
+	OutcomeUnchanged = "unchanged"
+)
+
+// FileChange is one file of a book that a command changed.
+type FileChange struct {
+	// Href is relative to the package document; files outside its
+	// directory, such as those in META-INF, start with "../".
+	Href string `json:"href"`
+	Kind string `json:"kind"`
+}
+
+// Changeset records which files a command changed in a book and whether
+// and why the result was written, the same way for every command.
+type Changeset struct {
+	Outcome string `json:"outcome"`
+	// OutPath is the file written, when Outcome is OutcomeWritten.
+	OutPath string `json:"out_path,omitempty"`
+	// Reason explains the outcome.
+	Reason string       `json:"reason"`
+	Files  []FileChange `json:"files"`
+}
+
+// Changed reports whether any file was (or, in a dry run, would be)
+// changed.
+func (c *Changeset) Changed() bool { return len(c.Files) > 0 }
+
+// Written reports whether the book was saved.
+func (c *Changeset) Written() bool { return c.Outcome == OutcomeWritten }
+
+func (c *Changeset) modified(href string) { c.record(href, ChangeModified) }
+func (c *Changeset) added(href string)    { c.record(href, ChangeAdded) }
+func (c *Changeset) removed(href string)  { c.record(href, ChangeRemoved) }
+
+// record notes a change to href. A file added and then modified stays
+// added, one added and then removed is dropped, and one removed and then
+// written again counts as modified. A nil Changeset records nothing, for
+// helpers shared with code that does not report changes.
+func (c *Changeset) record(href, kind string) {
+	if c == nil {
+		return
+	}
+	href = normalizeEPUBPath(href)
+	for i, f := range c.Files {
+		if f.Href != href {
+			continue
+		}
+		switch {
+		case f.Kind == ChangeAdded && kind == ChangeRemoved:
+			c.Files = append(c.Files[:i], c.Files[i+1:]...)
+		case f.Kind == ChangeAdded:
+		case f.Kind == ChangeRemoved && kind != ChangeRemoved:
+			c.Files[i].Kind = ChangeModified
+		default:
+			c.Files[i].Kind = kind
+		}
+		return
+	}
+	c.Files = append(c.Files, FileChange{Href: href, Kind: kind})
+}
+
+func (c *Changeset) has(href string) bool {
+	for _, f := range c.Files {
+		if f.Href == href {
+			return true
+		}
+	}
+	return false
+}
+
+// packageHref is the package document's href for Changeset purposes.
+func packageHref(vol *Volume) string {
+	return filepath.Base(vol.PackagePath)
+}
+
+// commit saves vol to outPath (input when empty) if anything changed and
+// this is not a dry run, and records the outcome. The package document is
+// rewritten only when the changeset includes it.
+func (c *Changeset) commit(ctx context.Context, vol *Volume, input, outPath string, dryRun bool, progress ProgressFunc, log *slog.Logger) error {
+	if c.Files == nil {
+		c.Files = []FileChange{}
+	}
+	switch {
+	case dryRun && !c.Changed():
+		c.Outcome = OutcomeDryRun
+		c.Reason = "dry run; nothing would change"
+		return nil
+	case dryRun:
+		c.Outcome = OutcomeDryRun
+		c.Reason = fmt.Sprintf("dry run; %s would change", countFiles(len(c.Files)))
+		return nil
+	}
+	if outPath == "" {
+		outPath = input
+	}
+	// A book headed down a pipeline is written even when unchanged, so the
+	// next command gets it.
+	if !c.Changed() && outPath != StreamPath {
+		c.Outcome = OutcomeUnchanged
+		c.Reason = "nothing to change"
+		log.Info("no changes to write")
+		return nil
+	}
+	if c.has(packageHref(vol)) {
+		if err := writePackage(vol.PackageDoc, vol.PackagePath); err != nil {
+			return err
+		}
+	}
+	log.Info("zipping output", "path", outPath)
+	if err := saveVolume(ctx, vol, outPath, progress); err != nil {
+		return err
+	}
+	c.Outcome = OutcomeWritten
+	c.OutPath = outPath
+	c.Reason = fmt.Sprintf("%s changed", countFiles(len(c.Files)))
+	if !c.Changed() {
+		c.Reason = "nothing to change; passed through"
+	}
+	return nil
+}
+
+func countFiles(n int) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%d files", n)
+}
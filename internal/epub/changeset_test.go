@@ -0,0 +1,133 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangesetRecord(t *testing.T) {
+	var cs Changeset
+	cs.added("Text/new.xhtml")
+	cs.modified("Text/new.xhtml")
+	cs.added("Images/tmp.png")
+	cs.removed("Images/tmp.png")
+	cs.removed("Text/cover.xhtml")
+	cs.added("Text/cover.xhtml")
+	cs.modified("Text/../content.opf")
+	want := []FileChange{
+		{"Text/new.xhtml", ChangeAdded},
+		{"Text/cover.xhtml", ChangeModified},
+		{"content.opf", ChangeModified},
+	}
+	if !reflect.DeepEqual(cs.Files, want) {
+		t.Fatalf("files = %+v, want %+v", cs.Files, want)
+	}
+
+	var none *Changeset
+	none.modified("a.xhtml")
+}
+
+func TestChangesetOutcome(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier><dc:language>en</dc:language></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/><item id="b" href="b.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Wait...</p></body></html>`,
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Fine.</p></body></html>`,
+	})
+	before, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := NormalizeTypography(ctx, input, TypoOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	cs := stats.Changeset
+	if cs.Outcome != OutcomeDryRun || cs.Written() || len(cs.Files) != 1 || cs.Files[0].Href != "a.xhtml" {
+		t.Fatalf("dry run changeset = %+v", cs)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.epub")
+	stats, err = NormalizeTypography(ctx, input, TypoOptions{OutPath: out})
+	if err != nil {
+		t.Fatalf("NormalizeTypography: %v", err)
+	}
+	cs = stats.Changeset
+	if cs.Outcome != OutcomeWritten || cs.OutPath != out || !reflect.DeepEqual(cs.Files, []FileChange{{"a.xhtml", ChangeModified}}) {
+		t.Fatalf("changeset = %+v", cs)
+	}
+
+	again := filepath.Join(t.TempDir(), "again.epub")
+	stats, err = NormalizeTypography(ctx, out, TypoOptions{OutPath: again})
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if cs := stats.Changeset; cs.Outcome != OutcomeUnchanged || cs.Changed() || cs.Reason == "" {
+		t.Fatalf("second run changeset = %+v", cs)
+	}
+	if _, err := os.Stat(again); !os.IsNotExist(err) {
+		t.Fatalf("unchanged book was written: %v", err)
+	}
+	if after, _ := os.Stat(input); !after.ModTime().Equal(before.ModTime()) {
+		t.Fatal("input was modified")
+	}
+
+	cs, err = EditEPUB(ctx, out, EditOptions{MetadataPatch: MetadataPatch{Title: stringPtr("Renamed")}})
+	if err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	if !cs.Written() || !reflect.DeepEqual(cs.Files, []FileChange{{"content.opf", ChangeModified}}) {
+		t.Fatalf("edit changeset = %+v", cs)
+	}
+}
+
+func TestCanceledSaveLeavesNoPartialOutput(t *testing.T) {
+	input := buildTestEPUB(t, "Cancel", "en")
+	before, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if err := os.WriteFile(filepath.Join(vol.PackageDir, "chapter.xhtml"), []byte("<html/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var cs Changeset
+	cs.modified("chapter.xhtml")
+	out := filepath.Join(t.TempDir(), "out.epub")
+	for _, dest := range []string{"", out} {
+		err := cs.commit(ctx, vol, input, dest, false, nil, loggerOrDiscard(nil))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("commit to %q: err = %v, want context.Canceled", dest, err)
+		}
+	}
+	after, err := os.ReadFile(input)
+	if err != nil || !bytes.Equal(before, after) {
+		t.Fatalf("input changed by a canceled save (%v)", err)
+	}
+	for _, dir := range []string{filepath.Dir(input), filepath.Dir(out)} {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if e.Name() != filepath.Base(input) {
+				t.Errorf("left behind %s", filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ChapterHashesFile is the container-relative path of the chapter hash
+// sidecar.
+const ChapterHashesFile = "META-INF/novfmt-chapters.json"
+
+// ErrNoChapterHashes is returned when a book has no chapter hash sidecar.
+var ErrNoChapterHashes = errors.New("book has no embedded chapter hashes")
+
+// ChapterHash is the SHA-256 of one spine document's bytes.
+type ChapterHash struct {
+	// Href is relative to the package document.
+	Href   string `json:"href"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ChapterHashes lists the spine documents of a book in reading order.
+type ChapterHashes struct {
+	Algorithm string        `json:"algorithm"`
+	Chapters  []ChapterHash `json:"chapters"`
+}
+
+// ChapterHashChange is one difference between two sets of chapter hashes.
+type ChapterHashChange struct {
+	Href string `json:"href"`
+	// Status is "added", "removed" or "changed".
+	Status string `json:"status"`
+}
+
+type ChapterHashOptions struct {
+	OutPath  string
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// EmbedChapterHashes writes the chapter hash sidecar into a book. Once
+// present, every command that saves the book keeps it up to date.
+func EmbedChapterHashes(ctx context.Context, input string, opts ChapterHashOptions) (*ChapterHashes, Changeset, error) {
+	var cs Changeset
+	if input == "" {
+		return nil, cs, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, cs, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	sidecar := filepath.Join(vol.RootDir, filepath.FromSlash(ChapterHashesFile))
+	before, err := os.ReadFile(sidecar)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, cs, err
+	}
+	existed := err == nil
+	hashes, err := writeChapterHashes(vol.RootDir, vol.PackagePath)
+	if err != nil {
+		return nil, cs, err
+	}
+	after, err := os.ReadFile(sidecar)
+	if err != nil {
+		return nil, cs, err
+	}
+	href, err := filepath.Rel(vol.PackageDir, sidecar)
+	if err != nil {
+		return nil, cs, err
+	}
+	switch {
+	case !existed:
+		cs.added(filepath.ToSlash(href))
+	case !bytes.Equal(before, after):
+		cs.modified(filepath.ToSlash(href))
+	}
+	if err := cs.commit(ctx, vol, input, opts.OutPath, false, opts.Progress, log); err != nil {
+		return nil, cs, err
+	}
+	return hashes, cs, nil
+}
+
+// BookChapterHashes returns the hashes embedded in a book (nil when it has
+// none) along with hashes computed from its current content.
+func BookChapterHashes(ctx context.Context, input string) (embedded, actual *ChapterHashes, err error) {
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	embedded, err = readChapterHashes(vol.RootDir)
+	if err != nil && !errors.Is(err, ErrNoChapterHashes) {
+		return nil, nil, err
+	}
+	actual, err = computeChapterHashes(vol.PackageDir, vol.PackageDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return embedded, actual, nil
+}
+
+// DiffChapterHashes reports chapters added, removed or modified between old
+// and new, in the reading order of new followed by removed chapters.
+func DiffChapterHashes(old, new *ChapterHashes) []ChapterHashChange {
+	before := map[string]string{}
+	for _, c := range old.Chapters {
+		before[c.Href] = c.SHA256
+	}
+	var out []ChapterHashChange
+	seen := map[string]bool{}
+	for _, c := range new.Chapters {
+		seen[c.Href] = true
+		sum, ok := before[c.Href]
+		switch {
+		case !ok:
+			out = append(out, ChapterHashChange{Href: c.Href, Status: "added"})
+		case sum != c.SHA256:
+			out = append(out, ChapterHashChange{Href: c.Href, Status: "changed"})
+		}
+	}
+	var removed []ChapterHashChange
+	for href := range before {
+		if !seen[href] {
+			removed = append(removed, ChapterHashChange{Href: href, Status: "removed"})
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Href < removed[j].Href })
+	return append(out, removed...)
+}
+
+func computeChapterHashes(pkgDir string, pkg *PackageDocument) (*ChapterHashes, error) {
+	hashes := &ChapterHashes{Algorithm: "sha256"}
+	for _, href := range spineHrefs(pkg) {
+		data, err := os.ReadFile(filepath.Join(pkgDir, filepath.FromSlash(href)))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		hashes.Chapters = append(hashes.Chapters, ChapterHash{
+			Href:   href,
+			SHA256: hex.EncodeToString(sum[:]),
+			Size:   int64(len(data)),
+		})
+	}
+	return hashes, nil
+}
+
+// writeChapterHashes hashes the spine of the package document at pkgPath,
+// as currently on disk, into the sidecar under rootDir.
+func writeChapterHashes(rootDir, pkgPath string) (*ChapterHashes, error) {
+	data, err := os.ReadFile(pkgPath)
+	if err != nil {
+		return nil, err
+	}
+	var pkg PackageDocument
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return nil, fmt.Errorf("parse package: %w", err)
+	}
+	hashes, err := computeChapterHashes(filepath.Dir(pkgPath), &pkg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(hashes, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	dest := filepath.Join(rootDir, filepath.FromSlash(ChapterHashesFile))
+	if err := ensureParentDir(dest); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(dest, append(out, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func readChapterHashes(rootDir string) (*ChapterHashes, error) {
+	data, err := os.ReadFile(filepath.Join(rootDir, filepath.FromSlash(ChapterHashesFile)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoChapterHashes
+		}
+		return nil, err
+	}
+	var hashes ChapterHashes
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", ChapterHashesFile, err)
+	}
+	return &hashes, nil
+}
+
+// refreshChapterHashes rewrites the sidecar of an extracted book if it has
+// one, so saved books never carry stale hashes.
+func refreshChapterHashes(vol *Volume) error {
+	if _, err := os.Stat(filepath.Join(vol.RootDir, filepath.FromSlash(ChapterHashesFile))); err != nil {
+		return nil
+	}
+	_, err := writeChapterHashes(vol.RootDir, vol.PackagePath)
+	return err
+}
@@ -0,0 +1,66 @@
+package epub
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChapterHashesEmbedAndRefresh(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Hashes", "en")
+
+	embedded, _, err := BookChapterHashes(ctx, input)
+	if err != nil || embedded != nil {
+		t.Fatalf("fresh book should have no embedded hashes, got %+v, %v", embedded, err)
+	}
+
+	original, _, err := EmbedChapterHashes(ctx, input, ChapterHashOptions{})
+	if err != nil {
+		t.Fatalf("EmbedChapterHashes: %v", err)
+	}
+	if len(original.Chapters) != 1 || original.Chapters[0].Href != "chapter.xhtml" || len(original.Chapters[0].SHA256) != 64 {
+		t.Fatalf("unexpected hashes: %+v", original)
+	}
+
+	if _, err := RewriteEPUB(ctx, input, RewriteOptions{Rules: []RewriteRule{{Find: "Chapter", Replace: "Part"}}}); err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	embedded, actual, err := BookChapterHashes(ctx, input)
+	if err != nil {
+		t.Fatalf("BookChapterHashes: %v", err)
+	}
+	if embedded == nil || embedded.Chapters[0].SHA256 != actual.Chapters[0].SHA256 {
+		t.Fatalf("embedded hashes not refreshed on save: %+v vs %+v", embedded, actual)
+	}
+	changes := DiffChapterHashes(original, embedded)
+	if len(changes) != 1 || changes[0].Status != "changed" {
+		t.Fatalf("expected one changed chapter, got %+v", changes)
+	}
+}
+
+func TestDiffChapterHashes(t *testing.T) {
+	old := &ChapterHashes{Chapters: []ChapterHash{
+		{Href: "a.xhtml", SHA256: "1"},
+		{Href: "b.xhtml", SHA256: "2"},
+		{Href: "c.xhtml", SHA256: "3"},
+	}}
+	new := &ChapterHashes{Chapters: []ChapterHash{
+		{Href: "a.xhtml", SHA256: "1"},
+		{Href: "c.xhtml", SHA256: "4"},
+		{Href: "d.xhtml", SHA256: "5"},
+	}}
+	got := DiffChapterHashes(old, new)
+	want := []ChapterHashChange{
+		{Href: "c.xhtml", Status: "changed"},
+		{Href: "d.xhtml", Status: "added"},
+		{Href: "b.xhtml", Status: "removed"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("change %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
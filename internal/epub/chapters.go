@@ -0,0 +1,59 @@
+package epub
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// chapterLabels maps each spine document's href to the navigation labels
+// of the chapters it belongs to: the entries pointing into it and their
+// parents, so a part's label covers its chapters. A document no entry
+// points at continues the chapter before it in the spine. The NCX stands
+// in for a missing navigation document.
+func chapterLabels(vol *Volume) (map[string][]string, error) {
+	items, dir := vol.NavItems, ""
+	if vol.NavHref != "" {
+		dir = path.Dir(normalizeEPUBPath(vol.NavHref))
+	} else if ncx := ncxHref(vol.PackageDoc); ncx != "" {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(ncx)))
+		if err != nil {
+			return nil, err
+		}
+		if items, err = parseNCXNavMap(data); err != nil {
+			return nil, err
+		}
+		dir = path.Dir(ncx)
+	}
+
+	pointed := map[string][]string{}
+	var walk func(items []NavItem, parents []string)
+	walk = func(items []NavItem, parents []string) {
+		for _, item := range items {
+			labels := append(append([]string(nil), parents...), normalizeSpace(item.Title))
+			target, _, _ := strings.Cut(item.Href, "#")
+			if target != "" && !strings.Contains(target, ":") {
+				href := normalizeEPUBPath(path.Join(dir, target))
+				for _, l := range labels {
+					if !containsString(pointed[href], l) {
+						pointed[href] = append(pointed[href], l)
+					}
+				}
+			}
+			walk(item.Children, labels)
+		}
+	}
+	walk(items, nil)
+
+	out := map[string][]string{}
+	var current []string
+	for _, href := range spineHrefs(vol.PackageDoc) {
+		href = normalizeEPUBPath(href)
+		if labels, ok := pointed[href]; ok {
+			current = labels
+		}
+		out[href] = current
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteChapterConditions(t *testing.T) {
+	input := buildMatterVolume(t, "Book")
+	rules := []RewriteRule{
+		{Find: "thanks", Replace: "THANKS", Chapters: []string{"^Afterword$"}},
+		{Find: "buy", Replace: "BUY", Chapters: []string{"(?i)afterword"}},
+		{Find: "(c)", Replace: "©", Chapters: []string{"Afterword"}},
+		{Find: "text", Replace: "TEXT", SkipChapters: []string{"Chapter"}},
+		{Find: "Book", Replace: "Tome", Scope: "meta", Chapters: []string{"."}},
+	}
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{Scope: RewriteScopeBody, Rules: rules})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if stats.MatchCount != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	for href, want := range map[string]string{
+		"Text/p010.xhtml": "THANKS",
+		"Text/ads.xhtml":  "BUY more",
+		"Text/p002.xhtml": "(c)",
+		"Text/ch1.xhtml":  "<p>text</p>",
+	} {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s = %s, want %q", href, data, want)
+		}
+	}
+
+	labels, err := chapterLabels(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := labels["Text/ads.xhtml"]; len(got) != 1 || got[0] != "Afterword" {
+		t.Fatalf("labels = %v", labels)
+	}
+}
+
+func TestChapterLabelsIncludeParts(t *testing.T) {
+	vol := &Volume{
+		PackageDoc: &PackageDocument{
+			Manifest: Manifest{Items: []ManifestItem{{ID: "a", Href: "Text/a.xhtml"}, {ID: "b", Href: "Text/b.xhtml"}}},
+			Spine:    Spine{Itemrefs: []SpineItemRef{{IDRef: "a"}, {IDRef: "b"}}},
+		},
+		NavHref: "Text/nav.xhtml",
+		NavItems: []NavItem{{Title: "Part  One", Href: "a.xhtml", Children: []NavItem{
+			{Title: "Prologue", Href: "a.xhtml#p"},
+			{Title: "Chapter 1", Href: "b.xhtml"},
+		}}},
+	}
+	labels, err := chapterLabels(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(labels["Text/a.xhtml"], "|"); got != "Part One|Prologue" {
+		t.Fatalf("a = %q", got)
+	}
+	if got := strings.Join(labels["Text/b.xhtml"], "|"); got != "Part One|Chapter 1" {
+		t.Fatalf("b = %q", got)
+	}
+}
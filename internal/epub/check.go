@@ -0,0 +1,294 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DeviceProfile is what a reading system copes with. Zero limits are not
+// checked.
+type DeviceProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// MaxBookSize bounds the EPUB file.
+	MaxBookSize int64 `json:"max_book_size,omitempty"`
+	// MaxDocumentSize bounds each XHTML document, uncompressed.
+	MaxDocumentSize int64 `json:"max_document_size,omitempty"`
+	MaxImageBytes   int64 `json:"max_image_bytes,omitempty"`
+	MaxImagePixels  int   `json:"max_image_pixels,omitempty"`
+	// ImageTypes are the image media types shown; others need a fallback
+	// chain that reaches one of them.
+	ImageTypes []string `json:"image_types"`
+	// NeedsNCX is set for reading systems that build their table of
+	// contents from an EPUB 2 NCX only.
+	NeedsNCX bool `json:"needs_ncx,omitempty"`
+	// Scripts is set when the reading system runs JavaScript.
+	Scripts bool `json:"scripts,omitempty"`
+	// UnsupportedCSS lists "property" or "property: value" declarations
+	// that are ignored or misrendered.
+	UnsupportedCSS []string `json:"unsupported_css,omitempty"`
+	// KEPUB suggests Kobo's own renderer over the Adobe one sideloaded
+	// EPUBs get.
+	KEPUB bool `json:"kepub,omitempty"`
+	// FontDisplayOptions is set when embedded fonts are only used if
+	// META-INF/com.apple.ibooks.display-options.xml asks for them.
+	FontDisplayOptions bool `json:"font_display_options,omitempty"`
+}
+
+const (
+	kib = 1 << 10
+	mib = 1 << 20
+)
+
+var deviceProfiles = []DeviceProfile{
+	{
+		Name:            "kobo",
+		Description:     "Kobo e-readers; sideloaded .epub files use Adobe's RMSDK renderer",
+		MaxDocumentSize: 300 * kib,
+		ImageTypes:      []string{"image/jpeg", "image/png", "image/gif", "image/svg+xml"},
+		UnsupportedCSS:  []string{"display: flex", "display: grid", "position: fixed"},
+		KEPUB:           true,
+	},
+	{
+		Name:           "kindle",
+		Description:    "Kindle through Send to Kindle, which converts EPUB on Amazon's side",
+		MaxBookSize:    200 * mib,
+		MaxImageBytes:  5 * mib,
+		ImageTypes:     []string{"image/jpeg", "image/png", "image/gif", "image/svg+xml"},
+		UnsupportedCSS: []string{"display: grid", "position: fixed"},
+	},
+	{
+		Name:            "ade",
+		Description:     "Adobe Digital Editions and other RMSDK-based readers",
+		MaxDocumentSize: 300 * kib,
+		ImageTypes:      []string{"image/jpeg", "image/png", "image/gif", "image/svg+xml"},
+		NeedsNCX:        true,
+		UnsupportedCSS:  []string{"display: flex", "display: grid", "position: fixed"},
+	},
+	{
+		Name:               "apple",
+		Description:        "Apple Books on iOS and macOS",
+		MaxBookSize:        2 << 30,
+		MaxImagePixels:     4_000_000,
+		ImageTypes:         []string{"image/jpeg", "image/png", "image/gif", "image/svg+xml", "image/webp"},
+		Scripts:            true,
+		FontDisplayOptions: true,
+	},
+}
+
+// DeviceProfiles returns the profiles CheckDevice knows.
+func DeviceProfiles() []DeviceProfile {
+	return append([]DeviceProfile(nil), deviceProfiles...)
+}
+
+// LookupDeviceProfile returns the profile with the given name.
+func LookupDeviceProfile(name string) (DeviceProfile, error) {
+	var names []string
+	for _, p := range deviceProfiles {
+		if strings.EqualFold(p.Name, name) {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return DeviceProfile{}, fmt.Errorf("unknown device profile %q (want %s)", name, strings.Join(names, ", "))
+}
+
+type CheckOptions struct {
+	Profile  DeviceProfile
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+type CheckIssue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	// Href is empty for book-level issues.
+	Href    string `json:"href,omitempty"`
+	Message string `json:"message"`
+}
+
+type CheckReport struct {
+	Profile  string       `json:"profile"`
+	Size     int64        `json:"size"`
+	Errors   int          `json:"errors"`
+	Warnings int          `json:"warnings"`
+	Hints    int          `json:"hints"`
+	Issues   []CheckIssue `json:"issues"`
+}
+
+// Passed reports whether the check found no errors.
+func (r CheckReport) Passed() bool { return r.Errors == 0 }
+
+func (r *CheckReport) add(check, severity, href, format string, args ...any) {
+	r.Issues = append(r.Issues, CheckIssue{Check: check, Severity: severity, Href: href, Message: fmt.Sprintf(format, args...)})
+	switch severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	default:
+		r.Hints++
+	}
+}
+
+var (
+	styleElementRE = regexp.MustCompile(`(?is)<style[^>]*>(.*?)</style>`)
+	styleAttrRE    = regexp.MustCompile(`(?i)\sstyle\s*=\s*("[^"]*"|'[^']*')`)
+	scriptRE       = regexp.MustCompile(`(?i)<script[\s>]`)
+)
+
+// CheckDevice reports what in the book a reading system will reject, drop
+// or misrender, according to opts.Profile: file sizes, image formats and
+// dimensions, navigation, CSS and scripts.
+func CheckDevice(ctx context.Context, input string, opts CheckOptions) (CheckReport, error) {
+	profile := opts.Profile
+	report := CheckReport{Profile: profile.Name, Issues: []CheckIssue{}}
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	r, size, closeBook, err := EnvFrom(ctx).openBook(ctx, input)
+	if err != nil {
+		return report, err
+	}
+	report.Size = size
+	if profile.MaxBookSize > 0 && report.Size > profile.MaxBookSize {
+		report.add("book-size", SeverityError, "", "the book is %s; %s accepts up to %s", FormatByteSize(report.Size), profile.Name, FormatByteSize(profile.MaxBookSize))
+	}
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolumeReader(ctx, 0, input, r, size)
+	closeBook()
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+	pkg := vol.PackageDoc
+
+	hasNCX, hasFonts := false, false
+	for _, item := range pkg.Manifest.Items {
+		switch {
+		case item.MediaType == "application/x-dtbncx+xml":
+			hasNCX = true
+		case isFontItem(item):
+			hasFonts = true
+		}
+	}
+	switch {
+	case profile.NeedsNCX && !hasNCX:
+		report.add("toc", SeverityError, "", "the book has no NCX, which %s needs for its table of contents", profile.Name)
+	case !hasNCX && vol.NavHref == "":
+		report.add("toc", SeverityError, "", "the book has neither a navigation document nor an NCX")
+	}
+	if profile.KEPUB && !strings.HasSuffix(strings.ToLower(input), ".kepub.epub") {
+		report.add("kepub", SeverityInfo, "", "sideloaded as .epub this book uses Adobe's renderer; as .kepub.epub it gets Kobo's, with reading statistics and better typography")
+	}
+	if profile.FontDisplayOptions && hasFonts {
+		if _, err := os.Stat(filepath.Join(vol.RootDir, "META-INF", "com.apple.ibooks.display-options.xml")); os.IsNotExist(err) {
+			report.add("fonts", SeverityInfo, "", "embedded fonts are ignored without META-INF/com.apple.ibooks.display-options.xml setting specified-fonts")
+		}
+	}
+
+	items := pkg.Manifest.Items
+	for i, item := range items {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		opts.Progress.report(StageRewrite, i, len(items), item.Href)
+		p := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		switch {
+		case item.MediaType == "application/xhtml+xml":
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return report, err
+			}
+			if profile.MaxDocumentSize > 0 && int64(len(data)) > profile.MaxDocumentSize {
+				report.add("doc-size", SeverityWarning, item.Href, "%s uncompressed; %s slows down or fails above %s, so split it", FormatByteSize(int64(len(data))), profile.Name, FormatByteSize(profile.MaxDocumentSize))
+			}
+			if !profile.Scripts && (hasProperty(item.Properties, "scripted") || scriptRE.Match(data)) {
+				report.add("script", SeverityWarning, item.Href, "%s does not run scripts", profile.Name)
+			}
+			var css []string
+			for _, m := range styleElementRE.FindAllSubmatch(data, -1) {
+				css = append(css, string(m[1]))
+			}
+			for _, m := range styleAttrRE.FindAllSubmatch(data, -1) {
+				css = append(css, "x{"+string(m[1][1:len(m[1])-1])+"}")
+			}
+			checkDeviceCSS(&report, profile, item.Href, strings.Join(css, "\n"))
+		case item.MediaType == "text/css":
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return report, err
+			}
+			checkDeviceCSS(&report, profile, item.Href, string(data))
+		case strings.HasPrefix(item.MediaType, "image/"):
+			if err := checkDeviceImage(&report, profile, pkg, item, p); err != nil {
+				return report, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(items), len(items), "")
+	return report, nil
+}
+
+func checkDeviceImage(report *CheckReport, profile DeviceProfile, pkg *PackageDocument, item ManifestItem, p string) error {
+	if !containsString(profile.ImageTypes, item.MediaType) && !hasFallbackIn(pkg, item, profile.ImageTypes) {
+		report.add("image-type", SeverityError, item.Href, "%s cannot show %s and there is no fallback it can", profile.Name, item.MediaType)
+	}
+	if profile.MaxImageBytes == 0 && profile.MaxImagePixels == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if profile.MaxImageBytes > 0 && int64(len(data)) > profile.MaxImageBytes {
+		report.add("image-size", SeverityWarning, item.Href, "%s; %s accepts images up to %s", FormatByteSize(int64(len(data))), profile.Name, FormatByteSize(profile.MaxImageBytes))
+	}
+	if profile.MaxImagePixels > 0 {
+		// Formats the standard library cannot decode are not measured.
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && cfg.Width*cfg.Height > profile.MaxImagePixels {
+			report.add("image-size", SeverityWarning, item.Href, "%dx%d is over %s's %d pixels; it will be downscaled", cfg.Width, cfg.Height, profile.Name, profile.MaxImagePixels)
+		}
+	}
+	return nil
+}
+
+// checkDeviceCSS adds one issue per unsupported declaration found in css.
+func checkDeviceCSS(report *CheckReport, profile DeviceProfile, href, css string) {
+	if len(profile.UnsupportedCSS) == 0 || css == "" {
+		return
+	}
+	counts := map[string]int{}
+	for _, rule := range parseCSSRules(css) {
+		for prop, val := range rule.decls {
+			val = strings.TrimSpace(strings.TrimSuffix(val, "!important"))
+			for _, bad := range profile.UnsupportedCSS {
+				bp, bv, hasValue := strings.Cut(bad, ":")
+				if prop == bp && (!hasValue || val == strings.TrimSpace(bv)) {
+					counts[bad]++
+				}
+			}
+		}
+	}
+	var found []string
+	for bad := range counts {
+		found = append(found, bad)
+	}
+	sort.Strings(found)
+	for _, bad := range found {
+		report.add("css", SeverityWarning, href, "%s is not supported by %s (%d rules)", bad, profile.Name, counts[bad])
+	}
+}
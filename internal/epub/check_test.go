@@ -0,0 +1,87 @@
+package epub
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckDevice(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:check</dc:identifier>
+    <dc:title>Check</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml" properties="scripted"/>
+    <item id="css" href="Styles/book.css" media-type="text/css"/>
+    <item id="pic" href="Images/pic.webp" media-type="image/webp"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc"><ol><li><a href="Text/ch1.xhtml">One</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>one</title><script>void 0</script></head>
+<body><div style="display: grid"><p>Text.</p><img src="../Images/pic.webp" alt=""/></div></body></html>
+`,
+		"OEBPS/Styles/book.css": `.row { display: flex } .box { display: block } .top { position: fixed !important }`,
+		"OEBPS/Images/pic.webp": "RIFF",
+	})
+
+	checks := func(profile string) []string {
+		t.Helper()
+		p, err := LookupDeviceProfile(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := CheckDevice(context.Background(), input, CheckOptions{Profile: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, issue := range report.Issues {
+			out = append(out, issue.Severity+" "+issue.Check+" "+issue.Href)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	cases := map[string][]string{
+		"kobo": {
+			"error image-type Images/pic.webp",
+			"info kepub ",
+			"warning css Styles/book.css",
+			"warning css Styles/book.css",
+			"warning css Text/ch1.xhtml",
+			"warning script Text/ch1.xhtml",
+		},
+		"ade": {
+			"error image-type Images/pic.webp",
+			"error toc ",
+			"warning css Styles/book.css",
+			"warning css Styles/book.css",
+			"warning css Text/ch1.xhtml",
+			"warning script Text/ch1.xhtml",
+		},
+		"apple": nil,
+	}
+	for profile, want := range cases {
+		if got := checks(profile); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: issues =\n%s\nwant\n%s", profile, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	if _, err := LookupDeviceProfile("nook"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
@@ -0,0 +1,268 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+type CleanupOptions struct {
+	// MaxBlank is the longest run of blank paragraphs (empty, whitespace or
+	// <br/> only) to keep, and the longest run of blank lines (<br/>s beyond
+	// the first) inside a paragraph. Zero removes them all.
+	MaxBlank int
+	// KeepNBSP keeps paragraphs holding only non-breaking spaces, which are
+	// otherwise removed outright.
+	KeepNBSP bool
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// cleanupInline may appear inside a blank paragraph; anything else means the
+// paragraph has content.
+var cleanupInline = map[string]bool{
+	"br": true, "span": true, "font": true, "b": true, "i": true,
+	"em": true, "strong": true, "small": true,
+}
+
+// CleanupParagraphs removes runs of blank paragraphs, paragraphs that only
+// hold non-breaking spaces, and runs of <br/> longer than allowed. Blank
+// paragraphs with an id (link targets) or centered ones (often scene breaks)
+// are kept.
+func CleanupParagraphs(ctx context.Context, input string, opts CleanupOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.MaxBlank < 0 {
+		return stats, fmt.Errorf("max blank must not be negative")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return stats, err
+		}
+		out, changes, err := cleanupXHTML(data, opts)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		if out == nil {
+			continue
+		}
+		log.Debug("cleaned up paragraphs", "href", item.Href, "removed", len(changes))
+		stats.MatchCount += len(changes)
+		stats.FilesChanged++
+		stats.Changeset.modified(item.Href)
+		stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: len(changes), Changes: changes})
+		if !opts.DryRun {
+			if err := os.WriteFile(src, out, 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// cleanupXHTML returns the cleaned document, or nil data when nothing
+// changed.
+func cleanupXHTML(data []byte, opts CleanupOptions) ([]byte, []TextChange, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	var (
+		changes []TextChange
+		// buf holds a candidate paragraph until its end tag.
+		buf   []rawToken
+		depth int
+		// blankRun counts blank paragraphs kept since the last content.
+		blankRun int
+		// brRun counts consecutive <br/>s; dropBrEnd skips the end tag of
+		// a dropped one.
+		brRun     int
+		dropBrEnd bool
+	)
+	emit := func(rt rawToken) error {
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			if strings.EqualFold(t.Name.Local, "br") {
+				brRun++
+				if brRun > opts.MaxBlank+1 {
+					changes = append(changes, TextChange{Before: "<br/>", After: ""})
+					dropBrEnd = true
+					return nil
+				}
+			} else {
+				brRun = 0
+				blankRun = 0
+			}
+		case xml.EndElement:
+			if dropBrEnd && strings.EqualFold(t.Name.Local, "br") {
+				dropBrEnd = false
+				return nil
+			}
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				brRun = 0
+				blankRun = 0
+			}
+		}
+		return sp.copy(rt)
+	}
+	flush := func() error {
+		for _, rt := range buf {
+			if err := emit(rt); err != nil {
+				return err
+			}
+		}
+		buf = nil
+		return nil
+	}
+
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+
+		if buf == nil {
+			start, ok := rt.tok.(xml.StartElement)
+			if !ok || !isParagraphCandidate(start.Name.Local) {
+				if err := emit(rt); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			buf, depth = []rawToken{rt}, 0
+			continue
+		}
+
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			if !cleanupInline[strings.ToLower(t.Name.Local)] {
+				if err := flush(); err != nil {
+					return nil, nil, err
+				}
+				if isParagraphCandidate(t.Name.Local) {
+					buf, depth = []rawToken{rt}, 0
+				} else if err := emit(rt); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			depth++
+			buf = append(buf, rt)
+			continue
+		case xml.EndElement:
+			buf = append(buf, rt)
+			if depth > 0 {
+				depth--
+				continue
+			}
+		default:
+			buf = append(buf, rt)
+			continue
+		}
+
+		kind := blankParagraphKind(buf)
+		switch {
+		case kind == "":
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		case kind == "nbsp" && !opts.KeepNBSP:
+			changes = append(changes, TextChange{Before: "(paragraph of non-breaking spaces)", After: ""})
+			buf = nil
+		case blankRun >= opts.MaxBlank:
+			changes = append(changes, TextChange{Before: "(empty paragraph)", After: ""})
+			buf = nil
+		default:
+			// Emitting the paragraph's own start tag resets the run.
+			run := blankRun
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+			blankRun = run + 1
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	return out.Bytes(), changes, nil
+}
+
+func isParagraphCandidate(local string) bool {
+	switch strings.ToLower(local) {
+	case "p", "div":
+		return true
+	}
+	return false
+}
+
+// blankParagraphKind classifies a buffered paragraph: "nbsp" when its text is
+// only non-breaking spaces, "blank" when it has no text at all, and "" when
+// it has content or must be kept.
+func blankParagraphKind(toks []rawToken) string {
+	start := toks[0].tok.(xml.StartElement)
+	if attrValue(start.Attr, "id") != "" || isCenteredElement(start) {
+		return ""
+	}
+	nbspOnly := false
+	for _, rt := range toks[1:] {
+		cd, ok := rt.tok.(xml.CharData)
+		if !ok {
+			continue
+		}
+		for _, r := range string(cd) {
+			switch {
+			case r == nbsp || r == narrowNBSP:
+				nbspOnly = true
+			case unicode.IsSpace(r):
+			default:
+				return ""
+			}
+		}
+	}
+	if nbspOnly {
+		return "nbsp"
+	}
+	return "blank"
+}
@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanupXHTML(t *testing.T) {
+	src := `<html xmlns="http://www.w3.org/1999/xhtml"><body>
+<p>One.</p>
+<p></p>
+<p> <br/> </p>
+<p><span></span></p>
+<p>&#160;</p>
+<p>Two.<br/><br/><br/><br/>Three.</p>
+<p id="anchor"></p>
+<p class="center"></p>
+<p><img src="a.png"/></p>
+</body></html>`
+
+	out, changes, err := cleanupXHTML([]byte(src), CleanupOptions{MaxBlank: 1})
+	if err != nil {
+		t.Fatalf("cleanupXHTML: %v", err)
+	}
+	// Two extra blank paragraphs, the nbsp paragraph and two extra <br/>s.
+	if len(changes) != 5 {
+		t.Fatalf("expected 5 changes, got %d: %+v", len(changes), changes)
+	}
+	s := string(out)
+	if strings.Count(s, "<br") != 2 || strings.Contains(s, " ") {
+		t.Fatalf("unexpected output %s", s)
+	}
+	for _, keep := range []string{`id="anchor"`, `class="center"`, `<img`} {
+		if !strings.Contains(s, keep) {
+			t.Fatalf("missing %q in %s", keep, s)
+		}
+	}
+
+	if out, _, _ := cleanupXHTML([]byte(src), CleanupOptions{MaxBlank: 2, KeepNBSP: true}); strings.Count(string(out), "<p") != 7 {
+		t.Fatalf("expected a run of four blank paragraphs cut to two, got %s", out)
+	}
+}
+
+func TestCleanupParagraphs(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>A</p><p></p><p></p><p>B</p></body></html>`,
+	})
+	stats, err := CleanupParagraphs(context.Background(), input, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("CleanupParagraphs: %v", err)
+	}
+	if stats.MatchCount != 2 {
+		t.Fatalf("expected 2 removals, got %+v", stats)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "a.xhtml"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if strings.Count(string(data), "<p") != 2 {
+		t.Fatalf("blank paragraphs not removed: %s", data)
+	}
+}
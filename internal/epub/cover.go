@@ -0,0 +1,583 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	CoverPNG = "png"
+	CoverSVG = "svg"
+)
+
+type CoverOptions struct {
+	// Title and Author default to the book's title and creators.
+	Title  string
+	Author string
+	// Width and Height default to 1600x2400.
+	Width  int
+	Height int
+	// Background is a #rgb or #rrggbb colour (default #23395b). With
+	// Gradient set, the background fades from one to the other downwards.
+	Background string
+	Gradient   string
+	// Foreground is the text colour (default #ffffff).
+	Foreground string
+	// TemplatePath is a PNG or JPEG drawn over the background, scaled to
+	// fill the cover.
+	TemplatePath string
+	// Format is CoverPNG (default) or CoverSVG. The PNG renderer has a
+	// built-in bitmap font that only covers ASCII; SVG text is drawn by the
+	// reading system's fonts, so it suits any script.
+	Format string
+	// Replace allows replacing a cover the book already has.
+	Replace bool
+	// ImagePath, if set, also saves the rendered image there.
+	ImagePath string
+	OutPath   string
+	Logger    *slog.Logger
+}
+
+// ErrHasCover is returned by GenerateCover when the book already has a
+// cover and Replace is not set.
+var ErrHasCover = errors.New("book already has a cover")
+
+const (
+	defaultCoverWidth  = 1600
+	defaultCoverHeight = 2400
+)
+
+// GenerateCover renders a cover for the book and installs it: the image is
+// added to the manifest as the cover-image (and as the EPUB 2 cover meta),
+// and a cover page showing it is put first in the spine.
+func GenerateCover(ctx context.Context, input string, opts CoverOptions) (Changeset, error) {
+	var cs Changeset
+	if input == "" {
+		return cs, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return cs, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	if vol.CoverID != "" && !opts.Replace {
+		return cs, fmt.Errorf("%s: %w (%s)", input, ErrHasCover, vol.CoverID)
+	}
+	if opts.Title == "" {
+		opts.Title = normalizeSpace(firstDCValue(pkg.Metadata.Titles))
+	}
+	if opts.Author == "" {
+		opts.Author = strings.Join(collectCreators(pkg.Metadata.Creators), ", ")
+	}
+	data, mediaType, err := RenderCover(opts)
+	if err != nil {
+		return cs, err
+	}
+	if opts.ImagePath != "" {
+		if err := ensureParentDir(opts.ImagePath); err != nil {
+			return cs, err
+		}
+		if err := os.WriteFile(opts.ImagePath, data, 0o644); err != nil {
+			return cs, err
+		}
+	}
+
+	if vol.CoverID != "" {
+		if err := removeCoverPage(vol, &cs); err != nil {
+			return cs, err
+		}
+	}
+	for i := range pkg.Manifest.Items {
+		pkg.Manifest.Items[i].Properties = removeProperty(pkg.Manifest.Items[i].Properties, "cover-image")
+	}
+	kept := pkg.Metadata.Meta[:0]
+	for _, m := range pkg.Metadata.Meta {
+		if !strings.EqualFold(m.Name, "cover") {
+			kept = append(kept, m)
+		}
+	}
+	pkg.Metadata.Meta = kept
+
+	imgDir := "Images"
+	for _, item := range pkg.Manifest.Items {
+		if strings.HasPrefix(item.MediaType, "image/") {
+			imgDir = path.Dir(normalizeEPUBPath(item.Href))
+			break
+		}
+	}
+	ext := ".png"
+	if mediaType == "image/svg+xml" {
+		ext = ".svg"
+	}
+	imgHref := uniqueHref(pkg, path.Join(imgDir, "cover"+ext))
+	if err := writePackageFile(vol, imgHref, data); err != nil {
+		return cs, err
+	}
+	cs.added(imgHref)
+	imgID := uniqueManifestID(pkg, "cover-image")
+	pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: imgID, Href: imgHref, MediaType: mediaType, Properties: "cover-image"})
+	pkg.Metadata.Meta = append(pkg.Metadata.Meta, MetaNode{Name: "cover", Content: imgID})
+
+	pageDir := path.Dir(imgHref)
+	if hrefs := spineHrefs(pkg); len(hrefs) > 0 {
+		pageDir = path.Dir(normalizeEPUBPath(hrefs[0]))
+	}
+	pageHref := uniqueHref(pkg, path.Join(pageDir, "cover.xhtml"))
+	page := coverPage(relativeHref(pageDir, imgHref), opts, firstDCValue(pkg.Metadata.Languages))
+	if err := writePackageFile(vol, pageHref, page); err != nil {
+		return cs, err
+	}
+	cs.added(pageHref)
+	pageID := uniqueManifestID(pkg, "cover")
+	pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: pageID, Href: pageHref, MediaType: "application/xhtml+xml", Properties: "svg"})
+	pkg.Spine.Itemrefs = append([]SpineItemRef{{IDRef: pageID}}, pkg.Spine.Itemrefs...)
+	log.Info("added cover", "image", imgHref, "page", pageHref)
+
+	cs.modified(packageHref(vol))
+	if err := cs.commit(ctx, vol, input, opts.OutPath, false, nil, log); err != nil {
+		return cs, err
+	}
+	return cs, nil
+}
+
+// RenderCover draws a cover from opts without touching any book and
+// returns the image and its media type.
+func RenderCover(opts CoverOptions) ([]byte, string, error) {
+	if opts.Width <= 0 {
+		opts.Width = defaultCoverWidth
+	}
+	if opts.Height <= 0 {
+		opts.Height = defaultCoverHeight
+	}
+	bg, err := parseHexColor(opts.Background, color.RGBA{0x23, 0x39, 0x5b, 0xff})
+	if err != nil {
+		return nil, "", err
+	}
+	bg2 := bg
+	if opts.Gradient != "" {
+		if bg2, err = parseHexColor(opts.Gradient, bg); err != nil {
+			return nil, "", err
+		}
+	}
+	fg, err := parseHexColor(opts.Foreground, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	if err != nil {
+		return nil, "", err
+	}
+	var tmpl []byte
+	if opts.TemplatePath != "" {
+		if tmpl, err = os.ReadFile(opts.TemplatePath); err != nil {
+			return nil, "", err
+		}
+	}
+
+	switch opts.Format {
+	case "", CoverPNG:
+		data, err := renderCoverPNG(opts, bg, bg2, fg, tmpl)
+		return data, "image/png", err
+	case CoverSVG:
+		data, err := renderCoverSVG(opts, bg, bg2, fg, tmpl)
+		return data, "image/svg+xml", err
+	}
+	return nil, "", fmt.Errorf("unknown cover format %q (want png or svg)", opts.Format)
+}
+
+func renderCoverPNG(opts CoverOptions, bg, bg2, fg color.RGBA, tmpl []byte) ([]byte, error) {
+	for _, r := range opts.Title + opts.Author {
+		if _, ok := coverGlyph(r); !ok && !unicode.IsSpace(r) {
+			return nil, fmt.Errorf("the built-in cover font cannot draw %q; use the svg format for this title", r)
+		}
+	}
+	w, h := opts.Width, opts.Height
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		c := lerpColor(bg, bg2, float64(y)/float64(max(h-1, 1)))
+		draw.Draw(img, image.Rect(0, y, w, y+1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	if tmpl != nil {
+		src, _, err := image.Decode(bytes.NewReader(tmpl))
+		if err != nil {
+			return nil, fmt.Errorf("cover template: %w", err)
+		}
+		drawCovering(img, src)
+	}
+
+	margin := w / 12
+	titleScale, titleLines := fitBitmapText(opts.Title, w-2*margin, max(w/60, 2), 5)
+	authorScale := max(titleScale/2, 2)
+	authorLines := wrapWords(opts.Author, (w-2*margin)/((coverFontW+1)*authorScale))
+
+	if tmpl != nil {
+		// A translucent band keeps the text readable over busy artwork.
+		band := color.RGBA{0, 0, 0, 0x99}
+		th := len(titleLines) * (coverFontH + 3) * titleScale
+		draw.Draw(img, image.Rect(0, h/6-titleScale*2, w, h/6+th), image.NewUniform(band), image.Point{}, draw.Over)
+		ah := len(authorLines) * (coverFontH + 3) * authorScale
+		draw.Draw(img, image.Rect(0, h*5/6-ah-authorScale*2, w, h*5/6+authorScale), image.NewUniform(band), image.Point{}, draw.Over)
+	}
+	y := h / 6
+	for _, line := range titleLines {
+		drawBitmapLine(img, line, y, titleScale, fg)
+		y += (coverFontH + 3) * titleScale
+	}
+	y = h*5/6 - len(authorLines)*(coverFontH+3)*authorScale
+	for _, line := range authorLines {
+		drawBitmapLine(img, line, y, authorScale, fg)
+		y += (coverFontH + 3) * authorScale
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fitBitmapText picks the largest dot size, up to maxScale, at which text
+// wraps into at most maxLines lines of width.
+func fitBitmapText(text string, width, maxScale, maxLines int) (int, []string) {
+	for scale := maxScale; scale > 1; scale-- {
+		lines := wrapWords(text, width/((coverFontW+1)*scale))
+		if len(lines) <= maxLines && fitsColumns(lines, width/((coverFontW+1)*scale)) {
+			return scale, lines
+		}
+	}
+	return 1, wrapWords(text, width/(coverFontW+1))
+}
+
+func fitsColumns(lines []string, cols int) bool {
+	for _, l := range lines {
+		if len([]rune(l)) > cols {
+			return false
+		}
+	}
+	return true
+}
+
+// wrapWords breaks text into lines of at most cols runes at spaces; a
+// single longer word gets a line of its own.
+func wrapWords(text string, cols int) []string {
+	var lines []string
+	var cur []rune
+	for _, word := range strings.Fields(text) {
+		wr := []rune(word)
+		if len(cur) > 0 && len(cur)+1+len(wr) > cols {
+			lines = append(lines, string(cur))
+			cur = nil
+		}
+		if len(cur) > 0 {
+			cur = append(cur, ' ')
+		}
+		cur = append(cur, wr...)
+	}
+	if len(cur) > 0 {
+		lines = append(lines, string(cur))
+	}
+	return lines
+}
+
+// drawBitmapLine draws line centred horizontally with its top at y, with a
+// soft shadow.
+func drawBitmapLine(img *image.RGBA, line string, y, scale int, fg color.RGBA) {
+	runes := []rune(line)
+	width := len(runes)*(coverFontW+1)*scale - scale
+	x0 := (img.Bounds().Dx() - width) / 2
+	shadow := image.NewUniform(color.RGBA{0, 0, 0, 0x80})
+	ink := image.NewUniform(fg)
+	off := max(scale/3, 1)
+	for pass, src := range []*image.Uniform{shadow, ink} {
+		d := 0
+		if pass == 0 {
+			d = off
+		}
+		for i, r := range runes {
+			rows, _ := coverGlyph(r)
+			for gy, row := range rows {
+				for gx := 0; gx < len(row); gx++ {
+					if row[gx] != '#' {
+						continue
+					}
+					px := x0 + (i*(coverFontW+1)+gx)*scale + d
+					py := y + gy*scale + d
+					draw.Draw(img, image.Rect(px, py, px+scale, py+scale), src, image.Point{}, draw.Over)
+				}
+			}
+		}
+	}
+}
+
+// drawCovering scales src to cover dst, cropping the overflow evenly, with
+// bilinear sampling.
+func drawCovering(dst *image.RGBA, src image.Image) {
+	sb := src.Bounds()
+	dw, dh := dst.Bounds().Dx(), dst.Bounds().Dy()
+	scale := max(float64(dw)/float64(sb.Dx()), float64(dh)/float64(sb.Dy()))
+	offX := (float64(sb.Dx()) - float64(dw)/scale) / 2
+	offY := (float64(sb.Dy()) - float64(dh)/scale) / 2
+	at := func(x, y int) color.RGBA {
+		x = min(max(x, 0), sb.Dx()-1)
+		y = min(max(y, 0), sb.Dy()-1)
+		return color.RGBAModel.Convert(src.At(sb.Min.X+x, sb.Min.Y+y)).(color.RGBA)
+	}
+	for y := 0; y < dh; y++ {
+		sy := offY + (float64(y)+0.5)/scale - 0.5
+		y0 := int(sy)
+		fy := sy - float64(y0)
+		for x := 0; x < dw; x++ {
+			sx := offX + (float64(x)+0.5)/scale - 0.5
+			x0 := int(sx)
+			fx := sx - float64(x0)
+			top := lerpColor(at(x0, y0), at(x0+1, y0), fx)
+			bottom := lerpColor(at(x0, y0+1), at(x0+1, y0+1), fx)
+			dst.SetRGBA(x, y, lerpColor(top, bottom, fy))
+		}
+	}
+}
+
+func lerpColor(a, b color.RGBA, t float64) color.RGBA {
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+func parseHexColor(s string, def color.RGBA) (color.RGBA, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return def, fmt.Errorf("invalid colour %q (want #rrggbb)", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func renderCoverSVG(opts CoverOptions, bg, bg2, fg color.RGBA, tmpl []byte) ([]byte, error) {
+	w, h := opts.Width, opts.Height
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d">
+<defs><linearGradient id="bg" x1="0" y1="0" x2="0" y2="1"><stop offset="0" stop-color="%s"/><stop offset="1" stop-color="%s"/></linearGradient></defs>
+<rect width="%d" height="%d" fill="url(#bg)"/>
+`, w, h, w, h, hexColor(bg), hexColor(bg2), w, h)
+	if tmpl != nil {
+		mediaType := http.DetectContentType(tmpl)
+		if mediaType != "image/png" && mediaType != "image/jpeg" {
+			return nil, fmt.Errorf("cover template must be PNG or JPEG, not %s", mediaType)
+		}
+		fmt.Fprintf(&buf, `<image width="%d" height="%d" preserveAspectRatio="xMidYMid slice" xlink:href="data:%s;base64,%s"/>`+"\n",
+			w, h, mediaType, base64.StdEncoding.EncodeToString(tmpl))
+	}
+
+	margin := float64(w) / 12
+	titleSize, titleLines := fitSVGText(opts.Title, float64(w)-2*margin, float64(w)/9, 4)
+	authorSize := titleSize / 2
+	_, authorLines := fitSVGText(opts.Author, float64(w)-2*margin, authorSize, 3)
+	text := func(lines []string, size, top float64) {
+		for i, line := range lines {
+			y := top + size*(1.25*float64(i)+1)
+			fmt.Fprintf(&buf, `<text x="%d" y="%.0f" font-size="%.0f" font-family="serif" font-weight="bold" text-anchor="middle" fill="%s" stroke="#000000" stroke-opacity="0.35" stroke-width="%.1f" paint-order="stroke">%s</text>`+"\n",
+				w/2, y, size, hexColor(fg), size/20, html.EscapeString(line))
+		}
+	}
+	text(titleLines, titleSize, float64(h)/6)
+	text(authorLines, authorSize, float64(h)*5/6-authorSize*1.25*float64(len(authorLines)))
+	buf.WriteString("</svg>\n")
+	return buf.Bytes(), nil
+}
+
+// fitSVGText shrinks the font size from size until text wraps into at most
+// maxLines lines of width, estimating glyph widths: full-width scripts take
+// one em, everything else about 0.6.
+func fitSVGText(text string, width, size float64, maxLines int) (float64, []string) {
+	for ; size > 8; size *= 0.9 {
+		if lines := wrapEm(text, width/size); len(lines) <= maxLines {
+			return size, lines
+		}
+	}
+	return size, wrapEm(text, width/size)
+}
+
+func runeEm(r rune) float64 {
+	if r >= 0x2e80 && !(r >= 0xff61 && r <= 0xffdc) {
+		return 1
+	}
+	return 0.6
+}
+
+// wrapEm wraps text into lines of at most ems; spaces are preferred break
+// points, and full-width text breaks between any two characters.
+func wrapEm(text string, ems float64) []string {
+	var lines []string
+	var cur []rune
+	curEm := 0.0
+	lastSpace := -1
+	for _, r := range normalizeSpace(text) {
+		if r == ' ' && len(cur) == 0 {
+			continue
+		}
+		if curEm+runeEm(r) > ems && len(cur) > 0 {
+			if r != ' ' && runeEm(r) < 1 && lastSpace > 0 {
+				lines = append(lines, string(cur[:lastSpace]))
+				cur = append([]rune(nil), cur[lastSpace+1:]...)
+			} else {
+				lines = append(lines, strings.TrimSpace(string(cur)))
+				cur = nil
+			}
+			curEm, lastSpace = 0, -1
+			for i, c := range cur {
+				curEm += runeEm(c)
+				if c == ' ' {
+					lastSpace = i
+				}
+			}
+			if r == ' ' && len(cur) == 0 {
+				continue
+			}
+		}
+		if r == ' ' {
+			lastSpace = len(cur)
+		}
+		cur = append(cur, r)
+		curEm += runeEm(r)
+	}
+	if s := strings.TrimSpace(string(cur)); s != "" {
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+// coverPage is the XHTML page that shows the cover image full-page, using
+// the SVG wrapper most reading systems scale best.
+func coverPage(src string, opts CoverOptions, lang string) []byte {
+	w, h := opts.Width, opts.Height
+	if w <= 0 {
+		w = defaultCoverWidth
+	}
+	if h <= 0 {
+		h = defaultCoverHeight
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"`)
+	if lang = html.EscapeString(strings.TrimSpace(lang)); lang != "" {
+		buf.WriteString(` xml:lang="` + lang + `" lang="` + lang + `"`)
+	}
+	buf.WriteString(">\n<head><title>Cover</title>\n")
+	buf.WriteString("<style>html, body { margin: 0; padding: 0; height: 100%; } svg { display: block; }</style>\n</head>\n")
+	buf.WriteString(`<body epub:type="cover">` + "\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%%" height="100%%" viewBox="0 0 %d %d" preserveAspectRatio="xMidYMid meet">`+"\n", w, h)
+	fmt.Fprintf(&buf, `<image width="%d" height="%d" xlink:href="%s"><title>%s</title></image>`+"\n", w, h, html.EscapeString(src), html.EscapeString(opts.Title))
+	buf.WriteString("</svg>\n</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// coverPagePattern recognises a page marked up as the book's cover.
+var coverPagePattern = regexp.MustCompile(`epub:type="[^"]*\bcover\b`)
+
+// removeCoverPage drops the first spine page if it is a cover page, and the
+// old cover image with it when nothing else in the book refers to it.
+func removeCoverPage(vol *Volume, cs *Changeset) error {
+	pkg := vol.PackageDoc
+	if len(pkg.Spine.Itemrefs) == 0 {
+		return nil
+	}
+	pageID := pkg.Spine.Itemrefs[0].IDRef
+	var pageHref, imgHref string
+	for _, item := range pkg.Manifest.Items {
+		switch item.ID {
+		case pageID:
+			pageHref = item.Href
+		case vol.CoverID:
+			imgHref = item.Href
+		}
+	}
+	if pageHref == "" {
+		return nil
+	}
+	page, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(pageHref)))
+	if err != nil || !coverPagePattern.Match(page) {
+		return nil
+	}
+	drop := map[string]bool{pageID: true}
+	if imgHref != "" {
+		name := []byte(path.Base(imgHref))
+		used := false
+		for _, item := range pkg.Manifest.Items {
+			if item.ID == pageID || (item.MediaType != "application/xhtml+xml" && item.MediaType != "text/css") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href)))
+			if err == nil && bytes.Contains(data, name) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			drop[vol.CoverID] = true
+		}
+	}
+	items := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		if !drop[item.ID] {
+			items = append(items, item)
+			continue
+		}
+		if err := os.Remove(filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cs.removed(item.Href)
+	}
+	pkg.Manifest.Items = items
+	pkg.Spine.Itemrefs = pkg.Spine.Itemrefs[1:]
+	return nil
+}
+
+// uniqueHref returns href, or href with a numeric suffix if the manifest
+// already has it.
+func uniqueHref(pkg *PackageDocument, href string) string {
+	ext := path.Ext(href)
+	base := strings.TrimSuffix(href, ext)
+	for n := 2; hasManifestHref(pkg, href); n++ {
+		href = base + "-" + strconv.Itoa(n) + ext
+	}
+	return href
+}
+
+func writePackageFile(vol *Volume, href string, data []byte) error {
+	dest := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+	if err := ensureParentDir(dest); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, data, 0o644)
+}
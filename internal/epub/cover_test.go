@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCover(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	book := filepath.Join(dir, "book.epub")
+	if err := GenerateEPUB(ctx, GenerateOptions{Title: "Road North", Chapters: 2, WordsPerChapter: 20, Images: 1, OutPath: book}); err != nil {
+		t.Fatal(err)
+	}
+	// The generated book's first image is its cover.
+	opts := CoverOptions{Width: 300, Height: 450, Gradient: "#7e2553", ImagePath: filepath.Join(dir, "cover.png")}
+	if _, err := GenerateCover(ctx, book, opts); !errors.Is(err, ErrHasCover) {
+		t.Fatalf("err = %v, want ErrHasCover", err)
+	}
+
+	opts.Replace = true
+	if _, err := GenerateCover(ctx, book, opts); err != nil {
+		t.Fatalf("GenerateCover: %v", err)
+	}
+	saved, err := os.ReadFile(opts.ImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 450 {
+		t.Fatalf("cover is %v", b)
+	}
+
+	vol, err := loadVolume(ctx, 0, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	pkg := vol.PackageDoc
+	if vol.CoverID != "cover-image" {
+		t.Fatalf("cover = %q", vol.CoverID)
+	}
+	covers := 0
+	for _, item := range pkg.Manifest.Items {
+		if hasProperty(item.Properties, "cover-image") {
+			covers++
+		}
+		if item.ID == "img0001" && item.Properties != "" {
+			t.Fatalf("old cover keeps properties %q", item.Properties)
+		}
+	}
+	if covers != 1 {
+		t.Fatalf("%d cover-image items", covers)
+	}
+	if got := spineHrefs(pkg); len(got) != 3 || got[0] != "Text/cover.xhtml" {
+		t.Fatalf("spine = %v", got)
+	}
+	page, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "cover.xhtml"))
+	if !bytes.Contains(page, []byte(`xlink:href="../Images/cover.png"`)) || !bytes.Contains(page, []byte(`epub:type="cover"`)) {
+		t.Fatalf("cover page:\n%s", page)
+	}
+
+	// Replacing again swaps the generated page instead of stacking another.
+	if _, err := GenerateCover(ctx, book, CoverOptions{Width: 300, Height: 450, Replace: true}); err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadVolume(ctx, 0, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(again.TempDir)
+	if got := spineHrefs(again.PackageDoc); len(got) != 3 || got[0] != "Text/cover.xhtml" {
+		t.Fatalf("spine after replacing = %v", got)
+	}
+}
+
+func TestRenderCoverScripts(t *testing.T) {
+	opts := CoverOptions{Title: "竜と騎士の物語", Author: "山田 & 田中", Width: 600, Height: 900}
+	if _, _, err := RenderCover(opts); err == nil || !strings.Contains(err.Error(), "svg") {
+		t.Fatalf("PNG of a Japanese title: err = %v", err)
+	}
+	opts.Format = CoverSVG
+	data, mediaType, err := RenderCover(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "image/svg+xml" || !bytes.Contains(data, []byte(">竜と騎士の物語</text>")) || !bytes.Contains(data, []byte("山田 &amp; 田中")) {
+		t.Fatalf("svg cover:\n%s", data)
+	}
+	if _, _, err := RenderCover(CoverOptions{Title: "x", Background: "blue"}); err == nil {
+		t.Fatal("accepted a non-hex colour")
+	}
+}
+
+func TestWrapEm(t *testing.T) {
+	got := wrapEm("The Long Road to the Northern Castle", 5)
+	want := []string{"The Long", "Road to", "the", "Northern", "Castle"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("wrapEm = %q", got)
+	}
+	if got := wrapEm("竜と騎士の物語", 3); strings.Join(got, "|") != "竜と騎|士の物|語" {
+		t.Fatalf("wrapEm = %q", got)
+	}
+}
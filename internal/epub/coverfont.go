@@ -0,0 +1,128 @@
+package epub
+
+import "strings"
+
+// coverFontW and coverFontH are the glyph size of the built-in cover font,
+// in dots. Each glyph below is seven rows of five dots, '#' for ink.
+const (
+	coverFontW = 5
+	coverFontH = 7
+)
+
+var coverFontSrc = map[rune]string{
+	' ':  "...../...../...../...../...../...../.....",
+	'!':  "..#../..#../..#../..#../..#../...../..#..",
+	'"':  ".#.#./.#.#./...../...../...../...../.....",
+	'#':  ".#.#./.#.#./#####/.#.#./#####/.#.#./.#.#.",
+	'$':  "..#../.####/#.#../.###./..#.#/####./..#..",
+	'%':  "##.../##..#/...#./..#../.#.../#..##/...##",
+	'&':  ".##../#..#./#.#../.#.../#.#.#/#..#./.##.#",
+	'\'': "..#../..#../...../...../...../...../.....",
+	'(':  "...#./..#../.#.../.#.../.#.../..#../...#.",
+	')':  ".#.../..#../...#./...#./...#./..#../.#...",
+	'*':  "...../..#../#.#.#/.###./#.#.#/..#../.....",
+	'+':  "...../..#../..#../#####/..#../..#../.....",
+	',':  "...../...../...../...../.##../..#../.#...",
+	'-':  "...../...../...../#####/...../...../.....",
+	'.':  "...../...../...../...../...../.##../.##..",
+	'/':  "...../....#/...#./..#../.#.../#..../.....",
+	'0':  ".###./#...#/#..##/#.#.#/##..#/#...#/.###.",
+	'1':  "..#../.##../..#../..#../..#../..#../.###.",
+	'2':  ".###./#...#/....#/...#./..#../.#.../#####",
+	'3':  "#####/...#./..#../...#./....#/#...#/.###.",
+	'4':  "...#./..##./.#.#./#..#./#####/...#./...#.",
+	'5':  "#####/#..../####./....#/....#/#...#/.###.",
+	'6':  "..##./.#.../#..../####./#...#/#...#/.###.",
+	'7':  "#####/....#/...#./..#../.#.../.#.../.#...",
+	'8':  ".###./#...#/#...#/.###./#...#/#...#/.###.",
+	'9':  ".###./#...#/#...#/.####/....#/...#./.##..",
+	':':  "...../.##../.##../...../.##../.##../.....",
+	';':  "...../.##../.##../...../.##../..#../.#...",
+	'<':  "...#./..#../.#.../#..../.#.../..#../...#.",
+	'=':  "...../...../#####/...../#####/...../.....",
+	'>':  ".#.../..#../...#./....#/...#./..#../.#...",
+	'?':  ".###./#...#/....#/...#./..#../...../..#..",
+	'@':  ".###./#...#/....#/.##.#/#.#.#/#.#.#/.###.",
+	'A':  ".###./#...#/#...#/#####/#...#/#...#/#...#",
+	'B':  "####./#...#/#...#/####./#...#/#...#/####.",
+	'C':  ".###./#...#/#..../#..../#..../#...#/.###.",
+	'D':  "###../#..#./#...#/#...#/#...#/#..#./###..",
+	'E':  "#####/#..../#..../####./#..../#..../#####",
+	'F':  "#####/#..../#..../####./#..../#..../#....",
+	'G':  ".###./#...#/#..../#.###/#...#/#...#/.####",
+	'H':  "#...#/#...#/#...#/#####/#...#/#...#/#...#",
+	'I':  ".###./..#../..#../..#../..#../..#../.###.",
+	'J':  "..###/...#./...#./...#./...#./#..#./.##..",
+	'K':  "#...#/#..#./#.#../##.../#.#../#..#./#...#",
+	'L':  "#..../#..../#..../#..../#..../#..../#####",
+	'M':  "#...#/##.##/#.#.#/#.#.#/#...#/#...#/#...#",
+	'N':  "#...#/#...#/##..#/#.#.#/#..##/#...#/#...#",
+	'O':  ".###./#...#/#...#/#...#/#...#/#...#/.###.",
+	'P':  "####./#...#/#...#/####./#..../#..../#....",
+	'Q':  ".###./#...#/#...#/#...#/#.#.#/#..#./.##.#",
+	'R':  "####./#...#/#...#/####./#.#../#..#./#...#",
+	'S':  ".####/#..../#..../.###./....#/....#/####.",
+	'T':  "#####/..#../..#../..#../..#../..#../..#..",
+	'U':  "#...#/#...#/#...#/#...#/#...#/#...#/.###.",
+	'V':  "#...#/#...#/#...#/#...#/#...#/.#.#./..#..",
+	'W':  "#...#/#...#/#...#/#.#.#/#.#.#/#.#.#/.#.#.",
+	'X':  "#...#/#...#/.#.#./..#../.#.#./#...#/#...#",
+	'Y':  "#...#/#...#/#...#/.#.#./..#../..#../..#..",
+	'Z':  "#####/....#/...#./..#../.#.../#..../#####",
+	'[':  ".###./.#.../.#.../.#.../.#.../.#.../.###.",
+	'\\': "...../#..../.#.../..#../...#./....#/.....",
+	']':  ".###./...#./...#./...#./...#./...#./.###.",
+	'^':  "..#../.#.#./#...#/...../...../...../.....",
+	'_':  "...../...../...../...../...../...../#####",
+	'`':  ".#.../..#../...../...../...../...../.....",
+	'a':  "...../...../.###./....#/.####/#...#/.####",
+	'b':  "#..../#..../#.##./##..#/#...#/#...#/####.",
+	'c':  "...../...../.###./#..../#..../#...#/.###.",
+	'd':  "....#/....#/.##.#/#..##/#...#/#...#/.####",
+	'e':  "...../...../.###./#...#/#####/#..../.###.",
+	'f':  "..##./.#..#/.#.../###../.#.../.#.../.#...",
+	'g':  "...../.####/#...#/#...#/.####/....#/.###.",
+	'h':  "#..../#..../#.##./##..#/#...#/#...#/#...#",
+	'i':  "..#../...../.##../..#../..#../..#../.###.",
+	'j':  "...#./...../..##./...#./...#./#..#./.##..",
+	'k':  "#..../#..../#..#./#.#../##.../#.#../#..#.",
+	'l':  ".##../..#../..#../..#../..#../..#../.###.",
+	'm':  "...../...../##.#./#.#.#/#.#.#/#...#/#...#",
+	'n':  "...../...../#.##./##..#/#...#/#...#/#...#",
+	'o':  "...../...../.###./#...#/#...#/#...#/.###.",
+	'p':  "...../...../####./#...#/####./#..../#....",
+	'q':  "...../...../.##.#/#..##/.####/....#/....#",
+	'r':  "...../...../#.##./##..#/#..../#..../#....",
+	's':  "...../...../.###./#..../.###./....#/####.",
+	't':  ".#.../.#.../###../.#.../.#.../.#..#/..##.",
+	'u':  "...../...../#...#/#...#/#...#/#..##/.##.#",
+	'v':  "...../...../#...#/#...#/#...#/.#.#./..#..",
+	'w':  "...../...../#...#/#...#/#.#.#/#.#.#/.#.#.",
+	'x':  "...../...../#...#/.#.#./..#../.#.#./#...#",
+	'y':  "...../...../#...#/#...#/.####/....#/.###.",
+	'z':  "...../...../#####/...#./..#../.#.../#####",
+	'{':  "...#./..#../..#../.#.../..#../..#../...#.",
+	'|':  "..#../..#../..#../..#../..#../..#../..#..",
+	'}':  ".#.../..#../..#../...#./..#../..#../.#...",
+	'~':  "...../...../.#.../#.#.#/...#./...../.....",
+}
+
+// coverFontAliases draws common typographic characters with the nearest
+// ASCII glyph.
+var coverFontAliases = map[rune]rune{
+	'‘': '\'', '’': '\'', '“': '"', '”': '"', '–': '-', '—': '-', '…': '.',
+	'\u00a0': ' ',
+}
+
+// coverGlyph returns the rows of r's glyph, or false if the built-in font
+// cannot draw it.
+func coverGlyph(r rune) ([]string, bool) {
+	if a, ok := coverFontAliases[r]; ok {
+		r = a
+	}
+	src, ok := coverFontSrc[r]
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(src, "/"), true
+}
@@ -0,0 +1,150 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Creator is a dc:creator with its MARC relator role, such as "aut",
+// "ill" or "trl", and the form of the name used for sorting.
+type Creator struct {
+	Name   string
+	Role   string
+	FileAs string
+}
+
+// marcRelatorRE matches a MARC relator code.
+var marcRelatorRE = regexp.MustCompile(`^[a-z]{3}$`)
+
+// ParseCreator reads a creator written as "Name", "Name|role" or
+// "Name|role|File-as", such as "Jane Doe|ill|Doe, Jane". The role may be
+// left empty to give only the file-as form.
+func ParseCreator(s string) (Creator, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) > 3 {
+		return Creator{}, fmt.Errorf("creator %q: want name|role|file-as", s)
+	}
+	c := Creator{Name: strings.TrimSpace(parts[0])}
+	if c.Name == "" {
+		return Creator{}, fmt.Errorf("creator %q: name is empty", s)
+	}
+	if len(parts) > 1 {
+		c.Role = strings.ToLower(strings.TrimSpace(parts[1]))
+		if c.Role != "" && !marcRelatorRE.MatchString(c.Role) {
+			return Creator{}, fmt.Errorf("creator %q: role %q is not a MARC relator code such as aut, ill or trl", s, parts[1])
+		}
+	}
+	if len(parts) > 2 {
+		c.FileAs = strings.TrimSpace(parts[2])
+	}
+	return c, nil
+}
+
+// String writes c in the form ParseCreator reads.
+func (c Creator) String() string {
+	switch {
+	case c.FileAs != "":
+		return c.Name + "|" + c.Role + "|" + c.FileAs
+	case c.Role != "":
+		return c.Name + "|" + c.Role
+	}
+	return c.Name
+}
+
+func formatCreators(creators []Creator) []string {
+	out := make([]string, 0, len(creators))
+	for _, c := range creators {
+		out = append(out, c.String())
+	}
+	return out
+}
+
+// creatorsOf returns the creators of meta with their roles and file-as
+// forms, from EPUB 3 refinements or else EPUB 2 opf attributes.
+func creatorsOf(meta Metadata) []Creator {
+	var out []Creator
+	for _, dc := range meta.Creators {
+		name := strings.TrimSpace(dc.Value)
+		if name == "" {
+			continue
+		}
+		c := Creator{Name: name, Role: dc.Role, FileAs: dc.FileAs}
+		if dc.ID != "" {
+			for _, node := range meta.Meta {
+				if node.Refines != "#"+dc.ID {
+					continue
+				}
+				switch node.Property {
+				case "role":
+					c.Role = strings.TrimSpace(node.Value)
+				case "file-as":
+					c.FileAs = strings.TrimSpace(node.Value)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// setCreators replaces the creators of meta. Roles and file-as forms are
+// written as refinements in EPUB 3 and as opf attributes in EPUB 2. A
+// creator that was already there keeps its id and any other refinements,
+// such as display-seq; the refinements of creators dropped go with them.
+func setCreators(meta *Metadata, epub3 bool, creators []Creator) {
+	oldIDs := map[string]string{}
+	for _, dc := range meta.Creators {
+		name := strings.TrimSpace(dc.Value)
+		if _, ok := oldIDs[name]; !ok && dc.ID != "" {
+			oldIDs[name] = dc.ID
+		}
+	}
+	ids := metadataIDs(meta)
+	kept := map[string]bool{}
+	list := make([]DCMeta, 0, len(creators))
+	for _, c := range creators {
+		dc := DCMeta{Value: c.Name}
+		if id := oldIDs[c.Name]; id != "" && !kept["#"+id] {
+			dc.ID = id
+			kept["#"+id] = true
+		}
+		list = append(list, dc)
+	}
+
+	dropped := map[string]bool{}
+	for _, dc := range meta.Creators {
+		if dc.ID != "" && !kept["#"+dc.ID] {
+			dropped["#"+dc.ID] = true
+		}
+	}
+	metas := meta.Meta[:0]
+	for _, node := range meta.Meta {
+		switch {
+		case dropped[node.Refines]:
+		case kept[node.Refines] && (node.Property == "role" || node.Property == "file-as"):
+		default:
+			metas = append(metas, node)
+		}
+	}
+	meta.Meta = metas
+
+	for i, c := range creators {
+		dc := &list[i]
+		switch {
+		case !epub3:
+			dc.Role, dc.FileAs = c.Role, c.FileAs
+		case c.Role != "" || c.FileAs != "":
+			if dc.ID == "" {
+				dc.ID = newMetadataID(ids, "creator")
+			}
+			if c.Role != "" {
+				meta.Meta = append(meta.Meta, MetaNode{Refines: "#" + dc.ID, Property: "role", Scheme: "marc:relators", Value: c.Role})
+			}
+			if c.FileAs != "" {
+				meta.Meta = append(meta.Meta, MetaNode{Refines: "#" + dc.ID, Property: "file-as", Value: c.FileAs})
+			}
+		}
+	}
+	meta.Creators = list
+}
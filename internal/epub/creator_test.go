@@ -0,0 +1,128 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCreator(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Creator
+	}{
+		{"Jane Doe", Creator{Name: "Jane Doe"}},
+		{"Jane Doe|ILL", Creator{Name: "Jane Doe", Role: "ill"}},
+		{" Jane Doe | aut | Doe, Jane ", Creator{Name: "Jane Doe", Role: "aut", FileAs: "Doe, Jane"}},
+		{"Jane Doe||Doe, Jane", Creator{Name: "Jane Doe", FileAs: "Doe, Jane"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCreator(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseCreator(%q) = %+v, %v", tt.in, got, err)
+		}
+		if back, _ := ParseCreator(got.String()); back != got {
+			t.Errorf("%+v does not round-trip: %q", got, got.String())
+		}
+	}
+	for _, bad := range []string{"", "|aut", "Jane|author", "a|b|c|d"} {
+		if _, err := ParseCreator(bad); err == nil {
+			t.Errorf("ParseCreator(%q): expected error", bad)
+		}
+	}
+}
+
+func TestEditCreatorRoles(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Title", "en")
+	edit := func(creators ...string) Metadata {
+		t.Helper()
+		if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Creators: &creators}}); err != nil {
+			t.Fatal(err)
+		}
+		vol, err := loadVolume(ctx, 0, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(vol.TempDir)
+		return vol.PackageDoc.Metadata
+	}
+
+	meta := edit("Jane Doe|aut|Doe, Jane", "Taro Yamada|ill")
+	got := formatCreators(creatorsOf(meta))
+	if len(got) != 2 || got[0] != "Jane Doe|aut|Doe, Jane" || got[1] != "Taro Yamada|ill" {
+		t.Fatalf("creators = %q", got)
+	}
+	if meta.Creators[0].Role != "" || meta.Creators[0].ID == "" {
+		t.Fatalf("EPUB 3 creator should be refined, not carry opf attributes: %+v", meta.Creators[0])
+	}
+	refines := 0
+	for _, node := range meta.Meta {
+		if node.Refines != "" {
+			refines++
+			if node.Property == "role" && node.Scheme != "marc:relators" {
+				t.Fatalf("role without scheme: %+v", node)
+			}
+		}
+	}
+	if refines != 3 {
+		t.Fatalf("refines = %d, want 3", refines)
+	}
+
+	meta = edit("Ann Lee")
+	for _, node := range meta.Meta {
+		if node.Refines != "" {
+			t.Fatalf("refinement of a replaced creator kept: %+v", node)
+		}
+	}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Creators: &[]string{"Ann|writer"}}}); err == nil {
+		t.Fatal("expected a bad role to be rejected")
+	}
+}
+
+func TestEditCreatorRolesEPUB2(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" unique-identifier="id" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:2</dc:identifier>
+    <dc:title>Old</dc:title>
+    <dc:creator opf:role="aut" opf:file-as="Doe, Jane">Jane Doe</dc:creator>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest><item id="ch" href="ch.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch"/></spine>
+</package>`,
+		"OEBPS/ch.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Hi</p></body></html>`,
+	})
+	dump := filepath.Join(t.TempDir(), "meta.json")
+	creators := []string{"Jane Doe|aut|Doe, Jane", "Ann Lee|trl"}
+	if _, err := EditEPUB(ctx, input, EditOptions{DumpMetaPath: dump, MetadataPatch: MetadataPatch{Creators: &creators}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Jane Doe|aut|Doe, Jane"`) {
+		t.Fatalf("dump lost the opf attributes:\n%s", data)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	opf, err := os.ReadFile(vol.PackagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(opf), `xmlns:opf=`) || !strings.Contains(string(opf), `opf:role="trl"`) {
+		t.Fatalf("package:\n%s", opf)
+	}
+	if got := formatCreators(creatorsOf(vol.PackageDoc.Metadata)); len(got) != 2 || got[1] != "Ann Lee|trl" {
+		t.Fatalf("creators = %q", got)
+	}
+}
@@ -0,0 +1,386 @@
+package epub
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	linkTagPattern  = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	hrefAttrPattern = regexp.MustCompile(`(?is)(\bhref\s*=\s*)("[^"]*"|'[^']*')`)
+	relAttrPattern  = regexp.MustCompile(`(?is)\brel\s*=\s*("[^"]*"|'[^']*')`)
+	headEndPattern  = regexp.MustCompile(`(?i)</head\s*>`)
+	cssCommentRE    = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssImportRE     = regexp.MustCompile(`(?i)(@import\s+(?:url\(\s*)?)("[^"]*"|'[^']*'|[^\s"');]+)`)
+)
+
+// cssConflict is a selector whose property is set to different values by
+// different stylesheets.
+type cssConflict struct {
+	Selector string
+	Property string
+	// Values maps each distinct value to the stylesheets that use it.
+	Values map[string][]string
+}
+
+// consolidateCSS runs the stylesheet steps of a merge over the staged OEBPS
+// directory: byte-identical stylesheets are collapsed into one, or every
+// chapter is pointed at a single replacement stylesheet.
+func consolidateCSS(oebpsDir string, manifest *Manifest, opts MergeOptions, plan *MergePlan, log *slog.Logger) error {
+	if opts.Stylesheet != "" {
+		return useCanonicalStylesheet(oebpsDir, manifest, opts.Stylesheet, log)
+	}
+	if !opts.DedupeCSS {
+		return nil
+	}
+
+	byHash := map[[32]byte]string{}
+	replaced := map[string]string{}
+	kept := manifest.Items[:0]
+	for _, item := range manifest.Items {
+		if item.MediaType != "text/css" {
+			kept = append(kept, item)
+			continue
+		}
+		p := filepath.Join(oebpsDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if first, ok := byHash[sum]; ok {
+			replaced[item.Href] = first
+			plan.resource(item.Href, ResourceDeduplicated, first)
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			continue
+		}
+		byHash[sum] = item.Href
+		kept = append(kept, item)
+	}
+	manifest.Items = kept
+	log.Info("deduplicated stylesheets", "removed", len(replaced), "kept", len(byHash))
+
+	if len(replaced) > 0 {
+		err := rewriteStylesheetLinks(oebpsDir, manifest, func(dir string, tag string, target string) (string, bool) {
+			canonical, ok := replaced[target]
+			if !ok {
+				return tag, false
+			}
+			return setLinkHref(tag, relativeHref(dir, canonical)), true
+		})
+		if err != nil {
+			return err
+		}
+		if err := rewriteCSSImports(oebpsDir, manifest, replaced); err != nil {
+			return err
+		}
+	}
+
+	var sheets []string
+	for _, item := range manifest.Items {
+		if item.MediaType == "text/css" {
+			sheets = append(sheets, item.Href)
+		}
+	}
+	conflicts, err := findCSSConflicts(oebpsDir, sheets)
+	if err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		log.Warn("stylesheet conflict", "selector", c.Selector, "property", c.Property, "values", c.describe())
+	}
+	return nil
+}
+
+// useCanonicalStylesheet replaces every stylesheet in the book with the CSS
+// file at src: old stylesheets leave the manifest, and each XHTML document
+// links only to the new one.
+func useCanonicalStylesheet(oebpsDir string, manifest *Manifest, src string, log *slog.Logger) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("stylesheet: %w", err)
+	}
+	href := "Styles/novfmt.css"
+	dest := filepath.Join(oebpsDir, filepath.FromSlash(href))
+	if err := ensureParentDir(dest); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dest, data, 0o644); err != nil {
+		return err
+	}
+
+	removed := 0
+	kept := manifest.Items[:0]
+	for _, item := range manifest.Items {
+		if item.MediaType == "text/css" {
+			if err := os.Remove(filepath.Join(oebpsDir, filepath.FromSlash(item.Href))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+			continue
+		}
+		kept = append(kept, item)
+	}
+	manifest.Items = append(kept, ManifestItem{ID: "novfmt-css", Href: href, MediaType: "text/css"})
+	log.Info("replaced stylesheets", "removed", removed, "stylesheet", src)
+
+	for _, item := range manifest.Items {
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		p := filepath.Join(oebpsDir, filepath.FromSlash(item.Href))
+		doc, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		s := linkTagPattern.ReplaceAllStringFunc(string(doc), func(tag string) string {
+			if isStylesheetLink(tag) {
+				return ""
+			}
+			return tag
+		})
+		link := fmt.Sprintf(`<link rel="stylesheet" type="text/css" href="%s"/>`, relativeHref(path.Dir(item.Href), href))
+		loc := headEndPattern.FindStringIndex(s)
+		if loc == nil {
+			log.Warn("document has no head; stylesheet not linked", "href", item.Href)
+			continue
+		}
+		s = s[:loc[0]] + link + "\n" + s[loc[0]:]
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteStylesheetLinks calls fn for every stylesheet <link> in the XHTML
+// documents of manifest with the document's directory and the link target
+// resolved against it; fn returns the replacement tag.
+func rewriteStylesheetLinks(oebpsDir string, manifest *Manifest, fn func(dir, tag, target string) (string, bool)) error {
+	for _, item := range manifest.Items {
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		p := filepath.Join(oebpsDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		dir := path.Dir(item.Href)
+		changed := false
+		out := linkTagPattern.ReplaceAllStringFunc(string(data), func(tag string) string {
+			if !isStylesheetLink(tag) {
+				return tag
+			}
+			target := linkTarget(tag)
+			if target == "" {
+				return tag
+			}
+			repl, ok := fn(dir, tag, normalizeEPUBPath(path.Join(dir, target)))
+			if ok {
+				changed = true
+			}
+			return repl
+		})
+		if changed {
+			if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteCSSImports points @import rules of the remaining stylesheets at
+// the kept copy of a removed duplicate.
+func rewriteCSSImports(oebpsDir string, manifest *Manifest, replaced map[string]string) error {
+	for _, item := range manifest.Items {
+		if item.MediaType != "text/css" {
+			continue
+		}
+		p := filepath.Join(oebpsDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		dir := path.Dir(item.Href)
+		changed := false
+		out := cssImportRE.ReplaceAllStringFunc(string(data), func(m string) string {
+			sub := cssImportRE.FindStringSubmatch(m)
+			target := strings.Trim(sub[2], `"'`)
+			canonical, ok := replaced[normalizeEPUBPath(path.Join(dir, target))]
+			if !ok {
+				return m
+			}
+			changed = true
+			return sub[1] + `"` + relativeHref(dir, canonical) + `"`
+		})
+		if changed {
+			if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isStylesheetLink(tag string) bool {
+	m := relAttrPattern.FindStringSubmatch(tag)
+	return m != nil && strings.Contains(strings.ToLower(m[1]), "stylesheet")
+}
+
+func linkTarget(tag string) string {
+	m := hrefAttrPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	href := m[2][1 : len(m[2])-1]
+	if strings.Contains(href, "://") {
+		return ""
+	}
+	href, _, _ = strings.Cut(href, "#")
+	return href
+}
+
+func setLinkHref(tag, href string) string {
+	return hrefAttrPattern.ReplaceAllString(tag, `${1}"`+href+`"`)
+}
+
+// findCSSConflicts compares the top-level rules of the given stylesheets
+// (package-relative hrefs under oebpsDir). At-rules such as @media and
+// @font-face are not compared.
+func findCSSConflicts(oebpsDir string, hrefs []string) ([]cssConflict, error) {
+	type key struct{ selector, property string }
+	values := map[key]map[string][]string{}
+	for _, href := range hrefs {
+		data, err := os.ReadFile(filepath.Join(oebpsDir, filepath.FromSlash(href)))
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range parseCSSRules(string(data)) {
+			for _, sel := range rule.selectors {
+				for prop, val := range rule.decls {
+					k := key{sel, prop}
+					if values[k] == nil {
+						values[k] = map[string][]string{}
+					}
+					if !containsString(values[k][val], href) {
+						values[k][val] = append(values[k][val], href)
+					}
+				}
+			}
+		}
+	}
+
+	var out []cssConflict
+	for k, vals := range values {
+		if len(vals) > 1 {
+			out = append(out, cssConflict{Selector: k.selector, Property: k.property, Values: vals})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Selector != out[j].Selector {
+			return out[i].Selector < out[j].Selector
+		}
+		return out[i].Property < out[j].Property
+	})
+	return out, nil
+}
+
+func (c cssConflict) describe() string {
+	vals := make([]string, 0, len(c.Values))
+	for v := range c.Values {
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	parts := make([]string, 0, len(vals))
+	for _, v := range vals {
+		parts = append(parts, fmt.Sprintf("%s in %s", v, strings.Join(c.Values[v], ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+type cssRule struct {
+	selectors []string
+	decls     map[string]string
+}
+
+// parseCSSRules returns the top-level style rules of css; later
+// declarations of a property win within a rule.
+func parseCSSRules(css string) []cssRule {
+	css = cssCommentRE.ReplaceAllString(css, "")
+	var rules []cssRule
+	i := 0
+	for i < len(css) {
+		open := strings.IndexByte(css[i:], '{')
+		if open < 0 {
+			break
+		}
+		prelude := strings.TrimSpace(css[i : i+open])
+		// Skip statements like @import ...; that precede the block.
+		if semi := strings.LastIndexByte(prelude, ';'); semi >= 0 {
+			prelude = strings.TrimSpace(prelude[semi+1:])
+		}
+		end := matchingBrace(css, i+open)
+		body := css[i+open+1 : end]
+		i = end + 1
+		if strings.HasPrefix(prelude, "@") || prelude == "" {
+			continue
+		}
+		rule := cssRule{decls: map[string]string{}}
+		for _, sel := range strings.Split(prelude, ",") {
+			if sel = normalizeSpace(sel); sel != "" {
+				rule.selectors = append(rule.selectors, sel)
+			}
+		}
+		for _, decl := range strings.Split(body, ";") {
+			prop, val, ok := strings.Cut(decl, ":")
+			if !ok {
+				continue
+			}
+			prop = strings.ToLower(strings.TrimSpace(prop))
+			val = strings.ToLower(normalizeSpace(val))
+			if prop != "" && val != "" {
+				rule.decls[prop] = val
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matchingBrace returns the index of the brace closing the one at open, or
+// the end of s.
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func cssTestVolume(t *testing.T, title, css string) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">%[1]s</dc:identifier>
+    <dc:title>%[1]s</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="css" href="Styles/style.css" media-type="text/css"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`, title),
+		"OEBPS/Styles/style.css": css,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>x</title>
+<link href="../Styles/style.css" rel="stylesheet" type="text/css"/>
+</head><body><p>Text</p></body></html>
+`,
+	})
+}
+
+func TestMergeDedupeCSS(t *testing.T) {
+	same := "body { margin: 0 }\np { text-indent: 1em }\n"
+	vols := []string{
+		cssTestVolume(t, "One", same),
+		cssTestVolume(t, "Two", same),
+		cssTestVolume(t, "Three", "/* v3 */ body { margin: 2em; }\n@media print { body { margin: 5em } }\n"),
+	}
+	var logs bytes.Buffer
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	opts := MergeOptions{
+		OutPath:   out,
+		DedupeCSS: true,
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	if err := MergeEPUBs(context.Background(), vols, opts); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatalf("load merged: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	var sheets []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.MediaType == "text/css" {
+			sheets = append(sheets, item.Href)
+		}
+	}
+	if len(sheets) != 2 || sheets[0] != "Volumes/v0001/Styles/style.css" || sheets[1] != "Volumes/v0003/Styles/style.css" {
+		t.Fatalf("unexpected stylesheets: %v", sheets)
+	}
+	if _, err := os.Stat(filepath.Join(vol.PackageDir, "Volumes", "v0002", "Styles", "style.css")); !os.IsNotExist(err) {
+		t.Fatalf("duplicate stylesheet should be removed, stat err %v", err)
+	}
+	ch2, err := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0002", "Text", "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(ch2), `href="../../v0001/Styles/style.css"`) {
+		t.Fatalf("link not redirected to the kept copy:\n%s", ch2)
+	}
+
+	got := logs.String()
+	if !strings.Contains(got, "stylesheet conflict") || !strings.Contains(got, "selector=body property=margin") {
+		t.Fatalf("expected body margin conflict in logs:\n%s", got)
+	}
+	if strings.Contains(got, "5em") || strings.Contains(got, "text-indent") {
+		t.Fatalf("unexpected conflict reported:\n%s", got)
+	}
+}
+
+func TestMergeCanonicalStylesheet(t *testing.T) {
+	vols := []string{
+		cssTestVolume(t, "One", "body { margin: 0 }"),
+		cssTestVolume(t, "Two", "body { margin: 1em }"),
+	}
+	canonical := filepath.Join(t.TempDir(), "series.css")
+	if err := os.WriteFile(canonical, []byte("body { margin: 0.5em }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, Stylesheet: canonical}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatalf("load merged: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	var sheets []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.MediaType == "text/css" {
+			sheets = append(sheets, item.Href)
+		}
+	}
+	if len(sheets) != 1 || sheets[0] != "Styles/novfmt.css" {
+		t.Fatalf("unexpected stylesheets: %v", sheets)
+	}
+	for _, v := range []string{"v0001", "v0002"} {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", v, "Text", "ch1.xhtml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := string(data)
+		if strings.Count(doc, "<link") != 1 || !strings.Contains(doc, `href="../../../Styles/novfmt.css"`) {
+			t.Fatalf("%s: expected a single link to the canonical stylesheet:\n%s", v, doc)
+		}
+	}
+}
+
+func TestParseCSSRules(t *testing.T) {
+	rules := parseCSSRules(`@import url("base.css");
+h1,  h2 { FONT-WEIGHT: Bold; margin:0 }
+@font-face { font-family: X; src: url(x.ttf) }
+p{}`)
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %+v", rules)
+	}
+	if len(rules[0].selectors) != 2 || rules[0].selectors[1] != "h2" {
+		t.Fatalf("selectors: %+v", rules[0].selectors)
+	}
+	if rules[0].decls["font-weight"] != "bold" || rules[0].decls["margin"] != "0" {
+		t.Fatalf("declarations: %+v", rules[0].decls)
+	}
+}
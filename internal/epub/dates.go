@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// w3cdtfRE matches the W3C date and time formats dc:date takes: a year, a
+// month, a day, or a day and time with a zone.
+var w3cdtfRE = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2}))?)?)?$`)
+
+// checkPubDate reports whether s is a date dc:date can hold, such as
+// "2023", "2023-05" or "2023-05-01".
+func checkPubDate(s string) error {
+	bad := fmt.Errorf("pubdate %q is not a W3C date such as 2023-05-01", s)
+	if !w3cdtfRE.MatchString(s) {
+		return bad
+	}
+	layouts := map[int]string{4: "2006", 7: "2006-01", 10: "2006-01-02"}
+	if layout, ok := layouts[len(s)]; ok {
+		if _, err := time.Parse(layout, s); err != nil {
+			return bad
+		}
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, fixW3CDTFTime(s)); err != nil {
+		return bad
+	}
+	return nil
+}
+
+// fixW3CDTFTime adds the seconds W3CDTF lets a time omit, so that it
+// parses as RFC 3339.
+func fixW3CDTFTime(s string) string {
+	if len(s) > 16 && s[16] != ':' {
+		return s[:16] + ":00" + s[16:]
+	}
+	return s
+}
+
+// pubDateIndex returns the index of the publication date in meta.Dates,
+// or -1. EPUB 3 allows one dc:date, the publication date. EPUB 2 tells
+// dates apart with opf:event; there the publication date is the one with
+// event publication, or else the first without an event.
+func pubDateIndex(meta Metadata) int {
+	for i, dc := range meta.Dates {
+		if strings.EqualFold(dc.Event, "publication") {
+			return i
+		}
+	}
+	for i, dc := range meta.Dates {
+		if dc.Event == "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// pubDate returns the publication date of meta, or "".
+func pubDate(meta Metadata) string {
+	if i := pubDateIndex(meta); i >= 0 {
+		return strings.TrimSpace(meta.Dates[i].Value)
+	}
+	return ""
+}
+
+// setPubDate replaces the publication date of meta; an empty value
+// removes it. EPUB 2 dates for other events, such as creation, are kept.
+func setPubDate(meta *Metadata, epub3 bool, value string) {
+	if epub3 {
+		if value == "" {
+			meta.Dates = nil
+			return
+		}
+		meta.Dates = replaceFirstDC(meta.Dates, value)
+		meta.Dates[0].Event = ""
+		return
+	}
+	i := pubDateIndex(*meta)
+	switch {
+	case value == "" && i >= 0:
+		meta.Dates = append(meta.Dates[:i], meta.Dates[i+1:]...)
+	case value == "":
+	case i >= 0:
+		meta.Dates[i].Value = value
+		meta.Dates[i].Event = "publication"
+	default:
+		meta.Dates = append([]DCMeta{{Value: value, Event: "publication"}}, meta.Dates...)
+	}
+}
+
+// setModified sets dcterms:modified to stamp, and an EPUB 2 dc:date with
+// event modification to match.
+func setModified(meta *Metadata, stamp time.Time) {
+	value := stamp.UTC().Format(time.RFC3339)
+	for i := range meta.Dates {
+		if strings.EqualFold(meta.Dates[i].Event, "modification") {
+			meta.Dates[i].Value = value
+		}
+	}
+	for i := range meta.Meta {
+		if meta.Meta[i].Property == "dcterms:modified" {
+			meta.Meta[i].Value = value
+			return
+		}
+	}
+	meta.Meta = append(meta.Meta, MetaNode{
+		Property: "dcterms:modified",
+		Value:    value,
+	})
+}
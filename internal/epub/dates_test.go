@@ -0,0 +1,109 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckPubDate(t *testing.T) {
+	for _, s := range []string{"2023", "2023-05", "2023-05-01", "2023-05-01T09:30Z", "2023-05-01T09:30:00+09:00"} {
+		if err := checkPubDate(s); err != nil {
+			t.Errorf("checkPubDate(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"May 2023", "2023-13", "2023-02-30", "2023/05/01", "2023-05-01T09:30"} {
+		if err := checkPubDate(s); err == nil {
+			t.Errorf("checkPubDate(%q) accepted", s)
+		}
+	}
+}
+
+func TestEditDatesEPUB2(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" unique-identifier="id" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:2</dc:identifier>
+    <dc:title>Old</dc:title>
+    <dc:date opf:event="creation">2019-01-01</dc:date>
+    <dc:date opf:event="modification">2019-02-01</dc:date>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest><item id="ch" href="ch.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch"/></spine>
+</package>`,
+		"OEBPS/ch.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Hi</p></body></html>`,
+	})
+
+	date := "2020-06-15"
+	stamp := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{PubDate: &date}, Modified: stamp}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	if got := pubDate(meta); got != date {
+		t.Fatalf("pubdate = %q", got)
+	}
+	events := map[string]string{}
+	for _, dc := range meta.Dates {
+		events[dc.Event] = dc.Value
+	}
+	want := map[string]string{"publication": date, "creation": "2019-01-01", "modification": "2023-05-01T00:00:00Z"}
+	if len(events) != len(want) {
+		t.Fatalf("dates = %+v", meta.Dates)
+	}
+	for event, value := range want {
+		if events[event] != value {
+			t.Fatalf("dates = %+v", meta.Dates)
+		}
+	}
+	if metaValues(meta, "dcterms:modified")[0] != "2023-05-01T00:00:00Z" {
+		t.Fatalf("meta = %+v", meta.Meta)
+	}
+
+	bad := "last spring"
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{PubDate: &bad}}); err == nil {
+		t.Fatal("expected a malformed pubdate to be rejected")
+	}
+}
+
+func TestEditModifiedOnly(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Title", "en")
+	stamp := time.Date(2023, 5, 1, 9, 0, 0, 0, time.FixedZone("JST", 9*3600))
+	cs, err := EditEPUB(ctx, input, EditOptions{Modified: stamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.Written() {
+		t.Fatalf("outcome = %s", cs.Outcome)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := metaValues(vol.PackageDoc.Metadata, "dcterms:modified"); len(got) != 1 || got[0] != "2023-05-01T00:00:00Z" {
+		t.Fatalf("dcterms:modified = %v", got)
+	}
+}
+
+func TestSetPubDateEPUB3(t *testing.T) {
+	meta := Metadata{Dates: []DCMeta{{ID: "d", Value: "2001"}, {Value: "2002"}}}
+	setPubDate(&meta, true, "2020-01-02")
+	if len(meta.Dates) != 1 || meta.Dates[0].ID != "d" || meta.Dates[0].Value != "2020-01-02" {
+		t.Fatalf("dates = %+v", meta.Dates)
+	}
+	setPubDate(&meta, true, "")
+	if len(meta.Dates) != 0 {
+		t.Fatalf("dates = %+v", meta.Dates)
+	}
+}
@@ -0,0 +1,161 @@
+package epub
+
+import "sort"
+
+// diffHunk is a region that differs between two sequences: a[A0:A1] was
+// replaced by b[B0:B1]. Either side may be empty.
+type diffHunk struct {
+	A0, A1, B0, B1 int
+}
+
+// lcsCellLimit bounds the table used when no unique anchors are left; larger
+// regions are reported as replaced wholesale.
+const lcsCellLimit = 4 << 20
+
+// diffStrings returns the differing regions of a and b in order. It uses
+// patience-style anchoring on elements unique to both sides and falls back
+// to a plain LCS for small unanchored regions.
+func diffStrings(a, b []string) []diffHunk {
+	var pairs [][2]int
+	matchRange(a, b, 0, 0, &pairs)
+
+	var hunks []diffHunk
+	ai, bi := 0, 0
+	for _, p := range append(pairs, [2]int{len(a), len(b)}) {
+		if p[0] > ai || p[1] > bi {
+			hunks = append(hunks, diffHunk{A0: ai, A1: p[0], B0: bi, B1: p[1]})
+		}
+		ai, bi = p[0]+1, p[1]+1
+	}
+	return hunks
+}
+
+// matchRange appends the matched index pairs of a and b (offset by aOff and
+// bOff) to out in increasing order.
+func matchRange(a, b []string, aOff, bOff int, out *[][2]int) {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		*out = append(*out, [2]int{aOff + pre, bOff + pre})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	midA, midB := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(midA) > 0 && len(midB) > 0 {
+		matchMiddle(midA, midB, aOff+pre, bOff+pre, out)
+	}
+	for i := suf; i > 0; i-- {
+		*out = append(*out, [2]int{aOff + len(a) - i, bOff + len(b) - i})
+	}
+}
+
+func matchMiddle(a, b []string, aOff, bOff int, out *[][2]int) {
+	anchors := uniqueAnchors(a, b)
+	if len(anchors) == 0 {
+		if len(a)*len(b) <= lcsCellLimit {
+			for _, p := range lcsPairs(a, b) {
+				*out = append(*out, [2]int{aOff + p[0], bOff + p[1]})
+			}
+		}
+		return
+	}
+	ai, bi := 0, 0
+	for _, p := range anchors {
+		matchRange(a[ai:p[0]], b[bi:p[1]], aOff+ai, bOff+bi, out)
+		*out = append(*out, [2]int{aOff + p[0], bOff + p[1]})
+		ai, bi = p[0]+1, p[1]+1
+	}
+	matchRange(a[ai:], b[bi:], aOff+ai, bOff+bi, out)
+}
+
+// uniqueAnchors pairs up elements occurring exactly once in both a and b
+// and keeps the longest subsequence that is increasing on both sides.
+func uniqueAnchors(a, b []string) [][2]int {
+	type counts struct{ a, b, ai, bi int }
+	seen := map[string]*counts{}
+	for i, s := range a {
+		c := seen[s]
+		if c == nil {
+			c = &counts{}
+			seen[s] = c
+		}
+		c.a++
+		c.ai = i
+	}
+	for i, s := range b {
+		if c := seen[s]; c != nil {
+			c.b++
+			c.bi = i
+		}
+	}
+	var cand [][2]int
+	for _, c := range seen {
+		if c.a == 1 && c.b == 1 {
+			cand = append(cand, [2]int{c.ai, c.bi})
+		}
+	}
+	sort.Slice(cand, func(i, j int) bool { return cand[i][0] < cand[j][0] })
+	return longestIncreasing(cand)
+}
+
+// longestIncreasing returns the longest subsequence of pairs (sorted by
+// first element) whose second elements increase.
+func longestIncreasing(pairs [][2]int) [][2]int {
+	if len(pairs) == 0 {
+		return nil
+	}
+	tails := []int{}
+	prev := make([]int, len(pairs))
+	for i, p := range pairs {
+		j := sort.Search(len(tails), func(k int) bool { return pairs[tails[k]][1] >= p[1] })
+		if j > 0 {
+			prev[i] = tails[j-1]
+		} else {
+			prev[i] = -1
+		}
+		if j == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[j] = i
+		}
+	}
+	out := make([][2]int, len(tails))
+	for i, k := len(tails)-1, tails[len(tails)-1]; i >= 0; i, k = i-1, prev[k] {
+		out[i] = pairs[k]
+	}
+	return out
+}
+
+func lcsPairs(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	table := make([]int32, (n+1)*(m+1))
+	at := func(i, j int) *int32 { return &table[i*(m+1)+j] }
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				*at(i, j) = *at(i+1, j+1) + 1
+			case *at(i+1, j) >= *at(i, j+1):
+				*at(i, j) = *at(i+1, j)
+			default:
+				*at(i, j) = *at(i, j+1)
+			}
+		}
+	}
+	var out [][2]int
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, [2]int{i, j})
+			i++
+			j++
+		case *at(i+1, j) >= *at(i, j+1):
+			i++
+		default:
+			j++
+		}
+	}
+	return out
+}
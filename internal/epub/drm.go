@@ -0,0 +1,52 @@
+package epub
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// algAdobeObfuscation is Adobe's font obfuscation algorithm, which, like the
+// IDPF one, hides fonts rather than the book.
+const algAdobeObfuscation = "http://ns.adobe.com/pdf/enc#RC"
+
+// drmMarkers are files that DRM schemes add to META-INF, by the scheme they
+// identify.
+var drmMarkers = []struct{ file, scheme string }{
+	{"rights.xml", "Adobe ADEPT"},
+	{"sinf.xml", "Apple FairPlay"},
+	{"license.lcpl", "Readium LCP"},
+}
+
+// checkDRM fails with ErrDRM when META-INF/encryption.xml of the book
+// extracted under rootDir encrypts anything but obfuscated fonts.
+func checkDRM(rootDir string) error {
+	data, err := os.ReadFile(filepath.Join(rootDir, "META-INF", "encryption.xml"))
+	if err != nil {
+		return nil
+	}
+	var doc encryptionDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return invalidEPUB(fmt.Errorf("parse encryption.xml: %w", err))
+	}
+	encrypted := 0
+	for _, d := range doc.Data {
+		switch d.Method.Algorithm {
+		case algIDPFObfuscation, algAdobeObfuscation:
+		default:
+			encrypted++
+		}
+	}
+	if encrypted == 0 {
+		return nil
+	}
+	scheme := "unknown scheme"
+	for _, m := range drmMarkers {
+		if _, err := os.Stat(filepath.Join(rootDir, "META-INF", m.file)); err == nil {
+			scheme = m.scheme
+			break
+		}
+	}
+	return fmt.Errorf("%w (%s, %d encrypted files)", ErrDRM, scheme, encrypted)
+}
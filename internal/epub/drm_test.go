@@ -0,0 +1,65 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadVolumeClassifiesBadInput(t *testing.T) {
+	ctx := context.Background()
+	opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/><item id="f" href="font.otf" media-type="font/otf"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`
+	encryption := func(alg string) string {
+		return `<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+<enc:EncryptedData><enc:EncryptionMethod Algorithm="` + alg + `"/><enc:CipherData><enc:CipherReference URI="OEBPS/font.otf"/></enc:CipherData></enc:EncryptedData>
+</encryption>`
+	}
+	book := func(extra map[string]string) string {
+		files := map[string]string{
+			"OEBPS/content.opf": opf,
+			"OEBPS/a.xhtml":     `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>a</p></body></html>`,
+			"OEBPS/font.otf":    "font",
+		}
+		for k, v := range extra {
+			files[k] = v
+		}
+		return buildEPUBFromFiles(t, files)
+	}
+
+	obfuscated := book(map[string]string{"META-INF/encryption.xml": encryption(algIDPFObfuscation)})
+	vol, err := loadVolume(ctx, 0, obfuscated)
+	if err != nil {
+		t.Fatalf("obfuscated fonts are not DRM: %v", err)
+	}
+	os.RemoveAll(vol.TempDir)
+
+	drm := book(map[string]string{
+		"META-INF/encryption.xml": encryption("http://www.w3.org/2001/04/xmlenc#aes128-cbc"),
+		"META-INF/rights.xml":     "<rights/>",
+	})
+	if _, err := loadVolume(ctx, 0, drm); !errors.Is(err, ErrDRM) {
+		t.Fatalf("DRM book: err = %v, want ErrDRM", err)
+	}
+
+	junk := filepath.Join(t.TempDir(), "junk.epub")
+	os.WriteFile(junk, []byte("not a zip"), 0o644)
+	noPackage := buildEPUBFromFiles(t, map[string]string{"OEBPS/a.xhtml": "<html/>"})
+	for _, input := range []string{junk, noPackage} {
+		if _, err := loadVolume(ctx, 0, input); !errors.Is(err, ErrInvalidEPUB) {
+			t.Fatalf("%s: err = %v, want ErrInvalidEPUB", input, err)
+		}
+	}
+
+	_, err = loadVolume(ctx, 0, filepath.Join(t.TempDir(), "missing.epub"))
+	if !errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrInvalidEPUB) {
+		t.Fatalf("missing input: err = %v, want a plain not-exist error", err)
+	}
+}
@@ -0,0 +1,218 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultWordsPerMinute is a typical audiobook narration pace.
+	DefaultWordsPerMinute = 155
+	// DefaultCharsPerMinute is the narration pace for Chinese and Japanese
+	// text, which is counted per character.
+	DefaultCharsPerMinute = 300
+
+	propNarrationDuration = "novfmt:narration-duration"
+	novfmtVocabPrefix     = "novfmt: https://novfmt.local/vocab#"
+)
+
+type DurationOptions struct {
+	// WordsPerMinute and CharsPerMinute set the narration pace (defaults
+	// DefaultWordsPerMinute and DefaultCharsPerMinute).
+	WordsPerMinute int
+	CharsPerMinute int
+	// Headings decides where chapters start: a spine document without a
+	// heading belongs to the chapter before it.
+	Headings HeadingDetector
+	// Embed writes the estimates into the package as
+	// novfmt:narration-duration metas: one for the book and, in EPUB 3,
+	// one refining the first document of each chapter, as media:duration
+	// does for media overlays.
+	Embed    bool
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ChapterDuration is the estimated narration time of one chapter.
+type ChapterDuration struct {
+	Title string `json:"title"`
+	// Hrefs lists the chapter's spine documents.
+	Hrefs    []string `json:"hrefs"`
+	Words    int      `json:"words"`
+	CJKChars int      `json:"cjk_chars"`
+	Seconds  int      `json:"seconds"`
+	// Duration is Seconds as a clock value (H:MM:SS).
+	Duration string `json:"duration"`
+}
+
+type DurationReport struct {
+	Chapters  []ChapterDuration `json:"chapters"`
+	Words     int               `json:"words"`
+	CJKChars  int               `json:"cjk_chars"`
+	Seconds   int               `json:"seconds"`
+	Duration  string            `json:"duration"`
+	Changeset Changeset         `json:"changeset"`
+}
+
+// EstimateNarration estimates how long each chapter takes to read aloud:
+// words over WordsPerMinute plus CJK characters over CharsPerMinute. With
+// opts.Embed the estimates are written to the package.
+func EstimateNarration(ctx context.Context, input string, opts DurationOptions) (DurationReport, error) {
+	report := DurationReport{Chapters: []ChapterDuration{}}
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.WordsPerMinute < 0 || opts.CharsPerMinute < 0 {
+		return report, fmt.Errorf("narration pace must be positive")
+	}
+	if opts.WordsPerMinute == 0 {
+		opts.WordsPerMinute = DefaultWordsPerMinute
+	}
+	if opts.CharsPerMinute == 0 {
+		opts.CharsPerMinute = DefaultCharsPerMinute
+	}
+	matcher, err := opts.Headings.compile()
+	if err != nil {
+		return report, err
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	hrefs := spineHrefs(vol.PackageDoc)
+	for i, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		opts.Progress.report(StageRewrite, i, len(hrefs), href)
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+		headings, _, err := scanHeadings(src, href, matcher, false)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return report, err
+		}
+		paras, err := visibleParagraphs(data)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		if len(headings) > 0 || len(report.Chapters) == 0 {
+			title := href
+			if len(headings) > 0 {
+				title = headings[0].title
+			}
+			report.Chapters = append(report.Chapters, ChapterDuration{Title: title})
+		}
+		ch := &report.Chapters[len(report.Chapters)-1]
+		ch.Hrefs = append(ch.Hrefs, href)
+		for _, p := range paras {
+			for _, w := range textWords(p) {
+				if r, size := utf8.DecodeRuneInString(w); size == len(w) && isCJK(r) {
+					ch.CJKChars++
+				} else {
+					ch.Words++
+				}
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(hrefs), len(hrefs), "")
+
+	for i := range report.Chapters {
+		ch := &report.Chapters[i]
+		ch.Seconds = narrationSeconds(ch.Words, ch.CJKChars, opts)
+		ch.Duration = FormatClock(ch.Seconds)
+		report.Words += ch.Words
+		report.CJKChars += ch.CJKChars
+	}
+	report.Seconds = narrationSeconds(report.Words, report.CJKChars, opts)
+	report.Duration = FormatClock(report.Seconds)
+	log.Debug("estimated narration", "chapters", len(report.Chapters), "duration", report.Duration)
+
+	if opts.Embed && embedNarration(vol.PackageDoc, report) {
+		report.Changeset.modified(packageHref(vol))
+	}
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun || !opts.Embed, opts.Progress, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func narrationSeconds(words, cjk int, opts DurationOptions) int {
+	minutes := float64(words)/float64(opts.WordsPerMinute) + float64(cjk)/float64(opts.CharsPerMinute)
+	return int(minutes*60 + 0.5)
+}
+
+// FormatClock renders seconds as H:MM:SS, the clock value form
+// media:duration uses.
+func FormatClock(seconds int) string {
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// embedNarration replaces the narration metas of pkg with the report's and
+// reports whether anything changed.
+func embedNarration(pkg *PackageDocument, report DurationReport) bool {
+	epub2 := strings.HasPrefix(strings.TrimSpace(pkg.Version), "2")
+	var want []MetaNode
+	if epub2 {
+		want = append(want, MetaNode{Name: propNarrationDuration, Content: report.Duration})
+	} else {
+		want = append(want, MetaNode{Property: propNarrationDuration, Value: report.Duration})
+		ids := map[string]string{}
+		for _, item := range pkg.Manifest.Items {
+			ids[item.Href] = item.ID
+		}
+		for _, ch := range report.Chapters {
+			if id := ids[ch.Hrefs[0]]; id != "" {
+				want = append(want, MetaNode{Refines: "#" + id, Property: propNarrationDuration, Value: ch.Duration})
+			}
+		}
+	}
+
+	var have []MetaNode
+	kept := make([]MetaNode, 0, len(pkg.Metadata.Meta))
+	for _, m := range pkg.Metadata.Meta {
+		if m.Property == propNarrationDuration || m.Name == propNarrationDuration {
+			have = append(have, m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	prefixed := epub2 || strings.Contains(pkg.Prefix, "novfmt:")
+	if prefixed && equalMetaNodes(have, want) {
+		return false
+	}
+	pkg.Metadata.Meta = append(kept, want...)
+	if !prefixed {
+		pkg.Prefix = strings.TrimSpace(pkg.Prefix + " " + novfmtVocabPrefix)
+	}
+	return true
+}
+
+func equalMetaNodes(a, b []MetaNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.Value, y.Value = strings.TrimSpace(x.Value), strings.TrimSpace(y.Value)
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
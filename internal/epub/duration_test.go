@@ -0,0 +1,82 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEstimateNarration(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+    <item id="c" href="c.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/><itemref idref="c"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>One</h1><p>` + strings.Repeat("word ", 154) + `</p></body></html>`,
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>` + strings.Repeat("word ", 155) + `</p></body></html>`,
+		"OEBPS/c.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Two</h1><p>` + strings.Repeat("あ", 150) + `</p></body></html>`,
+	})
+
+	report, err := EstimateNarration(ctx, input, DurationOptions{})
+	if err != nil {
+		t.Fatalf("EstimateNarration: %v", err)
+	}
+	if len(report.Chapters) != 2 {
+		t.Fatalf("chapters = %+v", report.Chapters)
+	}
+	one, two := report.Chapters[0], report.Chapters[1]
+	if one.Title != "One" || len(one.Hrefs) != 2 || one.Words != 310 || one.Duration != "0:02:00" {
+		t.Fatalf("first chapter = %+v", one)
+	}
+	// "Two" is a word; the 150 kana take half a minute.
+	if two.CJKChars != 150 || two.Words != 1 || two.Seconds != 30 {
+		t.Fatalf("second chapter = %+v", two)
+	}
+	if report.Seconds != 150 || report.Duration != "0:02:30" || report.Changeset.Written() {
+		t.Fatalf("report = %+v", report)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.epub")
+	report, err = EstimateNarration(ctx, input, DurationOptions{Embed: true, WordsPerMinute: 310, OutPath: out})
+	if err != nil {
+		t.Fatalf("embed: %v", err)
+	}
+	if !report.Changeset.Written() {
+		t.Fatalf("changeset = %+v", report.Changeset)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	pkg := vol.PackageDoc
+	if !strings.Contains(pkg.Prefix, "novfmt:") {
+		t.Fatalf("prefix = %q", pkg.Prefix)
+	}
+	got := map[string]string{}
+	for _, m := range pkg.Metadata.Meta {
+		if m.Property == propNarrationDuration {
+			got[m.Refines] = strings.TrimSpace(m.Value)
+		}
+	}
+	if got[""] != "0:01:30" || got["#a"] != "0:01:00" || got["#c"] != "0:00:30" || len(got) != 3 {
+		t.Fatalf("metas = %v", got)
+	}
+
+	report, err = EstimateNarration(ctx, out, DurationOptions{Embed: true, WordsPerMinute: 310})
+	if err != nil {
+		t.Fatalf("second embed: %v", err)
+	}
+	if report.Changeset.Changed() {
+		t.Fatalf("second embed changed %+v", report.Changeset)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,16 +16,85 @@ type EditOptions struct {
 	NavReplacePath string
 	DumpNavPath    string
 	DumpMetaPath   string
-	MetadataPatch  MetadataPatch
-	TouchModified  bool
+	// DumpTOCPath and ApplyTOCPath name a TOC file (JSON) to write the
+	// table of contents to, or to replace it from; see dumpTOCFile. TOC,
+	// when set, replaces the table of contents directly, with hrefs
+	// relative to the package document. The NCX, if any, is rewritten to
+	// match.
+	DumpTOCPath  string
+	ApplyTOCPath string
+	TOC          []NavItem
+	// ImportCalibrePath and ExportCalibrePath name a Calibre metadata.opf
+	// to apply to the book before MetadataPatch, or to write from it.
+	ImportCalibrePath string
+	ExportCalibrePath string
+	MetadataPatch     MetadataPatch
+	// AddSources and RemoveSources edit the dc:source list after
+	// MetadataPatch, removing first. Values already present are not added
+	// twice.
+	AddSources    []string
+	RemoveSources []string
+	// AddIdentifiers and RemoveIdentifiers edit the dc:identifier list
+	// after MetadataPatch, removing first. A removal names a scheme, such
+	// as "isbn", or an identifier. NewUUID gives the book a fresh
+	// urn:uuid as its unique identifier.
+	AddIdentifiers    []string
+	RemoveIdentifiers []string
+	NewUUID           bool
+	// SpineEdits reorder, drop or insert spine documents, in order.
+	SpineEdits []SpineEdit
+	// Start names where reading systems open the book: a spine document's
+	// href relative to the package document, optionally with a fragment,
+	// or a spine idref. It applies after SpineEdits.
+	Start string
+	// TouchModified sets dcterms:modified to the current time when the
+	// book changes. Modified, when not zero, is written instead, whether or
+	// not anything else changes.
+	TouchModified bool
+	Modified      time.Time
+	Logger        *slog.Logger
 }
 
+// MetadataPatch holds metadata edits; nil fields are left alone. Creators
+// are written as ParseCreator reads them, such as "Jane Doe|ill|Doe, Jane".
 type MetadataPatch struct {
 	Title       *string   `json:"title,omitempty"`
+	Subtitle    *string   `json:"subtitle,omitempty"`
 	Language    *string   `json:"language,omitempty"`
 	Identifier  *string   `json:"identifier,omitempty"`
 	Description *string   `json:"description,omitempty"`
 	Creators    *[]string `json:"creators,omitempty"`
+	// PubDate sets the publication date (dc:date), a W3C date such as
+	// "2023-05-01"; an empty PubDate removes it.
+	PubDate *string `json:"pubdate,omitempty"`
+	// Series and SeriesIndex set the series as Calibre and EPUB 3 record
+	// it; an empty Series removes it.
+	Series      *string `json:"series,omitempty"`
+	SeriesIndex *string `json:"series_index,omitempty"`
+	// Titles replaces every title; Title and Subtitle then replace the
+	// main title and the subtitle.
+	Titles *[]Title `json:"titles,omitempty"`
+	// Sources replaces the dc:source list, which records the books this one
+	// was made from.
+	Sources *[]string `json:"sources,omitempty"`
+	// Refines replaces the EPUB 3 refinements of the elements it names by
+	// id, such as "creator1"; an empty list removes them.
+	Refines map[string][]Refinement `json:"refines,omitempty"`
+	// The schema.org accessibility metadata. Each AccessModesSufficient
+	// entry is a comma-separated set of access modes, such as
+	// "textual,visual".
+	AccessModes           *[]string `json:"access_modes,omitempty"`
+	AccessModesSufficient *[]string `json:"access_modes_sufficient,omitempty"`
+	AccessibilityFeatures *[]string `json:"accessibility_features,omitempty"`
+	AccessibilityHazards  *[]string `json:"accessibility_hazards,omitempty"`
+	AccessibilitySummary  *string   `json:"accessibility_summary,omitempty"`
+	// The EPUB 3 rendition settings, which fixed-layout books use; an
+	// empty value removes the setting, leaving its default (reflowable or
+	// auto).
+	RenditionLayout      *string `json:"rendition_layout,omitempty"`
+	RenditionOrientation *string `json:"rendition_orientation,omitempty"`
+	RenditionSpread      *string `json:"rendition_spread,omitempty"`
+	RenditionFlow        *string `json:"rendition_flow,omitempty"`
 }
 
 type MetadataSnapshot struct {
@@ -33,105 +103,291 @@ type MetadataSnapshot struct {
 	Identifier  string   `json:"identifier,omitempty"`
 	Description string   `json:"description,omitempty"`
 	Creators    []string `json:"creators,omitempty"`
+	PubDate     string   `json:"pubdate,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex string   `json:"series_index,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	// Titles lists every title when there is more than one or they are
+	// typed.
+	Titles []Title `json:"titles,omitempty"`
+	// Identifiers lists every identifier when there is more than one.
+	Identifiers []string `json:"identifiers,omitempty"`
+	// Refines lists the refinements by the id of the element they refine.
+	Refines map[string][]Refinement `json:"refines,omitempty"`
+
+	AccessModes           []string `json:"access_modes,omitempty"`
+	AccessModesSufficient []string `json:"access_modes_sufficient,omitempty"`
+	AccessibilityFeatures []string `json:"accessibility_features,omitempty"`
+	AccessibilityHazards  []string `json:"accessibility_hazards,omitempty"`
+	AccessibilitySummary  string   `json:"accessibility_summary,omitempty"`
+
+	RenditionLayout      string `json:"rendition_layout,omitempty"`
+	RenditionOrientation string `json:"rendition_orientation,omitempty"`
+	RenditionSpread      string `json:"rendition_spread,omitempty"`
+	RenditionFlow        string `json:"rendition_flow,omitempty"`
 }
 
 func (p MetadataPatch) IsZero() bool {
 	return p.Title == nil &&
+		p.Subtitle == nil &&
+		p.Titles == nil &&
+		p.PubDate == nil &&
+		p.Series == nil &&
+		p.SeriesIndex == nil &&
 		p.Language == nil &&
 		p.Identifier == nil &&
 		p.Description == nil &&
-		p.Creators == nil
+		p.Creators == nil &&
+		p.Sources == nil &&
+		p.Refines == nil &&
+		p.AccessModes == nil &&
+		p.AccessModesSufficient == nil &&
+		p.AccessibilityFeatures == nil &&
+		p.AccessibilityHazards == nil &&
+		p.AccessibilitySummary == nil &&
+		p.RenditionLayout == nil &&
+		p.RenditionOrientation == nil &&
+		p.RenditionSpread == nil &&
+		p.RenditionFlow == nil
 }
 
-func EditEPUB(ctx context.Context, input string, opts EditOptions) error {
+// EditEPUB applies opts to the book and reports what changed. Dumps and
+// exports are written even when nothing else changes.
+func EditEPUB(ctx context.Context, input string, opts EditOptions) (Changeset, error) {
+	var cs Changeset
 	if input == "" {
-		return fmt.Errorf("input EPUB path is required")
+		return cs, fmt.Errorf("input EPUB path is required")
+	}
+	if err := validateAccessibility(opts.MetadataPatch); err != nil {
+		return cs, err
+	}
+	if err := validateRendition(opts.MetadataPatch); err != nil {
+		return cs, err
+	}
+	if opts.NewUUID && opts.MetadataPatch.Identifier != nil {
+		return cs, fmt.Errorf("a new UUID and an identifier cannot both be set")
+	}
+	if opts.MetadataPatch.Identifier != nil {
+		id, err := NormalizeIdentifier(*opts.MetadataPatch.Identifier)
+		if err != nil {
+			return cs, err
+		}
+		opts.MetadataPatch.Identifier = &id
+	}
+	for i, id := range opts.AddIdentifiers {
+		norm, err := NormalizeIdentifier(id)
+		if err != nil {
+			return cs, err
+		}
+		opts.AddIdentifiers[i] = norm
+	}
+	if opts.NavReplacePath != "" && (opts.ApplyTOCPath != "" || opts.TOC != nil) {
+		return cs, fmt.Errorf("a nav replacement and a TOC file cannot be applied together")
 	}
+	if opts.ApplyTOCPath != "" {
+		items, err := readTOCFile(opts.ApplyTOCPath)
+		if err != nil {
+			return cs, err
+		}
+		opts.TOC = items
+	}
+	if opts.MetadataPatch.Titles != nil {
+		if err := checkTitles(*opts.MetadataPatch.Titles); err != nil {
+			return cs, err
+		}
+	}
+	if d := opts.MetadataPatch.PubDate; d != nil && strings.TrimSpace(*d) != "" {
+		if err := checkPubDate(strings.TrimSpace(*d)); err != nil {
+			return cs, err
+		}
+	}
+	if opts.MetadataPatch.Creators != nil {
+		for _, c := range *opts.MetadataPatch.Creators {
+			if _, err := ParseCreator(c); err != nil {
+				return cs, err
+			}
+		}
+	}
+	log := loggerOrDiscard(opts.Logger)
 
+	log.Info("loading book", "path", input)
 	vol, err := loadVolume(ctx, 0, input)
 	if err != nil {
-		return err
+		return cs, err
 	}
 	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
 
 	pkg := vol.PackageDoc
 
 	if opts.DumpMetaPath != "" {
-		if err := writeMetadataSnapshot(pkg.Metadata, opts.DumpMetaPath); err != nil {
-			return err
+		if err := writeMetadataSnapshot(pkg, opts.DumpMetaPath); err != nil {
+			return cs, err
 		}
 	}
 
 	if opts.DumpNavPath != "" {
 		if err := dumpNavFile(vol, opts.DumpNavPath); err != nil {
-			return err
+			return cs, err
+		}
+	}
+
+	if opts.DumpTOCPath != "" {
+		if err := dumpTOCFile(vol, opts.DumpTOCPath); err != nil {
+			return cs, err
+		}
+	}
+
+	if opts.ExportCalibrePath != "" {
+		log.Info("exporting calibre metadata", "path", opts.ExportCalibrePath)
+		if err := WriteCalibreOPF(opts.ExportCalibrePath, calibreFromPackage(pkg.Metadata)); err != nil {
+			return cs, err
 		}
 	}
 
 	metaChanged := false
+	if opts.ImportCalibrePath != "" {
+		log.Info("importing calibre metadata", "path", opts.ImportCalibrePath)
+		calibre, err := ReadCalibreOPF(opts.ImportCalibrePath)
+		if err != nil {
+			return cs, err
+		}
+		metaChanged = applyCalibreMetadata(&pkg.Metadata, strings.HasPrefix(pkg.Version, "3"), calibre)
+	}
 	if !opts.MetadataPatch.IsZero() {
-		metaChanged = applyMetadataPatch(&pkg.Metadata, opts.MetadataPatch)
+		metaChanged = applyMetadataPatch(pkg, opts.MetadataPatch) || metaChanged
+		metaChanged = applyAccessibilityPatch(pkg, opts.MetadataPatch) || metaChanged
+		changed, err := applyRenditionPatch(pkg, opts.MetadataPatch)
+		if err != nil {
+			return cs, err
+		}
+		metaChanged = changed || metaChanged
+	}
+	if opts.MetadataPatch.Sources != nil || len(opts.AddSources) > 0 || len(opts.RemoveSources) > 0 {
+		metaChanged = editSources(&pkg.Metadata, opts.MetadataPatch.Sources, opts.AddSources, opts.RemoveSources) || metaChanged
+	}
+	for _, spec := range opts.RemoveIdentifiers {
+		n, err := removeIdentifiers(pkg, spec)
+		if err != nil {
+			return cs, err
+		}
+		if n == 0 {
+			log.Warn("no identifier to remove", "identifier", spec)
+		}
+		metaChanged = n > 0 || metaChanged
+	}
+	for _, id := range opts.AddIdentifiers {
+		metaChanged = addIdentifier(pkg, id) || metaChanged
+	}
+	if opts.NewUUID {
+		id := randomURN()
+		log.Info("new unique identifier", "identifier", id)
+		setPrimaryIdentifier(pkg, id)
+		metaChanged = true
+	}
+	// Refinements go last, so that they can name creators the patch added.
+	if opts.MetadataPatch.Refines != nil {
+		changed, err := applyRefinesPatch(pkg, opts.MetadataPatch.Refines)
+		if err != nil {
+			return cs, err
+		}
+		metaChanged = changed || metaChanged
+	}
+
+	// Spine edits go first so that a -nav replacement has the last word.
+	spineChanged := false
+	if len(opts.SpineEdits) > 0 {
+		done, err := applySpineEdits(vol, opts.SpineEdits, &cs)
+		if err != nil {
+			return cs, err
+		}
+		for _, d := range done {
+			log.Info("spine edit", "change", d)
+		}
+		spineChanged = true
 	}
 
 	navChanged := false
 	if opts.NavReplacePath != "" {
 		if vol.NavHref == "" {
-			return fmt.Errorf("nav document not found in %s", input)
+			return cs, fmt.Errorf("nav document not found in %s", input)
 		}
 		if err := replaceNavFile(vol, opts.NavReplacePath); err != nil {
-			return err
+			return cs, err
 		}
 		navChanged = true
 	}
-
-	needsWrite := metaChanged || navChanged
-	if !needsWrite {
-		return nil
-	}
-
-	if opts.TouchModified {
-		updateModifiedTimestamp(&pkg.Metadata)
+	if opts.TOC != nil {
+		if err := applyTOC(vol, opts.TOC, &cs); err != nil {
+			return cs, err
+		}
 	}
-
-	if err := writePackage(pkg, vol.PackagePath); err != nil {
-		return err
+	if opts.Start != "" {
+		href, err := resolveStart(pkg, opts.Start)
+		if err != nil {
+			return cs, err
+		}
+		log.Info("reading start", "href", href)
+		if err := setReadingStart(vol, href, &cs); err != nil {
+			return cs, err
+		}
 	}
 
-	outPath := opts.OutPath
-	if outPath == "" {
-		outPath = input
+	if metaChanged || spineChanged {
+		cs.modified(packageHref(vol))
 	}
-
-	tmpFile, err := os.CreateTemp(filepath.Dir(outPath), "novfmt-edit-*.epub")
-	if err != nil {
-		return err
+	if navChanged {
+		cs.modified(vol.NavHref)
 	}
-	tmpPath := tmpFile.Name()
-	tmpFile.Close()
-	defer func() {
-		if tmpPath != "" {
-			os.Remove(tmpPath)
-		}
-	}()
-
-	if err := writeZip(vol.RootDir, tmpPath); err != nil {
-		return err
+	switch {
+	case !opts.Modified.IsZero():
+		setModified(&pkg.Metadata, opts.Modified)
+		cs.modified(packageHref(vol))
+	case cs.Changed() && opts.TouchModified:
+		updateModifiedTimestamp(&pkg.Metadata)
+		cs.modified(packageHref(vol))
 	}
-	if err := os.Rename(tmpPath, outPath); err != nil {
-		return err
+	if err := cs.commit(ctx, vol, input, opts.OutPath, false, nil, log); err != nil {
+		return cs, err
 	}
-	tmpPath = ""
-
-	return nil
+	return cs, nil
 }
 
-func writeMetadataSnapshot(meta Metadata, dest string) error {
+func writeMetadataSnapshot(pkg *PackageDocument, dest string) error {
+	meta := pkg.Metadata
+	calibre := calibreFromPackage(meta)
 	snapshot := MetadataSnapshot{
-		Title:       firstDCValue(meta.Titles),
+		Title:       mainTitle(meta),
 		Language:    firstDCValue(meta.Languages),
-		Identifier:  firstDCValue(meta.Identifiers),
+		Identifier:  primaryIdentifier(pkg),
 		Description: firstDCValue(meta.Descriptions),
-		Creators:    collectCreators(meta.Creators),
+		Creators:    formatCreators(creatorsOf(meta)),
+		PubDate:     pubDate(meta),
+		Series:      calibre.Series,
+		SeriesIndex: calibre.SeriesIndex,
+		Sources:     collectSources(meta),
+		Refines:     refinementsOf(meta),
+
+		AccessModes:           metaValues(meta, propAccessMode),
+		AccessModesSufficient: metaValues(meta, propAccessModeSufficient),
+		AccessibilityFeatures: metaValues(meta, propA11yFeature),
+		AccessibilityHazards:  metaValues(meta, propA11yHazard),
+	}
+	r := renditionOf(meta)
+	snapshot.RenditionLayout = r[propRenditionLayout]
+	snapshot.RenditionOrientation = r[propRenditionOrientation]
+	snapshot.RenditionSpread = r[propRenditionSpread]
+	snapshot.RenditionFlow = r[propRenditionFlow]
+	if len(meta.Identifiers) > 1 {
+		for _, dc := range meta.Identifiers {
+			snapshot.Identifiers = append(snapshot.Identifiers, strings.TrimSpace(dc.Value))
+		}
+	}
+	if titles := titlesOf(meta); len(titles) > 1 || len(titles) == 1 && titles[0].Type != "" {
+		snapshot.Titles = titles
+	}
+	if summary := metaValues(meta, propA11ySummary); len(summary) > 0 {
+		snapshot.AccessibilitySummary = summary[0]
 	}
 	data, err := json.MarshalIndent(snapshot, "", "  ")
 	if err != nil {
@@ -190,48 +446,74 @@ func collectCreators(nodes []DCMeta) []string {
 	return out
 }
 
-func applyMetadataPatch(meta *Metadata, patch MetadataPatch) bool {
+func applyMetadataPatch(pkg *PackageDocument, patch MetadataPatch) bool {
+	meta := &pkg.Metadata
 	changed := false
+	epub3 := strings.HasPrefix(pkg.Version, "3")
+	if patch.Titles != nil {
+		setTitles(meta, epub3, *patch.Titles)
+		changed = true
+	}
 	if patch.Title != nil {
-		meta.Titles = []DCMeta{{Value: *patch.Title}}
+		setMainTitle(meta, *patch.Title)
+		changed = true
+	}
+	if patch.Subtitle != nil {
+		setSubtitle(meta, epub3, strings.TrimSpace(*patch.Subtitle))
 		changed = true
 	}
 	if patch.Language != nil {
-		meta.Languages = []DCMeta{{Value: *patch.Language}}
+		meta.Languages = replaceFirstDC(meta.Languages, *patch.Language)
 		changed = true
 	}
 	if patch.Identifier != nil {
-		if len(meta.Identifiers) == 0 {
-			meta.Identifiers = []DCMeta{{Value: *patch.Identifier}}
-		} else {
-			meta.Identifiers[0].Value = *patch.Identifier
-		}
+		setPrimaryIdentifier(pkg, *patch.Identifier)
 		changed = true
 	}
 	if patch.Description != nil {
-		meta.Descriptions = []DCMeta{{Value: *patch.Description}}
+		meta.Descriptions = replaceFirstDC(meta.Descriptions, *patch.Description)
+		changed = true
+	}
+	if patch.PubDate != nil {
+		setPubDate(meta, epub3, strings.TrimSpace(*patch.PubDate))
+		changed = true
+	}
+	if patch.Series != nil || patch.SeriesIndex != nil {
+		current := calibreFromPackage(*meta)
+		series, index := current.Series, current.SeriesIndex
+		if patch.Series != nil {
+			series = strings.TrimSpace(*patch.Series)
+		}
+		if patch.SeriesIndex != nil {
+			index = strings.TrimSpace(*patch.SeriesIndex)
+		}
+		setSeries(meta, epub3, series, index)
 		changed = true
 	}
 	if patch.Creators != nil {
-		meta.Creators = make([]DCMeta, 0, len(*patch.Creators))
-		for _, name := range *patch.Creators {
-			meta.Creators = append(meta.Creators, DCMeta{Value: name})
+		creators := make([]Creator, 0, len(*patch.Creators))
+		for _, s := range *patch.Creators {
+			if c, err := ParseCreator(s); err == nil {
+				creators = append(creators, c)
+			}
 		}
+		setCreators(meta, epub3, creators)
 		changed = true
 	}
 	return changed
 }
 
-func updateModifiedTimestamp(meta *Metadata) {
-	stamp := time.Now().UTC().Format(time.RFC3339)
-	for i := range meta.Meta {
-		if meta.Meta[i].Property == "dcterms:modified" {
-			meta.Meta[i].Value = stamp
-			return
-		}
+// replaceFirstDC returns list reduced to its first element, which keeps
+// its id and attributes so that refinements stay attached, with value.
+func replaceFirstDC(list []DCMeta, value string) []DCMeta {
+	first := DCMeta{}
+	if len(list) > 0 {
+		first = list[0]
 	}
-	meta.Meta = append(meta.Meta, MetaNode{
-		Property: "dcterms:modified",
-		Value:    stamp,
-	})
+	first.Value = value
+	return []DCMeta{first}
+}
+
+func updateModifiedTimestamp(meta *Metadata) {
+	setModified(meta, time.Now())
 }
@@ -31,7 +31,7 @@ func TestEditEPUBMetadata(t *testing.T) {
 		TouchModified: false,
 	}
 
-	if err := EditEPUB(context.Background(), input, opts); err != nil {
+	if _, err := EditEPUB(context.Background(), input, opts); err != nil {
 		t.Fatalf("EditEPUB: %v", err)
 	}
 
@@ -64,6 +64,63 @@ func TestEditEPUBMetadata(t *testing.T) {
 	}
 }
 
+func TestEditEPUBAccessibility(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Title", "en")
+	defer os.Remove(input)
+
+	patch, err := AccessibilityPreset("text-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: patch}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	// A second edit replaces the features rather than adding to them.
+	features := []string{"tableOfContents", "pageNavigation"}
+	dump := filepath.Join(t.TempDir(), "meta.json")
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{AccessibilityFeatures: &features}}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	if _, err := EditEPUB(ctx, input, EditOptions{DumpMetaPath: dump}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"access_modes": [
+    "textual"
+  ]`,
+		`"accessibility_features": [
+    "tableOfContents",
+    "pageNavigation"
+  ]`,
+		`"accessibility_hazards": [
+    "none"
+  ]`,
+		`"accessibility_summary": "This publication is prose text`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("snapshot missing %s:\n%s", want, data)
+		}
+	}
+
+	bad := []string{"tableOfContent"}
+	_, err = EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{AccessibilityFeatures: &bad}})
+	if err == nil || !strings.Contains(err.Error(), `"tableOfContent"`) {
+		t.Fatalf("err = %v, want unknown value", err)
+	}
+	mixed := []string{"none", "flashing"}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{AccessibilityHazards: &mixed}}); err == nil {
+		t.Fatal("accepted none with another hazard")
+	}
+	if _, err := AccessibilityPreset("comics"); err == nil {
+		t.Fatal("accepted an unknown preset")
+	}
+}
+
 func TestEditEPUBReplaceNav(t *testing.T) {
 	input := buildTestEPUB(t, "Title", "en")
 	defer os.Remove(input)
@@ -80,7 +137,7 @@ func TestEditEPUBReplaceNav(t *testing.T) {
 		TouchModified:  false,
 	}
 
-	if err := EditEPUB(context.Background(), input, opts); err != nil {
+	if _, err := EditEPUB(context.Background(), input, opts); err != nil {
 		t.Fatalf("EditEPUB: %v", err)
 	}
 
@@ -166,3 +223,40 @@ func buildTestEPUB(t *testing.T, title, lang string) string {
 	}
 	return outFile
 }
+
+// buildEPUBFromFiles zips the given container-relative files into an EPUB.
+// A mimetype and META-INF/container.xml pointing at OEBPS/content.opf are
+// added unless files provides them.
+func buildEPUBFromFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	all := map[string]string{
+		"mimetype": "application/epub+zip",
+		"META-INF/container.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`,
+	}
+	for name, data := range files {
+		all[name] = data
+	}
+	for name, data := range all {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", name, err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	outFile := filepath.Join(t.TempDir(), "test.epub")
+	if err := writeZip(root, outFile); err != nil {
+		t.Fatalf("write zip: %v", err)
+	}
+	return outFile
+}
@@ -0,0 +1,264 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encodings decodeText recognises.
+const (
+	charsetUTF8        = "UTF-8"
+	charsetUTF16LE     = "UTF-16LE"
+	charsetUTF16BE     = "UTF-16BE"
+	charsetWindows1252 = "Windows-1252"
+	charsetShiftJIS    = "Shift_JIS"
+	charsetGBK         = "GBK"
+)
+
+// charsetLabels maps the labels books declare to the encodings above.
+// Supersets stand in for the standards they extend, as browsers do:
+// Windows-1252 for ISO-8859-1 and ASCII, Windows-31J for Shift_JIS and
+// GBK for GB2312.
+var charsetLabels = map[string]string{
+	"utf-8": charsetUTF8, "utf8": charsetUTF8,
+	"windows-1252": charsetWindows1252, "cp1252": charsetWindows1252,
+	"iso-8859-1": charsetWindows1252, "iso8859-1": charsetWindows1252,
+	"latin1": charsetWindows1252, "latin-1": charsetWindows1252,
+	"us-ascii": charsetWindows1252, "ascii": charsetWindows1252,
+	"shift_jis": charsetShiftJIS, "shift-jis": charsetShiftJIS,
+	"sjis": charsetShiftJIS, "x-sjis": charsetShiftJIS,
+	"windows-31j": charsetShiftJIS, "cp932": charsetShiftJIS,
+	"ms932": charsetShiftJIS, "ms_kanji": charsetShiftJIS,
+	"gbk": charsetGBK, "x-gbk": charsetGBK, "cp936": charsetGBK,
+	"ms936": charsetGBK, "gb2312": charsetGBK, "euc-cn": charsetGBK,
+	"gb18030": charsetGBK,
+}
+
+// TextDecoder converts text in a multi-byte legacy encoding, Shift_JIS or
+// GBK, to UTF-8.
+type TextDecoder func(ctx context.Context, data []byte, charset string) (string, error)
+
+// ExternalTextDecoder converts with the iconv command-line tool, which
+// must be on PATH; Go's standard library has no CJK encodings. It reads
+// Shift_JIS as Windows-31J and GBK as GB18030, the supersets books
+// actually use.
+func ExternalTextDecoder(ctx context.Context, data []byte, charset string) (string, error) {
+	from := map[string]string{charsetShiftJIS: "CP932", charsetGBK: "GB18030"}[charset]
+	if from == "" {
+		return "", fmt.Errorf("cannot convert %s", charset)
+	}
+	bin, err := exec.LookPath("iconv")
+	if err != nil {
+		return "", fmt.Errorf("iconv not found on PATH; install it to convert %s text", charset)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, "-f", from, "-t", "UTF-8")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("iconv: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// errUnknownCharset is returned for a declared encoding decodeText does
+// not know.
+var errUnknownCharset = errors.New("unknown encoding")
+
+// decodeText returns data as UTF-8. from names the encoding it was in,
+// and is empty when data is already UTF-8 without a byte order mark and
+// declared so. Undeclared text that is not UTF-8 is sniffed: Shift_JIS
+// and GBK by the structure of their two-byte characters, with lang (the
+// book's language) breaking ties, and anything else as Windows-1252.
+func decodeText(ctx context.Context, data []byte, lang string, dec TextDecoder) (text, from string, err error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}) && utf8.Valid(data[3:]):
+		return string(data[3:]), "UTF-8 with a byte order mark", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUTF16(data[2:], false), charsetUTF16LE, nil
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUTF16(data[2:], true), charsetUTF16BE, nil
+	}
+	declared := ""
+	for _, re := range []*regexp.Regexp{xmlDeclEncodingRE, metaCharsetRE, cssCharsetRE} {
+		if m := re.FindSubmatch(data); m != nil {
+			declared = string(m[2])
+			break
+		}
+	}
+	charset, known := charsetLabels[strings.ToLower(declared)]
+	switch {
+	case declared != "" && !known:
+		return "", declared, fmt.Errorf("%w %s", errUnknownCharset, declared)
+	case charset == "" || charset == charsetUTF8:
+		if utf8.Valid(data) {
+			return string(data), "", nil
+		}
+		charset = sniffCharset(data, lang)
+		declared = charset + " (undeclared)"
+	default:
+		declared = charset
+	}
+	switch charset {
+	case charsetWindows1252:
+		return decodeWindows1252(data), declared, nil
+	default:
+		if dec == nil {
+			dec = ExternalTextDecoder
+		}
+		text, err := dec(ctx, data, charset)
+		return text, declared, err
+	}
+}
+
+// sniffCharset guesses the encoding of text that is not UTF-8. Japanese
+// in Shift_JIS is mostly kana, whose two-byte codes have recognisable lead
+// bytes; Chinese in GBK is mostly characters whose both bytes are high.
+// Text in Windows-1252 has lone high bytes between ASCII letters, which
+// fit neither pattern.
+func sniffCharset(data []byte, lang string) string {
+	sjisOK, sjisPairs, sjisKana := scanShiftJIS(data)
+	gbkOK, gbkPairs, gbkHigh := scanGBK(data)
+	primary, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	switch {
+	case sjisOK && sjisPairs > 0 && primary == "ja":
+		return charsetShiftJIS
+	case gbkOK && gbkPairs > 0 && primary == "zh":
+		return charsetGBK
+	case sjisOK && sjisPairs > 0 && sjisKana*4 >= sjisPairs:
+		return charsetShiftJIS
+	case gbkOK && gbkPairs > 0 && gbkHigh*10 >= gbkPairs*9:
+		return charsetGBK
+	}
+	return charsetWindows1252
+}
+
+// scanShiftJIS reports whether data is valid Shift_JIS, how many two-byte
+// characters it has and how many of those are kana.
+func scanShiftJIS(data []byte) (ok bool, pairs, kana int) {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80 || c >= 0xA1 && c <= 0xDF:
+			// ASCII or half-width katakana.
+		case c >= 0x81 && c <= 0x9F || c >= 0xE0 && c <= 0xFC:
+			if i+1 >= len(data) {
+				return false, pairs, kana
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7F || t > 0xFC {
+				return false, pairs, kana
+			}
+			pairs++
+			if c == 0x82 && t >= 0x9F && t <= 0xF1 || c == 0x83 && t >= 0x40 && t <= 0x96 {
+				kana++
+			}
+			i++
+		default:
+			return false, pairs, kana
+		}
+	}
+	return true, pairs, kana
+}
+
+// scanGBK reports whether data is valid GBK, how many two-byte characters
+// it has and how many of those fall in the GB2312 range, where both bytes
+// are high.
+func scanGBK(data []byte) (ok bool, pairs, high int) {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+		case c >= 0x81 && c <= 0xFE:
+			if i+1 >= len(data) {
+				return false, pairs, high
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7F || t == 0xFF {
+				return false, pairs, high
+			}
+			pairs++
+			if c >= 0xA1 && t >= 0xA1 {
+				high++
+			}
+			i++
+		default:
+			return false, pairs, high
+		}
+	}
+	return true, pairs, high
+}
+
+// normalizeTextFile returns a text file as UTF-8 in NFC, with its
+// encoding declarations pointing at UTF-8. from is the encoding it was
+// in, or empty when it was UTF-8 already; nfc is set when normalization
+// changed the text. out is nil when nothing changed.
+func normalizeTextFile(ctx context.Context, data []byte, lang string, dec TextDecoder) (out []byte, from string, nfc bool, err error) {
+	text, from, err := decodeText(ctx, data, lang, dec)
+	if err != nil {
+		return nil, from, false, err
+	}
+	if from != "" {
+		text = declareUTF8(text)
+	}
+	normalized := normalizeNFC(text)
+	nfc = normalized != text
+	if from == "" && !nfc {
+		return nil, "", false, nil
+	}
+	return []byte(normalized), from, nfc, nil
+}
+
+// normalizeVolumeText converts every text file of vol to UTF-8 in NFC, so
+// that volumes in different encodings merge into one consistent book. A
+// file that cannot be converted is left as it is, with a warning.
+func normalizeVolumeText(ctx context.Context, vol *Volume, dec TextDecoder, log *slog.Logger) error {
+	lang := ""
+	if langs := vol.PackageDoc.Metadata.Languages; len(langs) > 0 {
+		lang = strings.TrimSpace(langs[0].Value)
+	}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !containsString(textMediaTypes, item.MediaType) {
+			continue
+		}
+		p := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		out, from, nfc, err := normalizeTextFile(ctx, data, lang, dec)
+		if err != nil {
+			log.Warn("cannot convert text to UTF-8", "volume", vol.SourcePath, "href", item.Href, "error", err)
+			continue
+		}
+		if out == nil {
+			continue
+		}
+		if err := os.WriteFile(p, out, 0o644); err != nil {
+			return err
+		}
+		if from != "" {
+			log.Info("converted text to UTF-8", "volume", vol.SourcePath, "href", item.Href, "from", from)
+		}
+		if nfc {
+			log.Info("normalized text to NFC", "volume", vol.SourcePath, "href", item.Href)
+		}
+	}
+	return nil
+}
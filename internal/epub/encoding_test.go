@@ -0,0 +1,126 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTextDecoder decodes the few Shift_JIS and GBK characters the tests
+// use, so they do not need iconv.
+func fakeTextDecoder(_ context.Context, data []byte, charset string) (string, error) {
+	table := map[string]map[string]string{
+		charsetShiftJIS: {"\x82\xa0": "あ", "\x82\xa9": "か", "\x83\x4a": "カ"},
+		charsetGBK:      {"\xc4\xe3": "你", "\xba\xc3": "好"},
+	}[charset]
+	if table == nil {
+		return "", errors.New("unsupported")
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] < 0x80 {
+			b.WriteByte(data[i])
+			continue
+		}
+		r, ok := table[string(data[i:i+2])]
+		if !ok {
+			return "", errors.New("unmapped")
+		}
+		b.WriteString(r)
+		i++
+	}
+	return b.String(), nil
+}
+
+func TestSniffCharset(t *testing.T) {
+	cases := []struct {
+		data, lang, want string
+	}{
+		{"<p>\x82\xa0\x82\xa9\x83\x4a</p>", "", charsetShiftJIS},
+		{"<p>\xc4\xe3\xba\xc3</p>", "", charsetGBK},
+		{"<p>\xc4\xe3\xba\xc3</p>", "ja", charsetShiftJIS},
+		{"<p>Caf\xe9 \x93quoted\x94</p>", "en", charsetWindows1252},
+	}
+	for _, c := range cases {
+		if got := sniffCharset([]byte(c.data), c.lang); got != c.want {
+			t.Errorf("sniffCharset(%q, %q) = %s, want %s", c.data, c.lang, got, c.want)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		data, text, from string
+	}{
+		{"<p>plain</p>", "<p>plain</p>", ""},
+		{"\xef\xbb\xbf<p>bom</p>", "<p>bom</p>", "UTF-8 with a byte order mark"},
+		{"\xff\xfe<\x00p\x00>\x00", "<p>", charsetUTF16LE},
+		{`<?xml version="1.0" encoding="Shift_JIS"?><p>` + "\x82\xa0</p>", `<?xml version="1.0" encoding="Shift_JIS"?><p>あ</p>`, charsetShiftJIS},
+		{`<meta charset="gb2312"/><p>` + "\xc4\xe3\xba\xc3</p>", `<meta charset="gb2312"/><p>你好</p>`, charsetGBK},
+		{"<p>\x82\xa9</p>", "<p>か</p>", "Shift_JIS (undeclared)"},
+	}
+	for _, c := range cases {
+		text, from, err := decodeText(ctx, []byte(c.data), "", fakeTextDecoder)
+		if err != nil || text != c.text || from != c.from {
+			t.Errorf("decodeText(%q) = %q, %q, %v; want %q, %q", c.data, text, from, err, c.text, c.from)
+		}
+	}
+	if _, _, err := decodeText(ctx, []byte(`<?xml version="1.0" encoding="KOI8-R"?>`), "", fakeTextDecoder); !errors.Is(err, errUnknownCharset) {
+		t.Fatalf("unknown charset error = %v", err)
+	}
+}
+
+func TestNormalizeNFC(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"plain ascii", "plain ascii"},
+		{"e\u0301", "\u00e9"},
+		{"\u304b\u3099", "\u304c"},
+		{"\u1100\u1161\u11a8", "\uac01"},
+		{"a\u0323\u0302", "\u1ead"},
+		{"a\u0302\u0323", "\u1ead"},
+		{"\u212b", "\u00c5"},
+		// CJK compatibility ideographs are kept.
+		{"\ufa19", "\ufa19"},
+	}
+	for _, c := range cases {
+		if got := normalizeNFC(c.in); got != c.want {
+			t.Errorf("normalizeNFC(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMergeConvertsMixedEncodings(t *testing.T) {
+	ctx := context.Background()
+	utf8Vol := buildTestEPUB(t, "One", "ja")
+	base := buildTestEPUB(t, "Two", "ja")
+	sjisVol := filepath.Join(t.TempDir(), "sjis.epub")
+	copyZip(t, base, sjisVol, map[string]string{
+		"OEBPS/chapter.xhtml": `<?xml version="1.0" encoding="Shift_JIS"?>` + "\n" +
+			`<html xmlns="http://www.w3.org/1999/xhtml"><head><meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS"/></head><body><p>` + "\x82\xa9\x83\x4a" + `</p></body></html>`,
+	})
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	if err := MergeEPUBs(ctx, []string{utf8Vol, sjisVol}, MergeOptions{OutPath: out, TextDecoder: fakeTextDecoder}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	hrefs := spineHrefs(vol.PackageDoc)
+	if len(hrefs) != 2 {
+		t.Fatalf("spine = %v", hrefs)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(hrefs[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	if !strings.Contains(got, "<p>かカ</p>") || !strings.Contains(got, `encoding="UTF-8"`) || !strings.Contains(got, "charset=UTF-8") || strings.Contains(got, "Shift_JIS") {
+		t.Fatalf("chapter = %s", got)
+	}
+}
@@ -0,0 +1,32 @@
+package epub
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// ErrInvalidEPUB is matched by errors for an input that is not a readable
+// EPUB: not a zip archive, or one without a usable container or package
+// document.
+var ErrInvalidEPUB = errors.New("not a valid EPUB")
+
+// ErrDRM is matched by errors for an input whose content is encrypted by a
+// DRM scheme.
+var ErrDRM = errors.New("book is DRM-protected")
+
+// invalidEPUBError marks err as caused by a broken input while keeping its
+// message.
+type invalidEPUBError struct{ err error }
+
+func (e invalidEPUBError) Error() string   { return e.err.Error() }
+func (e invalidEPUBError) Unwrap() []error { return []error{ErrInvalidEPUB, e.err} }
+
+// invalidEPUB marks err as caused by a broken input, unless it is a
+// filesystem error, such as a missing input or a full disk.
+func invalidEPUB(err error) error {
+	var pathErr *fs.PathError
+	if err == nil || errors.As(err, &pathErr) {
+		return err
+	}
+	return invalidEPUBError{err}
+}
@@ -0,0 +1,126 @@
+package epub
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractLimits bounds what loading a book may unpack, so that a hostile
+// archive cannot fill the disk. A zero field means no limit.
+type ExtractLimits struct {
+	// MaxSize caps the total uncompressed size of the entries.
+	MaxSize int64
+	// MaxFiles caps the number of entries.
+	MaxFiles int
+	// MaxRatio caps how many times larger than its compressed form an
+	// entry may be. Entries under ratioFloor are not held to it, since
+	// small repetitive files compress well.
+	MaxRatio int
+}
+
+// DefaultExtractLimits are far above what a real book needs: the largest
+// illustrated omnibus is a few hundred megabytes in a few thousand files,
+// and text compresses about five to one.
+var DefaultExtractLimits = ExtractLimits{MaxSize: 4 << 30, MaxFiles: 50000, MaxRatio: 200}
+
+// ratioFloor is the size under which an entry's compression ratio is not
+// checked.
+const ratioFloor = 1 << 20
+
+// errExtractLimit is matched by errors for an archive that exceeds the
+// extraction limits.
+var errExtractLimit = errors.New("archive exceeds the extraction limits")
+
+// limitError reports an archive over one of the limits.
+func limitError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errExtractLimit, fmt.Sprintf(format, args...))
+}
+
+// checkArchive checks the entries of an archive before anything is
+// extracted: their names must stay inside the destination, none may be a
+// symbolic link, and their declared sizes must fit the limits.
+func checkArchive(files []*zip.File, limits ExtractLimits) error {
+	if limits.MaxFiles > 0 && len(files) > limits.MaxFiles {
+		return limitError("%d entries, more than %d", len(files), limits.MaxFiles)
+	}
+	var total uint64
+	for _, f := range files {
+		if err := checkEntryName(f.Name); err != nil {
+			return err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("zip entry %s is a symbolic link", f.Name)
+		}
+		total += f.UncompressedSize64
+		if limits.MaxSize > 0 && total > uint64(limits.MaxSize) {
+			return limitError("more than %s uncompressed", FormatByteSize(limits.MaxSize))
+		}
+		if limits.MaxRatio > 0 && f.UncompressedSize64 >= ratioFloor &&
+			f.UncompressedSize64 > f.CompressedSize64*uint64(limits.MaxRatio) {
+			return limitError("zip entry %s expands %d times, more than %d", f.Name, f.UncompressedSize64/max(f.CompressedSize64, 1), limits.MaxRatio)
+		}
+	}
+	return nil
+}
+
+// checkEntryName rejects entry names that are absolute or climb out of the
+// destination with "..", in either slash direction.
+func checkEntryName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || len(name) >= 2 && name[1] == ':' {
+		return fmt.Errorf("zip entry %q has an absolute path", name)
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("zip entry %q escapes the archive", name)
+		}
+	}
+	return nil
+}
+
+// insideDir reports whether target, a path joined onto dir, stays inside
+// dir.
+func insideDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkManifestHrefs rejects a package whose manifest names files outside
+// root, the directory the book was extracted to. Commands read and write
+// items through their hrefs, so an href climbing out with "..", whether
+// written plainly, with backslashes or percent-encoded, would let a book
+// overwrite files on the host.
+func checkManifestHrefs(root, pkgDir string, items []ManifestItem) error {
+	for _, item := range items {
+		forms := []string{item.Href, normalizeEPUBPath(item.Href)}
+		if name, err := url.PathUnescape(item.Href); err == nil {
+			forms = append(forms, name, normalizeEPUBPath(name))
+		}
+		for _, href := range forms {
+			if !insideDir(root, filepath.Join(pkgDir, filepath.FromSlash(href))) {
+				return fmt.Errorf("manifest item %q: href %q points outside the book", item.ID, item.Href)
+			}
+		}
+	}
+	return nil
+}
+
+// limitedWriter fails once more than its budget has been written, which
+// catches entries whose headers understate their size.
+type limitedWriter struct {
+	w      io.Writer
+	budget int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.budget {
+		return 0, limitError("more uncompressed data than the archive declares or the limit allows")
+	}
+	l.budget -= int64(len(p))
+	return l.w.Write(p)
+}
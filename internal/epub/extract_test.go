@@ -0,0 +1,143 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type zipEntry struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+func openRawZip(t *testing.T, entries ...zipEntry) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.mode != 0 {
+			h.SetMode(e.mode)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestUnzipRejectsHostileArchives(t *testing.T) {
+	mimetype := zipEntry{name: "mimetype", data: []byte("application/epub+zip")}
+	many := []zipEntry{mimetype}
+	for i := 0; i < 5; i++ {
+		many = append(many, zipEntry{name: strings.Repeat("a", i+1) + ".xhtml", data: []byte("x")})
+	}
+	for _, tc := range []struct {
+		name    string
+		entries []zipEntry
+		limits  ExtractLimits
+		want    string
+	}{
+		{"dotdot", []zipEntry{mimetype, {name: "OEBPS/../../evil.txt", data: []byte("x")}}, DefaultExtractLimits, "escapes the archive"},
+		{"backslash", []zipEntry{mimetype, {name: `OEBPS\..\..\evil.txt`, data: []byte("x")}}, DefaultExtractLimits, "escapes the archive"},
+		{"absolute", []zipEntry{mimetype, {name: "/tmp/evil.txt", data: []byte("x")}}, DefaultExtractLimits, "absolute path"},
+		{"drive", []zipEntry{mimetype, {name: "C:/evil.txt", data: []byte("x")}}, DefaultExtractLimits, "absolute path"},
+		{"symlink", []zipEntry{mimetype, {name: "OEBPS/link", data: []byte("/etc/passwd"), mode: os.ModeSymlink | 0o777}}, DefaultExtractLimits, "symbolic link"},
+		{"files", many, ExtractLimits{MaxFiles: 5}, "6 entries, more than 5"},
+		{"size", []zipEntry{mimetype, {name: "big.bin", data: make([]byte, 4096)}}, ExtractLimits{MaxSize: 1024}, "more than 1.0KB uncompressed"},
+		{"ratio", []zipEntry{mimetype, {name: "bomb.bin", data: make([]byte, 2<<20)}}, DefaultExtractLimits, "expands"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := WithEnv(context.Background(), Env{Limits: &tc.limits})
+			dst := t.TempDir()
+			_, err := unzip(ctx, openRawZip(t, tc.entries...), dst)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want %q", err, tc.want)
+			}
+			if names, _ := os.ReadDir(dst); len(names) > 0 {
+				t.Fatalf("extracted %d entries before refusing", len(names))
+			}
+		})
+	}
+}
+
+func TestUnzipLimitsOff(t *testing.T) {
+	ctx := WithEnv(context.Background(), Env{Limits: &ExtractLimits{}})
+	src := openRawZip(t, zipEntry{name: "mimetype", data: []byte("application/epub+zip")}, zipEntry{name: "bomb.bin", data: make([]byte, 2<<20)})
+	if _, err := unzip(ctx, src, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &limitedWriter{w: &buf, budget: 4}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("de")); !errors.Is(err, errExtractLimit) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLoadVolumeRejectsEscapingHrefs(t *testing.T) {
+	victim := filepath.Join(t.TempDir(), "victim.xhtml")
+	if err := os.WriteFile(victim, []byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body><p>oldname</p></body></html>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	climb := strings.Repeat("../", 32) + strings.TrimPrefix(filepath.ToSlash(victim), "/")
+	opf := func(href string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:escape</dc:identifier>
+    <dc:title>Escape</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="` + href + `" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`
+	}
+	ctx := context.Background()
+	for _, href := range []string{climb, strings.ReplaceAll(climb, "../", `..\`), strings.ReplaceAll(climb, "../", "%2e%2e/")} {
+		input := buildEPUBFromFiles(t, map[string]string{"OEBPS/content.opf": opf(href)})
+		out := filepath.Join(t.TempDir(), "out.epub")
+		_, err := RewriteEPUB(ctx, input, RewriteOptions{Rules: []RewriteRule{{Find: "oldname", Replace: "PWNED"}}, OutPath: out})
+		if !errors.Is(err, ErrInvalidEPUB) || !strings.Contains(err.Error(), "outside the book") {
+			t.Fatalf("href %q: err = %v", href, err)
+		}
+		if data, _ := os.ReadFile(victim); strings.Contains(string(data), "PWNED") {
+			t.Fatalf("href %q overwrote a file outside the book", href)
+		}
+	}
+
+	input := buildEPUBFromFiles(t, map[string]string{
+		"META-INF/container.xml": `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="` + climb + `" media-type="application/oebps-package+xml"/></rootfiles></container>`,
+	})
+	if _, err := loadVolume(ctx, 0, input); !errors.Is(err, ErrInvalidEPUB) || !strings.Contains(err.Error(), "outside the book") {
+		t.Fatalf("escaping rootfile: err = %v", err)
+	}
+}
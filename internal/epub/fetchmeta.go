@@ -0,0 +1,345 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MetadataQuery is what a MetadataProvider searches for. An ISBN takes
+// precedence over the title and author.
+type MetadataQuery struct {
+	ISBN   string
+	Title  string
+	Author string
+}
+
+func (q MetadataQuery) IsZero() bool {
+	return q.ISBN == "" && q.Title == "" && q.Author == ""
+}
+
+// MetadataCandidate is one record returned by a provider.
+type MetadataCandidate struct {
+	Provider    string   `json:"provider"`
+	ID          string   `json:"id,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Authors     []string `json:"authors,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Published   string   `json:"published,omitempty"`
+	ISBN        string   `json:"isbn,omitempty"`
+}
+
+// Patch turns the candidate into a MetadataPatch for EditEPUB. Only the
+// fields the candidate has are set; the book's identifier is left alone.
+func (c MetadataCandidate) Patch() MetadataPatch {
+	var p MetadataPatch
+	if c.Title != "" {
+		p.Title = &c.Title
+	}
+	if c.Language != "" {
+		p.Language = &c.Language
+	}
+	if c.Description != "" {
+		p.Description = &c.Description
+	}
+	if len(c.Authors) > 0 {
+		authors := append([]string(nil), c.Authors...)
+		p.Creators = &authors
+	}
+	return p
+}
+
+// MetadataProvider looks books up in an online catalogue.
+type MetadataProvider interface {
+	Name() string
+	Search(ctx context.Context, q MetadataQuery) ([]MetadataCandidate, error)
+}
+
+// DefaultMetadataProviders returns the built-in providers in the order
+// their results are listed.
+func DefaultMetadataProviders() []MetadataProvider {
+	return []MetadataProvider{&OpenLibraryProvider{}, &GoogleBooksProvider{}}
+}
+
+// MetadataProviderByName returns a built-in provider: "openlibrary" or
+// "google".
+func MetadataProviderByName(name string) (MetadataProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "openlibrary", "open-library", "ol":
+		return &OpenLibraryProvider{}, nil
+	case "google", "googlebooks", "google-books":
+		return &GoogleBooksProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q (want openlibrary or google)", name)
+}
+
+// SearchMetadata asks every provider and concatenates their candidates.
+// A provider that fails is skipped unless all of them fail.
+func SearchMetadata(ctx context.Context, providers []MetadataProvider, q MetadataQuery) ([]MetadataCandidate, error) {
+	if q.IsZero() {
+		return nil, fmt.Errorf("metadata query needs an ISBN, a title or an author")
+	}
+	if len(providers) == 0 {
+		providers = DefaultMetadataProviders()
+	}
+	var (
+		out  []MetadataCandidate
+		errs []error
+	)
+	for _, p := range providers {
+		found, err := p.Search(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		out = append(out, found...)
+	}
+	if len(errs) == len(providers) {
+		return nil, errors.Join(errs...)
+	}
+	return out, nil
+}
+
+// MetadataQueryFromBook builds a query from the book's own metadata: its
+// ISBN if an identifier looks like one, else its title and first creator.
+func MetadataQueryFromBook(ctx context.Context, input string) (MetadataQuery, error) {
+	var q MetadataQuery
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return q, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	for _, id := range meta.Identifiers {
+		if isbn := normalizeISBN(id.Value); isbn != "" {
+			q.ISBN = isbn
+			return q, nil
+		}
+	}
+	q.Title = normalizeSpace(firstDCValue(meta.Titles))
+	q.Author = normalizeSpace(firstDCValue(meta.Creators))
+	return q, nil
+}
+
+// normalizeISBN strips a urn:isbn: prefix, hyphens and spaces and returns
+// the result if it has the shape of an ISBN-10 or ISBN-13, else "".
+func normalizeISBN(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 9 && strings.EqualFold(s[:9], "urn:isbn:") {
+		s = s[9:]
+	}
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	if len(s) != 10 && len(s) != 13 {
+		return ""
+	}
+	for i, r := range s {
+		if r >= '0' && r <= '9' || (r == 'X' || r == 'x') && i == 9 && len(s) == 10 {
+			continue
+		}
+		return ""
+	}
+	return strings.ToUpper(s)
+}
+
+var defaultMetadataClient = &http.Client{Timeout: 20 * time.Second}
+
+func getJSON(ctx context.Context, client *http.Client, u string, v any) error {
+	if client == nil {
+		client = defaultMetadataClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "novfmt (https://github.com/kototok903/novfmt)")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(v)
+}
+
+// OpenLibraryProvider searches openlibrary.org.
+type OpenLibraryProvider struct {
+	// BaseURL defaults to https://openlibrary.org.
+	BaseURL string
+	Client  *http.Client
+	// Limit caps the number of candidates (default 5).
+	Limit int
+}
+
+func (p *OpenLibraryProvider) Name() string { return "openlibrary" }
+
+func (p *OpenLibraryProvider) Search(ctx context.Context, q MetadataQuery) ([]MetadataCandidate, error) {
+	base := strings.TrimRight(p.BaseURL, "/")
+	if base == "" {
+		base = "https://openlibrary.org"
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = 5
+	}
+	params := url.Values{}
+	if q.ISBN != "" {
+		params.Set("isbn", q.ISBN)
+	} else {
+		if q.Title != "" {
+			params.Set("title", q.Title)
+		}
+		if q.Author != "" {
+			params.Set("author", q.Author)
+		}
+	}
+	params.Set("limit", fmt.Sprint(limit))
+	params.Set("fields", "key,title,subtitle,author_name,language,publisher,first_publish_year,isbn")
+
+	var resp struct {
+		Docs []struct {
+			Key       string   `json:"key"`
+			Title     string   `json:"title"`
+			Subtitle  string   `json:"subtitle"`
+			Authors   []string `json:"author_name"`
+			Languages []string `json:"language"`
+			Publisher []string `json:"publisher"`
+			Year      int      `json:"first_publish_year"`
+			ISBN      []string `json:"isbn"`
+		} `json:"docs"`
+	}
+	if err := getJSON(ctx, p.Client, base+"/search.json?"+params.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	var out []MetadataCandidate
+	for _, d := range resp.Docs {
+		c := MetadataCandidate{
+			Provider: p.Name(),
+			ID:       d.Key,
+			Title:    joinSubtitle(d.Title, d.Subtitle),
+			Authors:  d.Authors,
+		}
+		if len(d.Languages) == 1 {
+			c.Language = languageTag(d.Languages[0])
+		}
+		if len(d.Publisher) > 0 {
+			c.Publisher = d.Publisher[0]
+		}
+		if d.Year > 0 {
+			c.Published = fmt.Sprint(d.Year)
+		}
+		c.ISBN = q.ISBN
+		if c.ISBN == "" && len(d.ISBN) > 0 {
+			c.ISBN = normalizeISBN(d.ISBN[0])
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// GoogleBooksProvider searches the Google Books API. It works without an
+// API key within Google's anonymous quota.
+type GoogleBooksProvider struct {
+	// BaseURL defaults to https://www.googleapis.com/books/v1.
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+	// Limit caps the number of candidates (default 5).
+	Limit int
+}
+
+func (p *GoogleBooksProvider) Name() string { return "google" }
+
+func (p *GoogleBooksProvider) Search(ctx context.Context, q MetadataQuery) ([]MetadataCandidate, error) {
+	base := strings.TrimRight(p.BaseURL, "/")
+	if base == "" {
+		base = "https://www.googleapis.com/books/v1"
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = 5
+	}
+	var terms []string
+	if q.ISBN != "" {
+		terms = append(terms, "isbn:"+q.ISBN)
+	} else {
+		if q.Title != "" {
+			terms = append(terms, "intitle:"+q.Title)
+		}
+		if q.Author != "" {
+			terms = append(terms, "inauthor:"+q.Author)
+		}
+	}
+	params := url.Values{}
+	params.Set("q", strings.Join(terms, " "))
+	params.Set("maxResults", fmt.Sprint(limit))
+	if p.APIKey != "" {
+		params.Set("key", p.APIKey)
+	}
+
+	var resp struct {
+		Items []struct {
+			ID   string `json:"id"`
+			Info struct {
+				Title       string   `json:"title"`
+				Subtitle    string   `json:"subtitle"`
+				Authors     []string `json:"authors"`
+				Publisher   string   `json:"publisher"`
+				Published   string   `json:"publishedDate"`
+				Description string   `json:"description"`
+				Language    string   `json:"language"`
+				Identifiers []struct {
+					Type       string `json:"type"`
+					Identifier string `json:"identifier"`
+				} `json:"industryIdentifiers"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, p.Client, base+"/volumes?"+params.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	var out []MetadataCandidate
+	for _, item := range resp.Items {
+		info := item.Info
+		c := MetadataCandidate{
+			Provider:    p.Name(),
+			ID:          item.ID,
+			Title:       joinSubtitle(info.Title, info.Subtitle),
+			Authors:     info.Authors,
+			Language:    info.Language,
+			Description: strings.TrimSpace(info.Description),
+			Publisher:   info.Publisher,
+			Published:   info.Published,
+		}
+		for _, id := range info.Identifiers {
+			if id.Type == "ISBN_13" || (id.Type == "ISBN_10" && c.ISBN == "") {
+				c.ISBN = normalizeISBN(id.Identifier)
+			}
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func joinSubtitle(title, subtitle string) string {
+	title, subtitle = normalizeSpace(title), normalizeSpace(subtitle)
+	if subtitle == "" {
+		return title
+	}
+	return title + ": " + subtitle
+}
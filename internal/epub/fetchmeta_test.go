@@ -0,0 +1,85 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSearchMetadata(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Path+"?"+r.URL.RawQuery)
+		switch r.URL.Path {
+		case "/ol/search.json":
+			fmt.Fprint(w, `{"docs":[{"key":"/works/OL1W","title":"Saga","subtitle":"Volume 1","author_name":["Jane Doe"],"language":["jpn"],"publisher":["Pub"],"first_publish_year":2019}]}`)
+		case "/gb/volumes":
+			fmt.Fprint(w, `{"items":[{"id":"abc","volumeInfo":{"title":"Saga","authors":["Jane Doe","Artist"],"description":" Blurb. ","language":"ja","publishedDate":"2019-03-25","industryIdentifiers":[{"type":"ISBN_10","identifier":"1975300319"},{"type":"ISBN_13","identifier":"978-1975300319"}]}}]}`)
+		default:
+			http.Error(w, "nope", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ol := &OpenLibraryProvider{BaseURL: srv.URL + "/ol"}
+	gb := &GoogleBooksProvider{BaseURL: srv.URL + "/gb"}
+	ctx := context.Background()
+	got, err := SearchMetadata(ctx, []MetadataProvider{ol, gb}, MetadataQuery{ISBN: "9781975300319"})
+	if err != nil {
+		t.Fatalf("SearchMetadata: %v", err)
+	}
+	want := []MetadataCandidate{
+		{Provider: "openlibrary", ID: "/works/OL1W", Title: "Saga: Volume 1", Authors: []string{"Jane Doe"}, Language: "ja", Publisher: "Pub", Published: "2019", ISBN: "9781975300319"},
+		{Provider: "google", ID: "abc", Title: "Saga", Authors: []string{"Jane Doe", "Artist"}, Language: "ja", Description: "Blurb.", Published: "2019-03-25", ISBN: "9781975300319"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %+v", got)
+	}
+	if queries[0] != "/ol/search.json?fields=key%2Ctitle%2Csubtitle%2Cauthor_name%2Clanguage%2Cpublisher%2Cfirst_publish_year%2Cisbn&isbn=9781975300319&limit=5" ||
+		queries[1] != "/gb/volumes?maxResults=5&q=isbn%3A9781975300319" {
+		t.Fatalf("queries = %q", queries)
+	}
+
+	// One failing provider is tolerated; all failing is not.
+	broken := &OpenLibraryProvider{BaseURL: srv.URL + "/missing"}
+	if got, err := SearchMetadata(ctx, []MetadataProvider{broken, gb}, MetadataQuery{Title: "Saga"}); err != nil || len(got) != 1 {
+		t.Fatalf("partial failure = %v, %v", got, err)
+	}
+	if _, err := SearchMetadata(ctx, []MetadataProvider{broken}, MetadataQuery{Title: "Saga"}); err == nil {
+		t.Fatalf("expected error when every provider fails")
+	}
+
+	// The chosen record goes through EditEPUB as a MetadataPatch.
+	input := buildTestEPUB(t, "Old", "en")
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: got[1].Patch()}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	if firstDCValue(meta.Titles) != "Saga" || firstDCValue(meta.Languages) != "ja" ||
+		firstDCValue(meta.Descriptions) != "Blurb." || len(meta.Creators) != 2 {
+		t.Fatalf("metadata = %+v", meta)
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	for in, want := range map[string]string{
+		"urn:isbn:978-1-975300-31-9": "9781975300319",
+		"0-306-40615-x":              "030640615X",
+		"urn:uuid:1234":              "",
+		"12345678901":                "",
+		"X123456789":                 "",
+	} {
+		if got := normalizeISBN(in); got != want {
+			t.Errorf("normalizeISBN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
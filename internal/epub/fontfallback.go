@@ -0,0 +1,202 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	fontFaceBlockPattern = regexp.MustCompile(`(?is)@font-face\s*\{[^}]*\}`)
+	fontFamilyPattern    = regexp.MustCompile(`(?i)(font-family\s*:\s*)([^;}]+)`)
+)
+
+var genericFamilies = map[string]bool{
+	"serif": true, "sans-serif": true, "monospace": true, "cursive": true,
+	"fantasy": true, "system-ui": true, "ui-serif": true, "ui-sans-serif": true,
+	"ui-monospace": true, "ui-rounded": true, "math": true, "emoji": true,
+	"fangsong": true,
+}
+
+// fallbackChain returns the families appended after an embedded font. The
+// chain ends in a generic family so readers without the font degrade to
+// something of the same style.
+func fallbackChain(family, lang string) []string {
+	sans := looksSans(family)
+	lang = strings.ToLower(lang)
+	switch {
+	case strings.HasPrefix(lang, "ja"):
+		if sans {
+			return []string{`"Hiragino Sans"`, `"Yu Gothic"`, `"Noto Sans CJK JP"`, "sans-serif"}
+		}
+		return []string{`"Hiragino Mincho ProN"`, `"Yu Mincho"`, `"Noto Serif CJK JP"`, "serif"}
+	case strings.HasPrefix(lang, "zh"):
+		if sans {
+			return []string{`"PingFang SC"`, `"Microsoft YaHei"`, `"Noto Sans CJK SC"`, "sans-serif"}
+		}
+		return []string{`"Songti SC"`, `"SimSun"`, `"Noto Serif CJK SC"`, "serif"}
+	case strings.HasPrefix(lang, "ko"):
+		if sans {
+			return []string{`"Apple SD Gothic Neo"`, `"Malgun Gothic"`, `"Noto Sans CJK KR"`, "sans-serif"}
+		}
+		return []string{`"AppleMyungjo"`, `"Batang"`, `"Noto Serif CJK KR"`, "serif"}
+	}
+	if sans {
+		return []string{"sans-serif"}
+	}
+	return []string{"serif"}
+}
+
+func looksSans(family string) bool {
+	f := strings.ToLower(family)
+	for _, hint := range []string{"sans", "gothic", "goth", "hei", "kaku", "grotesk", "arial", "helvetica"} {
+		if strings.Contains(f, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedFamilies returns the family names declared by @font-face rules.
+func embeddedFamilies(css string) []string {
+	var out []string
+	for _, block := range fontFaceBlockPattern.FindAllString(css, -1) {
+		m := fontFamilyPattern.FindStringSubmatch(block)
+		if m == nil {
+			continue
+		}
+		if name := unquoteFamily(m[2]); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func unquoteFamily(s string) string {
+	return strings.Trim(strings.TrimSpace(s), `"'`)
+}
+
+// injectFontFallbacks appends a fallback chain to every font-family
+// declaration (outside @font-face) that names one of the embedded families
+// and has no generic family yet. It reports whether css changed.
+func injectFontFallbacks(css string, embedded map[string]bool, lang string) (string, bool) {
+	faces := fontFaceBlockPattern.FindAllStringIndex(css, -1)
+	inFace := func(pos int) bool {
+		for _, f := range faces {
+			if pos >= f[0] && pos < f[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var b strings.Builder
+	changed := false
+	last := 0
+	for _, m := range fontFamilyPattern.FindAllStringSubmatchIndex(css, -1) {
+		if inFace(m[0]) {
+			continue
+		}
+		value := css[m[4]:m[5]]
+		updated, ok := extendFamilyList(value, embedded, lang)
+		if !ok {
+			continue
+		}
+		b.WriteString(css[last:m[4]])
+		b.WriteString(updated)
+		last = m[5]
+		changed = true
+	}
+	if !changed {
+		return css, false
+	}
+	b.WriteString(css[last:])
+	return b.String(), true
+}
+
+func extendFamilyList(value string, embedded map[string]bool, lang string) (string, bool) {
+	important := ""
+	trimmed := strings.TrimRight(value, " \t\r\n")
+	trailing := value[len(trimmed):]
+	if idx := strings.Index(strings.ToLower(trimmed), "!important"); idx >= 0 {
+		important = " " + strings.TrimSpace(trimmed[idx:])
+		trimmed = strings.TrimRight(trimmed[:idx], " \t")
+	}
+
+	var (
+		families []string
+		first    string
+	)
+	for _, part := range strings.Split(trimmed, ",") {
+		name := unquoteFamily(part)
+		if name == "" {
+			continue
+		}
+		if genericFamilies[strings.ToLower(name)] {
+			return value, false
+		}
+		if first == "" && embedded[name] {
+			first = name
+		}
+		families = append(families, strings.TrimSpace(part))
+	}
+	if first == "" {
+		return value, false
+	}
+
+	seen := map[string]bool{}
+	for _, f := range families {
+		seen[strings.ToLower(unquoteFamily(f))] = true
+	}
+	for _, f := range fallbackChain(first, lang) {
+		if !seen[strings.ToLower(unquoteFamily(f))] {
+			families = append(families, f)
+		}
+	}
+	return strings.Join(families, ", ") + important + trailing, true
+}
+
+// injectVolumeFontFallbacks rewrites every stylesheet in vol and returns the
+// hrefs that changed.
+func injectVolumeFontFallbacks(vol *Volume) ([]string, error) {
+	type sheet struct {
+		href string
+		path string
+		css  string
+	}
+	var sheets []sheet
+	embedded := map[string]bool{}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.MediaType != "text/css" {
+			continue
+		}
+		p := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		css := string(data)
+		for _, name := range embeddedFamilies(css) {
+			embedded[name] = true
+		}
+		sheets = append(sheets, sheet{href: item.Href, path: p, css: css})
+	}
+	if len(embedded) == 0 {
+		return nil, nil
+	}
+
+	lang := firstDCValue(vol.PackageDoc.Metadata.Languages)
+	var changed []string
+	for _, s := range sheets {
+		updated, ok := injectFontFallbacks(s.css, embedded, lang)
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(s.path, []byte(updated), 0o644); err != nil {
+			return nil, err
+		}
+		changed = append(changed, s.href)
+	}
+	return changed, nil
+}
@@ -0,0 +1,53 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInjectFontFallbacks(t *testing.T) {
+	css := `@font-face { font-family: "Book Mincho"; src: url(../Fonts/m.ttf); }
+@font-face { font-family: 'Book Gothic'; src: url(../Fonts/g.ttf); }
+body { font-family: "Book Mincho"; }
+h1 { font-family: 'Book Gothic' !important; }
+.note { font-family: "Book Mincho", serif; }
+.other { font-family: Arial; }
+`
+	embedded := map[string]bool{}
+	for _, name := range embeddedFamilies(css) {
+		embedded[name] = true
+	}
+	if !embedded["Book Mincho"] || !embedded["Book Gothic"] {
+		t.Fatalf("unexpected embedded families %v", embedded)
+	}
+
+	out, changed := injectFontFallbacks(css, embedded, "ja")
+	if !changed {
+		t.Fatalf("expected changes")
+	}
+	for _, want := range []string{
+		`body { font-family: "Book Mincho", "Hiragino Mincho ProN", "Yu Mincho", "Noto Serif CJK JP", serif; }`,
+		`h1 { font-family: 'Book Gothic', "Hiragino Sans", "Yu Gothic", "Noto Sans CJK JP", sans-serif !important; }`,
+		`.note { font-family: "Book Mincho", serif; }`,
+		`.other { font-family: Arial; }`,
+		`@font-face { font-family: "Book Mincho"; src: url(../Fonts/m.ttf); }`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	again, changed := injectFontFallbacks(out, embedded, "ja")
+	if changed || again != out {
+		t.Fatalf("injection should be idempotent")
+	}
+}
+
+func TestFallbackChainLatin(t *testing.T) {
+	if got := fallbackChain("Source Sans", "en"); len(got) != 1 || got[0] != "sans-serif" {
+		t.Fatalf("chain = %v", got)
+	}
+	if got := fallbackChain("Garamond", "en-US"); len(got) != 1 || got[0] != "serif" {
+		t.Fatalf("chain = %v", got)
+	}
+}
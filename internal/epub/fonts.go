@@ -0,0 +1,525 @@
+package epub
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const algIDPFObfuscation = "http://www.idpf.org/2008/embedding"
+
+type FontOptions struct {
+	// InjectFallback appends fallback font-family chains to rules that use
+	// embedded fonts and writes the book to OutPath (the input when empty).
+	InjectFallback bool
+	OutPath        string
+	Logger         *slog.Logger
+}
+
+type FontInfo struct {
+	Href   string `json:"href"`
+	Glyphs int    `json:"glyphs"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ChapterCoverage struct {
+	Href    string `json:"href"`
+	Missing string `json:"missing"`
+}
+
+type FontReport struct {
+	Fonts       []FontInfo        `json:"fonts"`
+	Chapters    []ChapterCoverage `json:"chapters,omitempty"`
+	FallbackCSS []string          `json:"fallback_css,omitempty"`
+	Changeset   Changeset         `json:"changeset"`
+}
+
+// AnalyzeFonts compares the characters used in each spine document against
+// the combined cmap coverage of the book's embedded fonts. Chapters listed in
+// the report use characters that no embedded font can render.
+func AnalyzeFonts(ctx context.Context, input string, opts FontOptions) (FontReport, error) {
+	var report FontReport
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	cov, fonts, err := loadFontCoverage(vol, log)
+	if err != nil {
+		return report, err
+	}
+	report.Fonts = fonts
+
+	for _, href := range spineHrefs(vol.PackageDoc) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if len(cov) == 0 {
+			break
+		}
+		used, err := collectTextRunes(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		var missing []rune
+		for _, r := range used {
+			if !cov.contains(r) {
+				missing = append(missing, r)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		log.Debug("uncovered characters", "href", href, "count", len(missing))
+		report.Chapters = append(report.Chapters, ChapterCoverage{
+			Href:    href,
+			Missing: string(missing),
+		})
+	}
+
+	if opts.InjectFallback {
+		changed, err := injectVolumeFontFallbacks(vol)
+		if err != nil {
+			return report, err
+		}
+		report.FallbackCSS = changed
+		for _, href := range changed {
+			report.Changeset.modified(href)
+		}
+	}
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, false, nil, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// loadFontCoverage merges the cmap coverage of every font in the manifest.
+// Fonts that cannot be decoded are reported with an error and skipped.
+func loadFontCoverage(vol *Volume, log *slog.Logger) (runeRanges, []FontInfo, error) {
+	obfuscated, err := readObfuscatedPaths(vol)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := obfuscationKey(vol.PackageDoc)
+
+	var (
+		all   runeRanges
+		infos []FontInfo
+	)
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if !isFontItem(item) {
+			continue
+		}
+		info := FontInfo{Href: item.Href}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		rel := normalizeEPUBPath(path.Join(path.Dir(filepath.ToSlash(vol.packageRel())), item.Href))
+		if obfuscated[rel] {
+			deobfuscateIDPF(data, key)
+		}
+		cov, err := parseFontCoverage(data)
+		if err != nil {
+			log.Warn("cannot read font", "href", item.Href, "err", err)
+			info.Error = err.Error()
+		} else {
+			info.Glyphs = cov.size()
+			all = append(all, cov...)
+		}
+		infos = append(infos, info)
+	}
+	return all.normalize(), infos, nil
+}
+
+func isFontItem(item ManifestItem) bool {
+	switch strings.ToLower(item.MediaType) {
+	case "font/ttf", "font/otf", "font/woff", "font/sfnt", "application/font-sfnt",
+		"application/font-woff", "application/vnd.ms-opentype", "application/x-font-ttf",
+		"application/x-font-otf", "application/x-font-truetype", "application/x-font-opentype":
+		return true
+	}
+	switch strings.ToLower(path.Ext(item.Href)) {
+	case ".ttf", ".otf", ".woff", ".ttc":
+		return true
+	}
+	return false
+}
+
+func spineHrefs(pkg *PackageDocument) []string {
+	byID := make(map[string]string, len(pkg.Manifest.Items))
+	for _, item := range pkg.Manifest.Items {
+		byID[item.ID] = item.Href
+	}
+	out := make([]string, 0, len(pkg.Spine.Itemrefs))
+	for _, ref := range pkg.Spine.Itemrefs {
+		if href, ok := byID[ref.IDRef]; ok {
+			out = append(out, href)
+		}
+	}
+	return out
+}
+
+// collectTextRunes returns the distinct non-space runes of the document body
+// in first-seen order.
+func collectTextRunes(path string) ([]rune, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+
+	seen := map[rune]struct{}{}
+	var out []rune
+	inBody := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "body" {
+				inBody = true
+			}
+		case xml.EndElement:
+			if t.Name.Local == "body" {
+				inBody = false
+			}
+		case xml.CharData:
+			if !inBody {
+				continue
+			}
+			for _, r := range string(t) {
+				if unicode.IsSpace(r) || unicode.IsControl(r) {
+					continue
+				}
+				if _, ok := seen[r]; ok {
+					continue
+				}
+				seen[r] = struct{}{}
+				out = append(out, r)
+			}
+		}
+	}
+	return out, nil
+}
+
+type encryptionDoc struct {
+	Data []struct {
+		Method struct {
+			Algorithm string `xml:"Algorithm,attr"`
+		} `xml:"EncryptionMethod"`
+		Reference struct {
+			URI string `xml:"URI,attr"`
+		} `xml:"CipherData>CipherReference"`
+	} `xml:"EncryptedData"`
+}
+
+// readObfuscatedPaths lists container paths that META-INF/encryption.xml
+// marks as obfuscated with the IDPF font algorithm.
+func readObfuscatedPaths(vol *Volume) (map[string]bool, error) {
+	out := map[string]bool{}
+	data, err := os.ReadFile(filepath.Join(vol.RootDir, "META-INF", "encryption.xml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	var doc encryptionDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse encryption.xml: %w", err)
+	}
+	for _, d := range doc.Data {
+		if d.Method.Algorithm == algIDPFObfuscation {
+			out[normalizeEPUBPath(d.Reference.URI)] = true
+		}
+	}
+	return out, nil
+}
+
+func obfuscationKey(pkg *PackageDocument) [sha1.Size]byte {
+	id := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, primaryIdentifier(pkg))
+	return sha1.Sum([]byte(id))
+}
+
+// deobfuscateIDPF reverses the IDPF font obfuscation in place. The algorithm
+// is a XOR over the first 1040 bytes, so applying it twice is a no-op.
+func deobfuscateIDPF(data []byte, key [sha1.Size]byte) {
+	for i := 0; i < len(data) && i < 1040; i++ {
+		data[i] ^= key[i%len(key)]
+	}
+}
+
+type runeRange struct {
+	lo, hi rune
+}
+
+type runeRanges []runeRange
+
+func (rs runeRanges) normalize() runeRanges {
+	if len(rs) == 0 {
+		return rs
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].lo < rs[j].lo })
+	out := rs[:1]
+	for _, r := range rs[1:] {
+		last := &out[len(out)-1]
+		if r.lo <= last.hi+1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (rs runeRanges) contains(r rune) bool {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].hi >= r })
+	return i < len(rs) && rs[i].lo <= r
+}
+
+func (rs runeRanges) size() int {
+	n := 0
+	for _, r := range rs {
+		n += int(r.hi-r.lo) + 1
+	}
+	return n
+}
+
+// parseFontCoverage returns the code points mapped by the font's cmap table.
+// TrueType, OpenType, collections (first face) and WOFF 1.0 are supported.
+func parseFontCoverage(data []byte) (runeRanges, error) {
+	cmap, err := fontTable(data, "cmap")
+	if err != nil {
+		return nil, err
+	}
+	return parseCmap(cmap)
+}
+
+func fontTable(data []byte, tag string) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("font too short")
+	}
+	switch string(data[:4]) {
+	case "wOFF":
+		return woffTable(data, tag)
+	case "wOF2":
+		return nil, fmt.Errorf("WOFF2 fonts are not supported")
+	case "ttcf":
+		if len(data) < 16 {
+			return nil, fmt.Errorf("truncated font collection")
+		}
+		off := binary.BigEndian.Uint32(data[12:16])
+		if int(off)+12 > len(data) {
+			return nil, fmt.Errorf("truncated font collection")
+		}
+		return sfntTable(data, int(off), tag)
+	}
+	return sfntTable(data, 0, tag)
+}
+
+func sfntTable(data []byte, base int, tag string) ([]byte, error) {
+	numTables := int(binary.BigEndian.Uint16(data[base+4 : base+6]))
+	for i := 0; i < numTables; i++ {
+		rec := base + 12 + i*16
+		if rec+16 > len(data) {
+			break
+		}
+		if string(data[rec:rec+4]) != tag {
+			continue
+		}
+		off := int(binary.BigEndian.Uint32(data[rec+8 : rec+12]))
+		length := int(binary.BigEndian.Uint32(data[rec+12 : rec+16]))
+		if off < 0 || length < 0 || off+length > len(data) {
+			return nil, fmt.Errorf("table %s out of bounds", tag)
+		}
+		return data[off : off+length], nil
+	}
+	return nil, fmt.Errorf("font has no %s table", tag)
+}
+
+func woffTable(data []byte, tag string) ([]byte, error) {
+	if len(data) < 44 {
+		return nil, fmt.Errorf("truncated WOFF header")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[12:14]))
+	for i := 0; i < numTables; i++ {
+		rec := 44 + i*20
+		if rec+20 > len(data) {
+			break
+		}
+		if string(data[rec:rec+4]) != tag {
+			continue
+		}
+		off := int(binary.BigEndian.Uint32(data[rec+4 : rec+8]))
+		compLen := int(binary.BigEndian.Uint32(data[rec+8 : rec+12]))
+		origLen := int(binary.BigEndian.Uint32(data[rec+12 : rec+16]))
+		if off < 0 || compLen < 0 || off+compLen > len(data) {
+			return nil, fmt.Errorf("table %s out of bounds", tag)
+		}
+		raw := data[off : off+compLen]
+		if compLen >= origLen {
+			return raw, nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, int64(origLen)))
+	}
+	return nil, fmt.Errorf("font has no %s table", tag)
+}
+
+func parseCmap(cmap []byte) (runeRanges, error) {
+	if len(cmap) < 4 {
+		return nil, fmt.Errorf("truncated cmap")
+	}
+	numTables := int(binary.BigEndian.Uint16(cmap[2:4]))
+	best, bestScore := -1, 0
+	for i := 0; i < numTables; i++ {
+		rec := 4 + i*8
+		if rec+8 > len(cmap) {
+			break
+		}
+		platform := binary.BigEndian.Uint16(cmap[rec : rec+2])
+		encoding := binary.BigEndian.Uint16(cmap[rec+2 : rec+4])
+		off := int(binary.BigEndian.Uint32(cmap[rec+4 : rec+8]))
+		if off+2 > len(cmap) {
+			continue
+		}
+		format := binary.BigEndian.Uint16(cmap[off : off+2])
+		score := 0
+		switch {
+		case format == 12 && (platform == 0 || (platform == 3 && encoding == 10)):
+			score = 3
+		case format == 4 && (platform == 0 || (platform == 3 && encoding == 1)):
+			score = 2
+		case format == 4 && platform == 3 && encoding == 0:
+			score = 1
+		}
+		if score > bestScore {
+			best, bestScore = off, score
+		}
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no supported Unicode cmap subtable")
+	}
+	sub := cmap[best:]
+	switch binary.BigEndian.Uint16(sub[0:2]) {
+	case 12:
+		return parseCmap12(sub)
+	default:
+		return parseCmap4(sub)
+	}
+}
+
+func parseCmap4(sub []byte) (runeRanges, error) {
+	if len(sub) < 14 {
+		return nil, fmt.Errorf("truncated cmap format 4")
+	}
+	segCount := int(binary.BigEndian.Uint16(sub[6:8])) / 2
+	endOff := 14
+	startOff := endOff + segCount*2 + 2
+	deltaOff := startOff + segCount*2
+	rangeOff := deltaOff + segCount*2
+	if rangeOff+segCount*2 > len(sub) {
+		return nil, fmt.Errorf("truncated cmap format 4")
+	}
+	u16 := func(off int) int {
+		if off < 0 || off+2 > len(sub) {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(sub[off : off+2]))
+	}
+
+	var out runeRanges
+	add := func(c int) {
+		r := rune(c)
+		if n := len(out); n > 0 && out[n-1].hi+1 == r {
+			out[n-1].hi = r
+			return
+		}
+		out = append(out, runeRange{lo: r, hi: r})
+	}
+	for i := 0; i < segCount; i++ {
+		end := u16(endOff + i*2)
+		start := u16(startOff + i*2)
+		delta := u16(deltaOff + i*2)
+		ro := u16(rangeOff + i*2)
+		for c := start; c <= end && c != 0xFFFF; c++ {
+			glyph := 0
+			if ro == 0 {
+				glyph = (c + delta) & 0xFFFF
+			} else {
+				g := u16(rangeOff + i*2 + ro + 2*(c-start))
+				if g != 0 {
+					glyph = (g + delta) & 0xFFFF
+				}
+			}
+			if glyph != 0 {
+				add(c)
+			}
+		}
+	}
+	return out, nil
+}
+
+func parseCmap12(sub []byte) (runeRanges, error) {
+	if len(sub) < 16 {
+		return nil, fmt.Errorf("truncated cmap format 12")
+	}
+	groups := int(binary.BigEndian.Uint32(sub[12:16]))
+	var out runeRanges
+	for i := 0; i < groups; i++ {
+		rec := 16 + i*12
+		if rec+12 > len(sub) {
+			return nil, fmt.Errorf("truncated cmap format 12")
+		}
+		lo := rune(binary.BigEndian.Uint32(sub[rec : rec+4]))
+		hi := rune(binary.BigEndian.Uint32(sub[rec+4 : rec+8]))
+		glyph := binary.BigEndian.Uint32(sub[rec+8 : rec+12])
+		if glyph == 0 {
+			// The first code point maps to .notdef.
+			lo++
+		}
+		if lo <= hi {
+			out = append(out, runeRange{lo: lo, hi: hi})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+// buildTestFont returns a minimal sfnt whose only table is a format 4 cmap
+// mapping the given inclusive rune ranges.
+func buildTestFont(ranges ...[2]uint16) []byte {
+	segs := append(ranges, [2]uint16{0xFFFF, 0xFFFF})
+	segCount := len(segs)
+
+	sub := make([]byte, 14+segCount*8+2)
+	binary.BigEndian.PutUint16(sub[0:], 4)
+	binary.BigEndian.PutUint16(sub[2:], uint16(len(sub)))
+	binary.BigEndian.PutUint16(sub[6:], uint16(segCount*2))
+	glyph := uint16(1)
+	for i, s := range segs {
+		binary.BigEndian.PutUint16(sub[14+i*2:], s[1])
+		binary.BigEndian.PutUint16(sub[16+segCount*2+i*2:], s[0])
+		delta := glyph - s[0]
+		if s[0] == 0xFFFF {
+			delta = 1
+		}
+		binary.BigEndian.PutUint16(sub[16+segCount*4+i*2:], delta)
+		glyph += s[1] - s[0] + 1
+	}
+
+	cmap := make([]byte, 12, 12+len(sub))
+	binary.BigEndian.PutUint16(cmap[2:], 1)
+	binary.BigEndian.PutUint16(cmap[4:], 3)
+	binary.BigEndian.PutUint16(cmap[6:], 1)
+	binary.BigEndian.PutUint32(cmap[8:], 12)
+	cmap = append(cmap, sub...)
+
+	font := make([]byte, 28, 28+len(cmap))
+	binary.BigEndian.PutUint32(font[0:], 0x00010000)
+	binary.BigEndian.PutUint16(font[4:], 1)
+	copy(font[12:], "cmap")
+	binary.BigEndian.PutUint32(font[20:], 28)
+	binary.BigEndian.PutUint32(font[24:], uint32(len(cmap)))
+	return append(font, cmap...)
+}
+
+func TestParseFontCoverageFormat4(t *testing.T) {
+	cov, err := parseFontCoverage(buildTestFont([2]uint16{'A', 'Z'}, [2]uint16{'a', 'z'}))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cov = cov.normalize()
+	for _, r := range "AZaqz" {
+		if !cov.contains(r) {
+			t.Fatalf("expected %q covered", r)
+		}
+	}
+	for _, r := range "0@漢" {
+		if cov.contains(r) {
+			t.Fatalf("unexpected coverage of %q", r)
+		}
+	}
+	if cov.size() != 52 {
+		t.Fatalf("size = %d", cov.size())
+	}
+}
+
+func TestDeobfuscateIDPFRoundTrip(t *testing.T) {
+	font := buildTestFont([2]uint16{'A', 'Z'})
+	key := sha1.Sum([]byte("urn:uuid:1234"))
+	deobfuscateIDPF(font, key)
+	if _, err := parseFontCoverage(font); err == nil {
+		t.Fatalf("expected obfuscated font to be unreadable")
+	}
+	deobfuscateIDPF(font, key)
+	if _, err := parseFontCoverage(font); err != nil {
+		t.Fatalf("parse after round trip: %v", err)
+	}
+}
+
+func TestAnalyzeFontsReportsMissingGlyphs(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="f" href="font.ttf" media-type="font/ttf"/>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/font.ttf": string(buildTestFont([2]uint16{'A', 'Z'}, [2]uint16{'a', 'z'})),
+		"OEBPS/a.xhtml":  `<html><head><title>Ignored 123</title></head><body><p>Plain text</p></body></html>`,
+		"OEBPS/b.xhtml":  `<html><body><p>Kanji 漢字 here</p></body></html>`,
+	})
+
+	report, err := AnalyzeFonts(context.Background(), input, FontOptions{})
+	if err != nil {
+		t.Fatalf("AnalyzeFonts: %v", err)
+	}
+	if len(report.Fonts) != 1 || report.Fonts[0].Glyphs != 52 {
+		t.Fatalf("unexpected fonts %+v", report.Fonts)
+	}
+	if len(report.Chapters) != 1 {
+		t.Fatalf("expected one chapter with gaps, got %+v", report.Chapters)
+	}
+	if got := report.Chapters[0]; got.Href != "b.xhtml" || got.Missing != "漢字" {
+		t.Fatalf("unexpected chapter coverage %+v", got)
+	}
+}
+
+func TestAnalyzeFontsReadsEncryptionXML(t *testing.T) {
+	font := buildTestFont([2]uint16{'A', 'Z'}, [2]uint16{'a', 'z'})
+	deobfuscateIDPF(font, sha1.Sum([]byte("urn:uuid:0a1b2c3d")))
+	input := buildEPUBFromFiles(t, map[string]string{
+		// As written by Sigil and InDesign: one IDPF-obfuscated font and
+		// one the Adobe algorithm covers.
+		"META-INF/encryption.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData>
+      <enc:CipherReference URI="OEBPS/Fonts/font.ttf"/>
+    </enc:CipherData>
+  </enc:EncryptedData>
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://ns.adobe.com/pdf/enc#RC"/>
+    <enc:CipherData>
+      <enc:CipherReference URI="OEBPS/Fonts/other.otf"/>
+    </enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`,
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:uuid:0a1b2c3d</dc:identifier></metadata>
+  <manifest>
+    <item id="f" href="Fonts/font.ttf" media-type="font/ttf"/>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/Fonts/font.ttf": string(font),
+		"OEBPS/a.xhtml":        `<html><body><p>Plain text</p></body></html>`,
+	})
+
+	report, err := AnalyzeFonts(context.Background(), input, FontOptions{})
+	if err != nil {
+		t.Fatalf("AnalyzeFonts: %v", err)
+	}
+	if len(report.Fonts) != 1 || report.Fonts[0].Glyphs != 52 || report.Fonts[0].Error != "" {
+		t.Fatalf("obfuscated font not read: %+v", report.Fonts)
+	}
+}
@@ -0,0 +1,340 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Threshold is a limit given either as an absolute count or as a percentage
+// of a total. The zero value disables the check.
+type Threshold struct {
+	Value   float64
+	Percent bool
+	Set     bool
+}
+
+// ParseThreshold accepts "500" or "2%" / "2.5%".
+func ParseThreshold(s string) (Threshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Threshold{}, nil
+	}
+	t := Threshold{Set: true}
+	if strings.HasSuffix(s, "%") {
+		t.Percent = true
+		s = strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return Threshold{}, fmt.Errorf("invalid threshold %q (want a count or a percentage like 2%%)", s)
+	}
+	t.Value = v
+	return t, nil
+}
+
+func (t Threshold) String() string {
+	v := strconv.FormatFloat(t.Value, 'f', -1, 64)
+	if t.Percent {
+		return v + "%"
+	}
+	return v
+}
+
+// exceeded reports whether n out of total is over the limit.
+func (t Threshold) exceeded(n, total int) bool {
+	if !t.Set {
+		return false
+	}
+	if t.Percent {
+		return percentOf(n, total) > t.Value
+	}
+	return float64(n) > t.Value
+}
+
+type GateOptions struct {
+	// MaxChangedWords limits changed words, counted against the old book.
+	MaxChangedWords Threshold
+	// MaxChangedChapters limits spine documents with any change, counted
+	// against the old book.
+	MaxChangedChapters Threshold
+	Logger             *slog.Logger
+}
+
+// GateChapter is the number of changed words attributed to one spine
+// document of the old book (or of the new book for inserted chapters).
+type GateChapter struct {
+	Href         string `json:"href"`
+	ChangedWords int    `json:"changed_words"`
+}
+
+type GateReport struct {
+	OldWords        int           `json:"old_words"`
+	NewWords        int           `json:"new_words"`
+	ChangedWords    int           `json:"changed_words"`
+	OldChapters     int           `json:"old_chapters"`
+	ChangedChapters int           `json:"changed_chapters"`
+	Chapters        []GateChapter `json:"chapters,omitempty"`
+	// Failures describes every exceeded threshold; empty means the gate
+	// passed.
+	Failures []string `json:"failures,omitempty"`
+}
+
+func (r GateReport) Passed() bool { return len(r.Failures) == 0 }
+
+// ChangedWordsPercent is ChangedWords relative to OldWords.
+func (r GateReport) ChangedWordsPercent() float64 {
+	return percentOf(r.ChangedWords, r.OldWords)
+}
+
+type gateParagraph struct {
+	text    string
+	chapter string
+}
+
+// CompareBooks measures how much of the visible text differs between two
+// builds of a book and checks the result against opts. Paragraphs are
+// aligned first, then changed paragraphs are compared word by word; a
+// replaced word counts once.
+func CompareBooks(ctx context.Context, oldPath, newPath string, opts GateOptions) (GateReport, error) {
+	var report GateReport
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("reading old book", "path", oldPath)
+	oldParas, oldChapters, err := bookParagraphs(ctx, oldPath)
+	if err != nil {
+		return report, fmt.Errorf("%s: %w", oldPath, err)
+	}
+	log.Info("reading new book", "path", newPath)
+	newParas, _, err := bookParagraphs(ctx, newPath)
+	if err != nil {
+		return report, fmt.Errorf("%s: %w", newPath, err)
+	}
+	report.OldChapters = oldChapters
+
+	oldTexts := make([]string, len(oldParas))
+	for i, p := range oldParas {
+		oldTexts[i] = p.text
+		report.OldWords += len(textWords(p.text))
+	}
+	newTexts := make([]string, len(newParas))
+	for i, p := range newParas {
+		newTexts[i] = p.text
+		report.NewWords += len(textWords(p.text))
+	}
+
+	log.Info("comparing text", "old_paragraphs", len(oldParas), "new_paragraphs", len(newParas))
+	perChapter := map[string]int{}
+	for _, h := range diffStrings(oldTexts, newTexts) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		var oldWords, newWords []string
+		var oldWordChapter []string
+		for _, p := range oldParas[h.A0:h.A1] {
+			for _, w := range textWords(p.text) {
+				oldWords = append(oldWords, w)
+				oldWordChapter = append(oldWordChapter, p.chapter)
+			}
+		}
+		for _, p := range newParas[h.B0:h.B1] {
+			newWords = append(newWords, textWords(p.text)...)
+		}
+		fallback := hunkChapter(oldParas, newParas, h)
+		for _, wh := range diffStrings(oldWords, newWords) {
+			n := max(wh.A1-wh.A0, wh.B1-wh.B0)
+			chapter := fallback
+			if wh.A1 > wh.A0 {
+				chapter = oldWordChapter[wh.A0]
+			}
+			report.ChangedWords += n
+			perChapter[chapter] += n
+		}
+	}
+
+	for href, n := range perChapter {
+		report.Chapters = append(report.Chapters, GateChapter{Href: href, ChangedWords: n})
+	}
+	sort.Slice(report.Chapters, func(i, j int) bool {
+		a, b := report.Chapters[i], report.Chapters[j]
+		if a.ChangedWords != b.ChangedWords {
+			return a.ChangedWords > b.ChangedWords
+		}
+		return a.Href < b.Href
+	})
+	report.ChangedChapters = len(report.Chapters)
+
+	if opts.MaxChangedWords.exceeded(report.ChangedWords, report.OldWords) {
+		report.Failures = append(report.Failures, fmt.Sprintf("%d changed words (%.2f%%) exceeds limit %s",
+			report.ChangedWords, report.ChangedWordsPercent(), opts.MaxChangedWords))
+	}
+	if opts.MaxChangedChapters.exceeded(report.ChangedChapters, report.OldChapters) {
+		report.Failures = append(report.Failures, fmt.Sprintf("%d changed chapters of %d exceeds limit %s",
+			report.ChangedChapters, report.OldChapters, opts.MaxChangedChapters))
+	}
+	return report, nil
+}
+
+// hunkChapter picks the chapter to blame for words inserted without any old
+// counterpart: the old chapter around the insertion, else the new one.
+func hunkChapter(oldParas, newParas []gateParagraph, h diffHunk) string {
+	switch {
+	case h.A1 > h.A0:
+		return oldParas[h.A0].chapter
+	case h.A0 > 0:
+		return oldParas[h.A0-1].chapter
+	case h.B1 > h.B0:
+		return newParas[h.B0].chapter
+	}
+	return ""
+}
+
+// bookParagraphs returns the visible text blocks of a book's spine in
+// reading order, plus the number of spine documents.
+func bookParagraphs(ctx context.Context, path string) ([]gateParagraph, int, error) {
+	vol, err := loadVolume(ctx, 0, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	hrefs := spineHrefs(vol.PackageDoc)
+	var out []gateParagraph
+	for _, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return nil, 0, err
+		}
+		paras, err := visibleParagraphs(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", href, err)
+		}
+		for _, text := range paras {
+			out = append(out, gateParagraph{text: text, chapter: href})
+		}
+	}
+	return out, len(hrefs), nil
+}
+
+// gateBlockTags end the current paragraph when they open or close.
+var gateBlockTags = map[string]bool{
+	"p": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "li": true, "td": true, "th": true, "dt": true,
+	"dd": true, "blockquote": true, "pre": true, "caption": true,
+	"figcaption": true, "section": true, "tr": true, "body": true,
+}
+
+// visibleParagraphs returns the whitespace-normalized text of each block in
+// the document body, skipping script and style.
+func visibleParagraphs(data []byte) ([]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+
+	var (
+		out    []string
+		cur    strings.Builder
+		inBody bool
+		hidden int
+	)
+	flush := func() {
+		if s := normalizeSpace(cur.String()); s != "" {
+			out = append(out, s)
+		}
+		cur.Reset()
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case name == "body":
+				inBody = true
+			case name == "script" || name == "style":
+				hidden++
+			case name == "br":
+				cur.WriteByte(' ')
+			}
+			if gateBlockTags[name] {
+				flush()
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if name == "script" || name == "style" {
+				hidden--
+			}
+			if gateBlockTags[name] {
+				flush()
+			}
+			if name == "body" {
+				inBody = false
+			}
+		case xml.CharData:
+			if inBody && hidden == 0 {
+				cur.Write(t)
+			}
+		}
+	}
+	flush()
+	return out, nil
+}
+
+// textWords splits text into words on whitespace; CJK characters count as
+// one word each since those scripts don't separate words.
+func textWords(s string) []string {
+	var (
+		out   []string
+		start = -1
+	)
+	for i, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			if start >= 0 {
+				out = append(out, s[start:i])
+				start = -1
+			}
+		case isCJK(r):
+			if start >= 0 {
+				out = append(out, s[start:i])
+				start = -1
+			}
+			out = append(out, string(r))
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		out = append(out, s[start:])
+	}
+	return out
+}
+
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		if n == 0 {
+			return 0
+		}
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
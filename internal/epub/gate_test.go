@@ -0,0 +1,88 @@
+package epub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffStrings(t *testing.T) {
+	a := strings.Fields("the cat sat on the mat today")
+	b := strings.Fields("the dog sat on the mat and slept today")
+	got := diffStrings(a, b)
+	want := []diffHunk{{A0: 1, A1: 2, B0: 1, B1: 2}, {A0: 6, A1: 6, B0: 6, B1: 8}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffStrings = %+v, want %+v", got, want)
+	}
+	if got := diffStrings(a, a); len(got) != 0 {
+		t.Fatalf("identical input should have no hunks, got %+v", got)
+	}
+}
+
+func TestTextWords(t *testing.T) {
+	got := textWords("Hello  world 日本語です!")
+	want := []string{"Hello", "world", "日", "本", "語", "で", "す", "!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("textWords = %q, want %q", got, want)
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	th, err := ParseThreshold("2.5%")
+	if err != nil || !th.Percent || th.Value != 2.5 || th.String() != "2.5%" {
+		t.Fatalf("ParseThreshold(2.5%%) = %+v, %v", th, err)
+	}
+	if !th.exceeded(3, 100) || th.exceeded(2, 100) {
+		t.Fatalf("percentage threshold comparison is wrong")
+	}
+	if _, err := ParseThreshold("lots"); err == nil {
+		t.Fatalf("expected error for invalid threshold")
+	}
+}
+
+func gateTestBook(t *testing.T, ch1, ch2 string) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><style>p{}</style></head><body>` + ch1 + `</body></html>`,
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body>` + ch2 + `</body></html>`,
+	})
+}
+
+func TestCompareBooks(t *testing.T) {
+	ch1 := `<p>One two three four five.</p><p>Six seven eight nine ten.</p>`
+	ch2 := `<p>Alpha beta gamma delta epsilon.</p><p>Zeta eta theta iota kappa.</p>`
+	oldBook := gateTestBook(t, ch1, ch2)
+	newBook := gateTestBook(t, ch1, strings.Replace(ch2, "gamma", "GAMMA", 1)+`<p>Added line.</p>`)
+
+	words, _ := ParseThreshold("20%")
+	chapters, _ := ParseThreshold("1")
+	report, err := CompareBooks(context.Background(), oldBook, newBook, GateOptions{MaxChangedWords: words, MaxChangedChapters: chapters})
+	if err != nil {
+		t.Fatalf("CompareBooks: %v", err)
+	}
+	if report.OldWords != 20 || report.NewWords != 22 || report.ChangedWords != 3 {
+		t.Fatalf("unexpected counts %+v", report)
+	}
+	if report.ChangedChapters != 1 || report.Chapters[0].Href != "b.xhtml" || !report.Passed() {
+		t.Fatalf("unexpected chapters %+v", report)
+	}
+
+	strict, _ := ParseThreshold("2%")
+	report, err = CompareBooks(context.Background(), oldBook, newBook, GateOptions{MaxChangedWords: strict})
+	if err != nil {
+		t.Fatalf("CompareBooks: %v", err)
+	}
+	if report.Passed() || !strings.Contains(report.Failures[0], "exceeds limit 2%") {
+		t.Fatalf("expected failure, got %+v", report)
+	}
+}
@@ -0,0 +1,315 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GenerateOptions describes a synthetic book. Zero values pick small
+// defaults, so GenerateOptions{OutPath: p} gives a valid ten-chapter book.
+// The same options, including Seed, always produce the same file.
+type GenerateOptions struct {
+	Title    string
+	Language string
+	// Chapters defaults to 10 and WordsPerChapter to 1000.
+	Chapters        int
+	WordsPerChapter int
+	// Images adds that many PNGs spread over the chapters; the first one
+	// is the cover.
+	Images int
+	Seed   uint64
+
+	// NestingDepth wraps every paragraph in that many nested divs.
+	NestingDepth int
+	// HugeChapterWords adds one more chapter of that many words, written
+	// as a single paragraph.
+	HugeChapterWords int
+	// WeirdNamespaces writes chapters with a prefixed XHTML namespace,
+	// a default namespace redeclared on inner elements, and attributes
+	// from an unrelated namespace.
+	WeirdNamespaces bool
+
+	OutPath  string
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+const (
+	defaultGenChapters = 10
+	defaultGenWords    = 1000
+)
+
+var genWords = map[string][]string{
+	"en": strings.Fields(`the a of and to in was he she it that for on with as his her
+		they at by from but not what all were when we there can an your which their said
+		if do will each about how up out them then many some so these would other into
+		has more two like time see no way could people my than first been who now find
+		long down day did get come made may part sword castle dragon village night rain
+		letter road guild merchant knight window mountain river quietly suddenly again`),
+	"ja": strings.Fields(`私 彼 彼女 それ ここ そこ 今日 明日 昨日 剣 城 竜 村 夜 雨 手紙 道
+		ギルド 商人 騎士 窓 山 川 静かに 突然 また は が を に で と も から まで 見た
+		言った 来た 行った 思った 待っていた 笑った 走った ゆっくり 少し とても`),
+}
+
+// GenerateEPUB writes a synthetic EPUB for benchmarks and bug reports.
+func GenerateEPUB(ctx context.Context, opts GenerateOptions) error {
+	if opts.OutPath == "" {
+		return fmt.Errorf("output path is required")
+	}
+	if opts.Chapters < 0 || opts.WordsPerChapter < 0 || opts.Images < 0 || opts.NestingDepth < 0 || opts.HugeChapterWords < 0 {
+		return fmt.Errorf("generator sizes must not be negative")
+	}
+	if opts.Chapters == 0 {
+		opts.Chapters = defaultGenChapters
+	}
+	if opts.WordsPerChapter == 0 {
+		opts.WordsPerChapter = defaultGenWords
+	}
+	if opts.Title == "" {
+		opts.Title = "Synthetic Book"
+	}
+	if opts.Language == "" {
+		opts.Language = "en"
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	root, err := os.MkdirTemp("", "novfmt-gen-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	oebps := filepath.Join(root, "OEBPS")
+	for _, dir := range []string{"Text", "Images"} {
+		if err := os.MkdirAll(filepath.Join(oebps, dir), 0o755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "mimetype"), []byte(epubMimeType), 0o644); err != nil {
+		return err
+	}
+	if err := writeContainer(filepath.Join(root, "META-INF")); err != nil {
+		return err
+	}
+
+	base := strings.ToLower(strings.SplitN(opts.Language, "-", 2)[0])
+	g := &generator{
+		opts:  opts,
+		rng:   rand.New(rand.NewPCG(opts.Seed, opts.Seed^0x9e3779b97f4a7c15)),
+		words: genWords["en"],
+		ja:    base == "ja",
+	}
+	if w, ok := genWords[base]; ok {
+		g.words = w
+	}
+
+	pkg := &PackageDocument{
+		XMLNS:            nsOPF,
+		XMLNSDC:          nsDC,
+		Version:          "3.0",
+		UniqueIdentifier: "BookId",
+		Metadata: Metadata{
+			Titles:      []DCMeta{{Value: opts.Title}},
+			Languages:   []DCMeta{{Value: opts.Language}},
+			Identifiers: []DCMeta{{ID: "BookId", Value: fmt.Sprintf("urn:novfmt:synthetic:%d", opts.Seed)}},
+			Creators:    []DCMeta{{Value: "novfmt gen"}},
+			Meta:        []MetaNode{{Property: "dcterms:modified", Value: "2000-01-01T00:00:00Z"}},
+		},
+	}
+	pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: "nav", Href: "nav.xhtml", MediaType: "application/xhtml+xml", Properties: "nav"})
+
+	// Image i goes into chapter i*chapters/images.
+	images := make(map[int][]string)
+	for i := 0; i < opts.Images; i++ {
+		href := fmt.Sprintf("Images/img%04d.png", i+1)
+		if err := writeGenImage(filepath.Join(oebps, filepath.FromSlash(href)), i); err != nil {
+			return err
+		}
+		item := ManifestItem{ID: fmt.Sprintf("img%04d", i+1), Href: href, MediaType: "image/png"}
+		if i == 0 {
+			item.Properties = "cover-image"
+		}
+		pkg.Manifest.Items = append(pkg.Manifest.Items, item)
+		ch := i * opts.Chapters / opts.Images
+		images[ch] = append(images[ch], href)
+	}
+
+	total := opts.Chapters
+	if opts.HugeChapterWords > 0 {
+		total++
+	}
+	var nav []NavItem
+	for i := 0; i < total; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		href := fmt.Sprintf("Text/ch%04d.xhtml", i+1)
+		opts.Progress.report(StageRewrite, i, total, href)
+		title := fmt.Sprintf("Chapter %d", i+1)
+		var body []byte
+		if i == opts.Chapters {
+			title = "Huge Chapter"
+			body = g.chapter(title, opts.HugeChapterWords, true, nil)
+		} else {
+			body = g.chapter(title, opts.WordsPerChapter, false, images[i])
+		}
+		if err := os.WriteFile(filepath.Join(oebps, filepath.FromSlash(href)), body, 0o644); err != nil {
+			return err
+		}
+		id := fmt.Sprintf("ch%04d", i+1)
+		pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: id, Href: href, MediaType: "application/xhtml+xml"})
+		pkg.Spine.Itemrefs = append(pkg.Spine.Itemrefs, SpineItemRef{IDRef: id})
+		nav = append(nav, NavItem{Title: title, Href: href})
+	}
+	opts.Progress.report(StageRewrite, total, total, "")
+
+	if err := os.WriteFile(filepath.Join(oebps, "nav.xhtml"), RenderNavDocument(nav), 0o644); err != nil {
+		return err
+	}
+	if err := writePackage(pkg, filepath.Join(oebps, "content.opf")); err != nil {
+		return err
+	}
+	log.Info("zipping output", "path", opts.OutPath)
+	return writeZipProgress(ctx, root, opts.OutPath, opts.Progress)
+}
+
+type generator struct {
+	opts  GenerateOptions
+	rng   *rand.Rand
+	words []string
+	// ja writes sentences without spaces and with Japanese punctuation.
+	ja bool
+}
+
+func (g *generator) chapter(title string, words int, single bool, images []string) []byte {
+	var buf bytes.Buffer
+	lang := html.EscapeString(g.opts.Language)
+	p, h1, img := "p", "h1", "img"
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	if g.opts.WeirdNamespaces {
+		p, h1, img = "h:p", "h:h1", "h:img"
+		buf.WriteString(`<h:html xmlns:h="http://www.w3.org/1999/xhtml" xmlns:x="urn:novfmt:synthetic" xml:lang="` + lang + `">` + "\n")
+		buf.WriteString("<h:head><h:title>" + title + "</h:title></h:head>\n<h:body x:kind=\"chapter\">\n")
+		buf.WriteString(`<section xmlns="http://www.w3.org/1999/xhtml">` + "\n")
+	} else {
+		buf.WriteString(`<!DOCTYPE html>` + "\n")
+		buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="` + lang + `">` + "\n")
+		buf.WriteString("<head><title>" + title + "</title></head>\n<body>\n")
+	}
+	buf.WriteString("<" + h1 + ">" + title + "</" + h1 + ">\n")
+
+	open := strings.Repeat(`<div class="nest">`, g.opts.NestingDepth)
+	closing := strings.Repeat("</div>", g.opts.NestingDepth)
+	paraAttrs := ""
+	if g.opts.WeirdNamespaces {
+		paraAttrs = ` x:n="1"`
+	}
+	var paras []int
+	if single {
+		paras = []int{words}
+	} else {
+		for left := words; left > 0; {
+			n := min(40+g.rng.IntN(80), left)
+			paras = append(paras, n)
+			left -= n
+		}
+	}
+	every := 0
+	if len(images) > 0 {
+		every = max(len(paras)/(len(images)+1), 1)
+	}
+	for i, n := range paras {
+		if every > 0 && i > 0 && i%every == 0 && len(images) > 0 {
+			buf.WriteString("<" + p + `><` + img + ` src="../` + images[0] + `" alt=""/></` + p + ">\n")
+			images = images[1:]
+		}
+		if i > 0 && !single && g.rng.IntN(25) == 0 {
+			buf.WriteString(open + "<" + p + ">* * *</" + p + ">" + closing + "\n")
+		}
+		buf.WriteString(open + "<" + p + paraAttrs + ">")
+		buf.WriteString(html.EscapeString(g.paragraph(n)))
+		buf.WriteString("</" + p + ">" + closing + "\n")
+	}
+	for _, src := range images {
+		buf.WriteString("<" + p + `><` + img + ` src="../` + src + `" alt=""/></` + p + ">\n")
+	}
+
+	if g.opts.WeirdNamespaces {
+		buf.WriteString("</section>\n</h:body>\n</h:html>\n")
+	} else {
+		buf.WriteString("</body>\n</html>\n")
+	}
+	return buf.Bytes()
+}
+
+// paragraph returns n words of filler in sentences, some of them quoted
+// dialogue so the typography passes have something to do.
+func (g *generator) paragraph(n int) string {
+	ja := g.ja
+	var sb strings.Builder
+	for n > 0 {
+		k := min(6+g.rng.IntN(12), n)
+		n -= k
+		quoted := g.rng.IntN(4) == 0
+		if sb.Len() > 0 && !ja {
+			sb.WriteByte(' ')
+		}
+		if quoted {
+			if ja {
+				sb.WriteString("「")
+			} else {
+				sb.WriteByte('"')
+			}
+		}
+		for i := 0; i < k; i++ {
+			w := g.words[g.rng.IntN(len(g.words))]
+			if i == 0 && !ja {
+				w = strings.ToUpper(w[:1]) + w[1:]
+			}
+			if i > 0 && !ja {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(w)
+		}
+		switch {
+		case ja && quoted:
+			sb.WriteString("」")
+		case ja:
+			sb.WriteString("。")
+		case quoted:
+			sb.WriteString(`,"`)
+		default:
+			sb.WriteByte('.')
+		}
+	}
+	return sb.String()
+}
+
+// writeGenImage writes a small PNG whose colour depends on i.
+func writeGenImage(dest string, i int) error {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 96))
+	c := color.RGBA{R: uint8(40 + i*53%200), G: uint8(40 + i*97%200), B: uint8(40 + i*31%200), A: 255}
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 64; x++ {
+			if (x/8+y/8)%2 == 0 {
+				img.Set(x, y, c)
+			} else {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, buf.Bytes(), 0o644)
+}
@@ -0,0 +1,73 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateEPUB(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := GenerateOptions{
+		Chapters:         4,
+		WordsPerChapter:  300,
+		Images:           3,
+		Seed:             7,
+		NestingDepth:     5,
+		HugeChapterWords: 5000,
+		WeirdNamespaces:  true,
+		OutPath:          filepath.Join(dir, "a.epub"),
+	}
+	if err := GenerateEPUB(ctx, opts); err != nil {
+		t.Fatalf("GenerateEPUB: %v", err)
+	}
+
+	vol, err := loadVolume(ctx, 0, opts.OutPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if n := len(vol.PackageDoc.Spine.Itemrefs); n != 5 {
+		t.Fatalf("spine has %d items, want 5", n)
+	}
+	if len(vol.NavItems) != 5 || vol.NavItems[4].Title != "Huge Chapter" {
+		t.Fatalf("nav = %+v", vol.NavItems)
+	}
+	if vol.CoverID != "img0001" {
+		t.Fatalf("cover = %q", vol.CoverID)
+	}
+	ch1, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch0001.xhtml"))
+	if !bytes.Contains(ch1, []byte(strings.Repeat(`<div class="nest">`, 5)+`<h:p x:n="1">`)) {
+		t.Fatalf("chapter lacks nesting or namespaces:\n%s", ch1)
+	}
+
+	var text bytes.Buffer
+	if err := ExportText(ctx, opts.OutPath, &text, TextExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if words := len(strings.Fields(text.String())); words < 4*300+5000 {
+		t.Fatalf("exported %d words", words)
+	}
+
+	// The same seed gives the same file; another seed does not.
+	again := opts
+	again.OutPath = filepath.Join(dir, "b.epub")
+	if err := GenerateEPUB(ctx, again); err != nil {
+		t.Fatal(err)
+	}
+	other := opts
+	other.OutPath, other.Seed = filepath.Join(dir, "c.epub"), 8
+	if err := GenerateEPUB(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(opts.OutPath)
+	b, _ := os.ReadFile(again.OutPath)
+	c, _ := os.ReadFile(other.OutPath)
+	if !bytes.Equal(a, b) || bytes.Equal(a, c) {
+		t.Fatalf("output is not determined by the seed")
+	}
+}
@@ -0,0 +1,198 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// GoldenDiff is one file that differs between a built EPUB and its golden
+// directory.
+type GoldenDiff struct {
+	Path string
+	// Kind is "added" (only in the EPUB), "removed" (only in the golden
+	// directory) or "changed".
+	Kind string
+	// Diff is a unified-style line diff for changed text files.
+	Diff string
+}
+
+// goldenModifiedPattern matches the dcterms:modified value every edit
+// stamps with the current time.
+var goldenModifiedPattern = regexp.MustCompile(`(property="dcterms:modified"[^>]*>)[^<]*(<)`)
+
+const goldenModifiedPlaceholder = "[modified]"
+
+// CompareGolden compares the files in the EPUB at epubPath with the unpacked
+// tree in goldenDir. dcterms:modified values are masked so that timestamps
+// do not count as differences. With update set, goldenDir is rewritten to
+// match the EPUB and the differences that were fixed are returned.
+func CompareGolden(epubPath, goldenDir string, update bool) ([]GoldenDiff, error) {
+	got, err := readGoldenEPUB(epubPath)
+	if err != nil {
+		return nil, err
+	}
+	want, err := readGoldenDir(goldenDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(got)+len(want))
+	for name := range got {
+		names = append(names, name)
+	}
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []GoldenDiff
+	for _, name := range names {
+		g, inGot := got[name]
+		w, inWant := want[name]
+		switch {
+		case !inWant:
+			diffs = append(diffs, GoldenDiff{Path: name, Kind: "added"})
+		case !inGot:
+			diffs = append(diffs, GoldenDiff{Path: name, Kind: "removed"})
+		case !bytes.Equal(g, w):
+			d := GoldenDiff{Path: name, Kind: "changed"}
+			if utf8.Valid(g) && utf8.Valid(w) {
+				d.Diff = unifiedLineDiff(string(w), string(g))
+			}
+			diffs = append(diffs, d)
+		}
+	}
+
+	if update && len(diffs) > 0 {
+		for _, d := range diffs {
+			dest := filepath.Join(goldenDir, filepath.FromSlash(d.Path))
+			if d.Kind == "removed" {
+				if err := os.Remove(dest); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := ensureParentDir(dest); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(dest, got[d.Path], 0o644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return diffs, nil
+}
+
+func readGoldenEPUB(src string) (map[string][]byte, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files := map[string][]byte{}
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		name := path.Clean(f.Name)
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("%s: unsafe entry %q", src, f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(strings.ToLower(name), ".opf") {
+			data = goldenModifiedPattern.ReplaceAll(data, []byte("${1}"+goldenModifiedPlaceholder+"${2}"))
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+func readGoldenDir(dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	return files, err
+}
+
+// goldenDiffContext is the number of unchanged lines shown around a change.
+const goldenDiffContext = 2
+
+// unifiedLineDiff renders the line differences from a to b with a little
+// context, in the style of diff -u without file headers. Hunks whose
+// context would overlap are printed as one.
+func unifiedLineDiff(a, b string) string {
+	al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	hunks := diffStrings(al, bl)
+	var buf strings.Builder
+	for i := 0; i < len(hunks); {
+		j := i + 1
+		for j < len(hunks) && hunks[j].A0-hunks[j-1].A1 <= 2*goldenDiffContext {
+			j++
+		}
+		group := hunks[i:j]
+		first, last := group[0], group[len(group)-1]
+		aStart := max(first.A0-goldenDiffContext, 0)
+		aEnd := min(last.A1+goldenDiffContext, len(al))
+		bStart := first.B0 - (first.A0 - aStart)
+		bEnd := last.B1 + (aEnd - last.A1)
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart+1, aEnd-aStart, bStart+1, bEnd-bStart)
+		at := aStart
+		for _, h := range group {
+			for _, l := range al[at:h.A0] {
+				buf.WriteString(" " + l + "\n")
+			}
+			for _, l := range al[h.A0:h.A1] {
+				buf.WriteString("-" + l + "\n")
+			}
+			for _, l := range bl[h.B0:h.B1] {
+				buf.WriteString("+" + l + "\n")
+			}
+			at = h.A1
+		}
+		for _, l := range al[at:aEnd] {
+			buf.WriteString(" " + l + "\n")
+		}
+		i = j
+	}
+	return buf.String()
+}
@@ -0,0 +1,61 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareGolden(t *testing.T) {
+	opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:golden</dc:identifier>
+    <dc:title>T</dc:title>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest><item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>
+`
+	chapter := "<html>\n<body>\n<p>1</p>\n<p>2</p>\n<p>3</p>\n<p>4</p>\n<p>5</p>\n<p>6</p>\n<p>7</p>\n</body>\n</html>\n"
+	book := func(stamp, ch string) string {
+		return buildEPUBFromFiles(t, map[string]string{
+			"OEBPS/content.opf": strings.Replace(opf, "%s", stamp, 1),
+			"OEBPS/ch1.xhtml":   ch,
+		})
+	}
+	golden := filepath.Join(t.TempDir(), "expected")
+
+	diffs, err := CompareGolden(book("2020-01-01T00:00:00Z", chapter), golden, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) == 0 || diffs[0].Kind != "added" {
+		t.Fatalf("first update = %+v", diffs)
+	}
+	stored, _ := os.ReadFile(filepath.Join(golden, "OEBPS", "content.opf"))
+	if !strings.Contains(string(stored), ">[modified]<") {
+		t.Fatalf("timestamp not masked:\n%s", stored)
+	}
+
+	// A new timestamp alone is not a difference.
+	if diffs, err := CompareGolden(book("2030-06-01T12:00:00Z", chapter), golden, false); err != nil || len(diffs) != 0 {
+		t.Fatalf("diffs = %+v, %v", diffs, err)
+	}
+
+	os.WriteFile(filepath.Join(golden, "stale.txt"), []byte("x"), 0o644)
+	changed := strings.Replace(strings.Replace(chapter, "<p>2</p>", "<p>two</p>", 1), "<p>4</p>", "<p>four</p>", 1)
+	diffs, err = CompareGolden(book("2030-06-01T12:00:00Z", changed), golden, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || diffs[0].Path != "OEBPS/ch1.xhtml" || diffs[1].Kind != "removed" {
+		t.Fatalf("diffs = %+v", diffs)
+	}
+	want := "@@ -2,7 +2,7 @@\n <body>\n <p>1</p>\n-<p>2</p>\n+<p>two</p>\n <p>3</p>\n-<p>4</p>\n+<p>four</p>\n <p>5</p>\n <p>6</p>\n"
+	if diffs[0].Diff != want {
+		t.Fatalf("diff =\n%s\nwant\n%s", diffs[0].Diff, want)
+	}
+}
@@ -0,0 +1,242 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// headingLevelOptions configure the headings transform.
+type headingLevelOptions struct {
+	// chapter is the level chapter titles get; volume titles get the one
+	// above it.
+	chapter int
+	// bold also takes short, centered, fully bold paragraphs at the top
+	// of a document for headings.
+	bold    bool
+	matcher *headingMatcher
+}
+
+// parseHeadingLevelArg parses the headings transform's argument: the
+// chapter level (default 2), and "bold" to infer headings from bold
+// paragraphs, joined with +, as in "2+bold".
+func parseHeadingLevelArg(arg string, d HeadingDetector) (headingLevelOptions, error) {
+	opts := headingLevelOptions{chapter: 2}
+	var err error
+	if opts.matcher, err = d.compile(); err != nil {
+		return opts, err
+	}
+	if arg == "" {
+		return opts, nil
+	}
+	for _, part := range strings.Split(arg, "+") {
+		if part == "bold" {
+			opts.bold = true
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 || n > 6 {
+			return opts, fmt.Errorf("invalid heading level %q (want 1–6, optionally +bold)", part)
+		}
+		opts.chapter = n
+	}
+	return opts, nil
+}
+
+// volumeTitlePattern matches the titles of volumes and parts, which are
+// set a level above chapter titles.
+var volumeTitlePattern = regexp.MustCompile(`(?i)^(?:volume|vol\.|book|part)\s*(?:[0-9]+|[ivxlc]+|one|two|three|four|five|six|seven|eight|nine|ten)\b|^第[0-9０-９〇一二三四五六七八九十百]+[巻部]`)
+
+// blockInHeading lists elements a heading cannot hold; a candidate that
+// has one is a container, not a title.
+var blockInHeading = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "table": true,
+	"ul": true, "ol": true, "blockquote": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// levelHeading is a heading found by normalizeHeadingLevels.
+type levelHeading struct {
+	start, end int // token indexes of its tags
+	name       string
+	rank       int
+	volume     bool
+	text       string
+}
+
+// normalizeHeadingLevels sets the chapter headings of an XHTML document
+// to one level. The headings the detector finds, and with opts.bold the
+// bold paragraphs that stand in for them, keep their relative order: the
+// document's top heading gets the chapter level and the rest follow below
+// it. Volume and part titles get the level above. It returns nil data when
+// nothing changed.
+func normalizeHeadingLevels(data []byte, opts headingLevelOptions) ([]byte, []TextChange, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+	var toks []rawToken
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		toks = append(toks, rt)
+	}
+
+	var (
+		headings []levelHeading
+		// cur is the candidate being read, with its text so far, the part
+		// of it that is bold, and whether it holds a block element.
+		// leading counts the text before it that is not a heading.
+		cur       *levelHeading
+		depth     int
+		text      strings.Builder
+		boldTxt   strings.Builder
+		boldAll   bool
+		block     bool
+		boldOpen  []bool
+		boldDepth int
+		leading   int
+	)
+	for i, rt := range toks {
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if cur != nil {
+				depth++
+				block = block || blockInHeading[name]
+				b := name == "b" || name == "strong" || boldStyle(attrValue(t.Attr, "style"))
+				boldOpen = append(boldOpen, b)
+				if b {
+					boldDepth++
+				}
+				continue
+			}
+			if opts.matcher.firstOnly && len(headings) > 0 {
+				continue
+			}
+			rank, ok := opts.matcher.candidate(t, leading)
+			if !ok && opts.bold && name == "p" && leading == 0 && isCenteredElement(t) {
+				rank, ok = 0, true
+			}
+			if !ok {
+				continue
+			}
+			cur = &levelHeading{start: i, name: name, rank: rank}
+			depth, block, boldOpen, boldDepth = 0, false, boldOpen[:0], 0
+			boldAll = boldStyle(attrValue(t.Attr, "style"))
+			text.Reset()
+			boldTxt.Reset()
+		case xml.EndElement:
+			if cur == nil {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				if boldOpen[len(boldOpen)-1] {
+					boldDepth--
+				}
+				boldOpen = boldOpen[:len(boldOpen)-1]
+				continue
+			}
+			cur.end = i
+			cur.text = normalizeSpace(text.String())
+			keep := !block && cur.text != ""
+			if cur.rank == 0 {
+				// A bold paragraph: all of its text must be bold.
+				keep = keep && (boldAll || normalizeSpace(boldTxt.String()) == cur.text) && looksLikeHeading(cur.text)
+			} else {
+				keep = keep && opts.matcher.accept(cur.text)
+			}
+			if keep {
+				cur.volume = volumeTitlePattern.MatchString(cur.text)
+				headings = append(headings, *cur)
+			} else {
+				leading += len(strings.TrimSpace(text.String()))
+			}
+			cur = nil
+		case xml.CharData:
+			if cur == nil {
+				leading += len(bytes.TrimSpace(t))
+				continue
+			}
+			text.Write(t)
+			if boldDepth > 0 {
+				boldTxt.Write(t)
+			}
+		}
+	}
+	if len(headings) == 0 {
+		return nil, nil, nil
+	}
+
+	// Bold paragraphs rank with top-level headings.
+	top := 0
+	for i := range headings {
+		if headings[i].rank == 0 {
+			headings[i].rank = 1
+		}
+		if !headings[i].volume && (top == 0 || headings[i].rank < top) {
+			top = headings[i].rank
+		}
+	}
+	rename := map[int]string{}
+	var changes []TextChange
+	for _, h := range headings {
+		level := min(opts.chapter+h.rank-top, 6)
+		if h.volume {
+			level = max(opts.chapter-1, 1)
+		}
+		name := "h" + strconv.Itoa(level)
+		if name == h.name {
+			continue
+		}
+		rename[h.start], rename[h.end] = name, name
+		changes = append(changes, TextChange{
+			Before: fmt.Sprintf("<%s>%s</%s>", h.name, h.text, h.name),
+			After:  fmt.Sprintf("<%s>%s</%s>", name, h.text, name),
+		})
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	for i, rt := range toks {
+		var err error
+		if name, ok := rename[i]; ok {
+			err = sp.writeRaw(string(renameTag(rt.raw, name)))
+		} else {
+			err = sp.copy(rt)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return out.Bytes(), changes, nil
+}
+
+// renameTag returns the source of a start or end tag with its element
+// name replaced. The empty source of a self-closing element's end tag
+// stays empty.
+func renameTag(raw []byte, name string) []byte {
+	start := bytes.IndexByte(raw, '<')
+	if start < 0 {
+		return raw
+	}
+	start++
+	if start < len(raw) && raw[start] == '/' {
+		start++
+	}
+	end := start
+	for end < len(raw) && !isXMLSpace(raw[end]) && raw[end] != '/' && raw[end] != '>' {
+		end++
+	}
+	out := append([]byte(nil), raw[:start]...)
+	out = append(out, name...)
+	return append(out, raw[end:]...)
+}
@@ -0,0 +1,67 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHeadingLevels(t *testing.T) {
+	doc := func(body string) []byte {
+		return []byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body>` + body + `</body></html>`)
+	}
+	opts, err := parseHeadingLevelArg("2+bold", HeadingDetector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct{ in, want string }{
+		{`<h3 id="c1">Chapter 1</h3><p>Text.</p><h5>Aside</h5>`, `<h2 id="c1">Chapter 1</h2><p>Text.</p><h4>Aside</h4>`},
+		{`<h1>Chapter 2</h1><h2>Scene</h2>`, `<h2>Chapter 2</h2><h3>Scene</h3>`},
+		{`<h2>Volume 3</h2><h4>Chapter 1</h4>`, `<h1>Volume 3</h1><h2>Chapter 1</h2>`},
+		{`<p class="center"><b>Chapter 4</b></p><p>Text.</p>`, `<h2 class="center"><b>Chapter 4</b></h2><p>Text.</p>`},
+		// Bold paragraphs after body text, partly bold or ending like a
+		// sentence are left alone.
+		{`<p>Text.</p><p class="center"><b>Not a title</b></p>`, ``},
+		{`<p class="center"><b>Half</b> bold</p>`, ``},
+		{`<p class="center"><b>It was late.</b></p>`, ``},
+		{`<h2>Chapter 5</h2>`, ``},
+	}
+	for _, c := range cases {
+		out, changes, err := normalizeHeadingLevels(doc(c.in), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.want == "" {
+			if out != nil {
+				t.Errorf("%s changed to %s", c.in, out)
+			}
+			continue
+		}
+		if string(out) != string(doc(c.want)) {
+			t.Errorf("%s\n got %s\nwant %s", c.in, out, doc(c.want))
+		}
+		if again, _, _ := normalizeHeadingLevels(out, opts); again != nil {
+			t.Errorf("second run changed %s to %s", out, again)
+		}
+		if len(changes) == 0 || !strings.HasPrefix(changes[0].Before, "<") {
+			t.Errorf("changes = %+v", changes)
+		}
+	}
+
+	byClass, err := parseHeadingLevelArg("1", HeadingDetector{Selectors: []string{"p.chapter-title", "h1", "h2", "h3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := normalizeHeadingLevels(doc(`<p class="chapter-title">One</p><h3>Part</h3>`), byClass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := doc(`<h1 class="chapter-title">One</h1><h3>Part</h3>`); string(out) != string(want) {
+		t.Errorf("got %s\nwant %s", out, want)
+	}
+
+	for _, bad := range []string{"0", "7", "bold+x"} {
+		if _, err := parseHeadingLevelArg(bad, HeadingDetector{}); err == nil {
+			t.Errorf("argument %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// HeadingDetector decides which elements of a spine document are chapter
+// headings. Every command that needs chapters (toc and the commands built
+// on it) shares one detector, so a book's conventions are described once,
+// usually in a JSON file loaded with LoadHeadingDetector. The zero value
+// takes every h1–h6 element with text.
+type HeadingDetector struct {
+	// Selectors lists the candidate elements as tag, .class or tag.class
+	// (default h1–h6). h1–h6 keep their own level; any other element is a
+	// top-level heading.
+	Selectors []string `json:"selectors,omitempty"`
+	// Match and Exclude are regular expressions on a candidate's text: it
+	// is kept when it matches Match (if set) and not Exclude (if set).
+	Match   string `json:"match,omitempty"`
+	Exclude string `json:"exclude,omitempty"`
+	// MaxLength drops candidates with more characters than this, which are
+	// usually styled paragraphs rather than titles.
+	MaxLength int `json:"max_length,omitempty"`
+	// MaxLeadingText drops candidates with more than this many characters
+	// of body text before them in their document; chapter titles come
+	// first. Zero disables the check.
+	MaxLeadingText int `json:"max_leading_text,omitempty"`
+	// FirstPerDocument keeps at most one heading per document, the first
+	// one that passes the other rules.
+	FirstPerDocument bool `json:"first_per_document,omitempty"`
+}
+
+// LoadHeadingDetector reads a HeadingDetector from a JSON file and checks
+// that it compiles.
+func LoadHeadingDetector(path string) (HeadingDetector, error) {
+	var d HeadingDetector
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return d, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&d); err != nil {
+		return d, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := d.compile(); err != nil {
+		return d, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+type headingMatcher struct {
+	selectors      []compiledSelector
+	match, exclude *regexp.Regexp
+	maxLength      int
+	maxLeading     int
+	firstOnly      bool
+}
+
+func (d HeadingDetector) compile() (*headingMatcher, error) {
+	m := &headingMatcher{
+		selectors:  parseSelectors(d.Selectors),
+		maxLength:  d.MaxLength,
+		maxLeading: d.MaxLeadingText,
+		firstOnly:  d.FirstPerDocument,
+	}
+	if d.MaxLength < 0 || d.MaxLeadingText < 0 {
+		return nil, fmt.Errorf("heading lengths must not be negative")
+	}
+	var err error
+	if m.match, err = compileOptionalRegexp(d.Match); err != nil {
+		return nil, fmt.Errorf("heading match pattern: %w", err)
+	}
+	if m.exclude, err = compileOptionalRegexp(d.Exclude); err != nil {
+		return nil, fmt.Errorf("heading exclude pattern: %w", err)
+	}
+	return m, nil
+}
+
+// candidate returns the level of el if it may be a heading.
+func (m *headingMatcher) candidate(el xml.StartElement, leading int) (int, bool) {
+	if m.maxLeading > 0 && leading > m.maxLeading {
+		return 0, false
+	}
+	lvl := headingLevel(strings.ToLower(el.Name.Local))
+	if len(m.selectors) == 0 {
+		return lvl, lvl > 0
+	}
+	if !matchSelectors(m.selectors, el) {
+		return 0, false
+	}
+	return max(lvl, 1), true
+}
+
+// accept reports whether a candidate with the given normalized text is a
+// heading.
+func (m *headingMatcher) accept(title string) bool {
+	switch {
+	case title == "":
+		return false
+	case m.maxLength > 0 && utf8.RuneCountInString(title) > m.maxLength:
+		return false
+	case m.match != nil && !m.match.MatchString(title):
+		return false
+	case m.exclude != nil && m.exclude.MatchString(title):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHeadingDetector(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.xhtml")
+	doc := `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Book</title></head><body>
+<p class="chapter-title">Chapter 1</p>
+<h2>Summary of the previous volume, which is rather long</h2>
+<p>Body text that pushes later candidates down the page.</p>
+<p class="chapter-title">Chapter 2</p>
+<h3 id="s">Contents</h3>
+</body></html>`
+	if err := os.WriteFile(src, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	titles := func(d HeadingDetector) []string {
+		t.Helper()
+		m, err := d.compile()
+		if err != nil {
+			t.Fatalf("compile: %v", err)
+		}
+		found, _, err := scanHeadings(src, "a.xhtml", m, false)
+		if err != nil {
+			t.Fatalf("scanHeadings: %v", err)
+		}
+		var out []string
+		for _, h := range found {
+			out = append(out, h.title)
+		}
+		return out
+	}
+
+	cases := []struct {
+		name string
+		d    HeadingDetector
+		want []string
+	}{
+		{"default", HeadingDetector{}, []string{"Summary of the previous volume, which is rather long", "Contents"}},
+		{"selectors", HeadingDetector{Selectors: []string{"p.chapter-title", "h3"}}, []string{"Chapter 1", "Chapter 2", "Contents"}},
+		{"exclude", HeadingDetector{Selectors: []string{"p.chapter-title", "h2", "h3"}, Exclude: "^Contents$", MaxLength: 20}, []string{"Chapter 1", "Chapter 2"}},
+		{"match", HeadingDetector{Selectors: []string{"p", "h2"}, Match: `^Chapter \d+$`}, []string{"Chapter 1", "Chapter 2"}},
+		{"leading", HeadingDetector{Selectors: []string{".chapter-title"}, MaxLeadingText: 20}, []string{"Chapter 1"}},
+		{"first", HeadingDetector{Selectors: []string{"h2", "h3"}, FirstPerDocument: true}, []string{"Summary of the previous volume, which is rather long"}},
+	}
+	for _, c := range cases {
+		if got := titles(c.d); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: headings = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	path := filepath.Join(dir, "headings.json")
+	if err := os.WriteFile(path, []byte(`{"selectors": ["p.chapter-title"], "max_length": 40}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadHeadingDetector(path)
+	if err != nil {
+		t.Fatalf("LoadHeadingDetector: %v", err)
+	}
+	if !reflect.DeepEqual(d, HeadingDetector{Selectors: []string{"p.chapter-title"}, MaxLength: 40}) {
+		t.Fatalf("loaded %+v", d)
+	}
+	for _, bad := range []string{`{"selector": "h1"}`, `{"match": "("}`} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadHeadingDetector(path); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
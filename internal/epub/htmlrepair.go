@@ -0,0 +1,563 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// MarkupRepair is a content document that was not well-formed XHTML and
+// was parsed as HTML and written back as XHTML.
+type MarkupRepair struct {
+	Href string `json:"href"`
+	// Problem is the first error an XML parser reports for the original.
+	Problem string `json:"problem"`
+}
+
+// checkWellFormed parses data as strict XML, the way XHTML reading
+// systems do.
+func checkWellFormed(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if _, err := dec.Token(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// repairContentMarkup repairs, in the extracted book, the XHTML documents
+// of vol that include accepts and that do not parse as XML, and records
+// them in cs. Well-formed documents are not touched.
+func repairContentMarkup(ctx context.Context, vol *Volume, include func(href string) bool, cs *Changeset) ([]MarkupRepair, error) {
+	var repairs []MarkupRepair
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return repairs, err
+		}
+		if item.MediaType != "application/xhtml+xml" || (include != nil && !include(item.Href)) {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return repairs, err
+		}
+		problem := checkWellFormed(data)
+		if problem == nil {
+			continue
+		}
+		fixed := repairHTML(data)
+		if err := checkWellFormed(fixed); err != nil {
+			return repairs, fmt.Errorf("%s: repair failed: %w", item.Href, err)
+		}
+		if err := os.WriteFile(src, fixed, 0o644); err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, MarkupRepair{Href: item.Href, Problem: problem.Error()})
+		cs.modified(item.Href)
+	}
+	return repairs, nil
+}
+
+// htmlVoidElements never have content; HTML writes them without an end
+// tag.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// htmlClosesP are the start tags that end an open paragraph.
+var htmlClosesP = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"details": true, "div": true, "dl": true, "fieldset": true,
+	"figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "main": true, "nav": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "ul": true,
+}
+
+// htmlScopeBoundaries stop the search for an element a start tag
+// implicitly ends.
+var htmlScopeBoundaries = map[string]bool{
+	"html": true, "body": true, "table": true, "td": true, "th": true,
+	"caption": true, "button": true, "object": true, "template": true,
+}
+
+// htmlImpliedEnds lists, for start tags that end an open element of
+// their own kind, the elements they end and the containers that stop the
+// search.
+var htmlImpliedEnds = map[string]struct{ ends, stops []string }{
+	"li":     {[]string{"li"}, []string{"ul", "ol"}},
+	"dt":     {[]string{"dt", "dd"}, []string{"dl"}},
+	"dd":     {[]string{"dt", "dd"}, []string{"dl"}},
+	"tr":     {[]string{"tr", "td", "th"}, []string{"thead", "tbody", "tfoot"}},
+	"td":     {[]string{"td", "th"}, []string{"tr"}},
+	"th":     {[]string{"td", "th"}, []string{"tr"}},
+	"option": {[]string{"option"}, []string{"select", "datalist"}},
+	"rt":     {[]string{"rt", "rp"}, []string{"ruby"}},
+	"rp":     {[]string{"rt", "rp"}, []string{"ruby"}},
+}
+
+// repairHTML parses a document the way a forgiving HTML parser would and
+// writes it back as well-formed XHTML: bare ampersands and angle brackets
+// are escaped, HTML named entities become character references,
+// attributes are quoted, void elements are self-closed, elements HTML
+// ends implicitly (paragraphs, list items, table cells) are closed, stray
+// end tags are dropped and everything left open is closed at the end.
+// Comments, the doctype and processing instructions are kept; other
+// markup declarations become comments, as in HTML.
+func repairHTML(data []byte) []byte {
+	r := &htmlRepairer{src: validXMLText(data)}
+	r.run()
+	return []byte(r.out.String())
+}
+
+type htmlRepairer struct {
+	src  string
+	i    int
+	out  strings.Builder
+	open []string
+}
+
+func (r *htmlRepairer) run() {
+	for r.i < len(r.src) {
+		j := strings.IndexByte(r.src[r.i:], '<')
+		if j < 0 {
+			r.text(r.src[r.i:])
+			break
+		}
+		r.text(r.src[r.i : r.i+j])
+		r.i += j
+		r.markup()
+	}
+	for len(r.open) > 0 {
+		r.pop()
+	}
+}
+
+// markup handles the construct at r.i, which starts with '<'.
+func (r *htmlRepairer) markup() {
+	rest := r.src[r.i:]
+	switch {
+	case strings.HasPrefix(rest, "<!--"):
+		body, n := cutThrough(rest[4:], "-->")
+		r.comment(body)
+		r.i += 4 + n
+	case strings.HasPrefix(rest, "<![CDATA["):
+		body, n := cutThrough(rest[9:], "]]>")
+		r.out.WriteString("<![CDATA[" + body + "]]>")
+		r.i += 9 + n
+	case len(rest) >= 9 && strings.EqualFold(rest[:9], "<!doctype"):
+		k := strings.IndexByte(rest, '>')
+		if k < 0 {
+			r.out.WriteString("&lt;")
+			r.i++
+			return
+		}
+		r.out.WriteString(rest[:k+1])
+		r.i += k + 1
+	case strings.HasPrefix(rest, "<!"):
+		// Anything else, such as Word's <![if !supportLists]> and
+		// <![endif]>, is a bogus comment running to the next '>'.
+		body, n := cutThrough(rest[2:], ">")
+		r.comment(body)
+		r.i += 2 + n
+	case strings.HasPrefix(rest, "<?"):
+		k := strings.Index(rest, "?>")
+		if k < 0 {
+			r.out.WriteString("&lt;")
+			r.i++
+			return
+		}
+		r.out.WriteString(rest[:k+2])
+		r.i += k + 2
+	case len(rest) > 2 && rest[1] == '/' && isASCIILetter(rest[2]):
+		k := strings.IndexByte(rest, '>')
+		if k < 0 {
+			k = len(rest) - 1
+		}
+		name, _ := readTagName(rest[2:])
+		r.i += k + 1
+		r.endTag(name)
+	case len(rest) > 1 && isASCIILetter(rest[1]):
+		r.startTag()
+	default:
+		r.out.WriteString("&lt;")
+		r.i++
+	}
+}
+
+// comment writes a comment with the given body.
+func (r *htmlRepairer) comment(body string) {
+	// XML forbids "--" inside a comment and a comment ending in "-".
+	body = strings.ReplaceAll(body, "--", "- -")
+	if strings.HasSuffix(body, "-") {
+		body += " "
+	}
+	r.out.WriteString("<!--" + body + "-->")
+}
+
+// cutThrough returns s up to end and the length consumed including end,
+// or all of s when end is missing.
+func cutThrough(s, end string) (string, int) {
+	k := strings.Index(s, end)
+	if k < 0 {
+		return s, len(s)
+	}
+	return s[:k], k + len(end)
+}
+
+func (r *htmlRepairer) startTag() {
+	s := r.src
+	name, n := readTagName(s[r.i+1:])
+	j := r.i + 1 + n
+	var (
+		attrs       []xml.Attr
+		selfClosing bool
+	)
+	for j < len(s) {
+		c := s[j]
+		switch {
+		case isXMLSpace(c):
+			j++
+			continue
+		case c == '>':
+			j++
+		case c == '/' && j+1 < len(s) && s[j+1] == '>':
+			selfClosing = true
+			j += 2
+		case c == '/':
+			j++
+			continue
+		default:
+			var a xml.Attr
+			a, j = readAttr(s, j)
+			if isXMLName(a.Name.Local) && !hasAttr(attrs, a.Name.Local) {
+				attrs = append(attrs, a)
+			}
+			continue
+		}
+		break
+	}
+	r.i = j
+
+	lname := strings.ToLower(name)
+	r.closeImplied(lname)
+	if lname == "html" && len(r.open) == 0 {
+		if !hasAttr(attrs, "xmlns:epub") && strings.Contains(s, "epub:") {
+			attrs = append([]xml.Attr{{Name: xml.Name{Local: "xmlns:epub"}, Value: "http://www.idpf.org/2007/ops"}}, attrs...)
+		}
+		if !hasAttr(attrs, "xmlns") {
+			attrs = append([]xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://www.w3.org/1999/xhtml"}}, attrs...)
+		}
+	}
+	r.out.WriteString("<" + name)
+	for _, a := range attrs {
+		r.out.WriteString(" " + a.Name.Local + `="` + a.Value + `"`)
+	}
+	if selfClosing || htmlVoidElements[lname] {
+		r.out.WriteString("/>")
+		return
+	}
+	r.out.WriteString(">")
+	r.open = append(r.open, name)
+	if lname == "script" || lname == "style" {
+		r.rawText(lname)
+	}
+}
+
+// rawText copies the content of a script or style element, which HTML
+// does not parse for markup.
+func (r *htmlRepairer) rawText(lname string) {
+	rest := r.src[r.i:]
+	k := strings.Index(strings.ToLower(rest), "</"+lname)
+	if k < 0 {
+		k = len(rest)
+	}
+	body := rest[:k]
+	r.i += k
+	switch {
+	case strings.Contains(body, "<![CDATA["):
+		r.out.WriteString(body)
+	case strings.ContainsRune(body, '<') || fixReferences(body) != body:
+		r.out.WriteString("<![CDATA[" + strings.ReplaceAll(body, "]]>", "]]]]><![CDATA[>") + "]]>")
+	default:
+		r.out.WriteString(body)
+	}
+}
+
+// closeImplied ends the open elements that a start tag for lname ends in
+// HTML.
+func (r *htmlRepairer) closeImplied(lname string) {
+	if htmlClosesP[lname] {
+		r.closeInScope([]string{"p"}, nil)
+	}
+	if rule, ok := htmlImpliedEnds[lname]; ok {
+		r.closeInScope(rule.ends, rule.stops)
+	}
+	if len(lname) == 2 && lname[0] == 'h' && lname[1] >= '1' && lname[1] <= '6' && len(r.open) > 0 {
+		top := strings.ToLower(r.open[len(r.open)-1])
+		if len(top) == 2 && top[0] == 'h' && top[1] >= '1' && top[1] <= '6' {
+			r.pop()
+		}
+	}
+}
+
+// closeInScope closes the innermost open element named in ends, and
+// everything opened inside it, unless a scope boundary or an element in
+// stops comes first.
+func (r *htmlRepairer) closeInScope(ends, stops []string) {
+	for k := len(r.open) - 1; k >= 0; k-- {
+		lname := strings.ToLower(r.open[k])
+		if containsString(ends, lname) {
+			for len(r.open) > k {
+				r.pop()
+			}
+			return
+		}
+		if htmlScopeBoundaries[lname] || containsString(stops, lname) {
+			return
+		}
+	}
+}
+
+// endTag closes the innermost open element with the name, and everything
+// opened inside it. An end tag with no open element is dropped. The root
+// element stays open until the end, so that content after it, which HTML
+// moves into the body, does not start a second root.
+func (r *htmlRepairer) endTag(name string) {
+	for k := len(r.open) - 1; k > 0; k-- {
+		if strings.EqualFold(r.open[k], name) {
+			for len(r.open) > k {
+				r.pop()
+			}
+			return
+		}
+	}
+}
+
+func (r *htmlRepairer) pop() {
+	n := len(r.open) - 1
+	r.out.WriteString("</" + r.open[n] + ">")
+	r.open = r.open[:n]
+}
+
+func (r *htmlRepairer) text(s string) {
+	r.out.WriteString(strings.ReplaceAll(fixReferences(s), ">", "&gt;"))
+}
+
+// readTagName reads an element name and returns it with the number of
+// bytes it took. Characters XML does not allow in names are dropped.
+func readTagName(s string) (string, int) {
+	n := 0
+	for n < len(s) && !isXMLSpace(s[n]) && s[n] != '/' && s[n] != '>' {
+		n++
+	}
+	return xmlNameChars(s[:n]), n
+}
+
+// readAttr reads one attribute at s[j:] and returns it with the offset
+// after it. A value is quoted, unquoted or missing; a missing value
+// repeats the name, as XHTML writes boolean attributes.
+func readAttr(s string, j int) (xml.Attr, int) {
+	k := j
+	for k < len(s) && !isXMLSpace(s[k]) && s[k] != '=' && s[k] != '>' && !(s[k] == '/' && k+1 < len(s) && s[k+1] == '>') {
+		k++
+	}
+	if k == j {
+		// A lone '=' or another character that cannot start a name.
+		k++
+	}
+	name := s[j:k]
+	j = k
+	for j < len(s) && isXMLSpace(s[j]) {
+		j++
+	}
+	if j >= len(s) || s[j] != '=' {
+		return xml.Attr{Name: xml.Name{Local: name}, Value: attrEscape(name)}, j
+	}
+	j++
+	for j < len(s) && isXMLSpace(s[j]) {
+		j++
+	}
+	var value string
+	switch {
+	case j < len(s) && (s[j] == '"' || s[j] == '\''):
+		q := s[j]
+		end := strings.IndexByte(s[j+1:], q)
+		if end < 0 {
+			// An unterminated quote runs to the end of the tag.
+			end = strings.IndexByte(s[j+1:], '>')
+			if end < 0 {
+				end = len(s) - j - 1
+			}
+			value, j = s[j+1:j+1+end], j+1+end
+		} else {
+			value, j = s[j+1:j+1+end], j+2+end
+		}
+	default:
+		k := j
+		for k < len(s) && !isXMLSpace(s[k]) && s[k] != '>' {
+			k++
+		}
+		value, j = s[j:k], k
+	}
+	return xml.Attr{Name: xml.Name{Local: name}, Value: attrEscape(value)}, j
+}
+
+// attrEscape fixes the references in a raw attribute value and escapes
+// what a double-quoted XML attribute cannot hold.
+func attrEscape(v string) string {
+	return strings.NewReplacer("<", "&lt;", `"`, "&quot;").Replace(fixReferences(v))
+}
+
+func hasAttr(attrs []xml.Attr, name string) bool {
+	for _, a := range attrs {
+		if a.Name.Local == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fixReferences escapes every ampersand that does not start a reference
+// XML understands. HTML named entities become numeric references and
+// numeric references to characters XML cannot hold become U+FFFD.
+func fixReferences(s string) string {
+	if !strings.Contains(s, "&") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		k := strings.IndexByte(s, '&')
+		if k < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:k])
+		s = s[k:]
+		end := strings.IndexByte(s, ';')
+		if end < 0 || end > 32 {
+			b.WriteString("&amp;")
+			s = s[1:]
+			continue
+		}
+		ref := s[1:end]
+		switch {
+		case ref == "amp" || ref == "lt" || ref == "gt" || ref == "quot" || ref == "apos":
+			b.WriteString(s[:end+1])
+		case strings.HasPrefix(ref, "#"):
+			c, ok := parseCharRef(ref[1:])
+			if !ok {
+				b.WriteString("&amp;")
+				s = s[1:]
+				continue
+			}
+			if !isXMLChar(c) {
+				c = utf8.RuneError
+			}
+			fmt.Fprintf(&b, "&#%d;", c)
+		case xml.HTMLEntity[ref] != "":
+			for _, c := range xml.HTMLEntity[ref] {
+				fmt.Fprintf(&b, "&#%d;", c)
+			}
+		default:
+			b.WriteString("&amp;")
+			s = s[1:]
+			continue
+		}
+		s = s[end+1:]
+	}
+}
+
+func parseCharRef(ref string) (rune, bool) {
+	base := 10
+	if strings.HasPrefix(ref, "x") || strings.HasPrefix(ref, "X") {
+		base, ref = 16, ref[1:]
+	}
+	if ref == "" {
+		return 0, false
+	}
+	var c int64
+	for _, d := range ref {
+		var v int64
+		switch {
+		case d >= '0' && d <= '9':
+			v = int64(d - '0')
+		case base == 16 && d >= 'a' && d <= 'f':
+			v = int64(d-'a') + 10
+		case base == 16 && d >= 'A' && d <= 'F':
+			v = int64(d-'A') + 10
+		default:
+			return 0, false
+		}
+		c = c*int64(base) + v
+		if c > utf8.MaxRune {
+			return utf8.RuneError, true
+		}
+	}
+	return rune(c), true
+}
+
+// validXMLText returns data as valid UTF-8 without the control characters
+// XML does not allow.
+func validXMLText(data []byte) string {
+	s := strings.ToValidUTF8(string(data), "\uFFFD")
+	return strings.Map(func(c rune) rune {
+		if isXMLChar(c) {
+			return c
+		}
+		return -1
+	}, s)
+}
+
+func isXMLChar(c rune) bool {
+	return c == 0x09 || c == 0x0A || c == 0x0D ||
+		c >= 0x20 && c <= 0xD7FF ||
+		c >= 0xE000 && c <= 0xFFFD ||
+		c >= 0x10000 && c <= 0x10FFFF
+}
+
+// xmlNameChars drops the characters XML does not allow in a name.
+func xmlNameChars(s string) string {
+	return strings.Map(func(c rune) rune {
+		if isXMLNameChar(c) {
+			return c
+		}
+		return -1
+	}, s)
+}
+
+func isXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !isXMLNameChar(c) || i == 0 && (c == '-' || c == '.' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isXMLNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == ':' || c == '-' || c == '.' || c >= 0xC0 && c != 0xD7 && c != 0xF7
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,70 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepairHTML(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`<p>Fish & chips</p>`, `<p>Fish &amp; chips</p>`},
+		{`<p>a&nbsp;b &copy; &amp; &#8212; &#0; &bogus;</p>`, `<p>a&#160;b &#169; &amp; &#8212; &#65533; &amp;bogus;</p>`},
+		{`<p>one<p>two<div>three</div>`, `<p>one</p><p>two</p><div>three</div>`},
+		{`<ul><li>a<li>b</ul>`, `<ul><li>a</li><li>b</li></ul>`},
+		{`<p>line<br>next<img src=a.png alt>`, `<p>line<br/>next<img src="a.png" alt="alt"/></p>`},
+		{`<p class='x' class="y" id=a"b>t</span></p>`, `<p class="x" id="a&quot;b">t</p>`},
+		{`<p>1 < 2 <em>yes</p>`, `<p>1 &lt; 2 <em>yes</em></p>`},
+		{`<!-- a -- b --><p>x</p>`, `<!-- a - - b --><p>x</p>`},
+		// Word's HTML export marks list numbers with downlevel-revealed
+		// conditionals, which HTML reads as bogus comments.
+		{`<p><![if !supportLists]>1.<![endif]>Item</p>`, `<p><!--[if !supportLists]-->1.<!--[endif]-->Item</p>`},
+		{`<!><!ELEMENT x--><p>x</p>`, `<!----><!--ELEMENT x- - --><p>x</p>`},
+		{`<!doctype html><p>x</p>`, `<!doctype html><p>x</p>`},
+		{`<style>p > a { x: "&" }</style>`, `<style><![CDATA[p > a { x: "&" }]]></style>`},
+		{`<html><body><p>x</body></html><p>after`, `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>x</p></body><p>after</p></html>`},
+	}
+	for _, c := range cases {
+		got := string(repairHTML([]byte(c.in)))
+		if got != c.want {
+			t.Errorf("repairHTML(%q)\n got %q\nwant %q", c.in, got, c.want)
+		}
+		if err := checkWellFormed([]byte(got)); err != nil {
+			t.Errorf("repairHTML(%q) is not well-formed: %v", c.in, err)
+		}
+	}
+}
+
+func TestRewriteRepairHTML(t *testing.T) {
+	input := buildTestEPUB(t, "Sloppy", "en")
+	broken := filepath.Join(t.TempDir(), "broken.epub")
+	copyZip(t, input, broken, map[string]string{
+		"OEBPS/chapter.xhtml": `<html><body><p>Tom & Jerry<br><p>Chapter 1</body></html>`,
+	})
+	stats, err := RewriteEPUB(context.Background(), broken, RewriteOptions{
+		Scope:      RewriteScopeBody,
+		Rules:      []RewriteRule{{Find: "Chapter", Replace: "Section"}},
+		RepairHTML: true,
+	})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if len(stats.RepairedHTML) != 1 || stats.RepairedHTML[0].Href != "chapter.xhtml" || stats.MatchCount != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, broken)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "chapter.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWellFormed(data); err != nil || !strings.Contains(string(data), "<p>Tom &amp; Jerry<br/></p><p>Section 1</p>") {
+		t.Fatalf("chapter = %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,187 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// identifierSchemes are the schemes -remove-identifier accepts by name.
+var identifierSchemes = []string{"isbn", "issn", "uuid", "doi", "urn", "uri"}
+
+var (
+	uuidRE = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	isbnRE = regexp.MustCompile(`(?i)^(?:isbn[:\s]*)?([0-9][0-9\- ]{8,15}[0-9x])$`)
+)
+
+// identifierScheme returns the scheme of an identifier: isbn, issn, uuid,
+// doi, urn or uri, its EPUB 2 opf:scheme in lower case, or "".
+func identifierScheme(dc DCMeta) string {
+	v := strings.ToLower(strings.TrimSpace(dc.Value))
+	switch {
+	case strings.HasPrefix(v, "urn:isbn:"), isbnDigits(v) != "":
+		return "isbn"
+	case strings.HasPrefix(v, "urn:issn:"):
+		return "issn"
+	case strings.HasPrefix(v, "urn:uuid:"), uuidRE.MatchString(v):
+		return "uuid"
+	case strings.HasPrefix(v, "doi:"), strings.HasPrefix(v, "https://doi.org/"), strings.HasPrefix(v, "http://dx.doi.org/"):
+		return "doi"
+	case dc.Scheme != "":
+		return strings.ToLower(dc.Scheme)
+	case strings.HasPrefix(v, "urn:"):
+		return "urn"
+	case strings.Contains(v, "://"):
+		return "uri"
+	}
+	return ""
+}
+
+// isbnDigits returns the digits of an ISBN-10 or ISBN-13 written with
+// optional hyphens or spaces and "ISBN" prefix, or "" when s is not one.
+func isbnDigits(s string) string {
+	m := isbnRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return ""
+	}
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(m[1]))
+	if len(digits) != 10 && len(digits) != 13 || len(digits) == 13 && strings.HasSuffix(digits, "X") {
+		return ""
+	}
+	return digits
+}
+
+// validISBN reports whether the check digit of an ISBN from isbnDigits is
+// right.
+func validISBN(digits string) bool {
+	sum := 0
+	if len(digits) == 10 {
+		for i, r := range digits {
+			d := int(r - '0')
+			if r == 'X' {
+				if i != 9 {
+					return false
+				}
+				d = 10
+			}
+			sum += d * (10 - i)
+		}
+		return sum%11 == 0
+	}
+	for i, r := range digits {
+		d := int(r - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// NormalizeIdentifier writes a bare ISBN or UUID as a URN and checks the
+// ISBN's check digit; other identifiers are returned trimmed.
+func NormalizeIdentifier(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("identifier is empty")
+	}
+	lower := strings.ToLower(s)
+	if digits := isbnDigits(strings.TrimPrefix(lower, "urn:isbn:")); digits != "" {
+		if !validISBN(digits) {
+			return "", fmt.Errorf("ISBN %q has a wrong check digit", s)
+		}
+		return "urn:isbn:" + digits, nil
+	}
+	if uuidRE.MatchString(s) {
+		return "urn:uuid:" + lower, nil
+	}
+	return s, nil
+}
+
+// epub2Scheme is the opf:scheme EPUB 2 readers expect for a scheme.
+func epub2Scheme(scheme string) string {
+	switch scheme {
+	case "isbn", "issn", "uuid", "doi", "uri":
+		return strings.ToUpper(scheme)
+	}
+	return ""
+}
+
+// addIdentifier adds an identifier to pkg unless it has it, and reports
+// whether it did.
+func addIdentifier(pkg *PackageDocument, value string) bool {
+	for _, dc := range pkg.Metadata.Identifiers {
+		if strings.EqualFold(strings.TrimSpace(dc.Value), value) {
+			return false
+		}
+	}
+	dc := DCMeta{Value: value}
+	if !strings.HasPrefix(pkg.Version, "3") {
+		dc.Scheme = epub2Scheme(identifierScheme(dc))
+	}
+	pkg.Metadata.Identifiers = append(pkg.Metadata.Identifiers, dc)
+	return true
+}
+
+// removeIdentifiers removes the identifiers of pkg with the scheme spec
+// names, such as "isbn", or else with the value spec. The package's
+// unique identifier cannot be removed.
+func removeIdentifiers(pkg *PackageDocument, spec string) (int, error) {
+	spec = strings.TrimSpace(spec)
+	byScheme := containsString(identifierSchemes, strings.ToLower(spec))
+	value := spec
+	if !byScheme {
+		if v, err := NormalizeIdentifier(spec); err == nil {
+			value = v
+		}
+	}
+	kept := pkg.Metadata.Identifiers[:0]
+	removed := 0
+	for _, dc := range pkg.Metadata.Identifiers {
+		match := byScheme && identifierScheme(dc) == strings.ToLower(spec) ||
+			!byScheme && (strings.EqualFold(strings.TrimSpace(dc.Value), value) || strings.EqualFold(strings.TrimSpace(dc.Value), spec))
+		if !match {
+			kept = append(kept, dc)
+			continue
+		}
+		if dc.ID != "" && dc.ID == pkg.UniqueIdentifier {
+			return 0, fmt.Errorf("%s is the book's unique identifier; change it with -identifier or -new-uuid instead", dc.Value)
+		}
+		removed++
+	}
+	pkg.Metadata.Identifiers = kept
+	return removed, nil
+}
+
+// setPrimaryIdentifier sets the value of the package's unique identifier.
+func setPrimaryIdentifier(pkg *PackageDocument, value string) {
+	ensureUniqueIdentifier(pkg)
+	for i, dc := range pkg.Metadata.Identifiers {
+		if dc.ID == pkg.UniqueIdentifier {
+			pkg.Metadata.Identifiers[i].Value = value
+			if !strings.HasPrefix(pkg.Version, "3") {
+				pkg.Metadata.Identifiers[i].Scheme = epub2Scheme(identifierScheme(DCMeta{Value: value}))
+			}
+			return
+		}
+	}
+}
+
+// ensureUniqueIdentifier makes the package's unique-identifier attribute
+// name one of its identifiers: the first, given an id if it has none, or
+// a new UUID when there are none.
+func ensureUniqueIdentifier(pkg *PackageDocument) {
+	meta := &pkg.Metadata
+	for _, dc := range meta.Identifiers {
+		if dc.ID != "" && dc.ID == pkg.UniqueIdentifier {
+			return
+		}
+	}
+	if len(meta.Identifiers) == 0 {
+		meta.Identifiers = []DCMeta{{Value: randomURN()}}
+	}
+	if meta.Identifiers[0].ID == "" {
+		meta.Identifiers[0].ID = newMetadataID(metadataIDs(meta), "bookid")
+	}
+	pkg.UniqueIdentifier = meta.Identifiers[0].ID
+}
@@ -0,0 +1,84 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"978-4-04-000000-8":                    "urn:isbn:9784040000008",
+		"ISBN 0-8044-2957-X":                   "urn:isbn:080442957X",
+		"urn:isbn:9784040000008":               "urn:isbn:9784040000008",
+		"0F1E2D3C-4B5A-4978-8695-A4B3C2D1E0F0": "urn:uuid:0f1e2d3c-4b5a-4978-8695-a4b3c2d1e0f0",
+		" https://example.com/book ":           "https://example.com/book",
+	}
+	for in, want := range tests {
+		if got, err := NormalizeIdentifier(in); err != nil || got != want {
+			t.Errorf("NormalizeIdentifier(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := NormalizeIdentifier("978-4-04-000000-3"); err == nil {
+		t.Error("expected a bad ISBN check digit to be rejected")
+	}
+}
+
+func TestEditIdentifiers(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Title", "en")
+	load := func() *PackageDocument {
+		t.Helper()
+		vol, err := loadVolume(ctx, 0, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.RemoveAll(vol.TempDir)
+		return vol.PackageDoc
+	}
+	edit := func(opts EditOptions) error {
+		_, err := EditEPUB(ctx, input, opts)
+		return err
+	}
+
+	if err := edit(EditOptions{AddIdentifiers: []string{"9784040000008", "doi:10.1000/182"}}); err != nil {
+		t.Fatal(err)
+	}
+	pkg := load()
+	if len(pkg.Metadata.Identifiers) != 3 || pkg.Metadata.Identifiers[1].Value != "urn:isbn:9784040000008" {
+		t.Fatalf("identifiers = %+v", pkg.Metadata.Identifiers)
+	}
+
+	if err := edit(EditOptions{RemoveIdentifiers: []string{"isbn"}, NewUUID: true}); err != nil {
+		t.Fatal(err)
+	}
+	pkg = load()
+	if len(pkg.Metadata.Identifiers) != 2 || identifierScheme(pkg.Metadata.Identifiers[1]) != "doi" {
+		t.Fatalf("identifiers = %+v", pkg.Metadata.Identifiers)
+	}
+	if id := primaryIdentifier(pkg); !strings.HasPrefix(id, "urn:uuid:") || pkg.Metadata.Identifiers[0].ID != pkg.UniqueIdentifier {
+		t.Fatalf("unique identifier = %q (%s)", id, pkg.UniqueIdentifier)
+	}
+
+	if err := edit(EditOptions{RemoveIdentifiers: []string{"uuid"}}); err == nil {
+		t.Fatal("expected removing the unique identifier to fail")
+	}
+	id := "urn:test:x"
+	if err := edit(EditOptions{NewUUID: true, MetadataPatch: MetadataPatch{Identifier: &id}}); err == nil {
+		t.Fatal("expected -identifier with -new-uuid to fail")
+	}
+}
+
+func TestEnsureUniqueIdentifier(t *testing.T) {
+	pkg := &PackageDocument{UniqueIdentifier: "gone", Metadata: Metadata{Identifiers: []DCMeta{{Value: "urn:isbn:9784040000008"}}}}
+	ensureUniqueIdentifier(pkg)
+	if pkg.Metadata.Identifiers[0].ID == "" || pkg.UniqueIdentifier != pkg.Metadata.Identifiers[0].ID {
+		t.Fatalf("unique identifier %q, identifiers %+v", pkg.UniqueIdentifier, pkg.Metadata.Identifiers)
+	}
+	empty := &PackageDocument{}
+	ensureUniqueIdentifier(empty)
+	if !strings.HasPrefix(primaryIdentifier(empty), "urn:uuid:") {
+		t.Fatalf("identifiers = %+v", empty.Metadata.Identifiers)
+	}
+}
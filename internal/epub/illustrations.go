@@ -0,0 +1,123 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Where MergeOptions.IllustrationsAt puts the illustration pages.
+const (
+	// IllustrationsBook gathers every volume's illustrations into one
+	// section at the end of the book.
+	IllustrationsBook = "book"
+	// IllustrationsVolume keeps each volume's illustrations together at
+	// the start of the volume, after its cover page.
+	IllustrationsVolume = "volume"
+)
+
+// illustrationsTitle labels the illustrations in the table of contents.
+const illustrationsTitle = "Illustrations"
+
+// DefaultIllustrationFiles and DefaultIllustrationTypes select the colour
+// plates light-novel volumes open with; MergeOptions.Illustrations usually
+// starts from them.
+var (
+	DefaultIllustrationFiles = []string{`(?i)(?:^|/)[^/]*(?:insert|colou?r|illust|plate|frontispiece|kuchie|gallery)[^/]*\.x?html?$`}
+	DefaultIllustrationTypes = []string{"frontispiece", "illustration", "plate"}
+)
+
+// coverFilePattern matches the file names of cover pages.
+var coverFilePattern = regexp.MustCompile(`(?i)(?:^|/)[^/]*cover[^/]*\.x?html?$`)
+
+// ParseIllustrationsAt checks a MergeOptions.IllustrationsAt value.
+func ParseIllustrationsAt(s string) (string, error) {
+	switch s {
+	case "", IllustrationsBook:
+		return IllustrationsBook, nil
+	case IllustrationsVolume:
+		return IllustrationsVolume, nil
+	}
+	return "", fmt.Errorf("unknown illustrations placement %q (want book or volume)", s)
+}
+
+// gatherIllustrations finds the illustration pages of vol and takes their
+// entries out of its table of contents. With IllustrationsVolume it moves
+// them to the start of the volume, after its cover page, under one
+// "Illustrations" entry; with IllustrationsBook the caller leaves them out
+// of the volume's spine. It returns their hrefs in reading order.
+func gatherIllustrations(vol *Volume, f *compiledMatter, at string, log *slog.Logger) ([]string, error) {
+	pages, err := f.pages(vol)
+	if err != nil || len(pages) == 0 {
+		return nil, err
+	}
+	refs := vol.PackageDoc.Spine.Itemrefs
+	if len(pages) == len(refs) {
+		log.Warn("illustration filters match every page of the volume; leaving it as it is", "volume", vol.SourcePath)
+		return nil, nil
+	}
+	var hrefs []string
+	gathered := map[string]bool{}
+	for _, p := range pages {
+		log.Info("gathering illustration", "volume", vol.SourcePath, "href", p.href, "reason", p.reason)
+		hrefs = append(hrefs, p.href)
+		gathered[p.href] = true
+	}
+	navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+	vol.NavItems = dropNavTargets(vol.NavItems, navDir, gathered)
+	if at != IllustrationsVolume {
+		return hrefs, nil
+	}
+
+	start := 0
+	if first := normalizeEPUBPath(spineHref(vol.PackageDoc, refs[0].IDRef)); !gathered[first] {
+		cover, err := isCoverPage(vol, first)
+		if err != nil {
+			return nil, err
+		}
+		if cover {
+			start = 1
+		}
+	}
+	var edits []SpineEdit
+	for i, p := range pages {
+		edits = append(edits, SpineEdit{Op: SpineMove, IDRef: p.idref, Position: start + i + 1})
+	}
+	if _, err := applySpineEdits(vol, edits, nil); err != nil {
+		return nil, err
+	}
+	entry := NavItem{Title: illustrationsTitle, Href: relativeHref(navDir, hrefs[0])}
+	vol.NavItems = append([]NavItem{entry}, vol.NavItems...)
+	return hrefs, nil
+}
+
+// isCoverPage reports whether the spine document href of vol is its cover
+// page: named or typed cover, or the landmarks' cover.
+func isCoverPage(vol *Volume, href string) (bool, error) {
+	landmarks, err := landmarkTypes(vol)
+	if err != nil {
+		return false, err
+	}
+	f := &compiledMatter{files: []*regexp.Regexp{coverFilePattern}, types: map[string]bool{"cover": true}}
+	reason, err := f.match(vol, href, landmarks[href], nil)
+	return reason != "", err
+}
+
+// dropNavTargets removes the entries pointing at the given documents from
+// a table of contents; their children take their place.
+func dropNavTargets(items []NavItem, navDir string, hrefs map[string]bool) []NavItem {
+	var out []NavItem
+	for _, item := range items {
+		children := dropNavTargets(item.Children, navDir, hrefs)
+		target, _, _ := strings.Cut(strings.TrimSpace(item.Href), "#")
+		if target != "" && !strings.Contains(target, ":") && hrefs[normalizeEPUBPath(path.Join(navDir, target))] {
+			out = append(out, children...)
+			continue
+		}
+		item.Children = children
+		out = append(out, item)
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildIllustratedVolume(t *testing.T, title string) string {
+	t.Helper()
+	page := func(body string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>p</title></head>` + body + `</html>
+`
+	}
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:illustrated</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="cover" href="Text/cover.xhtml" media-type="application/xhtml+xml"/>
+    <item id="toc" href="Text/contents.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ins1" href="Text/insert1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ins2" href="Text/insert2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="plate" href="Text/p050.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="cover"/>
+    <itemref idref="toc"/>
+    <itemref idref="ins1"/>
+    <itemref idref="ins2"/>
+    <itemref idref="ch1"/>
+    <itemref idref="plate"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": page(`<body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/insert1.xhtml">Colour Illustrations</a><ol><li><a href="Text/ch1.xhtml">Chapter</a></li></ol></li></ol></nav>
+</body>`),
+		"OEBPS/Text/cover.xhtml":    page(`<body epub:type="cover"><p>cover</p></body>`),
+		"OEBPS/Text/contents.xhtml": page(`<body><p>contents</p></body>`),
+		"OEBPS/Text/insert1.xhtml":  page(`<body><p>plate 1</p></body>`),
+		"OEBPS/Text/insert2.xhtml":  page(`<body><p>plate 2</p></body>`),
+		"OEBPS/Text/ch1.xhtml":      page(`<body><p>text</p></body>`),
+		"OEBPS/Text/p050.xhtml":     page(`<body><section epub:type="plate"><p>plate 3</p></section></body>`),
+	})
+}
+
+func mergedSpine(t *testing.T, path string) (string, []NavItem) {
+	t.Helper()
+	vol, err := loadVolume(context.Background(), 0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	var order []string
+	for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+		order = append(order, strings.TrimPrefix(ref.IDRef, "v000"))
+	}
+	return strings.Join(order, " "), vol.NavItems
+}
+
+func TestMergeIllustrations(t *testing.T) {
+	vols := []string{buildIllustratedVolume(t, "One"), buildIllustratedVolume(t, "Two")}
+	filter := &MatterFilter{Files: DefaultIllustrationFiles, Types: DefaultIllustrationTypes}
+
+	out := filepath.Join(t.TempDir(), "book.epub")
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, Illustrations: filter}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	spine, nav := mergedSpine(t, out)
+	want := "1_cover 1_toc 1_ch1 2_cover 2_toc 2_ch1 1_ins1 1_ins2 1_plate 2_ins1 2_ins2 2_plate"
+	if spine != want {
+		t.Fatalf("spine = %s, want %s", spine, want)
+	}
+	if len(nav) != 3 || nav[2].Title != "Illustrations" || len(nav[2].Children) != 2 || nav[2].Children[1].Href != "Volumes/v0002/Text/insert1.xhtml" {
+		t.Fatalf("nav = %+v", nav)
+	}
+	if c := nav[0].Children; len(c) != 1 || c[0].Title != "Chapter" {
+		t.Fatalf("illustration entry kept in volume nav: %+v", c)
+	}
+
+	out = filepath.Join(t.TempDir(), "volume.epub")
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, Illustrations: filter, IllustrationsAt: IllustrationsVolume}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	spine, nav = mergedSpine(t, out)
+	want = "1_cover 1_ins1 1_ins2 1_plate 1_toc 1_ch1 2_cover 2_ins1 2_ins2 2_plate 2_toc 2_ch1"
+	if spine != want {
+		t.Fatalf("spine = %s, want %s", spine, want)
+	}
+	if c := nav[1].Children; len(c) != 2 || c[0].Title != "Illustrations" || c[0].Href != "Volumes/v0002/Text/insert1.xhtml" {
+		t.Fatalf("volume nav = %+v", c)
+	}
+
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, Illustrations: filter, IllustrationsAt: "front"}); err == nil {
+		t.Fatal("unknown placement accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Templates of the image-pages transform.
+const (
+	// ImagePageSVG shows the image through a full-page SVG wrapper whose
+	// viewBox is the image's size, which most reading systems scale to
+	// the screen without cropping or stretching.
+	ImagePageSVG = "svg"
+	// ImagePageImg shows it as an <img> held within the page.
+	ImagePageImg = "img"
+)
+
+// imagePageStyleID marks the stylesheet image-pages adds to a page.
+const imagePageStyleID = "novfmt-image-page"
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// backgroundURLPattern finds the image of a background or background-image
+// declaration.
+var backgroundURLPattern = regexp.MustCompile(`(?i)background(?:-image)?\s*:[^;]*url\(\s*["']?([^"')]+?)["']?\s*\)`)
+
+// backgroundDeclPattern matches the background declarations of a style
+// attribute.
+var backgroundDeclPattern = regexp.MustCompile(`(?i)\s*background(?:-[a-z]+)?\s*:[^;]*;?`)
+
+// svgElementPattern finds inline SVG in a document.
+var svgElementPattern = regexp.MustCompile(`<(?:[A-Za-z_][\w.-]*:)?svg[\s/>]`)
+
+// ParseImagePageTemplate checks an image-pages template name.
+func ParseImagePageTemplate(s string) (string, error) {
+	switch s {
+	case "", ImagePageSVG:
+		return ImagePageSVG, nil
+	case ImagePageImg:
+		return ImagePageImg, nil
+	}
+	return "", fmt.Errorf("unknown image page template %q (want svg or img)", s)
+}
+
+// pageImage is the one image of a page that shows nothing else.
+type pageImage struct {
+	src, alt string
+	// width and height come from the image's own markup, or 0.
+	width, height int
+	// holder is the token index of the element whose background it is,
+	// or -1.
+	holder int
+}
+
+// normalizeImagePage rewrites a page that shows nothing but one image
+// (an <img>, an SVG <image> or an inline background-image) to the
+// template, sized by the image file where size knows it, or by the
+// page's own markup. It returns nil data for other pages and for pages
+// already in the template.
+func normalizeImagePage(href string, data []byte, template string, size func(href string) (int, int, bool)) ([]byte, []TextChange, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+	var toks []rawToken
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		toks = append(toks, rt)
+	}
+
+	head, headEnd, body, bodyEnd := -1, -1, -1, -1
+	// style is the stylesheet an earlier run added, styleEnd its end tag.
+	style, styleEnd := -1, -1
+	var (
+		images []pageImage
+		text   int
+		// skip counts open elements whose text is not shown, such as an
+		// SVG title.
+		skip int
+	)
+	for i, rt := range toks {
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case name == "head" && head < 0:
+				head = i
+			case name == "style" && head >= 0 && headEnd < 0 && attrValue(t.Attr, "id") == imagePageStyleID:
+				style = i
+			case name == "body" && body < 0:
+				body = i
+			}
+			if body < 0 {
+				continue
+			}
+			if skip > 0 || name == "title" || name == "desc" || name == "script" || name == "style" {
+				skip++
+				continue
+			}
+			if m := backgroundURLPattern.FindStringSubmatch(attrValue(t.Attr, "style")); m != nil {
+				images = append(images, pageImage{src: strings.TrimSpace(m[1]), holder: i})
+			}
+			switch name {
+			case "img":
+				images = append(images, pageImage{
+					src: attrValue(t.Attr, "src"), alt: attrValue(t.Attr, "alt"), holder: -1,
+					width: atoiAttr(t.Attr, "width"), height: atoiAttr(t.Attr, "height"),
+				})
+			case "image":
+				img := pageImage{src: svgImageHref(t), holder: -1, width: atoiAttr(t.Attr, "width"), height: atoiAttr(t.Attr, "height")}
+				// An SVG wrapper's viewBox is the image's size more often
+				// than its width and height are.
+				if p := parentSVG(toks, i); p >= 0 {
+					if w, h, ok := viewBoxSize(toks[p].tok.(xml.StartElement)); ok {
+						img.width, img.height = w, h
+					}
+				}
+				images = append(images, img)
+			case "video", "audio", "object", "iframe", "canvas", "math", "table":
+				return nil, nil, nil
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case name == "head" && head >= 0 && headEnd < 0:
+				headEnd = i
+			case name == "style" && style >= 0 && styleEnd < 0:
+				styleEnd = i
+			case name == "body" && body >= 0 && bodyEnd < 0 && skip == 0:
+				bodyEnd = i
+			}
+			if skip > 0 {
+				skip--
+			}
+		case xml.CharData:
+			if body >= 0 && bodyEnd < 0 && skip == 0 {
+				text += utf8.RuneCount(bytes.TrimSpace(t))
+			}
+		}
+	}
+	if body < 0 || bodyEnd < 0 || text > 0 || len(images) != 1 || images[0].src == "" {
+		return nil, nil, nil
+	}
+	img := images[0]
+	if strings.HasPrefix(img.src, "data:") {
+		return nil, nil, nil
+	}
+	if size != nil && !strings.Contains(img.src, ":") {
+		if w, h, ok := size(normalizeEPUBPath(path.Join(path.Dir(href), img.src))); ok {
+			img.width, img.height = w, h
+		}
+	}
+	if template == ImagePageSVG && (img.width <= 0 || img.height <= 0) {
+		return nil, nil, nil
+	}
+
+	content := imagePageContent(img, template)
+	bodyTag := toks[body].raw
+	if img.holder == body {
+		bodyTag = withoutBackground(bodyTag, toks[body].tok.(xml.StartElement))
+	}
+	var inner []byte
+	for _, rt := range toks[body+1 : bodyEnd] {
+		inner = append(inner, rt.raw...)
+	}
+	// A stylesheet for another template is replaced.
+	styled := head < 0
+	if style >= 0 && styleEnd >= 0 {
+		var b strings.Builder
+		for _, rt := range toks[style : styleEnd+1] {
+			b.Write(rt.raw)
+		}
+		styled = b.String()+"\n" == imagePageStyle(template)
+	}
+	if string(inner) == content && bytes.Equal(bodyTag, toks[body].raw) && styled {
+		return nil, nil, nil
+	}
+
+	for i := 0; i < len(toks); i++ {
+		var err error
+		switch {
+		case !styled && style >= 0 && i >= style && i <= styleEnd:
+			continue
+		case i == headEnd && !styled:
+			err = sp.writeRaw(imagePageStyle(template) + string(toks[i].raw))
+		case i == body:
+			err = sp.writeRaw(string(bodyTag) + content)
+			i = bodyEnd - 1
+		default:
+			err = sp.copy(toks[i])
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	change := TextChange{Before: strings.TrimSpace(string(inner)), After: content}
+	return out.Bytes(), []TextChange{change}, nil
+}
+
+// imagePageContent is the body of a page in the template.
+func imagePageContent(img pageImage, template string) string {
+	src, alt := html.EscapeString(img.src), html.EscapeString(img.alt)
+	if template == ImagePageImg {
+		return "\n" + `<div class="novfmt-image-page"><img src="` + src + `" alt="` + alt + `"/></div>` + "\n"
+	}
+	w, h := strconv.Itoa(img.width), strconv.Itoa(img.height)
+	var b strings.Builder
+	b.WriteString("\n" + `<svg xmlns="` + svgNamespace + `" xmlns:xlink="` + xlinkNamespace + `" version="1.1" width="100%" height="100%" viewBox="0 0 ` + w + " " + h + `" preserveAspectRatio="xMidYMid meet">`)
+	b.WriteString(`<image width="` + w + `" height="` + h + `" xlink:href="` + src + `">`)
+	if alt != "" {
+		b.WriteString("<title>" + alt + "</title>")
+	}
+	b.WriteString("</image></svg>\n")
+	return b.String()
+}
+
+// imagePageStyle is the stylesheet that fits the template to the page.
+func imagePageStyle(template string) string {
+	css := "html, body { margin: 0; padding: 0; height: 100%; } svg { display: block; }"
+	if template == ImagePageImg {
+		css = "html, body { margin: 0; padding: 0; height: 100%; } div.novfmt-image-page { height: 100%; text-align: center; } div.novfmt-image-page img { max-width: 100%; max-height: 100%; }"
+	}
+	return `<style id="` + imagePageStyleID + `">` + css + "</style>\n"
+}
+
+// svgImageHref returns the link of an SVG <image>, in xlink:href or href.
+func svgImageHref(el xml.StartElement) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == "href" && (a.Name.Space == "" || a.Name.Space == xlinkNamespace || a.Name.Space == "xlink") {
+			return strings.TrimSpace(a.Value)
+		}
+	}
+	return ""
+}
+
+// parentSVG returns the index of the <svg> start tag holding token i, or
+// -1.
+func parentSVG(toks []rawToken, i int) int {
+	depth := 0
+	for j := i - 1; j >= 0; j-- {
+		switch t := toks[j].tok.(type) {
+		case xml.EndElement:
+			depth++
+		case xml.StartElement:
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if strings.EqualFold(t.Name.Local, "svg") {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// viewBoxSize returns the width and height of an element's viewBox.
+func viewBoxSize(el xml.StartElement) (int, int, bool) {
+	f := strings.FieldsFunc(attrValue(el.Attr, "viewBox"), func(r rune) bool { return r == ' ' || r == ',' })
+	if len(f) != 4 {
+		return 0, 0, false
+	}
+	w, err1 := strconv.ParseFloat(f[2], 64)
+	h, err2 := strconv.ParseFloat(f[3], 64)
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return int(w + 0.5), int(h + 0.5), true
+}
+
+// atoiAttr returns an integer attribute such as width="600" or
+// width="600px", or 0.
+func atoiAttr(attrs []xml.Attr, name string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(attrValue(attrs, name)), "px"))
+	return n
+}
+
+// withoutBackground returns a start tag with the background declarations
+// taken out of its style attribute.
+func withoutBackground(raw []byte, el xml.StartElement) []byte {
+	style := strings.TrimSpace(backgroundDeclPattern.ReplaceAllString(attrValue(el.Attr, "style"), ""))
+	if style == "" {
+		return withoutAttr(raw, "style")
+	}
+	return setAttr(raw, el, "style", style)
+}
+
+// imageFileSize returns the pixel size of an image file: a format the
+// standard library decodes, or an SVG with a viewBox or a width and
+// height.
+func imageFileSize(p string) (int, int, bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	if cfg, _, err := image.DecodeConfig(f); err == nil {
+		return cfg.Width, cfg.Height, true
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, false
+	}
+	dec := xml.NewDecoder(io.LimitReader(f, 1<<16))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if el.Name.Local != "svg" {
+			return 0, 0, false
+		}
+		if w, h, ok := viewBoxSize(el); ok {
+			return w, h, true
+		}
+		w, h := atoiAttr(el.Attr, "width"), atoiAttr(el.Attr, "height")
+		return w, h, w > 0 && h > 0
+	}
+}
+
+// setSVGProperty gives a document the manifest's svg property when it has
+// inline SVG, and takes it away when it has none. It reports whether the
+// item changed.
+func setSVGProperty(item *ManifestItem, data []byte) bool {
+	has := svgElementPattern.Match(data)
+	switch {
+	case has && !hasProperty(item.Properties, "svg"):
+		item.Properties = addProperty(item.Properties, "svg")
+	case !has && hasProperty(item.Properties, "svg"):
+		item.Properties = removeProperty(item.Properties, "svg")
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeImagePage(t *testing.T) {
+	size := func(href string) (int, int, bool) {
+		if href == "Images/p1.jpg" {
+			return 1200, 1700, true
+		}
+		return 0, 0, false
+	}
+	page := func(body string) string {
+		return `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>x</title></head>` + body + `</html>`
+	}
+	wantSVG := page(`<body>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" viewBox="0 0 1200 1700" preserveAspectRatio="xMidYMid meet"><image width="1200" height="1700" xlink:href="../Images/p1.jpg"></image></svg>
+</body>`)
+	wantSVG = strings.Replace(wantSVG, "</head>", imagePageStyle(ImagePageSVG)+"</head>", 1)
+
+	for _, in := range []string{
+		page(`<body><div class="illus"><img src="../Images/p1.jpg" alt=""/></div></body>`),
+		page(`<body><p><img src="../Images/p1.jpg" width="600"/></p></body>`),
+		page(`<body style="background-image: url('../Images/p1.jpg'); background-size: cover"><div> </div></body>`),
+		page(`<body><svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 600 850"><image width="600" height="850" xlink:href="../Images/p1.jpg"/></svg></body>`),
+	} {
+		out, changes, err := normalizeImagePage("Text/p1.xhtml", []byte(in), ImagePageSVG, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != wantSVG || len(changes) != 1 {
+			t.Errorf("%s\ngot  %s\nwant %s", in, out, wantSVG)
+		}
+	}
+	if out, _, err := normalizeImagePage("Text/p1.xhtml", []byte(wantSVG), ImagePageSVG, size); out != nil || err != nil {
+		t.Fatalf("second run changed the page: %s, %v", out, err)
+	}
+
+	img, _, err := normalizeImagePage("Text/p1.xhtml", []byte(wantSVG), ImagePageImg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<div class="novfmt-image-page"><img src="../Images/p1.jpg" alt=""/></div>`, `div.novfmt-image-page img`} {
+		if !strings.Contains(string(img), want) {
+			t.Errorf("missing %s in %s", want, img)
+		}
+	}
+	if strings.Contains(string(img), "svg { display") {
+		t.Errorf("svg stylesheet kept: %s", img)
+	}
+
+	for _, in := range []string{
+		page(`<body><p><img src="../Images/p1.jpg"/></p><p>Caption</p></body>`),
+		page(`<body><img src="../Images/p1.jpg"/><img src="../Images/p2.jpg"/></body>`),
+		page(`<body><img src="../Images/unknown.jpg"/></body>`),
+	} {
+		if out, _, err := normalizeImagePage("Text/p1.xhtml", []byte(in), ImagePageSVG, size); out != nil || err != nil {
+			t.Errorf("changed %s: %s, %v", in, out, err)
+		}
+	}
+}
+
+func TestTransformImagePagesSVGProperty(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="p" href="p.xhtml" media-type="application/xhtml+xml"/>
+    <item id="i" href="i.svg" media-type="image/svg+xml"/>
+  </manifest>
+  <spine><itemref idref="p"/></spine>
+</package>`,
+		"OEBPS/p.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>p</title></head><body><img src="i.svg" alt="A map"/></body></html>`,
+		"OEBPS/i.svg":   `<svg xmlns="http://www.w3.org/2000/svg" width="300" height="400"/>`,
+	})
+	steps, err := ParseTransformChain("image-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TransformEPUB(context.Background(), input, TransformOptions{Steps: steps}); err != nil {
+		t.Fatalf("TransformEPUB: %v", err)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if item := manifestByID(vol.PackageDoc)["p"]; !hasProperty(item.Properties, "svg") {
+		t.Fatalf("page has no svg property: %+v", item)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "p.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `viewBox="0 0 300 400"`) || !strings.Contains(string(data), "<title>A map</title>") {
+		t.Fatalf("unexpected page %s", data)
+	}
+}
@@ -0,0 +1,298 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ImageWebP = "webp"
+	ImageAVIF = "avif"
+)
+
+// Compatibility targets for ConvertImages.
+const (
+	// CompatModern replaces PNG and JPEG with WebP, a core media type
+	// since EPUB 3.3. AVIF is not, so the originals stay as manifest
+	// fallbacks.
+	CompatModern = "modern"
+	// CompatKobo converts but keeps every original as a fallback, and
+	// leaves the cover alone for library thumbnails.
+	CompatKobo = "kobo"
+	// CompatKindle converts nothing: Kindle's EPUB import rejects WebP and
+	// AVIF. Images already in those formats without a fallback are
+	// reported.
+	CompatKindle = "kindle"
+)
+
+// ImageEncoder converts one PNG or JPEG image (mediaType says which) to
+// format at the given quality (1-100).
+type ImageEncoder func(ctx context.Context, src []byte, mediaType, format string, quality int) ([]byte, error)
+
+type ImageConvertOptions struct {
+	// Format is ImageWebP (default) or ImageAVIF.
+	Format string
+	// Compat is CompatModern (default), CompatKobo or CompatKindle.
+	Compat string
+	// Quality defaults to 80.
+	Quality int
+	// Encoder defaults to ExternalImageEncoder.
+	Encoder  ImageEncoder
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ImageConversion is the outcome for one image.
+type ImageConversion struct {
+	Href string `json:"href"`
+	// NewHref is the converted image, empty when it was skipped.
+	NewHref string `json:"new_href,omitempty"`
+	Before  int64  `json:"before"`
+	After   int64  `json:"after,omitempty"`
+	// Fallback is set when the original stays in the book as the converted
+	// image's manifest fallback.
+	Fallback bool `json:"fallback,omitempty"`
+	// Skipped says why the image was left alone.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+type ImageConvertReport struct {
+	Images    []ImageConversion `json:"images"`
+	Converted int               `json:"converted"`
+	// BytesBefore and BytesAfter total the images that were converted,
+	// counting kept originals in BytesAfter.
+	BytesBefore int64     `json:"bytes_before"`
+	BytesAfter  int64     `json:"bytes_after"`
+	Changeset   Changeset `json:"changeset"`
+}
+
+const defaultImageQuality = 80
+
+// ConvertImages re-encodes the book's PNG and JPEG images as WebP or AVIF
+// and updates every reference to them. Whether the originals are replaced
+// or kept as fallbacks for readers without support depends on
+// opts.Compat. Images whose converted form is not smaller are left alone.
+func ConvertImages(ctx context.Context, input string, opts ImageConvertOptions) (ImageConvertReport, error) {
+	var report ImageConvertReport
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.Format == "" {
+		opts.Format = ImageWebP
+	}
+	if opts.Format != ImageWebP && opts.Format != ImageAVIF {
+		return report, fmt.Errorf("unknown image format %q (want webp or avif)", opts.Format)
+	}
+	if opts.Compat == "" {
+		opts.Compat = CompatModern
+	}
+	if opts.Compat != CompatModern && opts.Compat != CompatKobo && opts.Compat != CompatKindle {
+		return report, fmt.Errorf("unknown compatibility target %q (want modern, kobo or kindle)", opts.Compat)
+	}
+	if opts.Quality == 0 {
+		opts.Quality = defaultImageQuality
+	}
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return report, fmt.Errorf("quality must be between 1 and 100")
+	}
+	if opts.Encoder == nil {
+		opts.Encoder = ExternalImageEncoder
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	newType := "image/" + opts.Format
+	// Originals are replaced only where every reader is expected to cope.
+	replace := opts.Compat == CompatModern && opts.Format == ImageWebP
+
+	if opts.Compat == CompatKindle {
+		for _, item := range pkg.Manifest.Items {
+			if (item.MediaType == "image/webp" || item.MediaType == "image/avif") && !hasCoreFallback(pkg, item) {
+				report.Images = append(report.Images, ImageConversion{Href: item.Href, Skipped: "no PNG or JPEG fallback; Kindle cannot show it"})
+			}
+		}
+		if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+			return report, err
+		}
+		return report, nil
+	}
+
+	renamed := map[string]string{}
+	var added []ManifestItem
+	n := len(pkg.Manifest.Items)
+	for i := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		item := &pkg.Manifest.Items[i]
+		opts.Progress.report(StageRewrite, i, n, item.Href)
+		if item.MediaType != "image/png" && item.MediaType != "image/jpeg" {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return report, err
+		}
+		conv := ImageConversion{Href: item.Href, Before: int64(len(data))}
+		if hasProperty(item.Properties, "cover-image") && !replace {
+			conv.Skipped = "cover image"
+			report.Images = append(report.Images, conv)
+			continue
+		}
+		out, err := opts.Encoder(ctx, data, item.MediaType, opts.Format, opts.Quality)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		if len(out) >= len(data) {
+			conv.Skipped = fmt.Sprintf("%s is not smaller (%d bytes)", opts.Format, len(out))
+			report.Images = append(report.Images, conv)
+			continue
+		}
+
+		href := normalizeEPUBPath(item.Href)
+		newHref := strings.TrimSuffix(href, path.Ext(href)) + "." + opts.Format
+		if hasManifestHref(pkg, newHref) || hasAddedHref(added, newHref) {
+			newHref = uniqueName(newHref, func(h string) bool { return hasManifestHref(pkg, h) || hasAddedHref(added, h) })
+		}
+		if err := writePackageFile(vol, newHref, out); err != nil {
+			return report, err
+		}
+		conv.NewHref = newHref
+		conv.After = int64(len(out))
+		renamed[href] = newHref
+		report.Changeset.added(newHref)
+		if replace {
+			if err := os.Remove(src); err != nil {
+				return report, err
+			}
+			report.Changeset.removed(href)
+			item.Href, item.MediaType = newHref, newType
+			report.BytesAfter += conv.After
+		} else {
+			conv.Fallback = true
+			added = append(added, ManifestItem{
+				ID:        uniqueManifestID(pkg, item.ID+"-"+opts.Format),
+				Href:      newHref,
+				MediaType: newType,
+				Fallback:  item.ID,
+			})
+			report.BytesAfter += conv.After + conv.Before
+		}
+		report.BytesBefore += conv.Before
+		report.Converted++
+		report.Images = append(report.Images, conv)
+		log.Debug("converted image", "href", href, "to", newHref, "before", conv.Before, "after", conv.After)
+	}
+	opts.Progress.report(StageRewrite, n, n, "")
+	pkg.Manifest.Items = append(pkg.Manifest.Items, added...)
+
+	if report.Converted > 0 {
+		changed, err := rewriteReferences(vol.PackageDir, pkg, func(target string) (string, bool) {
+			href, ok := renamed[target]
+			return href, ok
+		})
+		if err != nil {
+			return report, err
+		}
+		for _, href := range changed {
+			report.Changeset.modified(href)
+		}
+		report.Changeset.modified(packageHref(vol))
+	}
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func hasAddedHref(items []ManifestItem, href string) bool {
+	for _, item := range items {
+		if item.Href == href {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCoreFallback reports whether item's fallback chain reaches a PNG, JPEG
+// or GIF.
+func hasCoreFallback(pkg *PackageDocument, item ManifestItem) bool {
+	return hasFallbackIn(pkg, item, []string{"image/png", "image/jpeg", "image/gif"})
+}
+
+// hasFallbackIn reports whether item's fallback chain reaches one of types.
+func hasFallbackIn(pkg *PackageDocument, item ManifestItem, types []string) bool {
+	seen := map[string]bool{}
+	for id := item.Fallback; id != "" && !seen[id]; {
+		seen[id] = true
+		next := ""
+		for _, it := range pkg.Manifest.Items {
+			if it.ID != id {
+				continue
+			}
+			if containsString(types, it.MediaType) {
+				return true
+			}
+			next = it.Fallback
+		}
+		id = next
+	}
+	return false
+}
+
+// ExternalImageEncoder encodes with the cwebp and avifenc command-line
+// tools, which must be on PATH; Go's standard library has no WebP or AVIF
+// encoder.
+func ExternalImageEncoder(ctx context.Context, src []byte, mediaType, format string, quality int) ([]byte, error) {
+	tool := map[string]string{ImageWebP: "cwebp", ImageAVIF: "avifenc"}[format]
+	if tool == "" {
+		return nil, fmt.Errorf("unknown image format %q", format)
+	}
+	bin, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found on PATH; install it to convert images to %s", tool, format)
+	}
+	dir, err := os.MkdirTemp("", "novfmt-img-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.png")
+	if mediaType == "image/jpeg" {
+		in = filepath.Join(dir, "in.jpg")
+	}
+	out := filepath.Join(dir, "out."+format)
+	if err := os.WriteFile(in, src, 0o644); err != nil {
+		return nil, err
+	}
+	q := fmt.Sprint(quality)
+	args := []string{"-quiet", "-q", q, in, "-o", out}
+	if format == ImageAVIF {
+		args = []string{"-q", q, in, out}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(out)
+}
@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakeImageEncoder(_ context.Context, src []byte, _, format string, _ int) ([]byte, error) {
+	return []byte("fake " + format), nil
+}
+
+func TestConvertImages(t *testing.T) {
+	ctx := context.Background()
+	newBook := func() string {
+		p := filepath.Join(t.TempDir(), "book.epub")
+		if err := GenerateEPUB(ctx, GenerateOptions{Chapters: 2, WordsPerChapter: 50, Images: 2, OutPath: p}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	open := func(p string) (*Volume, map[string]ManifestItem) {
+		t.Helper()
+		vol, err := loadVolume(ctx, 0, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(vol.TempDir) })
+		items := map[string]ManifestItem{}
+		for _, item := range vol.PackageDoc.Manifest.Items {
+			items[item.Href] = item
+		}
+		return vol, items
+	}
+
+	t.Run("modern", func(t *testing.T) {
+		book := newBook()
+		report, err := ConvertImages(ctx, book, ImageConvertOptions{Encoder: fakeImageEncoder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Converted != 2 {
+			t.Fatalf("report = %+v", report)
+		}
+		vol, items := open(book)
+		cover, ok := items["Images/img0001.webp"]
+		if !ok || cover.MediaType != "image/webp" || !hasProperty(cover.Properties, "cover-image") {
+			t.Fatalf("manifest = %+v", items)
+		}
+		if _, ok := items["Images/img0001.png"]; ok {
+			t.Fatal("original kept")
+		}
+		if _, err := os.Stat(filepath.Join(vol.PackageDir, "Images", "img0001.png")); !os.IsNotExist(err) {
+			t.Fatalf("original file still there: %v", err)
+		}
+		ch, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch0002.xhtml"))
+		if !bytes.Contains(ch, []byte(`src="../Images/img0002.webp"`)) {
+			t.Fatalf("chapter not updated:\n%s", ch)
+		}
+
+		// Kindle cannot show the result.
+		report, err = ConvertImages(ctx, book, ImageConvertOptions{Compat: CompatKindle, Encoder: fakeImageEncoder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Converted != 0 || len(report.Images) != 2 || !strings.Contains(report.Images[0].Skipped, "Kindle") {
+			t.Fatalf("kindle report = %+v", report)
+		}
+	})
+
+	t.Run("kobo", func(t *testing.T) {
+		book := newBook()
+		report, err := ConvertImages(ctx, book, ImageConvertOptions{Compat: CompatKobo, Format: ImageAVIF, Encoder: fakeImageEncoder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Converted != 1 || report.Images[0].Skipped != "cover image" || !report.Images[1].Fallback {
+			t.Fatalf("report = %+v", report)
+		}
+		vol, items := open(book)
+		avif := items["Images/img0002.avif"]
+		if avif.MediaType != "image/avif" || avif.Fallback != "img0002" {
+			t.Fatalf("manifest = %+v", items)
+		}
+		if orig := items["Images/img0002.png"]; orig.ID != "img0002" {
+			t.Fatalf("original missing: %+v", items)
+		}
+		ch, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch0002.xhtml"))
+		if !bytes.Contains(ch, []byte(`src="../Images/img0002.avif"`)) {
+			t.Fatalf("chapter not updated:\n%s", ch)
+		}
+		if !hasCoreFallback(vol.PackageDoc, avif) {
+			t.Fatal("fallback chain does not reach the PNG")
+		}
+	})
+
+	t.Run("no saving", func(t *testing.T) {
+		book := newBook()
+		bigger := func(_ context.Context, src []byte, _, _ string, _ int) ([]byte, error) {
+			return append(src, src...), nil
+		}
+		report, err := ConvertImages(ctx, book, ImageConvertOptions{Encoder: bigger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Converted != 0 || !strings.Contains(report.Images[0].Skipped, "not smaller") {
+			t.Fatalf("report = %+v", report)
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mergeStateVersion is the format version of the merge state file; a
+// state of another version never matches.
+const mergeStateVersion = 1
+
+// MergeState is what an incremental merge records about its last run:
+// enough to tell, without merging again, whether the output would be the
+// same.
+type MergeState struct {
+	Version int `json:"version"`
+	// Options is a hash of the merge options that shape the output,
+	// including the contents of the stylesheets they name.
+	Options string      `json:"options"`
+	Inputs  []StateFile `json:"inputs"`
+	Output  StateFile   `json:"output"`
+}
+
+// StateFile identifies the contents of a file. Size and ModTime let an
+// unchanged file skip hashing.
+type StateFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// MergeStatePath is where an incremental merge to out keeps its state
+// unless MergeOptions.StatePath says otherwise.
+func MergeStatePath(out string) string {
+	return out + ".novfmt-merge.json"
+}
+
+// MergeIfChanged merges sources like MergeEPUBs unless the sources, the
+// options and the output are all unchanged since the last merge it made
+// to the same output. It reports whether it merged. Options it cannot
+// compare, a custom NavBuilder, ConflictResolver or TextDecoder, always
+// merge.
+func MergeIfChanged(ctx context.Context, sources []string, opts MergeOptions) (bool, error) {
+	if opts.OutPath == "" {
+		return false, fmt.Errorf("output path is required")
+	}
+	// The output and the state are compared by their files on disk.
+	env := EnvFrom(ctx)
+	if !env.isLocalPath(opts.OutPath) {
+		return false, fmt.Errorf("incremental merge needs a local output file, not %s", opts.OutPath)
+	}
+	if opts.StatePath != "" && !env.isLocalPath(opts.StatePath) {
+		return false, fmt.Errorf("incremental merge needs a local state file, not %s", opts.StatePath)
+	}
+	log := loggerOrDiscard(opts.Logger)
+	statePath := opts.StatePath
+	if statePath == "" {
+		statePath = MergeStatePath(opts.OutPath)
+	}
+	optsHash, stable, err := mergeOptionsHash(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	last, err := readMergeState(statePath)
+	if err != nil {
+		return false, err
+	}
+
+	state := MergeState{Version: mergeStateVersion, Options: optsHash}
+	for i, src := range sources {
+		var prev *StateFile
+		if last != nil && i < len(last.Inputs) {
+			prev = &last.Inputs[i]
+		}
+		f, err := stateFile(ctx, src, prev)
+		if err != nil {
+			return false, err
+		}
+		state.Inputs = append(state.Inputs, f)
+	}
+
+	reason := ""
+	var out StateFile
+	switch {
+	case !stable:
+		reason = "options include a custom nav builder or conflict resolver"
+	case last == nil:
+		reason = "no previous incremental merge"
+	case last.Version != mergeStateVersion || last.Options != optsHash:
+		reason = "options changed"
+	case !sameStateFiles(last.Inputs, state.Inputs):
+		reason = "inputs changed"
+	default:
+		out, err = stateFile(ctx, opts.OutPath, &last.Output)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			reason = "output missing"
+		case err != nil:
+			return false, err
+		case out.SHA256 != last.Output.SHA256:
+			reason = "output changed since the last merge"
+		}
+	}
+	if reason == "" {
+		log.Info("inputs and options unchanged; keeping output", "path", opts.OutPath)
+		// Store new modification times so touched files are not hashed
+		// again next time.
+		state.Output = out
+		return false, writeMergeState(statePath, state)
+	}
+	log.Info("merging", "reason", reason)
+
+	// A failed merge must not leave a state that matches the old output.
+	if err := os.Remove(statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err := MergeEPUBs(ctx, sources, opts); err != nil {
+		return true, err
+	}
+	if !stable {
+		return true, nil
+	}
+	if state.Output, err = stateFile(ctx, opts.OutPath, nil); err != nil {
+		return true, err
+	}
+	return true, writeMergeState(statePath, state)
+}
+
+func writeMergeState(path string, state MergeState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write merge state: %w", err)
+	}
+	return nil
+}
+
+func readMergeState(path string) (*MergeState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read merge state: %w", err)
+	}
+	var state MergeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse merge state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// stateFile describes the file at p, reusing prev's hash when p is the
+// same file with the same size and modification time.
+func stateFile(ctx context.Context, p string, prev *StateFile) (StateFile, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return StateFile{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return StateFile{}, err
+	}
+	f := StateFile{Path: abs, Size: info.Size(), ModTime: info.ModTime().UTC()}
+	if prev != nil && prev.Path == f.Path && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+		f.SHA256 = prev.SHA256
+		return f, nil
+	}
+	f.SHA256, err = Env{}.hashFile(ctx, abs)
+	return f, err
+}
+
+func sameStateFiles(a, b []StateFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].SHA256 != b[i].SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeOptionsHash hashes the options that shape a merge's output. It
+// reports false when opts holds a NavBuilder, ConflictResolver or
+// TextDecoder whose behaviour cannot be compared between runs. New MergeOptions fields
+// that change the output belong here too.
+func mergeOptionsHash(ctx context.Context, opts MergeOptions) (string, bool, error) {
+	stable := true
+	if opts.NavBuilder != nil {
+		if _, ok := opts.NavBuilder.(DefaultNavBuilder); !ok {
+			stable = false
+		}
+	}
+	if opts.TextDecoder != nil {
+		stable = false
+	}
+	conflict := -1
+	switch r := opts.ConflictResolver.(type) {
+	case nil:
+	case ConflictAction:
+		conflict = int(r)
+	default:
+		stable = false
+	}
+	fileHash := func(p string) (string, error) {
+		if p == "" {
+			return "", nil
+		}
+		return Env{}.hashFile(ctx, p)
+	}
+	stylesheet, err := fileHash(opts.Stylesheet)
+	if err != nil {
+		return "", false, fmt.Errorf("stylesheet: %w", err)
+	}
+	userCSS, err := fileHash(opts.UserCSS)
+	if err != nil {
+		return "", false, fmt.Errorf("user CSS: %w", err)
+	}
+	// An inserted page counts by its content and that of its files.
+	var insertPages []string
+	for _, page := range opts.InsertPages {
+		files, err := insertPageFiles(page.Path)
+		if err != nil {
+			return "", false, fmt.Errorf("insert page: %w", err)
+		}
+		for _, f := range files {
+			sum, err := Env{}.hashFile(ctx, f)
+			if err != nil {
+				return "", false, fmt.Errorf("insert page: %w", err)
+			}
+			insertPages = append(insertPages, page.Position+" "+sum)
+		}
+	}
+	data, err := json.Marshal(struct {
+		Title, Language, Layout    string
+		Creators, KeepCSS          []string
+		StripMatter                *MatterFilter
+		NonLinear                  string
+		MixedLayout                bool
+		Illustrations              *MatterFilter
+		IllustrationsAt            string
+		VolumeTitlePages           bool
+		InsertPages                []string
+		ShareResources             bool
+		Conflict                   int
+		DedupeCSS, StripCSS        bool
+		Stylesheet, UserCSS        string
+		WritingMode, Ruby          string
+		ChapterHashes, ShrinkToFit bool
+		MaxSize                    int64
+		Checksums                  bool
+	}{
+		opts.Title, opts.Language, opts.Layout,
+		opts.Creators, opts.KeepCSS,
+		opts.StripMatter,
+		opts.NonLinear,
+		opts.MixedLayout,
+		opts.Illustrations, opts.IllustrationsAt,
+		opts.VolumeTitlePages,
+		insertPages,
+		opts.ShareResources,
+		conflict,
+		opts.DedupeCSS, opts.StripCSS,
+		stylesheet, userCSS,
+		opts.WritingMode, opts.Ruby,
+		opts.ChapterHashes, opts.ShrinkToFit,
+		opts.MaxSize,
+		opts.Checksums,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), stable, nil
+}
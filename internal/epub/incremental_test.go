@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergeIfChanged(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	vol1 := buildTestEPUB(t, "Vol 1", "en")
+	vol2 := buildTestEPUB(t, "Vol 2", "en")
+	opts := MergeOptions{OutPath: filepath.Join(dir, "out.epub")}
+
+	run := func(step string, opts MergeOptions, want bool) {
+		t.Helper()
+		merged, err := MergeIfChanged(ctx, []string{vol1, vol2}, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if merged != want {
+			t.Fatalf("%s: merged = %v, want %v", step, merged, want)
+		}
+	}
+	run("first run", opts, true)
+	if _, err := os.Stat(MergeStatePath(opts.OutPath)); err != nil {
+		t.Fatalf("state not written: %v", err)
+	}
+	run("unchanged", opts, false)
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(vol2, later, later); err != nil {
+		t.Fatal(err)
+	}
+	run("touched input", opts, false)
+
+	titled := opts
+	titled.Title = "Omnibus"
+	run("title changed", titled, true)
+	run("title unchanged", titled, false)
+	run("title dropped", opts, true)
+
+	data, err := os.ReadFile(vol1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vol2, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run("input replaced", opts, true)
+
+	if err := os.Remove(opts.OutPath); err != nil {
+		t.Fatal(err)
+	}
+	run("output removed", opts, true)
+
+	custom := opts
+	custom.ConflictResolver = ConflictResolverFunc(func(ResourceConflict) (ConflictAction, error) { return ConflictRename, nil })
+	run("custom resolver", custom, true)
+	run("custom resolver again", custom, true)
+
+	decoder := opts
+	decoder.TextDecoder = ExternalTextDecoder
+	run("custom decoder", decoder, true)
+	run("custom decoder again", decoder, true)
+
+	for _, out := range []string{StreamPath, "mem://out.epub"} {
+		ctx := WithEnv(ctx, Env{Storages: map[string]Storage{"mem": NewMemStorage()}})
+		if _, err := MergeIfChanged(ctx, []string{vol1, vol2}, MergeOptions{OutPath: out}); err == nil {
+			t.Fatalf("incremental merge to %s succeeded", out)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package epub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Where MergeOptions.InsertPages go, besides "before-volume-N".
+const (
+	// InsertFront puts a page first in the book.
+	InsertFront = "front"
+	// InsertAfterCover puts it after the first volume's cover page, or
+	// first when that volume starts without one.
+	InsertAfterCover = "after-cover"
+	// InsertEnd puts it last.
+	InsertEnd = "end"
+)
+
+// insertedPagesDir holds the inserted pages and their files in the
+// merged book, one numbered directory per page.
+const insertedPagesDir = "Inserted"
+
+var beforeVolumeRE = regexp.MustCompile(`^before-volume-([1-9][0-9]*)$`)
+
+// InsertPage is a page of one's own, such as a dedication, a translator's
+// credit or a disclaimer, that a merge adds to the book.
+type InsertPage struct {
+	// Path is the XHTML file. The stylesheets, images, fonts and other
+	// files it refers to, and those its stylesheets refer to, come with
+	// it; links to other XHTML documents are left to the link check.
+	Path string
+	// Position is InsertFront, InsertAfterCover, InsertEnd, or
+	// "before-volume-N" for the volume numbered N from 1.
+	Position string
+}
+
+// ParseInsertPage reads an InsertPage written as "file.xhtml:position".
+func ParseInsertPage(s string) (InsertPage, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return InsertPage{}, fmt.Errorf("insert page %q: want file.xhtml:position", s)
+	}
+	p := InsertPage{Path: s[:i], Position: s[i+1:]}
+	if _, err := insertVolume(p.Position); err != nil {
+		return InsertPage{}, fmt.Errorf("insert page %q: %w", s, err)
+	}
+	return p, nil
+}
+
+// insertVolume returns N for a "before-volume-N" position and 0 for the
+// other positions.
+func insertVolume(position string) (int, error) {
+	switch position {
+	case InsertFront, InsertAfterCover, InsertEnd:
+		return 0, nil
+	}
+	if m := beforeVolumeRE.FindStringSubmatch(position); m != nil {
+		return strconv.Atoi(m[1])
+	}
+	return 0, fmt.Errorf("unknown position %q (want front, after-cover, before-volume-N or end)", position)
+}
+
+// checkInsertPages checks the positions of pages against a merge of
+// volumes volumes.
+func checkInsertPages(pages []InsertPage, volumes int) error {
+	for _, p := range pages {
+		n, err := insertVolume(p.Position)
+		if err != nil {
+			return fmt.Errorf("insert page %s: %w", p.Path, err)
+		}
+		if n > volumes {
+			return fmt.Errorf("insert page %s: %s, but there are %d volumes", p.Path, p.Position, volumes)
+		}
+	}
+	return nil
+}
+
+// insertPageFiles returns the page at p followed by the local files it
+// refers to, directly or through its stylesheets. Missing files and other
+// XHTML documents are left out.
+func insertPageFiles(p string) ([]string, error) {
+	page, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(page)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWellFormed(data); err != nil {
+		return nil, fmt.Errorf("%s is not well-formed XHTML: %w", p, err)
+	}
+	files := []string{page}
+	seen := map[string]bool{page: true}
+	for i := 0; i < len(files); i++ {
+		if i > 0 {
+			if data, err = os.ReadFile(files[i]); err != nil {
+				return nil, err
+			}
+		}
+		pattern := referencePattern(insertMediaType(files[i], data))
+		if pattern == nil {
+			continue
+		}
+		for _, m := range pattern.FindAllStringSubmatch(string(data), -1) {
+			raw := strings.Trim(m[2], `"'`)
+			if raw == "" || strings.HasPrefix(raw, "#") || strings.Contains(raw, ":") {
+				continue
+			}
+			target, _, _ := strings.Cut(raw, "#")
+			target, _, _ = strings.Cut(target, "?")
+			dep := filepath.Join(filepath.Dir(files[i]), filepath.FromSlash(target))
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			if extensionMediaTypes[strings.ToLower(filepath.Ext(dep))] == "application/xhtml+xml" {
+				continue
+			}
+			if info, err := os.Stat(dep); err != nil || info.IsDir() {
+				continue
+			}
+			files = append(files, dep)
+		}
+	}
+	return files, nil
+}
+
+// insertMediaType returns the media type of the file at p with content
+// data.
+func insertMediaType(p string, data []byte) string {
+	if t := sniffMediaType(data); t != "" {
+		return t
+	}
+	switch ext := strings.ToLower(filepath.Ext(p)); ext {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png", ".gif", ".webp", ".avif":
+		return "image/" + ext[1:]
+	case ".svg":
+		return "image/svg+xml"
+	default:
+		if t := extensionMediaTypes[ext]; t != "" {
+			return t
+		}
+	}
+	return "application/octet-stream"
+}
+
+// stageInsertPages copies each page and its files into oebpsDir under
+// insertedPagesDir, keeping their places relative to each other so their
+// references hold, and adds them to manifest. It returns the manifest id
+// of each page.
+func stageInsertPages(pages []InsertPage, oebpsDir string, manifest *Manifest, idHref map[string]string, taken map[string]bool) ([]string, error) {
+	ids := make([]string, len(pages))
+	for n, page := range pages {
+		files, err := insertPageFiles(page.Path)
+		if err != nil {
+			return nil, fmt.Errorf("insert page: %w", err)
+		}
+		base := filepath.Dir(files[0])
+		for _, f := range files[1:] {
+			for {
+				if rel, err := filepath.Rel(base, f); err == nil && !strings.HasPrefix(rel, "..") {
+					break
+				}
+				parent := filepath.Dir(base)
+				if parent == base {
+					break
+				}
+				base = parent
+			}
+		}
+		prefix := path.Join(insertedPagesDir, fmt.Sprintf("p%d", n+1))
+		for i, f := range files {
+			rel, err := filepath.Rel(base, f)
+			if err != nil {
+				return nil, err
+			}
+			href := path.Join(prefix, filepath.ToSlash(rel))
+			if taken[strings.ToLower(href)] {
+				return nil, fmt.Errorf("insert page %s: the layout already puts a file at %s", page.Path, href)
+			}
+			taken[strings.ToLower(href)] = true
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			dst := filepath.Join(oebpsDir, filepath.FromSlash(href))
+			if err := ensureParentDir(dst); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(dst, data, 0o644); err != nil {
+				return nil, err
+			}
+			mediaType := insertMediaType(f, data)
+			if i == 0 {
+				mediaType = "application/xhtml+xml"
+			}
+			id := fmt.Sprintf("ins%d_%s", n+1, manifestID(path.Base(href)))
+			for k := 2; idHref[id] != ""; k++ {
+				id = fmt.Sprintf("ins%d_%s-%d", n+1, manifestID(path.Base(href)), k)
+			}
+			manifest.Items = append(manifest.Items, ManifestItem{ID: id, Href: href, MediaType: mediaType})
+			idHref[id] = href
+			if i == 0 {
+				ids[n] = id
+			}
+		}
+	}
+	return ids, nil
+}
+
+// placeInsertPages adds the pages with the given manifest ids to the
+// spine. volumeStart holds the spine index of each volume's first item
+// and afterCover the index following the first volume's cover page.
+func placeInsertPages(spine *Spine, pages []InsertPage, ids []string, volumeStart []int, afterCover int, book rendition) {
+	at := make([]int, len(pages))
+	for i, p := range pages {
+		switch p.Position {
+		case InsertFront:
+			at[i] = 0
+		case InsertAfterCover:
+			at[i] = afterCover
+		case InsertEnd:
+			at[i] = len(spine.Itemrefs)
+		default:
+			n, _ := insertVolume(p.Position)
+			at[i] = volumeStart[n-1]
+		}
+	}
+	refs := make([]SpineItemRef, 0, len(spine.Itemrefs)+len(pages))
+	for pos := 0; pos <= len(spine.Itemrefs); pos++ {
+		for i := range pages {
+			if at[i] == pos {
+				refs = append(refs, titlePageRef(ids[i], book))
+			}
+		}
+		if pos < len(spine.Itemrefs) {
+			refs = append(refs, spine.Itemrefs[pos])
+		}
+	}
+	spine.Itemrefs = refs
+}
@@ -0,0 +1,81 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeInsertPages(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"pages/credits.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><link rel="stylesheet" href="../css/extra.css"/></head>` +
+			`<body><p><img src="seal.png" alt=""/>Translated by us.</p><p><a href="other.xhtml">more</a></p></body></html>`,
+		"pages/seal.png":         "\x89PNG\r\n\x1a\nseal",
+		"pages/other.xhtml":      `<html xmlns="http://www.w3.org/1999/xhtml"><body/></html>`,
+		"css/extra.css":          `body { background: url("../fonts/paper.png") } @font-face { src: url(missing.otf) }`,
+		"fonts/paper.png":        "\x89PNG\r\n\x1a\npaper",
+		"pages/dedication.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>For K.</p></body></html>`,
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	credits := filepath.Join(dir, "pages", "credits.xhtml")
+	dedication := filepath.Join(dir, "pages", "dedication.xhtml")
+
+	vols := []string{buildBannerBook(t), buildBannerBook(t)}
+	out := filepath.Join(t.TempDir(), "book.epub")
+	err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, InsertPages: []InsertPage{
+		{Path: credits, Position: InsertAfterCover},
+		{Path: dedication, Position: InsertFront},
+		{Path: dedication, Position: "before-volume-2"},
+		{Path: credits, Position: InsertEnd},
+	}})
+	if err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	spine, _ := mergedSpine(t, out)
+	want := "ins2_dedication.xhtml 1_cover ins1_credits.xhtml 1_c1 1_c2 ins3_dedication.xhtml 2_cover 2_c1 2_c2 ins4_credits.xhtml"
+	if spine != want {
+		t.Fatalf("spine = %s\nwant %s", spine, want)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	var hrefs []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if strings.HasPrefix(item.ID, "ins1_") {
+			hrefs = append(hrefs, item.Href+" "+item.MediaType)
+		}
+	}
+	if got := strings.Join(hrefs, ", "); got != "Inserted/p1/pages/credits.xhtml application/xhtml+xml, Inserted/p1/css/extra.css text/css, "+
+		"Inserted/p1/pages/seal.png image/png, Inserted/p1/fonts/paper.png image/png" {
+		t.Fatalf("inserted files = %s", got)
+	}
+
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, InsertPages: []InsertPage{{Path: credits, Position: "before-volume-3"}}}); err == nil {
+		t.Fatal("inserted a page before a volume that does not exist")
+	}
+}
+
+func TestParseInsertPage(t *testing.T) {
+	p, err := ParseInsertPage(`C:\pages\credits.xhtml:before-volume-2`)
+	if err != nil || p.Path != `C:\pages\credits.xhtml` || p.Position != "before-volume-2" {
+		t.Fatalf("ParseInsertPage = %+v, %v", p, err)
+	}
+	for _, s := range []string{"credits.xhtml", "credits.xhtml:middle", "credits.xhtml:before-volume-0"} {
+		if _, err := ParseInsertPage(s); err == nil {
+			t.Fatalf("%q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// ChecksumsFile is the container-relative path of the checksum manifest.
+const ChecksumsFile = "META-INF/novfmt-checksums.json"
+
+// ErrNoChecksums is returned when a book has no checksum manifest.
+var ErrNoChecksums = errors.New("book has no checksum manifest")
+
+// FileChecksum is the SHA-256 of one file in the container.
+type FileChecksum struct {
+	// Path is relative to the container root.
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Checksums lists every file of a book but the checksum manifest itself,
+// sorted by path.
+type Checksums struct {
+	Algorithm string         `json:"algorithm"`
+	Files     []FileChecksum `json:"files"`
+}
+
+// Integrity problems.
+const (
+	IntegrityMissing    = "missing"
+	IntegrityChanged    = "changed"
+	IntegrityUnlisted   = "unlisted"
+	IntegrityUnreadable = "unreadable"
+)
+
+// IntegrityProblem is one file that failed verification.
+type IntegrityProblem struct {
+	Path string `json:"path"`
+	// Status is one of the Integrity constants.
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// IntegrityReport is the result of VerifyIntegrity.
+type IntegrityReport struct {
+	// HasChecksums is false for a book without a checksum manifest, which
+	// only has its zip entries' CRCs checked.
+	HasChecksums bool               `json:"has_checksums"`
+	Checked      int                `json:"checked"`
+	Problems     []IntegrityProblem `json:"problems"`
+}
+
+// OK reports whether the book passed.
+func (r IntegrityReport) OK() bool { return len(r.Problems) == 0 }
+
+type ChecksumOptions struct {
+	OutPath  string
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// EmbedChecksums writes a checksum manifest into a book. Once present,
+// every command that saves the book keeps it up to date.
+func EmbedChecksums(ctx context.Context, input string, opts ChecksumOptions) (*Checksums, Changeset, error) {
+	var cs Changeset
+	if input == "" {
+		return nil, cs, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, cs, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	dest := filepath.Join(vol.RootDir, filepath.FromSlash(ChecksumsFile))
+	before, err := os.ReadFile(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, cs, err
+	}
+	existed := err == nil
+	sums, err := writeChecksums(vol.RootDir)
+	if err != nil {
+		return nil, cs, err
+	}
+	after, err := os.ReadFile(dest)
+	if err != nil {
+		return nil, cs, err
+	}
+	href, err := filepath.Rel(vol.PackageDir, dest)
+	if err != nil {
+		return nil, cs, err
+	}
+	switch {
+	case !existed:
+		cs.added(filepath.ToSlash(href))
+	case !bytes.Equal(before, after):
+		cs.modified(filepath.ToSlash(href))
+	}
+	if err := cs.commit(ctx, vol, input, opts.OutPath, false, opts.Progress, log); err != nil {
+		return nil, cs, err
+	}
+	return sums, cs, nil
+}
+
+// VerifyIntegrity reads every entry of the EPUB at input straight from
+// the archive, so that no repair hides damage, and checks it against the
+// book's checksum manifest. Entries that fail their zip CRC are reported
+// whether or not the book has a manifest.
+func VerifyIntegrity(ctx context.Context, input string) (IntegrityReport, error) {
+	report := IntegrityReport{Problems: []IntegrityProblem{}}
+	book, size, closeBook, err := EnvFrom(ctx).openBook(ctx, input)
+	if err != nil {
+		return report, err
+	}
+	defer closeBook()
+	r, err := zip.NewReader(book, size)
+	if err != nil {
+		return report, invalidEPUB(err)
+	}
+
+	actual := map[string]FileChecksum{}
+	var listed *Checksums
+	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(f.Name)
+		data, err := readZipFile(f)
+		if err != nil {
+			report.Problems = append(report.Problems, IntegrityProblem{Path: name, Status: IntegrityUnreadable, Detail: err.Error()})
+			continue
+		}
+		if name == ChecksumsFile {
+			listed = &Checksums{}
+			if err := json.Unmarshal(data, listed); err != nil {
+				return report, fmt.Errorf("parse %s: %w", ChecksumsFile, err)
+			}
+			continue
+		}
+		actual[name] = checksumOf(name, data)
+	}
+	report.Checked = len(actual)
+	if listed == nil {
+		return report, nil
+	}
+	report.HasChecksums = true
+
+	seen := map[string]bool{}
+	for _, want := range listed.Files {
+		seen[want.Path] = true
+		got, ok := actual[want.Path]
+		switch {
+		case !ok:
+			if !hasProblem(report.Problems, want.Path) {
+				report.Problems = append(report.Problems, IntegrityProblem{Path: want.Path, Status: IntegrityMissing})
+			}
+		case got.SHA256 != want.SHA256:
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Path:   want.Path,
+				Status: IntegrityChanged,
+				Detail: fmt.Sprintf("%d bytes, expected %d", got.Size, want.Size),
+			})
+		}
+	}
+	var unlisted []string
+	for name := range actual {
+		if !seen[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		report.Problems = append(report.Problems, IntegrityProblem{Path: name, Status: IntegrityUnlisted})
+	}
+	return report, nil
+}
+
+func hasProblem(problems []IntegrityProblem, name string) bool {
+	for _, p := range problems {
+		if p.Path == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readZipFile reads an entry in full, which makes archive/zip check its
+// CRC.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func checksumOf(name string, data []byte) FileChecksum {
+	sum := sha256.Sum256(data)
+	return FileChecksum{Path: name, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
+
+// computeChecksums hashes every file under rootDir but the checksum
+// manifest. The mimetype is hashed as the zip writer stores it, whatever
+// the file on disk holds.
+func computeChecksums(rootDir string) (*Checksums, error) {
+	sums := &Checksums{Algorithm: "sha256"}
+	sums.Files = append(sums.Files, checksumOf("mimetype", []byte(epubMimeType)))
+	err := filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == ChecksumsFile || name == "mimetype" {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sums.Files = append(sums.Files, checksumOf(name, data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sums.Files, func(i, j int) bool { return sums.Files[i].Path < sums.Files[j].Path })
+	return sums, nil
+}
+
+// writeChecksums hashes the extracted book under rootDir, as currently on
+// disk, into its checksum manifest.
+func writeChecksums(rootDir string) (*Checksums, error) {
+	sums, err := computeChecksums(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(sums, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	dest := filepath.Join(rootDir, filepath.FromSlash(ChecksumsFile))
+	if err := ensureParentDir(dest); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(dest, append(out, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// refreshChecksums rewrites the checksum manifest of an extracted book if
+// it has one. It runs last before zipping, after every other file,
+// including the chapter hash sidecar, is final.
+func refreshChecksums(rootDir string) error {
+	if _, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(ChecksumsFile))); err != nil {
+		return nil
+	}
+	_, err := writeChecksums(rootDir)
+	return err
+}
@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumsEmbedVerifyAndRefresh(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Integrity", "en")
+
+	report, err := VerifyIntegrity(ctx, input)
+	if err != nil {
+		t.Fatalf("VerifyIntegrity: %v", err)
+	}
+	if report.HasChecksums || !report.OK() {
+		t.Fatalf("fresh book: %+v", report)
+	}
+
+	sums, cs, err := EmbedChecksums(ctx, input, ChecksumOptions{})
+	if err != nil {
+		t.Fatalf("EmbedChecksums: %v", err)
+	}
+	if len(cs.Files) != 1 || cs.Files[0].Kind != "added" {
+		t.Fatalf("changes = %+v", cs.Files)
+	}
+	if sums.Files[0].Path != "META-INF/container.xml" || len(sums.Files[0].SHA256) != 64 {
+		t.Fatalf("checksums = %+v", sums.Files)
+	}
+	report, err = VerifyIntegrity(ctx, input)
+	if err != nil || !report.HasChecksums || !report.OK() || report.Checked != len(sums.Files) {
+		t.Fatalf("after embed: %+v, %v", report, err)
+	}
+
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Title: stringPtr("Renamed")}}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	report, err = VerifyIntegrity(ctx, input)
+	if err != nil || !report.HasChecksums || !report.OK() {
+		t.Fatalf("manifest not refreshed on save: %+v, %v", report, err)
+	}
+
+	// Alter a chapter and slip in a file behind novfmt's back.
+	tampered := filepath.Join(t.TempDir(), "tampered.epub")
+	copyZip(t, input, tampered, map[string]string{
+		"OEBPS/chapter.xhtml": "<html/>",
+		"OEBPS/extra.css":     "p {}",
+	})
+	report, err = VerifyIntegrity(ctx, tampered)
+	if err != nil {
+		t.Fatalf("VerifyIntegrity: %v", err)
+	}
+	want := []IntegrityProblem{
+		{Path: "OEBPS/chapter.xhtml", Status: IntegrityChanged},
+		{Path: "OEBPS/extra.css", Status: IntegrityUnlisted},
+	}
+	if len(report.Problems) != len(want) {
+		t.Fatalf("problems = %+v", report.Problems)
+	}
+	for i, p := range report.Problems {
+		if p.Path != want[i].Path || p.Status != want[i].Status {
+			t.Fatalf("problem %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+}
+
+// copyZip copies the zip at src to dst, replacing or adding the entries
+// in replace.
+func copyZip(t *testing.T, src, dst string, replace map[string]string) {
+	t.Helper()
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, entry := range r.File {
+		out, err := w.Create(entry.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := replace[entry.Name]; ok {
+			io.WriteString(out, data)
+			delete(replace, entry.Name)
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(out, rc)
+		rc.Close()
+	}
+	for name, data := range replace {
+		out, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,282 @@
+// Command gen writes the Unicode tables behind the epub package's NFC
+// normalization, nfc_tables.go, from the Unicode Character Database.
+//
+// It reads UnicodeData.txt and CompositionExclusions.txt from -ucd, a
+// directory or a URL, and is run from internal/epub by go generate.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultVersion = "14.0.0"
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gen: ")
+	version := flag.String("version", defaultVersion, "Unicode version the tables are built from")
+	ucd := flag.String("ucd", "", "directory or URL holding UnicodeData.txt and CompositionExclusions.txt (default the Unicode site for -version)")
+	out := flag.String("o", "nfc_tables.go", "file to write")
+	flag.Parse()
+	if *ucd == "" {
+		*ucd = "https://www.unicode.org/Public/" + *version + "/ucd"
+	}
+
+	data, err := readUCD(*ucd, "UnicodeData.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	exclusions, err := readUCD(*ucd, "CompositionExclusions.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, err := parseTables(data, exclusions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(t.write(*version))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readUCD returns the file name from base, a directory or a URL.
+func readUCD(base, name string) ([]byte, error) {
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		return os.ReadFile(filepath.Join(base, name))
+	}
+	url := strings.TrimSuffix(base, "/") + "/" + path.Base(name)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type tables struct {
+	ccc map[rune]uint8
+	// raw holds the canonical decompositions as UnicodeData.txt lists
+	// them, one level deep.
+	raw        map[rune][]rune
+	excluded   map[rune]bool
+	decomposed map[rune][]rune
+	composed   map[[2]rune]rune
+}
+
+// parseTables reads the combining classes and canonical decompositions
+// from UnicodeData.txt and the composition exclusions, and derives the
+// full decompositions and primary composites.
+func parseTables(data, exclusions []byte) (*tables, error) {
+	t := &tables{
+		ccc:        map[rune]uint8{},
+		raw:        map[rune][]rune{},
+		excluded:   map[rune]bool{},
+		decomposed: map[rune][]rune{},
+		composed:   map[[2]rune]rune{},
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ";")
+		if len(fields) < 6 {
+			continue
+		}
+		c, err := parseRune(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("UnicodeData.txt: %w", err)
+		}
+		cc, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("UnicodeData.txt: %04X: %w", c, err)
+		}
+		if cc != 0 {
+			t.ccc[c] = uint8(cc)
+		}
+		// Compatibility decompositions start with a <tag>.
+		if fields[5] == "" || strings.HasPrefix(fields[5], "<") {
+			continue
+		}
+		for _, f := range strings.Fields(fields[5]) {
+			r, err := parseRune(f)
+			if err != nil {
+				return nil, fmt.Errorf("UnicodeData.txt: %04X: %w", c, err)
+			}
+			t.raw[c] = append(t.raw[c], r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sc = bufio.NewScanner(bytes.NewReader(exclusions))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		c, err := parseRune(line)
+		if err != nil {
+			return nil, fmt.Errorf("CompositionExclusions.txt: %w", err)
+		}
+		t.excluded[c] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	for c, d := range t.raw {
+		// Hangul syllables are listed as a range without decompositions;
+		// CJK compatibility ideographs are kept by normalizeNFC.
+		if isCJKCompatibility(c) {
+			continue
+		}
+		t.decomposed[c] = t.decompose(c)
+		// Singletons, composition exclusions and decompositions starting
+		// with a non-starter do not compose.
+		if len(d) == 2 && !t.excluded[c] && t.ccc[c] == 0 && t.ccc[d[0]] == 0 {
+			t.composed[[2]rune{d[0], d[1]}] = c
+		}
+	}
+	return t, nil
+}
+
+// decompose returns the full canonical decomposition of c in canonical
+// order.
+func (t *tables) decompose(c rune) []rune {
+	var out []rune
+	var walk func(rune)
+	walk = func(r rune) {
+		d, ok := t.raw[r]
+		if !ok {
+			out = append(out, r)
+			return
+		}
+		for _, x := range d {
+			walk(x)
+		}
+	}
+	walk(c)
+	// Canonical ordering: sort each run of non-starters by class.
+	for i := 1; i < len(out); i++ {
+		for j := i; j > 0; j-- {
+			cc := t.ccc[out[j]]
+			if cc == 0 || t.ccc[out[j-1]] <= cc {
+				break
+			}
+			out[j-1], out[j] = out[j], out[j-1]
+		}
+	}
+	return out
+}
+
+func isCJKCompatibility(c rune) bool {
+	return c >= 0xF900 && c <= 0xFAFF || c >= 0x2F800 && c <= 0x2FA1F
+}
+
+func parseRune(s string) (rune, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return rune(n), nil
+}
+
+// write returns the source of nfc_tables.go.
+func (t *tables) write(version string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated from the Unicode Character Database %s. DO NOT EDIT.\n\npackage epub\n\n", version)
+
+	b.WriteString("// nfcCombiningClass holds the non-zero canonical combining classes.\n")
+	b.WriteString("var nfcCombiningClass = map[rune]uint8{\n")
+	keys := sortedRunes(t.ccc)
+	writeRows(&b, len(keys), 8, func(i int) string {
+		return fmt.Sprintf("0x%04X: %d,", keys[i], t.ccc[keys[i]])
+	})
+	b.WriteString("}\n\n")
+
+	b.WriteString("// nfcDecomposition holds full canonical decompositions, leaving out\n")
+	b.WriteString("// Hangul syllables, which are decomposed arithmetically, and CJK\n")
+	b.WriteString("// compatibility ideographs, which normalizeNFC keeps.\n")
+	b.WriteString("var nfcDecomposition = map[rune]string{\n")
+	keys = sortedRunes(t.decomposed)
+	writeRows(&b, len(keys), 4, func(i int) string {
+		return fmt.Sprintf("0x%04X: %s,", keys[i], runeLiteral(t.decomposed[keys[i]]))
+	})
+	b.WriteString("}\n\n")
+
+	b.WriteString("// nfcComposition holds the primary composites by their two-rune\n")
+	b.WriteString("// canonical decomposition.\n")
+	b.WriteString("var nfcComposition = map[[2]rune]rune{\n")
+	pairs := make([][2]rune, 0, len(t.composed))
+	for p := range t.composed {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	writeRows(&b, len(pairs), 4, func(i int) string {
+		return fmt.Sprintf("{0x%04X, 0x%04X}: 0x%04X,", pairs[i][0], pairs[i][1], t.composed[pairs[i]])
+	})
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// writeRows writes n entries, perRow to a line.
+func writeRows(b *bytes.Buffer, n, perRow int, entry func(int) string) {
+	for i := 0; i < n; i += perRow {
+		b.WriteString("\t")
+		for j := i; j < min(i+perRow, n); j++ {
+			if j > i {
+				b.WriteString(" ")
+			}
+			b.WriteString(entry(j))
+		}
+		b.WriteString("\n")
+	}
+}
+
+func sortedRunes[V any](m map[rune]V) []rune {
+	keys := make([]rune, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// runeLiteral returns rs as a Go string literal of \u and \U escapes.
+func runeLiteral(rs []rune) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range rs {
+		if r < 0x10000 {
+			fmt.Fprintf(&b, `\u%04X`, r)
+		} else {
+			fmt.Fprintf(&b, `\U%08X`, r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
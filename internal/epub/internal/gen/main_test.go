@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTables(t *testing.T) {
+	data := strings.Join([]string{
+		"0041;LATIN CAPITAL LETTER A;Lu;0;L;;;;;N;;;;0061;",
+		"0073;LATIN SMALL LETTER S;Ll;0;L;;;;;N;;;0053;;0053",
+		"00C5;LATIN CAPITAL LETTER A WITH RING ABOVE;Lu;0;L;0041 030A;;;;N;;;;00E5;",
+		"0301;COMBINING ACUTE ACCENT;Mn;230;NSM;;;;;N;;;;;",
+		"0307;COMBINING DOT ABOVE;Mn;230;NSM;;;;;N;;;;;",
+		"0308;COMBINING DIAERESIS;Mn;230;NSM;;;;;N;;;;;",
+		"030A;COMBINING RING ABOVE;Mn;230;NSM;;;;;N;;;;;",
+		"0323;COMBINING DOT BELOW;Mn;220;NSM;;;;;N;;;;;",
+		"0344;COMBINING GREEK DIALYTIKA TONOS;Mn;230;NSM;0308 0301;;;;N;;;;;",
+		"0915;DEVANAGARI LETTER KA;Lo;0;L;;;;;N;;;;;",
+		"093C;DEVANAGARI SIGN NUKTA;Mn;7;NSM;;;;;N;;;;;",
+		"0958;DEVANAGARI LETTER QA;Lo;0;L;0915 093C;;;;N;;;;;",
+		"1E63;LATIN SMALL LETTER S WITH DOT BELOW;Ll;0;L;0073 0323;;;;N;;;1E62;;1E62",
+		"1E69;LATIN SMALL LETTER S WITH DOT BELOW AND DOT ABOVE;Ll;0;L;1E63 0307;;;;N;;;1E68;;1E68",
+		"212B;ANGSTROM SIGN;Lu;0;L;00C5;;;;N;ANGSTROM UNIT;;;00E5;",
+		"2460;CIRCLED DIGIT ONE;No;0;ON;<circle> 0031;;1;1;N;;;;;",
+		"F900;CJK COMPATIBILITY IDEOGRAPH-F900;Lo;0;L;8C48;;;;N;;;;;",
+	}, "\n")
+	exclusions := "# Script Specifics\n0958    #  DEVANAGARI LETTER QA\n"
+	tab, err := parseTables([]byte(data), []byte(exclusions))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDecomposed := map[rune][]rune{
+		0x00C5: {0x0041, 0x030A},
+		0x0344: {0x0308, 0x0301},
+		0x0958: {0x0915, 0x093C},
+		0x1E63: {0x0073, 0x0323},
+		0x1E69: {0x0073, 0x0323, 0x0307},
+		0x212B: {0x0041, 0x030A},
+	}
+	if !reflect.DeepEqual(tab.decomposed, wantDecomposed) {
+		t.Fatalf("decomposed = %X\nwant %X", tab.decomposed, wantDecomposed)
+	}
+	// The singleton, the non-starter decomposition and the exclusion
+	// do not compose.
+	wantComposed := map[[2]rune]rune{
+		{0x0041, 0x030A}: 0x00C5,
+		{0x0073, 0x0323}: 0x1E63,
+		{0x1E63, 0x0307}: 0x1E69,
+	}
+	if !reflect.DeepEqual(tab.composed, wantComposed) {
+		t.Fatalf("composed = %X\nwant %X", tab.composed, wantComposed)
+	}
+
+	src := string(tab.write("14.0.0"))
+	for _, want := range []string{
+		"// Code generated from the Unicode Character Database 14.0.0. DO NOT EDIT.",
+		"\t0x0301: 230, 0x0307: 230, 0x0308: 230, 0x030A: 230, 0x0323: 220, 0x0344: 230, 0x093C: 7,\n",
+		`0x1E69: "\u0073\u0323\u0307",`,
+		"{0x0041, 0x030A}: 0x00C5,",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("output lacks %q:\n%s", want, src)
+		}
+	}
+}
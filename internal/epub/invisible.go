@@ -0,0 +1,305 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// InvisibleChar is a character that shows nothing but gets in the way of
+// search, text-to-speech and line breaking when it leaks from a source
+// document.
+type InvisibleChar struct {
+	Rune rune   `json:"rune"`
+	Name string `json:"name"`
+	// Group is "bidi" for directional marks, else empty.
+	Group       string `json:"group,omitempty"`
+	Description string `json:"description"`
+}
+
+var invisibleChars = []InvisibleChar{
+	{'\u00AD', "shy", "", "soft hyphen"},
+	{'\u200B', "zwsp", "", "zero-width space"},
+	{'\u200C', "zwnj", "", "zero-width non-joiner"},
+	{'\u200D', "zwj", "", "zero-width joiner"},
+	{'\u2060', "wj", "", "word joiner"},
+	{'\uFEFF', "bom", "", "byte order mark"},
+	{'\u200E', "lrm", "bidi", "left-to-right mark"},
+	{'\u200F', "rlm", "bidi", "right-to-left mark"},
+	{'\u061C', "alm", "bidi", "Arabic letter mark"},
+	{'\u202A', "lre", "bidi", "left-to-right embedding"},
+	{'\u202B', "rle", "bidi", "right-to-left embedding"},
+	{'\u202C', "pdf", "bidi", "pop directional formatting"},
+	{'\u202D', "lro", "bidi", "left-to-right override"},
+	{'\u202E', "rlo", "bidi", "right-to-left override"},
+	{'\u2066', "lri", "bidi", "left-to-right isolate"},
+	{'\u2067', "rli", "bidi", "right-to-left isolate"},
+	{'\u2068', "fsi", "bidi", "first strong isolate"},
+	{'\u2069', "pdi", "bidi", "pop directional isolate"},
+}
+
+var invisibleByRune = func() map[rune]InvisibleChar {
+	m := map[rune]InvisibleChar{}
+	for _, c := range invisibleChars {
+		m[c.Rune] = c
+	}
+	return m
+}()
+
+// InvisibleChars returns the characters AuditInvisible looks for.
+func InvisibleChars() []InvisibleChar {
+	return append([]InvisibleChar(nil), invisibleChars...)
+}
+
+// ParseInvisibleKeep turns names (shy, zwj, ...), the group name bidi and
+// U+XXXX code points into the set of characters to leave alone.
+func ParseInvisibleKeep(names []string) (map[rune]bool, error) {
+	keep := map[rune]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, c := range invisibleChars {
+			if strings.EqualFold(name, c.Name) || strings.EqualFold(name, c.Group) {
+				keep[c.Rune] = true
+				found = true
+			}
+		}
+		if upper := strings.ToUpper(name); !found && strings.HasPrefix(upper, "U+") {
+			n, err := strconv.ParseUint(upper[2:], 16, 32)
+			if _, ok := invisibleByRune[rune(n)]; err == nil && ok {
+				keep[rune(n)] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown invisible character %q", name)
+		}
+	}
+	return keep, nil
+}
+
+type InvisibleOptions struct {
+	// Strip removes the characters found; without it the book is only
+	// audited.
+	Strip bool
+	// Keep lists characters to leave alone, as ParseInvisibleKeep accepts.
+	Keep     []string
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+type InvisibleFile struct {
+	Href   string         `json:"href"`
+	Counts map[string]int `json:"counts"`
+	Total  int            `json:"total"`
+}
+
+type InvisibleReport struct {
+	Files []InvisibleFile `json:"files"`
+	// Counts totals each character, by name, across the book.
+	Counts    map[string]int `json:"counts"`
+	Total     int            `json:"total"`
+	Changeset Changeset      `json:"changeset"`
+}
+
+// AuditInvisible counts soft hyphens, zero-width characters, stray byte
+// order marks and directional marks in the text of every XHTML document
+// (except the nav), and with opts.Strip removes them. A zero-width joiner
+// between two emoji builds a single emoji and is always kept.
+func AuditInvisible(ctx context.Context, input string, opts InvisibleOptions) (InvisibleReport, error) {
+	report := InvisibleReport{Files: []InvisibleFile{}, Counts: map[string]int{}}
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	keep, err := ParseInvisibleKeep(opts.Keep)
+	if err != nil {
+		return report, err
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return report, err
+		}
+		out, counts, err := stripInvisible(data, keep)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		if out == nil {
+			continue
+		}
+		file := InvisibleFile{Href: item.Href, Counts: counts}
+		for name, n := range counts {
+			file.Total += n
+			report.Counts[name] += n
+		}
+		log.Debug("invisible characters", "href", item.Href, "count", file.Total)
+		report.Total += file.Total
+		report.Files = append(report.Files, file)
+		report.Changeset.modified(item.Href)
+		if opts.Strip && !opts.DryRun {
+			if err := os.WriteFile(src, out, 0o644); err != nil {
+				return report, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun || !opts.Strip, opts.Progress, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// invisiblePattern finds the characters literally or as character
+// references.
+var invisiblePattern = func() *regexp.Regexp {
+	var class strings.Builder
+	for _, c := range invisibleChars {
+		fmt.Fprintf(&class, `\x{%X}`, c.Rune)
+	}
+	return regexp.MustCompile(`[` + class.String() + `]|&#[xX][0-9a-fA-F]+;|&#[0-9]+;|&shy;`)
+}()
+
+// stripInvisible returns doc without the invisible characters in its text
+// (outside script and style), and how many of each it removed. out is nil
+// when there were none. Only the text is touched, byte for byte.
+func stripInvisible(doc []byte, keep map[rune]bool) ([]byte, map[string]int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	dec.Strict = false
+
+	counts := map[string]int{}
+	var out bytes.Buffer
+	prev, hidden := 0, 0
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if name := strings.ToLower(t.Name.Local); name == "script" || name == "style" {
+				hidden++
+			}
+		case xml.EndElement:
+			if name := strings.ToLower(t.Name.Local); name == "script" || name == "style" {
+				hidden--
+			}
+		case xml.CharData:
+			if hidden > 0 {
+				continue
+			}
+			end := int(dec.InputOffset())
+			raw := doc[start:end]
+			locs := invisiblePattern.FindAllIndex(raw, -1)
+			for _, loc := range locs {
+				r := invisibleRef(raw[loc[0]:loc[1]])
+				c, ok := invisibleByRune[r]
+				if !ok || keep[r] || (r == '\u200D' && emojiJoined(raw[:loc[0]], raw[loc[1]:])) {
+					continue
+				}
+				if r == '\uFEFF' && start+loc[0] == 0 {
+					// A byte order mark heading the file is an encoding signature.
+					continue
+				}
+				counts[c.Name]++
+				out.Write(doc[prev : start+loc[0]])
+				prev = start + loc[1]
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return nil, nil, nil
+	}
+	out.Write(doc[prev:])
+	return out.Bytes(), counts, nil
+}
+
+// invisibleRef decodes one match of invisiblePattern.
+func invisibleRef(m []byte) rune {
+	s := string(m)
+	switch {
+	case s == "&shy;":
+		return '\u00AD'
+	case strings.HasPrefix(s, "&#x"), strings.HasPrefix(s, "&#X"):
+		n, _ := strconv.ParseUint(s[3:len(s)-1], 16, 32)
+		return rune(n)
+	case strings.HasPrefix(s, "&#"):
+		n, _ := strconv.ParseUint(s[2:len(s)-1], 10, 32)
+		return rune(n)
+	}
+	r, _ := utf8.DecodeRune(m)
+	return r
+}
+
+// emojiJoined reports whether a zero-width joiner between before and after
+// is part of an emoji sequence, such as woman + ZWJ + laptop.
+func emojiJoined(before, after []byte) bool {
+	b, _ := utf8.DecodeLastRune(before)
+	a, _ := utf8.DecodeRune(after)
+	return pictographic(b) && pictographic(a)
+}
+
+func pictographic(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) || r == 0xFE0F
+}
+
+// invisibleNames lists counts by name in the order of invisibleChars.
+func invisibleNames(counts map[string]int) []string {
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	order := map[string]int{}
+	for i, c := range invisibleChars {
+		order[c.Name] = i
+	}
+	sort.Slice(names, func(i, j int) bool { return order[names[i]] < order[names[j]] })
+	return names
+}
+
+// FormatInvisibleCounts renders counts as "shy 3, zwsp 1".
+func FormatInvisibleCounts(counts map[string]int) string {
+	var parts []string
+	for _, name := range invisibleNames(counts) {
+		parts = append(parts, fmt.Sprintf("%s %d", name, counts[name]))
+	}
+	return strings.Join(parts, ", ")
+}
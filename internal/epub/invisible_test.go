@@ -0,0 +1,93 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripInvisible(t *testing.T) {
+	src := "\uFEFF<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><style>p::after { content: \"\u200B\" }</style></head><body>\n" +
+		"<p title=\"a\u00ADb\">ex\u00ADam&shy;ple and\u200B&#x200b;more</p>\n" +
+		"<p>\u200Fmarked\u200E &#8207;text\uFEFF</p>\n" +
+		"<p>team \U0001F469\u200D\U0001F4BB and n\u200Dj</p>\n" +
+		"</body></html>"
+
+	out, counts, err := stripInvisible([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("stripInvisible: %v", err)
+	}
+	want := map[string]int{"shy": 2, "zwsp": 2, "rlm": 2, "lrm": 1, "bom": 1, "zwj": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts = %v, want %v", counts, want)
+	}
+	wantOut := "\uFEFF<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><style>p::after { content: \"\u200B\" }</style></head><body>\n" +
+		"<p title=\"a\u00ADb\">example andmore</p>\n" +
+		"<p>marked text</p>\n" +
+		"<p>team \U0001F469\u200D\U0001F4BB and nj</p>\n" +
+		"</body></html>"
+	if string(out) != wantOut {
+		t.Fatalf("output:\n%s\nwant:\n%s", out, wantOut)
+	}
+
+	keep, err := ParseInvisibleKeep([]string{"shy", "bidi", "U+200b"})
+	if err != nil {
+		t.Fatalf("ParseInvisibleKeep: %v", err)
+	}
+	_, counts, err = stripInvisible([]byte(src), keep)
+	if err != nil {
+		t.Fatalf("stripInvisible: %v", err)
+	}
+	if want := map[string]int{"bom": 1, "zwj": 1}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts with keep = %v, want %v", counts, want)
+	}
+	if _, err := ParseInvisibleKeep([]string{"U+0041"}); err == nil {
+		t.Fatal("expected an error for a visible character")
+	}
+}
+
+func TestAuditInvisible(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/><item id="b" href="b.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": "<html xmlns=\"http://www.w3.org/1999/xhtml\"><body><p>hy\u00ADphen\u200B</p></body></html>",
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Clean.</p></body></html>`,
+	})
+
+	report, err := AuditInvisible(ctx, input, InvisibleOptions{})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if report.Total != 2 || len(report.Files) != 1 || report.Files[0].Href != "a.xhtml" || report.Changeset.Outcome != OutcomeDryRun {
+		t.Fatalf("audit report = %+v", report)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.epub")
+	report, err = AuditInvisible(ctx, input, InvisibleOptions{Strip: true, Keep: []string{"shy"}, OutPath: out})
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if report.Total != 1 || !report.Changeset.Written() {
+		t.Fatalf("strip report = %+v", report)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "a.xhtml"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := "<p>hy\u00ADphen</p>"; !strings.Contains(string(data), want) {
+		t.Fatalf("expected %q in %s", want, data)
+	}
+}
@@ -0,0 +1,464 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type JoinOptions struct {
+	// Depth is how many levels of the table of contents start a chapter
+	// (default 1: only top-level entries).
+	Depth int
+	// MaxSize stops a chapter file from growing past this many bytes
+	// (default DefaultMaxChapterSize); the next fragment starts a new file.
+	MaxSize  int64
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ChapterJoin is one chapter file JoinChapters built: Href is the first
+// fragment, which the others were appended to in Parts order.
+type ChapterJoin struct {
+	Href  string   `json:"href"`
+	Parts []string `json:"parts"`
+	Size  int64    `json:"size"`
+}
+
+type JoinResult struct {
+	Joins []ChapterJoin `json:"joins"`
+	// SpineBefore and SpineAfter count the spine items.
+	SpineBefore int       `json:"spine_before"`
+	SpineAfter  int       `json:"spine_after"`
+	Changeset   Changeset `json:"changeset"`
+}
+
+var (
+	styleElementPattern = regexp.MustCompile(`(?is)<style\b.*?</style\s*>`)
+	bodyEndPattern      = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+// joinedFile records where a fragment went: into dest, after an empty
+// element with id marker, with the ids in renamed changed to avoid
+// clashing with ids already in dest.
+type joinedFile struct {
+	dest, marker string
+	renamed      map[string]string
+}
+
+// JoinChapters merges runs of consecutive spine documents that belong to
+// the same table of contents entry into one file per entry, for books
+// converted one page per file. A run starts at a document an entry (down
+// to opts.Depth) points at and takes the documents after it up to the
+// next one; documents before the first entry are left alone. The first
+// document of a run keeps its name. Links to the others, the navigation
+// included, are pointed into it. Fixed-layout pages, each sized by its
+// own viewport, are never joined.
+func JoinChapters(ctx context.Context, input string, opts JoinOptions) (JoinResult, error) {
+	res := JoinResult{Joins: []ChapterJoin{}}
+	if input == "" {
+		return res, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.MaxSize < 0 {
+		return res, fmt.Errorf("max size must not be negative")
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxChapterSize
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = 1
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	starts, err := chapterStarts(vol, opts.Depth)
+	if err != nil {
+		return res, err
+	}
+	if len(starts) == 0 {
+		return res, fmt.Errorf("the book has no table of contents to group its spine by (run toc first)")
+	}
+
+	pkg := vol.PackageDoc
+	items := map[string]ManifestItem{}
+	for _, item := range pkg.Manifest.Items {
+		items[item.ID] = item
+	}
+	type run struct {
+		hrefs []string
+		ids   []string
+		size  int64
+	}
+	var (
+		runs    []*run
+		current *run
+		linear  string
+	)
+	res.SpineBefore = len(pkg.Spine.Itemrefs)
+	book := renditionOf(pkg.Metadata)
+	for _, ref := range pkg.Spine.Itemrefs {
+		item, ok := items[ref.IDRef]
+		if !ok || item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") || itemRendition(book, ref).fixedLayout() {
+			current = nil
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		info, err := os.Stat(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return res, err
+		}
+		switch {
+		case starts[href]:
+		case current == nil:
+			continue
+		case ref.Linear != linear || current.size+info.Size() > opts.MaxSize:
+			log.Debug("chapter continues in a new file", "href", href)
+		default:
+			current.hrefs = append(current.hrefs, href)
+			current.ids = append(current.ids, ref.IDRef)
+			current.size += info.Size()
+			continue
+		}
+		current = &run{hrefs: []string{href}, ids: []string{ref.IDRef}, size: info.Size()}
+		linear = ref.Linear
+		runs = append(runs, current)
+	}
+
+	joined := map[string]joinedFile{}
+	dropped := map[string]bool{}
+	for i, r := range runs {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		opts.Progress.report(StageRewrite, i, len(runs), r.hrefs[0])
+		if len(r.hrefs) < 2 {
+			continue
+		}
+		size, err := joinDocuments(vol.PackageDir, r.hrefs, joined)
+		if err != nil {
+			return res, err
+		}
+		res.Changeset.modified(r.hrefs[0])
+		for n, href := range r.hrefs[1:] {
+			if err := os.Remove(filepath.Join(vol.PackageDir, filepath.FromSlash(href))); err != nil {
+				return res, err
+			}
+			dropped[r.ids[n+1]] = true
+			res.Changeset.removed(href)
+		}
+		log.Debug("joined documents", "href", r.hrefs[0], "parts", len(r.hrefs))
+		res.Joins = append(res.Joins, ChapterJoin{Href: r.hrefs[0], Parts: r.hrefs, Size: size})
+	}
+	opts.Progress.report(StageRewrite, len(runs), len(runs), "")
+
+	if len(res.Joins) > 0 {
+		refs := pkg.Spine.Itemrefs[:0]
+		for _, ref := range pkg.Spine.Itemrefs {
+			if !dropped[ref.IDRef] {
+				refs = append(refs, ref)
+			}
+		}
+		pkg.Spine.Itemrefs = refs
+		kept := pkg.Manifest.Items[:0]
+		for _, item := range pkg.Manifest.Items {
+			if !dropped[item.ID] {
+				kept = append(kept, item)
+			}
+		}
+		pkg.Manifest.Items = kept
+		res.Changeset.modified(packageHref(vol))
+
+		changed, err := rewriteAnchoredRefs(vol.PackageDir, pkg, nil, func(target, frag string) (string, string, bool) {
+			j, ok := joined[target]
+			if !ok {
+				return "", "", false
+			}
+			if frag == "" {
+				return j.dest, j.marker, true
+			}
+			if id, ok := j.renamed[frag]; ok {
+				return j.dest, id, true
+			}
+			return j.dest, frag, true
+		})
+		if err != nil {
+			return res, err
+		}
+		for _, href := range changed {
+			if !res.Changeset.has(href) {
+				res.Changeset.modified(href)
+			}
+		}
+	}
+	res.SpineAfter = len(pkg.Spine.Itemrefs)
+
+	if err := res.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// chapterStarts returns the package-relative documents the table of
+// contents points at down to depth levels, from the navigation document
+// or, failing that, the NCX.
+func chapterStarts(vol *Volume, depth int) (map[string]bool, error) {
+	starts := map[string]bool{}
+	if vol.NavHref != "" {
+		navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+		var walk func(items []NavItem, level int)
+		walk = func(items []NavItem, level int) {
+			for _, item := range items {
+				target, _, _ := strings.Cut(item.Href, "#")
+				if target != "" && !strings.Contains(target, ":") {
+					starts[normalizeEPUBPath(path.Join(navDir, target))] = true
+				}
+				if level < depth {
+					walk(item.Children, level+1)
+				}
+			}
+		}
+		walk(vol.NavItems, 1)
+		return starts, nil
+	}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.MediaType != "application/x-dtbncx+xml" {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return nil, err
+		}
+		targets, err := ncxTargets(data, depth)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", href, err)
+		}
+		for _, target := range targets {
+			starts[normalizeEPUBPath(path.Join(path.Dir(href), target))] = true
+		}
+		break
+	}
+	return starts, nil
+}
+
+// ncxTargets returns the files the navPoints of an NCX point at, down to
+// depth levels, relative to the NCX.
+func ncxTargets(data []byte, depth int) ([]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	var targets []string
+	level := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return targets, nil
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "navPoint":
+				level++
+			case "content":
+				target, _, _ := strings.Cut(attrValue(t.Attr, "src"), "#")
+				if level > 0 && level <= depth && target != "" {
+					targets = append(targets, target)
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "navPoint" {
+				level--
+			}
+		}
+	}
+}
+
+// joinDocuments appends the bodies of hrefs[1:] to the body of hrefs[0],
+// each after an empty element whose id takes links to the file, and
+// copies stylesheets the first document lacks into its head. Links inside
+// the appended bodies are rebased onto the first document; ids already
+// used there are renamed. Where each file went is recorded in joined.
+// It returns the size of the result.
+func joinDocuments(pkgDir string, hrefs []string, joined map[string]joinedFile) (int64, error) {
+	dest := hrefs[0]
+	destDir := path.Dir(dest)
+	destPath := filepath.Join(pkgDir, filepath.FromSlash(dest))
+	data, err := os.ReadFile(destPath)
+	if err != nil {
+		return 0, err
+	}
+	doc := string(data)
+	ids := map[string]bool{}
+	for _, m := range idAttrPattern.FindAllStringSubmatch(doc, -1) {
+		ids[strings.Trim(m[1], `"'`)] = true
+	}
+	stylesheets := map[string]bool{}
+	var head, body strings.Builder
+	for _, tag := range linkTagPattern.FindAllString(doc, -1) {
+		if m := hrefAttrPattern.FindStringSubmatch(tag); m != nil {
+			stylesheets[normalizeEPUBPath(path.Join(destDir, strings.Trim(m[2], `"'`)))] = true
+		}
+	}
+
+	for _, href := range hrefs[1:] {
+		src, err := os.ReadFile(filepath.Join(pkgDir, filepath.FromSlash(href)))
+		if err != nil {
+			return 0, err
+		}
+		open, close, bodyID, err := bodyRange(src)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", href, err)
+		}
+		dir := path.Dir(href)
+
+		for _, tag := range linkTagPattern.FindAllString(string(src[:open]), -1) {
+			rel := relAttrPattern.FindStringSubmatch(tag)
+			m := hrefAttrPattern.FindStringSubmatch(tag)
+			if rel == nil || m == nil || !strings.Contains(strings.ToLower(rel[1]), "stylesheet") {
+				continue
+			}
+			target := normalizeEPUBPath(path.Join(dir, strings.Trim(m[2], `"'`)))
+			if stylesheets[target] {
+				continue
+			}
+			stylesheets[target] = true
+			head.WriteString(setLinkHref(tag, relativeHref(destDir, target)) + "\n")
+		}
+		for _, style := range styleElementPattern.FindAllString(string(src[:open]), -1) {
+			if !strings.Contains(doc, style) && !strings.Contains(head.String(), style) {
+				head.WriteString(style + "\n")
+			}
+		}
+
+		j := joinedFile{dest: dest, renamed: map[string]string{}}
+		content := string(src[open:close])
+		for _, m := range idAttrPattern.FindAllStringSubmatch(content, -1) {
+			id := strings.Trim(m[1], `"'`)
+			if ids[id] {
+				fresh := id
+				for n := 2; ids[fresh]; n++ {
+					fresh = fmt.Sprintf("%s-%d", id, n)
+				}
+				j.renamed[id] = fresh
+				id = fresh
+			}
+			ids[id] = true
+		}
+		if len(j.renamed) > 0 {
+			content = idAttrPattern.ReplaceAllStringFunc(content, func(m string) string {
+				sub := idAttrPattern.FindStringSubmatch(m)
+				if fresh, ok := j.renamed[strings.Trim(sub[1], `"'`)]; ok {
+					return strings.Replace(m, sub[1], `"`+fresh+`"`, 1)
+				}
+				return m
+			})
+			content = refAttrPattern.ReplaceAllStringFunc(content, func(m string) string {
+				sub := refAttrPattern.FindStringSubmatch(m)
+				frag, ok := strings.CutPrefix(strings.Trim(sub[2], `"'`), "#")
+				if fresh := j.renamed[frag]; ok && fresh != "" {
+					return sub[1] + `"#` + fresh + `"`
+				}
+				return m
+			})
+		}
+		if dir != destDir {
+			content, _ = rewriteRefs(content, refAttrPattern, dir, destDir, func(target string) (string, bool) {
+				return target, true
+			})
+		}
+
+		j.marker = bodyID
+		if j.marker == "" || ids[j.marker] {
+			base := xhtmlIDSanitizer.ReplaceAllString(strings.TrimSuffix(path.Base(href), path.Ext(href)), "-")
+			if base == "" || !isNameStart(base[0]) {
+				base = "x" + base
+			}
+			j.marker = base
+			for n := 2; ids[j.marker]; n++ {
+				j.marker = fmt.Sprintf("%s-%d", base, n)
+			}
+			if bodyID != "" {
+				j.renamed[bodyID] = j.marker
+			}
+		}
+		ids[j.marker] = true
+		fmt.Fprintf(&body, "<div id=\"%s\"></div>\n", j.marker)
+		body.WriteString(strings.Trim(content, "\n"))
+		body.WriteString("\n")
+		joined[href] = j
+	}
+
+	end := bodyEndPattern.FindAllStringIndex(doc, -1)
+	if end == nil {
+		return 0, fmt.Errorf("%s: no </body>", dest)
+	}
+	at := end[len(end)-1][0]
+	out := doc[:at] + body.String() + doc[at:]
+	if head.Len() > 0 {
+		if loc := headEndPattern.FindStringIndex(out); loc != nil {
+			out = out[:loc[0]] + head.String() + out[loc[0]:]
+		}
+	}
+	if err := os.WriteFile(destPath, []byte(out), 0o644); err != nil {
+		return 0, err
+	}
+	return int64(len(out)), nil
+}
+
+// bodyRange returns the offsets just after the body start tag and at the
+// body end tag of an XHTML document, with the body's id.
+func bodyRange(data []byte) (int, int, string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	open, depth := -1, 0
+	id := ""
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case open >= 0:
+				depth++
+			case strings.EqualFold(t.Name.Local, "body"):
+				open = int(dec.InputOffset())
+				id = attrValue(t.Attr, "id")
+			}
+		case xml.EndElement:
+			if open < 0 {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			return open, offset, id, nil
+		}
+	}
+	return 0, 0, "", fmt.Errorf("no body element")
+}
@@ -0,0 +1,128 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildPagedBook(t *testing.T) string {
+	t.Helper()
+	page := func(head, body string) string {
+		return `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Page</title>` + head + `</head><body>
+` + body + `
+</body></html>`
+	}
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:paged</dc:identifier>
+    <dc:title>Paged</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="css" href="Styles/base.css" media-type="text/css"/>
+    <item id="extra" href="Styles/extra.css" media-type="text/css"/>
+    <item id="img" href="Images/map.png" media-type="image/png"/>
+    <item id="p0" href="Text/p0.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p1" href="Text/p1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p2" href="Text/p2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p3" href="Text/more/p3.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p4" href="Text/p4.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p5" href="Text/p5.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="p0"/>
+    <itemref idref="p1"/>
+    <itemref idref="p2"/>
+    <itemref idref="p3"/>
+    <itemref idref="p4"/>
+    <itemref idref="p5"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/p1.xhtml">One</a><ol><li><a href="Text/p2.xhtml">One, part two</a></li></ol></li><li><a href="Text/p4.xhtml">Two</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/Styles/base.css":    `p { margin: 0 }`,
+		"OEBPS/Styles/extra.css":   `.map { width: 100% }`,
+		"OEBPS/Images/map.png":     "png",
+		"OEBPS/Text/p0.xhtml":      page("", `<p>Cover</p>`),
+		"OEBPS/Text/p1.xhtml":      page(`<link rel="stylesheet" href="../Styles/base.css"/>`, `<h1 id="a">One</h1>`),
+		"OEBPS/Text/p2.xhtml":      page(`<link rel="stylesheet" href="../Styles/base.css"/><link rel="stylesheet" href="../Styles/extra.css"/>`, `<p id="a">Clash <a href="#a">here</a></p>`),
+		"OEBPS/Text/more/p3.xhtml": page("", `<p><img class="map" src="../../Images/map.png" alt="Map"/></p>`),
+		"OEBPS/Text/p4.xhtml":      page("", `<h1>Two</h1>`),
+		"OEBPS/Text/p5.xhtml":      page("", `<p><a href="p2.xhtml#a">Back</a> <a href="more/p3.xhtml">Map</a></p>`),
+	})
+}
+
+func TestJoinChapters(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "joined.epub")
+	res, err := JoinChapters(context.Background(), buildPagedBook(t), JoinOptions{OutPath: out})
+	if err != nil {
+		t.Fatalf("JoinChapters: %v", err)
+	}
+	if len(res.Joins) != 2 || res.SpineBefore != 6 || res.SpineAfter != 3 {
+		t.Fatalf("result = %+v", res)
+	}
+	if got := strings.Join(res.Joins[0].Parts, " "); got != "Text/p1.xhtml Text/p2.xhtml Text/more/p3.xhtml" {
+		t.Errorf("first chapter parts = %s", got)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := strings.Join(spineHrefs(vol.PackageDoc), " "); got != "Text/p0.xhtml Text/p1.xhtml Text/p4.xhtml" {
+		t.Errorf("spine = %s", got)
+	}
+	read := func(href string) string {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	ch1 := read("Text/p1.xhtml")
+	for _, want := range []string{
+		`<h1 id="a">One</h1>`,
+		`<div id="p2"></div>`,
+		`<p id="a-2">Clash <a href="#a-2">here</a></p>`,
+		`<div id="p3"></div>`,
+		`src="../Images/map.png"`,
+		`href="../Styles/extra.css"`,
+	} {
+		if !strings.Contains(ch1, want) {
+			t.Errorf("chapter missing %s:\n%s", want, ch1)
+		}
+	}
+	if strings.Count(ch1, "base.css") != 1 {
+		t.Errorf("stylesheet linked twice:\n%s", ch1)
+	}
+	if ch2 := read("Text/p4.xhtml"); !strings.Contains(ch2, `href="p1.xhtml#a-2"`) || !strings.Contains(ch2, `href="p1.xhtml#p3"`) {
+		t.Errorf("links not pointed into the chapter:\n%s", ch2)
+	}
+	if nav := read("nav.xhtml"); !strings.Contains(nav, `href="Text/p1.xhtml#p2"`) {
+		t.Errorf("nav not updated:\n%s", nav)
+	}
+	if _, err := os.Stat(filepath.Join(vol.PackageDir, "Text", "p2.xhtml")); !os.IsNotExist(err) {
+		t.Errorf("joined file left behind: %v", err)
+	}
+}
+
+func TestJoinChaptersRespectsMaxSize(t *testing.T) {
+	res, err := JoinChapters(context.Background(), buildPagedBook(t), JoinOptions{MaxSize: 450, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range res.Joins {
+		if len(j.Parts) > 2 {
+			t.Errorf("join over the size limit: %+v", j)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// landmark is an entry of the landmarks nav.
+type landmark struct {
+	types string
+	href  string
+	title string
+}
+
+// resolveStart returns the package-relative href that -start names: the
+// href of a spine document, optionally with a fragment, or a spine idref.
+func resolveStart(pkg *PackageDocument, spec string) (string, error) {
+	spec = strings.TrimSpace(spec)
+	target, frag, hasFrag := strings.Cut(spec, "#")
+	byID := manifestByID(pkg)
+	for _, ref := range pkg.Spine.Itemrefs {
+		item, ok := byID[ref.IDRef]
+		if !ok {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		if ref.IDRef == spec {
+			return href, nil
+		}
+		if strings.EqualFold(href, normalizeEPUBPath(target)) {
+			if hasFrag {
+				href += "#" + frag
+			}
+			return href, nil
+		}
+	}
+	return "", fmt.Errorf("start %q is neither a spine document nor a spine idref", spec)
+}
+
+func manifestByID(pkg *PackageDocument) map[string]ManifestItem {
+	out := make(map[string]ManifestItem, len(pkg.Manifest.Items))
+	for _, item := range pkg.Manifest.Items {
+		out[item.ID] = item
+	}
+	return out
+}
+
+// setReadingStart makes href, relative to the package document, the place
+// reading systems open the book: the bodymatter entry of the landmarks
+// nav, and the text reference of the guide of EPUB 2 books or of books
+// that have one.
+func setReadingStart(vol *Volume, href string, cs *Changeset) error {
+	pkg := vol.PackageDoc
+	if vol.NavHref != "" {
+		navPath := filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref))
+		changed, err := rewriteFile(navPath, func() error {
+			return setBodymatterLandmark(navPath, relativeHref(path.Dir(vol.NavHref), href))
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", vol.NavHref, err)
+		}
+		if changed {
+			cs.modified(vol.NavHref)
+		}
+	}
+	if pkg.Guide != nil || !strings.HasPrefix(pkg.Version, "3") {
+		if setGuideReference(pkg, "text", "Start", href) {
+			cs.modified(packageHref(vol))
+		}
+	}
+	return nil
+}
+
+// setGuideReference points the guide reference of type typ at href,
+// adding the guide or the reference when missing, and reports whether
+// anything changed.
+func setGuideReference(pkg *PackageDocument, typ, title, href string) bool {
+	if pkg.Guide == nil {
+		pkg.Guide = &Guide{}
+	}
+	for i, ref := range pkg.Guide.References {
+		if strings.EqualFold(ref.Type, typ) {
+			if ref.Href == href {
+				return false
+			}
+			pkg.Guide.References[i].Href = href
+			return true
+		}
+	}
+	pkg.Guide.References = append(pkg.Guide.References, GuideReference{Type: typ, Title: title, Href: href})
+	return true
+}
+
+// pruneGuide drops guide references to files that are no longer in the
+// manifest, and the guide once it is empty.
+func pruneGuide(pkg *PackageDocument) {
+	if pkg.Guide == nil {
+		return
+	}
+	kept := pkg.Guide.References[:0]
+	for _, ref := range pkg.Guide.References {
+		target, _, _ := strings.Cut(ref.Href, "#")
+		if target != "" && !hasManifestHref(pkg, target) {
+			continue
+		}
+		kept = append(kept, ref)
+	}
+	pkg.Guide.References = kept
+	if len(kept) == 0 {
+		pkg.Guide = nil
+	}
+}
+
+// setBodymatterLandmark points the bodymatter entry of the landmarks nav
+// in the nav document at navPath to href, relative to the nav document.
+// The other entries are kept; a nav document without landmarks gets them.
+func setBodymatterLandmark(navPath, href string) error {
+	data, err := os.ReadFile(navPath)
+	if err != nil {
+		return err
+	}
+	nav, err := findLandmarksNav(data)
+	if err != nil {
+		return err
+	}
+	entries := nav.entries
+	found := false
+	for i, e := range entries {
+		if containsString(strings.Fields(e.types), "bodymatter") {
+			entries[i].href = href
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, landmark{types: "bodymatter", href: href, title: "Start of Content"})
+	}
+
+	var buf bytes.Buffer
+	if nav.start < 0 {
+		end := bytes.LastIndex(data, []byte("</body>"))
+		if end < 0 {
+			return fmt.Errorf("no body element")
+		}
+		buf.Write(data[:end])
+		buf.WriteString(`<nav epub:type="landmarks" id="landmarks" hidden="hidden">` + "\n<h2>Landmarks</h2>\n")
+		writeLandmarks(&buf, entries)
+		buf.WriteString("</nav>\n")
+		buf.Write(data[end:])
+	} else {
+		buf.Write(data[:nav.bodyStart])
+		buf.WriteString("\n")
+		buf.Write(nav.heading)
+		if len(nav.heading) > 0 {
+			buf.WriteString("\n")
+		}
+		writeLandmarks(&buf, entries)
+		buf.Write(data[nav.bodyEnd:])
+	}
+	return os.WriteFile(navPath, buf.Bytes(), 0o644)
+}
+
+func writeLandmarks(buf *bytes.Buffer, entries []landmark) {
+	buf.WriteString("<ol>\n")
+	for _, e := range entries {
+		title := e.title
+		if title == "" {
+			title = e.types
+		}
+		fmt.Fprintf(buf, "<li><a epub:type=\"%s\" href=\"%s\">%s</a></li>\n", html.EscapeString(e.types), html.EscapeString(e.href), html.EscapeString(title))
+	}
+	buf.WriteString("</ol>\n")
+}
+
+// landmarksNav is the landmarks nav element of a nav document: where it
+// starts (-1 when there is none), where its content starts and ends, its
+// heading as written and its entries.
+type landmarksNav struct {
+	start, bodyStart, bodyEnd int
+	heading                   []byte
+	entries                   []landmark
+}
+
+func findLandmarksNav(data []byte) (landmarksNav, error) {
+	nav := landmarksNav{start: -1}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	depth, headingStart := 0, -1
+	var current *landmark
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return landmarksNav{start: -1}, nil
+			}
+			return nav, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			switch {
+			case nav.start < 0:
+				if name == "nav" && hasNavType(t.Attr, "landmarks") {
+					nav.start, nav.bodyStart = offset, int(dec.InputOffset())
+				}
+			case name == "nav":
+				depth++
+			case headingLevel(name) > 0 && headingStart < 0 && len(nav.heading) == 0:
+				headingStart = offset
+			case name == "a":
+				current = &landmark{types: epubTypeAttr(t.Attr), href: attrValue(t.Attr, "href")}
+			}
+		case xml.EndElement:
+			if nav.start < 0 {
+				continue
+			}
+			name := t.Name.Local
+			switch {
+			case name == "nav" && depth > 0:
+				depth--
+			case name == "nav":
+				nav.bodyEnd = offset
+				return nav, nil
+			case headingLevel(name) > 0 && headingStart >= 0:
+				nav.heading = data[headingStart:dec.InputOffset()]
+				headingStart = -1
+			case name == "a" && current != nil:
+				current.title = normalizeSpace(current.title)
+				nav.entries = append(nav.entries, *current)
+				current = nil
+			}
+		case xml.CharData:
+			if current != nil {
+				current.title += string(t)
+			}
+		}
+	}
+}
+
+// epubTypeAttr returns the epub:type attribute of an element.
+func epubTypeAttr(attrs []xml.Attr) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == "type" && (attr.Name.Space == "http://www.idpf.org/2007/ops" || attr.Name.Space == "epub") {
+			return attr.Value
+		}
+	}
+	return ""
+}
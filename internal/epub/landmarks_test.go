@@ -0,0 +1,74 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetReadingStart(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="nav" href="Nav/nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="copyright" href="Text/copyright.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="copyright"/><itemref idref="ch1"/></spine>
+  <guide><reference type="text" title="Start" href="Text/copyright.xhtml"/><reference type="notes" href="Text/gone.xhtml"/></guide>
+</package>`,
+		"OEBPS/Nav/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol><li><a href="../Text/ch1.xhtml">One</a></li></ol></nav>
+<nav epub:type="landmarks"><h2>Guide</h2><ol><li><a epub:type="toc" href="#toc">Contents</a></li><li><a epub:type="bodymatter" href="../Text/copyright.xhtml">Begin</a></li></ol></nav></body></html>`,
+		"OEBPS/Text/copyright.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>(c)</p></body></html>`,
+		"OEBPS/Text/ch1.xhtml":       `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1 id="c1">One</h1></body></html>`,
+	})
+
+	if _, err := EditEPUB(ctx, input, EditOptions{Start: "Text/ch1.xhtml#c1"}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	landmarks, err := landmarkTypes(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := landmarks["Text/ch1.xhtml"]; len(got) != 1 || got[0] != "bodymatter" {
+		t.Fatalf("landmarks = %v", landmarks)
+	}
+	nav, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Nav", "nav.xhtml"))
+	if !strings.Contains(string(nav), "<h2>Guide</h2>") || !strings.Contains(string(nav), `href="../Text/ch1.xhtml#c1">Begin<`) || !strings.Contains(string(nav), ">Contents<") {
+		t.Fatalf("nav = %s", nav)
+	}
+	guide := vol.PackageDoc.Guide
+	if guide == nil || len(guide.References) != 1 || guide.References[0].Href != "Text/ch1.xhtml#c1" {
+		t.Fatalf("guide = %+v", guide)
+	}
+
+	if _, err := EditEPUB(ctx, input, EditOptions{Start: "Text/missing.xhtml"}); err == nil {
+		t.Fatal("expected a start outside the spine to be rejected")
+	}
+}
+
+func TestSetBodymatterLandmarkAddsNav(t *testing.T) {
+	navPath := filepath.Join(t.TempDir(), "nav.xhtml")
+	os.WriteFile(navPath, []byte(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol><li><a href="a.xhtml">A</a></li></ol></nav></body></html>`), 0o644)
+	if err := setBodymatterLandmark(navPath, "a.xhtml"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(navPath)
+	nav, err := findLandmarksNav(data)
+	if err != nil || nav.start < 0 || len(nav.entries) != 1 || nav.entries[0].href != "a.xhtml" {
+		t.Fatalf("nav = %s (%v)", data, err)
+	}
+	if _, err := parseNavDocument(data); err != nil {
+		t.Fatalf("toc lost: %v", err)
+	}
+}
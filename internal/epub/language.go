@@ -0,0 +1,557 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type LanguageTagOptions struct {
+	// Threshold is the confidence, from 0 to 1, a segment needs to be
+	// tagged (default 0.8). Segments below it are still reported.
+	Threshold float64
+	// Fix also corrects declared languages the text contradicts:
+	// dc:language and the package's xml:lang get the book's dominant
+	// language, each document's html element its own dominant language,
+	// and blocks whose lang does not match their text are retagged.
+	Fix      bool
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+const defaultLanguageThreshold = 0.8
+
+// langDocMinLetters is how much text a document needs for its own
+// dominant language to count; shorter ones take the book's.
+const langDocMinLetters = 40
+
+// LanguageSegment is a block whose text looks like another language than
+// the one it inherits.
+type LanguageSegment struct {
+	Href    string `json:"href"`
+	Element string `json:"element"`
+	// Inherited is the language the block had before tagging.
+	Inherited  string  `json:"inherited"`
+	Lang       string  `json:"lang"`
+	Confidence float64 `json:"confidence"`
+	// Tagged is set when the confidence reached the threshold and the block
+	// was given the language.
+	Tagged  bool   `json:"tagged"`
+	Excerpt string `json:"excerpt"`
+}
+
+// LanguageFix is a declared language that LanguageTagOptions.Fix
+// corrected.
+type LanguageFix struct {
+	// Href is empty for the package document's dc:language and xml:lang.
+	Href    string `json:"href,omitempty"`
+	Element string `json:"element"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type LanguageReport struct {
+	// Dominant is the language of most of the book's text, weighted by
+	// detection confidence, and DominantShare its share from 0 to 1.
+	// Dominant is empty when no language has more than half.
+	Dominant      string            `json:"dominant,omitempty"`
+	DominantShare float64           `json:"dominant_share"`
+	Segments      []LanguageSegment `json:"segments"`
+	Fixes         []LanguageFix     `json:"fixes,omitempty"`
+	Tagged        int               `json:"tagged"`
+	FilesChanged  int               `json:"files_changed"`
+	Changeset     Changeset         `json:"changeset"`
+}
+
+// langLeafTags are the blocks that get their own language; a block that
+// contains another of them is left to its children.
+var langLeafTags = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "li": true, "dt": true, "dd": true, "td": true, "th": true,
+	"caption": true, "figcaption": true, "blockquote": true, "div": true,
+}
+
+// TagLanguages detects the language of every paragraph in the spine and
+// marks those that differ from the language they inherit (from the
+// document or the book's dc:language) with xml:lang and lang, so reading
+// systems pick the right dictionary, hyphenation and text-to-speech voice.
+// Blocks that already carry a language are left alone unless opts.Fix is
+// set.
+func TagLanguages(ctx context.Context, input string, opts LanguageTagOptions) (LanguageReport, error) {
+	var report LanguageReport
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = defaultLanguageThreshold
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	hrefs := spineHrefs(pkg)
+	docs := make([][]byte, len(hrefs))
+	bookWeights := map[string]float64{}
+	docLangs := make([]string, len(hrefs))
+	for i, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return report, err
+		}
+		docs[i] = data
+		res, err := tagDocumentLanguages(data, "", "", false, opts.Threshold)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		for lang, w := range res.weights {
+			bookWeights[lang] += w
+		}
+		if lang, _, total := dominantLanguage(res.weights); total >= langDocMinLetters {
+			docLangs[i] = lang
+		}
+	}
+	report.Dominant, report.DominantShare, _ = dominantLanguage(bookWeights)
+	log.Info("detected dominant language", "lang", report.Dominant, "share", report.DominantShare)
+
+	bookLang := strings.TrimSpace(firstDCValue(pkg.Metadata.Languages))
+	if opts.Fix && report.Dominant != "" {
+		fix := func(element, from string) {
+			report.Fixes = append(report.Fixes, LanguageFix{Element: element, From: from, To: report.Dominant})
+			report.Changeset.modified(packageHref(vol))
+		}
+		if !sameLanguage(report.Dominant, bookLang) {
+			if len(pkg.Metadata.Languages) == 0 {
+				pkg.Metadata.Languages = []DCMeta{{Value: report.Dominant}}
+			} else {
+				pkg.Metadata.Languages[0].Value = report.Dominant
+			}
+			fix("dc:language", bookLang)
+			bookLang = report.Dominant
+		}
+		if !sameLanguage(report.Dominant, pkg.Lang) {
+			fix("package", pkg.Lang)
+			pkg.Lang = report.Dominant
+		}
+	}
+
+	for i, href := range hrefs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		opts.Progress.report(StageRewrite, i, len(hrefs), href)
+		docLang := ""
+		if opts.Fix {
+			docLang = docLangs[i]
+			if docLang == "" {
+				docLang = report.Dominant
+			}
+		}
+		res, err := tagDocumentLanguages(docs[i], bookLang, docLang, opts.Fix, opts.Threshold)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", href, err)
+		}
+		tagged := 0
+		for _, s := range res.segments {
+			s.Href = href
+			report.Segments = append(report.Segments, s)
+			if s.Tagged {
+				tagged++
+			}
+		}
+		for _, f := range res.fixes {
+			f.Href = href
+			report.Fixes = append(report.Fixes, f)
+		}
+		if tagged == 0 && len(res.fixes) == 0 {
+			continue
+		}
+		log.Debug("tagged languages", "href", href, "segments", tagged, "fixes", len(res.fixes))
+		report.Tagged += tagged
+		report.FilesChanged++
+		report.Changeset.modified(href)
+		if !opts.DryRun {
+			if err := os.WriteFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)), res.out, 0o644); err != nil {
+				return report, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(hrefs), len(hrefs), "")
+
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// dominantLanguage returns the language with more than half of weights,
+// its share, and the total weight.
+func dominantLanguage(weights map[string]float64) (string, float64, float64) {
+	total := 0.0
+	best, bestWeight := "", 0.0
+	for lang, w := range weights {
+		total += w
+		if w > bestWeight || (w == bestWeight && lang < best) {
+			best, bestWeight = lang, w
+		}
+	}
+	if total == 0 {
+		return "", 0, 0
+	}
+	share := bestWeight / total
+	if share <= 0.5 {
+		return "", share, total
+	}
+	return best, share, total
+}
+
+type langBlock struct {
+	name string
+	// start is the offset of the start tag's '<', tagAt that of its
+	// closing '>' or "/>".
+	start, tagAt int
+	lang         string
+	ownLang      string
+	text         strings.Builder
+	hasChild     bool
+}
+
+type documentLanguages struct {
+	out      []byte
+	segments []LanguageSegment
+	fixes    []LanguageFix
+	// weights sums the letters of each leaf block, times the detection
+	// confidence, by detected language.
+	weights map[string]float64
+}
+
+// langEdit replaces doc[start:end] with text.
+type langEdit struct {
+	start, end int
+	text       string
+}
+
+var langAttrPattern = regexp.MustCompile(`\s+(?:xml:)?lang\s*=\s*(?:"[^"]*"|'[^']*')`)
+
+// tagDocumentLanguages returns doc with language attributes added to the
+// start tags of leaf blocks whose detected language differs from the one
+// they inherit, plus every such block found. With fix set, the html
+// element gets docLang (when not empty) and blocks declaring a language
+// their text contradicts are retagged. The document is edited textually,
+// so everything else is kept byte for byte.
+func tagDocumentLanguages(doc []byte, defaultLang, docLang string, fix bool, threshold float64) (documentLanguages, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	dec.Strict = false
+
+	res := documentLanguages{out: doc, weights: map[string]float64{}}
+	var (
+		edits  []langEdit
+		langs  []string
+		blocks []*langBlock
+		inBody bool
+		hidden int
+	)
+	current := func() string {
+		if n := len(langs); n > 0 {
+			return langs[n-1]
+		}
+		return defaultLang
+	}
+	retag := func(start, end int, lang string) {
+		tag := langAttrPattern.ReplaceAllString(string(doc[start:end]), "")
+		edits = append(edits, langEdit{start, end, tag + ` xml:lang="` + lang + `" lang="` + lang + `"`})
+	}
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return res, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			own := attrValue(t.Attr, "lang")
+			l := own
+			if l == "" {
+				l = current()
+			}
+			at := int(dec.InputOffset()) - 1
+			if at > 0 && doc[at-1] == '/' {
+				at--
+			}
+			if name == "html" && fix && docLang != "" && !sameLanguage(docLang, own) {
+				res.fixes = append(res.fixes, LanguageFix{Element: name, From: own, To: docLang})
+				retag(start, at, docLang)
+				l = docLang
+			}
+			langs = append(langs, l)
+			switch {
+			case name == "body":
+				inBody = true
+			case name == "script" || name == "style" || name == "rt" || name == "rp":
+				hidden++
+			case name == "br":
+				if n := len(blocks); n > 0 {
+					blocks[n-1].text.WriteByte(' ')
+				}
+			}
+			if inBody && langLeafTags[name] {
+				for _, b := range blocks {
+					b.hasChild = true
+				}
+				blocks = append(blocks, &langBlock{name: name, start: start, tagAt: at, lang: l, ownLang: own})
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if n := len(langs); n > 0 {
+				langs = langs[:n-1]
+			}
+			switch name {
+			case "body":
+				inBody = false
+			case "script", "style", "rt", "rp":
+				hidden--
+			}
+			n := len(blocks)
+			if n == 0 || blocks[n-1].name != name {
+				break
+			}
+			b := blocks[n-1]
+			blocks = blocks[:n-1]
+			if b.hasChild {
+				break
+			}
+			text := normalizeSpace(b.text.String())
+			lang, conf := DetectLanguage(text)
+			if lang != "" {
+				res.weights[lang] += conf * float64(countLetters(text))
+			}
+			if lang == "" || sameLanguage(lang, b.lang) {
+				break
+			}
+			if b.ownLang != "" {
+				if fix && conf >= threshold && b.tagAt > b.start {
+					res.fixes = append(res.fixes, LanguageFix{Element: name, From: b.ownLang, To: lang})
+					retag(b.start, b.tagAt, lang)
+				}
+				break
+			}
+			seg := LanguageSegment{Element: name, Inherited: b.lang, Lang: lang, Confidence: conf, Excerpt: excerpt(text, 60)}
+			if conf >= threshold && b.tagAt > 0 {
+				seg.Tagged = true
+				edits = append(edits, langEdit{b.tagAt, b.tagAt, ` xml:lang="` + lang + `" lang="` + lang + `"`})
+			}
+			res.segments = append(res.segments, seg)
+		case xml.CharData:
+			if n := len(blocks); n > 0 && hidden == 0 && current() == blocks[n-1].lang {
+				blocks[n-1].text.Write(t)
+			}
+		}
+	}
+	if len(edits) == 0 {
+		return res, nil
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	prev := 0
+	for _, e := range edits {
+		out.Write(doc[prev:e.start])
+		out.WriteString(e.text)
+		prev = e.end
+	}
+	out.Write(doc[prev:])
+	res.out = out.Bytes()
+	return res, nil
+}
+
+func countLetters(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// sameLanguage reports whether two language tags share a primary subtag.
+// An unknown inherited language never matches.
+func sameLanguage(a, b string) bool {
+	pa, _, _ := strings.Cut(strings.ReplaceAll(a, "_", "-"), "-")
+	pb, _, _ := strings.Cut(strings.ReplaceAll(b, "_", "-"), "-")
+	return pb != "" && strings.EqualFold(strings.TrimSpace(pa), strings.TrimSpace(pb))
+}
+
+func excerpt(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	return string(rs[:n]) + "…"
+}
+
+// langStopwords are frequent short words that tell Latin-script languages
+// apart.
+var langStopwords = map[string][]string{
+	"en": strings.Fields("the and of to is was that it he she you with for his her they not but have this are had were what"),
+	"fr": strings.Fields("le les et est un une son sa ses des du que qui dans pas pour sur ne il elle nous vous au avec ce je était mais"),
+	"de": strings.Fields("der die das und ist nicht ein eine ich sie zu mit den dem auf sich auch es war wir nach"),
+	"es": strings.Fields("el los las y que del una por con para no se su al lo como pero está muy fue"),
+	"it": strings.Fields("il che di è un una per non con sono gli del della ma le si anche questo era"),
+	"pt": strings.Fields("o os as e que do da um uma não com para em é se no na mas você foi"),
+	"nl": strings.Fields("het een en van is dat niet ik je zijn op te met die voor maar was"),
+}
+
+// langMarks are letters that point to one Latin-script language.
+var langMarks = map[rune]string{
+	'ñ': "es", '¿': "es", '¡': "es",
+	'ß': "de", 'ä': "de", 'ö': "de", 'ü': "de",
+	'ã': "pt", 'õ': "pt",
+	'ç': "fr", 'œ': "fr", 'ê': "fr", 'ù': "fr",
+}
+
+var langStopwordIndex = func() map[string][]string {
+	idx := map[string][]string{}
+	for lang, words := range langStopwords {
+		for _, w := range words {
+			idx[w] = append(idx[w], lang)
+		}
+	}
+	return idx
+}()
+
+// DetectLanguage guesses the language of text and returns a BCP 47 tag with
+// a confidence from 0 to 1, or "" when it cannot tell. Scripts used by one
+// language (kana, Hangul, Thai, ...) decide on their own; Latin text is
+// scored against common words of English, French, German, Spanish,
+// Italian, Portuguese and Dutch. Han characters without kana could be
+// Chinese or Japanese, so they get half the confidence. Short texts get
+// lower confidence.
+func DetectLanguage(text string) (string, float64) {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		counts[letterScript(r)]++
+	}
+	if letters == 0 {
+		return "", 0
+	}
+	share := func(n int) float64 { return float64(n) / float64(letters) }
+	brevity := func(n, full int) float64 { return min(1, float64(n)/float64(full)) }
+
+	if kana := counts["kana"]; kana > 0 {
+		n := kana + counts["han"]
+		return "ja", share(n) * brevity(n, 8)
+	}
+	if n := counts["han"]; n > 0 && n >= letters/2 {
+		return "zh", share(n) * brevity(n, 8) / 2
+	}
+	for _, s := range []struct{ script, lang string }{
+		{"hangul", "ko"}, {"thai", "th"}, {"greek", "el"}, {"hebrew", "he"},
+		{"devanagari", "hi"}, {"cyrillic", cyrillicLanguage(text)}, {"arabic", arabicLanguage(text)},
+	} {
+		if n := counts[s.script]; n >= letters/2 && n > 0 {
+			return s.lang, share(n) * brevity(n, 8)
+		}
+	}
+
+	n := counts["latin"]
+	if n < letters/2 || n == 0 {
+		return "", 0
+	}
+	scores := map[string]int{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' }) {
+		for _, lang := range langStopwordIndex[w] {
+			scores[lang]++
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		if lang, ok := langMarks[r]; ok {
+			scores[lang]++
+		}
+	}
+	best, bestScore, second := "", 0, 0
+	for _, lang := range []string{"en", "fr", "de", "es", "it", "pt", "nl"} {
+		switch s := scores[lang]; {
+		case s > bestScore:
+			best, bestScore, second = lang, s, bestScore
+		case s > second:
+			second = s
+		}
+	}
+	if bestScore == 0 {
+		return "", 0
+	}
+	// Related languages share some common words; only a close second
+	// costs much confidence.
+	ratio := float64(second) / float64(bestScore)
+	margin := 1 - ratio*ratio
+	return best, share(n) * margin * brevity(bestScore, 4)
+}
+
+func letterScript(r rune) string {
+	switch {
+	case unicode.Is(unicode.Latin, r):
+		return "latin"
+	case unicode.In(r, unicode.Hiragana, unicode.Katakana) || r == 'ー':
+		return "kana"
+	case unicode.Is(unicode.Han, r):
+		return "han"
+	case unicode.Is(unicode.Hangul, r):
+		return "hangul"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "cyrillic"
+	case unicode.Is(unicode.Greek, r):
+		return "greek"
+	case unicode.Is(unicode.Arabic, r):
+		return "arabic"
+	case unicode.Is(unicode.Hebrew, r):
+		return "hebrew"
+	case unicode.Is(unicode.Thai, r):
+		return "thai"
+	case unicode.Is(unicode.Devanagari, r):
+		return "devanagari"
+	}
+	return "other"
+}
+
+func cyrillicLanguage(text string) string {
+	if strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+		return "uk"
+	}
+	return "ru"
+}
+
+func arabicLanguage(text string) string {
+	if strings.ContainsAny(text, "پچژگ") {
+		return "fa"
+	}
+	return "ar"
+}
@@ -0,0 +1,187 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+		min  float64
+	}{
+		{"The knight rode out of the castle and did not look back at the village.", "en", 0.8},
+		{"Il était une fois une princesse qui vivait dans un château avec son père.", "fr", 0.8},
+		{"Der Ritter ritt aus der Burg und sah nicht zurück auf das Dorf.", "de", 0.8},
+		{"古池や蛙飛び込む水の音", "ja", 0.8},
+		{"바람이 불어도 괜찮아요", "ko", 0.8},
+		{"Тихо в лесу, только не спит барсук.", "ru", 0.8},
+	}
+	for _, c := range cases {
+		lang, conf := DetectLanguage(c.text)
+		if lang != c.want || conf < c.min {
+			t.Errorf("DetectLanguage(%q) = %s %.2f, want %s >= %.2f", c.text, lang, conf, c.want, c.min)
+		}
+	}
+	// Kanji alone could be Chinese or Japanese; short Latin text says little.
+	if lang, conf := DetectLanguage("春眠不覺曉處處聞啼鳥"); lang != "zh" || conf >= 0.8 {
+		t.Errorf("Han-only text = %s %.2f", lang, conf)
+	}
+	if _, conf := DetectLanguage("Oh."); conf >= 0.8 {
+		t.Errorf("short text confidence %.2f", conf)
+	}
+}
+
+func TestTagLanguages(t *testing.T) {
+	chapter := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>One</title></head>
+<body>
+  <h1>Chapter One</h1>
+  <p>The old poet closed his eyes and recited the verse he had carried with him for years.</p>
+  <blockquote>
+    <p class="poem">古池や<ruby>蛙<rt>かわず</rt></ruby>飛び込む水の音</p>
+    <p lang="ja">静かさや岩にしみ入る蝉の声</p>
+  </blockquote>
+  <p>Nobody said a word, and the fire went on crackling in the hearth for a while.</p>
+  <p>春眠不覺曉處處聞啼鳥</p>
+</body>
+</html>
+`
+	book := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test</dc:identifier>
+    <dc:title>Poems</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": chapter,
+	})
+	ctx := context.Background()
+
+	report, err := TagLanguages(ctx, book, LanguageTagOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tagged != 1 || len(report.Segments) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	if s := report.Segments[0]; s.Lang != "ja" || !s.Tagged || s.Href != "ch1.xhtml" || s.Inherited != "en" {
+		t.Fatalf("segment = %+v", s)
+	}
+
+	if _, err := TagLanguages(ctx, book, LanguageTagOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(chapter, `<p class="poem">`, `<p class="poem" xml:lang="ja" lang="ja">`, 1)
+	if string(data) != want {
+		t.Fatalf("chapter =\n%s", data)
+	}
+
+	// Tagged blocks now carry their own language.
+	again, err := TagLanguages(ctx, book, LanguageTagOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Tagged != 0 {
+		t.Fatalf("second run tagged %d blocks", again.Tagged)
+	}
+}
+
+func TestTagLanguagesFix(t *testing.T) {
+	chapter := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+<head><title>一</title></head>
+<body>
+  <p>朝になると、少女はいつものように窓を開けて、遠くの山を眺めていた。</p>
+  <p lang="en">彼女はまだ、その手紙の意味を知らなかったのである。</p>
+  <p>The letter said only that the king would come before the snow.</p>
+  <p>それから三日後、村に最初の雪が降った。誰も王の姿を見なかった。</p>
+</body>
+</html>
+`
+	book := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test</dc:identifier>
+    <dc:title>Letter</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": chapter,
+	})
+	ctx := context.Background()
+
+	report, err := TagLanguages(ctx, book, LanguageTagOptions{Fix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Dominant != "ja" || report.DominantShare <= 0.5 {
+		t.Fatalf("dominant = %s %.2f", report.Dominant, report.DominantShare)
+	}
+	var fixed []string
+	for _, f := range report.Fixes {
+		fixed = append(fixed, f.Element+":"+f.From+">"+f.To)
+	}
+	if got := strings.Join(fixed, " "); got != "dc:language:en>ja package:>ja html:en>ja p:en>ja" {
+		t.Fatalf("fixes = %s", got)
+	}
+	if report.Tagged != 1 || report.Segments[0].Lang != "en" || report.Segments[0].Inherited != "ja" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	vol, err := loadVolume(ctx, 0, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if lang := firstDCValue(vol.PackageDoc.Metadata.Languages); lang != "ja" || vol.PackageDoc.Lang != "ja" {
+		t.Fatalf("package languages = %s, %s", lang, vol.PackageDoc.Lang)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.NewReplacer(
+		`<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">`, `<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="ja" lang="ja">`,
+		`<p lang="en">彼女`, `<p xml:lang="ja" lang="ja">彼女`,
+		`<p>The letter`, `<p xml:lang="en" lang="en">The letter`,
+	).Replace(chapter)
+	if string(data) != want {
+		t.Fatalf("chapter =\n%s", data)
+	}
+
+	again, err := TagLanguages(ctx, book, LanguageTagOptions{Fix: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Fixes) != 0 || again.Tagged != 0 || again.Changeset.Changed() {
+		t.Fatalf("second run = %+v", again)
+	}
+}
@@ -0,0 +1,267 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultMergeLayout is where merge puts the files of each volume: under a
+// numbered directory, at the same path as in the volume.
+const DefaultMergeLayout = "Volumes/v{v:04}/{orig}"
+
+// mergeLayout is a path template expanded for every file of every
+// volume, relative to the merged package document:
+//
+//	{v}      the volume number, from 1; {v:02} pads it to two digits
+//	{orig}   the file's path relative to its volume's package document
+//	{dir}    the directory part of {orig}
+//	{name}   the file name; {base} without and {ext} only its extension
+//	{type}   text, styles, images, fonts, audio, video or misc
+//
+// "vol{v:02}/{orig}" keeps each volume's tree under vol01, vol02, ...;
+// "v{v}/{name}" flattens each volume into one directory, and
+// "{type}/v{v}-{name}" groups files by kind across volumes. Files that
+// end up at the same path get a numeric suffix.
+type mergeLayout string
+
+var layoutPlaceholderRE = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+func parseMergeLayout(s string) (mergeLayout, error) {
+	if strings.TrimSpace(s) == "" {
+		s = DefaultMergeLayout
+	}
+	names := false
+	for _, m := range layoutPlaceholderRE.FindAllStringSubmatch(s, -1) {
+		switch m[1] {
+		case "orig", "name", "base":
+			names = true
+		case "v", "dir", "ext", "type":
+		default:
+			return "", fmt.Errorf("layout %q: unknown placeholder {%s}", s, m[1])
+		}
+		if m[2] != "" && m[1] != "v" {
+			return "", fmt.Errorf("layout %q: only {v} takes a width", s)
+		}
+	}
+	if !names {
+		return "", fmt.Errorf("layout %q: name the file with {orig}, {name} or {base}", s)
+	}
+	if strings.HasPrefix(s, "/") {
+		return "", fmt.Errorf("layout %q: must be relative", s)
+	}
+	return mergeLayout(s), nil
+}
+
+// expand returns the merged path of file orig, of the given media type, in
+// volume v.
+func (l mergeLayout) expand(v int, orig, mediaType string) string {
+	name := path.Base(orig)
+	ext := path.Ext(name)
+	return normalizeEPUBPath(layoutPlaceholderRE.ReplaceAllStringFunc(string(l), func(m string) string {
+		sub := layoutPlaceholderRE.FindStringSubmatch(m)
+		switch sub[1] {
+		case "v":
+			width, _ := strconv.Atoi(sub[2])
+			return fmt.Sprintf("%0*d", width, v)
+		case "orig":
+			return orig
+		case "dir":
+			return path.Dir(orig)
+		case "name":
+			return name
+		case "base":
+			return strings.TrimSuffix(name, ext)
+		case "ext":
+			return ext
+		case "type":
+			return layoutType(mediaType, ext)
+		}
+		return m
+	}))
+}
+
+func layoutType(mediaType, ext string) string {
+	switch {
+	case mediaType == "application/xhtml+xml":
+		return "text"
+	case mediaType == "text/css":
+		return "styles"
+	case strings.HasPrefix(mediaType, "image/"):
+		return "images"
+	case isFontItem(ManifestItem{MediaType: mediaType, Href: "f" + ext}):
+		return "fonts"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "video"
+	}
+	return "misc"
+}
+
+// layoutVolume decides where each file of vol goes in the merged book and
+// sets vol.Paths and vol.Prefix, the directory holding all of them. taken
+// holds the paths used so far, lower-cased. It reports whether the files
+// keep their relative places, so links between them stay valid.
+func layoutVolume(vol *Volume, layout mergeLayout, taken map[string]bool, log *slog.Logger) (bool, error) {
+	types := map[string]string{}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		types[normalizeEPUBPath(item.Href)] = item.MediaType
+	}
+	pkgRel := filepath.Base(vol.PackagePath)
+	vol.Paths = map[string]string{}
+	var merged []string
+	err := filepath.Walk(vol.PackageDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(vol.PackageDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == pkgRel {
+			return nil
+		}
+		rel = normalizeEPUBPath(filepath.ToSlash(rel))
+		href := layout.expand(vol.Index+1, rel, types[rel])
+		if href == "." || href == ".." || strings.HasPrefix(href, "../") || strings.HasPrefix(href, "/") {
+			return fmt.Errorf("layout puts %s outside the book (%s)", rel, href)
+		}
+		if taken[strings.ToLower(href)] {
+			unique := uniqueName(href, func(s string) bool { return taken[strings.ToLower(s)] })
+			log.Warn("layout puts two files at the same path; renaming", "volume", vol.SourcePath, "file", rel, "path", href, "to", unique)
+			href = unique
+		}
+		taken[strings.ToLower(href)] = true
+		vol.Paths[rel] = href
+		merged = append(merged, href)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	vol.Prefix = commonDir(merged)
+	for rel, href := range vol.Paths {
+		if href != path.Join(vol.Prefix, rel) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// commonDir returns the longest directory that holds every path, or "."
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return "."
+	}
+	dir := path.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for dir != "." && !strings.HasPrefix(p, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	return dir
+}
+
+// mergedHref returns where the file at href, relative to the volume's
+// package document, is in the merged book. An href naming a file with
+// different case finds the file, as it would on a case-insensitive disk.
+func (v *Volume) mergedHref(href string) string {
+	href = normalizeEPUBPath(href)
+	if p, ok := v.Paths[href]; ok {
+		return p
+	}
+	for rel, p := range v.Paths {
+		if strings.EqualFold(rel, href) {
+			return p
+		}
+	}
+	return normalizeEPUBPath(path.Join(v.Prefix, href))
+}
+
+// copyVolumePayload copies the files of vol but its package and navigation
+// documents to their places under oebpsDir. When moved is set, the files
+// no longer sit where their links expect, and the links are rewritten.
+func copyVolumePayload(vol *Volume, oebpsDir string, moved bool) error {
+	navRel := ""
+	if vol.NavHref != "" {
+		navRel = normalizeEPUBPath(vol.NavHref)
+	}
+	types := map[string]string{}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		types[normalizeEPUBPath(item.Href)] = item.MediaType
+	}
+	rels := make([]string, 0, len(vol.Paths))
+	for rel := range vol.Paths {
+		if rel != navRel {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(rel))
+		dst := filepath.Join(oebpsDir, filepath.FromSlash(vol.Paths[rel]))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		pattern := referencePattern(types[rel])
+		if !moved || pattern == nil {
+			if err := copyFile(src, dst, info.Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		out, _ := rewriteRefs(string(data), pattern, path.Dir(rel), path.Dir(vol.Paths[rel]), func(target string) (string, bool) {
+			return vol.mergedHref(target), true
+		})
+		if err := os.WriteFile(dst, []byte(out), info.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedNavItems returns the volume's table of contents with hrefs
+// relative to the merged package document.
+func mergedNavItems(vol *Volume) []NavItem {
+	navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+	var clone func(items []NavItem) []NavItem
+	clone = func(items []NavItem) []NavItem {
+		out := make([]NavItem, 0, len(items))
+		for _, item := range items {
+			c := NavItem{Title: item.Title}
+			href := strings.TrimSpace(item.Href)
+			switch {
+			case href == "" || strings.HasPrefix(href, "#") || strings.Contains(href, ":"):
+				c.Href = href
+			default:
+				target, frag, hasFrag := strings.Cut(href, "#")
+				c.Href = vol.mergedHref(path.Join(navDir, target))
+				if hasFrag {
+					c.Href += "#" + frag
+				}
+			}
+			if len(item.Children) > 0 {
+				c.Children = clone(item.Children)
+			}
+			out = append(out, c)
+		}
+		return out
+	}
+	return clone(vol.NavItems)
+}
@@ -0,0 +1,73 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeLayoutExpand(t *testing.T) {
+	cases := []struct {
+		layout, orig, mediaType, want string
+	}{
+		{DefaultMergeLayout, "Text/ch1.xhtml", "application/xhtml+xml", "Volumes/v0003/Text/ch1.xhtml"},
+		{"vol{v:02}/{orig}", "Images/a.png", "image/png", "vol03/Images/a.png"},
+		{"v{v}/{name}", "Text/sub/ch1.xhtml", "application/xhtml+xml", "v3/ch1.xhtml"},
+		{"{type}/v{v}-{base}{ext}", "Fonts/serif.otf", "application/vnd.ms-opentype", "fonts/v3-serif.otf"},
+		{"{dir}/v{v}/{name}", "ch1.xhtml", "", "v3/ch1.xhtml"},
+	}
+	for _, c := range cases {
+		layout, err := parseMergeLayout(c.layout)
+		if err != nil {
+			t.Fatalf("%s: %v", c.layout, err)
+		}
+		if got := layout.expand(3, c.orig, c.mediaType); got != c.want {
+			t.Errorf("%s with %s = %s, want %s", c.layout, c.orig, got, c.want)
+		}
+	}
+	for _, bad := range []string{"v{v}", "{v}/{file}", "/abs/{orig}", "{name:02}"} {
+		if _, err := parseMergeLayout(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestMergeWithLayout(t *testing.T) {
+	vols := []string{buildLinkVolume(t), buildLinkVolume(t)}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, Layout: "{type}/{name}"}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	var hrefs []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		hrefs = append(hrefs, item.Href)
+	}
+	want := "text/copyright.xhtml text/ch1.xhtml text/ch2.xhtml text/copyright-2.xhtml text/ch1-2.xhtml text/ch2-2.xhtml nav.xhtml"
+	if got := strings.Join(hrefs, " "); got != want {
+		t.Fatalf("manifest = %s, want %s", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "text", "ch1-2.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{`href="../nav.xhtml#toc"`, `href="copyright-2.xhtml"`, `href="ch2-2.xhtml#s2"`} {
+		if !strings.Contains(string(data), link) {
+			t.Errorf("missing %s in\n%s", link, data)
+		}
+	}
+	nav, err := os.ReadFile(filepath.Join(vol.PackageDir, "nav.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(nav), `href="text/ch2-2.xhtml#s2"`) {
+		t.Errorf("nav not pointed at the new paths:\n%s", nav)
+	}
+}
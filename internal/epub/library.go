@@ -0,0 +1,463 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles of a LibraryEvent.
+const (
+	LibraryRead    = "read"
+	LibraryWritten = "written"
+)
+
+// libraryVersion is the format version of the library file.
+const libraryVersion = 1
+
+// LibraryEvent is one time a command read or wrote a book.
+type LibraryEvent struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Role    string    `json:"role"`
+	// Inputs lists, for a book written, the SHA-256 of every book the
+	// command read, in order; a book edited in place lists its old
+	// contents.
+	Inputs []string `json:"inputs,omitempty"`
+}
+
+// LibraryBook is one EPUB file in the library, as it was when last seen.
+type LibraryBook struct {
+	// Path is absolute.
+	Path        string         `json:"path"`
+	SHA256      string         `json:"sha256"`
+	Size        int64          `json:"size"`
+	ModTime     time.Time      `json:"mod_time"`
+	Identifier  string         `json:"identifier,omitempty"`
+	Title       string         `json:"title"`
+	Authors     []string       `json:"authors"`
+	Language    string         `json:"language,omitempty"`
+	Publisher   string         `json:"publisher,omitempty"`
+	Series      string         `json:"series,omitempty"`
+	SeriesIndex string         `json:"series_index,omitempty"`
+	Sources     []string       `json:"sources,omitempty"`
+	History     []LibraryEvent `json:"history"`
+}
+
+// Library is a local index of the books novfmt has read and written,
+// kept as a JSON file.
+type Library struct {
+	Version int           `json:"version"`
+	Books   []LibraryBook `json:"books"`
+
+	path string
+}
+
+// LibraryRun describes what one command did, for Library.Record.
+type LibraryRun struct {
+	Command string
+	Time    time.Time
+	// Inputs are the books the command read and Outputs those it wrote; a
+	// book edited in place is in both.
+	Inputs  []string
+	Outputs []string
+	// Before maps the absolute path of a book edited in place to its
+	// SHA-256 before the command ran.
+	Before map[string]string
+}
+
+// LibraryQuery selects books from a library. Text fields match
+// case-insensitively anywhere in the value; empty fields match anything.
+type LibraryQuery struct {
+	Title  string
+	Author string
+	// Series matches a book's own series, or a series of any book it was
+	// made from, so that an omnibus is found by the series it collects.
+	Series     string
+	Identifier string
+	// SHA256 matches a prefix of the checksum.
+	SHA256 string
+	// MadeBy and ReadBy match books that the named command wrote or read.
+	MadeBy string
+	ReadBy string
+}
+
+// OpenLibrary reads the library at path. A missing file is an empty
+// library that Save creates.
+func OpenLibrary(path string) (*Library, error) {
+	if path == "" {
+		return nil, fmt.Errorf("library path is required")
+	}
+	lib := &Library{Version: libraryVersion, Books: []LibraryBook{}, path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lib, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read library: %w", err)
+	}
+	if err := json.Unmarshal(data, lib); err != nil {
+		return nil, fmt.Errorf("parse library %s: %w", path, err)
+	}
+	if lib.Version > libraryVersion {
+		return nil, fmt.Errorf("library %s has version %d; this novfmt reads up to %d", path, lib.Version, libraryVersion)
+	}
+	if lib.Books == nil {
+		lib.Books = []LibraryBook{}
+	}
+	return lib, nil
+}
+
+// The holder of a library lock touches its file every libraryLockRefresh,
+// however long an update runs, so a lock file not touched for
+// libraryLockStale was left behind by a novfmt that died holding it.
+var (
+	libraryLockRefresh = 10 * time.Second
+	libraryLockStale   = time.Minute
+)
+
+// UpdateLibrary opens the library at path, lets update change it and saves
+// it, holding the library's lock file throughout so that novfmt runs
+// recording at the same time do not lose each other's changes. It waits
+// for the lock until ctx is done.
+func UpdateLibrary(ctx context.Context, path string, update func(*Library) error) error {
+	unlock, err := lockLibrary(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lib, err := OpenLibrary(path)
+	if err != nil {
+		return err
+	}
+	if err := update(lib); err != nil {
+		return err
+	}
+	return lib.Save()
+}
+
+// lockLibrary creates path's lock file, waiting while another process
+// holds it, and returns the function that removes it. The file is kept
+// fresh until then.
+func lockLibrary(ctx context.Context, path string) (func(), error) {
+	if path == "" {
+		return nil, fmt.Errorf("library path is required")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	lock := path + ".lock"
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return refreshLock(lock), nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("lock library: %w", err)
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > libraryLockStale {
+			os.Remove(lock)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lock library: %w", ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// refreshLock touches lock every libraryLockRefresh until the returned
+// function is called, which stops it and removes the file.
+func refreshLock(lock string) func() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(libraryLockRefresh)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				now := time.Now()
+				os.Chtimes(lock, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		os.Remove(lock)
+	}
+}
+
+// Save writes the library back to its file, replacing it atomically. A
+// library other processes may update is better changed through
+// UpdateLibrary.
+func (l *Library) Save() error {
+	l.Version = libraryVersion
+	sort.Slice(l.Books, func(i, j int) bool { return l.Books[i].Path < l.Books[j].Path })
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := createTempFile(filepath.Dir(l.path), "novfmt-library-*.json")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameOver(tmpPath, l.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("write library: %w", err)
+	}
+	return nil
+}
+
+// Index brings the entry for the book at p up to date and returns it.
+// Books whose size and modification time are unchanged are not read
+// again.
+func (l *Library) Index(ctx context.Context, p string) (*LibraryBook, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	mod := info.ModTime().UTC()
+	book := l.book(abs)
+	if book != nil && book.Size == info.Size() && book.ModTime.Equal(mod) {
+		return book, nil
+	}
+	sum, err := Env{}.hashFile(ctx, abs)
+	if err != nil {
+		return nil, err
+	}
+	if book == nil || book.SHA256 != sum {
+		entry, err := libraryEntry(ctx, abs)
+		if err != nil {
+			return nil, err
+		}
+		if book != nil {
+			entry.History = book.History
+		}
+		if book == nil {
+			l.Books = append(l.Books, entry)
+			book = &l.Books[len(l.Books)-1]
+		} else {
+			*book = entry
+		}
+	}
+	book.SHA256, book.Size, book.ModTime = sum, info.Size(), mod
+	return book, nil
+}
+
+// Record indexes the books of run and adds the run to their history.
+// Books that no longer exist, such as the output of a dry run, are
+// skipped.
+func (l *Library) Record(ctx context.Context, run LibraryRun) error {
+	if run.Time.IsZero() {
+		run.Time = time.Now().UTC()
+	}
+	written := map[string]bool{}
+	for _, p := range run.Outputs {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		written[abs] = true
+	}
+
+	var inputs []string
+	for _, p := range run.Inputs {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if sum, ok := run.Before[abs]; ok {
+			inputs = append(inputs, sum)
+			continue
+		}
+		book, err := l.Index(ctx, abs)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("index %s: %w", p, err)
+		}
+		inputs = append(inputs, book.SHA256)
+		if !written[abs] {
+			book.History = append(book.History, LibraryEvent{Time: run.Time, Command: run.Command, Role: LibraryRead})
+		}
+	}
+	for _, p := range run.Outputs {
+		book, err := l.Index(ctx, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("index %s: %w", p, err)
+		}
+		var from []string
+		for _, sum := range inputs {
+			if sum != book.SHA256 {
+				from = append(from, sum)
+			}
+		}
+		book.History = append(book.History, LibraryEvent{Time: run.Time, Command: run.Command, Role: LibraryWritten, Inputs: from})
+	}
+	return nil
+}
+
+// Find returns the books matching q, sorted by title and path.
+func (l *Library) Find(q LibraryQuery) []LibraryBook {
+	bySum := map[string][]*LibraryBook{}
+	for i := range l.Books {
+		bySum[l.Books[i].SHA256] = append(bySum[l.Books[i].SHA256], &l.Books[i])
+	}
+	out := []LibraryBook{}
+	for _, b := range l.Books {
+		if !containsFold(b.Title, q.Title) ||
+			!containsFold(b.Identifier, q.Identifier) ||
+			!strings.HasPrefix(b.SHA256, strings.ToLower(q.SHA256)) ||
+			!anyContainsFold(b.Authors, q.Author) ||
+			!hasLibraryEvent(b, q.MadeBy, LibraryWritten) ||
+			!hasLibraryEvent(b, q.ReadBy, LibraryRead) ||
+			!inLibrarySeries(b, q.Series, bySum) {
+			continue
+		}
+		out = append(out, b)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := strings.ToLower(out[i].Title), strings.ToLower(out[j].Title)
+		if a != b {
+			return a < b
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+func (l *Library) book(abs string) *LibraryBook {
+	for i := range l.Books {
+		if l.Books[i].Path == abs {
+			return &l.Books[i]
+		}
+	}
+	return nil
+}
+
+// libraryEntry reads the metadata of the book at abs.
+func libraryEntry(ctx context.Context, abs string) (LibraryBook, error) {
+	vol, err := loadVolume(ctx, 0, abs)
+	if err != nil {
+		return LibraryBook{}, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	cal := calibreFromPackage(meta)
+	return LibraryBook{
+		Path:        abs,
+		Identifier:  primaryIdentifier(vol.PackageDoc),
+		Title:       vol.DisplayName,
+		Authors:     collectCreators(meta.Creators),
+		Language:    cal.Language,
+		Publisher:   cal.Publisher,
+		Series:      cal.Series,
+		SeriesIndex: cal.SeriesIndex,
+		Sources:     collectSources(meta),
+		History:     []LibraryEvent{},
+	}, nil
+}
+
+// inLibrarySeries reports whether b, or a book it was written from, is in
+// a series matching series.
+func inLibrarySeries(b LibraryBook, series string, bySum map[string][]*LibraryBook) bool {
+	if containsFold(b.Series, series) {
+		return true
+	}
+	for _, ev := range b.History {
+		if ev.Role != LibraryWritten {
+			continue
+		}
+		for _, sum := range ev.Inputs {
+			for _, in := range bySum[sum] {
+				if in.Series != "" && containsFold(in.Series, series) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func hasLibraryEvent(b LibraryBook, command, role string) bool {
+	if command == "" {
+		return true
+	}
+	for _, ev := range b.History {
+		if ev.Role == role && ev.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+func anyContainsFold(values []string, sub string) bool {
+	if sub == "" {
+		return true
+	}
+	for _, v := range values {
+		if containsFold(v, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashFile returns the hex SHA-256 of the file at p, which may name a
+// book in a Storage of ctx's Env.
+func HashFile(ctx context.Context, p string) (string, error) {
+	return EnvFrom(ctx).hashFile(ctx, p)
+}
+
+func (e Env) hashFile(ctx context.Context, p string) (string, error) {
+	f, err := e.openFile(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,184 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func buildLibraryBook(t *testing.T, id, title, series string) string {
+	t.Helper()
+	seriesMeta := ""
+	if series != "" {
+		seriesMeta = `<meta name="calibre:series" content="` + series + `"/><meta name="calibre:series_index" content="1"/>`
+	}
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head><body><p>Hi</p></body></html>`,
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">` + id + `</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:creator>Ann Author</dc:creator>
+    <dc:language>en</dc:language>
+    ` + seriesMeta + `
+  </metadata>
+  <manifest><item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`,
+	})
+}
+
+func TestLibraryRecordAndFind(t *testing.T) {
+	ctx := context.Background()
+	vol1 := buildLibraryBook(t, "urn:test:v1", "Saga 1", "The Saga")
+	vol2 := buildLibraryBook(t, "urn:test:v2", "Saga 2", "The Saga")
+	omnibus := buildLibraryBook(t, "urn:test:omni", "Saga Omnibus", "")
+	other := buildLibraryBook(t, "urn:test:x", "Unrelated", "Other")
+
+	path := filepath.Join(t.TempDir(), "lib", "index.json")
+	lib, err := OpenLibrary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Record(ctx, LibraryRun{Command: "merge", Inputs: []string{vol1, vol2}, Outputs: []string{omnibus}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Record(ctx, LibraryRun{Command: "check", Inputs: []string{other, filepath.Join(t.TempDir(), "gone.epub")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err = OpenLibrary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Books) != 4 {
+		t.Fatalf("books = %d, want 4", len(lib.Books))
+	}
+	merged := lib.Find(LibraryQuery{Series: "saga", MadeBy: "merge"})
+	if len(merged) != 1 || merged[0].Title != "Saga Omnibus" {
+		t.Fatalf("find -series saga -made-by merge = %+v", merged)
+	}
+	if ev := merged[0].History[0]; ev.Role != LibraryWritten || len(ev.Inputs) != 2 {
+		t.Fatalf("omnibus history = %+v", merged[0].History)
+	}
+	if got := lib.Find(LibraryQuery{Series: "saga"}); len(got) != 3 {
+		t.Fatalf("find -series saga = %d books, want 3", len(got))
+	}
+	if got := lib.Find(LibraryQuery{ReadBy: "merge", Title: "2"}); len(got) != 1 || got[0].SeriesIndex != "1" || got[0].Identifier != "urn:test:v2" {
+		t.Fatalf("find -read-by merge -title 2 = %+v", got)
+	}
+	sum := lib.Find(LibraryQuery{Title: "unrelated"})[0].SHA256
+	if got := lib.Find(LibraryQuery{SHA256: sum[:8]}); len(got) != 1 {
+		t.Fatalf("find by checksum prefix = %d books", len(got))
+	}
+
+	// An in-place edit lists the book's old contents as its input.
+	old := sum
+	data, err := os.ReadFile(vol1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(other, later, later); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(other)
+	if err := lib.Record(ctx, LibraryRun{Command: "rewrite", Inputs: []string{other}, Outputs: []string{other}, Before: map[string]string{abs: old}}); err != nil {
+		t.Fatal(err)
+	}
+	got := lib.Find(LibraryQuery{MadeBy: "rewrite"})
+	if len(got) != 1 || got[0].Title != "Saga 1" || got[0].SHA256 == old {
+		t.Fatalf("after in-place edit = %+v", got)
+	}
+	last := got[0].History[len(got[0].History)-1]
+	if len(last.Inputs) != 1 || last.Inputs[0] != old {
+		t.Fatalf("in-place edit inputs = %v, want [%s]", last.Inputs, old)
+	}
+}
+
+func TestUpdateLibraryConcurrent(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index.json")
+	var books []string
+	for i := range 4 {
+		books = append(books, buildLibraryBook(t, fmt.Sprintf("urn:test:%d", i), fmt.Sprintf("Book %d", i), ""))
+	}
+	errs := make(chan error, len(books))
+	for _, b := range books {
+		go func() {
+			errs <- UpdateLibrary(ctx, path, func(lib *Library) error {
+				return lib.Record(ctx, LibraryRun{Command: "check", Inputs: []string{b}})
+			})
+		}()
+	}
+	for range books {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	lib, err := OpenLibrary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Books) != len(books) {
+		t.Fatalf("books = %d, want %d", len(lib.Books), len(books))
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("lock file left behind: %v", err)
+	}
+}
+
+func TestUpdateLibraryHoldsLock(t *testing.T) {
+	refresh, stale := libraryLockRefresh, libraryLockStale
+	libraryLockRefresh, libraryLockStale = 10*time.Millisecond, 100*time.Millisecond
+	defer func() { libraryLockRefresh, libraryLockStale = refresh, stale }()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index.json")
+	// An update running well past the stale age keeps the lock.
+	held := make(chan struct{})
+	release := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- UpdateLibrary(ctx, path, func(*Library) error {
+			close(held)
+			<-release
+			return nil
+		})
+	}()
+	<-held
+	waitCtx, cancel := context.WithTimeout(ctx, 5*libraryLockStale)
+	defer cancel()
+	if err := UpdateLibrary(waitCtx, path, func(*Library) error { return nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second update while the lock was held: %v", err)
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock nobody refreshes is broken once stale.
+	if err := os.WriteFile(path+".lock", []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * libraryLockStale)
+	if err := os.Chtimes(path+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := UpdateLibrary(waitCtx, path, func(*Library) error { return nil }); err != nil {
+		t.Fatalf("update after a stale lock: %v", err)
+	}
+}
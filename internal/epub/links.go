@@ -0,0 +1,158 @@
+package epub
+
+import (
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BrokenLink is a link that points at no file of the book, or at no
+// element of the file.
+type BrokenLink struct {
+	// Href is the file holding the link, Link the link as written.
+	Href   string `json:"href"`
+	Link   string `json:"link"`
+	Reason string `json:"reason"`
+}
+
+// verifyLinks checks every local link in the documents and stylesheets of
+// the book staged in dir. A link to a missing file is pointed at
+// renames[target] when there is one, or at the file it names with
+// different case; the number of links changed is returned with those that
+// still do not resolve, fragments included.
+func verifyLinks(dir string, manifest Manifest, renames map[string]string, log *slog.Logger) (int, []BrokenLink, error) {
+	files := map[string]bool{}
+	folded := map[string]string{}
+	for _, item := range manifest.Items {
+		href := normalizeEPUBPath(item.Href)
+		files[href] = true
+		folded[strings.ToLower(href)] = href
+	}
+	exists := func(target string) bool {
+		if files[target] {
+			return true
+		}
+		name, err := url.PathUnescape(target)
+		return err == nil && files[normalizeEPUBPath(name)]
+	}
+
+	fixed := 0
+	pkg := &PackageDocument{Manifest: manifest}
+	if _, err := rewriteReferences(dir, pkg, func(target string) (string, bool) {
+		if exists(target) {
+			return "", false
+		}
+		to, ok := renames[target]
+		if !ok {
+			to, ok = folded[strings.ToLower(target)]
+		}
+		if ok {
+			fixed++
+		}
+		return to, ok
+	}); err != nil {
+		return 0, nil, err
+	}
+	if fixed > 0 {
+		log.Info("fixed links", "count", fixed)
+	}
+
+	ids := map[string]map[string]bool{}
+	idsOf := func(href string) (map[string]bool, error) {
+		if set, ok := ids[href]; ok {
+			return set, nil
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(href)))
+		if err != nil {
+			return nil, err
+		}
+		set := map[string]bool{}
+		for _, m := range idAttrPattern.FindAllStringSubmatch(string(data), -1) {
+			set[strings.Trim(m[1], `"'`)] = true
+		}
+		ids[href] = set
+		return set, nil
+	}
+	isDocument := map[string]bool{}
+	for _, item := range manifest.Items {
+		if item.MediaType == "application/xhtml+xml" || item.MediaType == "image/svg+xml" {
+			isDocument[normalizeEPUBPath(item.Href)] = true
+		}
+	}
+
+	var broken []BrokenLink
+	for _, item := range manifest.Items {
+		pattern := referencePattern(item.MediaType)
+		if pattern == nil {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(href)))
+		if err != nil {
+			return fixed, nil, err
+		}
+		base := path.Dir(href)
+		for _, m := range pattern.FindAllStringSubmatch(string(data), -1) {
+			raw := strings.Trim(m[2], `"'`)
+			if raw == "" || strings.Contains(raw, ":") {
+				continue
+			}
+			target, frag, _ := strings.Cut(raw, "#")
+			target, _, _ = strings.Cut(target, "?")
+			resolved := href
+			if target != "" {
+				resolved = normalizeEPUBPath(path.Join(base, target))
+				if !exists(resolved) {
+					broken = append(broken, BrokenLink{Href: href, Link: raw, Reason: "no such file"})
+					continue
+				}
+				if name, err := url.PathUnescape(resolved); err == nil && !files[resolved] {
+					resolved = normalizeEPUBPath(name)
+				}
+			}
+			if frag == "" || !isDocument[resolved] {
+				continue
+			}
+			set, err := idsOf(resolved)
+			if err != nil {
+				return fixed, nil, err
+			}
+			if fragment, err := url.PathUnescape(frag); err == nil && !set[frag] && !set[fragment] {
+				broken = append(broken, BrokenLink{Href: href, Link: raw, Reason: "no element with id " + fragment})
+			}
+		}
+	}
+	for _, b := range broken {
+		log.Warn("broken link", "href", b.Href, "link", b.Link, "reason", b.Reason)
+	}
+	return fixed, broken, nil
+}
+
+// mergeLinkRenames maps the files of the merged book that links from the
+// volumes may name but that are not there: each volume's own navigation
+// document, replaced by the merged one, and matter dropped as a repeat,
+// replaced by the same file in the earliest volume that kept it. dropped
+// holds each volume's dropped spine documents.
+func mergeLinkRenames(volumes []*Volume, dropped [][]string) map[string]string {
+	renames := map[string]string{}
+	for i, vol := range volumes {
+		if vol.NavHref != "" {
+			renames[vol.mergedHref(vol.NavHref)] = "nav.xhtml"
+		}
+		if i >= len(dropped) {
+			continue
+		}
+		for _, href := range dropped[i] {
+			for _, earlier := range volumes[:i] {
+				if containsString(spineHrefs(earlier.PackageDoc), href) {
+					renames[vol.mergedHref(href)] = earlier.mergedHref(href)
+					break
+				}
+			}
+		}
+	}
+	return renames
+}
@@ -0,0 +1,95 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func buildLinkVolume(t *testing.T) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:links</dc:identifier>
+    <dc:title>Links</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="copy" href="Text/copyright.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="copy"/>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/ch1.xhtml">One</a></li><li><a href="Text/ch2.xhtml#s2">Two</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/Text/copyright.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Copyright</p></body></html>`,
+		"OEBPS/Text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body>
+<p><a href="../nav.xhtml#toc">Contents</a> <a href="copyright.xhtml">Copyright</a> <a href="Ch2.xhtml#s2">Next</a></p>
+<p><a href="ch2.xhtml#nowhere">Lost</a> <a href="gone.xhtml">Gone</a> <a href="#top">Top</a> <a href="https://example.com/">Web</a></p>
+</body></html>`,
+		"OEBPS/Text/ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h2 id="s2">Two</h2></body></html>`,
+	})
+}
+
+func TestMergeVerifiesLinks(t *testing.T) {
+	vols := []string{buildLinkVolume(t), buildLinkVolume(t)}
+	opts := MergeOptions{
+		OutPath:     filepath.Join(t.TempDir(), "merged.epub"),
+		StripMatter: &MatterFilter{Files: []string{"copyright"}},
+	}
+	plan, err := PlanMerge(context.Background(), vols, opts)
+	if err != nil {
+		t.Fatalf("PlanMerge: %v", err)
+	}
+	// Per volume: the nav link, Ch2.xhtml, and in the second volume the
+	// dropped copyright page.
+	if plan.FixedLinks != 5 {
+		t.Errorf("fixed links = %d, want 5", plan.FixedLinks)
+	}
+	var broken []string
+	for _, b := range plan.BrokenLinks {
+		broken = append(broken, b.Href+" "+b.Link+" "+b.Reason)
+	}
+	want := []string{
+		"Volumes/v0001/Text/ch1.xhtml ch2.xhtml#nowhere no element with id nowhere",
+		"Volumes/v0001/Text/ch1.xhtml gone.xhtml no such file",
+		"Volumes/v0001/Text/ch1.xhtml #top no element with id top",
+		"Volumes/v0002/Text/ch1.xhtml ch2.xhtml#nowhere no element with id nowhere",
+		"Volumes/v0002/Text/ch1.xhtml gone.xhtml no such file",
+		"Volumes/v0002/Text/ch1.xhtml #top no element with id top",
+	}
+	if !reflect.DeepEqual(broken, want) {
+		t.Errorf("broken links =\n%s\nwant\n%s", strings.Join(broken, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := MergeEPUBs(context.Background(), vols, opts); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	vol, err := loadVolume(context.Background(), 0, opts.OutPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0002", "Text", "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{`href="../../../nav.xhtml#toc"`, `href="../../v0001/Text/copyright.xhtml"`, `href="ch2.xhtml#s2"`} {
+		if !strings.Contains(string(data), link) {
+			t.Errorf("missing %s in\n%s", link, data)
+		}
+	}
+}
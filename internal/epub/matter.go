@@ -0,0 +1,206 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultMatterTypes are the epub:type values of pages every volume
+// repeats; MatterFilter.Types usually starts from them.
+var DefaultMatterTypes = []string{"titlepage", "halftitlepage", "copyright-page", "imprint", "colophon"}
+
+// MatterFilter selects front and back matter pages that merge drops from
+// every volume but the first. A spine document is dropped when any of the
+// filters matches it.
+type MatterFilter struct {
+	// Files are regular expressions matched against each document's href
+	// (relative to its package document).
+	Files []string
+	// Types are epub:type values (titlepage, copyright-page, afterword, ...)
+	// looked up on the document's body and section elements and in the
+	// landmarks nav.
+	Types []string
+	// NavTitles are regular expressions matched against table of contents
+	// entries; the documents those entries point to are dropped.
+	NavTitles []string
+}
+
+var (
+	epubTypeAttrPattern  = regexp.MustCompile(`(?is)<(?:body|section)\b[^>]*?\sepub:type\s*=\s*["']([^"']*)["']`)
+	landmarksPattern     = regexp.MustCompile(`(?is)<nav\b[^>]*epub:type\s*=\s*["'][^"']*\blandmarks\b[^"']*["'][^>]*>(.*?)</nav\s*>`)
+	anchorPattern        = regexp.MustCompile(`(?is)<a\b[^>]*>`)
+	epubTypeValuePattern = regexp.MustCompile(`(?i)\sepub:type\s*=\s*["']([^"']*)["']`)
+)
+
+type compiledMatter struct {
+	files []*regexp.Regexp
+	types map[string]bool
+	nav   []*regexp.Regexp
+}
+
+func compileMatterFilter(f *MatterFilter) (*compiledMatter, error) {
+	c := &compiledMatter{types: map[string]bool{}}
+	for _, p := range f.Files {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("matter file pattern %q: %w", p, err)
+		}
+		c.files = append(c.files, re)
+	}
+	for _, p := range f.NavTitles {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("matter nav pattern %q: %w", p, err)
+		}
+		c.nav = append(c.nav, re)
+	}
+	for _, t := range f.Types {
+		c.types[strings.TrimSpace(t)] = true
+	}
+	return c, nil
+}
+
+// stripMatter drops the spine documents of vol that f selects, keeping the
+// volume's first document when everything would go.
+func stripMatter(vol *Volume, f *compiledMatter, log *slog.Logger) error {
+	pages, err := f.pages(vol)
+	if err != nil {
+		return err
+	}
+	var edits []SpineEdit
+	for _, p := range pages {
+		log.Info("dropping repeated matter", "volume", vol.SourcePath, "href", p.href, "reason", p.reason)
+		edits = append(edits, SpineEdit{Op: SpineDrop, IDRef: p.idref})
+	}
+	if len(edits) == 0 {
+		return nil
+	}
+	if len(edits) == len(vol.PackageDoc.Spine.Itemrefs) {
+		log.Warn("matter filters match every page of the volume; keeping it", "volume", vol.SourcePath)
+		return nil
+	}
+	_, err = applySpineEdits(vol, edits, nil)
+	return err
+}
+
+// matterPage is a spine document a filter selects.
+type matterPage struct {
+	idref, href, reason string
+}
+
+// pages returns the spine documents of vol that f selects, in reading
+// order.
+func (f *compiledMatter) pages(vol *Volume) ([]matterPage, error) {
+	pkg := vol.PackageDoc
+	hrefs := map[string]string{}
+	for _, item := range pkg.Manifest.Items {
+		hrefs[item.ID] = normalizeEPUBPath(item.Href)
+	}
+	landmarks, err := landmarkTypes(vol)
+	if err != nil {
+		return nil, err
+	}
+	byNav := map[string]string{}
+	if len(f.nav) > 0 && vol.NavHref != "" {
+		navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+		collectNavMatches(vol.NavItems, navDir, f.nav, byNav)
+	}
+
+	var pages []matterPage
+	for _, ref := range pkg.Spine.Itemrefs {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		reason, err := f.match(vol, href, landmarks[href], byNav)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			pages = append(pages, matterPage{idref: ref.IDRef, href: href, reason: reason})
+		}
+	}
+	return pages, nil
+}
+
+// match returns why href is matter, or "" when it isn't.
+func (f *compiledMatter) match(vol *Volume, href string, landmarks []string, byNav map[string]string) (string, error) {
+	for _, re := range f.files {
+		if re.MatchString(href) {
+			return "file " + re.String(), nil
+		}
+	}
+	if title, ok := byNav[href]; ok {
+		return "nav " + title, nil
+	}
+	if len(f.types) == 0 {
+		return "", nil
+	}
+	for _, t := range landmarks {
+		if f.types[t] {
+			return "landmark " + t, nil
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+	if err != nil {
+		return "", err
+	}
+	for _, m := range epubTypeAttrPattern.FindAllSubmatch(data, -1) {
+		for _, t := range strings.Fields(string(m[1])) {
+			if f.types[t] {
+				return "epub:type " + t, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func collectNavMatches(items []NavItem, navDir string, patterns []*regexp.Regexp, out map[string]string) {
+	for _, item := range items {
+		target, _, _ := strings.Cut(item.Href, "#")
+		if target != "" {
+			for _, re := range patterns {
+				if re.MatchString(item.Title) {
+					out[normalizeEPUBPath(path.Join(navDir, target))] = item.Title
+					break
+				}
+			}
+		}
+		collectNavMatches(item.Children, navDir, patterns, out)
+	}
+}
+
+// landmarkTypes maps package-relative hrefs to the epub:type values the
+// landmarks nav gives them.
+func landmarkTypes(vol *Volume) (map[string][]string, error) {
+	out := map[string][]string{}
+	if vol.NavHref == "" {
+		return out, nil
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref)))
+	if err != nil {
+		return nil, err
+	}
+	navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+	for _, nav := range landmarksPattern.FindAllSubmatch(data, -1) {
+		for _, a := range anchorPattern.FindAll(nav[1], -1) {
+			types := epubTypeValuePattern.FindSubmatch(a)
+			href := hrefAttrPattern.FindSubmatch(a)
+			if types == nil || href == nil {
+				continue
+			}
+			target, _, _ := strings.Cut(strings.Trim(string(href[2]), `"'`), "#")
+			if target == "" {
+				continue
+			}
+			key := normalizeEPUBPath(path.Join(navDir, target))
+			out[key] = append(out[key], strings.Fields(string(types[1]))...)
+		}
+	}
+	return out, nil
+}
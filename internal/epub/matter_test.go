@@ -0,0 +1,89 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildMatterVolume(t *testing.T, title string) string {
+	t.Helper()
+	page := func(body string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>p</title></head>` + body + `</html>
+`
+	}
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:matter</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="title" href="Text/title.xhtml" media-type="application/xhtml+xml"/>
+    <item id="copy" href="Text/p002.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="after" href="Text/p010.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ads" href="Text/ads.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="title"/>
+    <itemref idref="copy"/>
+    <itemref idref="ch1"/>
+    <itemref idref="after"/>
+    <itemref idref="ads"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": page(`<body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/ch1.xhtml">Chapter</a></li><li><a href="Text/p010.xhtml">Afterword</a></li></ol></nav>
+<nav epub:type="landmarks"><ol><li><a epub:type="copyright-page" href="Text/p002.xhtml">Copyright</a></li></ol></nav>
+</body>`),
+		"OEBPS/Text/title.xhtml": page(`<body><section epub:type="titlepage"><h1>` + title + `</h1></section></body>`),
+		"OEBPS/Text/p002.xhtml":  page(`<body><p>(c)</p></body>`),
+		"OEBPS/Text/ch1.xhtml":   page(`<body><p>text</p></body>`),
+		"OEBPS/Text/p010.xhtml":  page(`<body><p>thanks</p></body>`),
+		"OEBPS/Text/ads.xhtml":   page(`<body><p>buy more</p></body>`),
+	})
+}
+
+func TestMergeStripMatter(t *testing.T) {
+	vols := []string{buildMatterVolume(t, "One"), buildMatterVolume(t, "Two")}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	opts := MergeOptions{
+		OutPath: out,
+		StripMatter: &MatterFilter{
+			Types:     DefaultMatterTypes,
+			Files:     []string{`ads\.xhtml$`},
+			NavTitles: []string{`^Afterword$`},
+		},
+	}
+	if err := MergeEPUBs(context.Background(), vols, opts); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	var order []string
+	for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+		order = append(order, ref.IDRef)
+	}
+	want := "v0001_title v0001_copy v0001_ch1 v0001_after v0001_ads v0002_ch1"
+	if got := strings.Join(order, " "); got != want {
+		t.Fatalf("spine = %s, want %s", got, want)
+	}
+	if hasManifestHref(vol.PackageDoc, "Volumes/v0002/Text/p010.xhtml") {
+		t.Fatalf("dropped afterword still in manifest")
+	}
+	if len(vol.NavItems) != 2 || len(vol.NavItems[1].Children) != 1 {
+		t.Fatalf("volume 2 nav should keep only the chapter: %+v", vol.NavItems)
+	}
+}
@@ -0,0 +1,138 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// propMediaDuration refines each media overlay with its length; the one
+// refining nothing is the book's total.
+const propMediaDuration = "media:duration"
+
+// addMediaOverlayMetas adds the media overlay metas of vol to meta, the
+// metadata of a book vol was merged into. Refinements follow vol's items to
+// the ids rename gives them and are dropped with items it does not know. A
+// book-wide setting, such as media:active-class, that meta already has is
+// kept, with a warning when vol's differs. The book's total duration is
+// then recomputed.
+func addMediaOverlayMetas(meta *Metadata, vol *Volume, rename func(id string) (string, bool), log *slog.Logger) {
+	have := map[string]string{}
+	for _, m := range meta.Meta {
+		if m.Refines == "" && m.Property != "" {
+			have[m.Property] = strings.TrimSpace(m.Value)
+		}
+	}
+	added := false
+	for _, m := range vol.PackageDoc.Metadata.Meta {
+		if !strings.HasPrefix(m.Property, "media:") {
+			continue
+		}
+		if m.Refines != "" {
+			id, ok := rename(strings.TrimPrefix(m.Refines, "#"))
+			if !ok {
+				continue
+			}
+			m.ID, m.Refines = "", "#"+id
+			meta.Meta = append(meta.Meta, m)
+			added = true
+			continue
+		}
+		if m.Property == propMediaDuration {
+			continue
+		}
+		value := strings.TrimSpace(m.Value)
+		if prev, ok := have[m.Property]; ok {
+			if prev != value {
+				log.Warn("volumes disagree on a media overlay setting; keeping the first", "property", m.Property, "kept", prev, "volume", vol.SourcePath, "value", value)
+			}
+			continue
+		}
+		m.ID = ""
+		meta.Meta = append(meta.Meta, m)
+		have[m.Property] = value
+		added = true
+	}
+	if added {
+		setMediaDuration(meta, log)
+	}
+}
+
+// setMediaDuration replaces the book-wide media:duration of meta with the
+// sum of the durations refining its overlays, or removes it when there
+// are none.
+func setMediaDuration(meta *Metadata, log *slog.Logger) {
+	var total float64
+	overlays := 0
+	kept := meta.Meta[:0]
+	for _, m := range meta.Meta {
+		if m.Property != propMediaDuration {
+			kept = append(kept, m)
+			continue
+		}
+		if m.Refines == "" {
+			continue
+		}
+		kept = append(kept, m)
+		seconds, ok := parseClockValue(m.Value)
+		if !ok {
+			log.Warn("unreadable media overlay duration", "refines", m.Refines, "value", m.Value)
+			continue
+		}
+		total += seconds
+		overlays++
+	}
+	meta.Meta = kept
+	if overlays > 0 {
+		meta.Meta = append(meta.Meta, MetaNode{Property: propMediaDuration, Value: formatClockValue(total)})
+	}
+}
+
+// parseClockValue reads a SMIL clock value: a full (1:02:03.5) or partial
+// (02:03.5) clock value, or a timecount such as 3.5s, 90min or 250ms.
+func parseClockValue(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, false
+		}
+		var seconds float64
+		for i, p := range parts {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil || v < 0 || i < len(parts)-1 && strings.Contains(p, ".") {
+				return 0, false
+			}
+			seconds = seconds*60 + v
+		}
+		return seconds, true
+	}
+	scale := 1.0
+	for _, unit := range []struct {
+		suffix string
+		scale  float64
+	}{{"ms", 0.001}, {"min", 60}, {"h", 3600}, {"s", 1}} {
+		if rest, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, scale = rest, unit.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v * scale, true
+}
+
+// formatClockValue renders seconds as a full clock value, H:MM:SS with
+// milliseconds when there are any.
+func formatClockValue(seconds float64) string {
+	ms := int(math.Round(seconds * 1000))
+	clock := FormatClock(ms / 1000)
+	if ms%1000 != 0 {
+		clock += fmt.Sprintf(".%03d", ms%1000)
+	}
+	return clock
+}
@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseClockValue(t *testing.T) {
+	for in, want := range map[string]float64{
+		"0:32:29.5": 1949.5,
+		"02:03":     123,
+		"12.5s":     12.5,
+		"250ms":     0.25,
+		"1.5min":    90,
+		"2h":        7200,
+		"42":        42,
+	} {
+		if got, ok := parseClockValue(in); !ok || got != want {
+			t.Errorf("parseClockValue(%q) = %v, %v; want %v", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{"", "1:2:3:4", "1.5:00", "soon", "-3s"} {
+		if _, ok := parseClockValue(in); ok {
+			t.Errorf("parseClockValue(%q) accepted", in)
+		}
+	}
+	if got := formatClockValue(3723.25); got != "1:02:03.250" {
+		t.Errorf("formatClockValue = %s", got)
+	}
+}
+
+func buildOverlayVolume(t *testing.T, duration string) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:overlay</dc:identifier>
+    <dc:title>Volume</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="media:duration" refines="#ch1_overlay">` + duration + `</meta>
+    <meta property="media:duration">` + duration + `</meta>
+    <meta property="media:active-class">-epub-media-overlay-active</meta>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml" media-overlay="ch1_overlay"/>
+    <item id="ch1_overlay" href="Text/ch1.smil" media-type="application/smil+xml"/>
+    <item id="ch1_audio" href="Audio/ch1.mp3" media-type="audio/mpeg"/>
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>
+`,
+		"OEBPS/Text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head><body><p id="p1">Hello.</p></body></html>`,
+		"OEBPS/Text/ch1.smil": `<smil xmlns="http://www.w3.org/ns/SMIL" xmlns:epub="http://www.idpf.org/2007/ops" version="3.0">
+<body><seq epub:textref="ch1.xhtml"><par><text src="ch1.xhtml#p1"/><audio src="../Audio/ch1.mp3" clipBegin="0s" clipEnd="` + duration + `"/></par></seq></body>
+</smil>`,
+		"OEBPS/Audio/ch1.mp3": "ID3",
+	})
+}
+
+func TestMergeMediaOverlays(t *testing.T) {
+	ctx := context.Background()
+	vols := []string{buildOverlayVolume(t, "0:01:30"), buildOverlayVolume(t, "45.5s")}
+	out := filepath.Join(t.TempDir(), "book.epub")
+	plan, err := PlanMerge(ctx, vols, MergeOptions{OutPath: out, Layout: "{type}/v{v}-{name}"})
+	if err != nil {
+		t.Fatalf("PlanMerge: %v", err)
+	}
+	if len(plan.BrokenLinks) > 0 {
+		t.Fatalf("broken links: %+v", plan.BrokenLinks)
+	}
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, Layout: "{type}/v{v}-{name}"}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	items := manifestByID(vol.PackageDoc)
+	if got := items["v0002_ch1"].MediaOverlay; got != "v0002_ch1_overlay" {
+		t.Fatalf("media-overlay = %q", got)
+	}
+	var durations, classes []string
+	for _, m := range vol.PackageDoc.Metadata.Meta {
+		switch m.Property {
+		case propMediaDuration:
+			durations = append(durations, m.Refines+"="+m.Value)
+		case "media:active-class":
+			classes = append(classes, m.Value)
+		}
+	}
+	if got := strings.Join(durations, " "); got != "#v0001_ch1_overlay=0:01:30 #v0002_ch1_overlay=45.5s =0:02:15.500" {
+		t.Fatalf("durations = %s", got)
+	}
+	if len(classes) != 1 {
+		t.Fatalf("active classes = %v", classes)
+	}
+
+	smil, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(items["v0002_ch1_overlay"].Href)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`epub:textref="../text/v2-ch1.xhtml"`, `src="../text/v2-ch1.xhtml#p1"`, `src="../audio/v2-ch1.mp3"`} {
+		if !strings.Contains(string(smil), want) {
+			t.Errorf("missing %s in %s", want, smil)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"encoding/xml"
 	"fmt"
+	"hash/crc32"
 	"html"
 	"io"
 	"os"
@@ -19,6 +20,12 @@ import (
 )
 
 func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error {
+	return mergeEPUBs(ctx, sources, opts, nil)
+}
+
+// mergeEPUBs merges sources into opts.OutPath, describing what it did in
+// plan when it is not nil.
+func mergeEPUBs(ctx context.Context, sources []string, opts MergeOptions, plan *MergePlan) error {
 	if len(sources) < 2 {
 		return fmt.Errorf("need at least two input EPUB files")
 	}
@@ -26,12 +33,25 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 	if opts.OutPath == "" {
 		return fmt.Errorf("output path is required")
 	}
+	layout, err := parseMergeLayout(opts.Layout)
+	if err != nil {
+		return err
+	}
+	if err := checkTitleTemplate(opts.Title); err != nil {
+		return err
+	}
+	if err := checkInsertPages(opts.InsertPages, len(sources)); err != nil {
+		return err
+	}
+	log := loggerOrDiscard(opts.Logger)
 
 	volumes := make([]*Volume, len(sources))
 	for i, src := range sources {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		log.Info(fmt.Sprintf("loading volume %d/%d", i+1, len(sources)), "path", src)
+		opts.Progress.report(StageLoad, i, len(sources), src)
 		vol, err := loadVolume(ctx, i, src)
 		if err != nil {
 			for _, v := range volumes {
@@ -42,13 +62,81 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 			return err
 		}
 		volumes[i] = vol
+		logRepairs(log, vol)
+		if err := normalizeVolumeText(ctx, vol, opts.TextDecoder, log); err != nil {
+			for _, v := range volumes {
+				if v != nil {
+					os.RemoveAll(v.TempDir)
+				}
+			}
+			return err
+		}
 	}
+	opts.Progress.report(StageLoad, len(sources), len(sources), "")
 	defer func() {
 		for _, v := range volumes {
 			os.RemoveAll(v.TempDir)
 		}
 	}()
 
+	bookRendition, err := mergedRendition(volumes, opts.MixedLayout, log)
+	if err != nil {
+		return err
+	}
+	var before [][]string
+	for _, vol := range volumes {
+		before = append(before, spineHrefs(vol.PackageDoc))
+	}
+	if opts.StripMatter != nil {
+		matter, err := compileMatterFilter(opts.StripMatter)
+		if err != nil {
+			return err
+		}
+		for _, vol := range volumes[1:] {
+			if err := stripMatter(vol, matter, log); err != nil {
+				return fmt.Errorf("%s: %w", vol.SourcePath, err)
+			}
+		}
+	}
+	nonLinearPolicy, err := ParseNonLinearPolicy(opts.NonLinear)
+	if err != nil {
+		return err
+	}
+	nonLinear := make([]int, len(volumes))
+	for i, vol := range volumes {
+		if nonLinear[i], err = applyNonLinearPolicy(vol, nonLinearPolicy, log); err != nil {
+			return fmt.Errorf("%s: %w", vol.SourcePath, err)
+		}
+	}
+	illustrations := make([][]string, len(volumes))
+	illustrationsAt := ""
+	if opts.Illustrations != nil {
+		if illustrationsAt, err = ParseIllustrationsAt(opts.IllustrationsAt); err != nil {
+			return err
+		}
+		filter, err := compileMatterFilter(opts.Illustrations)
+		if err != nil {
+			return err
+		}
+		for i, vol := range volumes {
+			if illustrations[i], err = gatherIllustrations(vol, filter, illustrationsAt, log); err != nil {
+				return fmt.Errorf("%s: %w", vol.SourcePath, err)
+			}
+		}
+	}
+	dropped := make([][]string, len(volumes))
+	for i, vol := range volumes {
+		hrefs := spineHrefs(vol.PackageDoc)
+		for _, href := range before[i] {
+			if !containsString(hrefs, href) {
+				dropped[i] = append(dropped[i], href)
+			}
+		}
+		if plan != nil {
+			plan.Volumes = append(plan.Volumes, PlanVolume{Index: vol.Index, SourcePath: vol.SourcePath, Title: vol.DisplayName, Chapters: len(hrefs), Dropped: dropped[i], NonLinear: nonLinear[i], Illustrations: illustrations[i]})
+		}
+	}
+
 	stageDir, err := os.MkdirTemp("", "novfmt-stage-*")
 	if err != nil {
 		return err
@@ -60,10 +148,32 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 		return err
 	}
 
+	// The size budget is checked, and the book shrunk to fit it, on a local
+	// file; a stream or a Storage only gets the book that fits.
+	env := EnvFrom(ctx)
+	zipPath := opts.OutPath
+	if opts.MaxSize > 0 && !env.isLocalPath(opts.OutPath) {
+		zipDir, err := os.MkdirTemp("", "novfmt-budget-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(zipDir)
+		zipPath = filepath.Join(zipDir, "book.epub")
+	}
+
 	manifest := Manifest{}
 	spine := Spine{}
 	idHref := make(map[string]string)
 	var coverItemID string
+	taken := map[string]bool{"nav.xhtml": true, "content.opf": true}
+	// gallery holds the illustrations gathered for the end of the book.
+	var (
+		gallery    []SpineItemRef
+		galleryNav VolumeNav
+	)
+	// volumeStart and afterCover are where InsertPages go.
+	volumeStart := make([]int, len(volumes))
+	afterCover := 0
 
 	for _, vol := range volumes {
 		select {
@@ -72,13 +182,18 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 		default:
 		}
 
-		vol.Prefix = path.Join("Volumes", fmt.Sprintf("v%04d", vol.Index+1))
-		destDir := filepath.Join(oebpsDir, filepath.FromSlash(vol.Prefix))
-		if err := copyVolumePayload(vol, destDir); err != nil {
+		log.Info(fmt.Sprintf("copying volume %d/%d", vol.Index+1, len(volumes)), "title", vol.DisplayName)
+		opts.Progress.report(StageCopy, vol.Index, len(volumes), vol.DisplayName)
+		inPlace, err := layoutVolume(vol, layout, taken, log)
+		if err != nil {
+			return fmt.Errorf("%s: %w", vol.SourcePath, err)
+		}
+		if err := copyVolumePayload(vol, oebpsDir, !inPlace); err != nil {
 			return fmt.Errorf("%s: %w", vol.SourcePath, err)
 		}
 
 		idMap := make(map[string]string)
+		volumeStart[vol.Index] = len(spine.Itemrefs)
 
 		for _, item := range vol.PackageDoc.Manifest.Items {
 			if hasProperty(item.Properties, "nav") {
@@ -86,7 +201,7 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 			}
 			newID := fmt.Sprintf("v%04d_%s", vol.Index+1, item.ID)
 			idMap[item.ID] = newID
-			href := normalizeEPUBPath(path.Join(vol.Prefix, item.Href))
+			href := vol.mergedHref(item.Href)
 			entry := ManifestItem{
 				ID:         newID,
 				Href:       href,
@@ -96,6 +211,9 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 			if item.Fallback != "" {
 				entry.Fallback = fmt.Sprintf("v%04d_%s", vol.Index+1, item.Fallback)
 			}
+			if item.MediaOverlay != "" {
+				entry.MediaOverlay = fmt.Sprintf("v%04d_%s", vol.Index+1, item.MediaOverlay)
+			}
 			if coverItemID == "" {
 				switch {
 				case vol.CoverID != "" && item.ID == vol.CoverID:
@@ -110,19 +228,63 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 			idHref[newID] = href
 		}
 
+		if opts.VolumeTitlePages {
+			coverHref := ""
+			for _, item := range vol.PackageDoc.Manifest.Items {
+				if item.ID == vol.CoverID && strings.HasPrefix(item.MediaType, "image/") {
+					coverHref = vol.mergedHref(item.Href)
+				}
+			}
+			href, err := writeVolumeTitlePage(vol, oebpsDir, coverHref)
+			if err != nil {
+				return fmt.Errorf("%s: title page: %w", vol.SourcePath, err)
+			}
+			id := fmt.Sprintf("v%04d_novfmt-title", vol.Index+1)
+			for n := 2; idHref[id] != ""; n++ {
+				id = fmt.Sprintf("v%04d_novfmt-title-%d", vol.Index+1, n)
+			}
+			manifest.Items = append(manifest.Items, ManifestItem{ID: id, Href: href, MediaType: "application/xhtml+xml"})
+			idHref[id] = href
+			spine.Itemrefs = append(spine.Itemrefs, titlePageRef(id, bookRendition))
+			vol.FirstHref = href
+		}
+
 		if spine.PageProgressionDirection == "" && vol.PackageDoc.Spine.PageProgressionDirection != "" {
 			spine.PageProgressionDirection = vol.PackageDoc.Spine.PageProgressionDirection
 		}
 
+		if vol.Index == 0 {
+			afterCover = len(spine.Itemrefs)
+		}
+		listed := false
 		for _, ref := range vol.PackageDoc.Spine.Itemrefs {
 			newID, ok := idMap[ref.IDRef]
 			if !ok {
+				log.Warn("spine item not in manifest, skipping", "volume", vol.SourcePath, "idref", ref.IDRef)
+				continue
+			}
+			if illustrationsAt == IllustrationsBook && containsString(illustrations[vol.Index], normalizeEPUBPath(spineHref(vol.PackageDoc, ref.IDRef))) {
+				if !listed {
+					galleryNav.Items = append(galleryNav.Items, NavItem{Title: vol.DisplayName, Href: idHref[newID]})
+					listed = true
+				}
+				gallery = append(gallery, SpineItemRef{IDRef: newID, Linear: ref.Linear, Properties: ref.Properties})
 				continue
 			}
 			spine.Itemrefs = append(spine.Itemrefs, SpineItemRef{
-				IDRef:  newID,
-				Linear: ref.Linear,
+				IDRef:      newID,
+				Linear:     ref.Linear,
+				Properties: ref.Properties,
 			})
+			if vol.Index == 0 && len(opts.InsertPages) > 0 && len(spine.Itemrefs) == afterCover+1 {
+				cover, err := isCoverPage(vol, normalizeEPUBPath(spineHref(vol.PackageDoc, ref.IDRef)))
+				if err != nil {
+					return fmt.Errorf("%s: %w", vol.SourcePath, err)
+				}
+				if cover {
+					afterCover++
+				}
+			}
 
 			if vol.FirstHref == "" {
 				vol.FirstHref = idHref[newID]
@@ -130,6 +292,43 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 		}
 	}
 
+	opts.Progress.report(StageCopy, len(volumes), len(volumes), "")
+	var extraNav []VolumeNav
+	if len(gallery) > 0 {
+		spine.Itemrefs = append(spine.Itemrefs, gallery...)
+		galleryNav.Index, galleryNav.Title, galleryNav.Href = -1, illustrationsTitle, galleryNav.Items[0].Href
+		extraNav = append(extraNav, galleryNav)
+	}
+	if len(opts.InsertPages) > 0 {
+		ids, err := stageInsertPages(opts.InsertPages, oebpsDir, &manifest, idHref, taken)
+		if err != nil {
+			return err
+		}
+		placeInsertPages(&spine, opts.InsertPages, ids, volumeStart, afterCover, bookRendition)
+		log.Info("inserted pages", "count", len(ids))
+	}
+
+	if opts.ShareResources {
+		if err := shareResources(oebpsDir, &manifest, spine, volumes, opts.ConflictResolver, plan, log); err != nil {
+			return err
+		}
+	}
+	if err := consolidateCSS(oebpsDir, &manifest, opts, plan, log); err != nil {
+		return err
+	}
+	if opts.StripCSS || opts.UserCSS != "" {
+		restyle := RestyleOptions{StripCSS: opts.StripCSS, Keep: opts.KeepCSS, UserCSS: opts.UserCSS}
+		if _, err := restyleTree(ctx, oebpsDir, &manifest, restyle, log); err != nil {
+			return err
+		}
+	}
+	if opts.Ruby != "" {
+		log.Info("converting ruby", "mode", opts.Ruby)
+		if _, err := applyRuby(ctx, oebpsDir, &manifest, opts.Ruby, log); err != nil {
+			return err
+		}
+	}
+
 	manifest.Items = append(manifest.Items, ManifestItem{
 		ID:         "nav",
 		Href:       "nav.xhtml",
@@ -137,43 +336,105 @@ func MergeEPUBs(ctx context.Context, sources []string, opts MergeOptions) error
 		Properties: "nav",
 	})
 
-	if err := writeNav(volumes, filepath.Join(oebpsDir, "nav.xhtml")); err != nil {
+	log.Info("rewriting hrefs and building nav")
+	if err := writeNav(volumes, extraNav, opts.NavBuilder, filepath.Join(oebpsDir, "nav.xhtml")); err != nil {
 		return err
 	}
 
-	pkg := buildPackage(volumes, manifest, spine, opts, coverItemID)
-	if err := writePackage(pkg, filepath.Join(oebpsDir, "content.opf")); err != nil {
+	log.Info("checking links")
+	fixedLinks, brokenLinks, err := verifyLinks(oebpsDir, manifest, mergeLinkRenames(volumes, dropped), log)
+	if err != nil {
 		return err
 	}
-
-	if err := writeContainer(filepath.Join(stageDir, "META-INF")); err != nil {
-		return err
+	if plan != nil {
+		plan.FixedLinks = fixedLinks
+		plan.BrokenLinks = append(plan.BrokenLinks, brokenLinks...)
 	}
 
-	if err := os.WriteFile(filepath.Join(stageDir, "mimetype"), []byte("application/epub+zip"), 0o644); err != nil {
-		return err
+	pkg := buildPackage(volumes, manifest, spine, opts, coverItemID)
+	setRendition(&pkg.Metadata, bookRendition)
+	for _, vol := range volumes {
+		items := manifestByID(vol.PackageDoc)
+		addMediaOverlayMetas(&pkg.Metadata, vol, func(id string) (string, bool) {
+			item, ok := items[id]
+			if !ok || hasProperty(item.Properties, "nav") {
+				return "", false
+			}
+			return fmt.Sprintf("v%04d_%s", vol.Index+1, id), true
+		}, log)
 	}
-
-	if err := writeZip(stageDir, opts.OutPath); err != nil {
+	if opts.WritingMode != "" {
+		log.Info("setting writing mode", "mode", opts.WritingMode)
+		if _, err := applyWritingMode(ctx, oebpsDir, pkg, opts.WritingMode, nil, log); err != nil {
+			return err
+		}
+	}
+	if plan != nil {
+		meta := pkg.Metadata
+		plan.Title = meta.Titles[0].Value
+		plan.Language = meta.Languages[0].Value
+		for _, c := range meta.Creators {
+			plan.Creators = append(plan.Creators, c.Value)
+		}
+		plan.Files = len(pkg.Manifest.Items)
+		if plan.TOC, err = parseNavFile(filepath.Join(oebpsDir, "nav.xhtml")); err != nil {
+			return err
+		}
+	}
+	sums, err := hashSources(ctx, volumes)
+	if err != nil {
 		return err
 	}
+	mergedAt := time.Now()
+	// finish writes the package and zips the book; a size budget may need
+	// it more than once.
+	finish := func() error {
+		if err := writePackage(pkg, filepath.Join(oebpsDir, "content.opf")); err != nil {
+			return err
+		}
 
-	return nil
-}
+		if err := writeContainer(filepath.Join(stageDir, "META-INF")); err != nil {
+			return err
+		}
 
-func buildPackage(vols []*Volume, manifest Manifest, spine Spine, opts MergeOptions, coverID string) *PackageDocument {
-	title := opts.Title
-	if title == "" && len(vols) > 0 {
-		if len(vols[0].PackageDoc.Metadata.Titles) > 0 {
-			title = vols[0].PackageDoc.Metadata.Titles[0].Value
-		} else {
-			title = vols[0].DisplayName
+		if err := writeVolumeManifest(stageDir, mergedVolumeManifest(pkg, volumes, sums, mergedAt)); err != nil {
+			return err
+		}
+
+		if opts.ChapterHashes {
+			if _, err := writeChapterHashes(stageDir, filepath.Join(oebpsDir, "content.opf")); err != nil {
+				return err
+			}
+		}
+
+		if err := os.WriteFile(filepath.Join(stageDir, "mimetype"), []byte(epubMimeType), 0o644); err != nil {
+			return err
+		}
+
+		if opts.Checksums {
+			if _, err := writeChecksums(stageDir); err != nil {
+				return err
+			}
 		}
+
+		log.Info("zipping output", "path", opts.OutPath)
+		return writeZipProgress(ctx, stageDir, zipPath, opts.Progress)
 	}
-	if title == "" {
-		title = "Merged EPUB"
+	if err := finish(); err != nil {
+		return err
+	}
+	if opts.MaxSize > 0 {
+		if err := enforceSizeBudget(ctx, oebpsDir, pkg, zipPath, opts, finish, log); err != nil {
+			return err
+		}
+	}
+	if zipPath != opts.OutPath {
+		return env.copyBook(ctx, zipPath, opts.OutPath)
 	}
+	return nil
+}
 
+func buildPackage(vols []*Volume, manifest Manifest, spine Spine, opts MergeOptions, coverID string) *PackageDocument {
 	lang := opts.Language
 	if lang == "" && len(vols) > 0 {
 		if len(vols[0].PackageDoc.Metadata.Languages) > 0 {
@@ -210,6 +471,15 @@ func buildPackage(vols []*Volume, manifest Manifest, spine Spine, opts MergeOpti
 	}
 	sort.Strings(creators)
 
+	srcs := make([]titleSource, 0, len(vols))
+	for _, v := range vols {
+		srcs = append(srcs, titleSourceOf(v))
+	}
+	title := mergedTitle(opts.Title, srcs, creators[0])
+	if title == "" {
+		title = "Merged EPUB"
+	}
+
 	identifier := randomURN()
 
 	meta := Metadata{
@@ -227,6 +497,9 @@ func buildPackage(vols []*Volume, manifest Manifest, spine Spine, opts MergeOpti
 	for _, creator := range creators {
 		meta.Creators = append(meta.Creators, DCMeta{Value: creator})
 	}
+	for _, src := range mergedSources(vols) {
+		meta.Sources = append(meta.Sources, DCMeta{Value: src})
+	}
 
 	meta.Meta = append(meta.Meta, MetaNode{
 		Property: "novfmt:source-count",
@@ -253,13 +526,19 @@ func buildPackage(vols []*Volume, manifest Manifest, spine Spine, opts MergeOpti
 		Metadata:         meta,
 		Manifest:         manifest,
 		Spine:            spine,
-		Prefix:           "novfmt: https://novfmt.local/vocab#",
+		Prefix:           novfmtVocabPrefix,
 	}
 
 	return pkg
 }
 
 func writePackage(pkg *PackageDocument, dest string) error {
+	pruneRefines(pkg)
+	pruneGuide(pkg)
+	ensureUniqueIdentifier(pkg)
+	if pkg.XMLNSOPF == "" && pkg.Metadata.hasOPFAttrs() {
+		pkg.XMLNSOPF = nsOPF
+	}
 	data, err := xml.MarshalIndent(pkg, "", "  ")
 	if err != nil {
 		return err
@@ -285,42 +564,32 @@ func writeContainer(metaDir string) error {
 	return os.WriteFile(filepath.Join(metaDir, "container.xml"), []byte(container), 0o644)
 }
 
-func writeNav(vols []*Volume, dest string) error {
-	var buf bytes.Buffer
-	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
-	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` + "\n")
-	buf.WriteString("<head><title>Table of Contents</title></head>\n<body>\n")
+func writeTOCNav(buf *bytes.Buffer, items []NavItem) {
 	buf.WriteString(`<nav epub:type="toc" id="toc">` + "\n")
 	buf.WriteString("<h1>Table of Contents</h1>\n<ol>\n")
-
-	for _, vol := range vols {
-		entry := buildVolumeNav(vol)
-		if entry == nil {
-			continue
-		}
-		writeNavItem(&buf, *entry)
+	for _, item := range items {
+		writeNavItem(buf, item)
 	}
-
-	buf.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
-	return os.WriteFile(dest, buf.Bytes(), 0o644)
+	buf.WriteString("</ol>\n</nav>\n")
 }
 
 func writeZip(srcDir, outPath string) error {
-	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
-		return err
-	}
+	return writeZipProgress(context.Background(), srcDir, outPath, nil)
+}
 
-	out, err := os.Create(outPath)
+// writeZipProgress zips srcDir to outPath through createBook, so that a
+// failed or canceled write never leaves a partial archive behind.
+func writeZipProgress(ctx context.Context, srcDir, outPath string, progress ProgressFunc) error {
+	out, err := EnvFrom(ctx).createBook(ctx, outPath)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	w := zipWriter{w: out}
+	w := zipWriter{ctx: ctx, w: out, progress: progress}
 	if err := w.addEPUBTree(srcDir); err != nil {
+		out.Abort()
 		return err
 	}
-	return nil
+	return out.Commit()
 }
 
 func randomURN() string {
@@ -342,43 +611,6 @@ func normalizeEPUBPath(p string) string {
 	return path.Clean(strings.ReplaceAll(p, "\\", "/"))
 }
 
-func buildVolumeNav(vol *Volume) *NavItem {
-	if vol == nil {
-		return nil
-	}
-	if len(vol.NavItems) == 0 && vol.FirstHref == "" {
-		return nil
-	}
-	entry := &NavItem{
-		Title: vol.DisplayName,
-		Href:  vol.FirstHref,
-	}
-	if len(vol.NavItems) > 0 {
-		entry.Children = cloneNavItems(vol.NavItems, vol.Prefix)
-		if entry.Href == "" && len(entry.Children) > 0 {
-			entry.Href = entry.Children[0].Href
-		}
-	}
-	return entry
-}
-
-func cloneNavItems(items []NavItem, prefix string) []NavItem {
-	out := make([]NavItem, 0, len(items))
-	for _, item := range items {
-		clone := NavItem{
-			Title: item.Title,
-		}
-		if item.Href != "" {
-			clone.Href = joinHref(prefix, item.Href)
-		}
-		if len(item.Children) > 0 {
-			clone.Children = cloneNavItems(item.Children, prefix)
-		}
-		out = append(out, clone)
-	}
-	return out
-}
-
 func writeNavItem(buf *bytes.Buffer, item NavItem) {
 	buf.WriteString("<li>")
 	label := html.EscapeString(item.Title)
@@ -405,35 +637,6 @@ func writeNavItem(buf *bytes.Buffer, item NavItem) {
 	buf.WriteString("</li>\n")
 }
 
-func copyVolumePayload(vol *Volume, dst string) error {
-	pkgRel := filepath.Base(vol.PackagePath)
-	navRel := path.Clean(filepath.ToSlash(vol.NavHref))
-	return filepath.Walk(vol.PackageDir, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		rel, err := filepath.Rel(vol.PackageDir, p)
-		if err != nil {
-			return err
-		}
-		if rel == pkgRel {
-			return nil
-		}
-		relSlash := path.Clean(filepath.ToSlash(rel))
-		if navRel != "" && relSlash == navRel {
-			return nil
-		}
-		target := filepath.Join(dst, rel)
-		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-			return err
-		}
-		return copyFile(p, target, info.Mode())
-	})
-}
-
 func copyFile(src, dst string, mode os.FileMode) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -453,39 +656,79 @@ func copyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
+// epubMimeType is the content of the mimetype entry.
+const epubMimeType = "application/epub+zip"
+
+// writeMimetype writes the mimetype entry the way OCF requires readers to
+// find it: first, stored, without an extra field, and with its sizes in the
+// local header rather than a trailing data descriptor, so the media type
+// sits at byte 38 of the file. The extracted tree's own mimetype file is
+// ignored.
+func writeMimetype(w *zip.Writer) error {
+	data := []byte(epubMimeType)
+	header := &zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	header.SetMode(0o644)
+	mw, err := w.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	_, err = mw.Write(data)
+	return err
+}
+
 type zipWriter struct {
-	w io.Writer
+	ctx      context.Context
+	w        io.Writer
+	progress ProgressFunc
+	// skip, when set, leaves out the files whose slash-separated paths it
+	// reports.
+	skip func(rel string) bool
+}
+
+// skipped reports whether the file at p under root is left out.
+func (zw *zipWriter) skipped(root, p string) bool {
+	if zw.skip == nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, p)
+	return err == nil && zw.skip(filepath.ToSlash(rel))
 }
 
 func (zw *zipWriter) addEPUBTree(root string) error {
 	writer := zip.NewWriter(zw.w)
 
-	mimePath := filepath.Join(root, "mimetype")
-	mimeData, err := os.ReadFile(mimePath)
-	if err != nil {
+	if err := writeMimetype(writer); err != nil {
 		writer.Close()
 		return err
 	}
 
-	mimeHeader := &zip.FileHeader{
-		Name:   "mimetype",
-		Method: zip.Store,
-	}
-	mimeHeader.SetMode(0o644)
-	mimeWriter, err := writer.CreateHeader(mimeHeader)
-	if err != nil {
-		writer.Close()
-		return err
-	}
-	if _, err := mimeWriter.Write(mimeData); err != nil {
-		writer.Close()
-		return err
+	total := 0
+	if zw.progress != nil {
+		if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !zw.skipped(root, p) {
+				total++
+			}
+			return err
+		}); err != nil {
+			writer.Close()
+			return err
+		}
 	}
+	done := 1
 
 	if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := zw.ctx.Err(); err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -493,7 +736,7 @@ func (zw *zipWriter) addEPUBTree(root string) error {
 		if err != nil {
 			return err
 		}
-		if rel == "mimetype" {
+		if rel == "mimetype" || zw.skipped(root, p) {
 			return nil
 		}
 		header := &zip.FileHeader{
@@ -514,6 +757,8 @@ func (zw *zipWriter) addEPUBTree(root string) error {
 			return err
 		}
 		f.Close()
+		done++
+		zw.progress.report(StageZip, done, total, header.Name)
 		return nil
 	}); err != nil {
 		writer.Close()
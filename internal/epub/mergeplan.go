@@ -0,0 +1,98 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Actions a merge takes on a resource, as reported in a MergePlan.
+const (
+	// ResourceShared: a copy identical to another volume's is stored once
+	// (MergeOptions.ShareResources).
+	ResourceShared = "shared"
+	// ResourceDeduplicated: a stylesheet identical to another is stored
+	// once (MergeOptions.DedupeCSS).
+	ResourceDeduplicated = "deduplicated"
+	// ResourceRenamed: a copy that differs from another volume's at the
+	// same path stays under its own volume.
+	ResourceRenamed = "renamed"
+	// ResourceKeptFirst: a differing copy is dropped for the first
+	// volume's.
+	ResourceKeptFirst = "kept-first"
+)
+
+// MergePlan is what MergeEPUBs would produce for the same sources and
+// options.
+type MergePlan struct {
+	OutPath   string         `json:"out_path"`
+	Title     string         `json:"title"`
+	Language  string         `json:"language"`
+	Creators  []string       `json:"creators"`
+	Volumes   []PlanVolume   `json:"volumes"`
+	TOC       []NavItem      `json:"toc"`
+	Resources []PlanResource `json:"resources"`
+	// FixedLinks counts links the merge pointed at a file's new place;
+	// BrokenLinks are those it could not resolve.
+	FixedLinks  int          `json:"fixed_links"`
+	BrokenLinks []BrokenLink `json:"broken_links"`
+	// Files counts the manifest items of the merged book.
+	Files int `json:"files"`
+	// Size is the size in bytes of the output, zipped as it would be.
+	Size int64 `json:"size"`
+}
+
+// PlanVolume is one input in merge order.
+type PlanVolume struct {
+	Index      int    `json:"index"`
+	SourcePath string `json:"source_path"`
+	Title      string `json:"title"`
+	Chapters   int    `json:"chapters"`
+	// Dropped lists the spine documents MergeOptions.StripMatter removes,
+	// relative to the volume's package.
+	Dropped []string `json:"dropped,omitempty"`
+	// NonLinear counts the volume's spine items marked linear="no",
+	// before MergeOptions.NonLinear applies.
+	NonLinear int `json:"non_linear,omitempty"`
+	// Illustrations lists the spine documents MergeOptions.Illustrations
+	// gathers, relative to the volume's package.
+	Illustrations []string `json:"illustrations,omitempty"`
+}
+
+// PlanResource is a resource the merge stores once or keeps apart. Href is
+// the copy's path in the merged book; Target is the copy it is replaced by.
+type PlanResource struct {
+	Href   string `json:"href"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+}
+
+func (p *MergePlan) resource(href, action, target string) {
+	if p == nil {
+		return
+	}
+	p.Resources = append(p.Resources, PlanResource{Href: href, Action: action, Target: target})
+}
+
+// PlanMerge runs a merge without writing opts.OutPath and reports the
+// resolved volumes, the table of contents, what happens to shared
+// resources and the projected output size. A size budget is enforced as
+// in a real merge.
+func PlanMerge(ctx context.Context, sources []string, opts MergeOptions) (MergePlan, error) {
+	plan := MergePlan{OutPath: opts.OutPath, Volumes: []PlanVolume{}, Resources: []PlanResource{}, BrokenLinks: []BrokenLink{}}
+	tmpDir, err := os.MkdirTemp("", "novfmt-plan-*")
+	if err != nil {
+		return plan, err
+	}
+	defer os.RemoveAll(tmpDir)
+	opts.OutPath = filepath.Join(tmpDir, "merged.epub")
+	if err := mergeEPUBs(ctx, sources, opts, &plan); err != nil {
+		return plan, err
+	}
+	info, err := os.Stat(opts.OutPath)
+	if err != nil {
+		return plan, err
+	}
+	plan.Size = info.Size()
+	return plan, nil
+}
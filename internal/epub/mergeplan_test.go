@@ -0,0 +1,50 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanMerge(t *testing.T) {
+	vols := []string{buildImageVolume(t, "AAA"), buildImageVolume(t, "AAA"), buildImageVolume(t, "BBB")}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+
+	plan, err := PlanMerge(context.Background(), vols, MergeOptions{OutPath: out, ShareResources: true})
+	if err != nil {
+		t.Fatalf("PlanMerge: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("plan wrote the output: %v", err)
+	}
+	if plan.OutPath != out || plan.Title != "Share" || plan.Language != "ja" || plan.Size == 0 {
+		t.Fatalf("plan = %+v", plan)
+	}
+	if len(plan.Volumes) != 3 || plan.Volumes[2].SourcePath != vols[2] || plan.Volumes[0].Chapters != 1 {
+		t.Fatalf("volumes = %+v", plan.Volumes)
+	}
+	if len(plan.TOC) != 3 || plan.TOC[1].Href != "Volumes/v0002/Text/ch1.xhtml" {
+		t.Fatalf("toc = %+v", plan.TOC)
+	}
+	want := []PlanResource{
+		{Href: "Volumes/v0002/Images/logo.png", Action: ResourceShared, Target: "Volumes/v0001/Images/logo.png"},
+		{Href: "Volumes/v0003/Images/logo.png", Action: ResourceRenamed},
+	}
+	if !reflect.DeepEqual(plan.Resources, want) {
+		t.Fatalf("resources = %+v", plan.Resources)
+	}
+
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, ShareResources: true}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the random identifier and timestamp differ between the runs.
+	if diff := info.Size() - plan.Size; diff < -64 || diff > 64 {
+		t.Fatalf("projected size %d, real size %d", plan.Size, info.Size())
+	}
+}
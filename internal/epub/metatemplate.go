@@ -0,0 +1,119 @@
+package epub
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// metaPlaceholderRE matches a placeholder in a metadata template.
+var metaPlaceholderRE = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// MetadataTemplate is a MetadataPatch in JSON whose strings may hold
+// placeholders filled in for each book: {file}, the book's file name
+// without extension; {dir}, the name of its folder; and the named groups
+// of a pattern matched against {file}, such as {series} and {vol} for
+// `(?P<series>.+) v(?P<vol>\d+)`.
+type MetadataTemplate struct {
+	doc     any
+	pattern *regexp.Regexp
+}
+
+// ParseMetadataTemplate reads a template. pattern may be empty when the
+// template uses only {file} and {dir}.
+func ParseMetadataTemplate(data []byte, pattern string) (*MetadataTemplate, error) {
+	t := &MetadataTemplate{}
+	if err := json.Unmarshal(data, &t.doc); err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	// The template must be a patch once filled in.
+	var patch MetadataPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	known := map[string]bool{"file": true, "dir": true}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				known[name] = true
+			}
+		}
+		t.pattern = re
+	}
+	var unknown []string
+	walkTemplateStrings(t.doc, func(s string) string {
+		for _, m := range metaPlaceholderRE.FindAllStringSubmatch(s, -1) {
+			if !known[m[1]] && !containsString(unknown, m[1]) {
+				unknown = append(unknown, m[1])
+			}
+		}
+		return s
+	})
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("template uses {%s}, which is neither {file}, {dir} nor a named group of the pattern", strings.Join(unknown, "}, {"))
+	}
+	return t, nil
+}
+
+// Patch fills in the template for the book at path. It reports false
+// when the file name does not match the pattern.
+func (t *MetadataTemplate) Patch(path string) (MetadataPatch, bool, error) {
+	name := filepath.Base(path)
+	vars := map[string]string{
+		"file": strings.TrimSuffix(name, filepath.Ext(name)),
+		"dir":  filepath.Base(filepath.Dir(path)),
+	}
+	if t.pattern != nil {
+		m := t.pattern.FindStringSubmatch(vars["file"])
+		if m == nil {
+			return MetadataPatch{}, false, nil
+		}
+		for i, group := range t.pattern.SubexpNames() {
+			if group != "" {
+				vars[group] = strings.TrimSpace(m[i])
+			}
+		}
+	}
+	filled := walkTemplateStrings(t.doc, func(s string) string {
+		return metaPlaceholderRE.ReplaceAllStringFunc(s, func(p string) string {
+			return vars[p[1:len(p)-1]]
+		})
+	})
+	data, err := json.Marshal(filled)
+	if err != nil {
+		return MetadataPatch{}, false, err
+	}
+	var patch MetadataPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return MetadataPatch{}, false, fmt.Errorf("%s: %w", name, err)
+	}
+	return patch, true, nil
+}
+
+// walkTemplateStrings returns a copy of a decoded JSON value with every
+// string, but not object keys, passed through fn.
+func walkTemplateStrings(v any, fn func(string) string) any {
+	switch v := v.(type) {
+	case string:
+		return fn(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = walkTemplateStrings(e, fn)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = walkTemplateStrings(e, fn)
+		}
+		return out
+	}
+	return v
+}
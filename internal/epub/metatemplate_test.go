@@ -0,0 +1,61 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataTemplate(t *testing.T) {
+	tmpl, err := ParseMetadataTemplate([]byte(`{
+		"title": "{series} {vol}",
+		"series": "{series}",
+		"series_index": "{vol}",
+		"creators": ["Jane Doe"],
+		"description": "From {dir}/{file}"
+	}`), `^(?P<series>.+?) v(?P<vol>\d+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch, ok, err := tmpl.Patch(filepath.Join("library", "Saga", "Saga v03.epub"))
+	if err != nil || !ok {
+		t.Fatalf("Patch = %v, %v", ok, err)
+	}
+	if *patch.Title != "Saga 03" || *patch.Series != "Saga" || *patch.SeriesIndex != "03" {
+		t.Fatalf("patch = %+v", patch)
+	}
+	if *patch.Description != "From Saga/Saga v03" || (*patch.Creators)[0] != "Jane Doe" {
+		t.Fatalf("patch = %+v", patch)
+	}
+
+	if _, ok, err := tmpl.Patch("Afterword.epub"); ok || err != nil {
+		t.Fatalf("non-matching name: ok = %v, err = %v", ok, err)
+	}
+
+	if _, err := ParseMetadataTemplate([]byte(`{"title": "{volume}"}`), `(?P<vol>\d+)`); err == nil {
+		t.Fatal("expected an unknown placeholder to be rejected")
+	}
+	if _, err := ParseMetadataTemplate([]byte(`{"title": 3}`), ""); err == nil {
+		t.Fatal("expected a template that is not a patch to be rejected")
+	}
+}
+
+func TestEditSeriesPatch(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "Saga 3", "en")
+	series, index := "Saga", "3"
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Series: &series, SeriesIndex: &index}}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	got := calibreFromPackage(vol.PackageDoc.Metadata)
+	if got.Series != "Saga" || got.SeriesIndex != "3" {
+		t.Fatalf("series = %q #%q", got.Series, got.SeriesIndex)
+	}
+}
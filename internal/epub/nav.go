@@ -11,9 +11,9 @@ import (
 )
 
 type NavItem struct {
-	Title    string
-	Href     string
-	Children []NavItem
+	Title    string    `json:"title"`
+	Href     string    `json:"href"`
+	Children []NavItem `json:"children,omitempty"`
 }
 
 type navItemState struct {
@@ -141,6 +141,11 @@ func parseNavDocument(data []byte) ([]NavItem, error) {
 }
 
 func hasTOCTypeAttr(attrs []xml.Attr) bool {
+	return hasNavType(attrs, "toc")
+}
+
+// hasNavType reports whether the epub:type of a nav element lists want.
+func hasNavType(attrs []xml.Attr, want string) bool {
 	const navNS = "http://www.idpf.org/2007/ops"
 	for _, attr := range attrs {
 		if attr.Name.Local != "type" {
@@ -150,7 +155,7 @@ func hasTOCTypeAttr(attrs []xml.Attr) bool {
 			continue
 		}
 		for _, token := range strings.Fields(attr.Value) {
-			if token == "toc" {
+			if token == want {
 				return true
 			}
 		}
@@ -0,0 +1,96 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// VolumeNav is the navigation of one merge input, with hrefs already
+// rewritten to point into the merged book.
+type VolumeNav struct {
+	// Index is the volume's position among the inputs, or -1 for the
+	// illustrations section MergeOptions.Illustrations adds, whose Items
+	// point at each volume's illustrations.
+	Index      int
+	SourcePath string
+	// Title is the volume's display title (its dc:title, or the file name).
+	Title string
+	// Href is the volume's first spine document.
+	Href  string
+	Items []NavItem
+}
+
+// NavBuilder builds the navigation document (nav.xhtml) of a merged book
+// from the per-volume TOC trees. Set MergeOptions.NavBuilder to replace the
+// default strategy, which nests each volume's TOC under an entry named
+// after the volume.
+type NavBuilder interface {
+	BuildNav(vols []VolumeNav) ([]byte, error)
+}
+
+// NavBuilderFunc adapts a function to the NavBuilder interface.
+type NavBuilderFunc func(vols []VolumeNav) ([]byte, error)
+
+func (f NavBuilderFunc) BuildNav(vols []VolumeNav) ([]byte, error) { return f(vols) }
+
+// DefaultNavBuilder is the NavBuilder merge uses when none is set.
+type DefaultNavBuilder struct{}
+
+func (DefaultNavBuilder) BuildNav(vols []VolumeNav) ([]byte, error) {
+	var items []NavItem
+	for _, vol := range vols {
+		if len(vol.Items) == 0 && vol.Href == "" {
+			continue
+		}
+		entry := NavItem{Title: vol.Title, Href: vol.Href, Children: vol.Items}
+		if entry.Href == "" {
+			entry.Href = vol.Items[0].Href
+		}
+		items = append(items, entry)
+	}
+	return RenderNavDocument(items), nil
+}
+
+// RenderNavDocument returns an EPUB 3 navigation document whose toc nav
+// lists items, for NavBuilders that only need to reshape the tree.
+func RenderNavDocument(items []NavItem) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` + "\n")
+	buf.WriteString("<head><title>Table of Contents</title></head>\n<body>\n")
+	writeTOCNav(&buf, items)
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// writeNav writes the navigation document of the merged volumes, with the
+// extra entries after them.
+func writeNav(vols []*Volume, extra []VolumeNav, builder NavBuilder, dest string) error {
+	if builder == nil {
+		builder = DefaultNavBuilder{}
+	}
+	navs := make([]VolumeNav, 0, len(vols)+len(extra))
+	for _, vol := range vols {
+		navs = append(navs, VolumeNav{
+			Index:      vol.Index,
+			SourcePath: vol.SourcePath,
+			Title:      vol.DisplayName,
+			Href:       vol.FirstHref,
+			Items:      mergedNavItems(vol),
+		})
+	}
+	navs = append(navs, extra...)
+	data, err := builder.BuildNav(navs)
+	if err != nil {
+		return fmt.Errorf("build nav: %w", err)
+	}
+	if _, err := parseNavDocument(data); err != nil {
+		return fmt.Errorf("nav builder returned an invalid document: %w", err)
+	}
+	return os.WriteFile(dest, data, 0o644)
+}
+
+func writeNavDocument(items []NavItem, dest string) error {
+	return os.WriteFile(dest, RenderNavDocument(items), 0o644)
+}
@@ -0,0 +1,50 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeWithCustomNavBuilder(t *testing.T) {
+	vols := []string{buildTestEPUB(t, "Vol One", "ja"), buildTestEPUB(t, "Vol Two", "ja")}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+
+	var seen []VolumeNav
+	flat := NavBuilderFunc(func(navs []VolumeNav) ([]byte, error) {
+		seen = navs
+		var items []NavItem
+		for _, v := range navs {
+			for _, it := range v.Items {
+				items = append(items, NavItem{Title: v.Title + ": " + it.Title, Href: it.Href})
+			}
+		}
+		return RenderNavDocument(items), nil
+	})
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, NavBuilder: flat}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	if len(seen) != 2 || seen[1].Title != "Vol Two" || seen[1].Items[0].Href != "Volumes/v0002/chapter.xhtml" {
+		t.Fatalf("builder got %+v", seen)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	items, err := parseNavFile(filepath.Join(vol.PackageDir, "nav.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Title != "Vol One: Chapter" || len(items[0].Children) != 0 {
+		t.Fatalf("unexpected nav %+v", items)
+	}
+
+	failing := NavBuilderFunc(func([]VolumeNav) ([]byte, error) { return nil, errors.New("boom") })
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, NavBuilder: failing}); err == nil {
+		t.Fatalf("expected builder error to fail the merge")
+	}
+}
@@ -0,0 +1,101 @@
+package epub
+
+//go:generate go run ./internal/gen -o nfc_tables.go
+
+// Hangul syllables compose and decompose arithmetically.
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// normalizeNFC returns s in Unicode Normalization Form C, with one
+// deliberate exception: CJK compatibility ideographs (U+F900–U+FAFF,
+// U+2F800–U+2FA1F) are kept. NFC would replace them with the unified
+// ideograph, which Japanese fonts draw differently, and books use them on
+// purpose for names.
+func normalizeNFC(s string) string {
+	if isNFCQuick(s) {
+		return s
+	}
+	// Decompose.
+	d := make([]rune, 0, len(s))
+	for _, c := range s {
+		switch {
+		case c >= hangulSBase && c < hangulSBase+hangulSCount:
+			i := c - hangulSBase
+			d = append(d, hangulLBase+i/hangulNCount, hangulVBase+(i%hangulNCount)/hangulTCount)
+			if t := i % hangulTCount; t != 0 {
+				d = append(d, hangulTBase+t)
+			}
+		case nfcDecomposition[c] != "":
+			d = append(d, []rune(nfcDecomposition[c])...)
+		default:
+			d = append(d, c)
+		}
+	}
+	// Put each run of combining marks in canonical order. The sort must be
+	// stable, so marks of the same class keep their order.
+	for i := 1; i < len(d); i++ {
+		cc := nfcCombiningClass[d[i]]
+		if cc == 0 {
+			continue
+		}
+		for j := i; j > 0; j-- {
+			prev := nfcCombiningClass[d[j-1]]
+			if prev <= cc {
+				break
+			}
+			d[j], d[j-1] = d[j-1], d[j]
+		}
+	}
+	// Compose each mark with the last starter unless a mark of the same or
+	// a higher class, or another starter, stands between them.
+	out := d[:0]
+	starter := -1
+	var lastCC uint8
+	for _, c := range d {
+		cc := nfcCombiningClass[c]
+		if starter >= 0 && (len(out)-1 == starter || lastCC != 0 && lastCC < cc) {
+			if p, ok := composePair(out[starter], c); ok {
+				out[starter] = p
+				continue
+			}
+		}
+		if cc == 0 {
+			starter = len(out)
+		}
+		lastCC = cc
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// isNFCQuick reports whether s is certainly normalized: text below U+0300
+// has no combining marks to compose or reorder.
+func isNFCQuick(s string) bool {
+	for _, c := range s {
+		if c >= 0x300 {
+			return false
+		}
+	}
+	return true
+}
+
+func composePair(a, b rune) (rune, bool) {
+	switch {
+	case a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount:
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	case a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount:
+		return a + (b - hangulTBase), true
+	}
+	p, ok := nfcComposition[[2]rune{a, b}]
+	return p, ok
+}
@@ -0,0 +1,71 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// What MergeOptions.NonLinear does with spine items marked linear="no",
+// which readers skip when paging through the book.
+const (
+	// NonLinearKeep keeps them as the volume has them.
+	NonLinearKeep = "keep"
+	// NonLinearLinear makes them part of the reading order.
+	NonLinearLinear = "linear"
+	// NonLinearDrop leaves them out of the book.
+	NonLinearDrop = "drop"
+)
+
+// ParseNonLinearPolicy checks a MergeOptions.NonLinear value.
+func ParseNonLinearPolicy(s string) (string, error) {
+	switch s {
+	case "", NonLinearKeep:
+		return NonLinearKeep, nil
+	case NonLinearLinear, NonLinearDrop:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown non-linear policy %q (want keep, linear or drop)", s)
+}
+
+// isNonLinear reports whether a spine item is marked linear="no".
+func isNonLinear(ref SpineItemRef) bool {
+	return strings.EqualFold(strings.TrimSpace(ref.Linear), "no")
+}
+
+// applyNonLinearPolicy applies a non-linear policy to vol's spine and
+// returns how many of its items were non-linear. A volume with nothing but
+// non-linear items keeps its first.
+func applyNonLinearPolicy(vol *Volume, policy string, log *slog.Logger) (int, error) {
+	refs := vol.PackageDoc.Spine.Itemrefs
+	var nonLinear []int
+	for i, ref := range refs {
+		if isNonLinear(ref) {
+			nonLinear = append(nonLinear, i)
+		}
+	}
+	if len(nonLinear) == 0 {
+		return 0, nil
+	}
+	count := len(nonLinear)
+	log.Info("non-linear spine items", "volume", vol.SourcePath, "count", count, "policy", policy)
+	switch policy {
+	case NonLinearLinear:
+		for _, i := range nonLinear {
+			refs[i].Linear = ""
+		}
+	case NonLinearDrop:
+		if len(nonLinear) == len(refs) {
+			log.Warn("every spine item of the volume is non-linear; keeping the first", "volume", vol.SourcePath)
+			nonLinear = nonLinear[1:]
+		}
+		var edits []SpineEdit
+		for _, i := range nonLinear {
+			edits = append(edits, SpineEdit{Op: SpineDrop, IDRef: refs[i].IDRef})
+		}
+		if _, err := applySpineEdits(vol, edits, nil); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
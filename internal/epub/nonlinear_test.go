@@ -0,0 +1,82 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildNonLinearVolume(t *testing.T) string {
+	t.Helper()
+	page := `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>p</title></head><body><p>text</p></body></html>`
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:nonlinear</dc:identifier>
+    <dc:title>Volume</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ad" href="ad.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ad" linear="no"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": page,
+		"OEBPS/ad.xhtml":  page,
+		"OEBPS/ch2.xhtml": page,
+	})
+}
+
+func TestMergeNonLinear(t *testing.T) {
+	vols := []string{buildNonLinearVolume(t), buildNonLinearVolume(t)}
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{"", "1_ch1 1_ad:no 1_ch2 2_ch1 2_ad:no 2_ch2"},
+		{NonLinearLinear, "1_ch1 1_ad 1_ch2 2_ch1 2_ad 2_ch2"},
+		{NonLinearDrop, "1_ch1 1_ch2 2_ch1 2_ch2"},
+	} {
+		out := filepath.Join(t.TempDir(), "book.epub")
+		plan, err := PlanMerge(context.Background(), vols, MergeOptions{OutPath: out, NonLinear: tc.policy})
+		if err != nil {
+			t.Fatalf("%s: PlanMerge: %v", tc.policy, err)
+		}
+		if plan.Volumes[0].NonLinear != 1 || plan.Volumes[1].NonLinear != 1 {
+			t.Errorf("%s: plan volumes = %+v", tc.policy, plan.Volumes)
+		}
+		if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, NonLinear: tc.policy}); err != nil {
+			t.Fatalf("%s: MergeEPUBs: %v", tc.policy, err)
+		}
+		vol, err := loadVolume(context.Background(), 0, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spine []string
+		for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+			id := strings.TrimPrefix(ref.IDRef, "v000")
+			if ref.Linear != "" {
+				id += ":" + ref.Linear
+			}
+			spine = append(spine, id)
+		}
+		os.RemoveAll(vol.TempDir)
+		if got := strings.Join(spine, " "); got != tc.want {
+			t.Errorf("%s: spine = %s, want %s", tc.policy, got, tc.want)
+		}
+	}
+
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: filepath.Join(t.TempDir(), "x.epub"), NonLinear: "skip"}); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
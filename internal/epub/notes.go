@@ -0,0 +1,781 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// epubNamespace is the namespace of epub:type.
+const epubNamespace = "http://www.idpf.org/2007/ops"
+
+type NotesOptions struct {
+	// Endnotes moves every note into one endnotes chapter at the end of
+	// the spine, instead of marking notes up as pop-up footnotes where
+	// they are.
+	Endnotes bool
+	// Title is the endnotes chapter's heading (default "Notes").
+	Title string
+	// TranslatorNotes also turns paragraphs that start with a translator's
+	// note marker (TL note:, T/N:, Translator's note:) into notes,
+	// referenced from the end of the paragraph before them.
+	TranslatorNotes bool
+	OutPath         string
+	DryRun          bool
+	Logger          *slog.Logger
+	Progress        ProgressFunc
+}
+
+// NoteFix is one note RestructureNotes marked up or moved.
+type NoteFix struct {
+	// Refs are the references to the note, as href#id.
+	Refs []string `json:"refs"`
+	// Note is where the note is afterwards, as href#id.
+	Note string `json:"note"`
+	Text string `json:"text"`
+	// Translator reports a translator's note paragraph that had no
+	// reference before.
+	Translator bool `json:"translator,omitempty"`
+}
+
+type NotesResult struct {
+	Notes []NoteFix `json:"notes"`
+	// Broken lists the note references whose target does not exist, as
+	// href -> target.
+	Broken    []string  `json:"broken,omitempty"`
+	Changeset Changeset `json:"changeset"`
+}
+
+// noteMarkerPattern matches link text that marks a note reference even
+// outside <sup>: [1], (2), asterisks, daggers and 注/※ markers.
+var noteMarkerPattern = regexp.MustCompile(`^(?:\[\d+\]|\(\d+\)|\*+|[†‡]+|[注※]\d*)$`)
+
+// noteClassPattern matches classes that mark note references.
+var noteClassPattern = regexp.MustCompile(`(?i)(?:^|[-_ ])(?:note|notes|fn|footnote|noteref|endnote)(?:$|[-_ \d])`)
+
+// translatorNotePattern matches the start of a translator's note
+// paragraph.
+var translatorNotePattern = regexp.MustCompile(`(?i)^[(\[]?\s*(?:T/?L\s*notes?|T/N|TN|Translator'?s?\s+notes?)\s*[:：]`)
+
+// noteBlocks are the elements that can hold a note.
+var noteBlocks = map[string]bool{"p": true, "div": true, "li": true, "aside": true}
+
+// RestructureNotes finds footnotes and endnotes, however the source marked
+// them up, and makes them consistent: references become epub:type noteref
+// links, and notes become pop-up footnotes (<aside epub:type="footnote">,
+// or endnote list items) or, with Endnotes, items of one endnotes chapter.
+// A reference is a short link (a number in <sup>, [1], *, a link with a
+// note class, or one already typed noteref) to a paragraph, list item,
+// div or aside; links back from the note to the reference are pointed at
+// the reference.
+func RestructureNotes(ctx context.Context, input string, opts NotesOptions) (NotesResult, error) {
+	res := NotesResult{Notes: []NoteFix{}}
+	if input == "" {
+		return res, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.Title == "" {
+		opts.Title = "Notes"
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	byID := manifestByID(pkg)
+	var docs []*noteDoc
+	byHref := map[string]*noteDoc{}
+	for i, ref := range pkg.Spine.Itemrefs {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Spine.Itemrefs), "")
+		item, ok := byID[ref.IDRef]
+		if !ok || item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		if byHref[href] != nil {
+			continue
+		}
+		d, err := loadNoteDoc(href, filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href)))
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		d.order = len(docs)
+		docs = append(docs, d)
+		byHref[href] = d
+	}
+
+	notes, broken := findNotes(docs, byHref)
+	res.Broken = broken
+	for _, b := range broken {
+		log.Warn("broken note reference", "ref", b)
+	}
+	if opts.TranslatorNotes {
+		notes = append(notes, findTranslatorNotes(docs, notes)...)
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		a, b := notes[i].refs[0], notes[j].refs[0]
+		if a.doc != b.doc {
+			return a.doc.order < b.doc.order
+		}
+		return a.tok < b.tok
+	})
+
+	// Notes already in an endnotes list stay there, so a second run
+	// changes nothing.
+	var moving []*note
+	for _, n := range notes {
+		if opts.Endnotes && !n.isEndnote() {
+			moving = append(moving, n)
+		} else {
+			n.markPopup()
+		}
+	}
+	if len(moving) > 0 {
+		dir := path.Dir(docs[len(docs)-1].href)
+		notesHref := uniqueHref(pkg, path.Join(dir, "notes.xhtml"))
+		page := moveToEndnotes(moving, notesHref, opts.Title, firstDCValue(pkg.Metadata.Languages))
+		if err := writePackageFile(vol, notesHref, page); err != nil {
+			return res, err
+		}
+		res.Changeset.added(notesHref)
+		id := uniqueManifestID(pkg, "notes")
+		pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: id, Href: notesHref, MediaType: "application/xhtml+xml"})
+		pkg.Spine.Itemrefs = append(pkg.Spine.Itemrefs, SpineItemRef{IDRef: id})
+		res.Changeset.modified(packageHref(vol))
+		log.Info("added endnotes", "href", notesHref, "notes", len(moving))
+	}
+
+	for _, n := range notes {
+		fix := NoteFix{Note: n.href + "#" + n.id, Text: excerpt(n.text, 60), Translator: n.translator}
+		for _, r := range n.refs {
+			fix.Refs = append(fix.Refs, r.doc.href+"#"+r.id)
+		}
+		res.Notes = append(res.Notes, fix)
+	}
+	for _, d := range docs {
+		out, changed := d.render()
+		if !changed {
+			continue
+		}
+		res.Changeset.modified(d.href)
+		if !opts.DryRun {
+			if err := os.WriteFile(d.path, out, 0o644); err != nil {
+				return res, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Spine.Itemrefs), len(pkg.Spine.Itemrefs), "")
+
+	err = res.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log)
+	return res, err
+}
+
+// noteDoc is a spine document held as tokens, with the edits to make.
+type noteDoc struct {
+	href, path string
+	order      int
+	toks       []rawToken
+	// end maps a start tag to its end tag, start an end tag to its start
+	// tag, and parent any token to the start tag of its element.
+	end, start, parent []int
+	ids                map[string]int
+	root, body         int
+
+	// Edits: replaced tags, markup written before or after a token, and
+	// dropped tokens.
+	tags          map[int][]byte
+	before, after map[int]string
+	drop          map[int]bool
+	// epubType records that an epub:type attribute was added.
+	epubType bool
+}
+
+func loadNoteDoc(href, path string) (*noteDoc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &noteDoc{
+		href: href, path: path, ids: map[string]int{}, root: -1, body: -1,
+		tags: map[int][]byte{}, before: map[int]string{}, after: map[int]string{}, drop: map[int]bool{},
+	}
+	sp := newXMLSplicer(bytes.NewReader(data), io.Discard)
+	var stack []int
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		i := len(d.toks)
+		parent := -1
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		d.toks = append(d.toks, rt)
+		d.end, d.start, d.parent = append(d.end, -1), append(d.start, -1), append(d.parent, parent)
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			if id := attrValue(t.Attr, "id"); id != "" {
+				if _, dup := d.ids[id]; !dup {
+					d.ids[id] = i
+				}
+			}
+			switch strings.ToLower(t.Name.Local) {
+			case "html":
+				if d.root < 0 {
+					d.root = i
+				}
+			case "body":
+				if d.body < 0 {
+					d.body = i
+				}
+			}
+			stack = append(stack, i)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				s := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				d.end[s], d.start[i] = i, s
+				d.parent[i] = d.parent[s]
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *noteDoc) el(i int) (xml.StartElement, bool) {
+	if i < 0 || i >= len(d.toks) {
+		return xml.StartElement{}, false
+	}
+	el, ok := d.toks[i].tok.(xml.StartElement)
+	return el, ok
+}
+
+func (d *noteDoc) name(i int) string {
+	el, _ := d.el(i)
+	return strings.ToLower(el.Name.Local)
+}
+
+// text returns the text inside the element starting at i.
+func (d *noteDoc) text(i int) string {
+	var b strings.Builder
+	for j := i + 1; j < d.end[i]; j++ {
+		if t, ok := d.toks[j].tok.(xml.CharData); ok {
+			b.Write(t)
+		}
+	}
+	return normalizeSpace(b.String())
+}
+
+// contains reports whether token j is inside the element starting at i.
+func (d *noteDoc) contains(i, j int) bool {
+	return i >= 0 && j >= i && j <= d.end[i]
+}
+
+// block returns the note block holding the element at i, or -1.
+func (d *noteDoc) block(i int) int {
+	for j := i; j >= 0 && j != d.body; j = d.parent[j] {
+		if noteBlocks[d.name(j)] {
+			return j
+		}
+	}
+	return -1
+}
+
+// tag returns the current source of the tag at i.
+func (d *noteDoc) tag(i int) []byte {
+	if t, ok := d.tags[i]; ok {
+		return t
+	}
+	return d.toks[i].raw
+}
+
+func (d *noteDoc) setAttr(i int, name, value string) {
+	el, _ := d.el(i)
+	d.tags[i] = setAttr(d.tag(i), el, name, value)
+}
+
+func (d *noteDoc) removeAttr(i int, name string) {
+	d.tags[i] = withoutAttr(d.tag(i), name)
+}
+
+// setEPUBType adds the epub:type value to the element at i.
+func (d *noteDoc) setEPUBType(i int, value string) {
+	el, _ := d.el(i)
+	if containsString(strings.Fields(epubTypeOf(el)), value) {
+		return
+	}
+	d.setAttr(i, "epub:type", value)
+	d.epubType = true
+}
+
+// uniqueID returns base, or base with a number, that no element of the
+// document has as its id.
+func (d *noteDoc) uniqueID(base string) string {
+	id := base
+	for n := 2; ; n++ {
+		if _, ok := d.ids[id]; !ok {
+			d.ids[id] = -1
+			return id
+		}
+		id = base + "-" + strconv.Itoa(n)
+	}
+}
+
+// render returns the document with its edits, and whether it changed.
+func (d *noteDoc) render() ([]byte, bool) {
+	if d.epubType && d.root >= 0 {
+		el, _ := d.el(d.root)
+		if !hasNamespaceDecl(el, "epub") {
+			d.tags[d.root] = withAttr(d.tag(d.root), "xmlns:epub", epubNamespace)
+		}
+	}
+	changed := len(d.before) > 0 || len(d.after) > 0 || len(d.drop) > 0
+	var b bytes.Buffer
+	for i, rt := range d.toks {
+		b.WriteString(d.before[i])
+		if !d.drop[i] {
+			if t, ok := d.tags[i]; ok {
+				changed = changed || !bytes.Equal(t, rt.raw)
+				b.Write(t)
+			} else {
+				b.Write(rt.raw)
+			}
+		}
+		b.WriteString(d.after[i])
+	}
+	return b.Bytes(), changed
+}
+
+func epubTypeOf(el xml.StartElement) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == "type" && a.Name.Space != "" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func hasNamespaceDecl(el xml.StartElement, prefix string) bool {
+	for _, a := range el.Attr {
+		if a.Name.Space == "xmlns" && a.Name.Local == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// note is a note and the references to it.
+type note struct {
+	doc *noteDoc
+	// body is the note's block; target the element the references point
+	// at, body or an element inside it, whose id is targetID.
+	body, target int
+	targetID     string
+	refs         []noteRef
+	// backlinks are links inside the note to a reference.
+	backlinks  []int
+	translator bool
+	text       string
+	// href and id locate the note once it is marked up or moved.
+	href, id string
+}
+
+type noteRef struct {
+	doc *noteDoc
+	tok int
+	id  string
+	// written marks a new reference, written before token tok.
+	written bool
+}
+
+// findNotes resolves the note references of the documents in reading
+// order. A link inside a note already found is not a reference; notes
+// follow their references in the usual layouts.
+func findNotes(docs []*noteDoc, byHref map[string]*noteDoc) ([]*note, []string) {
+	var (
+		notes  []*note
+		broken []string
+	)
+	claimed := map[*noteDoc]map[int]*note{}
+	inNote := func(d *noteDoc, i int) *note {
+		for body, n := range claimed[d] {
+			if d.contains(body, i) {
+				return n
+			}
+		}
+		return nil
+	}
+	for _, d := range docs {
+		for i := range d.toks {
+			el, ok := d.el(i)
+			if !ok || strings.ToLower(el.Name.Local) != "a" || !d.looksLikeNoteRef(i) {
+				continue
+			}
+			file, frag, _ := strings.Cut(attrValue(el.Attr, "href"), "#")
+			if frag == "" || strings.Contains(file, ":") {
+				continue
+			}
+			if inNote(d, i) != nil {
+				continue
+			}
+			target := d
+			if file != "" {
+				target = byHref[normalizeEPUBPath(path.Join(path.Dir(d.href), file))]
+			}
+			ti, ok := -1, false
+			if target != nil {
+				ti, ok = target.ids[frag]
+			}
+			if !ok || ti < 0 {
+				broken = append(broken, d.href+" -> "+attrValue(el.Attr, "href"))
+				continue
+			}
+			body := target.block(ti)
+			if body < 0 || target == d && target.contains(body, i) {
+				continue
+			}
+			n := claimed[target][body]
+			if n == nil {
+				if inNote(target, body) != nil {
+					continue
+				}
+				n = &note{doc: target, body: body, target: ti, targetID: frag, text: target.text(body)}
+				if claimed[target] == nil {
+					claimed[target] = map[int]*note{}
+				}
+				claimed[target][body] = n
+				notes = append(notes, n)
+			}
+			n.refs = append(n.refs, noteRef{doc: d, tok: i, id: d.refID(i)})
+		}
+	}
+	for _, n := range notes {
+		n.findBacklinks()
+	}
+	return notes, broken
+}
+
+// findBacklinks collects the links inside the note that point at one of
+// its references.
+func (n *note) findBacklinks() {
+	d := n.doc
+	for i := n.body + 1; i < d.end[n.body]; i++ {
+		el, ok := d.el(i)
+		if !ok || strings.ToLower(el.Name.Local) != "a" {
+			continue
+		}
+		file, frag, _ := strings.Cut(attrValue(el.Attr, "href"), "#")
+		if frag == "" || strings.Contains(file, ":") {
+			continue
+		}
+		target := d.href
+		if file != "" {
+			target = normalizeEPUBPath(path.Join(path.Dir(d.href), file))
+		}
+		for _, r := range n.refs {
+			if r.doc.href == target && r.id == frag {
+				n.backlinks = append(n.backlinks, i)
+				break
+			}
+		}
+	}
+}
+
+// looksLikeNoteRef reports whether the link at i reads as a note
+// reference: typed noteref, or short text that is superscript, has a note
+// class or is a note marker.
+func (d *noteDoc) looksLikeNoteRef(i int) bool {
+	el, _ := d.el(i)
+	if containsString(strings.Fields(epubTypeOf(el)), "noteref") {
+		return true
+	}
+	text := d.text(i)
+	if n := utf8.RuneCountInString(text); n == 0 || n > 8 {
+		return false
+	}
+	if d.name(d.parent[i]) == "sup" || noteClassPattern.MatchString(attrValue(el.Attr, "class")) || noteMarkerPattern.MatchString(text) {
+		return true
+	}
+	for j := i + 1; j < d.end[i]; j++ {
+		if d.name(j) == "sup" {
+			return true
+		}
+	}
+	return false
+}
+
+// refID returns the id of the link at i, giving it one if it has none.
+func (d *noteDoc) refID(i int) string {
+	el, _ := d.el(i)
+	if id := attrValue(el.Attr, "id"); id != "" {
+		return id
+	}
+	id := d.uniqueID("noteref")
+	d.setAttr(i, "id", id)
+	return id
+}
+
+// findTranslatorNotes turns translator's note paragraphs outside the notes
+// already found into notes, each referenced from the end of the paragraph
+// before it.
+func findTranslatorNotes(docs []*noteDoc, known []*note) []*note {
+	var notes []*note
+	for _, d := range docs {
+		for i := range d.toks {
+			if d.name(i) != "p" || !translatorNotePattern.MatchString(d.text(i)) {
+				continue
+			}
+			inKnown := false
+			for _, n := range known {
+				if n.doc == d && d.contains(n.body, i) {
+					inKnown = true
+					break
+				}
+			}
+			anchor := d.previousStory(i)
+			if inKnown || anchor < 0 {
+				continue
+			}
+			el, _ := d.el(i)
+			id := attrValue(el.Attr, "id")
+			if id == "" {
+				id = d.uniqueID("tn")
+			}
+			notes = append(notes, &note{
+				doc: d, body: i, target: i, targetID: id, text: d.text(i), translator: true,
+				refs: []noteRef{{doc: d, tok: d.end[anchor], id: d.uniqueID("tnref"), written: true}},
+			})
+		}
+	}
+	return notes
+}
+
+// previousStory returns the paragraph before the one at i, skipping other
+// translator's notes, or -1.
+func (d *noteDoc) previousStory(i int) int {
+	for j := i - 1; j > d.parent[i]; j-- {
+		switch t := d.toks[j].tok.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return -1
+			}
+			continue
+		case xml.EndElement:
+			s := d.start[j]
+			if s < 0 || d.name(s) != "p" {
+				return -1
+			}
+			if translatorNotePattern.MatchString(d.text(s)) {
+				j = s
+				continue
+			}
+			return s
+		case xml.Comment, xml.ProcInst:
+			continue
+		}
+		return -1
+	}
+	return -1
+}
+
+// markPopup marks the note up as a pop-up note where it is: a list item
+// or aside gets the epub:type, and anything else is wrapped in an aside.
+// The id the references point at moves to the element with the type.
+func (n *note) markPopup() {
+	d := n.doc
+	targetID := n.targetID
+	n.href = d.href
+	switch name := d.name(n.body); name {
+	case "li", "aside":
+		bodyEl, _ := d.el(n.body)
+		n.id = attrValue(bodyEl.Attr, "id")
+		if n.id == "" {
+			n.id = targetID
+			if n.target != n.body {
+				d.removeAttr(n.target, "id")
+				d.setAttr(n.body, "id", n.id)
+			}
+		}
+		if name == "li" {
+			d.setEPUBType(n.body, "endnote")
+		} else {
+			d.setEPUBType(n.body, "footnote")
+		}
+	default:
+		if d.name(d.parent[n.body]) == "aside" {
+			if parent, _ := d.el(d.parent[n.body]); strings.Contains(epubTypeOf(parent), "footnote") && attrValue(parent.Attr, "id") != "" {
+				n.id = attrValue(parent.Attr, "id")
+				break
+			}
+		}
+		n.id = targetID
+		d.removeAttr(n.target, "id")
+		d.before[n.body] += `<aside epub:type="footnote" id="` + html.EscapeString(n.id) + `">`
+		d.after[d.end[n.body]] = "</aside>" + d.after[d.end[n.body]]
+		d.epubType = true
+	}
+	n.linkRefs()
+}
+
+// isEndnote reports whether the note is a list item typed endnote.
+func (n *note) isEndnote() bool {
+	el, _ := n.doc.el(n.body)
+	return n.doc.name(n.body) == "li" && containsString(strings.Fields(epubTypeOf(el)), "endnote")
+}
+
+// linkRefs points the references at the note, types them noteref, and
+// points the links back at the first reference.
+func (n *note) linkRefs() {
+	for _, r := range n.refs {
+		if r.written {
+			r.doc.before[r.tok] += `<sup><a id="` + html.EscapeString(r.id) + `" epub:type="noteref" href="` +
+				html.EscapeString(linkBetween(r.doc.href, n.href, n.id)) + `">TN</a></sup>`
+			r.doc.epubType = true
+			continue
+		}
+		r.doc.setEPUBType(r.tok, "noteref")
+		r.doc.setAttr(r.tok, "href", linkBetween(r.doc.href, n.href, n.id))
+	}
+	back := n.refs[0]
+	for _, b := range n.backlinks {
+		n.doc.setAttr(b, "href", linkBetween(n.href, back.doc.href, back.id))
+	}
+}
+
+// linkBetween returns the link from the document from to id in the
+// document to.
+func linkBetween(from, to, id string) string {
+	if from == to {
+		return "#" + id
+	}
+	return relativeHref(path.Dir(from), to) + "#" + id
+}
+
+// moveToEndnotes takes the notes out of their documents and returns the
+// endnotes chapter holding them, at href.
+func moveToEndnotes(notes []*note, href, title, lang string) []byte {
+	var items strings.Builder
+	for i, n := range notes {
+		n.href, n.id = href, "note-"+strconv.Itoa(i+1)
+		d := n.doc
+		back := n.refs[0]
+		backlinks := map[int]bool{}
+		for _, b := range n.backlinks {
+			backlinks[b] = true
+		}
+		items.WriteString(`<li id="` + n.id + `" epub:type="endnote">`)
+		// A list item's or container's content moves; a paragraph moves
+		// whole.
+		from, to := n.body, d.end[n.body]
+		if name := d.name(n.body); name != "p" {
+			from, to = from+1, to-1
+		}
+		skipUntil := -1
+		for j := from; j <= to; j++ {
+			if j <= skipUntil {
+				continue
+			}
+			if backlinks[j] {
+				skipUntil = d.end[j]
+				continue
+			}
+			items.Write(rebaseTag(d, j, path.Dir(href)))
+		}
+		items.WriteString(` <a href="` + html.EscapeString(linkBetween(href, back.doc.href, back.id)) + `">↩</a></li>` + "\n")
+		for j := n.body; j <= d.end[n.body]; j++ {
+			d.drop[j] = true
+		}
+		dropEmptyContainers(d, n.body)
+		n.linkRefs()
+	}
+
+	lang = html.EscapeString(strings.TrimSpace(lang))
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"`)
+	if lang != "" {
+		buf.WriteString(` xml:lang="` + lang + `" lang="` + lang + `"`)
+	}
+	buf.WriteString(">\n<head><title>" + html.EscapeString(title) + "</title></head>\n")
+	buf.WriteString(`<body epub:type="backmatter">` + "\n")
+	buf.WriteString(`<section epub:type="endnotes">` + "\n")
+	buf.WriteString("<h1>" + html.EscapeString(title) + "</h1>\n<ol>\n")
+	buf.WriteString(items.String())
+	buf.WriteString("</ol>\n</section>\n</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// rebaseTag returns the source of token j of d for a document in dir: ids
+// are dropped, since notes from several documents now share one, and
+// relative links and image sources are rewritten.
+func rebaseTag(d *noteDoc, j int, dir string) []byte {
+	el, ok := d.el(j)
+	if !ok {
+		return d.tag(j)
+	}
+	raw := d.tag(j)
+	for _, a := range el.Attr {
+		switch {
+		case a.Name.Local == "id" && a.Name.Space == "":
+			raw = withoutAttr(raw, "id")
+		case a.Name.Space == "" && (a.Name.Local == "href" || a.Name.Local == "src"):
+			file, frag, hasFrag := strings.Cut(a.Value, "#")
+			if strings.Contains(file, ":") || strings.HasPrefix(file, "/") {
+				continue
+			}
+			target := d.href
+			if file != "" {
+				target = normalizeEPUBPath(path.Join(path.Dir(d.href), file))
+			}
+			v := relativeHref(dir, target)
+			if hasFrag {
+				v += "#" + frag
+			}
+			raw = setAttr(raw, el, a.Name.Local, v)
+		}
+	}
+	return raw
+}
+
+// dropEmptyContainers drops the elements around a moved note that hold
+// nothing else, such as the list or div of a footnotes section.
+func dropEmptyContainers(d *noteDoc, i int) {
+	for p := d.parent[i]; p >= 0 && p != d.body; p = d.parent[p] {
+		for j := p + 1; j < d.end[p]; j++ {
+			if d.drop[j] {
+				continue
+			}
+			if t, ok := d.toks[j].tok.(xml.CharData); ok && len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+			return
+		}
+		for j := p; j <= d.end[p]; j++ {
+			d.drop[j] = true
+		}
+	}
+}
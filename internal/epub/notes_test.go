@@ -0,0 +1,130 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildNotesBook(t *testing.T) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier><dc:language>en</dc:language></metadata>
+  <manifest>
+    <item id="a" href="text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="text/b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/text/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+			`<p>She said<sup><a href="#fn1" id="r1">1</a></sup> it twice.</p>` +
+			`<p>He bowed.</p>` +
+			`<p>TL note: a formal bow.</p>` +
+			`<p>Gone.<a href="#nowhere">[2]</a></p>` +
+			`<div class="footnotes"><p id="fn1"><a href="#r1">1</a> An idiom.</p></div>` +
+			`</body></html>`,
+		"OEBPS/text/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+			`<p>Later<a class="noteref" href="a.xhtml#fn1">*</a>.</p>` +
+			`</body></html>`,
+	})
+}
+
+func readNotesFile(t *testing.T, input, name string) string {
+	t.Helper()
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestRestructureNotesPopup(t *testing.T) {
+	input := buildNotesBook(t)
+	res, err := RestructureNotes(context.Background(), input, NotesOptions{TranslatorNotes: true})
+	if err != nil {
+		t.Fatalf("RestructureNotes: %v", err)
+	}
+	if len(res.Notes) != 2 || len(res.Broken) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got := res.Notes[0].Refs; len(got) != 2 || got[0] != "text/a.xhtml#r1" || got[1] != "text/b.xhtml#noteref" {
+		t.Fatalf("refs = %v", got)
+	}
+	if !res.Notes[1].Translator || res.Notes[1].Text != "TL note: a formal bow." {
+		t.Fatalf("translator note = %+v", res.Notes[1])
+	}
+
+	a := readNotesFile(t, input, "text/a.xhtml")
+	for _, want := range []string{
+		`xmlns:epub="http://www.idpf.org/2007/ops"`,
+		`<a href="#fn1" id="r1" epub:type="noteref">1</a>`,
+		`<aside epub:type="footnote" id="fn1"><p><a href="#r1">1</a> An idiom.</p></aside>`,
+		`<p>He bowed.<sup><a id="tnref" epub:type="noteref" href="#tn">TN</a></sup></p>`,
+		`<aside epub:type="footnote" id="tn"><p>TL note: a formal bow.</p></aside>`,
+	} {
+		if !strings.Contains(a, want) {
+			t.Errorf("missing %s in %s", want, a)
+		}
+	}
+	b := readNotesFile(t, input, "text/b.xhtml")
+	if !strings.Contains(b, `epub:type="noteref"`) || !strings.Contains(b, `href="a.xhtml#fn1"`) {
+		t.Errorf("reference not linked to the note: %s", b)
+	}
+
+	again, err := RestructureNotes(context.Background(), input, NotesOptions{TranslatorNotes: true})
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if again.Changeset.Outcome == OutcomeWritten {
+		t.Fatalf("second run changed the book: %+v", again)
+	}
+}
+
+func TestRestructureNotesEndnotes(t *testing.T) {
+	input := buildNotesBook(t)
+	res, err := RestructureNotes(context.Background(), input, NotesOptions{Endnotes: true, TranslatorNotes: true})
+	if err != nil {
+		t.Fatalf("RestructureNotes: %v", err)
+	}
+	if len(res.Notes) != 2 || res.Notes[0].Note != "text/notes.xhtml#note-1" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	a := readNotesFile(t, input, "text/a.xhtml")
+	if strings.Contains(a, "An idiom") || strings.Contains(a, "footnotes") || strings.Contains(a, "TL note") {
+		t.Errorf("notes left behind: %s", a)
+	}
+	if !strings.Contains(a, `href="notes.xhtml#note-1"`) || !strings.Contains(a, `href="notes.xhtml#note-2"`) {
+		t.Errorf("references not pointed at the endnotes: %s", a)
+	}
+	notes := readNotesFile(t, input, "text/notes.xhtml")
+	for _, want := range []string{
+		`<section epub:type="endnotes">`,
+		`<li id="note-1" epub:type="endnote"><p> An idiom.</p> <a href="a.xhtml#r1">↩</a></li>`,
+		`<li id="note-2" epub:type="endnote"><p>TL note: a formal bow.</p> <a href="a.xhtml#tnref">↩</a></li>`,
+	} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("missing %s in %s", want, notes)
+		}
+	}
+	if opf := readNotesFile(t, input, "content.opf"); !strings.Contains(opf, `href="text/notes.xhtml"`) {
+		t.Errorf("endnotes not in the manifest: %s", opf)
+	}
+
+	again, err := RestructureNotes(context.Background(), input, NotesOptions{Endnotes: true, TranslatorNotes: true})
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if again.Changeset.Outcome == OutcomeWritten {
+		t.Fatalf("second run changed the book: %+v", again)
+	}
+}
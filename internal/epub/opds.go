@@ -0,0 +1,581 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// OPDS versions a catalog can be written in.
+const (
+	OPDS12 = "1.2"
+	OPDS20 = "2.0"
+)
+
+const (
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opds2Type           = "application/opds+json"
+	opdsAcquisitionRel  = "http://opds-spec.org/acquisition"
+)
+
+type OPDSOptions struct {
+	// OutDir receives the catalog (default: the library directory). Links
+	// to books and covers are relative to it, so serve both from one root.
+	OutDir string
+	// Title names the catalog (default "novfmt library").
+	Title string
+	// Versions lists the OPDS versions to write (default both).
+	Versions []string
+	// SearchURL is an OpenSearch template with {searchTerms}, for a search
+	// service next to the static catalog; without one the catalog offers
+	// no search.
+	SearchURL string
+	Logger    *slog.Logger
+	Progress  ProgressFunc
+}
+
+// OPDSBook is one book of a catalog. Path and Cover are relative to the
+// catalog directory, with forward slashes.
+type OPDSBook struct {
+	Path        string    `json:"path"`
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Authors     []string  `json:"authors"`
+	Language    string    `json:"language,omitempty"`
+	Publisher   string    `json:"publisher,omitempty"`
+	Published   string    `json:"published,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Subjects    []string  `json:"subjects,omitempty"`
+	Cover       string    `json:"cover,omitempty"`
+	CoverType   string    `json:"cover_type,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// OPDSSkip is a file that could not be read as an EPUB.
+type OPDSSkip struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type OPDSCatalog struct {
+	Books   []OPDSBook `json:"books"`
+	Skipped []OPDSSkip `json:"skipped"`
+	// Files lists the catalog files written, relative to OutDir.
+	Files []string `json:"files"`
+}
+
+// BuildOPDSCatalog scans dir and its subdirectories for EPUB files and
+// writes a static OPDS catalog of them: a navigation feed (catalog.xml,
+// catalog.json) leading to every book sorted by title (all) and to the
+// books of each author (authors, author-<name>). Covers are copied to
+// covers/. Files that fail to load are logged and skipped.
+func BuildOPDSCatalog(ctx context.Context, dir string, opts OPDSOptions) (OPDSCatalog, error) {
+	cat := OPDSCatalog{Books: []OPDSBook{}, Skipped: []OPDSSkip{}, Files: []string{}}
+	if dir == "" {
+		return cat, fmt.Errorf("library directory is required")
+	}
+	if opts.OutDir == "" {
+		opts.OutDir = dir
+	}
+	if opts.Title == "" {
+		opts.Title = "novfmt library"
+	}
+	if len(opts.Versions) == 0 {
+		opts.Versions = []string{OPDS12, OPDS20}
+	}
+	for _, v := range opts.Versions {
+		if v != OPDS12 && v != OPDS20 {
+			return cat, fmt.Errorf("unknown OPDS version %q (want %s or %s)", v, OPDS12, OPDS20)
+		}
+	}
+	if opts.SearchURL != "" && !strings.Contains(opts.SearchURL, "{searchTerms}") {
+		return cat, fmt.Errorf("search URL %q has no {searchTerms}", opts.SearchURL)
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	var paths []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".epub") {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return cat, err
+	}
+	sort.Strings(paths)
+	if err := os.MkdirAll(opts.OutDir, 0o755); err != nil {
+		return cat, err
+	}
+
+	ids := map[string]bool{}
+	for i, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return cat, err
+		}
+		opts.Progress.report(StageLoad, i, len(paths), p)
+		book, err := opdsBook(ctx, i, p, opts.OutDir)
+		if err != nil {
+			if ctx.Err() != nil {
+				return cat, ctx.Err()
+			}
+			log.Warn("skipping book", "path", p, "err", err)
+			cat.Skipped = append(cat.Skipped, OPDSSkip{Path: p, Error: err.Error()})
+			continue
+		}
+		if ids[book.ID] {
+			// Copies of a book share its identifier; entry ids must not.
+			book.ID = opdsPathID(book.Path)
+		}
+		ids[book.ID] = true
+		log.Debug("cataloged book", "path", p, "title", book.Title)
+		cat.Books = append(cat.Books, book)
+	}
+	opts.Progress.report(StageLoad, len(paths), len(paths), "")
+	sort.SliceStable(cat.Books, func(i, j int) bool {
+		a, b := strings.ToLower(cat.Books[i].Title), strings.ToLower(cat.Books[j].Title)
+		if a != b {
+			return a < b
+		}
+		return cat.Books[i].Path < cat.Books[j].Path
+	})
+
+	feeds := opdsFeeds(cat.Books, opts.Title)
+	for _, v := range opts.Versions {
+		for _, f := range feeds {
+			name, data, err := f.render(v, opts)
+			if err != nil {
+				return cat, err
+			}
+			if err := os.WriteFile(filepath.Join(opts.OutDir, name), data, 0o644); err != nil {
+				return cat, err
+			}
+			cat.Files = append(cat.Files, name)
+		}
+		if v == OPDS12 && opts.SearchURL != "" {
+			if err := os.WriteFile(filepath.Join(opts.OutDir, "opensearch.xml"), openSearchDescription(opts), 0o644); err != nil {
+				return cat, err
+			}
+			cat.Files = append(cat.Files, "opensearch.xml")
+		}
+	}
+	log.Info("wrote catalog", "dir", opts.OutDir, "books", len(cat.Books), "skipped", len(cat.Skipped))
+	return cat, nil
+}
+
+// opdsBook reads the metadata of the EPUB at p and copies its cover into
+// outDir.
+func opdsBook(ctx context.Context, idx int, p, outDir string) (OPDSBook, error) {
+	var book OPDSBook
+	info, err := os.Stat(p)
+	if err != nil {
+		return book, err
+	}
+	vol, err := loadVolume(ctx, idx, p)
+	if err != nil {
+		return book, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	rel, err := relativeSlashPath(outDir, p)
+	if err != nil {
+		return book, err
+	}
+	meta := vol.PackageDoc.Metadata
+	book = OPDSBook{
+		Path:        rel,
+		ID:          primaryIdentifier(vol.PackageDoc),
+		Title:       vol.DisplayName,
+		Authors:     []string{},
+		Language:    firstDCValue(meta.Languages),
+		Publisher:   firstDCValue(meta.Publishers),
+		Published:   pubDate(meta),
+		Description: firstDCValue(meta.Descriptions),
+		Updated:     info.ModTime().UTC().Truncate(time.Second),
+	}
+	if book.ID == "" {
+		book.ID = opdsPathID(rel)
+	}
+	for _, c := range meta.Creators {
+		if name := strings.TrimSpace(c.Value); name != "" {
+			book.Authors = append(book.Authors, name)
+		}
+	}
+	for _, s := range meta.Subjects {
+		if subject := strings.TrimSpace(s.Value); subject != "" {
+			book.Subjects = append(book.Subjects, subject)
+		}
+	}
+
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.ID != vol.CoverID || vol.CoverID == "" {
+			continue
+		}
+		name := path.Join("covers", strings.TrimPrefix(opdsPathID(rel), "urn:novfmt:")+strings.ToLower(path.Ext(item.Href)))
+		dst := filepath.Join(outDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return book, err
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(normalizeEPUBPath(item.Href)))
+		if err := copyFile(src, dst, 0o644); err != nil {
+			return book, fmt.Errorf("cover: %w", err)
+		}
+		book.Cover, book.CoverType = name, item.MediaType
+		break
+	}
+	return book, nil
+}
+
+// opdsPathID identifies a book by where it is in the library, for books
+// without an identifier of their own.
+func opdsPathID(rel string) string {
+	sum := sha256.Sum256([]byte(rel))
+	return "urn:novfmt:" + hex.EncodeToString(sum[:8])
+}
+
+func relativeSlashPath(base, target string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absBase, absTarget)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// opdsHref escapes a catalog-relative path for use as a link.
+func opdsHref(p string) string {
+	return (&url.URL{Path: p}).String()
+}
+
+// opdsFeed is one feed of the catalog, written once per OPDS version: a
+// navigation feed when it has entries, an acquisition feed otherwise.
+type opdsFeed struct {
+	name, id, title string
+	nav             []opdsNavEntry
+	books           []OPDSBook
+	updated         time.Time
+}
+
+type opdsNavEntry struct {
+	title, summary, feed string
+}
+
+func opdsFeeds(books []OPDSBook, title string) []opdsFeed {
+	var updated time.Time
+	byAuthor := map[string][]OPDSBook{}
+	var authors []string
+	for _, b := range books {
+		if b.Updated.After(updated) {
+			updated = b.Updated
+		}
+		names := b.Authors
+		if len(names) == 0 {
+			names = []string{"Unknown"}
+		}
+		for _, name := range names {
+			if _, ok := byAuthor[name]; !ok {
+				authors = append(authors, name)
+			}
+			byAuthor[name] = append(byAuthor[name], b)
+		}
+	}
+	sort.SliceStable(authors, func(i, j int) bool { return strings.ToLower(authors[i]) < strings.ToLower(authors[j]) })
+
+	root := opdsFeed{name: "catalog", id: "root", title: title, updated: updated, nav: []opdsNavEntry{
+		{title: "All books", summary: countBooks(len(books)), feed: "all"},
+		{title: "By author", summary: fmt.Sprintf("%d authors", len(authors)), feed: "authors"},
+	}}
+	all := opdsFeed{name: "all", id: "all", title: "All books", updated: updated, books: books}
+	index := opdsFeed{name: "authors", id: "authors", title: "By author", updated: updated, nav: []opdsNavEntry{}}
+	feeds := []opdsFeed{root, all}
+	slugs := map[string]bool{}
+	for _, name := range authors {
+		slug := opdsSlug(name)
+		for n := 2; slugs[slug]; n++ {
+			slug = fmt.Sprintf("%s-%d", opdsSlug(name), n)
+		}
+		slugs[slug] = true
+		feed := "author-" + slug
+		index.nav = append(index.nav, opdsNavEntry{title: name, summary: countBooks(len(byAuthor[name])), feed: feed})
+		feeds = append(feeds, opdsFeed{name: feed, id: "author:" + slug, title: name, updated: updated, books: byAuthor[name]})
+	}
+	return append(feeds, index)
+}
+
+func countBooks(n int) string {
+	if n == 1 {
+		return "1 book"
+	}
+	return fmt.Sprintf("%d books", n)
+}
+
+// opdsSlug turns an author's name into a file name part: letters and
+// digits of any script, lower-cased, with runs of anything else as "-".
+func opdsSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "unknown"
+	}
+	return slug
+}
+
+func (f opdsFeed) render(version string, opts OPDSOptions) (string, []byte, error) {
+	if version == OPDS20 {
+		data, err := json.MarshalIndent(f.opds2(opts), "", "  ")
+		return f.name + ".json", append(data, '\n'), err
+	}
+	data, err := xml.MarshalIndent(f.atom(opts), "", "  ")
+	return f.name + ".xml", append([]byte(xml.Header), append(data, '\n')...), err
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	XMLNS     string      `xml:"xmlns,attr"`
+	XMLNSDC   string      `xml:"xmlns:dc,attr"`
+	XMLNSOPDS string      `xml:"xmlns:opds,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomPerson   `xml:"author"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Publisher  string         `xml:"dc:publisher,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Links      []atomLink     `xml:"link"`
+}
+
+func (f opdsFeed) atom(opts OPDSOptions) atomFeed {
+	kind := opdsAcquisitionType
+	if f.nav != nil {
+		kind = opdsNavigationType
+	}
+	updated := f.updated.Format(time.RFC3339)
+	feed := atomFeed{
+		XMLNS:     "http://www.w3.org/2005/Atom",
+		XMLNSDC:   "http://purl.org/dc/terms/",
+		XMLNSOPDS: "http://opds-spec.org/2010/catalog",
+		ID:        "urn:novfmt:opds:" + f.id,
+		Title:     f.title,
+		Updated:   updated,
+		Links: []atomLink{
+			{Rel: "self", Href: opdsHref(f.name + ".xml"), Type: kind},
+			{Rel: "start", Href: "catalog.xml", Type: opdsNavigationType},
+		},
+	}
+	if f.name != "catalog" {
+		feed.Links = append(feed.Links, atomLink{Rel: "up", Href: "catalog.xml", Type: opdsNavigationType})
+	}
+	if opts.SearchURL != "" {
+		feed.Links = append(feed.Links, atomLink{Rel: "search", Href: "opensearch.xml", Type: "application/opensearchdescription+xml"})
+	}
+	for _, n := range f.nav {
+		feedKind := opdsAcquisitionType
+		if n.feed == "authors" {
+			feedKind = opdsNavigationType
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   n.title,
+			ID:      "urn:novfmt:opds:" + n.feed,
+			Updated: updated,
+			Content: &atomText{Type: "text", Value: n.summary},
+			Links:   []atomLink{{Rel: "subsection", Href: opdsHref(n.feed + ".xml"), Type: feedKind}},
+		})
+	}
+	for _, b := range f.books {
+		e := atomEntry{
+			Title:     b.Title,
+			ID:        b.ID,
+			Updated:   b.Updated.Format(time.RFC3339),
+			Language:  b.Language,
+			Publisher: b.Publisher,
+			Issued:    b.Published,
+			Links:     []atomLink{{Rel: opdsAcquisitionRel, Href: opdsHref(b.Path), Type: epubMimeType}},
+		}
+		for _, a := range b.Authors {
+			e.Authors = append(e.Authors, atomPerson{Name: a})
+		}
+		for _, s := range b.Subjects {
+			e.Categories = append(e.Categories, atomCategory{Term: s, Label: s})
+		}
+		if b.Description != "" {
+			e.Summary = &atomText{Type: "text", Value: b.Description}
+		}
+		if b.Cover != "" {
+			e.Links = append(e.Links,
+				atomLink{Rel: "http://opds-spec.org/image", Href: opdsHref(b.Cover), Type: b.CoverType},
+				atomLink{Rel: "http://opds-spec.org/image/thumbnail", Href: opdsHref(b.Cover), Type: b.CoverType})
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	return feed
+}
+
+type opds2Feed struct {
+	Metadata     opds2FeedMetadata  `json:"metadata"`
+	Links        []opds2Link        `json:"links"`
+	Navigation   []opds2Link        `json:"navigation,omitempty"`
+	Publications []opds2Publication `json:"publications,omitempty"`
+}
+
+type opds2FeedMetadata struct {
+	Title         string `json:"title"`
+	Modified      string `json:"modified,omitempty"`
+	NumberOfItems int    `json:"numberOfItems,omitempty"`
+}
+
+type opds2Link struct {
+	Rel       string `json:"rel,omitempty"`
+	Href      string `json:"href"`
+	Type      string `json:"type,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+}
+
+type opds2Name struct {
+	Name string `json:"name"`
+}
+
+type opds2Publication struct {
+	Metadata struct {
+		Type        string      `json:"@type"`
+		Identifier  string      `json:"identifier"`
+		Title       string      `json:"title"`
+		Author      []opds2Name `json:"author,omitempty"`
+		Language    string      `json:"language,omitempty"`
+		Publisher   string      `json:"publisher,omitempty"`
+		Published   string      `json:"published,omitempty"`
+		Modified    string      `json:"modified"`
+		Description string      `json:"description,omitempty"`
+		Subject     []opds2Name `json:"subject,omitempty"`
+	} `json:"metadata"`
+	Links  []opds2Link `json:"links"`
+	Images []opds2Link `json:"images,omitempty"`
+}
+
+func (f opdsFeed) opds2(opts OPDSOptions) opds2Feed {
+	feed := opds2Feed{
+		Metadata: opds2FeedMetadata{Title: f.title, Modified: f.updated.Format(time.RFC3339)},
+		Links: []opds2Link{
+			{Rel: "self", Href: opdsHref(f.name + ".json"), Type: opds2Type},
+			{Rel: "start", Href: "catalog.json", Type: opds2Type},
+		},
+	}
+	if f.name != "catalog" {
+		feed.Links = append(feed.Links, opds2Link{Rel: "up", Href: "catalog.json", Type: opds2Type})
+	}
+	if opts.SearchURL != "" {
+		feed.Links = append(feed.Links, opds2Link{Rel: "search", Href: opts.SearchURL, Type: opds2Type, Templated: true})
+	}
+	for _, n := range f.nav {
+		feed.Navigation = append(feed.Navigation, opds2Link{Href: opdsHref(n.feed + ".json"), Type: opds2Type, Title: n.title})
+	}
+	if f.nav == nil {
+		feed.Metadata.NumberOfItems = len(f.books)
+		feed.Publications = []opds2Publication{}
+	}
+	for _, b := range f.books {
+		var p opds2Publication
+		p.Metadata.Type = "http://schema.org/Book"
+		p.Metadata.Identifier = b.ID
+		p.Metadata.Title = b.Title
+		p.Metadata.Language = b.Language
+		p.Metadata.Publisher = b.Publisher
+		p.Metadata.Published = b.Published
+		p.Metadata.Modified = b.Updated.Format(time.RFC3339)
+		p.Metadata.Description = b.Description
+		for _, a := range b.Authors {
+			p.Metadata.Author = append(p.Metadata.Author, opds2Name{Name: a})
+		}
+		for _, s := range b.Subjects {
+			p.Metadata.Subject = append(p.Metadata.Subject, opds2Name{Name: s})
+		}
+		p.Links = []opds2Link{{Rel: opdsAcquisitionRel, Href: opdsHref(b.Path), Type: epubMimeType}}
+		if b.Cover != "" {
+			p.Images = []opds2Link{{Href: opdsHref(b.Cover), Type: b.CoverType}}
+		}
+		feed.Publications = append(feed.Publications, p)
+	}
+	return feed
+}
+
+// openSearchDescription points OPDS 1.2 clients at opts.SearchURL.
+func openSearchDescription(opts OPDSOptions) []byte {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">` + "\n")
+	b.WriteString("  <ShortName>")
+	xml.EscapeText(&b, []byte(opts.Title))
+	b.WriteString("</ShortName>\n  <Description>Search ")
+	xml.EscapeText(&b, []byte(opts.Title))
+	b.WriteString("</Description>\n")
+	fmt.Fprintf(&b, "  <Url type=\"%s\" template=\"", opdsAcquisitionType)
+	xml.EscapeText(&b, []byte(opts.SearchURL))
+	b.WriteString("\"/>\n</OpenSearchDescription>\n")
+	return []byte(b.String())
+}
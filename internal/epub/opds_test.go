@@ -0,0 +1,146 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildCatalogBook(t *testing.T, id, title, creator string, cover bool) string {
+	t.Helper()
+	coverItem, coverMeta := "", ""
+	files := map[string]string{
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One</title></head><body><p>Hi</p></body></html>`,
+	}
+	if cover {
+		coverItem = `<item id="cover" href="cover.jpg" media-type="image/jpeg" properties="cover-image"/>`
+		coverMeta = `<meta name="cover" content="cover"/>`
+		files["OEBPS/cover.jpg"] = "jpeg"
+	}
+	files["OEBPS/content.opf"] = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">` + id + `</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:creator>` + creator + `</dc:creator>
+    <dc:language>ja</dc:language>
+    <dc:subject>Fantasy</dc:subject>
+    ` + coverMeta + `
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    ` + coverItem + `
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`
+	return buildEPUBFromFiles(t, files)
+}
+
+func TestBuildOPDSCatalog(t *testing.T) {
+	lib := t.TempDir()
+	place := func(src, name string) {
+		t.Helper()
+		dst := filepath.Join(lib, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyFile(src, dst, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place(buildCatalogBook(t, "urn:test:b", "Beta", "山田 太郎", true), "series/beta vol 1.epub")
+	place(buildCatalogBook(t, "urn:test:a", "alpha", "Ann Author", false), "alpha.epub")
+	place(buildCatalogBook(t, "urn:test:a", "Alpha copy", "Ann Author", false), "copy/alpha.epub")
+	if err := os.WriteFile(filepath.Join(lib, "broken.epub"), []byte("not a zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cat, err := BuildOPDSCatalog(context.Background(), lib, OPDSOptions{Title: "Shelf", SearchURL: "https://example.com/search?q={searchTerms}"})
+	if err != nil {
+		t.Fatalf("BuildOPDSCatalog: %v", err)
+	}
+	if len(cat.Books) != 3 || len(cat.Skipped) != 1 {
+		t.Fatalf("books %d skipped %d, want 3 and 1", len(cat.Books), len(cat.Skipped))
+	}
+	if got := []string{cat.Books[0].Title, cat.Books[1].Title, cat.Books[2].Title}; strings.Join(got, "|") != "alpha|Alpha copy|Beta" {
+		t.Fatalf("books not sorted by title: %v", got)
+	}
+	if cat.Books[0].ID == cat.Books[1].ID {
+		t.Fatalf("copies share entry id %s", cat.Books[0].ID)
+	}
+	beta := cat.Books[2]
+	if beta.Path != "series/beta vol 1.epub" || beta.Cover == "" || beta.Language != "ja" {
+		t.Fatalf("beta = %+v", beta)
+	}
+	if _, err := os.Stat(filepath.Join(lib, filepath.FromSlash(beta.Cover))); err != nil {
+		t.Fatalf("cover not copied: %v", err)
+	}
+
+	var feed struct {
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+		Entries []struct {
+			Title string `xml:"title"`
+			Links []struct {
+				Rel  string `xml:"rel,attr"`
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	data, err := os.ReadFile(filepath.Join(lib, "author-山田-太郎.xml"))
+	if err != nil {
+		t.Fatalf("author feed: %v", err)
+	}
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("parse author feed: %v", err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Title != "Beta" {
+		t.Fatalf("author feed entries = %+v", feed.Entries)
+	}
+	links := map[string]string{}
+	for _, l := range feed.Entries[0].Links {
+		links[l.Rel] = l.Href
+	}
+	if links[opdsAcquisitionRel] != "series/beta%20vol%201.epub" || links["http://opds-spec.org/image"] != beta.Cover {
+		t.Fatalf("entry links = %v", links)
+	}
+	if _, err := os.Stat(filepath.Join(lib, "opensearch.xml")); err != nil {
+		t.Fatalf("no OpenSearch description: %v", err)
+	}
+
+	var root struct {
+		Navigation []struct {
+			Href  string `json:"href"`
+			Title string `json:"title"`
+		} `json:"navigation"`
+	}
+	data, err = os.ReadFile(filepath.Join(lib, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		t.Fatalf("parse catalog.json: %v", err)
+	}
+	if len(root.Navigation) != 2 || root.Navigation[0].Href != "all.json" {
+		t.Fatalf("navigation = %+v", root.Navigation)
+	}
+}
+
+func TestOPDSSlug(t *testing.T) {
+	for in, want := range map[string]string{
+		"Ann Author":  "ann-author",
+		"J. R. R. T.": "j-r-r-t",
+		"山田 太郎":       "山田-太郎",
+		"???":         "unknown",
+	} {
+		if got := opdsSlug(in); got != want {
+			t.Errorf("opdsSlug(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UnpackOptions configures Unpack.
+type UnpackOptions struct {
+	Logger *slog.Logger
+}
+
+// Unpack extracts the book at input into dir, which must be empty or not
+// exist yet, exactly as the archive holds it: unlike the commands that
+// edit a book, it repairs nothing. It returns the number of files written.
+func Unpack(ctx context.Context, input, dir string, opts UnpackOptions) (int, error) {
+	log := loggerOrDiscard(opts.Logger)
+	if input == "" || dir == "" {
+		return 0, fmt.Errorf("an input EPUB and a directory are required")
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return 0, fmt.Errorf("unpack into %s: directory is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	r, size, closeBook, err := EnvFrom(ctx).openBook(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	defer closeBook()
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, fmt.Errorf("extract %s: %w", input, invalidEPUB(err))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	renames, err := unzip(ctx, zr, dir)
+	if err != nil {
+		return 0, fmt.Errorf("extract %s: %w", input, invalidEPUB(err))
+	}
+	for from, to := range renames {
+		log.Warn("entry differs from another only by case; extracted under a new name", "entry", from, "path", to)
+	}
+	files := 0
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			files++
+		}
+	}
+	return files, nil
+}
+
+// PackOptions configures Pack.
+type PackOptions struct {
+	// NoValidate skips validating the packed book.
+	NoValidate bool
+	Logger     *slog.Logger
+	Progress   ProgressFunc
+}
+
+// packJunk names files that operating systems and editors leave in a
+// directory and that do not belong in a book.
+var packJunk = map[string]bool{".DS_Store": true, "Thumbs.db": true, "desktop.ini": true, "__MACOSX": true, ".git": true}
+
+// isPackJunk reports whether rel, a slash-separated path in an unpacked
+// book, is operating system or editor clutter.
+func isPackJunk(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if packJunk[part] || strings.HasPrefix(part, "._") {
+			return true
+		}
+	}
+	base := rel[strings.LastIndex(rel, "/")+1:]
+	return strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".swp") || strings.HasPrefix(base, ".#")
+}
+
+// Pack zips the unpacked book in dir to outPath in the order the OCF
+// container requires: an uncompressed mimetype entry first, whatever dir
+// holds for it, then everything else. Operating system and editor clutter
+// such as .DS_Store is left out. The packed book is then validated,
+// without fixing anything, and the report returned. A book packed to
+// StreamPath is buffered and validated before it is written.
+func Pack(ctx context.Context, dir, outPath string, opts PackOptions) (ValidationReport, error) {
+	log := loggerOrDiscard(opts.Logger)
+	report := ValidationReport{Issues: []ValidationIssue{}}
+	if dir == "" || outPath == "" {
+		return report, fmt.Errorf("a directory and an output EPUB are required")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "META-INF", "container.xml")); err != nil {
+		if os.IsNotExist(err) {
+			return report, invalidEPUB(fmt.Errorf("%s has no META-INF/container.xml; is it an unpacked book?", dir))
+		}
+		return report, err
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "mimetype")); err == nil && strings.TrimSpace(string(data)) != epubMimeType {
+		log.Warn("ignoring the mimetype file; packing the EPUB mimetype", "content", string(data))
+	}
+
+	log.Info("zipping output", "path", outPath)
+	env := EnvFrom(ctx)
+	var (
+		out BookWriter
+		err error
+		// buf holds a book for stdout until it has been validated.
+		buf *bytes.Buffer
+	)
+	if outPath == StreamPath && !opts.NoValidate {
+		buf = &bytes.Buffer{}
+		out = streamWriter{buf}
+	} else if out, err = env.createBook(ctx, outPath); err != nil {
+		return report, err
+	}
+	left := map[string]bool{}
+	w := zipWriter{ctx: ctx, w: out, progress: opts.Progress, skip: func(rel string) bool {
+		if isPackJunk(rel) {
+			left[rel] = true
+			return true
+		}
+		return false
+	}}
+	if err := w.addEPUBTree(dir); err != nil {
+		out.Abort()
+		return report, err
+	}
+	clutter := make([]string, 0, len(left))
+	for rel := range left {
+		clutter = append(clutter, rel)
+	}
+	sort.Strings(clutter)
+	for _, rel := range clutter {
+		log.Info("left out clutter", "path", rel)
+	}
+	if err := out.Commit(); err != nil {
+		return report, err
+	}
+	if opts.NoValidate {
+		return report, nil
+	}
+	if buf == nil {
+		return Validate(ctx, outPath, ValidateOptions{Logger: opts.Logger})
+	}
+	env.Stdin = bytes.NewReader(buf.Bytes())
+	if report, err = Validate(WithEnv(ctx, env), StreamPath, ValidateOptions{Logger: opts.Logger}); err != nil {
+		return report, err
+	}
+	_, err = env.stdout().Write(buf.Bytes())
+	return report, err
+}
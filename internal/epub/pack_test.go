@@ -0,0 +1,86 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnpackPack(t *testing.T) {
+	ctx := context.Background()
+	input := buildTestEPUB(t, "By Hand", "en")
+	defer os.Remove(input)
+
+	dir := filepath.Join(t.TempDir(), "work")
+	files, err := Unpack(ctx, input, dir, UnpackOptions{})
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if files == 0 {
+		t.Fatal("no files extracted")
+	}
+	if _, err := Unpack(ctx, input, dir, UnpackOptions{}); err == nil {
+		t.Fatal("unpacked into a non-empty directory")
+	}
+
+	for _, junk := range []string{".DS_Store", "OEBPS/._chapter1.xhtml", "__MACOSX/x", "OEBPS/notes.txt~"} {
+		p := filepath.Join(dir, filepath.FromSlash(junk))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("junk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(t.TempDir(), "packed.epub")
+	report, err := Pack(ctx, dir, out, PackOptions{})
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if !report.Valid() {
+		t.Fatalf("packed book invalid: %+v", report.Issues)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := zr.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Fatalf("first entry = %s (method %d)", first.Name, first.Method)
+	}
+	if len(zr.File) != files {
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		t.Fatalf("packed %d entries, unpacked %d: %q", len(zr.File), files, names)
+	}
+
+	// A book packed to stdout is validated too, and still written.
+	if err := os.Remove(filepath.Join(dir, "OEBPS", "chapter.xhtml")); err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	report, err = Pack(WithEnv(ctx, Env{Stdout: &stdout}), dir, StreamPath, PackOptions{})
+	if err != nil {
+		t.Fatalf("Pack to stdout: %v", err)
+	}
+	if report.Valid() {
+		t.Fatal("book without its chapter packed to stdout as valid")
+	}
+	if _, err := zip.NewReader(bytes.NewReader(stdout.Bytes()), int64(stdout.Len())); err != nil {
+		t.Fatalf("stdout holds no archive: %v", err)
+	}
+
+	if _, err := Pack(ctx, t.TempDir(), out, PackOptions{}); !errors.Is(err, ErrInvalidEPUB) {
+		t.Fatalf("packing a directory with no container: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NameEntry is a character's name for the name presets. Gender, "m" or
+// "f", lets honorifics-localize pick Mr. or Ms. and Lord or Lady.
+type NameEntry struct {
+	Given  string `json:"given"`
+	Family string `json:"family"`
+	Gender string `json:"gender,omitempty"`
+}
+
+// honorificSuffixes are the Japanese honorifics the presets recognise.
+const honorificSuffixes = `san|kun|chan|sama|senpai|sempai|sensei|dono|tan|chin|han`
+
+// honorificRE matches a capitalized name with an honorific, keeping the
+// name in group 1.
+const honorificRE = `(\p{Lu}[\p{L}\p{M}'’]*)-(?i:` + honorificSuffixes + `)\b`
+
+// rewritePresets build the rules of the built-in presets from a name
+// list, which only some of them need.
+var rewritePresets = map[string]struct {
+	needsNames bool
+	rules      func(names []NameEntry) []RewriteRule
+}{
+	// honorifics-strip drops -san, -kun, -sama and the like after names.
+	"honorifics-strip": {rules: func([]NameEntry) []RewriteRule {
+		return []RewriteRule{{Find: honorificRE, Replace: "$1", Regex: true}}
+	}},
+	// honorifics-localize turns -san and -sama after the names of the
+	// name list with a gender into Mr./Ms. and Lord/Lady, and drops the
+	// other honorifics as honorifics-strip does.
+	"honorifics-localize": {rules: func(names []NameEntry) []RewriteRule {
+		var out []RewriteRule
+		for _, n := range names {
+			title := map[string][2]string{"m": {"Mr.", "Lord"}, "f": {"Ms.", "Lady"}}[genderCode(n.Gender)]
+			if title[0] == "" {
+				continue
+			}
+			for _, name := range nameForms(n) {
+				out = append(out,
+					nameRule(name+"-san", title[0]+" "+name),
+					nameRule(name+"-sama", title[1]+" "+name))
+			}
+		}
+		sort.SliceStable(out, func(i, j int) bool { return len(out[i].Find) > len(out[j].Find) })
+		return append(out, RewriteRule{Find: honorificRE, Replace: "$1", Regex: true})
+	}},
+	// names-eastern writes the names of the name list family name first.
+	"names-eastern": {needsNames: true, rules: func(names []NameEntry) []RewriteRule {
+		var out []RewriteRule
+		for _, n := range names {
+			if n.Given != "" && n.Family != "" {
+				out = append(out, nameRule(n.Given+" "+n.Family, n.Family+" "+n.Given))
+			}
+		}
+		return out
+	}},
+	// names-western writes the names of the name list given name first.
+	"names-western": {needsNames: true, rules: func(names []NameEntry) []RewriteRule {
+		var out []RewriteRule
+		for _, n := range names {
+			if n.Given != "" && n.Family != "" {
+				out = append(out, nameRule(n.Family+" "+n.Given, n.Given+" "+n.Family))
+			}
+		}
+		return out
+	}},
+	// ellipsis turns "..." and ". . ." into "…".
+	"ellipsis": {rules: func([]NameEntry) []RewriteRule {
+		return []RewriteRule{{Find: `\.(?: ?\.){2,}`, Replace: "…", Regex: true}}
+	}},
+	// dashes turns "--", horizontal bars and spaced or doubled em dashes
+	// into one closed em dash.
+	"dashes": {rules: func([]NameEntry) []RewriteRule {
+		return []RewriteRule{{Find: `[ \x{00A0}]*(?:--+|[―—]+)[ \x{00A0}]*`, Replace: "—", Regex: true}}
+	}},
+}
+
+// RewritePreset returns the rules of a built-in preset, each with the ID
+// "preset:<name>". names is the name list the name presets need.
+func RewritePreset(name string, names []NameEntry) ([]RewriteRule, error) {
+	p, ok := rewritePresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rewrite preset %q (known: %s)", name, strings.Join(RewritePresetNames(), ", "))
+	}
+	if p.needsNames && len(names) == 0 {
+		return nil, fmt.Errorf("rewrite preset %s needs a name list", name)
+	}
+	rules := p.rules(names)
+	for i := range rules {
+		rules[i].ID = "preset:" + name
+	}
+	return rules, nil
+}
+
+// RewritePresetNames lists the built-in presets.
+func RewritePresetNames() []string {
+	names := make([]string, 0, len(rewritePresets))
+	for n := range rewritePresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadNameList reads a JSON array of NameEntry objects.
+func LoadNameList(path string) ([]NameEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []NameEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&names); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, n := range names {
+		if n.Given == "" && n.Family == "" {
+			return nil, fmt.Errorf("%s: entry %d has no name", path, i+1)
+		}
+		if n.Gender != "" && genderCode(n.Gender) == "" {
+			return nil, fmt.Errorf("%s: entry %d: gender %q is not m or f", path, i+1, n.Gender)
+		}
+	}
+	return names, nil
+}
+
+func genderCode(g string) string {
+	switch strings.ToLower(g) {
+	case "m", "male":
+		return "m"
+	case "f", "female":
+		return "f"
+	}
+	return ""
+}
+
+// notInWord matches the start or end of the text or a character that
+// cannot be part of a name, standing in for \b, which only knows ASCII.
+const notInWord = `[^\p{L}\p{M}\p{N}_]`
+
+// nameRule returns a rule writing name, where it stands as a whole word
+// and not as part of a longer name, as replace.
+func nameRule(name, replace string) RewriteRule {
+	return RewriteRule{
+		Find:    `(^|` + notInWord + `)` + regexp.QuoteMeta(name) + `(` + notInWord + `|$)`,
+		Replace: "${1}" + strings.ReplaceAll(replace, "$", "$$") + "${2}",
+		Regex:   true,
+		Stop:    true,
+	}
+}
+
+// nameForms are the ways a name is written before an honorific.
+func nameForms(n NameEntry) []string {
+	var out []string
+	if n.Given != "" && n.Family != "" {
+		out = append(out, n.Given+" "+n.Family, n.Family+" "+n.Given)
+	}
+	for _, s := range []string{n.Family, n.Given} {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
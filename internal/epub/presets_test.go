@@ -0,0 +1,67 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewritePresets(t *testing.T) {
+	names := []NameEntry{
+		{Given: "Haruhi", Family: "Suzumiya", Gender: "f"},
+		{Given: "Kyon", Gender: "m"},
+		{Given: "Itsuki", Family: "Koizumi"},
+		// One name is a prefix of the other.
+		{Given: "Mai", Family: "Sato", Gender: "f"},
+		{Given: "Mai", Family: "Satou"},
+	}
+	cases := []struct{ preset, in, want string }{
+		{"honorifics-strip", "Tanaka-san and Ōta-SAMA met Kyon-kun's sister.", "Tanaka and Ōta met Kyon's sister."},
+		{"honorifics-localize", "Suzumiya-san, Haruhi Suzumiya-sama, Kyon-san and Koizumi-san", "Ms. Suzumiya, Lady Haruhi Suzumiya, Mr. Kyon and Koizumi"},
+		{"names-eastern", "Haruhi Suzumiya and Itsuki Koizumi", "Suzumiya Haruhi and Koizumi Itsuki"},
+		{"names-eastern", "Mai Satou met Mai Sato, not Mai Satoh.", "Satou Mai met Sato Mai, not Mai Satoh."},
+		{"honorifics-localize", "Satou-san asked Sato-san.", "Satou asked Ms. Sato."},
+		{"names-western", "Suzumiya Haruhi", "Haruhi Suzumiya"},
+		{"ellipsis", "Well... I . . . see.", "Well… I … see."},
+		{"dashes", "No -- wait ― it was — him——yes", "No—wait—it was—him—yes"},
+	}
+	for _, c := range cases {
+		rules, err := RewritePreset(c.preset, names)
+		if err != nil {
+			t.Fatalf("%s: %v", c.preset, err)
+		}
+		compiled, err := compileRules(rules)
+		if err != nil {
+			t.Fatalf("%s: %v", c.preset, err)
+		}
+		if got, _, _ := applyRulesToText(c.in, compiled); got != c.want {
+			t.Errorf("%s(%q) = %q, want %q", c.preset, c.in, got, c.want)
+		}
+		if rules[0].ID != "preset:"+c.preset {
+			t.Errorf("%s: id = %q", c.preset, rules[0].ID)
+		}
+	}
+
+	if _, err := RewritePreset("names-eastern", nil); err == nil {
+		t.Fatal("names-eastern without names accepted")
+	}
+	if _, err := RewritePreset("shouting", nil); err == nil {
+		t.Fatal("unknown preset accepted")
+	}
+}
+
+func TestLoadNameList(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "names.json")
+	if err := os.WriteFile(p, []byte(`[{"given": "Kyon", "gender": "x"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadNameList(p); err == nil {
+		t.Fatal("bad gender accepted")
+	}
+	if err := os.WriteFile(p, []byte(`[{"given": "Haruhi", "family": "Suzumiya", "gender": "female"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := LoadNameList(p); err != nil || len(names) != 1 || names[0].Family != "Suzumiya" {
+		t.Fatalf("names = %+v, %v", names, err)
+	}
+}
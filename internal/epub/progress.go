@@ -0,0 +1,28 @@
+package epub
+
+const (
+	StageLoad    = "load"
+	StageCopy    = "copy"
+	StageRewrite = "rewrite"
+	StageZip     = "zip"
+)
+
+// ProgressEvent reports that Done of Total units of Stage are complete.
+// Item names the unit just started or finished (a volume path, an href).
+type ProgressEvent struct {
+	Stage string
+	Done  int
+	Total int
+	Item  string
+}
+
+// ProgressFunc receives coarse progress updates from long-running operations.
+// It is called synchronously, so implementations should return quickly.
+type ProgressFunc func(ProgressEvent)
+
+func (f ProgressFunc) report(stage string, done, total int, item string) {
+	if f == nil {
+		return
+	}
+	f(ProgressEvent{Stage: stage, Done: done, Total: total, Item: item})
+}
@@ -0,0 +1,359 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type QuoteStyleOptions struct {
+	// From and To name the conventions to convert between (see
+	// QuoteStyles). From defaults to the book's dc:language.
+	From string
+	To   string
+	// NoDashes leaves dashes alone and only converts quotes.
+	NoDashes bool
+	// Selectors limits the conversion to matching elements and their
+	// descendants (tag, .class or tag.class); empty converts everything
+	// except code, pre and similar elements.
+	Selectors []string
+	OutPath   string
+	DryRun    bool
+	Logger    *slog.Logger
+	Progress  ProgressFunc
+}
+
+// quoteStyle is one locale's convention for quotation marks and the dash
+// used to set off a clause.
+type quoteStyle struct {
+	open, close           rune
+	innerOpen, innerClose rune
+	// padded styles put a no-break space inside the outer quotes.
+	padded bool
+	dash   string
+	// dashPattern finds this style's dash in text.
+	dashPattern *regexp.Regexp
+}
+
+var (
+	unspacedEmDash = regexp.MustCompile(`[ \x{a0}]?—+[ \x{a0}]?`)
+	spacedEnDash   = regexp.MustCompile(`[ \x{a0}]–[ \x{a0}]`)
+	spacedEmDash   = regexp.MustCompile(`[ \x{a0}]—[ \x{a0}]`)
+	doubleDash     = regexp.MustCompile(`――|——`)
+)
+
+var quoteStyles = map[string]quoteStyle{
+	"en":      {open: '“', close: '”', innerOpen: '‘', innerClose: '’', dash: "—", dashPattern: unspacedEmDash},
+	"en-gb":   {open: '‘', close: '’', innerOpen: '“', innerClose: '”', dash: " – ", dashPattern: spacedEnDash},
+	"fr":      {open: '«', close: '»', innerOpen: '“', innerClose: '”', padded: true, dash: " – ", dashPattern: spacedEnDash},
+	"de":      {open: '„', close: '“', innerOpen: '‚', innerClose: '‘', dash: " – ", dashPattern: spacedEnDash},
+	"es":      {open: '«', close: '»', innerOpen: '“', innerClose: '”', dash: "—", dashPattern: unspacedEmDash},
+	"it":      {open: '«', close: '»', innerOpen: '“', innerClose: '”', dash: " – ", dashPattern: spacedEnDash},
+	"pl":      {open: '„', close: '”', innerOpen: '«', innerClose: '»', dash: " – ", dashPattern: spacedEnDash},
+	"ru":      {open: '«', close: '»', innerOpen: '„', innerClose: '“', dash: " — ", dashPattern: spacedEmDash},
+	"ja":      {open: '「', close: '」', innerOpen: '『', innerClose: '』', dash: "――", dashPattern: doubleDash},
+	"zh":      {open: '“', close: '”', innerOpen: '‘', innerClose: '’', dash: "——", dashPattern: doubleDash},
+	"zh-hant": {open: '「', close: '」', innerOpen: '『', innerClose: '』', dash: "——", dashPattern: doubleDash},
+}
+
+// QuoteStyles lists the locales ConvertQuoteStyle knows. Other tags fall
+// back to their primary language (en-US is en).
+func QuoteStyles() []string {
+	out := make([]string, 0, len(quoteStyles))
+	for name := range quoteStyles {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func lookupQuoteStyle(tag string) (quoteStyle, error) {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	switch tag {
+	case "zh-tw", "zh-hk", "zh-mo":
+		tag = "zh-hant"
+	}
+	if s, ok := quoteStyles[tag]; ok {
+		return s, nil
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	if s, ok := quoteStyles[primary]; ok {
+		return s, nil
+	}
+	return quoteStyle{}, fmt.Errorf("no quote style for %q (known: %s)", tag, strings.Join(QuoteStyles(), ", "))
+}
+
+// ConvertQuoteStyle rewrites quotation marks and dashes from one locale's
+// conventions to another's in every XHTML document, e.g. French « » to
+// English “ ” or Japanese 「」 to English quotes for a translation. Unlike
+// typo it starts from typographic quotes, so run typo first on books that
+// still have straight ones.
+func ConvertQuoteStyle(ctx context.Context, input string, opts QuoteStyleOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.To == "" {
+		return stats, fmt.Errorf("target quote style is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	from := opts.From
+	if from == "" {
+		from = strings.TrimSpace(firstDCValue(pkg.Metadata.Languages))
+	}
+	conv, err := newQuoteConverter(from, opts.To, opts.NoDashes, opts.Selectors)
+	if err != nil {
+		return stats, err
+	}
+
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return stats, err
+		}
+		res, err := conv.convert(data)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		stats.MatchCount += res.matches
+		if res.data == nil {
+			continue
+		}
+		log.Debug("converted quotes", "href", item.Href, "changes", res.matches)
+		stats.FilesChanged++
+		stats.Changeset.modified(item.Href)
+		stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: res.matches, Changes: res.changes})
+		if !opts.DryRun {
+			if err := os.WriteFile(src, res.data, 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+type quoteConverter struct {
+	from, to  quoteStyle
+	dashes    bool
+	selectors []compiledSelector
+}
+
+func newQuoteConverter(from, to string, noDashes bool, selectors []string) (*quoteConverter, error) {
+	if from == "" {
+		return nil, fmt.Errorf("source quote style is required (the book has no dc:language)")
+	}
+	src, err := lookupQuoteStyle(from)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := lookupQuoteStyle(to)
+	if err != nil {
+		return nil, err
+	}
+	return &quoteConverter{from: src, to: dst, dashes: !noDashes && src.dash != dst.dash, selectors: parseSelectors(selectors)}, nil
+}
+
+func (c *quoteConverter) convert(data []byte) (xhtmlRewrite, error) {
+	var res xhtmlRewrite
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	var (
+		skipStack  []bool
+		skipping   int
+		scopeStack []bool
+		inScope    = len(c.selectors) == 0
+		scoped     int
+		q          = &quoteRun{c: c}
+	)
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return res, err
+		}
+		tok := rt.tok
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			s := typoSkipTags[name]
+			skipStack = append(skipStack, s)
+			if s {
+				skipping++
+			}
+			m := !inScope && matchSelectors(c.selectors, t)
+			scopeStack = append(scopeStack, m)
+			if m {
+				scoped++
+			}
+			if typoBlockTags[name] {
+				q.reset()
+			}
+		case xml.EndElement:
+			if n := len(skipStack); n > 0 {
+				if skipStack[n-1] {
+					skipping--
+				}
+				skipStack = skipStack[:n-1]
+			}
+			if n := len(scopeStack); n > 0 {
+				if scopeStack[n-1] {
+					scoped--
+				}
+				scopeStack = scopeStack[:n-1]
+			}
+			if typoBlockTags[strings.ToLower(t.Name.Local)] {
+				q.reset()
+			}
+		case xml.CharData:
+			if skipping > 0 || !(inScope || scoped > 0) {
+				break
+			}
+			orig := string(t)
+			text, n := q.convert(orig)
+			if n > 0 {
+				res.matches += n
+				res.changes = append(res.changes, TextChange{Before: orig, After: text})
+				tok = xml.CharData(text)
+			}
+		}
+		if err := sp.emit(rt, tok); err != nil {
+			return res, err
+		}
+	}
+	if len(res.changes) > 0 {
+		res.data = out.Bytes()
+	}
+	return res, nil
+}
+
+// quoteRun converts the text of one block, which may arrive in several
+// runs split by inline elements.
+type quoteRun struct {
+	c *quoteConverter
+	// open counts unclosed outer and inner quotes, so that a closing mark
+	// that doubles as an apostrophe is only converted inside a quote. Inner
+	// marks only count inside outer quotes: outside them they are titles
+	// (Japanese 『』) or already the target's outer quotes, which keeps a
+	// second run from changing anything.
+	open, innerOpen int
+	prev            rune
+}
+
+func (q *quoteRun) reset() {
+	q.open, q.innerOpen, q.prev = 0, 0, 0
+}
+
+func isQuotePadding(r rune) bool {
+	return r == ' ' || r == nbsp || r == narrowNBSP
+}
+
+func (q *quoteRun) convert(s string) (string, int) {
+	from, to := q.c.from, q.c.to
+	rs := []rune(s)
+	out := make([]rune, 0, len(rs)+4)
+	n := 0
+	last := func() rune {
+		if len(out) > 0 {
+			return out[len(out)-1]
+		}
+		return q.prev
+	}
+	// apostrophe reports whether the mark at i is ’ inside a word.
+	apostrophe := func(i int) bool {
+		return rs[i] == '’' && unicode.IsLetter(last()) && i+1 < len(rs) && unicode.IsLetter(rs[i+1])
+	}
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == from.open && (r != from.close || q.open == 0) && !apostrophe(i):
+			q.open++
+			n++
+			out = append(out, to.open)
+			if from.padded {
+				for i+1 < len(rs) && isQuotePadding(rs[i+1]) {
+					i++
+				}
+			}
+			if to.padded {
+				out = append(out, nbsp)
+			}
+		case r == from.close && q.open > 0 && !apostrophe(i):
+			q.open--
+			n++
+			if from.padded {
+				out = trimQuotePadding(out)
+			}
+			if to.padded {
+				out = append(out, nbsp)
+			}
+			out = append(out, to.close)
+		case r == from.innerOpen && q.open > 0 && (r != from.innerClose || q.innerOpen == 0) && !apostrophe(i):
+			q.innerOpen++
+			n++
+			out = append(out, to.innerOpen)
+		case r == from.innerClose && q.innerOpen > 0 && !apostrophe(i):
+			q.innerOpen--
+			n++
+			out = append(out, to.innerClose)
+		default:
+			out = append(out, r)
+		}
+	}
+	text := string(out)
+	if q.c.dashes {
+		text = from.dashPattern.ReplaceAllStringFunc(text, func(m string) string {
+			if from.dash == "—" && strings.Count(m, "—") > 1 {
+				return m
+			}
+			n++
+			return to.dash
+		})
+	}
+	if text != "" {
+		tr := []rune(text)
+		q.prev = tr[len(tr)-1]
+	}
+	return text, n
+}
+
+func trimQuotePadding(rs []rune) []rune {
+	for len(rs) > 0 && isQuotePadding(rs[len(rs)-1]) {
+		rs = rs[:len(rs)-1]
+	}
+	return rs
+}
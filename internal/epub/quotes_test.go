@@ -0,0 +1,95 @@
+package epub
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var xmlnsAttrPattern = regexp.MustCompile(` xmlns="[^"]*"`)
+
+func TestQuoteConverter(t *testing.T) {
+	doc := func(body string) []byte {
+		return []byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body>` + body + `</body></html>`)
+	}
+	cases := []struct {
+		name, from, to string
+		selectors      []string
+		in, want       string
+	}{
+		{
+			name: "fr to en",
+			from: "fr", to: "en",
+			in:   "<p>« Il a dit “non” – puis il est parti. »</p>",
+			want: "<p>“Il a dit ‘non’—puis il est parti.”</p>",
+		},
+		{
+			name: "en to fr",
+			from: "en", to: "fr",
+			in:   "<p>“Don’t go—please,” she said.</p>",
+			want: "<p>«\u00a0Don’t go – please,\u00a0» she said.</p>",
+		},
+		{
+			name: "ja to en keeps titles",
+			from: "ja", to: "en",
+			in:   "<p>『竜の書』を読んだ。「はい」――と彼は言った。</p>",
+			want: "<p>『竜の書』を読んだ。“はい”—と彼は言った。</p>",
+		},
+		{
+			name: "nested inner quotes and inline elements",
+			from: "ja", to: "en",
+			in:   "<p>「彼は<em>『はい』</em>と言った」</p>",
+			want: "<p>“彼は<em>‘はい’</em>と言った”</p>",
+		},
+		{
+			name: "en to de leaves apostrophes",
+			from: "en", to: "de",
+			in:   "<p>“It’s the boys’ ‘secret’ place.”</p><p>The boys’ dog.</p>",
+			want: "<p>„It’s the boys’ ‚secret‘ place.“</p><p>The boys’ dog.</p>",
+		},
+		{
+			name: "selectors scope the change",
+			from: "ja", to: "en",
+			selectors: []string{"p.tl"},
+			in:        `<p>「原文」</p><p class="tl">「訳文」</p><pre>「コード」</pre>`,
+			want:      `<p>「原文」</p><p class="tl">“訳文”</p><pre>「コード」</pre>`,
+		},
+	}
+	for _, c := range cases {
+		conv, err := newQuoteConverter(c.from, c.to, false, c.selectors)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		res, err := conv.convert(doc(c.in))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := xmlnsAttrPattern.ReplaceAllString(string(res.data), ""); !strings.Contains(got, c.want) {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+
+	if _, err := newQuoteConverter("tlh", "en", false, nil); err == nil {
+		t.Fatal("accepted an unknown locale")
+	}
+}
+
+func TestQuotesTransformIdempotent(t *testing.T) {
+	data := []byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body><p>« Il a dit “non”. »</p><p>"Straight," he said.</p></body></html>`)
+	steps, err := ParseTransformChain("typo:fr,quotes:fr/en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := CheckTransformChain(steps, TransformBook{Language: "fr"}, "ch1.xhtml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(xmlnsAttrPattern.ReplaceAllString(string(out), ""), "<p>“Il a dit ‘non’.”</p><p>“Straight,” he said.</p>") {
+		t.Fatalf("got %s", out)
+	}
+
+	steps, _ = ParseTransformChain("quotes:en,typo")
+	if _, err := CheckTransformChain(steps, TransformBook{Language: "fr"}, "ch1.xhtml", data); err == nil || !strings.Contains(err.Error(), "must run after") {
+		t.Fatalf("err = %v, want an ordering error", err)
+	}
+}
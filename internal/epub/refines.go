@@ -0,0 +1,161 @@
+package epub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Refinement is an EPUB 3 <meta refines="#id"> statement about another
+// element of the package, such as a creator's role or a title's type.
+type Refinement struct {
+	Property string `json:"property"`
+	Value    string `json:"value"`
+	Scheme   string `json:"scheme,omitempty"`
+}
+
+// refinementsOf returns the refinements in meta, keyed by the id of the
+// element they refine.
+func refinementsOf(meta Metadata) map[string][]Refinement {
+	out := map[string][]Refinement{}
+	for _, node := range meta.Meta {
+		id, ok := strings.CutPrefix(node.Refines, "#")
+		if !ok || node.Property == "" {
+			continue
+		}
+		out[id] = append(out[id], Refinement{Property: node.Property, Value: strings.TrimSpace(node.Value), Scheme: node.Scheme})
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// applyRefinesPatch replaces the refinements of each element named in
+// refines, in id order; an empty list removes them all. Every id must name
+// an element of the package.
+func applyRefinesPatch(pkg *PackageDocument, refines map[string][]Refinement) (bool, error) {
+	ids := packageIDs(pkg)
+	targets := make([]string, 0, len(refines))
+	for id := range refines {
+		id = strings.TrimPrefix(id, "#")
+		if !ids[id] {
+			return false, fmt.Errorf("refines: no element with id %q", id)
+		}
+		targets = append(targets, id)
+	}
+	sort.Strings(targets)
+	changed := false
+	for _, id := range targets {
+		list, ok := refines[id]
+		if !ok {
+			list = refines["#"+id]
+		}
+		for _, r := range list {
+			if strings.TrimSpace(r.Property) == "" {
+				return false, fmt.Errorf("refines %q: property is required", id)
+			}
+		}
+		changed = setRefinements(&pkg.Metadata, id, list) || changed
+	}
+	return changed, nil
+}
+
+// setRefinements replaces the refinements of the element with the given
+// id. The new ones take the place of the first old one, or go last.
+func setRefinements(meta *Metadata, id string, list []Refinement) bool {
+	nodes := make([]MetaNode, 0, len(list))
+	for _, r := range list {
+		nodes = append(nodes, MetaNode{Refines: "#" + id, Property: strings.TrimSpace(r.Property), Scheme: r.Scheme, Value: r.Value})
+	}
+	var before []MetaNode
+	out := make([]MetaNode, 0, len(meta.Meta)+len(nodes))
+	placed := false
+	for _, node := range meta.Meta {
+		if node.Refines != "#"+id {
+			out = append(out, node)
+			continue
+		}
+		before = append(before, node)
+		if !placed {
+			out = append(out, nodes...)
+			placed = true
+		}
+	}
+	if !placed {
+		out = append(out, nodes...)
+	}
+	meta.Meta = out
+	if len(before) != len(nodes) {
+		return true
+	}
+	for i := range nodes {
+		if before[i].Property != nodes[i].Property || strings.TrimSpace(before[i].Value) != nodes[i].Value || before[i].Scheme != nodes[i].Scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneRefines drops refinements of elements the package no longer has,
+// which edits that replace metadata leave behind, and reports how many it
+// dropped.
+func pruneRefines(pkg *PackageDocument) int {
+	dropped := 0
+	for {
+		ids := packageIDs(pkg)
+		kept := pkg.Metadata.Meta[:0]
+		for _, node := range pkg.Metadata.Meta {
+			if id, ok := strings.CutPrefix(node.Refines, "#"); ok && !ids[id] {
+				dropped++
+				continue
+			}
+			kept = append(kept, node)
+		}
+		n := len(pkg.Metadata.Meta) - len(kept)
+		pkg.Metadata.Meta = kept
+		// Go round again: a dropped refinement may itself have been refined.
+		if n == 0 {
+			return dropped
+		}
+	}
+}
+
+// packageIDs returns the ids of the package's metadata and manifest
+// items.
+func packageIDs(pkg *PackageDocument) map[string]bool {
+	ids := metadataIDs(&pkg.Metadata)
+	for _, item := range pkg.Manifest.Items {
+		ids[item.ID] = true
+	}
+	return ids
+}
+
+// metadataIDs returns the ids used in meta.
+func metadataIDs(meta *Metadata) map[string]bool {
+	ids := map[string]bool{}
+	for _, list := range meta.dcElements() {
+		for _, dc := range list {
+			if dc.ID != "" {
+				ids[dc.ID] = true
+			}
+		}
+	}
+	for _, node := range meta.Meta {
+		if node.ID != "" {
+			ids[node.ID] = true
+		}
+	}
+	return ids
+}
+
+// newMetadataID returns prefix followed by the lowest number that makes
+// an id not in ids, and adds it.
+func newMetadataID(ids map[string]bool, prefix string) string {
+	for n := 1; ; n++ {
+		if id := fmt.Sprintf("%s%d", prefix, n); !ids[id] {
+			ids[id] = true
+			return id
+		}
+	}
+}
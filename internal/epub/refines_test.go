@@ -0,0 +1,107 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildRefinedBook(t *testing.T) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:refined</dc:identifier>
+    <dc:title id="t1" xml:lang="ja">サーガ</dc:title>
+    <meta refines="#t1" property="title-type">main</meta>
+    <meta refines="#t1" property="alternate-script" xml:lang="en">Saga</meta>
+    <dc:creator id="c1">Jane Doe</dc:creator>
+    <meta refines="#c1" property="role" scheme="marc:relators">aut</meta>
+    <meta refines="#c1" property="display-seq">1</meta>
+    <dc:creator id="c2">Taro Yamada</dc:creator>
+    <meta refines="#c2" property="role" scheme="marc:relators">ill</meta>
+    <meta refines="#gone" property="file-as">Nobody</meta>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest><item id="ch" href="ch.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="ch"/></spine>
+</package>`,
+		"OEBPS/ch.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Hi</p></body></html>`,
+	})
+}
+
+func TestRefinesKeptThroughEdits(t *testing.T) {
+	ctx := context.Background()
+	input := buildRefinedBook(t)
+	title := "サーガ 完全版"
+	creators := []string{"Jane Doe|edt"}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Title: &title, Creators: &creators}}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	meta := vol.PackageDoc.Metadata
+	if meta.Titles[0].ID != "t1" || meta.Titles[0].Lang != "ja" {
+		t.Fatalf("title = %+v", meta.Titles[0])
+	}
+	refines := refinementsOf(meta)
+	if len(refines["t1"]) != 2 || refines["t1"][1].Value != "Saga" {
+		t.Fatalf("title refinements = %+v", refines["t1"])
+	}
+	if got := refines["c1"]; len(got) != 2 || got[0].Property != "display-seq" || got[1].Value != "edt" {
+		t.Fatalf("creator refinements = %+v", got)
+	}
+	if len(refines["c2"]) != 0 || len(refines["gone"]) != 0 {
+		t.Fatalf("refinements of missing elements kept: %+v", refines)
+	}
+}
+
+func TestRefinesPatch(t *testing.T) {
+	ctx := context.Background()
+	input := buildRefinedBook(t)
+	dump := filepath.Join(t.TempDir(), "meta.json")
+	if _, err := EditEPUB(ctx, input, EditOptions{DumpMetaPath: dump}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap MetadataSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Refines["c1"]) != 2 || snap.Refines["c1"][0].Scheme != "marc:relators" {
+		t.Fatalf("snapshot refines = %+v", snap.Refines)
+	}
+
+	patch := MetadataPatch{Refines: map[string][]Refinement{
+		"#c2": {{Property: "role", Scheme: "marc:relators", Value: "art"}, {Property: "file-as", Value: "Yamada, Taro"}},
+		"t1":  {},
+	}}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: patch}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := formatCreators(creatorsOf(vol.PackageDoc.Metadata)); got[1] != "Taro Yamada|art|Yamada, Taro" {
+		t.Fatalf("creators = %q", got)
+	}
+	if r := refinementsOf(vol.PackageDoc.Metadata); len(r["t1"]) != 0 {
+		t.Fatalf("title refinements not removed: %+v", r["t1"])
+	}
+
+	bad := MetadataPatch{Refines: map[string][]Refinement{"nope": {{Property: "role", Value: "aut"}}}}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: bad}); err == nil {
+		t.Fatal("expected a refinement of a missing element to be rejected")
+	}
+}
@@ -0,0 +1,193 @@
+package epub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotCached is matched by errors for a remote input that offline mode
+// cannot serve because it was never downloaded.
+var ErrNotCached = errors.New("not in the download cache")
+
+// RemoteOptions configures how FetchRemote downloads books.
+type RemoteOptions struct {
+	// CacheDir holds the downloads; empty means novfmt/remote under the
+	// user's cache directory.
+	CacheDir string
+	// Offline serves books from the cache without contacting the server.
+	Offline bool
+	// Client defaults to one with a generous timeout.
+	Client *http.Client
+}
+
+// RemoteFetch describes how FetchRemote got a book.
+type RemoteFetch struct {
+	URL string `json:"url"`
+	// Path is the cached copy to read.
+	Path string `json:"path"`
+	// Status is "downloaded", "revalidated" when the server confirmed the
+	// cached copy, or "cached" when offline mode used it unchecked.
+	Status string `json:"status"`
+}
+
+// remoteEntry is the sidecar FetchRemote keeps next to each download.
+type remoteEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+var defaultRemoteClient = &http.Client{Timeout: 10 * time.Minute}
+
+// IsRemote reports whether an input names an http or https URL rather than
+// a file.
+func IsRemote(input string) bool {
+	u, err := url.Parse(input)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// FetchRemote downloads the book at rawURL into the cache, or reuses the
+// cached copy when the server reports it unchanged, going by its ETag or
+// modification time.
+func FetchRemote(ctx context.Context, rawURL string, opts RemoteOptions) (RemoteFetch, error) {
+	fetch := RemoteFetch{URL: rawURL}
+	dir, err := remoteCacheDir(opts.CacheDir)
+	if err != nil {
+		return fetch, err
+	}
+	fetch.Path = filepath.Join(dir, remoteCacheName(rawURL))
+	sidecar := fetch.Path + ".json"
+
+	var entry remoteEntry
+	cached := false
+	if data, err := os.ReadFile(sidecar); err == nil && json.Unmarshal(data, &entry) == nil && entry.URL == rawURL {
+		_, err := os.Stat(fetch.Path)
+		cached = err == nil
+	}
+	if opts.Offline {
+		if !cached {
+			return fetch, fmt.Errorf("%s: %w", rawURL, ErrNotCached)
+		}
+		fetch.Status = "cached"
+		return fetch, nil
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = defaultRemoteClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fetch, err
+	}
+	req.Header.Set("User-Agent", "novfmt (https://github.com/kototok903/novfmt)")
+	if cached {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetch, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		fetch.Status = "revalidated"
+		return fetch, nil
+	case resp.StatusCode != http.StatusOK:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return fetch, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+
+	tmp, err := createTempFile(dir, ".download-*")
+	if err != nil {
+		return fetch, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fetch, fmt.Errorf("download %s: %w", rawURL, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fetch, err
+	}
+	if err := renameOver(tmp.Name(), fetch.Path); err != nil {
+		return fetch, err
+	}
+	entry = remoteEntry{
+		URL:          rawURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fetch, err
+	}
+	if err := os.WriteFile(sidecar, data, 0o644); err != nil {
+		return fetch, err
+	}
+	fetch.Status = "downloaded"
+	return fetch, nil
+}
+
+func remoteCacheDir(dir string) (string, error) {
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("no cache directory; give one: %w", err)
+		}
+		dir = filepath.Join(base, "novfmt", "remote")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// remoteCacheName names the cached copy of a URL: a hash of the URL, so
+// that different servers' book.epub do not collide, followed by the file
+// name for anyone browsing the cache.
+func remoteCacheName(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	name := "book.epub"
+	if u, err := url.Parse(rawURL); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			name = sanitizeFileName(base)
+		}
+	}
+	if !strings.EqualFold(path.Ext(name), ".epub") {
+		name += ".epub"
+	}
+	return hex.EncodeToString(sum[:8]) + "-" + name
+}
+
+// sanitizeFileName replaces characters that are not safe in file names on
+// common systems.
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r < ' ', strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+}
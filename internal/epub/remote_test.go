@@ -0,0 +1,85 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFetchRemote(t *testing.T) {
+	ctx := context.Background()
+	body := "version one"
+	etag := `"v1"`
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone.epub" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	opts := RemoteOptions{CacheDir: t.TempDir()}
+	u := srv.URL + "/books/Vol%201.epub"
+	if _, err := FetchRemote(ctx, u, RemoteOptions{CacheDir: opts.CacheDir, Offline: true}); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("offline before download: %v", err)
+	}
+
+	fetch, err := FetchRemote(ctx, u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetch.Status != "downloaded" || !strings.HasSuffix(fetch.Path, "-Vol 1.epub") {
+		t.Fatalf("fetch = %+v", fetch)
+	}
+
+	fetch, err = FetchRemote(ctx, u, opts)
+	if err != nil || fetch.Status != "revalidated" || notModified != 1 {
+		t.Fatalf("second fetch = %+v, %v (%d not modified)", fetch, err, notModified)
+	}
+
+	body, etag = "version two", `"v2"`
+	fetch, err = FetchRemote(ctx, u, opts)
+	if err != nil || fetch.Status != "downloaded" {
+		t.Fatalf("changed fetch = %+v, %v", fetch, err)
+	}
+	if data, _ := os.ReadFile(fetch.Path); string(data) != "version two" {
+		t.Fatalf("cached copy = %q", data)
+	}
+
+	fetch, err = FetchRemote(ctx, u, RemoteOptions{CacheDir: opts.CacheDir, Offline: true})
+	if err != nil || fetch.Status != "cached" || requests != 3 {
+		t.Fatalf("offline fetch = %+v, %v (%d requests)", fetch, err, requests)
+	}
+
+	if _, err := FetchRemote(ctx, srv.URL+"/gone.epub", opts); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("missing book: %v", err)
+	}
+}
+
+func TestIsRemote(t *testing.T) {
+	for in, want := range map[string]bool{
+		"https://nas.local/books/v1.epub": true,
+		"http://192.168.1.2:8080/a.epub":  true,
+		"ftp://host/a.epub":               false,
+		"books/v1.epub":                   false,
+		`C:\books\v1.epub`:                false,
+		"http:/v1.epub":                   false,
+	} {
+		if got := IsRemote(in); got != want {
+			t.Errorf("IsRemote(%q) = %v", in, got)
+		}
+	}
+}
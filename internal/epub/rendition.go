@@ -0,0 +1,266 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// The EPUB 3 rendition properties, which fixed-layout books such as manga
+// and picture books use to ask for one page per screen. Each has a default
+// that an absent meta means.
+const (
+	propRenditionLayout      = "rendition:layout"
+	propRenditionOrientation = "rendition:orientation"
+	propRenditionSpread      = "rendition:spread"
+	propRenditionFlow        = "rendition:flow"
+)
+
+// renditionProps lists the rendition properties with their default values
+// and the values EPUB 3 allows.
+var renditionProps = []struct {
+	prop, def string
+	values    map[string]bool
+}{
+	{propRenditionLayout, "reflowable", vocabulary("reflowable pre-paginated")},
+	{propRenditionOrientation, "auto", vocabulary("auto landscape portrait")},
+	{propRenditionSpread, "auto", vocabulary("auto both landscape none portrait")},
+	{propRenditionFlow, "auto", vocabulary("auto paginated scrolled-continuous scrolled-doc")},
+}
+
+// rendition holds a book's rendition settings, by property; a property
+// left at its default is absent.
+type rendition map[string]string
+
+// fixedLayout reports whether the settings ask for pre-paginated pages.
+func (r rendition) fixedLayout() bool {
+	return r[propRenditionLayout] == "pre-paginated"
+}
+
+// renditionOf reads the package-wide rendition settings of meta. Metas that
+// refine another element are not package-wide and are skipped.
+func renditionOf(meta Metadata) rendition {
+	r := rendition{}
+	for _, m := range meta.Meta {
+		if m.Refines != "" {
+			continue
+		}
+		for _, p := range renditionProps {
+			if m.Property == p.prop {
+				if v := strings.TrimSpace(m.Value); v != "" && v != p.def {
+					r[p.prop] = v
+				}
+			}
+		}
+	}
+	return r
+}
+
+// setRendition replaces the package-wide rendition metas of meta with
+// r's, leaving out defaults.
+func setRendition(meta *Metadata, r rendition) {
+	kept := meta.Meta[:0]
+	for _, m := range meta.Meta {
+		if m.Refines != "" || renditionDefault(m.Property) == "" {
+			kept = append(kept, m)
+		}
+	}
+	meta.Meta = kept
+	for _, p := range renditionProps {
+		if v := r[p.prop]; v != "" && v != p.def {
+			meta.Meta = append(meta.Meta, MetaNode{Property: p.prop, Value: v})
+		}
+	}
+}
+
+// renditionDefault returns the default value of a rendition property, or ""
+// for a property that is not one.
+func renditionDefault(prop string) string {
+	for _, p := range renditionProps {
+		if p.prop == prop {
+			return p.def
+		}
+	}
+	return ""
+}
+
+// checkRendition checks a value of a rendition property; "" stands for
+// the default.
+func checkRendition(prop, value string) error {
+	for _, p := range renditionProps {
+		if p.prop != prop {
+			continue
+		}
+		if value != "" && !p.values[value] {
+			return fmt.Errorf("%s: unknown value %q", prop, value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rendition property %q", prop)
+}
+
+// itemRendition returns the rendition of a spine item: the book's, with
+// the item's own rendition:<property>-<value> overrides.
+func itemRendition(book rendition, ref SpineItemRef) rendition {
+	r := rendition{}
+	for k, v := range book {
+		r[k] = v
+	}
+	for _, p := range renditionProps {
+		for _, prop := range strings.Fields(ref.Properties) {
+			v, ok := strings.CutPrefix(prop, p.prop+"-")
+			if !ok || !p.values[v] {
+				continue
+			}
+			if v == p.def {
+				delete(r, p.prop)
+			} else {
+				r[p.prop] = v
+			}
+		}
+	}
+	return r
+}
+
+// overrideRendition makes every spine item of vol render as it did in vol
+// inside a book whose rendition is book, adding itemref overrides where
+// the two differ. It reports whether it changed anything.
+func overrideRendition(vol *Volume, book rendition) bool {
+	own := renditionOf(vol.PackageDoc.Metadata)
+	changed := false
+	refs := vol.PackageDoc.Spine.Itemrefs
+	for i := range refs {
+		want := itemRendition(own, refs[i])
+		for _, p := range renditionProps {
+			if want[p.prop] == book[p.prop] || hasItemOverride(refs[i], p.prop) {
+				continue
+			}
+			v := want[p.prop]
+			if v == "" {
+				v = p.def
+			}
+			refs[i].Properties = addProperty(refs[i].Properties, p.prop+"-"+v)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// hasItemOverride reports whether a spine item overrides prop itself.
+func hasItemOverride(ref SpineItemRef, prop string) bool {
+	for _, p := range strings.Fields(ref.Properties) {
+		if strings.HasPrefix(p, prop+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameRendition reports whether two rendition settings are the same.
+func sameRendition(a, b rendition) bool {
+	for _, p := range renditionProps {
+		if a[p.prop] != b[p.prop] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergedRendition picks the rendition of a book made from volumes: the
+// first volume's, as long as they share a layout. Fixed-layout and
+// reflowable volumes only merge with mixed set, into a reflowable book;
+// otherwise it fails. Volumes that differ from the book keep their
+// rendition through spine item overrides.
+func mergedRendition(volumes []*Volume, mixed bool, log *slog.Logger) (rendition, error) {
+	if len(volumes) == 0 {
+		return rendition{}, nil
+	}
+	book := renditionOf(volumes[0].PackageDoc.Metadata)
+	var fixed, reflowable []string
+	agree := true
+	for _, vol := range volumes {
+		r := renditionOf(vol.PackageDoc.Metadata)
+		if r.fixedLayout() {
+			fixed = append(fixed, vol.SourcePath)
+		} else {
+			reflowable = append(reflowable, vol.SourcePath)
+		}
+		agree = agree && sameRendition(r, book)
+	}
+	if len(fixed) > 0 && len(reflowable) > 0 {
+		if !mixed {
+			return nil, fmt.Errorf("cannot merge fixed-layout volumes (%s) with reflowable ones (%s) without allowing mixed layouts",
+				strings.Join(fixed, ", "), strings.Join(reflowable, ", "))
+		}
+		log.Warn("merging fixed-layout and reflowable volumes; the fixed-layout pages keep their layout through spine overrides, which not every reader supports",
+			"fixed", len(fixed), "reflowable", len(reflowable))
+		book = rendition{}
+	}
+	if !agree {
+		for _, vol := range volumes {
+			if overrideRendition(vol, book) {
+				log.Info("volume keeps its own rendition settings", "volume", vol.SourcePath)
+			}
+		}
+	}
+	return book, nil
+}
+
+// titlePageRef returns the spine item of a generated title page, which is
+// reflowable even in a fixed-layout book.
+func titlePageRef(id string, book rendition) SpineItemRef {
+	ref := SpineItemRef{IDRef: id}
+	if book.fixedLayout() {
+		ref.Properties = propRenditionLayout + "-reflowable"
+	}
+	return ref
+}
+
+// renditionPatch pairs the rendition fields of a patch with their
+// properties.
+func renditionPatch(p MetadataPatch) map[string]*string {
+	return map[string]*string{
+		propRenditionLayout:      p.RenditionLayout,
+		propRenditionOrientation: p.RenditionOrientation,
+		propRenditionSpread:      p.RenditionSpread,
+		propRenditionFlow:        p.RenditionFlow,
+	}
+}
+
+// validateRendition checks the patch's rendition values.
+func validateRendition(p MetadataPatch) error {
+	for prop, v := range renditionPatch(p) {
+		if v == nil {
+			continue
+		}
+		if err := checkRendition(prop, strings.TrimSpace(*v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRenditionPatch replaces the rendition settings the patch sets.
+// They only exist in EPUB 3, so an EPUB 2 package is an error.
+func applyRenditionPatch(pkg *PackageDocument, p MetadataPatch) (bool, error) {
+	r := renditionOf(pkg.Metadata)
+	changed := false
+	for prop, v := range renditionPatch(p) {
+		if v == nil {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(pkg.Version), "2") {
+			return false, fmt.Errorf("rendition settings need an EPUB 3 package (this one is EPUB %s)", pkg.Version)
+		}
+		if value := strings.TrimSpace(*v); value == "" || value == renditionDefault(prop) {
+			delete(r, prop)
+		} else {
+			r[prop] = value
+		}
+		changed = true
+	}
+	if changed {
+		setRendition(&pkg.Metadata, r)
+	}
+	return changed, nil
+}
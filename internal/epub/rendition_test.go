@@ -0,0 +1,139 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildRenditionVolume(t *testing.T, metas string) string {
+	t.Helper()
+	page := `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>p</title><meta name="viewport" content="width=1072, height=1448"/></head><body><p>page</p></body></html>`
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:rendition</dc:identifier>
+    <dc:title>Volume</dc:title>
+    <dc:language>ja</dc:language>
+    ` + metas + `
+  </metadata>
+  <manifest>
+    <item id="p1" href="p1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p2" href="p2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="p1" properties="page-spread-left"/>
+    <itemref idref="p2" properties="page-spread-right"/>
+  </spine>
+</package>
+`,
+		"OEBPS/p1.xhtml": page,
+		"OEBPS/p2.xhtml": page,
+	})
+}
+
+func TestMergeRendition(t *testing.T) {
+	ctx := context.Background()
+	fixed := buildRenditionVolume(t, `<meta property="rendition:layout">pre-paginated</meta>
+    <meta property="rendition:spread">landscape</meta>`)
+	reflowable := buildRenditionVolume(t, "")
+
+	load := func(path string) *Volume {
+		t.Helper()
+		vol, err := loadVolume(ctx, 0, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(vol.TempDir) })
+		return vol
+	}
+	props := func(vol *Volume) string {
+		var out []string
+		for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+			out = append(out, ref.Properties)
+		}
+		return strings.Join(out, "|")
+	}
+
+	out := filepath.Join(t.TempDir(), "fixed.epub")
+	if err := MergeEPUBs(ctx, []string{fixed, fixed}, MergeOptions{OutPath: out}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	vol := load(out)
+	if r := renditionOf(vol.PackageDoc.Metadata); !r.fixedLayout() || r[propRenditionSpread] != "landscape" {
+		t.Fatalf("rendition = %v", r)
+	}
+	if got := props(vol); got != "page-spread-left|page-spread-right|page-spread-left|page-spread-right" {
+		t.Fatalf("spine properties = %s", got)
+	}
+
+	out = filepath.Join(t.TempDir(), "mixed.epub")
+	err := MergeEPUBs(ctx, []string{reflowable, fixed}, MergeOptions{OutPath: out})
+	if err == nil || !strings.Contains(err.Error(), "fixed-layout") {
+		t.Fatalf("mixed layouts merged: %v", err)
+	}
+	if err := MergeEPUBs(ctx, []string{reflowable, fixed}, MergeOptions{OutPath: out, MixedLayout: true}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	vol = load(out)
+	if r := renditionOf(vol.PackageDoc.Metadata); len(r) != 0 {
+		t.Fatalf("rendition = %v", r)
+	}
+	want := "page-spread-left|page-spread-right|" +
+		"page-spread-left rendition:layout-pre-paginated rendition:spread-landscape|" +
+		"page-spread-right rendition:layout-pre-paginated rendition:spread-landscape"
+	if got := props(vol); got != want {
+		t.Fatalf("spine properties = %s, want %s", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0002", "p1.xhtml"))
+	if err != nil || !strings.Contains(string(data), `name="viewport"`) {
+		t.Fatalf("viewport lost: %s, %v", data, err)
+	}
+}
+
+func TestEditRendition(t *testing.T) {
+	ctx := context.Background()
+	input := buildRenditionVolume(t, "")
+	layout, spread := "pre-paginated", "none"
+	patch := MetadataPatch{RenditionLayout: &layout, RenditionSpread: &spread}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: patch}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	dump := filepath.Join(t.TempDir(), "meta.json")
+	if _, err := EditEPUB(ctx, input, EditOptions{DumpMetaPath: dump}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot MetadataSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.RenditionLayout != "pre-paginated" || snapshot.RenditionSpread != "none" || snapshot.RenditionOrientation != "" {
+		t.Fatalf("snapshot = %s", data)
+	}
+
+	layout = ""
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{RenditionLayout: &layout}}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if r := renditionOf(vol.PackageDoc.Metadata); len(r) != 1 || r[propRenditionSpread] != "none" {
+		t.Fatalf("rendition = %v", r)
+	}
+
+	bad := "fixed"
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{RenditionLayout: &bad}}); err == nil {
+		t.Fatal("unknown layout accepted")
+	}
+}
@@ -0,0 +1,325 @@
+package epub
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	refAttrPattern = regexp.MustCompile(`(?i)(\b(?:xlink:)?(?:href|src)\s*=\s*)("[^"]*"|'[^']*')`)
+	cssURLPattern  = regexp.MustCompile(`(?i)(url\(\s*)("[^"]*"|'[^']*'|[^)\s"']*)(\s*\))`)
+	// smilRefPattern finds the text and audio a media overlay plays.
+	smilRefPattern = regexp.MustCompile(`(?i)(\b(?:src|epub:textref)\s*=\s*)("[^"]*"|'[^']*')`)
+)
+
+// repairManifest makes manifest ids and hrefs unique so later steps can map
+// between them safely. Fixes are deterministic and made in document order:
+//
+//   - an id used again is renamed with a numeric suffix; references keep
+//     pointing at the first item with that id;
+//   - an item repeating an earlier href, or naming the same file with
+//     different case, is dropped and references to its id are moved to the
+//     earlier item;
+//   - a distinct file whose href differs from an earlier one only by case is
+//     renamed with a numeric suffix and links to it are updated.
+//
+// extracted maps package-relative names of archive entries that unzip had
+// to store under another name to that name; items and links are pointed at
+// it. It returns a description of each fix.
+func repairManifest(pkg *PackageDocument, pkgDir string, extracted map[string]string) ([]string, error) {
+	var fixes []string
+	renamed := map[string]string{}
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		href := normalizeEPUBPath(item.Href)
+		if to, ok := extracted[href]; ok {
+			fixes = append(fixes, fmt.Sprintf("kept %q as %q: its name differs from another archive entry only by case", item.Href, to))
+			item.Href = to
+			renamed[href] = to
+		}
+	}
+
+	ids := map[string]bool{}
+	for _, item := range pkg.Manifest.Items {
+		ids[item.ID] = true
+	}
+	seenID := map[string]bool{}
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		if !seenID[item.ID] {
+			seenID[item.ID] = true
+			continue
+		}
+		newID := item.ID
+		for n := 2; ids[newID]; n++ {
+			newID = fmt.Sprintf("%s-%d", item.ID, n)
+		}
+		ids[newID] = true
+		seenID[newID] = true
+		fixes = append(fixes, fmt.Sprintf("renamed duplicate manifest id %q to %q (%s)", item.ID, newID, item.Href))
+		item.ID = newID
+	}
+
+	idRemap := map[string]string{}
+	byHref := map[string]ManifestItem{}
+	byFold := map[string]ManifestItem{}
+	hrefTaken := map[string]bool{}
+	for _, item := range pkg.Manifest.Items {
+		hrefTaken[strings.ToLower(normalizeEPUBPath(item.Href))] = true
+	}
+	kept := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		href := normalizeEPUBPath(item.Href)
+		fold := strings.ToLower(href)
+		if first, ok := byHref[href]; ok {
+			idRemap[item.ID] = first.ID
+			fixes = append(fixes, fmt.Sprintf("dropped manifest item %q repeating href %q of %q", item.ID, item.Href, first.ID))
+			continue
+		}
+		first, ok := byFold[fold]
+		if !ok {
+			byHref[href] = item
+			byFold[fold] = item
+			kept = append(kept, item)
+			continue
+		}
+		if sameFile(filepath.Join(pkgDir, filepath.FromSlash(href)), filepath.Join(pkgDir, filepath.FromSlash(normalizeEPUBPath(first.Href)))) {
+			idRemap[item.ID] = first.ID
+			fixes = append(fixes, fmt.Sprintf("dropped manifest item %q: href %q names the same file as %q", item.ID, item.Href, first.Href))
+			continue
+		}
+		newHref := uniqueName(href, func(s string) bool { return hrefTaken[strings.ToLower(s)] })
+		if err := os.Rename(filepath.Join(pkgDir, filepath.FromSlash(href)), filepath.Join(pkgDir, filepath.FromSlash(newHref))); err != nil {
+			return nil, err
+		}
+		hrefTaken[strings.ToLower(newHref)] = true
+		renamed[href] = newHref
+		fixes = append(fixes, fmt.Sprintf("renamed %q to %q: its href differs from %q only by case", item.Href, newHref, first.Href))
+		item.Href = newHref
+		byHref[newHref] = item
+		byFold[strings.ToLower(newHref)] = item
+		kept = append(kept, item)
+	}
+	pkg.Manifest.Items = kept
+
+	if len(idRemap) > 0 {
+		for i := range pkg.Spine.Itemrefs {
+			if id, ok := idRemap[pkg.Spine.Itemrefs[i].IDRef]; ok {
+				pkg.Spine.Itemrefs[i].IDRef = id
+			}
+		}
+		for i := range pkg.Manifest.Items {
+			if id, ok := idRemap[pkg.Manifest.Items[i].Fallback]; ok {
+				pkg.Manifest.Items[i].Fallback = id
+			}
+		}
+		for i := range pkg.Metadata.Meta {
+			m := &pkg.Metadata.Meta[i]
+			if id, ok := idRemap[m.Content]; ok && strings.EqualFold(m.Name, "cover") {
+				m.Content = id
+			}
+		}
+	}
+
+	if len(renamed) > 0 {
+		_, err := rewriteReferences(pkgDir, pkg, func(target string) (string, bool) {
+			newHref, ok := renamed[target]
+			return newHref, ok
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fixes, nil
+}
+
+// rewriteReferences updates href/src attributes in the XHTML, SVG and NCX
+// documents and url() references in the stylesheets of pkg. fn receives each
+// local target resolved to a package-relative path and returns its new
+// package-relative path. It returns the hrefs of the files it changed.
+func rewriteReferences(pkgDir string, pkg *PackageDocument, fn func(target string) (string, bool)) ([]string, error) {
+	var changedHrefs []string
+	for _, item := range pkg.Manifest.Items {
+		pattern := referencePattern(item.MediaType)
+		if pattern == nil {
+			continue
+		}
+		p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		dir := path.Dir(normalizeEPUBPath(item.Href))
+		out, changed := rewriteRefs(string(data), pattern, dir, dir, fn)
+		if changed {
+			if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+				return nil, err
+			}
+			changedHrefs = append(changedHrefs, item.Href)
+		}
+	}
+	return changedHrefs, nil
+}
+
+// referencePattern returns the pattern that finds references in files of
+// mediaType, or nil for files without references.
+func referencePattern(mediaType string) *regexp.Regexp {
+	switch mediaType {
+	case "application/xhtml+xml", "image/svg+xml", "application/x-dtbncx+xml":
+		return refAttrPattern
+	case "text/css":
+		return cssURLPattern
+	case "application/smil+xml":
+		return smilRefPattern
+	}
+	return nil
+}
+
+// rewriteRefs applies fn to the local references pattern finds in text.
+// Targets are resolved against fromDir and rewritten relative to toDir,
+// which differ for a file that moves.
+func rewriteRefs(text string, pattern *regexp.Regexp, fromDir, toDir string, fn func(target string) (string, bool)) (string, bool) {
+	changed := false
+	out := pattern.ReplaceAllStringFunc(text, func(m string) string {
+		sub := pattern.FindStringSubmatch(m)
+		raw := strings.Trim(sub[2], `"'`)
+		if raw == "" || strings.HasPrefix(raw, "#") || strings.Contains(raw, ":") {
+			return m
+		}
+		target, frag, hasFrag := strings.Cut(raw, "#")
+		newTarget, ok := fn(normalizeEPUBPath(path.Join(fromDir, target)))
+		if !ok {
+			return m
+		}
+		changed = true
+		ref := relativeHref(toDir, newTarget)
+		if hasFrag {
+			ref += "#" + frag
+		}
+		quote := `"`
+		if strings.HasPrefix(sub[2], "'") {
+			quote = "'"
+		}
+		rest := ""
+		if len(sub) > 3 {
+			rest = sub[3]
+		}
+		return sub[1] + quote + ref + quote + rest
+	})
+	return out, changed
+}
+
+// rewriteAnchoredRefs is rewriteReferences for changes that depend on the
+// fragment: fn receives each local target with its fragment (empty when
+// the link has none) and returns the new target and fragment. A link to
+// "#id" targets its own file, or origins[file] for a file cut out of
+// another. Links to the file they are in come out as "#id".
+func rewriteAnchoredRefs(pkgDir string, pkg *PackageDocument, origins map[string]string, fn func(target, frag string) (string, string, bool)) ([]string, error) {
+	var changedHrefs []string
+	for _, item := range pkg.Manifest.Items {
+		pattern := referencePattern(item.MediaType)
+		if pattern == nil {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		p := filepath.Join(pkgDir, filepath.FromSlash(href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		self := href
+		if origin, ok := origins[href]; ok {
+			self = origin
+		}
+		dir := path.Dir(href)
+		changed := false
+		out := pattern.ReplaceAllStringFunc(string(data), func(m string) string {
+			sub := pattern.FindStringSubmatch(m)
+			raw := strings.Trim(sub[2], `"'`)
+			target, frag, _ := strings.Cut(raw, "#")
+			if raw == "" || strings.Contains(target, ":") {
+				return m
+			}
+			resolved := self
+			if target != "" {
+				resolved = normalizeEPUBPath(path.Join(dir, target))
+			}
+			newTarget, newFrag, ok := fn(resolved, frag)
+			if !ok {
+				return m
+			}
+			ref := ""
+			if newTarget != href || newFrag == "" {
+				ref = relativeHref(dir, newTarget)
+			}
+			if newFrag != "" {
+				ref += "#" + newFrag
+			}
+			if ref == raw {
+				return m
+			}
+			changed = true
+			quote := `"`
+			if strings.HasPrefix(sub[2], "'") {
+				quote = "'"
+			}
+			rest := ""
+			if len(sub) > 3 {
+				rest = sub[3]
+			}
+			return sub[1] + quote + ref + quote + rest
+		})
+		if changed {
+			if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+				return nil, err
+			}
+			changedHrefs = append(changedHrefs, href)
+		}
+	}
+	return changedHrefs, nil
+}
+
+// uniqueName appends -2, -3, ... before the extension of name until taken
+// reports false.
+func uniqueName(name string, taken func(string) bool) string {
+	ext := path.Ext(name)
+	if strings.Contains(ext, "/") {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// sameFile reports whether a and b name the same file on disk, or whether
+// only one of them exists (an href with the wrong case).
+func sameFile(a, b string) bool {
+	ai, errA := os.Stat(a)
+	bi, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return true
+	}
+	return os.SameFile(ai, bi)
+}
+
+// logRepairs reports the fixes made while loading vol.
+func logRepairs(log *slog.Logger, vol *Volume) {
+	for _, fix := range vol.Repairs {
+		log.Warn("repaired package", "book", vol.SourcePath, "fix", fix)
+	}
+}
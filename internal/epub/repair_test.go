@@ -0,0 +1,164 @@
+package epub
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadVolumeRepairsManifest(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:repair</dc:identifier>
+    <dc:title>Repair</dc:title>
+    <dc:language>en</dc:language>
+    <meta name="cover" content="cover2"/>
+  </metadata>
+  <manifest>
+    <item id="ch" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1again" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="cover" href="Images/Pic.png" media-type="image/png"/>
+    <item id="cover2" href="Images/pic.png" media-type="image/png"/>
+    <item id="wrongcase" href="text/CH2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch"/>
+    <itemref idref="ch1again"/>
+    <itemref idref="wrongcase"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><img src="../Images/Pic.png"/><img src='../Images/pic.png'/></body></html>`,
+		"OEBPS/Text/ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Two</p></body></html>`,
+		"OEBPS/Images/Pic.png": "upper",
+		"OEBPS/Images/pic.png": "lower",
+	})
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("loadVolume: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	if len(vol.Repairs) != 4 {
+		t.Fatalf("expected 4 repairs, got %d:\n%s", len(vol.Repairs), strings.Join(vol.Repairs, "\n"))
+	}
+
+	var ids, hrefs []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		ids = append(ids, item.ID)
+		hrefs = append(hrefs, item.Href)
+	}
+	if strings.Join(ids, ",") != "ch,ch-2,cover,cover2" {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+	if strings.Join(hrefs, ",") != "Text/ch1.xhtml,Text/ch2.xhtml,Images/Pic.png,Images/pic-2.png" {
+		t.Fatalf("unexpected hrefs: %v", hrefs)
+	}
+
+	var spine []string
+	for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+		spine = append(spine, ref.IDRef)
+	}
+	// "wrongcase" names ch2.xhtml, which now has id ch-2.
+	if strings.Join(spine, ",") != "ch,ch,ch-2" {
+		t.Fatalf("unexpected spine: %v", spine)
+	}
+
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "Images", "pic-2.png"))
+	if err != nil || string(data) != "lower" {
+		t.Fatalf("renamed file: %q, %v", data, err)
+	}
+	chapter, err := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(chapter), `src="../Images/Pic.png"`) || !strings.Contains(string(chapter), `src='../Images/pic-2.png'`) {
+		t.Fatalf("references not updated:\n%s", chapter)
+	}
+
+	reloaded, err := os.ReadFile(vol.PackagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(reloaded), `id="ch1again"`) {
+		t.Fatalf("repaired package not written back:\n%s", reloaded)
+	}
+}
+
+func TestUnzipKeepsCaseCollidingEntries(t *testing.T) {
+	// Built directly so the test also runs on case-insensitive filesystems.
+	src := filepath.Join(t.TempDir(), "collide.epub")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range [][2]string{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"OEBPS/content.opf", `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>C</dc:title></metadata><manifest><item id="a" href="Images/image.jpg" media-type="image/jpeg"/><item id="b" href="Images/Image.jpg" media-type="image/jpeg"/><item id="ch" href="ch.xhtml" media-type="application/xhtml+xml"/></manifest><spine><itemref idref="ch"/></spine></package>`},
+		{"OEBPS/Images/Image.jpg", "upper"},
+		{"OEBPS/Images/image.jpg", "lower"},
+		{"OEBPS/ch.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><body><img src="Images/Image.jpg"/><img src="Images/image.jpg"/></body></html>`},
+	} {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	vol, err := loadVolume(context.Background(), 0, src)
+	if err != nil {
+		t.Fatalf("loadVolume: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	hrefs := map[string]string{}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		hrefs[item.ID] = item.Href
+	}
+	if hrefs["a"] != "Images/image-2.jpg" || hrefs["b"] != "Images/Image.jpg" {
+		t.Fatalf("unexpected hrefs: %v", hrefs)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.epub")
+	if err := saveVolume(context.Background(), vol, out, nil); err != nil {
+		t.Fatalf("saveVolume: %v", err)
+	}
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents := map[string]string{}
+	for _, zf := range r.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[zf.Name] = string(data)
+	}
+	if contents["OEBPS/Images/Image.jpg"] != "upper" || contents["OEBPS/Images/image-2.jpg"] != "lower" {
+		t.Fatalf("both images should survive, got entries %v", contents)
+	}
+	if !strings.Contains(contents["OEBPS/ch.xhtml"], `src="Images/image-2.jpg"`) || !strings.Contains(contents["OEBPS/ch.xhtml"], `src="Images/Image.jpg"`) {
+		t.Fatalf("links not updated: %s", contents["OEBPS/ch.xhtml"])
+	}
+}
@@ -0,0 +1,219 @@
+package epub
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// replaceFuncs are the transforms a regex rule's replacement may apply to
+// a group, as in ${name|upper} or ${1|kana2romaji|title}.
+var replaceFuncs = map[string]func(string) string{
+	"upper":       strings.ToUpper,
+	"lower":       strings.ToLower,
+	"title":       titleCase,
+	"kana2romaji": kanaToRomaji,
+}
+
+// replaceFuncRE finds group references with transforms in a replacement.
+var replaceFuncRE = regexp.MustCompile(`\$\{(\w+)((?:\|\w+)+)\}`)
+
+// replaceTemplate is a replacement with transforms, in pieces: plain
+// templates expanded by the regexp package, and transformed groups.
+type replaceTemplate []replacePiece
+
+type replacePiece struct {
+	// tmpl is a plain template, used when group is empty.
+	tmpl  string
+	group string
+	funcs []func(string) string
+}
+
+// compileReplaceTemplate splits a regex rule's replacement into pieces. It
+// returns nil when the replacement uses no transforms.
+func compileReplaceTemplate(re *regexp.Regexp, repl string) (replaceTemplate, error) {
+	locs := replaceFuncRE.FindAllStringSubmatchIndex(repl, -1)
+	if len(locs) == 0 {
+		return nil, nil
+	}
+	var t replaceTemplate
+	last := 0
+	for _, m := range locs {
+		// "$${x|upper}" is a literal "$" followed by "{x|upper}".
+		if dollars := len(repl[:m[0]]) - len(strings.TrimRight(repl[:m[0]], "$")); dollars%2 == 1 {
+			continue
+		}
+		group := repl[m[2]:m[3]]
+		if !hasGroup(re, group) {
+			return nil, fmt.Errorf("replacement %q: no group %q", repl, group)
+		}
+		p := replacePiece{group: group}
+		for _, name := range strings.Split(repl[m[4]+1:m[5]], "|") {
+			f, ok := replaceFuncs[name]
+			if !ok {
+				return nil, fmt.Errorf("replacement %q: unknown function %q (want upper, lower, title or kana2romaji)", repl, name)
+			}
+			p.funcs = append(p.funcs, f)
+		}
+		t = append(t, replacePiece{tmpl: repl[last:m[0]]}, p)
+		last = m[1]
+	}
+	if len(t) == 0 {
+		return nil, nil
+	}
+	return append(t, replacePiece{tmpl: repl[last:]}), nil
+}
+
+func hasGroup(re *regexp.Regexp, name string) bool {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n >= 0 && n <= re.NumSubexp()
+	}
+	return re.SubexpIndex(name) >= 0
+}
+
+// expand returns the replacement for the match m in s.
+func (t replaceTemplate) expand(re *regexp.Regexp, s string, m []int) string {
+	var out []byte
+	for _, p := range t {
+		if p.group == "" {
+			out = re.ExpandString(out, p.tmpl, s, m)
+			continue
+		}
+		v := string(re.ExpandString(nil, "${"+p.group+"}", s, m))
+		for _, f := range p.funcs {
+			v = f(v)
+		}
+		out = append(out, v...)
+	}
+	return string(out)
+}
+
+// titleCase capitalizes the first letter of every word and lowers the
+// rest.
+func titleCase(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWord := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) && !inWord:
+			b.WriteRune(unicode.ToTitle(r))
+			inWord = true
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '’':
+			b.WriteRune(unicode.ToLower(r))
+			inWord = true
+		default:
+			b.WriteRune(r)
+			inWord = false
+		}
+	}
+	return b.String()
+}
+
+// kanaRomaji is the Hepburn romanization of each hiragana syllable; the
+// two-kana entries are the contracted sounds.
+var kanaRomaji = map[string]string{
+	"あ": "a", "い": "i", "う": "u", "え": "e", "お": "o",
+	"か": "ka", "き": "ki", "く": "ku", "け": "ke", "こ": "ko",
+	"さ": "sa", "し": "shi", "す": "su", "せ": "se", "そ": "so",
+	"た": "ta", "ち": "chi", "つ": "tsu", "て": "te", "と": "to",
+	"な": "na", "に": "ni", "ぬ": "nu", "ね": "ne", "の": "no",
+	"は": "ha", "ひ": "hi", "ふ": "fu", "へ": "he", "ほ": "ho",
+	"ま": "ma", "み": "mi", "む": "mu", "め": "me", "も": "mo",
+	"や": "ya", "ゆ": "yu", "よ": "yo",
+	"ら": "ra", "り": "ri", "る": "ru", "れ": "re", "ろ": "ro",
+	"わ": "wa", "ゐ": "i", "ゑ": "e", "を": "o", "ん": "n",
+	"が": "ga", "ぎ": "gi", "ぐ": "gu", "げ": "ge", "ご": "go",
+	"ざ": "za", "じ": "ji", "ず": "zu", "ぜ": "ze", "ぞ": "zo",
+	"だ": "da", "ぢ": "ji", "づ": "zu", "で": "de", "ど": "do",
+	"ば": "ba", "び": "bi", "ぶ": "bu", "べ": "be", "ぼ": "bo",
+	"ぱ": "pa", "ぴ": "pi", "ぷ": "pu", "ぺ": "pe", "ぽ": "po",
+	"ゔ": "vu",
+	"ぁ": "a", "ぃ": "i", "ぅ": "u", "ぇ": "e", "ぉ": "o",
+	"ゃ": "ya", "ゅ": "yu", "ょ": "yo", "ゎ": "wa",
+	"きゃ": "kya", "きゅ": "kyu", "きょ": "kyo",
+	"しゃ": "sha", "しゅ": "shu", "しぇ": "she", "しょ": "sho",
+	"ちゃ": "cha", "ちゅ": "chu", "ちぇ": "che", "ちょ": "cho",
+	"にゃ": "nya", "にゅ": "nyu", "にょ": "nyo",
+	"ひゃ": "hya", "ひゅ": "hyu", "ひょ": "hyo",
+	"みゃ": "mya", "みゅ": "myu", "みょ": "myo",
+	"りゃ": "rya", "りゅ": "ryu", "りょ": "ryo",
+	"ぎゃ": "gya", "ぎゅ": "gyu", "ぎょ": "gyo",
+	"じゃ": "ja", "じゅ": "ju", "じぇ": "je", "じょ": "jo",
+	"ぢゃ": "ja", "ぢゅ": "ju", "ぢょ": "jo",
+	"びゃ": "bya", "びゅ": "byu", "びょ": "byo",
+	"ぴゃ": "pya", "ぴゅ": "pyu", "ぴょ": "pyo",
+	"ふぁ": "fa", "ふぃ": "fi", "ふぇ": "fe", "ふぉ": "fo",
+	"てぃ": "ti", "でぃ": "di", "とぅ": "tu", "どぅ": "du",
+	"うぃ": "wi", "うぇ": "we", "うぉ": "wo",
+	"ゔぁ": "va", "ゔぃ": "vi", "ゔぇ": "ve", "ゔぉ": "vo",
+}
+
+// kanaToRomaji romanizes hiragana and katakana in s by Hepburn, as
+// honorifics and names are written in translations: さん is "san", っ
+// doubles the next consonant, ん before a vowel or y is "n'" and the
+// long vowel mark ー repeats the vowel before it. Other text is kept.
+func kanaToRomaji(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		// Katakana to hiragana; the blocks are parallel.
+		if r >= 'ァ' && r <= 'ヴ' {
+			runes[i] = r - 0x60
+		}
+	}
+	var b strings.Builder
+	geminate := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		var roma string
+		if i+1 < len(runes) {
+			roma = kanaRomaji[string(runes[i:i+2])]
+		}
+		if roma != "" {
+			i++
+		} else {
+			roma = kanaRomaji[string(r)]
+		}
+		switch {
+		case r == 'っ':
+			geminate = true
+			continue
+		case r == 'ー':
+			if out := b.String(); out != "" {
+				last, _ := utf8.DecodeLastRuneInString(out)
+				if strings.ContainsRune("aeiou", last) {
+					b.WriteRune(last)
+				}
+			}
+			continue
+		case roma == "":
+			if geminate {
+				b.WriteRune('っ')
+				geminate = false
+			}
+			b.WriteRune(r)
+			continue
+		}
+		if geminate {
+			if strings.HasPrefix(roma, "ch") {
+				b.WriteByte('t')
+			} else if !strings.ContainsRune("aeiou", rune(roma[0])) {
+				b.WriteByte(roma[0])
+			}
+			geminate = false
+		}
+		if r == 'ん' && i+1 < len(runes) {
+			if next := kanaRomaji[string(runes[i+1])]; next != "" && strings.ContainsRune("aeiouy", rune(next[0])) {
+				roma = "n'"
+			}
+		}
+		b.WriteString(roma)
+	}
+	if geminate {
+		b.WriteRune('っ')
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package epub
+
+import "testing"
+
+func TestReplaceFuncs(t *testing.T) {
+	cases := []struct{ find, replace, in, want string }{
+		{`(?P<name>\w+) (?P<honorific>さん|くん|ちゃん|先輩)`, "${name|title}-${honorific|kana2romaji}", "TANAKA さん and suzuki ちゃん", "Tanaka-san and Suzuki-chan"},
+		{`(\w+)`, "${1|upper}", "abc def", "ABC DEF"},
+		{`(?P<w>\w+)`, "$${w|upper}", "abc", "${w|upper}"},
+		{`(?P<w>\w+)`, "<${w|lower}>$w", "ABC", "<abc>ABC"},
+		{`(?P<k>[\p{Katakana}ー]+)`, "${k|kana2romaji|title}", "トーキョー", "Tookyoo"},
+	}
+	for _, c := range cases {
+		rules, err := compileRules([]RewriteRule{{Find: c.find, Replace: c.replace, Regex: true}})
+		if err != nil {
+			t.Fatalf("compile %q: %v", c.replace, err)
+		}
+		if got, _ := applyRuleToText(c.in, rules[0]); got != c.want {
+			t.Errorf("%q → %q: got %q, want %q", c.in, c.replace, got, c.want)
+		}
+	}
+
+	for _, repl := range []string{"${x|upper}", "${1|shout}"} {
+		if _, err := compileRules([]RewriteRule{{Find: `(\w)`, Replace: repl, Regex: true}}); err == nil {
+			t.Errorf("replacement %q accepted", repl)
+		}
+	}
+}
+
+func TestKanaToRomaji(t *testing.T) {
+	cases := map[string]string{
+		"さん":     "san",
+		"せんぱい":   "senpai",
+		"おにいちゃん": "oniichan",
+		"きょうこ":   "kyouko",
+		"まっちゃ":   "matcha",
+		"がっこう":   "gakkou",
+		"しんいち":   "shin'ichi",
+		"ラーメン":   "raamen",
+		"東京さま":   "東京sama",
+	}
+	for in, want := range cases {
+		if got := kanaToRomaji(in); got != want {
+			t.Errorf("kanaToRomaji(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// UserStylesheetHref is where RestyleOptions.UserCSS is stored, relative to
+// the package document.
+const UserStylesheetHref = "Styles/novfmt-user.css"
+
+// DefaultKeepCSS lists the properties StripCSS keeps by default: alignment,
+// vertical writing, tate-chu-yoko, emphasis dots, ruby layout and text
+// direction.
+var DefaultKeepCSS = []string{
+	"text-align", "writing-mode", "text-orientation", "text-combine",
+	"text-combine-upright", "text-emphasis", "ruby-position", "ruby-align",
+	"direction", "unicode-bidi",
+}
+
+type RestyleOptions struct {
+	// StripCSS removes publisher styling: inline style attributes, <style>
+	// elements and stylesheet rules, except declarations of Keep properties
+	// and rules that style ruby annotations. Stylesheets left empty are
+	// removed.
+	StripCSS bool
+	// Keep lists the properties that survive StripCSS; nil means
+	// DefaultKeepCSS. Vendor-prefixed forms (-epub-, -webkit-) and longhands
+	// (text-emphasis-style for text-emphasis) match too.
+	Keep []string
+	// UserCSS is a stylesheet file copied into the book and linked from every
+	// document after the publisher's, so its rules win.
+	UserCSS  string
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+var (
+	styleAttrPattern = regexp.MustCompile(`(?is)(\s)style\s*=\s*("[^"]*"|'[^']*')`)
+	startTagPattern  = regexp.MustCompile(`(?s)<[A-Za-z][^<>]*>`)
+	styleElemPattern = regexp.MustCompile(`(?is)<style\b[^>]*>(.*?)</style\s*>`)
+	rubySelectorRE   = regexp.MustCompile(`(?i)(^|[\s>+~,(])(ruby|rb|rt|rtc|rp)\b`)
+)
+
+// RestyleEPUB strips publisher CSS and/or injects a user stylesheet. Without
+// OutPath the input is modified in place.
+func RestyleEPUB(ctx context.Context, input string, opts RestyleOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	if !opts.StripCSS && opts.UserCSS == "" {
+		return stats, fmt.Errorf("nothing to do: set StripCSS or UserCSS")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	stats, err = restyleTree(ctx, vol.PackageDir, &vol.PackageDoc.Manifest, opts, log)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range stats.Changeset.Files {
+		if f.Kind != ChangeModified {
+			stats.Changeset.modified(packageHref(vol))
+			break
+		}
+	}
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// restyleTree applies opts to the documents and stylesheets of manifest,
+// whose hrefs are relative to pkgDir. Matches in the stats count edited
+// style attributes, style elements, stylesheets and added links.
+func restyleTree(ctx context.Context, pkgDir string, manifest *Manifest, opts RestyleOptions, log *slog.Logger) (RewriteStats, error) {
+	var stats RewriteStats
+	keep := keepProperty(opts.Keep)
+	record := func(href string, n int, kind string) {
+		if n == 0 {
+			return
+		}
+		stats.FilesChanged++
+		stats.MatchCount += n
+		stats.Files = append(stats.Files, RewriteFileResult{Href: href, Matches: n})
+		stats.Changeset.record(href, kind)
+	}
+
+	userHref := ""
+	if opts.UserCSS != "" {
+		data, err := os.ReadFile(opts.UserCSS)
+		if err != nil {
+			return stats, fmt.Errorf("user stylesheet: %w", err)
+		}
+		userHref = UserStylesheetHref
+		n := len(manifest.Items)
+		ensureManifestItem(manifest, "novfmt-user-css", userHref, "text/css")
+		kind := ChangeModified
+		if len(manifest.Items) > n {
+			kind = ChangeAdded
+		}
+		dest := filepath.Join(pkgDir, filepath.FromSlash(userHref))
+		if old, err := os.ReadFile(dest); err != nil || !bytes.Equal(old, data) || kind == ChangeAdded {
+			if err := ensureParentDir(dest); err != nil {
+				return stats, err
+			}
+			if err := os.WriteFile(dest, data, 0o644); err != nil {
+				return stats, err
+			}
+			record(userHref, 1, kind)
+		}
+	}
+
+	removed := map[string]bool{}
+	if opts.StripCSS {
+		kept := manifest.Items[:0]
+		for _, item := range manifest.Items {
+			if item.MediaType != "text/css" || normalizeEPUBPath(item.Href) == userHref {
+				kept = append(kept, item)
+				continue
+			}
+			p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return stats, err
+			}
+			out := filterCSS(string(data), keep)
+			switch {
+			case strings.TrimSpace(out) == "":
+				removed[normalizeEPUBPath(item.Href)] = true
+				if err := os.Remove(p); err != nil {
+					return stats, err
+				}
+				record(item.Href, 1, ChangeRemoved)
+				continue
+			case out != string(data):
+				if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+					return stats, err
+				}
+				record(item.Href, 1, ChangeModified)
+			}
+			kept = append(kept, item)
+		}
+		manifest.Items = kept
+		log.Info("stripped publisher stylesheets", "removed", len(removed))
+	}
+
+	for i, item := range manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return stats, err
+		}
+		dir := path.Dir(normalizeEPUBPath(item.Href))
+		doc, n := string(data), 0
+		if opts.StripCSS {
+			doc, n = stripDocumentCSS(doc, dir, removed, keep)
+		}
+		if userHref != "" {
+			link := relativeHref(dir, userHref)
+			if !linksStylesheet(doc, link) {
+				var ok bool
+				if doc, ok = addStylesheetLink(doc, link); ok {
+					n++
+				} else {
+					log.Warn("document has no head; user stylesheet not linked", "href", item.Href)
+				}
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		log.Debug("restyled document", "href", item.Href, "edits", n)
+		if err := os.WriteFile(p, []byte(doc), 0o644); err != nil {
+			return stats, err
+		}
+		record(item.Href, n, ChangeModified)
+	}
+	opts.Progress.report(StageRewrite, len(manifest.Items), len(manifest.Items), "")
+	return stats, nil
+}
+
+// stripDocumentCSS filters inline style attributes and <style> elements
+// and drops links to removed stylesheets. It returns the new document and
+// the number of edits.
+func stripDocumentCSS(doc, dir string, removed map[string]bool, keep func(string) bool) (string, int) {
+	n := 0
+	doc = linkTagPattern.ReplaceAllStringFunc(doc, func(tag string) string {
+		if !isStylesheetLink(tag) {
+			return tag
+		}
+		target := linkTarget(tag)
+		if target != "" && removed[normalizeEPUBPath(path.Join(dir, target))] {
+			n++
+			return ""
+		}
+		return tag
+	})
+	doc = styleElemPattern.ReplaceAllStringFunc(doc, func(elem string) string {
+		m := styleElemPattern.FindStringSubmatchIndex(elem)
+		body := elem[m[2]:m[3]]
+		clean := strings.NewReplacer("<![CDATA[", "", "]]>", "", "<!--", "", "-->", "").Replace(body)
+		out := filterCSS(clean, keep)
+		if out == clean && clean == body {
+			return elem
+		}
+		n++
+		if strings.TrimSpace(out) == "" {
+			return ""
+		}
+		return elem[:m[2]] + out + elem[m[3]:]
+	})
+	doc = startTagPattern.ReplaceAllStringFunc(doc, func(tag string) string {
+		return styleAttrPattern.ReplaceAllStringFunc(tag, func(attr string) string {
+			m := styleAttrPattern.FindStringSubmatch(attr)
+			quote := m[2][:1]
+			value := m[2][1 : len(m[2])-1]
+			decls := filterDeclarations(value, keep)
+			if decls == normalizeDeclarations(value) {
+				return attr
+			}
+			n++
+			if decls == "" {
+				return ""
+			}
+			return m[1] + "style=" + quote + decls + quote
+		})
+	})
+	return doc, n
+}
+
+func linksStylesheet(doc, href string) bool {
+	for _, tag := range linkTagPattern.FindAllString(doc, -1) {
+		if isStylesheetLink(tag) && linkTarget(tag) == href {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureManifestItem adds an item for href unless the manifest has one,
+// using id or id-2, id-3, ... when taken.
+func ensureManifestItem(manifest *Manifest, id, href, mediaType string) {
+	ids := map[string]bool{}
+	for _, item := range manifest.Items {
+		if normalizeEPUBPath(item.Href) == href {
+			return
+		}
+		ids[item.ID] = true
+	}
+	base := id
+	for n := 2; ids[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	manifest.Items = append(manifest.Items, ManifestItem{ID: id, Href: href, MediaType: mediaType})
+}
+
+// addStylesheetLink links href (relative to the document) at the end of
+// the head of doc. It reports false when doc has no head.
+func addStylesheetLink(doc, href string) (string, bool) {
+	loc := headEndPattern.FindStringIndex(doc)
+	if loc == nil {
+		return doc, false
+	}
+	return doc[:loc[0]] + `<link rel="stylesheet" type="text/css" href="` + href + `"/>` + "\n" + doc[loc[0]:], true
+}
+
+// keepProperty returns a predicate matching the allowlisted properties.
+func keepProperty(keep []string) func(string) bool {
+	if keep == nil {
+		keep = DefaultKeepCSS
+	}
+	return func(prop string) bool {
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		for _, prefix := range []string{"-epub-", "-webkit-", "-moz-", "-ms-"} {
+			prop = strings.TrimPrefix(prop, prefix)
+		}
+		for _, k := range keep {
+			k = strings.ToLower(strings.TrimSpace(k))
+			if prop == k || strings.HasPrefix(prop, k+"-") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// filterCSS keeps the allowed declarations of each rule, whole rules for
+// ruby selectors, and @charset/@namespace statements. @media and @supports
+// blocks are filtered recursively; other at-rules (@font-face, @page,
+// @import) are dropped.
+func filterCSS(css string, keep func(string) bool) string {
+	css = cssCommentRE.ReplaceAllString(css, "")
+	var b strings.Builder
+	i := 0
+	for i < len(css) {
+		open := strings.IndexByte(css[i:], '{')
+		if open < 0 {
+			for _, stmt := range strings.Split(css[i:], ";") {
+				writeCSSStatement(&b, stmt)
+			}
+			break
+		}
+		prelude := css[i : i+open]
+		if semi := strings.LastIndexByte(prelude, ';'); semi >= 0 {
+			for _, stmt := range strings.Split(prelude[:semi], ";") {
+				writeCSSStatement(&b, stmt)
+			}
+			prelude = prelude[semi+1:]
+		}
+		prelude = strings.TrimSpace(prelude)
+		end := matchingBrace(css, i+open)
+		body := css[i+open+1 : end]
+		i = end + 1
+
+		lower := strings.ToLower(prelude)
+		switch {
+		case strings.HasPrefix(lower, "@media") || strings.HasPrefix(lower, "@supports"):
+			if inner := filterCSS(body, keep); strings.TrimSpace(inner) != "" {
+				fmt.Fprintf(&b, "%s {\n%s}\n", prelude, inner)
+			}
+		case strings.HasPrefix(lower, "@") || prelude == "":
+		case rubySelectorRE.MatchString(prelude):
+			if decls := normalizeDeclarations(body); decls != "" {
+				fmt.Fprintf(&b, "%s { %s }\n", prelude, decls)
+			}
+		default:
+			if decls := filterDeclarations(body, keep); decls != "" {
+				fmt.Fprintf(&b, "%s { %s }\n", prelude, decls)
+			}
+		}
+	}
+	return b.String()
+}
+
+func writeCSSStatement(b *strings.Builder, stmt string) {
+	stmt = strings.TrimSpace(stmt)
+	lower := strings.ToLower(stmt)
+	if strings.HasPrefix(lower, "@charset") || strings.HasPrefix(lower, "@namespace") {
+		b.WriteString(stmt + ";\n")
+	}
+}
+
+// filterDeclarations returns the allowed declarations of a block as
+// "prop: value; ..." or "" when none are left.
+func filterDeclarations(body string, keep func(string) bool) string {
+	var out []string
+	for _, decl := range splitDeclarations(body) {
+		prop, _, ok := strings.Cut(decl, ":")
+		if ok && keep(prop) {
+			out = append(out, decl)
+		}
+	}
+	return strings.Join(out, "; ")
+}
+
+// normalizeDeclarations formats all declarations of a block the way
+// filterDeclarations does, for comparison.
+func normalizeDeclarations(body string) string {
+	return strings.Join(splitDeclarations(body), "; ")
+}
+
+// splitDeclarations splits a declaration block on semicolons outside quotes
+// and parentheses, trimming each declaration and dropping empty ones.
+func splitDeclarations(body string) []string {
+	var (
+		out   []string
+		depth int
+		quote rune
+		start int
+	)
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			prop, val, ok := strings.Cut(s, ":")
+			if ok {
+				s = strings.TrimSpace(prop) + ": " + strings.TrimSpace(val)
+			}
+			out = append(out, s)
+		}
+	}
+	for i, r := range body {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth > 0 {
+				depth--
+			}
+		case r == ';' && depth == 0:
+			add(body[start:i])
+			start = i + 1
+		}
+	}
+	add(body[start:])
+	return out
+}
@@ -0,0 +1,130 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestyleStripAndUserCSS(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:restyle</dc:identifier>
+    <dc:title>Restyle</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="main" href="Styles/main.css" media-type="text/css"/>
+    <item id="fonts" href="Styles/fonts.css" media-type="text/css"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Styles/main.css": `@charset "utf-8";
+body { margin: 2em; font-family: serif; -epub-writing-mode: vertical-rl }
+p.c { text-align: center; font-size: 80% }
+rt { font-size: 50% }
+@media (min-width: 600px) { body { margin: 4em } }
+`,
+		"OEBPS/Styles/fonts.css": `@font-face { font-family: X; src: url(x.ttf) }
+h1 { color: red }`,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>x</title>
+<link rel="stylesheet" type="text/css" href="../Styles/main.css"/>
+<link rel="stylesheet" type="text/css" href="../Styles/fonts.css"/>
+<style type="text/css">p { line-height: 2 }</style>
+</head><body><p style="color: blue; text-align: right">A</p><p style='font-size: 2em'>B</p></body></html>
+`,
+	})
+	userCSS := filepath.Join(t.TempDir(), "reading.css")
+	if err := os.WriteFile(userCSS, []byte("body { margin: 1em }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := RestyleOptions{StripCSS: true, UserCSS: userCSS}
+	if _, err := RestyleEPUB(context.Background(), input, opts); err != nil {
+		t.Fatalf("RestyleEPUB: %v", err)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	var sheets []string
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		if item.MediaType == "text/css" {
+			sheets = append(sheets, item.Href)
+		}
+	}
+	if strings.Join(sheets, ",") != "Styles/main.css,"+UserStylesheetHref {
+		t.Fatalf("unexpected stylesheets: %v", sheets)
+	}
+
+	css, err := os.ReadFile(filepath.Join(vol.PackageDir, "Styles", "main.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`@charset "utf-8";`, "body { -epub-writing-mode: vertical-rl }", "p.c { text-align: center }", "rt { font-size: 50% }"} {
+		if !strings.Contains(string(css), want) {
+			t.Fatalf("stylesheet missing %q:\n%s", want, css)
+		}
+	}
+	if strings.Contains(string(css), "margin") || strings.Contains(string(css), "@media") {
+		t.Fatalf("publisher rules survived:\n%s", css)
+	}
+
+	doc, err := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(doc)
+	for _, unwanted := range []string{"fonts.css", "<style", "color: blue", "font-size: 2em"} {
+		if strings.Contains(s, unwanted) {
+			t.Fatalf("document still contains %q:\n%s", unwanted, s)
+		}
+	}
+	if !strings.Contains(s, `style="text-align: right"`) || !strings.Contains(s, `href="../`+UserStylesheetHref+`"`) {
+		t.Fatalf("expected kept inline alignment and a user stylesheet link:\n%s", s)
+	}
+
+	// A second run must not link the user stylesheet twice.
+	if _, err := RestyleEPUB(context.Background(), input, RestyleOptions{UserCSS: userCSS}); err != nil {
+		t.Fatalf("second RestyleEPUB: %v", err)
+	}
+	vol2, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol2.TempDir)
+	doc, err = os.ReadFile(filepath.Join(vol2.PackageDir, "Text", "ch1.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(doc), UserStylesheetHref); n != 1 {
+		t.Fatalf("user stylesheet linked %d times:\n%s", n, doc)
+	}
+}
+
+func TestKeepProperty(t *testing.T) {
+	keep := keepProperty(nil)
+	for prop, want := range map[string]bool{
+		"text-align":                  true,
+		"-webkit-text-emphasis-style": true,
+		"-epub-writing-mode":          true,
+		"margin":                      false,
+		"text-indent":                 false,
+	} {
+		if got := keep(prop); got != want {
+			t.Errorf("keep(%q) = %v, want %v", prop, got, want)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package epub
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -18,27 +22,173 @@ type RewriteScope int
 const (
 	RewriteScopeBody RewriteScope = iota
 	RewriteScopeMeta
+	// RewriteScopeAll is body and metadata text.
 	RewriteScopeAll
+	// RewriteScopeCSS is the declaration values of stylesheets.
+	RewriteScopeCSS
+	// RewriteScopeSVG is the text of SVG images.
+	RewriteScopeSVG
 )
 
+// rewriteScopes are the names of the scopes.
+var rewriteScopes = map[string]RewriteScope{
+	"body": RewriteScopeBody,
+	"meta": RewriteScopeMeta,
+	"all":  RewriteScopeAll,
+	"css":  RewriteScopeCSS,
+	"svg":  RewriteScopeSVG,
+}
+
+// ParseRewriteScope returns the scope named body, meta, all, css or svg.
+func ParseRewriteScope(name string) (RewriteScope, error) {
+	scope, ok := rewriteScopes[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("invalid scope %q (want body, meta, all, css, svg)", name)
+	}
+	return scope, nil
+}
+
 type RewriteRule struct {
+	// ID names the rule in reports; optional.
+	ID         string   `json:"id,omitempty"`
 	Find       string   `json:"find"`
 	Replace    string   `json:"replace"`
 	Regex      bool     `json:"regex,omitempty"`
 	IgnoreCase bool     `json:"ignore_case,omitempty"`
 	Selectors  []string `json:"selectors,omitempty"`
+	// Scope limits the rule to "body" or "meta" text, "all" of both,
+	// stylesheets ("css") or SVG images ("svg"), or a comma-separated list
+	// of these; without it the rule runs where RewriteOptions.Scope allows.
+	Scope string `json:"scope,omitempty"`
+	// Files, when set, limits the rule to the files whose href (relative
+	// to the package document) matches one of these globs; Exclude keeps
+	// it out of the files matching any of its globs. Globs use path.Match
+	// syntax, and one without a slash is matched against the file name
+	// alone. Metadata counts as the package document's file.
+	Files   []string `json:"files,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Chapters, when set, limits the rule to chapters whose navigation
+	// label, or the label of a part containing them, matches one of these
+	// regular expressions; SkipChapters keeps it out of those matching
+	// any. A chapter runs from the document its entry points at to the
+	// next entry's document. Rules with Chapters never apply to metadata.
+	Chapters     []string `json:"chapters,omitempty"`
+	SkipChapters []string `json:"skip_chapters,omitempty"`
+	// Priority orders the rules: higher priorities run first, and rules of
+	// equal priority run in the order given.
+	Priority int `json:"priority,omitempty"`
+	// Stop protects the text the rule wrote from the rules after it.
+	Stop bool `json:"stop,omitempty"`
+	// Action, when set, makes the rule change the elements its Selectors
+	// match instead of text: "remove" drops them with their content,
+	// "unwrap" drops their tags and keeps their content, "wrap" puts them
+	// inside Element (such as <div class="box"/>), and "set-attribute"
+	// sets Attribute to Value. Action rules have no Find or Replace and run
+	// over body documents before any text rule.
+	Action    string `json:"action,omitempty"`
+	Element   string `json:"element,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Value     string `json:"value,omitempty"`
+	// Bare limits an action rule to elements without attributes, and
+	// Nested to elements directly inside an element of the same name.
+	Bare   bool `json:"bare,omitempty"`
+	Nested bool `json:"nested,omitempty"`
+	// Source records the rule pack the rule came from, if any.
+	Source *RuleSource `json:"-"`
+}
+
+// RuleSource identifies the rule pack a rule was loaded from.
+type RuleSource struct {
+	Pack    string `json:"pack"`
+	Version string `json:"version"`
+	Author  string `json:"author,omitempty"`
 }
 
 type RewriteOptions struct {
 	OutPath string
 	Scope   RewriteScope
 	Rules   []RewriteRule
-	DryRun  bool
+	// SkipSelectors protects the text of matching elements (and their
+	// descendants) from every rule.
+	SkipSelectors []string
+	// SceneBreak, when set, normalizes scene separators in body documents
+	// before the text rules run.
+	SceneBreak *SceneBreakRule
+	// Ruby converts ruby annotations in body documents before the text
+	// rules run; see ParseRubyMode.
+	Ruby   string
+	DryRun bool
+	// FileFilter, when set, limits rewriting to the hrefs (relative to the
+	// package document) for which it returns true. Metadata changes are
+	// reported under the package document's own file name.
+	FileFilter func(href string) bool
+	// Workers is how many documents are rewritten at once; 0 means one per
+	// CPU.
+	Workers int
+	// MaxMemory, when positive, caps the memory (in bytes) that documents
+	// being rewritten at once may take. Documents are streamed through the
+	// rules unless ruby or scene break handling needs them whole; those
+	// claim a multiple of their size, and one larger than MaxMemory is
+	// rewritten alone.
+	MaxMemory int64
+	// RepairHTML parses documents that are not well-formed XHTML as HTML
+	// and writes them back as XHTML before the rules run, instead of
+	// failing on them.
+	RepairHTML bool
+	// AcrossInline lets body rules match text split by inline elements
+	// such as <em> or <span>, as in "foo <em>bar</em>". The text between
+	// block boundaries is matched as one, and a replacement goes into the
+	// text node where its match starts, leaving the markup in place; an
+	// inline element whose text all went into such a match is dropped
+	// unless it has an id. An element a rule or skip selector names is a
+	// boundary, as are <br> and ruby annotations.
+	AcrossInline bool
+	Logger       *slog.Logger
+	Progress     ProgressFunc
 }
 
 type RewriteStats struct {
-	FilesChanged int
-	MatchCount   int
+	FilesChanged int                 `json:"files_changed"`
+	MatchCount   int                 `json:"match_count"`
+	Files        []RewriteFileResult `json:"files,omitempty"`
+	// RepairedHTML lists the documents RepairHTML had to repair.
+	RepairedHTML []MarkupRepair `json:"repaired_html,omitempty"`
+	Changeset    Changeset      `json:"changeset"`
+}
+
+// RewriteFileResult describes the changes made (or, in a dry run, proposed)
+// to one file.
+type RewriteFileResult struct {
+	Href    string       `json:"href"`
+	Matches int          `json:"matches"`
+	Changes []TextChange `json:"changes"`
+}
+
+// TextChange is one text node before and after all rules were applied;
+// with AcrossInline, the text of the inline elements matched together.
+type TextChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+	// Rules lists the rules that matched, in the order they were applied.
+	Rules []RuleRef `json:"rules,omitempty"`
+}
+
+// RuleRef attributes matches in a TextChange to the rule that made them.
+type RuleRef struct {
+	ID      string `json:"id,omitempty"`
+	Find    string `json:"find"`
+	Matches int    `json:"matches"`
+	*RuleSource
+}
+
+type xhtmlRewrite struct {
+	matches int
+	changes []TextChange
+	// data holds the re-encoded document, or nil when nothing changed or
+	// the document was streamed.
+	data []byte
+	// changed reports that the document differs from its input.
+	changed bool
 }
 
 type compiledSelector struct {
@@ -50,6 +200,25 @@ type compiledRule struct {
 	raw       RewriteRule
 	re        *regexp.Regexp
 	selectors []compiledSelector
+	scopes    []RewriteScope
+	chapters  []*regexp.Regexp
+	skipChap  []*regexp.Regexp
+	// tmpl is set when a regex rule's replacement transforms groups.
+	tmpl replaceTemplate
+	// wrapper is the element a wrap rule puts elements in.
+	wrapper *xml.StartElement
+}
+
+// ruleSet is everything rewriteXHTMLFile needs to know about the rules.
+type ruleSet struct {
+	rules []compiledRule
+	// skip suppresses all rules inside matching elements.
+	skip []compiledSelector
+	// within, when set, limits the rules to text inside matching elements.
+	within []compiledSelector
+	// inline lets rules match text split by inline elements; see
+	// RewriteOptions.AcrossInline.
+	inline bool
 }
 
 type ruleState struct {
@@ -62,7 +231,11 @@ func RewriteEPUB(ctx context.Context, input string, opts RewriteOptions) (Rewrit
 	if input == "" {
 		return stats, fmt.Errorf("input EPUB path is required")
 	}
-	if len(opts.Rules) == 0 {
+	ruby, err := ParseRubyMode(opts.Ruby)
+	if err != nil {
+		return stats, err
+	}
+	if len(opts.Rules) == 0 && opts.SceneBreak == nil && ruby == RubyKeep {
 		return stats, fmt.Errorf("no rewrite rules provided")
 	}
 
@@ -70,97 +243,169 @@ func RewriteEPUB(ctx context.Context, input string, opts RewriteOptions) (Rewrit
 	if err != nil {
 		return stats, err
 	}
+	sceneBreak, err := compileSceneBreak(opts.SceneBreak)
+	if err != nil {
+		return stats, err
+	}
+	skip := parseSelectors(opts.SkipSelectors)
+	log := loggerOrDiscard(opts.Logger)
 
+	log.Info("loading book", "path", input)
 	vol, err := loadVolume(ctx, 0, input)
 	if err != nil {
 		return stats, err
 	}
 	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
 
 	pkg := vol.PackageDoc
 
+	included := func(href string) bool {
+		return opts.FileFilter == nil || opts.FileFilter(href)
+	}
+
 	// Rewrite metadata if requested.
-	if opts.Scope == RewriteScopeMeta || opts.Scope == RewriteScopeAll {
-		metaRules := metadataApplicableRules(compiled)
-		matches, changed := rewriteMetadata(&pkg.Metadata, metaRules, !opts.DryRun)
+	pkgHref := filepath.Base(vol.PackagePath)
+	metaRules := metadataApplicableRules(rulesFor(compiled, RewriteScopeMeta, opts.Scope, pkgHref, nil))
+	if len(metaRules) > 0 && included(pkgHref) {
+		matches, changes := rewriteMetadata(&pkg.Metadata, metaRules, !opts.DryRun)
 		stats.MatchCount += matches
-		if changed {
+		if len(changes) > 0 {
 			stats.FilesChanged++
+			stats.Files = append(stats.Files, RewriteFileResult{Href: pkgHref, Matches: matches, Changes: changes})
+			stats.Changeset.modified(pkgHref)
 		}
 	}
 
-	// Rewrite XHTML content if requested.
-	if opts.Scope == RewriteScopeBody || opts.Scope == RewriteScopeAll {
-		for _, item := range pkg.Manifest.Items {
-			if item.MediaType != "application/xhtml+xml" {
-				continue
-			}
-			src := filepath.Join(filepath.Dir(vol.PackagePath), filepath.FromSlash(item.Href))
-			fileMatches, changed, rewritten, err := rewriteXHTMLFile(src, compiled)
+	// Rewrite XHTML content, stylesheets and SVG images if requested.
+	// Scene breaks and ruby follow the options' scope; rules may have
+	// their own.
+	bodyScope := opts.Scope == RewriteScopeBody || opts.Scope == RewriteScopeAll
+	if !bodyScope {
+		sceneBreak, ruby = nil, RubyKeep
+	}
+	inScope := map[RewriteScope]bool{RewriteScopeBody: bodyScope}
+	for _, r := range compiled {
+		for _, where := range []RewriteScope{RewriteScopeBody, RewriteScopeCSS, RewriteScopeSVG} {
+			inScope[where] = inScope[where] || r.appliesIn(where, opts.Scope)
+		}
+	}
+	if inScope[RewriteScopeBody] || inScope[RewriteScopeCSS] || inScope[RewriteScopeSVG] {
+		if opts.RepairHTML && inScope[RewriteScopeBody] {
+			stats.RepairedHTML, err = repairContentMarkup(ctx, vol, included, &stats.Changeset)
 			if err != nil {
 				return stats, err
 			}
-			stats.MatchCount += fileMatches
-			if changed {
-				stats.FilesChanged++
-				if !opts.DryRun {
-					if err := os.WriteFile(src, rewritten, 0o644); err != nil {
-						return stats, err
-					}
+			for _, r := range stats.RepairedHTML {
+				log.Warn("repaired markup", "href", r.Href, "problem", r.Problem)
+			}
+		}
+		var chapters map[string][]string
+		if chapterConditional(compiled) {
+			if chapters, err = chapterLabels(vol); err != nil {
+				return stats, err
+			}
+		}
+		items := pkg.Manifest.Items
+		results := make([]xhtmlRewrite, len(items))
+		where := func(i int) (RewriteScope, bool) {
+			var scope RewriteScope
+			switch items[i].MediaType {
+			case "application/xhtml+xml":
+				scope = RewriteScopeBody
+			case "text/css":
+				scope = RewriteScopeCSS
+			case "image/svg+xml":
+				scope = RewriteScopeSVG
+			default:
+				return 0, false
+			}
+			return scope, inScope[scope] && included(items[i].Href)
+		}
+		src := func(i int) string {
+			return filepath.Join(vol.PackageDir, filepath.FromSlash(items[i].Href))
+		}
+		structural := len(structuralRules(compiled)) > 0
+		cost := func(i int) int64 {
+			switch scope, ok := where(i); {
+			case !ok:
+				return 0
+			case scope == RewriteScopeBody:
+				return rewriteCost(src(i), sceneBreak, ruby, structural)
+			case scope == RewriteScopeCSS:
+				// Stylesheets are rewritten whole.
+				if info, err := os.Stat(src(i)); err == nil {
+					return 2*info.Size() + streamCost
 				}
 			}
+			return streamCost
 		}
-	}
-
-	if opts.DryRun {
-		return stats, nil
-	}
-
-	if stats.FilesChanged == 0 {
-		return stats, nil
-	}
-
-	if err := writePackage(pkg, vol.PackagePath); err != nil {
-		return stats, err
-	}
-
-	outPath := opts.OutPath
-	if outPath == "" {
-		outPath = input
-	}
-
-	tmpFile, err := os.CreateTemp(filepath.Dir(outPath), "novfmt-rewrite-*.epub")
-	if err != nil {
-		return stats, err
-	}
-	tmpPath := tmpFile.Name()
-	tmpFile.Close()
-	defer func() {
-		if tmpPath != "" {
-			os.Remove(tmpPath)
+		work := func(i int) error {
+			scope, ok := where(i)
+			if !ok {
+				return nil
+			}
+			href := items[i].Href
+			rules := rulesFor(compiled, scope, opts.Scope, href, chapters[normalizeEPUBPath(href)])
+			var (
+				res xhtmlRewrite
+				err error
+			)
+			switch scope {
+			case RewriteScopeBody:
+				res, err = rewriteBodyFile(src(i), ruleSet{rules: rules, skip: skip, inline: opts.AcrossInline}, sceneBreak, ruby, !opts.DryRun)
+			case RewriteScopeCSS:
+				// Stylesheets have no elements for selectors to match.
+				res, err = rewriteStylesheetFile(src(i), metadataApplicableRules(rules), !opts.DryRun)
+			case RewriteScopeSVG:
+				res, err = rewriteXHTMLFile(src(i), ruleSet{rules: rules, skip: skip, within: svgTextElements}, !opts.DryRun)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", href, err)
+			}
+			results[i] = res
+			return nil
+		}
+		done := func(i int) error {
+			item, res := items[i], results[i]
+			results[i] = xhtmlRewrite{}
+			opts.Progress.report(StageRewrite, i+1, len(items), item.Href)
+			if res.matches > 0 {
+				log.Debug("rewrote file", "href", item.Href, "matches", res.matches)
+			}
+			stats.MatchCount += res.matches
+			if res.changed {
+				stats.FilesChanged++
+				stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: res.matches, Changes: res.changes})
+				stats.Changeset.modified(item.Href)
+			}
+			return nil
+		}
+		if err := runFileJobs(ctx, len(items), opts.Workers, opts.MaxMemory, cost, work, done); err != nil {
+			return stats, err
 		}
-	}()
-
-	if err := writeZip(vol.RootDir, tmpPath); err != nil {
-		return stats, err
-	}
-	if err := os.Rename(tmpPath, outPath); err != nil {
-		return stats, err
 	}
-	tmpPath = ""
 
-	return stats, nil
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	err = stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log)
+	return stats, err
 }
 
+// compileRules compiles rules and puts them in the order they run.
 func compileRules(rules []RewriteRule) ([]compiledRule, error) {
 	out := make([]compiledRule, 0, len(rules))
 	for _, r := range rules {
-		if r.Find == "" {
+		cr := compiledRule{raw: r}
+		if r.Action != "" {
+			if err := compileStructuralRule(&cr); err != nil {
+				return nil, err
+			}
+		} else if r.Find == "" {
 			return nil, fmt.Errorf("rule missing find pattern")
 		}
-		cr := compiledRule{raw: r}
 
-		if r.Regex {
+		if r.Regex && r.Action == "" {
 			pat := r.Find
 			if r.IgnoreCase && !strings.HasPrefix(pat, "(?i)") {
 				pat = "(?i)" + pat
@@ -170,36 +415,160 @@ func compileRules(rules []RewriteRule) ([]compiledRule, error) {
 				return nil, fmt.Errorf("compile regex %q: %w", pat, err)
 			}
 			cr.re = re
+			if cr.tmpl, err = compileReplaceTemplate(re, r.Replace); err != nil {
+				return nil, err
+			}
 		}
 
-		for _, sel := range r.Selectors {
-			sel = strings.TrimSpace(sel)
-			if sel == "" {
-				continue
-			}
-			for _, part := range strings.Split(sel, ",") {
-				part = strings.TrimSpace(part)
-				if part == "" {
-					continue
+		cr.selectors = parseSelectors(r.Selectors)
+
+		if r.Scope != "" {
+			for _, name := range strings.Split(r.Scope, ",") {
+				scope, err := ParseRewriteScope(name)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", r.Summary(), err)
 				}
-				outSel := compiledSelector{}
-				token := part
-				if strings.Contains(token, ".") {
-					parts := strings.SplitN(token, ".", 2)
-					outSel.Tag = strings.ToLower(strings.TrimSpace(parts[0]))
-					outSel.Class = strings.TrimSpace(parts[1])
-				} else {
-					outSel.Tag = strings.ToLower(token)
+				if r.Action != "" && scope != RewriteScopeBody && scope != RewriteScopeAll {
+					return nil, fmt.Errorf("rule %q: action rules apply to body documents only", r.Summary())
 				}
-				cr.selectors = append(cr.selectors, outSel)
+				cr.scopes = append(cr.scopes, scope)
+			}
+		}
+		for _, pat := range r.Chapters {
+			re, err := regexp.Compile(pat)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: chapter pattern: %w", r.Summary(), err)
+			}
+			cr.chapters = append(cr.chapters, re)
+		}
+		for _, pat := range r.SkipChapters {
+			re, err := regexp.Compile(pat)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: chapter pattern: %w", r.Summary(), err)
+			}
+			cr.skipChap = append(cr.skipChap, re)
+		}
+		for _, glob := range append(append([]string(nil), r.Files...), r.Exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: invalid file glob %q", r.Summary(), glob)
 			}
 		}
 
 		out = append(out, cr)
 	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].raw.Priority > out[j].raw.Priority
+	})
 	return out, nil
 }
 
+// appliesIn reports whether the rule runs in where (any scope but
+// RewriteScopeAll) when the options allow scope.
+func (r compiledRule) appliesIn(where, scope RewriteScope) bool {
+	scopes := r.scopes
+	if len(scopes) == 0 {
+		scopes = []RewriteScope{scope}
+	}
+	for _, s := range scopes {
+		if s == where || s == RewriteScopeAll && (where == RewriteScopeBody || where == RewriteScopeMeta) {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo reports whether the rule's file globs admit href.
+func (r compiledRule) appliesTo(href string) bool {
+	if len(r.raw.Files) > 0 && !matchFileGlobs(r.raw.Files, href) {
+		return false
+	}
+	return !matchFileGlobs(r.raw.Exclude, href)
+}
+
+// appliesInChapter reports whether the rule's chapter patterns admit a
+// document in the chapters labelled labels.
+func (r compiledRule) appliesInChapter(labels []string) bool {
+	if len(r.chapters) > 0 && !matchAnyLabel(r.chapters, labels) {
+		return false
+	}
+	return !matchAnyLabel(r.skipChap, labels)
+}
+
+func matchAnyLabel(patterns []*regexp.Regexp, labels []string) bool {
+	for _, re := range patterns {
+		for _, l := range labels {
+			if re.MatchString(l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chapterConditional reports whether any rule depends on chapter labels.
+func chapterConditional(rules []compiledRule) bool {
+	for _, r := range rules {
+		if len(r.chapters) > 0 || len(r.skipChap) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFileGlobs(globs []string, href string) bool {
+	for _, glob := range globs {
+		name := href
+		if !strings.Contains(glob, "/") {
+			name = path.Base(href)
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesFor returns the rules that run in where, in the file href, which
+// belongs to the chapters labelled labels.
+func rulesFor(rules []compiledRule, where, scope RewriteScope, href string, labels []string) []compiledRule {
+	var out []compiledRule
+	for _, r := range rules {
+		if r.appliesIn(where, scope) && r.appliesTo(href) && r.appliesInChapter(labels) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// parseSelectors compiles tag, .class and tag.class selectors; entries may
+// hold comma-separated lists.
+func parseSelectors(list []string) []compiledSelector {
+	var out []compiledSelector
+	for _, sel := range list {
+		sel = strings.TrimSpace(sel)
+		if sel == "" {
+			continue
+		}
+		for _, part := range strings.Split(sel, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			outSel := compiledSelector{}
+			token := part
+			if strings.Contains(token, ".") {
+				parts := strings.SplitN(token, ".", 2)
+				outSel.Tag = strings.ToLower(strings.TrimSpace(parts[0]))
+				outSel.Class = strings.TrimSpace(parts[1])
+			} else {
+				outSel.Tag = strings.ToLower(token)
+			}
+			out = append(out, outSel)
+		}
+	}
+	return out
+}
+
 func metadataApplicableRules(rules []compiledRule) []compiledRule {
 	out := make([]compiledRule, 0, len(rules))
 	for _, r := range rules {
@@ -210,89 +579,277 @@ func metadataApplicableRules(rules []compiledRule) []compiledRule {
 	return out
 }
 
-func rewriteMetadata(meta *Metadata, rules []compiledRule, mutate bool) (int, bool) {
-	var matches int
-	changed := false
+func rewriteMetadata(meta *Metadata, rules []compiledRule, mutate bool) (int, []TextChange) {
+	var (
+		matches int
+		changes []TextChange
+	)
 
-	apply := func(nodes []DCMeta) ([]DCMeta, bool) {
-		localChanged := false
+	apply := func(nodes []DCMeta) {
 		for i := range nodes {
 			orig := nodes[i].Value
-			val, mc := applyRulesToText(orig, rules)
+			val, mc, refs := applyRulesToText(orig, rules)
 			if mc > 0 {
 				if mutate {
 					nodes[i].Value = val
 				}
 				matches += mc
-				localChanged = true
+				changes = append(changes, TextChange{Before: orig, After: val, Rules: refs})
 			}
 		}
-		return nodes, localChanged
 	}
 
-	if len(meta.Titles) > 0 {
-		var c bool
-		meta.Titles, c = apply(meta.Titles)
-		changed = changed || c
+	apply(meta.Titles)
+	apply(meta.Languages)
+	apply(meta.Identifiers)
+	apply(meta.Descriptions)
+	apply(meta.Creators)
+
+	return matches, changes
+}
+
+// rewriteBodyFile applies the action rules, converts ruby (unless ruby is
+// RubyKeep), normalizes scene breaks (when sb is set) and then applies the
+// text rules, reporting all of them as one result. With write, a changed
+// document replaces the file. Without action rules, ruby or scene break
+// handling the document is streamed.
+func rewriteBodyFile(path string, rs ruleSet, sb *compiledSceneBreak, ruby string, write bool) (xhtmlRewrite, error) {
+	structural := structuralRules(rs.rules)
+	if len(structural) == 0 && sb == nil && ruby == RubyKeep {
+		return rewriteXHTMLFile(path, rs, write)
 	}
-	if len(meta.Languages) > 0 {
-		var c bool
-		meta.Languages, c = apply(meta.Languages)
-		changed = changed || c
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return xhtmlRewrite{}, err
 	}
-	if len(meta.Identifiers) > 0 {
-		var c bool
-		meta.Identifiers, c = apply(meta.Identifiers)
-		changed = changed || c
+	var (
+		pre     []TextChange
+		changed bool
+	)
+	if len(structural) > 0 {
+		restructured, changes, err := applyStructuralRules(data, structural)
+		if err != nil {
+			return xhtmlRewrite{}, err
+		}
+		if restructured != nil {
+			data, changed = restructured, true
+			pre = append(pre, changes...)
+		}
+	}
+	if converted, changes := convertRuby(data, ruby); converted != nil {
+		data, changed = converted, true
+		pre = append(pre, changes...)
 	}
-	if len(meta.Descriptions) > 0 {
-		var c bool
-		meta.Descriptions, c = apply(meta.Descriptions)
-		changed = changed || c
+	if sb != nil {
+		normalized, breaks, err := normalizeSceneBreaks(data, sb)
+		if err != nil {
+			return xhtmlRewrite{}, err
+		}
+		if normalized != nil {
+			data, changed = normalized, true
+		}
+		pre = append(pre, breaks...)
 	}
-	if len(meta.Creators) > 0 {
-		var c bool
-		meta.Creators, c = apply(meta.Creators)
-		changed = changed || c
+	res, err := rewriteXHTML(data, rs)
+	if err != nil {
+		return res, err
+	}
+	res.matches += len(pre)
+	res.changes = append(pre, res.changes...)
+	if res.data == nil && changed {
+		res.data, res.changed = data, true
+	}
+	if res.changed && write {
+		if err := os.WriteFile(path, res.data, 0o644); err != nil {
+			return res, err
+		}
 	}
+	return res, nil
+}
 
-	return matches, changed
+// rewriteCost estimates the memory rewriteBodyFile needs for the document
+// at path: streaming needs little, while action rules, ruby and scene
+// break handling hold several copies of the document.
+func rewriteCost(path string, sb *compiledSceneBreak, ruby string, structural bool) int64 {
+	if !structural && sb == nil && ruby == RubyKeep {
+		return streamCost
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return streamCost
+	}
+	return 4*info.Size() + streamCost
 }
 
-func rewriteXHTMLFile(path string, rules []compiledRule) (int, bool, []byte, error) {
-	data, err := os.ReadFile(path)
+// rewriteXHTMLFile streams the document at path through the rules into a
+// temp file beside it, which replaces the document when a rule matched and
+// write is set. Memory use does not grow with the document.
+func rewriteXHTMLFile(path string, rs ruleSet, write bool) (xhtmlRewrite, error) {
+	in, err := os.Open(path)
 	if err != nil {
-		return 0, false, nil, err
+		return xhtmlRewrite{}, err
+	}
+	defer in.Close()
+	if !write {
+		return rewriteXHTMLStream(bufio.NewReader(in), io.Discard, rs)
 	}
 
-	dec := xml.NewDecoder(bytes.NewReader(data))
-	dec.Strict = false
+	tmp, err := createTempFile(filepath.Dir(path), ".novfmt-rewrite-*")
+	if err != nil {
+		return xhtmlRewrite{}, err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+	out := bufio.NewWriter(tmp)
+	res, err := rewriteXHTMLStream(bufio.NewReader(in), out, rs)
+	if err == nil {
+		err = out.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || !res.changed {
+		return res, err
+	}
+	in.Close()
+	if err := renameOver(tmpPath, path); err != nil {
+		return res, err
+	}
+	tmpPath = ""
+	return res, nil
+}
 
+func rewriteXHTML(data []byte, rs ruleSet) (xhtmlRewrite, error) {
 	var out bytes.Buffer
-	enc := xml.NewEncoder(&out)
+	res, err := rewriteXHTMLStream(bytes.NewReader(data), &out, rs)
+	if err == nil && res.changed {
+		res.data = out.Bytes()
+	}
+	return res, err
+}
+
+// rewriteXHTMLStream applies the rules to the document read from r,
+// writing it token by token to w. Markup is copied as it was read; only
+// text a rule changed is re-encoded. res.changed reports whether a rule
+// matched; the output is complete either way.
+func rewriteXHTMLStream(r io.Reader, w io.Writer, rs ruleSet) (xhtmlRewrite, error) {
+	var res xhtmlRewrite
+	sp := newXMLSplicer(r, w)
 
 	type frame struct {
 		name xml.Name
 	}
 	var stack []frame
 
+	rules := rs.rules
 	states := make([]ruleState, len(rules))
+	var skipStack, withinStack []bool
+	skipping, inside := 0, 0
 
-	var totalMatches int
-	changed := false
+	// With rs.inline, text and the tags of inline elements are held in
+	// seg until a boundary, and the text is rewritten as one. joined
+	// records which open elements were held as part of a segment.
+	segmenting := rs.inline
+	var (
+		seg    []rawToken
+		joined []bool
+	)
+	flush := func() error {
+		if len(seg) == 0 {
+			return nil
+		}
+		defer func() { seg = seg[:0] }()
+		var run textRun
+		var nodes []int // index in seg of each text node
+		for i, rt := range seg {
+			if t, ok := rt.tok.(xml.CharData); ok {
+				run = append(run, textSpan{text: string(t), node: len(nodes)})
+				nodes = append(nodes, i)
+			}
+		}
+		total := 0
+		var refs []RuleRef
+		if skipping == 0 && (len(rs.within) == 0 || inside > 0) {
+			for i := range rules {
+				if selectorInactive(rules[i], &states[i]) {
+					continue
+				}
+				var mc int
+				run, mc = run.apply(rules[i])
+				if mc > 0 {
+					total += mc
+					refs = append(refs, rules[i].ref(mc))
+				}
+			}
+		}
+		res.matches += total
+		texts := run.nodeTexts(len(nodes))
+		before := make([]string, len(nodes))
+		for n, i := range nodes {
+			before[n] = string(seg[i].tok.(xml.CharData))
+		}
+		if total > 0 && strings.Join(texts, "") != strings.Join(before, "") {
+			res.changes = append(res.changes, TextChange{Before: strings.Join(before, ""), After: strings.Join(texts, ""), Rules: refs})
+		}
+		omit := emptiedElements(seg, before, texts)
+		n := 0
+		for i, rt := range seg {
+			var err error
+			if omit[i] {
+				continue
+			}
+			if _, ok := rt.tok.(xml.CharData); ok {
+				if texts[n] != before[n] {
+					err = sp.writeText(texts[n])
+				} else {
+					err = sp.copy(rt)
+				}
+				n++
+			} else {
+				err = sp.copy(rt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	for {
-		tok, err := dec.Token()
+		rt, err := sp.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return 0, false, nil, err
+			return res, err
 		}
 
-		switch t := tok.(type) {
+		switch t := rt.tok.(type) {
 		case xml.StartElement:
+			join := segmenting && joinsText(t, rs)
+			if segmenting {
+				joined = append(joined, join)
+				if !join {
+					if err := flush(); err != nil {
+						return res, err
+					}
+				}
+			}
 			stack = append(stack, frame{name: t.Name})
+			skip := len(rs.skip) > 0 && matchSelectors(rs.skip, t)
+			skipStack = append(skipStack, skip)
+			if skip {
+				skipping++
+			}
+			in := len(rs.within) > 0 && matchSelectors(rs.within, t)
+			withinStack = append(withinStack, in)
+			if in {
+				inside++
+			}
 			for i := range rules {
 				match := selectorMatches(rules[i], t)
 				st := &states[i]
@@ -301,15 +858,38 @@ func rewriteXHTMLFile(path string, rules []compiledRule) (int, bool, []byte, err
 					st.active++
 				}
 			}
-			t.Attr = stripXMLNSAttrs(t.Attr)
-			if err := enc.EncodeToken(t); err != nil {
-				return 0, false, nil, err
+			if join {
+				seg = append(seg, rt)
+			} else if err := sp.copy(rt); err != nil {
+				return res, err
 			}
 
 		case xml.EndElement:
+			join := false
+			if n := len(joined); n > 0 {
+				join = joined[n-1]
+				joined = joined[:n-1]
+			}
+			if segmenting && !join {
+				if err := flush(); err != nil {
+					return res, err
+				}
+			}
 			if len(stack) > 0 {
 				stack = stack[:len(stack)-1]
 			}
+			if n := len(skipStack); n > 0 {
+				if skipStack[n-1] {
+					skipping--
+				}
+				skipStack = skipStack[:n-1]
+			}
+			if n := len(withinStack); n > 0 {
+				if withinStack[n-1] {
+					inside--
+				}
+				withinStack = withinStack[:n-1]
+			}
 			for i := range rules {
 				st := &states[i]
 				if len(st.depthStack) == 0 {
@@ -321,46 +901,136 @@ func rewriteXHTMLFile(path string, rules []compiledRule) (int, bool, []byte, err
 					st.active--
 				}
 			}
-			if err := enc.EncodeToken(t); err != nil {
-				return 0, false, nil, err
+			if join {
+				seg = append(seg, rt)
+			} else if err := sp.copy(rt); err != nil {
+				return res, err
 			}
 
 		case xml.CharData:
-			text := string(t)
-			orig := text
-			for i := range rules {
-				if selectorInactive(rules[i], &states[i]) {
-					continue
-				}
-				updated, mc := applyRuleToText(text, rules[i])
-				if mc > 0 {
-					text = updated
-					totalMatches += mc
-				}
+			if segmenting {
+				seg = append(seg, rt)
+				continue
 			}
-			if text != orig {
-				changed = true
+			orig := string(t)
+			var (
+				text string
+				mc   int
+				refs []RuleRef
+			)
+			if skipping == 0 && (len(rs.within) == 0 || inside > 0) {
+				text, mc, refs = applyActiveRules(orig, rules, func(i int) bool {
+					return !selectorInactive(rules[i], &states[i])
+				})
 			}
-			if err := enc.EncodeToken(xml.CharData([]byte(text))); err != nil {
-				return 0, false, nil, err
+			res.matches += mc
+			if mc == 0 || text == orig {
+				err = sp.copy(rt)
+			} else {
+				res.changes = append(res.changes, TextChange{Before: orig, After: text, Rules: refs})
+				err = sp.writeText(text)
+			}
+			if err != nil {
+				return res, err
 			}
 
 		default:
-			if err := enc.EncodeToken(t); err != nil {
-				return 0, false, nil, err
+			if err := flush(); err != nil {
+				return res, err
+			}
+			if err := sp.copy(rt); err != nil {
+				return res, err
 			}
 		}
 	}
+	if err := flush(); err != nil {
+		return res, err
+	}
 
-	if err := enc.Flush(); err != nil {
-		return 0, false, nil, err
+	res.changed = len(res.changes) > 0
+	return res, nil
+}
+
+// inlineElements are the elements whose text AcrossInline joins with the
+// text around them.
+var inlineElements = map[string]bool{
+	"a": true, "abbr": true, "b": true, "bdi": true, "bdo": true, "big": true,
+	"cite": true, "code": true, "data": true, "del": true, "dfn": true,
+	"em": true, "font": true, "i": true, "ins": true, "kbd": true,
+	"mark": true, "nobr": true, "q": true, "s": true, "samp": true,
+	"small": true, "span": true, "strike": true, "strong": true, "sub": true,
+	"sup": true, "time": true, "tt": true, "u": true, "var": true,
+}
+
+// joinsText reports whether the text inside el is matched together with
+// the text around it: el is an inline element no skip, within or rule
+// selector names, so the same rules apply on both sides of its tags.
+func joinsText(el xml.StartElement, rs ruleSet) bool {
+	if !inlineElements[strings.ToLower(el.Name.Local)] {
+		return false
 	}
+	if len(rs.skip) > 0 && matchSelectors(rs.skip, el) {
+		return false
+	}
+	if len(rs.within) > 0 && matchSelectors(rs.within, el) {
+		return false
+	}
+	for _, rule := range rs.rules {
+		if len(rule.selectors) > 0 && matchSelectors(rule.selectors, el) {
+			return false
+		}
+	}
+	return true
+}
 
-	if !changed {
-		return totalMatches, false, nil, nil
+// emptiedElements returns which tokens of seg, a segment of text and
+// inline element tags, to leave out: the tags of elements that held text
+// before the rules ran and hold none after, their text having gone into a
+// match that started outside them. An element with an id is kept, since
+// links may point to it. before and texts hold the text of each text node
+// of seg before and after the rules.
+func emptiedElements(seg []rawToken, before, texts []string) []bool {
+	omit := make([]bool, len(seg))
+	type frame struct {
+		start     int
+		had, kept bool
+	}
+	var open []frame
+	n := 0
+	for i, rt := range seg {
+		switch rt.tok.(type) {
+		case xml.StartElement:
+			open = append(open, frame{start: i})
+		case xml.CharData:
+			for k := range open {
+				open[k].had = open[k].had || before[n] != ""
+				open[k].kept = open[k].kept || texts[n] != ""
+			}
+			n++
+		case xml.EndElement:
+			// The segment may hold an element's end tag without its start.
+			if len(open) == 0 {
+				continue
+			}
+			f := open[len(open)-1]
+			open = open[:len(open)-1]
+			if f.had && !f.kept && !hasID(seg[f.start].tok.(xml.StartElement)) {
+				omit[f.start], omit[i] = true, true
+			} else if len(open) > 0 {
+				open[len(open)-1].kept = true
+			}
+		}
 	}
+	return omit
+}
 
-	return totalMatches, true, out.Bytes(), nil
+func hasID(el xml.StartElement) bool {
+	for _, a := range el.Attr {
+		if a.Name.Local == "id" {
+			return true
+		}
+	}
+	return false
 }
 
 func selectorMatches(rule compiledRule, el xml.StartElement) bool {
@@ -368,6 +1038,10 @@ func selectorMatches(rule compiledRule, el xml.StartElement) bool {
 		// No selector: apply everywhere in body scope.
 		return true
 	}
+	return matchSelectors(rule.selectors, el)
+}
+
+func matchSelectors(selectors []compiledSelector, el xml.StartElement) bool {
 	tag := strings.ToLower(el.Name.Local)
 	var classAttr string
 	for _, a := range el.Attr {
@@ -380,7 +1054,7 @@ func selectorMatches(rule compiledRule, el xml.StartElement) bool {
 	for _, token := range strings.Fields(classAttr) {
 		classes[token] = struct{}{}
 	}
-	for _, sel := range rule.selectors {
+	for _, sel := range selectors {
 		if sel.Tag != "" && sel.Tag != tag {
 			continue
 		}
@@ -402,20 +1076,196 @@ func selectorInactive(rule compiledRule, st *ruleState) bool {
 	return st.active == 0
 }
 
-func applyRulesToText(s string, rules []compiledRule) (string, int) {
+func applyRulesToText(s string, rules []compiledRule) (string, int, []RuleRef) {
+	return applyActiveRules(s, rules, func(int) bool { return true })
+}
+
+// applyActiveRules runs the rules for which active returns true over s.
+func applyActiveRules(s string, rules []compiledRule, active func(i int) bool) (string, int, []RuleRef) {
 	total := 0
+	var refs []RuleRef
+	run := textRun{{text: s}}
 	for i := range rules {
+		if !active(i) {
+			continue
+		}
 		var mc int
-		s, mc = applyRuleToText(s, rules[i])
-		total += mc
+		run, mc = run.apply(rules[i])
+		if mc > 0 {
+			total += mc
+			refs = append(refs, rules[i].ref(mc))
+		}
+	}
+	if total == 0 {
+		return s, 0, nil
+	}
+	return run.String(), total, refs
+}
+
+// textRun is text being rewritten, in spans. Frozen spans hold text a
+// stop rule wrote, which the rules after it leave alone. When rules match
+// across inline elements, the text comes from several text nodes, and
+// each span records the node it belongs to; a match spanning nodes puts
+// its replacement in the node where it starts.
+type textRun []textSpan
+
+type textSpan struct {
+	text   string
+	node   int
+	frozen bool
+}
+
+func (run textRun) String() string {
+	if len(run) == 1 {
+		return run[0].text
+	}
+	var b strings.Builder
+	for _, sp := range run {
+		b.WriteString(sp.text)
+	}
+	return b.String()
+}
+
+// nodeTexts returns the text of each of n nodes.
+func (run textRun) nodeTexts(n int) []string {
+	out := make([]string, n)
+	for _, sp := range run {
+		out[sp.node] += sp.text
+	}
+	return out
+}
+
+// apply runs rule over each stretch of spans that are not frozen.
+func (run textRun) apply(rule compiledRule) (textRun, int) {
+	total := 0
+	out := make(textRun, 0, len(run))
+	add := func(sp textSpan) {
+		if sp.text == "" {
+			return
+		}
+		if n := len(out); n > 0 && !out[n-1].frozen && !sp.frozen && out[n-1].node == sp.node {
+			out[n-1].text += sp.text
+			return
+		}
+		out = append(out, sp)
+	}
+	for i := 0; i < len(run); {
+		if run[i].frozen {
+			add(run[i])
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(run) && !run[j].frozen {
+			j++
+		}
+		stretch := run[i:j]
+		i = j
+		text := stretch.String()
+		matches := ruleMatches(text, rule)
+		if len(matches) == 0 {
+			for _, sp := range stretch {
+				add(sp)
+			}
+			continue
+		}
+		total += len(matches)
+		// copyTo adds the text from pos up to end, split by node.
+		k, off, pos := 0, 0, 0
+		copyTo := func(end int) {
+			for pos < end {
+				for off+len(stretch[k].text) <= pos {
+					off += len(stretch[k].text)
+					k++
+				}
+				stop := min(end, off+len(stretch[k].text))
+				add(textSpan{text: text[pos:stop], node: stretch[k].node})
+				pos = stop
+			}
+		}
+		nodeAt := func(at int) int {
+			o := 0
+			for _, sp := range stretch {
+				if at < o+len(sp.text) {
+					return sp.node
+				}
+				o += len(sp.text)
+			}
+			return stretch[len(stretch)-1].node
+		}
+		for _, m := range matches {
+			copyTo(m[0])
+			add(textSpan{text: ruleReplacement(text, rule, m), node: nodeAt(m[0]), frozen: rule.raw.Stop})
+			pos = m[1]
+		}
+		copyTo(len(text))
 	}
-	return s, total
+	if total == 0 {
+		return run, 0
+	}
+	return out, total
+}
+
+// ruleMatches returns the start and end offsets of rule's matches in s,
+// followed for a regex by those of its groups.
+func ruleMatches(s string, rule compiledRule) [][]int {
+	switch {
+	case rule.raw.Action != "":
+		// Action rules change elements, not text.
+		return nil
+	case rule.re != nil:
+		return rule.re.FindAllStringSubmatchIndex(s, -1)
+	}
+	find, text := rule.raw.Find, s
+	if rule.raw.IgnoreCase {
+		find, text = strings.ToLower(find), strings.ToLower(s)
+	}
+	var out [][]int
+	for i := 0; ; {
+		j := strings.Index(text[i:], find)
+		if j < 0 {
+			return out
+		}
+		j += i
+		out = append(out, []int{j, j + len(find)})
+		i = j + len(find)
+	}
+}
+
+// ruleReplacement is the text rule writes for the match m in s.
+func ruleReplacement(s string, rule compiledRule, m []int) string {
+	switch {
+	case rule.tmpl != nil:
+		return rule.tmpl.expand(rule.re, s, m)
+	case rule.re != nil:
+		return string(rule.re.ExpandString(nil, rule.raw.Replace, s, m))
+	}
+	return rule.raw.Replace
+}
+
+func (r compiledRule) ref(matches int) RuleRef {
+	return RuleRef{ID: r.raw.ID, Find: r.raw.Summary(), Matches: matches, RuleSource: r.raw.Source}
 }
 
 func applyRuleToText(s string, rule compiledRule) (string, int) {
 	if s == "" {
 		return s, 0
 	}
+	if rule.re != nil && rule.tmpl != nil {
+		matches := ruleMatches(s, rule)
+		if len(matches) == 0 {
+			return s, 0
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			b.WriteString(s[last:m[0]])
+			b.WriteString(rule.tmpl.expand(rule.re, s, m))
+			last = m[1]
+		}
+		b.WriteString(s[last:])
+		return b.String(), len(matches)
+	}
 	if rule.re != nil {
 		matches := len(rule.re.FindAllStringIndex(s, -1))
 		if matches == 0 {
@@ -459,20 +1309,6 @@ func applyRuleToText(s string, rule compiledRule) (string, int) {
 	return buf.String(), matches
 }
 
-// stripXMLNSAttrs removes xmlns attributes from the list. Go's xml.Encoder
-// re-generates namespace declarations from Name.Space, so keeping the
-// originals produces duplicates like `xmlns="..." xmlns="..."`.
-func stripXMLNSAttrs(attrs []xml.Attr) []xml.Attr {
-	out := attrs[:0]
-	for _, a := range attrs {
-		if a.Name.Local == "xmlns" || a.Name.Space == "xmlns" {
-			continue
-		}
-		out = append(out, a)
-	}
-	return out
-}
-
 func LoadRewriteRulesJSON(path string) ([]RewriteRule, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
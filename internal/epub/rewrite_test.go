@@ -135,15 +135,16 @@ func TestRewriteSelectors(t *testing.T) {
 	if err != nil {
 		t.Fatalf("compileRules: %v", err)
 	}
-	matches, changed, out, err := rewriteXHTMLFile(p, cr)
+	res, err := rewriteXHTMLFile(p, ruleSet{rules: cr}, true)
 	if err != nil {
 		t.Fatalf("rewriteXHTMLFile: %v", err)
 	}
-	if !changed || matches == 0 {
+	if !res.changed || res.matches == 0 {
 		t.Fatalf("expected changes")
 	}
-	if err := os.WriteFile(p, out, 0o644); err != nil {
-		t.Fatalf("write: %v", err)
+	out, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read: %v", err)
 	}
 	s := string(out)
 	if strings.Contains(s, "Chapter 1") == false {
@@ -190,3 +191,216 @@ func TestRewriteDryRunNoMutation(t *testing.T) {
 		t.Fatalf("dry-run should not mutate files")
 	}
 }
+
+func TestRewriteFileFilterAndChanges(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier><dc:title>Foo</dc:title></metadata>
+  <manifest>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Foo one</p><p>Foo two</p></body></html>`,
+		"OEBPS/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Foo three</p></body></html>`,
+	})
+	rules := []RewriteRule{{Find: "Foo", Replace: "Bar"}}
+
+	preview, err := RewriteEPUB(context.Background(), input, RewriteOptions{Scope: RewriteScopeAll, Rules: rules, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(preview.Files) != 3 || preview.Files[0].Href != "content.opf" {
+		t.Fatalf("unexpected preview files %+v", preview.Files)
+	}
+	a := preview.Files[1]
+	if a.Href != "a.xhtml" || a.Matches != 2 || len(a.Changes) != 2 || a.Changes[1].Before != "Foo two" || a.Changes[1].After != "Bar two" || len(a.Changes[1].Rules) != 1 {
+		t.Fatalf("unexpected changes for a.xhtml %+v", a)
+	}
+
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{
+		Scope:      RewriteScopeAll,
+		Rules:      rules,
+		FileFilter: func(href string) bool { return href == "b.xhtml" },
+	})
+	if err != nil {
+		t.Fatalf("filtered rewrite: %v", err)
+	}
+	if stats.FilesChanged != 1 || stats.MatchCount != 1 {
+		t.Fatalf("unexpected filtered stats %+v", stats)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen epub: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := firstDCValue(vol.PackageDoc.Metadata.Titles); got != "Foo" {
+		t.Fatalf("metadata should be untouched, title=%q", got)
+	}
+	a1, _ := os.ReadFile(filepath.Join(vol.PackageDir, "a.xhtml"))
+	b1, _ := os.ReadFile(filepath.Join(vol.PackageDir, "b.xhtml"))
+	if !strings.Contains(string(a1), "Foo one") || !strings.Contains(string(b1), "Bar three") {
+		t.Fatalf("filter not honored:\n%s\n%s", a1, b1)
+	}
+}
+
+func TestRewriteSkipSelectors(t *testing.T) {
+	root := t.TempDir()
+	content := `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>kanji<ruby>漢<rt>kanji</rt></ruby></p><p class="no-edit">kanji <b>kanji</b></p></body></html>`
+	p := filepath.Join(root, "test.xhtml")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cr, err := compileRules([]RewriteRule{{Find: "kanji", Replace: "KANJI"}})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	res, err := rewriteXHTMLFile(p, ruleSet{rules: cr, skip: parseSelectors([]string{"rt", ".no-edit"})}, true)
+	if err != nil {
+		t.Fatalf("rewriteXHTMLFile: %v", err)
+	}
+	if res.matches != 1 {
+		t.Fatalf("expected 1 match outside skipped elements, got %d", res.matches)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	s := string(data)
+	if strings.Count(s, "KANJI") != 1 || !strings.Contains(s, ">kanji</rt>") || !strings.Contains(s, ">kanji</b>") {
+		t.Fatalf("skipped elements were rewritten: %q", s)
+	}
+}
+
+func TestRewriteRulePipeline(t *testing.T) {
+	input := buildTestEPUB(t, "Chapter Book", "en")
+	defer os.Remove(input)
+
+	rules := []RewriteRule{
+		// Without stop, the later rule would turn "Part" into "Piece".
+		{ID: "piece", Find: "Part", Replace: "Piece"},
+		{ID: "part", Find: "Chapter", Replace: "Part", Stop: true, Priority: 1},
+		{ID: "title", Find: "Book", Replace: "Volume", Scope: "meta"},
+		{ID: "nav-only", Find: "Chapter", Replace: "Ch.", Files: []string{"nav.*"}, Priority: 2},
+		{ID: "never", Find: "1", Replace: "One", Exclude: []string{"*.xhtml"}},
+	}
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{
+		Scope: RewriteScopeBody,
+		Rules: rules,
+	})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if stats.MatchCount != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen epub: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read("chapter.xhtml"); !strings.Contains(got, "<p>Part 1</p>") {
+		t.Fatalf("chapter = %s", got)
+	}
+	if got := read("nav.xhtml"); !strings.Contains(got, ">Ch.</a>") {
+		t.Fatalf("nav = %s", got)
+	}
+	if got := firstDCValue(vol.PackageDoc.Metadata.Titles); got != "Chapter Volume" {
+		t.Fatalf("title = %q", got)
+	}
+
+	if _, err := compileRules([]RewriteRule{{Find: "x", Scope: "everywhere"}}); err == nil {
+		t.Fatal("invalid scope accepted")
+	}
+	if _, err := compileRules([]RewriteRule{{Find: "x", Files: []string{"["}}}); err == nil {
+		t.Fatal("invalid glob accepted")
+	}
+}
+
+func TestTextRunStop(t *testing.T) {
+	rules, err := compileRules([]RewriteRule{
+		{Find: `(\w+)-san`, Replace: "Mr. $1", Regex: true, Stop: true},
+		{Find: "Mr.", Replace: "Mister"},
+		{Find: "tanaka", Replace: "X", IgnoreCase: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, n, refs := applyRulesToText("Tanaka-san met Mr. Tanaka", rules)
+	if got != "Mr. Tanaka met Mister X" || n != 3 || len(refs) != 3 {
+		t.Fatalf("got %q, %d matches, %v", got, n, refs)
+	}
+}
+
+func TestRewriteAcrossInline(t *testing.T) {
+	rules, err := compileRules([]RewriteRule{
+		{Find: "foo bar", Replace: "qux"},
+		{Find: "Tanaka-san", Replace: "Mr. Tanaka"},
+		{Find: "a b", Replace: "x", Selectors: []string{"span.fixed"}},
+		{Find: "Mr. Smith", Replace: "Smith-san"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+		`<p>foo <em>bar</em> baz</p>` +
+		`<p><i>Tanaka</i>-<span>san</span> said</p>` +
+		`<p>foo<br/> bar</p>` +
+		`<p>a <span class="fixed">b</span></p>` +
+		`<p>Mr. <a id="n1">Smith</a> and <b>Mr. <em>Smith</em></b></p>` +
+		`</body></html>`
+
+	res, err := rewriteXHTML([]byte(doc), ruleSet{rules: rules, inline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+		`<p>qux baz</p>` +
+		`<p><i>Mr. Tanaka</i> said</p>` +
+		`<p>foo<br/> bar</p>` +
+		`<p>a <span class="fixed">b</span></p>` +
+		`<p>Smith-san<a id="n1"></a> and <b>Smith-san</b></p>` +
+		`</body></html>`
+	if got := string(res.data); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	if res.matches != 4 || len(res.changes) != 3 || res.changes[0].Before != "foo bar baz" || res.changes[0].After != "qux baz" {
+		t.Fatalf("matches %d, changes %+v", res.matches, res.changes)
+	}
+
+	res, err = rewriteXHTML([]byte(doc), ruleSet{rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.changed {
+		t.Fatalf("matched across tags without inline: %+v", res.changes)
+	}
+
+	// Within limits the joined text to the matching elements.
+	within := parseSelectors([]string{"q"})
+	doc = `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+		`<p>foo <em>bar</em> <q>foo <em>bar</em></q></p>` +
+		`</body></html>`
+	res, err = rewriteXHTML([]byte(doc), ruleSet{rules: rules, within: within, inline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<html xmlns="http://www.w3.org/1999/xhtml"><body>` +
+		`<p>foo <em>bar</em> <q>qux</q></p>` +
+		`</body></html>`
+	if got := string(res.data); got != want {
+		t.Fatalf("within: got  %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+package epub
+
+import (
+	"os"
+	"strings"
+)
+
+// svgTextElements hold the text of an SVG image that rules may change; the
+// rest, such as <style> and path data, is left alone.
+var svgTextElements = parseSelectors([]string{"text, tspan, textPath, title, desc"})
+
+// rewriteStylesheetFile applies the rules to the stylesheet at path; with
+// write, a changed stylesheet replaces the file.
+func rewriteStylesheetFile(path string, rules []compiledRule, write bool) (xhtmlRewrite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return xhtmlRewrite{}, err
+	}
+	out, res := rewriteCSS(string(data), rules)
+	if res.changed && write {
+		if err := os.WriteFile(path, []byte(out), 0o644); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// cssToken is a piece of a stylesheet: a comment, a quoted string, a url()
+// with its argument, one of the punctuation marks { } ; : or other text.
+type cssToken struct {
+	kind byte // '/', '"', 'u', the punctuation mark itself, or 0 for text
+	text string
+}
+
+// tokenizeCSS splits css into tokens that, joined, give css back.
+func tokenizeCSS(css string) []cssToken {
+	var out []cssToken
+	start := 0
+	text := func(end int) {
+		if end > start {
+			out = append(out, cssToken{text: css[start:end]})
+		}
+	}
+	for i := 0; i < len(css); {
+		c := css[i]
+		end := -1
+		var kind byte
+		switch {
+		case c == '/' && strings.HasPrefix(css[i:], "/*"):
+			kind, end = '/', len(css)
+			if j := strings.Index(css[i+2:], "*/"); j >= 0 {
+				end = i + 2 + j + 2
+			}
+		case c == '"' || c == '\'':
+			kind, end = '"', len(css)
+			for j := i + 1; j < len(css); j++ {
+				if css[j] == '\\' {
+					j++
+				} else if css[j] == c || css[j] == '\n' {
+					end = j + 1
+					break
+				}
+			}
+		case (c == 'u' || c == 'U') && len(css)-i >= 4 && strings.EqualFold(css[i:i+4], "url(") && (i == 0 || !isCSSNameByte(css[i-1])):
+			kind, end = 'u', len(css)
+			if j := strings.IndexByte(css[i:], ')'); j >= 0 {
+				end = i + j + 1
+			}
+		case c == '{' || c == '}' || c == ';' || c == ':':
+			kind, end = c, i+1
+		default:
+			i++
+			continue
+		}
+		text(i)
+		out = append(out, cssToken{kind: kind, text: css[i:min(end, len(css))]})
+		i, start = end, end
+	}
+	text(len(css))
+	return out
+}
+
+func isCSSNameByte(c byte) bool {
+	return c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// rewriteCSS applies the rules to the declaration values of a stylesheet:
+// their text and the contents of their strings, but not url() arguments or
+// comments. Selectors, property names and at-rule preludes are kept.
+func rewriteCSS(css string, rules []compiledRule) (string, xhtmlRewrite) {
+	var (
+		res   xhtmlRewrite
+		b     strings.Builder
+		stmt  []cssToken
+		depth int
+	)
+	apply := func(s string) string {
+		out, n, refs := applyRulesToText(s, rules)
+		res.matches += n
+		if n > 0 && out != s {
+			res.changes = append(res.changes, TextChange{Before: s, After: out, Rules: refs})
+		}
+		return out
+	}
+	// flush writes the statement so far; decl says it is a declaration,
+	// whose value the rules may change.
+	flush := func(decl bool) {
+		colon := -1
+		if decl {
+			for i, t := range stmt {
+				if t.kind == ':' {
+					colon = i
+					break
+				}
+			}
+		}
+		for i, t := range stmt {
+			switch {
+			case colon < 0 || i <= colon:
+				b.WriteString(t.text)
+			case t.kind == 0 || t.kind == ':':
+				b.WriteString(apply(t.text))
+			case t.kind == '"' && len(t.text) >= 2 && t.text[len(t.text)-1] == t.text[0]:
+				q := t.text[:1]
+				b.WriteString(q + escapeCSSString(apply(t.text[1:len(t.text)-1]), q[0]) + q)
+			default:
+				b.WriteString(t.text)
+			}
+		}
+		stmt = stmt[:0]
+	}
+	for _, t := range tokenizeCSS(css) {
+		switch t.kind {
+		case '{':
+			flush(false)
+			depth++
+			b.WriteString(t.text)
+		case '}', ';':
+			flush(depth > 0)
+			if t.kind == '}' && depth > 0 {
+				depth--
+			}
+			b.WriteString(t.text)
+		default:
+			stmt = append(stmt, t)
+		}
+	}
+	flush(depth > 0)
+	out := b.String()
+	res.changed = out != css
+	return out, res
+}
+
+// escapeCSSString escapes the quote marks and line breaks a replacement
+// put into the contents of a CSS string; existing escapes are kept.
+func escapeCSSString(s string, quote byte) string {
+	if !strings.ContainsAny(s, string(quote)+"\n") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(s[i])
+		case c == quote:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\a `)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteCSS(t *testing.T) {
+	rules, err := compileRules([]RewriteRule{
+		{Find: "Old Mincho", Replace: "New \"Mincho\""},
+		{Find: "old", Replace: "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := `@import url("old.css");
+/* old comment */
+p.old, a:hover { font-family: "Old Mincho", old-serif; background: url(old.png) }
+@media screen { .old { font-family: 'Old Mincho'; content: "x;y" } }
+@font-face { font-family: Old Mincho; src: url('fonts/old.otf') }
+`
+	want := `@import url("old.css");
+/* old comment */
+p.old, a:hover { font-family: "New \"Mincho\"", new-serif; background: url(old.png) }
+@media screen { .old { font-family: 'New "Mincho"'; content: "x;y" } }
+@font-face { font-family: New "Mincho"; src: url('fonts/old.otf') }
+`
+	got, res := rewriteCSS(in, rules)
+	if got != want {
+		t.Fatalf("rewriteCSS =\n%s\nwant\n%s", got, want)
+	}
+	if !res.changed || res.matches != 4 || len(res.changes) != 4 {
+		t.Fatalf("res = %+v", res)
+	}
+	if out, res := rewriteCSS("p { color: red }", rules); out != "p { color: red }" || res.changed {
+		t.Fatalf("unchanged stylesheet = %q, %+v", out, res)
+	}
+}
+
+func TestRewriteStylesheetsAndSVG(t *testing.T) {
+	page := `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>t</title></head><body><nav epub:type="toc"><ol><li><a href="nav.xhtml">Old Font</a></li></ol></nav></body></html>`
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:css</dc:identifier>
+    <dc:title>T</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="map" href="map.svg" media-type="image/svg+xml"/>
+  </manifest>
+  <spine><itemref idref="nav"/></spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": page,
+		"OEBPS/style.css": `body { font-family: "Old Font", serif }`,
+		"OEBPS/map.svg":   `<svg xmlns="http://www.w3.org/2000/svg"><style>.Old { fill: red }</style><text class="Old">Old <tspan>Font</tspan> Town</text><desc>Old Font</desc></svg>`,
+	})
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{
+		Scope: RewriteScopeBody,
+		Rules: []RewriteRule{
+			{Find: "Old Font", Replace: "New Font", Scope: "css,svg"},
+			{Find: "Old", Replace: "Ancient", Scope: "svg"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if stats.FilesChanged != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read("style.css"); got != `body { font-family: "New Font", serif }` {
+		t.Fatalf("style.css = %s", got)
+	}
+	if got := read("map.svg"); !strings.Contains(got, `<style>.Old { fill: red }</style><text class="Old">Ancient <tspan>Font</tspan> Town</text><desc>New Font</desc>`) {
+		t.Fatalf("map.svg = %s", got)
+	}
+	if got := read("nav.xhtml"); !strings.Contains(got, ">Old Font</a>") {
+		t.Fatalf("nav.xhtml = %s", got)
+	}
+}
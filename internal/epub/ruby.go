@@ -0,0 +1,140 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Ruby (furigana) handling modes.
+const (
+	// RubyKeep leaves ruby markup unchanged.
+	RubyKeep = "keep"
+	// RubyStrip removes the readings and the ruby markup, keeping only the
+	// base text.
+	RubyStrip = "strip"
+	// RubyParen replaces ruby with the base text followed by its reading in
+	// full-width parentheses: 漢字（かんじ）.
+	RubyParen = "paren"
+)
+
+var (
+	rubyElementRE = regexp.MustCompile(`(?is)<ruby\b[^>]*>(.*?)</ruby\s*>`)
+	rtElementRE   = regexp.MustCompile(`(?is)<rt\b[^>]*>(.*?)</rt\s*>`)
+	// rpElementRE also drops <rtc> (secondary annotations), which none of
+	// the modes keep.
+	rpElementRE = regexp.MustCompile(`(?is)<(rp|rtc)\b[^>]*>.*?</(?:rp|rtc)\s*>`)
+	rbTagRE     = regexp.MustCompile(`(?i)</?rb\b[^>]*>`)
+	anyTagRE    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// ParseRubyMode accepts keep, strip (or base) and paren; empty means keep.
+func ParseRubyMode(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "keep", "none":
+		return RubyKeep, nil
+	case "strip", "base":
+		return RubyStrip, nil
+	case "paren", "parens", "parenthesize":
+		return RubyParen, nil
+	}
+	return "", fmt.Errorf("unknown ruby mode %q (want keep, strip or paren)", s)
+}
+
+// convertRuby rewrites every <ruby> element in doc according to mode. It
+// returns nil when nothing changed; each converted element is reported as
+// a change from its markup to its replacement.
+func convertRuby(doc []byte, mode string) ([]byte, []TextChange) {
+	if mode == RubyKeep || mode == "" {
+		return nil, nil
+	}
+	var changes []TextChange
+	out := rubyElementRE.ReplaceAllFunc(doc, func(m []byte) []byte {
+		inner := rubyElementRE.FindSubmatch(m)[1]
+		repl := rubyReplacement(string(inner), mode)
+		changes = append(changes, TextChange{Before: string(m), After: repl})
+		return []byte(repl)
+	})
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return out, changes
+}
+
+// rubyReplacement converts the content of one <ruby> element. Each <rt>
+// annotates the base text since the previous one; consecutive <rt>s (as in
+// <rb>漢</rb><rb>字</rb><rt>かん</rt><rt>じ</rt>) share one parenthesis.
+func rubyReplacement(inner, mode string) string {
+	inner = rpElementRE.ReplaceAllString(inner, "")
+	var b strings.Builder
+	prev := 0
+	open := false
+	for _, loc := range rtElementRE.FindAllStringSubmatchIndex(inner, -1) {
+		base := rbTagRE.ReplaceAllString(inner[prev:loc[0]], "")
+		reading := strings.TrimSpace(anyTagRE.ReplaceAllString(inner[loc[2]:loc[3]], ""))
+		prev = loc[1]
+		if mode != RubyParen {
+			b.WriteString(base)
+			continue
+		}
+		if strings.TrimSpace(base) != "" {
+			if open {
+				b.WriteString("）")
+				open = false
+			}
+			b.WriteString(base)
+		}
+		if reading == "" {
+			continue
+		}
+		if !open {
+			b.WriteString("（")
+			open = true
+		}
+		b.WriteString(reading)
+	}
+	if open {
+		b.WriteString("）")
+	}
+	b.WriteString(rbTagRE.ReplaceAllString(inner[prev:], ""))
+	return b.String()
+}
+
+// applyRuby converts ruby in the XHTML documents of manifest (except the
+// nav document) under pkgDir in place.
+func applyRuby(ctx context.Context, pkgDir string, manifest *Manifest, mode string, log *slog.Logger) (RewriteStats, error) {
+	var stats RewriteStats
+	mode, err := ParseRubyMode(mode)
+	if err != nil || mode == RubyKeep {
+		return stats, err
+	}
+	for _, item := range manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return stats, err
+		}
+		out, changes := convertRuby(data, mode)
+		if out == nil {
+			continue
+		}
+		log.Debug("converted ruby", "href", item.Href, "count", len(changes))
+		if err := os.WriteFile(p, out, 0o644); err != nil {
+			return stats, err
+		}
+		stats.FilesChanged++
+		stats.MatchCount += len(changes)
+		stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: len(changes), Changes: changes})
+	}
+	return stats, nil
+}
@@ -0,0 +1,81 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestConvertRuby(t *testing.T) {
+	src := `<p><ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>と<ruby><rb>東</rb><rb>京</rb><rt>とう</rt><rt>きょう</rt></ruby>と<ruby>明<rt>あ</rt>日<rt>す</rt></ruby></p>`
+	cases := []struct {
+		mode, want string
+	}{
+		{RubyStrip, `<p>漢字と東京と明日</p>`},
+		{RubyParen, `<p>漢字（かんじ）と東京（とうきょう）と明（あ）日（す）</p>`},
+	}
+	for _, tc := range cases {
+		out, changes := convertRuby([]byte(src), tc.mode)
+		if string(out) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.mode, out, tc.want)
+		}
+		if len(changes) != 3 {
+			t.Errorf("%s: %d changes, want 3", tc.mode, len(changes))
+		}
+	}
+	if out, _ := convertRuby([]byte(src), RubyKeep); out != nil {
+		t.Errorf("keep should not change the document")
+	}
+	if _, err := ParseRubyMode("furigana"); err == nil {
+		t.Errorf("expected unknown mode to fail")
+	}
+}
+
+func TestRubyInRewriteAndText(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:ruby</dc:identifier>
+    <dc:title>Ruby</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head>
+<body><p><ruby>魔法<rt>まほう</rt></ruby>の国</p><p>二行目</p></body></html>
+`,
+	})
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	if err := ExportText(ctx, input, &buf, TextExportOptions{Ruby: RubyParen}); err != nil {
+		t.Fatalf("ExportText: %v", err)
+	}
+	if got := buf.String(); got != "魔法（まほう）の国\n二行目\n" {
+		t.Fatalf("paren text = %q", got)
+	}
+
+	stats, err := RewriteEPUB(ctx, input, RewriteOptions{Scope: RewriteScopeBody, Ruby: "strip"})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if stats.MatchCount != 1 || stats.FilesChanged != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	buf.Reset()
+	if err := ExportText(ctx, input, &buf, TextExportOptions{Ruby: RubyKeep}); err != nil {
+		t.Fatalf("ExportText: %v", err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "魔法の国\n") {
+		t.Fatalf("ruby not stripped by rewrite: %q", got)
+	}
+}
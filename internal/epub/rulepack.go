@@ -0,0 +1,270 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Files inside a rule pack archive. Only the manifest is required.
+const (
+	RulePackManifestFile      = "manifest.json"
+	RulePackRulesFile         = "rules.json"
+	RulePackGlossaryFile      = "glossary.json"
+	RulePackSkipSelectorsFile = "skip-selectors.json"
+	RulePackMetadataFile      = "metadata.json"
+	RulePackSceneBreakFile    = "scene-break.json"
+)
+
+var rulePackVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+([-+][0-9A-Za-z.-]+)?$`)
+
+type RulePackManifest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Series      string `json:"series,omitempty"`
+	Description string `json:"description,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Created     string `json:"created,omitempty"`
+}
+
+// GlossaryEntry is a literal term replacement shared across a series.
+type GlossaryEntry struct {
+	ID         string `json:"id,omitempty"`
+	Term       string `json:"term"`
+	Replace    string `json:"replace"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+}
+
+// RulePack bundles everything a curation team needs to reproduce a cleanup
+// pass: rewrite rules, a glossary, selectors whose text must not be touched,
+// a scene-break style and a metadata template.
+type RulePack struct {
+	Manifest      RulePackManifest `json:"manifest"`
+	Rules         []RewriteRule    `json:"rules,omitempty"`
+	Glossary      []GlossaryEntry  `json:"glossary,omitempty"`
+	SkipSelectors []string         `json:"skip_selectors,omitempty"`
+	Metadata      *MetadataPatch   `json:"metadata,omitempty"`
+	SceneBreak    *SceneBreakRule  `json:"scene_break,omitempty"`
+}
+
+func (m RulePackManifest) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("rule pack name is required")
+	}
+	if !rulePackVersionPattern.MatchString(m.Version) {
+		return fmt.Errorf("rule pack version %q is not MAJOR.MINOR.PATCH", m.Version)
+	}
+	return nil
+}
+
+// RewriteRules returns the pack's rules followed by its glossary expanded to
+// literal rules. Longer terms come first so they win over their prefixes.
+// Every rule is tagged with the pack as its source; rules without an ID get
+// "rule-N" (1-based position in rules.json) or "glossary:<term>".
+func (p *RulePack) RewriteRules() []RewriteRule {
+	src := p.source()
+	out := make([]RewriteRule, 0, len(p.Rules)+len(p.Glossary))
+	for i, r := range p.Rules {
+		if r.ID == "" {
+			r.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		r.Source = src
+		out = append(out, r)
+	}
+	glossary := append([]GlossaryEntry(nil), p.Glossary...)
+	sort.SliceStable(glossary, func(i, j int) bool {
+		return len(glossary[i].Term) > len(glossary[j].Term)
+	})
+	for _, g := range glossary {
+		if g.Term == "" {
+			continue
+		}
+		id := g.ID
+		if id == "" {
+			id = "glossary:" + g.Term
+		}
+		out = append(out, RewriteRule{ID: id, Find: g.Term, Replace: g.Replace, IgnoreCase: g.IgnoreCase, Source: src})
+	}
+	return out
+}
+
+// SceneBreakRule returns the pack's scene-break rule tagged with the pack as
+// its source, or nil.
+func (p *RulePack) SceneBreakRule() *SceneBreakRule {
+	if p.SceneBreak == nil {
+		return nil
+	}
+	rule := *p.SceneBreak
+	rule.Source = p.source()
+	return &rule
+}
+
+func (p *RulePack) source() *RuleSource {
+	return &RuleSource{Pack: p.Manifest.Name, Version: p.Manifest.Version, Author: p.Manifest.Author}
+}
+
+// LoadRulePackDir reads a pack from a directory laid out like the archive.
+// Non-empty fields of override replace those of the manifest on disk, which
+// may then be absent altogether.
+func LoadRulePackDir(dir string, override RulePackManifest) (*RulePack, error) {
+	read := func(name string) ([]byte, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return data, err
+	}
+	return decodeRulePack(read, override)
+}
+
+// ReadRulePack loads a pack archive.
+func ReadRulePack(path string) (*RulePack, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return decodeRulePack(read, RulePackManifest{})
+}
+
+func decodeRulePack(read func(name string) ([]byte, error), override RulePackManifest) (*RulePack, error) {
+	pack := &RulePack{}
+	targets := []struct {
+		name string
+		dst  any
+	}{
+		{RulePackManifestFile, &pack.Manifest},
+		{RulePackRulesFile, &pack.Rules},
+		{RulePackGlossaryFile, &pack.Glossary},
+		{RulePackSkipSelectorsFile, &pack.SkipSelectors},
+		{RulePackMetadataFile, &pack.Metadata},
+		{RulePackSceneBreakFile, &pack.SceneBreak},
+	}
+	for _, t := range targets {
+		data, err := read(t.name)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		if err := json.Unmarshal(data, t.dst); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", t.name, err)
+		}
+	}
+	m := &pack.Manifest
+	for _, f := range []struct {
+		dst *string
+		val string
+	}{
+		{&m.Name, override.Name},
+		{&m.Version, override.Version},
+		{&m.Series, override.Series},
+		{&m.Description, override.Description},
+		{&m.Author, override.Author},
+	} {
+		if f.val != "" {
+			*f.dst = f.val
+		}
+	}
+	if err := pack.Manifest.validate(); err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// WriteRulePack writes pack as a zip archive to dest. The creation time is
+// filled in when missing.
+func WriteRulePack(pack *RulePack, dest string) error {
+	if err := pack.Manifest.validate(); err != nil {
+		return err
+	}
+	if pack.Manifest.Created == "" {
+		pack.Manifest.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := writeRulePackFiles(pack, func(name string, data []byte) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := ensureParentDir(dest); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, buf.Bytes(), 0o644)
+}
+
+// WriteRulePackDir writes pack as plain JSON files under dir so it can be
+// edited and packed again with LoadRulePackDir.
+func WriteRulePackDir(pack *RulePack, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeRulePackFiles(pack, func(name string, data []byte) error {
+		return os.WriteFile(filepath.Join(dir, name), data, 0o644)
+	})
+}
+
+// writeRulePackFiles emits the manifest and every non-empty section.
+func writeRulePackFiles(pack *RulePack, write func(name string, data []byte) error) error {
+	sections := []struct {
+		name  string
+		v     any
+		empty bool
+	}{
+		{RulePackManifestFile, pack.Manifest, false},
+		{RulePackRulesFile, pack.Rules, len(pack.Rules) == 0},
+		{RulePackGlossaryFile, pack.Glossary, len(pack.Glossary) == 0},
+		{RulePackSkipSelectorsFile, pack.SkipSelectors, len(pack.SkipSelectors) == 0},
+		{RulePackMetadataFile, pack.Metadata, pack.Metadata == nil || pack.Metadata.IsZero()},
+		{RulePackSceneBreakFile, pack.SceneBreak, pack.SceneBreak == nil},
+	}
+	for _, sec := range sections {
+		if sec.empty {
+			continue
+		}
+		data, err := json.MarshalIndent(sec.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := write(sec.name, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRulePackRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	title := "Series Omnibus"
+	pack := &RulePack{
+		Manifest:      RulePackManifest{Name: "series-fixes", Version: "1.2.0", Series: "Example Series"},
+		Rules:         []RewriteRule{{Find: `\s+$`, Regex: true}},
+		Glossary:      []GlossaryEntry{{Term: "Rem", Replace: "Remu"}, {Term: "Remilia", Replace: "Remilia"}},
+		SkipSelectors: []string{"rt"},
+		Metadata:      &MetadataPatch{Title: &title},
+	}
+	archive := filepath.Join(dir, "fixes.novrules")
+	if err := WriteRulePack(pack, archive); err != nil {
+		t.Fatalf("WriteRulePack: %v", err)
+	}
+
+	got, err := ReadRulePack(archive)
+	if err != nil {
+		t.Fatalf("ReadRulePack: %v", err)
+	}
+	if got.Manifest.Name != "series-fixes" || got.Manifest.Version != "1.2.0" || got.Manifest.Series != "Example Series" {
+		t.Fatalf("manifest mismatch: %+v", got.Manifest)
+	}
+	if got.Manifest.Created == "" {
+		t.Fatalf("expected creation time to be recorded")
+	}
+	if len(got.Rules) != 1 || len(got.Glossary) != 2 || len(got.SkipSelectors) != 1 {
+		t.Fatalf("sections mismatch: %+v", got)
+	}
+	if got.Metadata == nil || got.Metadata.Title == nil || *got.Metadata.Title != title {
+		t.Fatalf("metadata mismatch: %+v", got.Metadata)
+	}
+
+	rules := got.RewriteRules()
+	if len(rules) != 3 || rules[1].Find != "Remilia" || rules[2].Find != "Rem" {
+		t.Fatalf("expected rules then glossary longest-first, got %+v", rules)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := WriteRulePackDir(got, unpacked); err != nil {
+		t.Fatalf("WriteRulePackDir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(unpacked, RulePackGlossaryFile)); err != nil {
+		t.Fatalf("glossary not unpacked: %v", err)
+	}
+	repacked, err := LoadRulePackDir(unpacked, RulePackManifest{Version: "1.3.0"})
+	if err != nil {
+		t.Fatalf("LoadRulePackDir: %v", err)
+	}
+	if repacked.Manifest.Version != "1.3.0" || repacked.Manifest.Name != "series-fixes" {
+		t.Fatalf("override not applied: %+v", repacked.Manifest)
+	}
+}
+
+func TestRulePackRejectsBadVersion(t *testing.T) {
+	pack := &RulePack{Manifest: RulePackManifest{Name: "x", Version: "v1"}}
+	if err := WriteRulePack(pack, filepath.Join(t.TempDir(), "x.novrules")); err == nil {
+		t.Fatalf("expected invalid version to be rejected")
+	}
+	if _, err := LoadRulePackDir(t.TempDir(), RulePackManifest{}); err == nil {
+		t.Fatalf("expected missing manifest to be rejected")
+	}
+}
+
+func TestRewriteReportsRuleProvenance(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Rem met Ram.</p></body></html>`,
+	})
+	pack := &RulePack{
+		Manifest: RulePackManifest{Name: "names", Version: "2.0.1", Author: "curator"},
+		Rules:    []RewriteRule{{Find: "met", Replace: "greeted"}},
+		Glossary: []GlossaryEntry{{Term: "Rem", Replace: "Remu"}, {ID: "ram", Term: "Ram", Replace: "Ramu"}},
+	}
+	rules := append(pack.RewriteRules(), RewriteRule{Find: ".", Replace: "!"})
+
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{Rules: rules, DryRun: true})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if len(stats.Files) != 1 || len(stats.Files[0].Changes) != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	refs := stats.Files[0].Changes[0].Rules
+	if len(refs) != 4 {
+		t.Fatalf("expected 4 rule refs, got %+v", refs)
+	}
+	want := []string{"rule-1", "glossary:Rem", "ram", ""}
+	for i, ref := range refs {
+		if ref.ID != want[i] || ref.Matches != 1 {
+			t.Fatalf("ref %d = %+v, want id %q", i, ref, want[i])
+		}
+	}
+	if refs[1].RuleSource == nil || refs[1].Pack != "names" || refs[1].Version != "2.0.1" || refs[1].Author != "curator" {
+		t.Fatalf("missing pack provenance: %+v", refs[1])
+	}
+	if refs[3].RuleSource != nil || refs[3].Find != "." {
+		t.Fatalf("ad-hoc rule should have no source: %+v", refs[3])
+	}
+}
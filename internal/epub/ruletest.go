@@ -0,0 +1,129 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RuleSample is a piece of text to run rewrite rules over without a book.
+type RuleSample struct {
+	Text string `json:"text"`
+	// Element is the selector of the element the text stands in, such as
+	// "p" or "p.note", for rules and skip selectors that need one; without
+	// it only rules without selectors apply.
+	Element string `json:"element,omitempty"`
+	// File is the href the text stands in, for rules with file globs;
+	// without it only rules without Files apply. Rule scopes are ignored:
+	// a sample is any text.
+	File string `json:"file,omitempty"`
+	// Chapter is the navigation label of the chapter the text stands in,
+	// for rules with chapter patterns.
+	Chapter string `json:"chapter,omitempty"`
+	// Expect, when set, is the text the rules must produce.
+	Expect *string `json:"expect,omitempty"`
+}
+
+// RuleSampleResult is what the rules did to one sample.
+type RuleSampleResult struct {
+	Sample RuleSample `json:"sample"`
+	// Steps lists every rule that matched, in order.
+	Steps  []RuleStep `json:"steps,omitempty"`
+	Output string     `json:"output"`
+	// Failed reports that the output differs from Sample.Expect.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// RuleStep is the text before and after one rule.
+type RuleStep struct {
+	Rule   RuleRef `json:"rule"`
+	Before string  `json:"before"`
+	After  string  `json:"after"`
+}
+
+// TestRewriteRules runs rules over each sample as RewriteEPUB would run
+// them over a text node, recording every step. skip is the list of skip
+// selectors.
+func TestRewriteRules(rules []RewriteRule, skip []string, samples []RuleSample) ([]RuleSampleResult, error) {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	skipSel := parseSelectors(skip)
+	results := make([]RuleSampleResult, 0, len(samples))
+	for _, sample := range samples {
+		res := RuleSampleResult{Sample: sample, Output: sample.Text}
+		var el xml.StartElement
+		if sample.Element != "" {
+			el = sampleElement(sample.Element)
+		}
+		if sample.Element == "" || !matchSelectors(skipSel, el) {
+			run := textRun{{text: sample.Text}}
+			for _, rule := range compiled {
+				if len(rule.selectors) > 0 && (sample.Element == "" || !selectorMatches(rule, el)) {
+					continue
+				}
+				if len(rule.raw.Files) > 0 && sample.File == "" || sample.File != "" && !rule.appliesTo(sample.File) {
+					continue
+				}
+				var labels []string
+				if sample.Chapter != "" {
+					labels = []string{sample.Chapter}
+				}
+				if !rule.appliesInChapter(labels) {
+					continue
+				}
+				next, n := run.apply(rule)
+				if n == 0 {
+					continue
+				}
+				after := next.String()
+				res.Steps = append(res.Steps, RuleStep{Rule: rule.ref(n), Before: res.Output, After: after})
+				run, res.Output = next, after
+			}
+		}
+		res.Failed = sample.Expect != nil && *sample.Expect != res.Output
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// sampleElement builds the element a tag.class selector describes.
+func sampleElement(sel string) xml.StartElement {
+	tag, class, _ := strings.Cut(strings.TrimSpace(sel), ".")
+	el := xml.StartElement{Name: xml.Name{Local: strings.ToLower(tag)}}
+	if class != "" {
+		el.Attr = []xml.Attr{{Name: xml.Name{Local: "class"}, Value: strings.ReplaceAll(class, ".", " ")}}
+	}
+	return el
+}
+
+// LoadRuleSamples reads a sample file: a JSON array of RuleSample objects,
+// which may carry expected outputs, or plain text with one sample per
+// non-empty line.
+func LoadRuleSamples(path string) ([]RuleSample, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var samples []RuleSample
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&samples); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return samples, nil
+	}
+	var samples []RuleSample
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) != "" {
+			samples = append(samples, RuleSample{Text: line})
+		}
+	}
+	return samples, nil
+}
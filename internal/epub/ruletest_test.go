@@ -0,0 +1,62 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTestRewriteRules(t *testing.T) {
+	rules := []RewriteRule{
+		{ID: "dash", Find: "--", Replace: "—"},
+		{ID: "honorific", Find: `(\w+)-san`, Replace: "Mr. $1", Regex: true},
+		{ID: "note", Find: "TL", Replace: "Translator", Selectors: []string{"p.note"}},
+	}
+	want := "Mr. Tanaka — TL"
+	samples := []RuleSample{
+		{Text: "Tanaka-san -- TL", Expect: &want},
+		{Text: "TL note", Element: "p.note"},
+		{Text: "TL -- note", Element: "rt"},
+		{Text: "untouched", Expect: &want},
+	}
+	results, err := TestRewriteRules(rules, []string{"rt"}, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Failed || r.Output != want || len(r.Steps) != 2 || r.Steps[0].Rule.ID != "dash" || r.Steps[0].After != "Tanaka-san — TL" {
+		t.Fatalf("sample 1 = %+v", r)
+	}
+	if r := results[1]; r.Output != "Translator note" || len(r.Steps) != 1 {
+		t.Fatalf("sample 2 = %+v", r)
+	}
+	if r := results[2]; r.Output != "TL -- note" || len(r.Steps) != 0 {
+		t.Fatalf("skipped sample = %+v", r)
+	}
+	if !results[3].Failed {
+		t.Fatalf("sample 4 should fail: %+v", results[3])
+	}
+
+	if _, err := TestRewriteRules([]RewriteRule{{Find: "(", Regex: true}}, nil, samples); err == nil {
+		t.Fatal("bad regex accepted")
+	}
+}
+
+func TestLoadRuleSamples(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "samples.txt")
+	if err := os.WriteFile(text, []byte("one\r\n\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := LoadRuleSamples(text)
+	if err != nil || len(samples) != 2 || samples[0].Text != "one" || samples[1].Text != "two" {
+		t.Fatalf("text samples = %+v, %v", samples, err)
+	}
+	js := filepath.Join(dir, "samples.json")
+	if err := os.WriteFile(js, []byte(`[{"text": "a--b", "expect": "a—b", "element": "p"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	samples, err = LoadRuleSamples(js)
+	if err != nil || len(samples) != 1 || samples[0].Expect == nil || *samples[0].Expect != "a—b" || samples[0].Element != "p" {
+		t.Fatalf("json samples = %+v, %v", samples, err)
+	}
+}
@@ -0,0 +1,515 @@
+package epub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config says how to reach an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the store's base URL, such as http://nas.local:9000 for
+	// MinIO; empty means AWS in Region.
+	Endpoint string
+	Region   string
+	// AccessKeyID and SecretAccessKey sign requests; without them requests
+	// are anonymous. SessionToken goes with temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle puts the bucket in the path rather than the host name.
+	// Stores other than AWS usually need it; it is on whenever Endpoint is
+	// set.
+	PathStyle bool
+	Client    *http.Client
+}
+
+// S3ConfigFromEnv reads the configuration the AWS tools use:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION
+// (or AWS_DEFAULT_REGION) and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL).
+func S3ConfigFromEnv() S3Config {
+	cfg := S3Config{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Region:          os.Getenv("AWS_REGION"),
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_S3"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return cfg
+}
+
+// S3Storage is a Storage on an S3-compatible object store, naming books
+// "bucket/key". Books are read with ranged requests as extraction needs
+// them, so nothing is synced to disk first; written books are uploaded
+// when the writer commits. ReadDir lists a key prefix as a directory.
+type S3Storage struct {
+	cfg S3Config
+}
+
+// NewS3Storage returns a Storage for the store cfg describes.
+func NewS3Storage(cfg S3Config) *S3Storage {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint != "" {
+		cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+		cfg.PathStyle = true
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Minute}
+	}
+	return &S3Storage{cfg: cfg}
+}
+
+// s3BlockSize is how much of an object one ranged read fetches, and
+// s3CachedBlocks how many blocks an open object keeps.
+const (
+	s3BlockSize    = 1 << 20
+	s3CachedBlocks = 8
+)
+
+// splitS3Name splits "bucket/key" into its bucket and key.
+func splitS3Name(op, name string) (bucket, key string, err error) {
+	bucket, key, _ = strings.Cut(name, "/")
+	if bucket == "" {
+		return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return bucket, key, nil
+}
+
+// objectURL returns the URL of key in bucket, with query q.
+func (s *S3Storage) objectURL(bucket, key string, q url.Values) *url.URL {
+	var u *url.URL
+	if s.cfg.Endpoint != "" {
+		u, _ = url.Parse(s.cfg.Endpoint)
+	} else {
+		u = &url.URL{Scheme: "https", Host: "s3." + s.cfg.Region + ".amazonaws.com"}
+	}
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	if q != nil {
+		u.RawQuery = s3CanonicalQuery(q)
+	}
+	return u
+}
+
+// do sends a signed request and returns the response for a 2xx status, or
+// an error naming the object.
+func (s *S3Storage) do(req *http.Request, payloadHash string, name string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now().UTC())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var s3err struct {
+		Code    string
+		Message string
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &s3err)
+	detail := resp.Status
+	if s3err.Code != "" {
+		detail += " (" + s3err.Code + ")"
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: "s3 " + strings.ToLower(req.Method), Path: name, Err: fs.ErrNotExist}
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return nil, &fs.PathError{Op: "s3 " + strings.ToLower(req.Method), Path: name, Err: fmt.Errorf("%w: %s", fs.ErrPermission, detail)}
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", strings.ToLower(req.Method), name, detail)
+}
+
+// emptyPayloadHash is the SHA-256 of no bytes, the payload hash of a
+// request without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Storage) Open(ctx context.Context, name string) (fs.File, error) {
+	bucket, key, err := splitS3Name("open", name)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(bucket, key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayloadHash, name)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3File{
+		s:      s,
+		ctx:    ctx,
+		bucket: bucket,
+		key:    key,
+		info:   s3Info{name: path.Base(key), size: resp.ContentLength, modTime: modTime},
+		etag:   resp.Header.Get("ETag"),
+		blocks: map[int64][]byte{},
+	}, nil
+}
+
+// s3File is an open object, read in blocks with ranged requests.
+type s3File struct {
+	s *S3Storage
+	// ctx is the context the object was opened with, which its reads
+	// stay bound to.
+	ctx         context.Context
+	bucket, key string
+	info        s3Info
+	// etag pins the reads to the object as it was opened.
+	etag string
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+	order  []int64
+	offset int64
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *s3File) Close() error               { return nil }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	off := f.offset
+	f.mu.Unlock()
+	n, err := f.ReadAt(p, off)
+	f.mu.Lock()
+	f.offset += int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.bucket + "/" + f.key, Err: fs.ErrInvalid}
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= f.info.size {
+			return n, io.EOF
+		}
+		block, err := f.block(pos / s3BlockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%s3BlockSize:])
+	}
+	return n, nil
+}
+
+// block returns block i of the object, fetching it if it is not cached.
+func (f *s3File) block(i int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if b, ok := f.blocks[i]; ok {
+		return b, nil
+	}
+	start := i * s3BlockSize
+	end := min(start+s3BlockSize, f.info.size) - 1
+	name := f.bucket + "/" + f.key
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.s.objectURL(f.bucket, f.key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if f.etag != "" {
+		req.Header.Set("If-Match", f.etag)
+	}
+	resp, err := f.s.do(req, emptyPayloadHash, name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && start > 0 {
+		return nil, fmt.Errorf("s3 get %s: ranged read answered with %s", name, resp.Status)
+	}
+	b := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, fmt.Errorf("s3 get %s: %w", name, err)
+	}
+	if len(f.order) == s3CachedBlocks {
+		delete(f.blocks, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.blocks[i] = b
+	f.order = append(f.order, i)
+	return b, nil
+}
+
+// s3Info describes an object or a key prefix.
+type s3Info struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i s3Info) Name() string       { return i.name }
+func (i s3Info) Size() int64        { return i.size }
+func (i s3Info) ModTime() time.Time { return i.modTime }
+func (i s3Info) IsDir() bool        { return i.dir }
+func (i s3Info) Sys() any           { return nil }
+func (i s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// ReadDir lists the objects and prefixes one level under the prefix name,
+// "bucket" or "bucket/prefix", sorted by name.
+func (s *S3Storage) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	bucket, prefix, err := splitS3Name("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := s.objectURL(bucket, "", q)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptyPayloadHash, name)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", name, err)
+		}
+		for _, c := range page.Contents {
+			if base := strings.TrimPrefix(c.Key, prefix); base != "" && !strings.Contains(base, "/") {
+				entries = append(entries, fs.FileInfoToDirEntry(s3Info{name: base, size: c.Size, modTime: c.LastModified}))
+			}
+		}
+		for _, p := range page.CommonPrefixes {
+			if base := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); base != "" {
+				entries = append(entries, fs.FileInfoToDirEntry(s3Info{name: base, dir: true}))
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *S3Storage) Create(ctx context.Context, name string) (BookWriter, error) {
+	bucket, key, err := splitS3Name("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	// A PUT needs the length and checksum of the whole book up front, so
+	// it is spooled to a temp file first.
+	f, err := os.CreateTemp("", "novfmt-upload-*.epub")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, ctx: ctx, bucket: bucket, key: key, f: f, sum: sha256.New()}, nil
+}
+
+// s3Writer spools a book and uploads it on commit.
+type s3Writer struct {
+	s *S3Storage
+	// ctx is the context the writer was created with; it bounds the
+	// upload.
+	ctx         context.Context
+	bucket, key string
+	f           *os.File
+	sum         hash.Hash
+	size        int64
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.sum.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Commit() error {
+	defer w.Abort()
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPut, w.s.objectURL(w.bucket, w.key, nil).String(), io.NopCloser(w.f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = w.size
+	req.Header.Set("Content-Type", epubMimeType)
+	resp, err := w.s.do(req, hex.EncodeToString(w.sum.Sum(nil)), w.bucket+"/"+w.key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.f.Close()
+	if err := os.Remove(w.f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.AccessKeyID == "" {
+		return
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKeyID+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way Signature Version 4 expects: every
+// byte but the unreserved characters.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of an object path.
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes q sorted by key, as both the request and its
+// signature use it.
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
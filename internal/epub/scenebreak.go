@@ -0,0 +1,331 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DefaultSceneBreakMarker replaces detected scene breaks when
+// SceneBreakRule.Marker is empty.
+const DefaultSceneBreakMarker = `<hr class="scene-break"/>`
+
+// SceneBreakRule replaces scene separators (hr elements, paragraphs made of
+// symbols such as *** or ◇◇◇, and empty centered paragraphs) with a single
+// canonical marker. Adjacent separators collapse into one marker.
+type SceneBreakRule struct {
+	// Marker is the XHTML snippet to insert (default DefaultSceneBreakMarker).
+	Marker string `json:"marker,omitempty"`
+	// Patterns are extra regular expressions; a paragraph whose whole
+	// trimmed text matches one is also treated as a break.
+	Patterns []string `json:"patterns,omitempty"`
+	// Source records the rule pack the rule came from, if any.
+	Source *RuleSource `json:"-"`
+}
+
+type compiledSceneBreak struct {
+	markerSig string
+	markerSrc string
+	patterns  []*regexp.Regexp
+	ref       RuleRef
+}
+
+// sceneBreakSymbols may make up a separator paragraph on their own.
+const sceneBreakSymbols = "*＊◇◆○●□■☆★※#＃~〜～=＝・·•♦♢◎†§-—―"
+
+// sceneBreakSingles are symbols that form a separator even when alone.
+const sceneBreakSingles = "*＊◇◆○●☆★※#＃§♦"
+
+// sceneBreakBlockers abort separator detection when they appear inside a
+// candidate element: the element holds real content.
+var sceneBreakBlockers = map[string]bool{
+	"p": true, "div": true, "section": true, "blockquote": true, "table": true,
+	"ul": true, "ol": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "img": true, "svg": true, "image": true,
+	"figure": true, "a": true,
+}
+
+func compileSceneBreak(rule *SceneBreakRule) (*compiledSceneBreak, error) {
+	if rule == nil {
+		return nil, nil
+	}
+	src := strings.TrimSpace(rule.Marker)
+	if src == "" {
+		src = DefaultSceneBreakMarker
+	}
+	marker, err := parseXHTMLSnippet(src)
+	if err != nil {
+		return nil, fmt.Errorf("scene-break marker: %w", err)
+	}
+	cs := &compiledSceneBreak{
+		markerSig: tokenSignature(marker),
+		markerSrc: src,
+		ref:       RuleRef{ID: "scene-break", Find: "scene-break", RuleSource: rule.Source},
+	}
+	for _, p := range rule.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("scene-break pattern %q: %w", p, err)
+		}
+		cs.patterns = append(cs.patterns, re)
+	}
+	return cs, nil
+}
+
+// parseXHTMLSnippet decodes a fragment that may have several top-level
+// nodes.
+func parseXHTMLSnippet(src string) ([]xml.Token, error) {
+	dec := xml.NewDecoder(strings.NewReader("<snippet>" + src + "</snippet>"))
+	var toks []xml.Token
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		toks = append(toks, xml.CopyToken(tok))
+	}
+	if len(toks) < 2 {
+		return nil, fmt.Errorf("empty snippet")
+	}
+	return toks[1 : len(toks)-1], nil
+}
+
+// normalizeSceneBreaks rewrites an XHTML document, returning nil data when
+// nothing changed.
+func normalizeSceneBreaks(data []byte, sb *compiledSceneBreak) ([]byte, []TextChange, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	var (
+		changes []TextChange
+		// buf holds a candidate element's tokens until its end tag.
+		buf   []rawToken
+		depth int
+		// afterMarker is set while only whitespace follows a marker, so a
+		// second separator right after it is dropped.
+		afterMarker bool
+	)
+	emit := func(rt rawToken) error {
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			afterMarker = false
+		case xml.EndElement:
+			afterMarker = false
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				afterMarker = false
+			}
+		}
+		return sp.copy(rt)
+	}
+	flush := func() error {
+		for _, rt := range buf {
+			if err := emit(rt); err != nil {
+				return err
+			}
+		}
+		buf = nil
+		return nil
+	}
+
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+
+		if buf == nil {
+			start, ok := rt.tok.(xml.StartElement)
+			if !ok || !isSceneBreakCandidate(start.Name.Local) {
+				if err := emit(rt); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			buf, depth = []rawToken{rt}, 0
+			continue
+		}
+
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			if sceneBreakBlockers[strings.ToLower(t.Name.Local)] {
+				// Real content: give up on the buffered element and treat
+				// this one as a fresh candidate.
+				if err := flush(); err != nil {
+					return nil, nil, err
+				}
+				if isSceneBreakCandidate(t.Name.Local) {
+					buf, depth = []rawToken{rt}, 0
+				} else if err := emit(rt); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			depth++
+			buf = append(buf, rt)
+			continue
+		case xml.EndElement:
+			buf = append(buf, rt)
+			if depth > 0 {
+				depth--
+				continue
+			}
+		default:
+			buf = append(buf, rt)
+			continue
+		}
+
+		// buf now holds one complete candidate element.
+		toks := rawTokens(buf)
+		before, isBreak := sb.classify(toks)
+		switch {
+		case !isBreak:
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		case afterMarker:
+			changes = append(changes, TextChange{Before: before, After: "", Rules: []RuleRef{sb.matchRef()}})
+			buf = nil
+		case tokenSignature(toks) == sb.markerSig:
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+			afterMarker = true
+		default:
+			if err := sp.writeRaw(sb.markerSrc); err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, TextChange{Before: before, After: sb.markerSrc, Rules: []RuleRef{sb.matchRef()}})
+			buf = nil
+			afterMarker = true
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	return out.Bytes(), changes, nil
+}
+
+func (sb *compiledSceneBreak) matchRef() RuleRef {
+	ref := sb.ref
+	ref.Matches = 1
+	return ref
+}
+
+func isSceneBreakCandidate(local string) bool {
+	switch strings.ToLower(local) {
+	case "p", "div", "hr":
+		return true
+	}
+	return false
+}
+
+// classify reports whether the buffered element is a scene break and
+// describes it for the change report.
+func (sb *compiledSceneBreak) classify(toks []xml.Token) (string, bool) {
+	start := toks[0].(xml.StartElement)
+	if strings.EqualFold(start.Name.Local, "hr") {
+		return "<hr>", true
+	}
+
+	var text strings.Builder
+	for _, tok := range toks[1:] {
+		if cd, ok := tok.(xml.CharData); ok {
+			text.Write(cd)
+		}
+	}
+	trimmed := strings.TrimFunc(text.String(), unicode.IsSpace)
+	if trimmed == "" {
+		if isCenteredElement(start) {
+			return "(empty centered paragraph)", true
+		}
+		return "", false
+	}
+	for _, re := range sb.patterns {
+		if re.MatchString(trimmed) {
+			return trimmed, true
+		}
+	}
+	return trimmed, isSeparatorText(trimmed)
+}
+
+func isSeparatorText(s string) bool {
+	count := 0
+	var only rune
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if !strings.ContainsRune(sceneBreakSymbols, r) {
+			return false
+		}
+		count++
+		only = r
+	}
+	if count == 1 {
+		return strings.ContainsRune(sceneBreakSingles, only)
+	}
+	return count > 1
+}
+
+func isCenteredElement(el xml.StartElement) bool {
+	for _, a := range el.Attr {
+		v := strings.ToLower(a.Value)
+		switch a.Name.Local {
+		case "class":
+			if strings.Contains(v, "center") || strings.Contains(v, "centre") {
+				return true
+			}
+		case "style":
+			if strings.Contains(v, "text-align") && strings.Contains(v, "center") {
+				return true
+			}
+		case "align":
+			if v == "center" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenSignature summarises tokens by local names, attributes and
+// non-blank text so namespace handling doesn't affect comparisons.
+func tokenSignature(toks []xml.Token) string {
+	var b strings.Builder
+	for _, tok := range toks {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			attrs := make([]string, 0, len(t.Attr))
+			for _, a := range t.Attr {
+				if a.Name.Local == "xmlns" || a.Name.Space == "xmlns" {
+					continue
+				}
+				attrs = append(attrs, a.Name.Local+"="+a.Value)
+			}
+			sort.Strings(attrs)
+			fmt.Fprintf(&b, "<%s %s>", strings.ToLower(t.Name.Local), strings.Join(attrs, " "))
+		case xml.EndElement:
+			fmt.Fprintf(&b, "</%s>", strings.ToLower(t.Name.Local))
+		case xml.CharData:
+			if s := strings.TrimSpace(string(t)); s != "" {
+				b.WriteString(s)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeSceneBreaks(t *testing.T) {
+	sb, err := compileSceneBreak(&SceneBreakRule{Patterns: []string{`^~ fin ~$`}})
+	if err != nil {
+		t.Fatalf("compileSceneBreak: %v", err)
+	}
+	src := `<html xmlns="http://www.w3.org/1999/xhtml"><body>
+<p>One.</p>
+<p class="center">* * *</p>
+<p>Two.</p>
+<p>◇◇◇</p>
+<hr/>
+<p style="text-align: center">&#160;</p>
+<p>Three.</p>
+<div><p>Keep — this</p><p>***</p></div>
+<p>#</p>
+<p>~ fin ~</p>
+<p>-</p>
+<p></p>
+</body></html>`
+	out, changes, err := normalizeSceneBreaks([]byte(src), sb)
+	if err != nil {
+		t.Fatalf("normalizeSceneBreaks: %v", err)
+	}
+	// * * *, ◇◇◇ (+ hr, empty centered dropped), *** inside the div, # (+ ~ fin ~ dropped).
+	if len(changes) != 7 {
+		t.Fatalf("expected 7 changes, got %d: %+v", len(changes), changes)
+	}
+	s := string(out)
+	if n := strings.Count(s, `class="scene-break"`); n != 4 {
+		t.Fatalf("expected 4 markers, got %d in %s", n, s)
+	}
+	for _, keep := range []string{"One.", "Keep — this", ">-</p>", "<p></p>"} {
+		if !strings.Contains(s, keep) {
+			t.Fatalf("missing %q in %s", keep, s)
+		}
+	}
+
+	again, changes, err := normalizeSceneBreaks(out, sb)
+	if err != nil || again != nil || len(changes) != 0 {
+		t.Fatalf("second pass should be a no-op, got %d changes (err %v)", len(changes), err)
+	}
+}
+
+func TestRewriteSceneBreakMarker(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>A</p><p>＊＊＊</p><p>B</p></body></html>`,
+	})
+	stats, err := RewriteEPUB(context.Background(), input, RewriteOptions{
+		SceneBreak: &SceneBreakRule{Marker: `<div class="sb"><span>◆</span></div>`},
+	})
+	if err != nil {
+		t.Fatalf("RewriteEPUB: %v", err)
+	}
+	if stats.MatchCount != 1 || stats.Files[0].Changes[0].Rules[0].ID != "scene-break" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "a.xhtml"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(data), `<div class="sb"><span>◆</span></div>`) || strings.Contains(string(data), "＊") {
+		t.Fatalf("marker not inserted: %s", data)
+	}
+}
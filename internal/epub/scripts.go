@@ -0,0 +1,232 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// scriptMediaTypes are the media types of JavaScript files.
+var scriptMediaTypes = map[string]bool{
+	"application/javascript":   true,
+	"application/ecmascript":   true,
+	"application/x-javascript": true,
+	"text/javascript":          true,
+}
+
+// isScriptItem reports whether a manifest item is a JavaScript file.
+func isScriptItem(item ManifestItem) bool {
+	return scriptMediaTypes[strings.ToLower(item.MediaType)] || strings.EqualFold(path.Ext(item.Href), ".js")
+}
+
+// scriptFindings counts the scripting a document holds.
+type scriptFindings struct {
+	elements int
+	// handlers counts event handler attributes by name.
+	handlers map[string]int
+	links    int
+}
+
+func (f scriptFindings) any() bool {
+	return f.elements > 0 || len(f.handlers) > 0 || f.links > 0
+}
+
+// String describes the findings, such as "2 <script> elements, 1 event
+// handler (onclick)".
+func (f scriptFindings) String() string {
+	var parts []string
+	if f.elements > 0 {
+		parts = append(parts, countNoun(f.elements, "<script> element", "<script> elements"))
+	}
+	if len(f.handlers) > 0 {
+		n := 0
+		names := make([]string, 0, len(f.handlers))
+		for name, c := range f.handlers {
+			n += c
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts = append(parts, fmt.Sprintf("%s (%s)", countNoun(n, "event handler", "event handlers"), strings.Join(names, ", ")))
+	}
+	if f.links > 0 {
+		parts = append(parts, countNoun(f.links, "javascript: link", "javascript: links"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func countNoun(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// stripScripts finds the scripting in an XHTML or SVG document: <script>
+// elements, on* event handler attributes and javascript: links. It returns
+// the document without them, or nil data when there are none.
+func stripScripts(data []byte) ([]byte, scriptFindings, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+	found := scriptFindings{handlers: map[string]int{}}
+	// skip counts the open elements of a <script> being dropped.
+	skip := 0
+	for {
+		rt, err := sp.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, found, err
+		}
+		if skip > 0 {
+			switch rt.tok.(type) {
+			case xml.StartElement:
+				skip++
+			case xml.EndElement:
+				skip--
+			}
+			continue
+		}
+		t, ok := rt.tok.(xml.StartElement)
+		if !ok {
+			if err := sp.copy(rt); err != nil {
+				return nil, found, err
+			}
+			continue
+		}
+		if strings.EqualFold(t.Name.Local, "script") {
+			found.elements++
+			skip = 1
+			continue
+		}
+		raw := rt.raw
+		for _, a := range t.Attr {
+			name := qualifiedAttrName(a.Name)
+			switch {
+			case isEventHandler(a.Name):
+				found.handlers[strings.ToLower(a.Name.Local)]++
+			case a.Name.Local == "href" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(a.Value)), "javascript:"):
+				found.links++
+			default:
+				continue
+			}
+			raw = withoutAttr(raw, name)
+		}
+		if _, err := out.Write(raw); err != nil {
+			return nil, found, err
+		}
+	}
+	if !found.any() {
+		return nil, found, nil
+	}
+	return out.Bytes(), found, nil
+}
+
+// isEventHandler reports whether an attribute is an on* event handler,
+// such as onclick.
+func isEventHandler(n xml.Name) bool {
+	local := strings.ToLower(n.Local)
+	return n.Space == "" && len(local) > 2 && strings.HasPrefix(local, "on") && local != "open"
+}
+
+// qualifiedAttrName returns an attribute's name as written in the usual
+// prefixes: the decoder resolves xlink:href to the XLink namespace.
+func qualifiedAttrName(n xml.Name) string {
+	switch n.Space {
+	case "":
+		return n.Local
+	case "http://www.w3.org/1999/xlink":
+		return "xlink:" + n.Local
+	}
+	return qualifiedName(n)
+}
+
+// checkScripts reports JavaScript files, scripting in content documents
+// and scripted properties that do not match. With strip it removes the
+// scripting, the files and the property; with fix it only corrects the
+// property.
+func (v *validator) checkScripts(strip bool) error {
+	pkg := v.vol.PackageDoc
+	epub3 := strings.HasPrefix(strings.TrimSpace(pkg.Version), "3")
+	removed := map[string]bool{}
+	kept := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		if !isScriptItem(item) {
+			kept = append(kept, item)
+			continue
+		}
+		v.report.add("scripts", SeverityWarning, item.Href, strip, "JavaScript file")
+		if !strip {
+			kept = append(kept, item)
+			continue
+		}
+		if err := os.Remove(filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href)))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		v.report.Changeset.removed(item.Href)
+		removed[item.ID] = true
+		v.packageChanged = true
+	}
+	pkg.Manifest.Items = kept
+	for i := range pkg.Manifest.Items {
+		if removed[pkg.Manifest.Items[i].Fallback] {
+			pkg.Manifest.Items[i].Fallback = ""
+		}
+	}
+
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		if item.MediaType != "application/xhtml+xml" && item.MediaType != "image/svg+xml" {
+			continue
+		}
+		p := filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href)))
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stripped, found, err := stripScripts(data)
+		if err != nil {
+			// Malformed markup is the markup check's to report.
+			continue
+		}
+		scripted := found.any()
+		if scripted {
+			v.report.add("scripts", SeverityWarning, item.Href, strip, "%s", found)
+			if strip {
+				if err := os.WriteFile(p, stripped, 0o644); err != nil {
+					return err
+				}
+				v.report.Changeset.modified(item.Href)
+				scripted = false
+			}
+		}
+		has := hasProperty(item.Properties, "scripted")
+		switch {
+		case scripted && !has && epub3:
+			v.report.add("scripts", SeverityError, item.Href, v.fix, "%s has scripts but lacks the scripted property", item.Href)
+			if v.fix {
+				item.Properties = addProperty(item.Properties, "scripted")
+				v.packageChanged = true
+			}
+		case !scripted && has:
+			fixed := v.fix || strip
+			if !found.any() {
+				v.report.add("scripts", SeverityWarning, item.Href, fixed, "%s has the scripted property but no scripts", item.Href)
+			}
+			if fixed {
+				item.Properties = removeProperty(item.Properties, "scripted")
+				v.packageChanged = true
+			}
+		}
+	}
+	return nil
+}
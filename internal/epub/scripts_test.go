@@ -0,0 +1,100 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripScripts(t *testing.T) {
+	in := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>t</title><script src="app.js"/><script type="text/javascript">if (a &lt; b) { go(); }</script></head>
+<body onload="init()"><p onclick='x()' class="a">Text <a href=" JavaScript:void(0)">here</a>.</p><details open="">d</details></body></html>`
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>t</title></head>
+<body><p class="a">Text <a>here</a>.</p><details open="">d</details></body></html>`
+	out, found, err := stripScripts([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Fatalf("got  %s\nwant %s", out, want)
+	}
+	if got := found.String(); got != "2 <script> elements, 2 event handlers (onclick, onload), 1 javascript: link" {
+		t.Fatalf("findings = %s", got)
+	}
+	if out, _, err := stripScripts([]byte(want)); out != nil || err != nil {
+		t.Fatalf("second run changed the document: %s, %v", out, err)
+	}
+}
+
+func TestValidateStripScripts(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:scripts</dc:identifier>
+    <dc:title>Scripts</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml" properties="scripted"/>
+    <item id="js" href="app.js" media-type="application/javascript"/>
+  </manifest>
+  <spine><itemref idref="ch1"/><itemref idref="ch2"/></spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>n</title></head><body><nav epub:type="toc"><ol><li><a href="ch1.xhtml">One</a></li></ol></nav></body></html>`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title><script src="app.js"></script></head><body><p>One</p></body></html>`,
+		"OEBPS/ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head><body><p>Two</p></body></html>`,
+		"OEBPS/app.js":    `alert(1)`,
+	})
+
+	report, err := Validate(ctx, input, ValidateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, issue := range report.Issues {
+		if issue.Check == "scripts" {
+			messages = append(messages, issue.Severity+" "+issue.Href+": "+issue.Message)
+		}
+	}
+	want := "warning app.js: JavaScript file|" +
+		"warning ch1.xhtml: 1 <script> element|" +
+		"error ch1.xhtml: ch1.xhtml has scripts but lacks the scripted property|" +
+		"warning ch2.xhtml: ch2.xhtml has the scripted property but no scripts"
+	if got := strings.Join(messages, "|"); got != want {
+		t.Fatalf("issues = %s\nwant %s", got, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "clean.epub")
+	report, err = Validate(ctx, input, ValidateOptions{StripScripts: true, OutPath: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() || !report.Changeset.Written() {
+		t.Fatalf("report = %+v", report)
+	}
+	vol, err := loadVolume(ctx, 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	items := manifestByID(vol.PackageDoc)
+	if _, ok := items["js"]; ok || items["ch2"].Properties != "" {
+		t.Fatalf("manifest = %+v", vol.PackageDoc.Manifest.Items)
+	}
+	if _, err := os.Stat(filepath.Join(vol.PackageDir, "app.js")); !os.IsNotExist(err) {
+		t.Fatalf("app.js kept: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "ch1.xhtml"))
+	if err != nil || strings.Contains(string(data), "script") {
+		t.Fatalf("ch1.xhtml = %s, %v", data, err)
+	}
+}
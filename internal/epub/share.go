@@ -0,0 +1,199 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictAction is what merge does with a resource found at the same path
+// in two volumes with different content.
+type ConflictAction int
+
+const (
+	// ConflictRename keeps both; the later copy stays under its own volume
+	// directory.
+	ConflictRename ConflictAction = iota
+	// ConflictKeepFirst drops the later copy and points its volume at the
+	// earlier one.
+	ConflictKeepFirst
+	// ConflictFail aborts the merge.
+	ConflictFail
+)
+
+func ParseConflictAction(s string) (ConflictAction, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "rename":
+		return ConflictRename, nil
+	case "keep-first":
+		return ConflictKeepFirst, nil
+	case "fail":
+		return ConflictFail, nil
+	}
+	return 0, fmt.Errorf("unknown conflict action %q (want rename, keep-first or fail)", s)
+}
+
+func (a ConflictAction) String() string {
+	switch a {
+	case ConflictRename:
+		return "rename"
+	case ConflictKeepFirst:
+		return "keep-first"
+	case ConflictFail:
+		return "fail"
+	}
+	return fmt.Sprintf("ConflictAction(%d)", int(a))
+}
+
+// ResolveConflict makes a ConflictAction a ConflictResolver that treats
+// every conflict the same way.
+func (a ConflictAction) ResolveConflict(ResourceConflict) (ConflictAction, error) { return a, nil }
+
+// ResourceConflict describes two volumes holding different files at the
+// same path.
+type ResourceConflict struct {
+	// Path is relative to each volume's package document.
+	Path      string
+	MediaType string
+	First     ConflictResource
+	Incoming  ConflictResource
+}
+
+type ConflictResource struct {
+	Volume     int
+	SourcePath string
+	// Href is the resource's path in the merged book.
+	Href string
+	// File is the staged copy on disk, for resolvers that compare content.
+	File string
+}
+
+// ConflictResolver decides, per case, what merge does when
+// MergeOptions.ShareResources finds differing resources at the same path.
+type ConflictResolver interface {
+	ResolveConflict(c ResourceConflict) (ConflictAction, error)
+}
+
+// ConflictResolverFunc adapts a function to the ConflictResolver interface.
+type ConflictResolverFunc func(c ResourceConflict) (ConflictAction, error)
+
+func (f ConflictResolverFunc) ResolveConflict(c ResourceConflict) (ConflictAction, error) {
+	return f(c)
+}
+
+type sharedCopy struct {
+	item ManifestItem
+	vol  *Volume
+	data []byte
+}
+
+// shareResources stores resources (stylesheets, images, fonts, ...) that
+// several volumes keep at the same path once, under the first volume that
+// has them, and points the other volumes' references there. Differing
+// copies go to resolver (nil means ConflictRename).
+func shareResources(oebpsDir string, manifest *Manifest, spine Spine, volumes []*Volume, resolver ConflictResolver, plan *MergePlan, log *slog.Logger) error {
+	if resolver == nil {
+		resolver = ConflictRename
+	}
+	inSpine := map[string]bool{}
+	for _, ref := range spine.Itemrefs {
+		inSpine[ref.IDRef] = true
+	}
+	type origin struct {
+		vol *Volume
+		rel string
+	}
+	origins := map[string]origin{}
+	for _, vol := range volumes {
+		for rel, href := range vol.Paths {
+			origins[href] = origin{vol, rel}
+		}
+	}
+	volumeOf := func(href string) (*Volume, string) {
+		o := origins[href]
+		return o.vol, o.rel
+	}
+
+	copies := map[string][]sharedCopy{}
+	replaced := map[string]string{}
+	replacedIDs := map[string]string{}
+	kept := manifest.Items[:0]
+	for _, item := range manifest.Items {
+		vol, rel := volumeOf(item.Href)
+		if vol == nil || item.Properties != "" || inSpine[item.ID] ||
+			item.MediaType == "application/xhtml+xml" || item.MediaType == "application/x-dtbncx+xml" {
+			kept = append(kept, item)
+			continue
+		}
+		p := filepath.Join(oebpsDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var target *sharedCopy
+		for i, c := range copies[rel] {
+			if c.item.MediaType == item.MediaType && bytes.Equal(c.data, data) {
+				target = &copies[rel][i]
+				break
+			}
+		}
+		if target == nil && len(copies[rel]) > 0 {
+			first := copies[rel][0]
+			conflict := ResourceConflict{
+				Path:      rel,
+				MediaType: item.MediaType,
+				First:     ConflictResource{Volume: first.vol.Index, SourcePath: first.vol.SourcePath, Href: first.item.Href, File: filepath.Join(oebpsDir, filepath.FromSlash(first.item.Href))},
+				Incoming:  ConflictResource{Volume: vol.Index, SourcePath: vol.SourcePath, Href: item.Href, File: p},
+			}
+			action, err := resolver.ResolveConflict(conflict)
+			if err != nil {
+				return fmt.Errorf("resolve conflict for %s: %w", rel, err)
+			}
+			log.Info("resource conflict", "path", rel, "first", first.vol.SourcePath, "incoming", vol.SourcePath, "action", action.String())
+			switch action {
+			case ConflictRename:
+				plan.resource(item.Href, ResourceRenamed, "")
+			case ConflictKeepFirst:
+				target = &copies[rel][0]
+			case ConflictFail:
+				return fmt.Errorf("resource conflict: %s differs between %s and %s", rel, first.vol.SourcePath, vol.SourcePath)
+			default:
+				return fmt.Errorf("resolve conflict for %s: unknown action %v", rel, action)
+			}
+		}
+		if target == nil {
+			copies[rel] = append(copies[rel], sharedCopy{item: item, vol: vol, data: data})
+			kept = append(kept, item)
+			continue
+		}
+		replaced[item.Href] = target.item.Href
+		replacedIDs[item.ID] = target.item.ID
+		if target == &copies[rel][0] && !bytes.Equal(target.data, data) {
+			plan.resource(item.Href, ResourceKeptFirst, target.item.Href)
+		} else {
+			plan.resource(item.Href, ResourceShared, target.item.Href)
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	manifest.Items = kept
+	if len(replaced) == 0 {
+		return nil
+	}
+	log.Info("shared resources", "removed", len(replaced))
+
+	for i := range manifest.Items {
+		if id, ok := replacedIDs[manifest.Items[i].Fallback]; ok {
+			manifest.Items[i].Fallback = id
+		}
+	}
+	_, err := rewriteReferences(oebpsDir, &PackageDocument{Manifest: *manifest}, func(target string) (string, bool) {
+		href, ok := replaced[target]
+		return href, ok
+	})
+	return err
+}
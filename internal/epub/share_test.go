@@ -0,0 +1,89 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildImageVolume(t *testing.T, image string) string {
+	t.Helper()
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:share</dc:identifier>
+    <dc:title>Share</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="logo" href="Images/logo.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head><body><p><img src="../Images/logo.png" alt=""/></p></body></html>
+`,
+		"OEBPS/Images/logo.png": image,
+	})
+}
+
+func TestMergeShareResources(t *testing.T) {
+	vols := []string{buildImageVolume(t, "AAA"), buildImageVolume(t, "AAA"), buildImageVolume(t, "BBB")}
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "merged.epub")
+
+	images := func() ([]string, *Volume) {
+		vol, err := loadVolume(ctx, 0, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(vol.TempDir) })
+		var hrefs []string
+		for _, item := range vol.PackageDoc.Manifest.Items {
+			if item.MediaType == "image/png" {
+				hrefs = append(hrefs, item.Href)
+			}
+		}
+		return hrefs, vol
+	}
+
+	// Default: identical copies are shared, differing ones kept.
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, ShareResources: true}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	hrefs, vol := images()
+	if strings.Join(hrefs, " ") != "Volumes/v0001/Images/logo.png Volumes/v0003/Images/logo.png" {
+		t.Fatalf("images = %v", hrefs)
+	}
+	doc, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0002", "Text", "ch1.xhtml"))
+	if !strings.Contains(string(doc), `src="../../v0001/Images/logo.png"`) {
+		t.Fatalf("reference not rewritten:\n%s", doc)
+	}
+
+	var seen []ResourceConflict
+	keepFirst := ConflictResolverFunc(func(c ResourceConflict) (ConflictAction, error) {
+		seen = append(seen, c)
+		return ConflictKeepFirst, nil
+	})
+	if err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, ShareResources: true, ConflictResolver: keepFirst}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+	if len(seen) != 1 || seen[0].Path != "Images/logo.png" || seen[0].First.Volume != 0 || seen[0].Incoming.Volume != 2 {
+		t.Fatalf("conflicts = %+v", seen)
+	}
+	if hrefs, _ := images(); len(hrefs) != 1 {
+		t.Fatalf("keep-first left images %v", hrefs)
+	}
+
+	err := MergeEPUBs(ctx, vols, MergeOptions{OutPath: out, ShareResources: true, ConflictResolver: ConflictFail})
+	if err == nil || !strings.Contains(err.Error(), "Images/logo.png") {
+		t.Fatalf("expected conflict failure, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// primaryIdentifier returns the identifier the package's unique-identifier
+// points at, or the first one.
+func primaryIdentifier(pkg *PackageDocument) string {
+	for _, ident := range pkg.Metadata.Identifiers {
+		if ident.ID == pkg.UniqueIdentifier {
+			return ident.Value
+		}
+	}
+	return firstDCValue(pkg.Metadata.Identifiers)
+}
+
+// mergedSources lists the dc:source values of a book merged from vols:
+// each volume's own sources, so that re-merging keeps the whole chain,
+// followed by its identifier. Duplicates are dropped.
+func mergedSources(vols []*Volume) []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(v string) {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			return
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	for _, vol := range vols {
+		for _, src := range vol.PackageDoc.Metadata.Sources {
+			add(src.Value)
+		}
+		add(primaryIdentifier(vol.PackageDoc))
+	}
+	return out
+}
+
+// ListSources returns the book's dc:source values in order.
+func ListSources(ctx context.Context, input string) ([]string, error) {
+	if input == "" {
+		return nil, fmt.Errorf("input EPUB path is required")
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	return collectSources(vol.PackageDoc.Metadata), nil
+}
+
+func collectSources(meta Metadata) []string {
+	var out []string
+	for _, src := range meta.Sources {
+		if v := strings.TrimSpace(src.Value); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// editSources applies a replacement list (when replace is non-nil), then
+// removals and additions. Additions already present are ignored, and
+// refining metas of removed sources go with them.
+func editSources(meta *Metadata, replace *[]string, add, remove []string) bool {
+	before := collectSources(*meta)
+	sources := meta.Sources
+	if replace != nil {
+		sources = nil
+		for _, v := range *replace {
+			sources = append(sources, DCMeta{Value: v})
+		}
+	}
+	drop := map[string]bool{}
+	for _, v := range remove {
+		drop[strings.TrimSpace(v)] = true
+	}
+	var kept []DCMeta
+	removedIDs := map[string]bool{}
+	for _, src := range sources {
+		v := strings.TrimSpace(src.Value)
+		if v == "" || drop[v] {
+			if src.ID != "" {
+				removedIDs["#"+src.ID] = true
+			}
+			continue
+		}
+		kept = append(kept, src)
+	}
+	for _, v := range add {
+		v = strings.TrimSpace(v)
+		if v == "" || drop[v] {
+			continue
+		}
+		dup := false
+		for _, src := range kept {
+			if strings.TrimSpace(src.Value) == v {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			kept = append(kept, DCMeta{Value: v})
+		}
+	}
+	meta.Sources = kept
+	if len(removedIDs) > 0 {
+		metas := meta.Meta[:0]
+		for _, m := range meta.Meta {
+			if !removedIDs[m.Refines] {
+				metas = append(metas, m)
+			}
+		}
+		meta.Meta = metas
+	}
+	return !slices.Equal(before, collectSources(*meta))
+}
@@ -0,0 +1,57 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourcesAccumulate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var vols []string
+	for i := 1; i <= 3; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("vol%d.epub", i))
+		if err := GenerateEPUB(ctx, GenerateOptions{Chapters: 1, WordsPerChapter: 20, Seed: uint64(i), OutPath: p}); err != nil {
+			t.Fatal(err)
+		}
+		vols = append(vols, p)
+	}
+	first := filepath.Join(dir, "first.epub")
+	if err := MergeEPUBs(ctx, vols[:2], MergeOptions{OutPath: first}); err != nil {
+		t.Fatal(err)
+	}
+	all := filepath.Join(dir, "all.epub")
+	if err := MergeEPUBs(ctx, []string{first, vols[2]}, MergeOptions{OutPath: all}); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := ListSources(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 4 ||
+		sources[0] != "urn:novfmt:synthetic:1" ||
+		sources[1] != "urn:novfmt:synthetic:2" ||
+		!strings.HasPrefix(sources[2], "urn:uuid:") ||
+		sources[3] != "urn:novfmt:synthetic:3" {
+		t.Fatalf("sources = %q", sources)
+	}
+
+	_, err = EditEPUB(ctx, all, EditOptions{
+		RemoveSources: []string{sources[2]},
+		AddSources:    []string{"urn:isbn:9780000000001", "urn:novfmt:synthetic:1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err = ListSources(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "urn:novfmt:synthetic:1 urn:novfmt:synthetic:2 urn:novfmt:synthetic:3 urn:isbn:9780000000001"
+	if got := strings.Join(sources, " "); got != want {
+		t.Fatalf("sources = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,261 @@
+package epub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Spine edit operations.
+const (
+	SpineDrop   = "drop"
+	SpineMove   = "move"
+	SpineInsert = "insert"
+)
+
+// SpineEdit is one change to the reading order. Edits apply in order.
+type SpineEdit struct {
+	Op string
+	// IDRef names the itemref to drop or move.
+	IDRef string
+	// File is the XHTML document on disk to insert.
+	File string
+	// Position is the 1-based place of the item in the spine once the edit
+	// is done; 0 means the end.
+	Position int
+}
+
+// ParseSpineEdit parses the command-line form of an edit: "idref" for
+// drop, "idref:position" for move and "file.xhtml[:position]" for insert.
+// Position is a number, "start" or "end".
+func ParseSpineEdit(op, s string) (SpineEdit, error) {
+	edit := SpineEdit{Op: op}
+	target, pos := s, ""
+	if i := strings.LastIndex(s, ":"); i >= 0 && op != SpineDrop {
+		target, pos = s[:i], s[i+1:]
+	}
+	switch op {
+	case SpineDrop:
+		edit.IDRef = s
+	case SpineMove:
+		if pos == "" {
+			return edit, fmt.Errorf("move %q: want idref:position", s)
+		}
+		edit.IDRef = target
+	case SpineInsert:
+		edit.File = target
+	default:
+		return edit, fmt.Errorf("unknown spine edit %q", op)
+	}
+	if target == "" {
+		return edit, fmt.Errorf("%s %q: missing target", op, s)
+	}
+	switch pos {
+	case "", "end":
+	case "start":
+		edit.Position = 1
+	default:
+		n, err := strconv.Atoi(pos)
+		if err != nil || n < 1 {
+			return edit, fmt.Errorf("%s %q: position must be a number from 1, start or end", op, s)
+		}
+		edit.Position = n
+	}
+	return edit, nil
+}
+
+var xhtmlIDSanitizer = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// applySpineEdits changes vol's spine and manifest; the caller writes the
+// package. Dropped documents are removed from the manifest, the tree and the
+// toc nav. It returns a description of each edit and records the files it
+// touches in cs.
+func applySpineEdits(vol *Volume, edits []SpineEdit, cs *Changeset) ([]string, error) {
+	pkg := vol.PackageDoc
+	var done []string
+	for _, e := range edits {
+		refs := pkg.Spine.Itemrefs
+		switch e.Op {
+		case SpineDrop, SpineMove:
+			idx := -1
+			for i, ref := range refs {
+				if ref.IDRef == e.IDRef {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				return done, fmt.Errorf("%s: no spine item with idref %q", e.Op, e.IDRef)
+			}
+			ref := refs[idx]
+			refs = append(refs[:idx:idx], refs[idx+1:]...)
+			if e.Op == SpineDrop {
+				pkg.Spine.Itemrefs = refs
+				if err := dropManifestDocument(vol, e.IDRef, cs); err != nil {
+					return done, err
+				}
+				done = append(done, fmt.Sprintf("dropped %s", e.IDRef))
+				continue
+			}
+			pos, err := spinePosition(e.Position, len(refs))
+			if err != nil {
+				return done, err
+			}
+			pkg.Spine.Itemrefs = insertItemref(refs, pos, ref)
+			done = append(done, fmt.Sprintf("moved %s to position %d", e.IDRef, pos+1))
+		case SpineInsert:
+			pos, err := spinePosition(e.Position, len(refs))
+			if err != nil {
+				return done, err
+			}
+			id, href, err := addXHTMLDocument(vol, e.File)
+			if err != nil {
+				return done, err
+			}
+			cs.added(href)
+			pkg.Spine.Itemrefs = insertItemref(refs, pos, SpineItemRef{IDRef: id})
+			done = append(done, fmt.Sprintf("inserted %s as %s at position %d", href, id, pos+1))
+		default:
+			return done, fmt.Errorf("unknown spine edit %q", e.Op)
+		}
+	}
+	return done, nil
+}
+
+// spinePosition converts a 1-based position (0 for the end) into an index
+// into a spine of n items.
+func spinePosition(pos, n int) (int, error) {
+	if pos == 0 {
+		return n, nil
+	}
+	if pos > n+1 {
+		return 0, fmt.Errorf("position %d is past the end of the spine (%d items)", pos, n)
+	}
+	return pos - 1, nil
+}
+
+func insertItemref(refs []SpineItemRef, idx int, ref SpineItemRef) []SpineItemRef {
+	out := make([]SpineItemRef, 0, len(refs)+1)
+	out = append(out, refs[:idx]...)
+	out = append(out, ref)
+	return append(out, refs[idx:]...)
+}
+
+// dropManifestDocument removes the manifest item id (unless it is the nav
+// document or still in the spine), its file, and toc nav entries linking
+// to it.
+func dropManifestDocument(vol *Volume, id string, cs *Changeset) error {
+	pkg := vol.PackageDoc
+	for _, ref := range pkg.Spine.Itemrefs {
+		if ref.IDRef == id {
+			return nil
+		}
+	}
+	href := ""
+	kept := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		if item.ID == id && !hasProperty(item.Properties, "nav") {
+			href = normalizeEPUBPath(item.Href)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	pkg.Manifest.Items = kept
+	if href == "" {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(vol.PackageDir, filepath.FromSlash(href))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cs.removed(href)
+	if vol.NavHref == "" {
+		return nil
+	}
+	navDir := path.Dir(normalizeEPUBPath(vol.NavHref))
+	items, pruned := pruneNavItems(vol.NavItems, navDir, href)
+	if !pruned {
+		return nil
+	}
+	vol.NavItems = items
+	cs.modified(vol.NavHref)
+	return installTOC(vol, packageRelativeNavItems(items, navDir))
+}
+
+// pruneNavItems drops entries (with their children) whose href, relative
+// to navDir, points into the document href.
+func pruneNavItems(items []NavItem, navDir, href string) ([]NavItem, bool) {
+	var out []NavItem
+	pruned := false
+	for _, item := range items {
+		target, _, _ := strings.Cut(item.Href, "#")
+		if target != "" && normalizeEPUBPath(path.Join(navDir, target)) == href {
+			pruned = true
+			continue
+		}
+		var p bool
+		item.Children, p = pruneNavItems(item.Children, navDir, href)
+		pruned = pruned || p
+		out = append(out, item)
+	}
+	return out, pruned
+}
+
+func packageRelativeNavItems(items []NavItem, navDir string) []NavItem {
+	out := make([]NavItem, 0, len(items))
+	for _, item := range items {
+		if navDir != "." {
+			item.Href = joinHref(navDir, item.Href)
+		}
+		item.Children = packageRelativeNavItems(item.Children, navDir)
+		out = append(out, item)
+	}
+	return out
+}
+
+// addXHTMLDocument copies src next to the book's first spine document and
+// registers it in the manifest, returning its id and href.
+func addXHTMLDocument(vol *Volume, src string) (string, string, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return "", "", err
+	}
+	pkg := vol.PackageDoc
+	dir := ""
+	if hrefs := spineHrefs(pkg); len(hrefs) > 0 {
+		dir = path.Dir(normalizeEPUBPath(hrefs[0]))
+	}
+	name := filepath.Base(src)
+	if ext := strings.ToLower(path.Ext(name)); ext != ".xhtml" && ext != ".html" && ext != ".htm" {
+		return "", "", fmt.Errorf("insert %s: not an XHTML file", src)
+	}
+	href := path.Join(dir, name)
+	for n := 2; hasManifestHref(pkg, href); n++ {
+		href = path.Join(dir, strings.TrimSuffix(name, path.Ext(name))+"-"+strconv.Itoa(n)+path.Ext(name))
+	}
+	dest := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+	if err := ensureParentDir(dest); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(dest, data, 0o644); err != nil {
+		return "", "", err
+	}
+	base := xhtmlIDSanitizer.ReplaceAllString(strings.TrimSuffix(path.Base(href), path.Ext(href)), "-")
+	if base == "" || !isNameStart(base[0]) {
+		base = "x" + base
+	}
+	id := uniqueManifestID(pkg, base)
+	pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{
+		ID:        id,
+		Href:      href,
+		MediaType: "application/xhtml+xml",
+	})
+	return id, href, nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
@@ -0,0 +1,103 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditSpine(t *testing.T) {
+	doc := func(title string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>` + title + `</title></head><body><p>` + title + `</p></body></html>
+`
+	}
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:spine</dc:identifier>
+    <dc:title>Spine</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="tl-note" href="Text/note.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="after" href="Text/after.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="after"/>
+    <itemref idref="ch1"/>
+    <itemref idref="tl-note"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>nav</title></head><body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/ch1.xhtml">One</a></li><li><a href="Text/note.xhtml#n1">Note</a></li><li><a href="Text/ch2.xhtml">Two</a></li></ol></nav>
+</body></html>
+`,
+		"OEBPS/Text/ch1.xhtml":   doc("one"),
+		"OEBPS/Text/note.xhtml":  doc("note"),
+		"OEBPS/Text/ch2.xhtml":   doc("two"),
+		"OEBPS/Text/after.xhtml": doc("afterword"),
+	})
+	insert := filepath.Join(t.TempDir(), "ch1.xhtml")
+	if err := os.WriteFile(insert, []byte(doc("interlude")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var edits []SpineEdit
+	for _, e := range [][2]string{
+		{SpineDrop, "tl-note"},
+		{SpineMove, "after:end"},
+		{SpineInsert, insert + ":2"},
+	} {
+		edit, err := ParseSpineEdit(e[0], e[1])
+		if err != nil {
+			t.Fatalf("ParseSpineEdit(%s, %s): %v", e[0], e[1], err)
+		}
+		edits = append(edits, edit)
+	}
+	ctx := context.Background()
+	if _, err := EditEPUB(ctx, input, EditOptions{SpineEdits: edits}); err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	var order []string
+	for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+		order = append(order, ref.IDRef)
+	}
+	if got := strings.Join(order, " "); got != "ch1 ch1-2 ch2 after" {
+		t.Fatalf("spine = %s", got)
+	}
+	if hasManifestHref(vol.PackageDoc, "Text/note.xhtml") {
+		t.Fatalf("dropped document still in manifest")
+	}
+	if !hasManifestHref(vol.PackageDoc, "Text/ch1-2.xhtml") {
+		t.Fatalf("inserted document not in manifest: %+v", vol.PackageDoc.Manifest.Items)
+	}
+	if _, err := os.Stat(filepath.Join(vol.PackageDir, "Text", "note.xhtml")); !os.IsNotExist(err) {
+		t.Fatalf("dropped file still present (%v)", err)
+	}
+	if len(vol.NavItems) != 2 || vol.NavItems[1].Href != "Text/ch2.xhtml" {
+		t.Fatalf("nav not pruned: %+v", vol.NavItems)
+	}
+
+	if _, err := EditEPUB(ctx, input, EditOptions{SpineEdits: []SpineEdit{{Op: SpineMove, IDRef: "ch2", Position: 9}}}); err == nil {
+		t.Fatalf("expected out-of-range move to fail")
+	}
+	if _, err := ParseSpineEdit(SpineMove, "ch1"); err == nil {
+		t.Fatalf("expected move without position to fail")
+	}
+}
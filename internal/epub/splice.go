@@ -0,0 +1,159 @@
+package epub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// xmlSplicer reads a document token by token while keeping the source
+// bytes of each token, so that a rewriter copies untouched markup through
+// byte for byte: the XML declaration, the doctype, entity references,
+// attribute quoting and self-closing tags all survive. Only what a
+// rewriter changes is serialized anew.
+type xmlSplicer struct {
+	dec *xml.Decoder
+	rec *byteRecorder
+	w   io.Writer
+}
+
+// rawToken is a token with its source bytes. Tokens the decoder implies,
+// such as the end of a self-closing element, have none.
+type rawToken struct {
+	tok xml.Token
+	raw []byte
+}
+
+func newXMLSplicer(r io.Reader, w io.Writer) *xmlSplicer {
+	rec := &byteRecorder{r: asByteReader(r)}
+	dec := xml.NewDecoder(rec)
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	return &xmlSplicer{dec: dec, rec: rec, w: w}
+}
+
+// next returns the next token with a copy of its source bytes.
+func (s *xmlSplicer) next() (rawToken, error) {
+	start := s.dec.InputOffset()
+	tok, err := s.dec.Token()
+	if err != nil {
+		return rawToken{}, err
+	}
+	return rawToken{tok: xml.CopyToken(tok), raw: s.rec.take(start, s.dec.InputOffset())}, nil
+}
+
+// rawTokens returns the tokens of a buffered run.
+func rawTokens(rts []rawToken) []xml.Token {
+	toks := make([]xml.Token, len(rts))
+	for i, rt := range rts {
+		toks[i] = rt.tok
+	}
+	return toks
+}
+
+// copy writes a token as it was read.
+func (s *xmlSplicer) copy(t rawToken) error {
+	_, err := s.w.Write(t.raw)
+	return err
+}
+
+// emit writes a token as it was read, unless a rewriter replaced it with
+// different text.
+func (s *xmlSplicer) emit(t rawToken, tok xml.Token) error {
+	if text, ok := tok.(xml.CharData); ok {
+		if orig, ok := t.tok.(xml.CharData); !ok || !bytes.Equal(text, orig) {
+			return s.writeText(string(text))
+		}
+	}
+	return s.copy(t)
+}
+
+// writeRaw writes markup as given.
+func (s *xmlSplicer) writeRaw(markup string) error {
+	_, err := io.WriteString(s.w, markup)
+	return err
+}
+
+// writeText writes changed text, escaping only what XML requires.
+func (s *xmlSplicer) writeText(text string) error {
+	_, err := textEscaper.WriteString(s.w, text)
+	return err
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+)
+
+// withAttr returns the source of a start tag with an attribute appended,
+// keeping the tag's own spelling and self-closing style.
+func withAttr(raw []byte, name, value string) []byte {
+	end := len(raw) - 1
+	if end > 0 && raw[end-1] == '/' {
+		end--
+	}
+	for end > 0 && isXMLSpace(raw[end-1]) {
+		end--
+	}
+	var buf bytes.Buffer
+	buf.Write(raw[:end])
+	buf.WriteString(" " + name + `="`)
+	attrEscaper.WriteString(&buf, value)
+	buf.WriteString(`"`)
+	buf.Write(raw[end:])
+	return buf.Bytes()
+}
+
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// byteRecorder keeps the bytes the decoder has read and not yet claimed
+// for a token. The decoder reads one byte at a time from an io.ByteReader
+// and may push one back, so the recorder can be a byte or two ahead of the
+// decoder's offset.
+type byteRecorder struct {
+	r   io.ByteReader
+	buf []byte
+	// base is the input offset of buf[0].
+	base int64
+}
+
+func (b *byteRecorder) ReadByte() (byte, error) {
+	c, err := b.r.ReadByte()
+	if err == nil {
+		b.buf = append(b.buf, c)
+	}
+	return c, err
+}
+
+// Read makes byteRecorder an io.Reader; the decoder only calls ReadByte.
+func (b *byteRecorder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := b.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = c
+	return 1, nil
+}
+
+// take returns a copy of the bytes between two input offsets and forgets
+// everything before the second.
+func (b *byteRecorder) take(start, end int64) []byte {
+	raw := bytes.Clone(b.buf[start-b.base : end-b.base])
+	b.buf = append(b.buf[:0], b.buf[end-b.base:]...)
+	b.base = end
+	return raw
+}
+
+func asByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
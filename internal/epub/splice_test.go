@@ -0,0 +1,72 @@
+package epub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fidelityDoc = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Tom &amp; Jerry</title></head>
+<body>
+<!-- keep me -->
+<h1 epub:type='title'>Chapter&#160;One</h1>
+<p>Before<br/>after &#8212; &lt;fine&gt;</p>
+<p>old text</p>
+<h2>Part Two</h2>
+<img src="a.png" alt=""/>
+</body>
+</html>
+`
+
+func TestRewriteKeepsUntouchedMarkup(t *testing.T) {
+	cr, err := compileRules([]RewriteRule{{Find: "old", Replace: "new & improved"}})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	res, err := rewriteXHTML([]byte(fidelityDoc), ruleSet{rules: cr})
+	if err != nil {
+		t.Fatalf("rewriteXHTML: %v", err)
+	}
+	want := strings.Replace(fidelityDoc, "old text", "new &amp; improved text", 1)
+	if string(res.data) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", res.data, want)
+	}
+}
+
+func TestScanHeadingsOnlyTouchesAssignedIDs(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "a.xhtml")
+	if err := os.WriteFile(src, []byte(fidelityDoc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := HeadingDetector{}.compile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	found, data, err := scanHeadings(src, "a.xhtml", m, true)
+	if err != nil {
+		t.Fatalf("scanHeadings: %v", err)
+	}
+	if len(found) != 2 || found[1].href != "a.xhtml#novfmt-toc-2" {
+		t.Fatalf("headings = %+v", found)
+	}
+	want := strings.Replace(fidelityDoc, "<h2>", `<h2 id="novfmt-toc-2">`, 1)
+	if string(data) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestWithAttrKeepsSelfClosing(t *testing.T) {
+	for raw, want := range map[string]string{
+		`<p>`:              `<p id="x&amp;y">`,
+		`<hr class="a" />`: `<hr class="a" id="x&amp;y" />`,
+		`<br/>`:            `<br id="x&amp;y"/>`,
+	} {
+		if got := string(withAttr([]byte(raw), "id", "x&y")); got != want {
+			t.Errorf("withAttr(%s) = %s, want %s", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaxChapterSize is the largest XHTML document SplitChapters leaves
+// alone by default; Kobo and Adobe readers slow down or fail above it.
+const DefaultMaxChapterSize = 300 << 10
+
+type SplitOptions struct {
+	// MaxSize is the largest spine document, in bytes, to leave whole
+	// (default DefaultMaxChapterSize).
+	MaxSize int64
+	// Headings decides which elements are chapter headings, the preferred
+	// places to split.
+	Headings HeadingDetector
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ChapterSplit is one spine document SplitChapters split. Parts lists the
+// files it became, in reading order, starting with the original href.
+type ChapterSplit struct {
+	Href  string   `json:"href"`
+	Size  int64    `json:"size"`
+	Parts []string `json:"parts"`
+	// Oversized counts parts still over the limit because a single element
+	// is bigger than it.
+	Oversized int `json:"oversized,omitempty"`
+}
+
+type SplitResult struct {
+	Splits    []ChapterSplit `json:"splits"`
+	Changeset Changeset      `json:"changeset"`
+}
+
+// SplitChapters splits spine documents larger than opts.MaxSize into
+// several files, at chapter headings where it can and between paragraphs
+// where it must. The first part keeps the original name; the rest follow
+// it in the spine. Links into a split document, the navigation included,
+// are pointed at the part holding their fragment.
+func SplitChapters(ctx context.Context, input string, opts SplitOptions) (SplitResult, error) {
+	res := SplitResult{Splits: []ChapterSplit{}}
+	if input == "" {
+		return res, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.MaxSize < 0 {
+		return res, fmt.Errorf("max size must not be negative")
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxChapterSize
+	}
+	matcher, err := opts.Headings.compile()
+	if err != nil {
+		return res, err
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	items := map[string]ManifestItem{}
+	for _, item := range pkg.Manifest.Items {
+		items[item.ID] = item
+	}
+	// anchors maps each split document to the part holding each of its
+	// ids, for those not in the first part.
+	anchors := map[string]map[string]string{}
+	origins := map[string]string{}
+	refs := pkg.Spine.Itemrefs
+	var spine []SpineItemRef
+	for i, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		spine = append(spine, ref)
+		item, ok := items[ref.IDRef]
+		opts.Progress.report(StageRewrite, i, len(refs), item.Href)
+		if !ok || item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		href := normalizeEPUBPath(item.Href)
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return res, err
+		}
+		if int64(len(data)) <= opts.MaxSize {
+			continue
+		}
+		parts, oversized, err := splitXHTML(data, opts.MaxSize, matcher)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", href, err)
+		}
+		if len(parts) < 2 {
+			log.Warn("cannot split document: no break between elements fits the limit", "href", href, "size", len(data))
+			continue
+		}
+
+		split := ChapterSplit{Href: href, Size: int64(len(data)), Parts: []string{href}, Oversized: oversized}
+		ids := map[string]string{}
+		for n, part := range parts {
+			partHref := href
+			if n > 0 {
+				partHref = uniqueName(href, func(s string) bool { return hasManifestHref(pkg, s) })
+				id := uniqueManifestID(pkg, fmt.Sprintf("%s-%d", item.ID, n+1))
+				pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: id, Href: partHref, MediaType: item.MediaType, Properties: item.Properties})
+				spine = append(spine, SpineItemRef{IDRef: id, Linear: ref.Linear, Properties: ref.Properties})
+				split.Parts = append(split.Parts, partHref)
+				origins[partHref] = href
+				res.Changeset.added(partHref)
+				for _, m := range idAttrPattern.FindAllStringSubmatch(string(part), -1) {
+					ids[strings.Trim(m[1], `"'`)] = partHref
+				}
+			} else {
+				res.Changeset.modified(href)
+			}
+			dest := filepath.Join(vol.PackageDir, filepath.FromSlash(partHref))
+			if err := os.WriteFile(dest, part, 0o644); err != nil {
+				return res, err
+			}
+		}
+		anchors[href] = ids
+		if oversized > 0 {
+			log.Warn("parts still over the limit: a single element is too big", "href", href, "parts", oversized)
+		}
+		log.Debug("split document", "href", href, "size", len(data), "parts", len(parts))
+		res.Splits = append(res.Splits, split)
+	}
+	opts.Progress.report(StageRewrite, len(refs), len(refs), "")
+
+	if len(res.Splits) > 0 {
+		pkg.Spine.Itemrefs = spine
+		res.Changeset.modified(packageHref(vol))
+		changed, err := rewriteAnchoredRefs(vol.PackageDir, pkg, origins, func(target, frag string) (string, string, bool) {
+			ids, ok := anchors[target]
+			if !ok || frag == "" {
+				return "", "", false
+			}
+			if part, ok := ids[frag]; ok {
+				return part, frag, true
+			}
+			return target, frag, true
+		})
+		if err != nil {
+			return res, err
+		}
+		for _, href := range changed {
+			if !res.Changeset.has(href) {
+				res.Changeset.modified(href)
+			}
+		}
+	}
+
+	if err := res.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// splitNode is an element of a document being split, with byte offsets
+// into it: start and end around the whole element, open just after its
+// start tag and close at its end tag.
+type splitNode struct {
+	el                          xml.StartElement
+	start, open, close, end     int
+	children                    []*splitNode
+	text                        strings.Builder
+	hasText, candidate, heading bool
+}
+
+// splitXHTML cuts a document into parts of at most maxSize bytes between
+// the children of its body, or of the wrapper element holding all of the
+// body's content. It cuts before a chapter heading when one falls in the
+// allowed range and after the last child that fits otherwise. Each part
+// repeats everything outside the cut range (head, body and wrapper tags).
+// It also returns how many parts are still too big.
+func splitXHTML(data []byte, maxSize int64, m *headingMatcher) ([][]byte, int, error) {
+	body, err := parseSplitTree(data, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	if body == nil {
+		return nil, 0, fmt.Errorf("no body element")
+	}
+	flow := body
+	for len(flow.children) == 1 && !flow.hasText && isSplitWrapper(flow.children[0]) {
+		flow = flow.children[0]
+	}
+	kids := flow.children
+	if len(kids) < 2 {
+		return nil, 0, nil
+	}
+
+	// Cut points are the starts of the flow's children; bounds[i] begins
+	// the segment of child i, which runs to bounds[i+1].
+	bounds := make([]int, 0, len(kids)+1)
+	bounds = append(bounds, flow.open)
+	for _, k := range kids[1:] {
+		bounds = append(bounds, k.start)
+	}
+	bounds = append(bounds, flow.close)
+	prefix, suffix := data[:flow.open], data[flow.close:]
+	budget := maxSize - int64(len(prefix)+len(suffix))
+	if budget <= 0 {
+		return nil, 0, nil
+	}
+
+	var parts [][]byte
+	oversized := 0
+	for a := 0; a < len(kids); {
+		e := a + 1
+		for e < len(kids) && int64(bounds[e+1]-bounds[a]) <= budget {
+			e++
+		}
+		if e < len(kids) {
+			for j := e; j > a+1; j-- {
+				if kids[j].heading {
+					e = j
+					break
+				}
+			}
+		}
+		if int64(bounds[e]-bounds[a]) > budget {
+			oversized++
+		}
+		part := make([]byte, 0, len(prefix)+bounds[e]-bounds[a]+len(suffix))
+		part = append(part, prefix...)
+		part = append(part, data[bounds[a]:bounds[e]]...)
+		part = append(part, suffix...)
+		parts = append(parts, part)
+		a = e
+	}
+	return parts, oversized, nil
+}
+
+// isSplitWrapper reports whether an element that holds all of the body's
+// content is a container to split inside rather than a single block.
+func isSplitWrapper(n *splitNode) bool {
+	switch strings.ToLower(n.el.Name.Local) {
+	case "div", "section", "article", "main":
+		return !n.heading
+	}
+	return false
+}
+
+// parseSplitTree returns the body element of an XHTML document with the
+// element tree below it. Elements are headings when m accepts them or
+// they open with an element it accepts (a section and its title).
+func parseSplitTree(data []byte, m *headingMatcher) (*splitNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	var (
+		body  *splitNode
+		stack []*splitNode
+		// titles is the stack of open heading candidates collecting text.
+		titles []*splitNode
+	)
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &splitNode{el: t.Copy(), start: offset, open: int(dec.InputOffset())}
+			if len(stack) == 0 {
+				if strings.EqualFold(t.Name.Local, "body") && body == nil {
+					body = n
+					stack = append(stack, n)
+				}
+				continue
+			}
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+			if _, ok := m.candidate(t, 0); ok {
+				n.candidate = true
+				titles = append(titles, n)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			n.close, n.end = offset, int(dec.InputOffset())
+			if n.candidate {
+				titles = titles[:len(titles)-1]
+				n.heading = m.accept(normalizeSpace(n.text.String()))
+			}
+			if len(n.children) > 0 && n.children[0].heading {
+				n.heading = true
+			}
+			if len(stack) == 0 {
+				return body, nil
+			}
+		case xml.CharData:
+			if len(stack) == 0 {
+				continue
+			}
+			if strings.TrimSpace(string(t)) != "" {
+				stack[len(stack)-1].hasText = true
+			}
+			for _, n := range titles {
+				n.text.Write(t)
+			}
+		}
+	}
+	if body != nil && body.end == 0 {
+		return nil, fmt.Errorf("body element is not closed")
+	}
+	return body, nil
+}
@@ -0,0 +1,127 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildSplitBook(t *testing.T) string {
+	t.Helper()
+	var big strings.Builder
+	for ch := 1; ch <= 3; ch++ {
+		fmt.Fprintf(&big, "<h2 id=\"c%d\">Chapter %d</h2>\n", ch, ch)
+		for p := 1; p <= 20; p++ {
+			fmt.Fprintf(&big, "<p id=\"c%dp%d\">%s</p>\n", ch, p, strings.Repeat("word ", 20))
+		}
+	}
+	return buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:split</dc:identifier>
+    <dc:title>Split</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="big" href="Text/big.xhtml" media-type="application/xhtml+xml"/>
+    <item id="end" href="Text/end.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="big"/>
+    <itemref idref="end"/>
+  </spine>
+</package>
+`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc" id="toc"><ol><li><a href="Text/big.xhtml">One</a></li><li><a href="Text/big.xhtml#c2">Two</a></li><li><a href="Text/big.xhtml#c3">Three</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/Text/big.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Big</title></head><body>
+<div class="main">
+<p><a href="#c3p5">Skip ahead</a></p>
+` + big.String() + `</div>
+</body></html>`,
+		"OEBPS/Text/end.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p><a href="big.xhtml#c2p1">Back</a> <a href="big.xhtml#c1">Start</a></p></body></html>`,
+	})
+}
+
+func TestSplitChapters(t *testing.T) {
+	input := buildSplitBook(t)
+	out := filepath.Join(t.TempDir(), "split.epub")
+	res, err := SplitChapters(context.Background(), input, SplitOptions{MaxSize: 4000, OutPath: out})
+	if err != nil {
+		t.Fatalf("SplitChapters: %v", err)
+	}
+	if len(res.Splits) != 1 {
+		t.Fatalf("splits = %+v", res.Splits)
+	}
+	want := "Text/big.xhtml Text/big-2.xhtml Text/big-3.xhtml"
+	if got := strings.Join(res.Splits[0].Parts, " "); got != want {
+		t.Fatalf("parts = %s, want %s", got, want)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := strings.Join(spineHrefs(vol.PackageDoc), " "); got != want+" Text/end.xhtml" {
+		t.Errorf("spine = %s", got)
+	}
+	read := func(href string) string {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for i, href := range []string{"Text/big.xhtml", "Text/big-2.xhtml", "Text/big-3.xhtml"} {
+		doc := read(href)
+		if len(doc) > 4000 {
+			t.Errorf("%s is %d bytes", href, len(doc))
+		}
+		if !strings.Contains(doc, fmt.Sprintf(`<h2 id="c%d">`, i+1)) || strings.Count(doc, "<h2") != 1 {
+			t.Errorf("%s does not hold exactly chapter %d:\n%s", href, i+1, doc)
+		}
+		if !strings.Contains(doc, `<div class="main">`) || !strings.HasSuffix(strings.TrimSpace(doc), "</html>") {
+			t.Errorf("%s lost its wrapper or ending:\n%s", href, doc)
+		}
+	}
+	if !strings.Contains(read("Text/big.xhtml"), `href="big-3.xhtml#c3p5"`) {
+		t.Errorf("in-document link not moved:\n%s", read("Text/big.xhtml"))
+	}
+	end := read("Text/end.xhtml")
+	if !strings.Contains(end, `href="big-2.xhtml#c2p1"`) || !strings.Contains(end, `href="big.xhtml#c1"`) {
+		t.Errorf("links not updated:\n%s", end)
+	}
+	nav := read("nav.xhtml")
+	for _, link := range []string{`href="Text/big.xhtml"`, `href="Text/big-2.xhtml#c2"`, `href="Text/big-3.xhtml#c3"`} {
+		if !strings.Contains(nav, link) {
+			t.Errorf("nav missing %s:\n%s", link, nav)
+		}
+	}
+}
+
+func TestSplitChaptersLeavesSmallDocuments(t *testing.T) {
+	res, err := SplitChapters(context.Background(), buildSplitBook(t), SplitOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Splits) != 0 || res.Changeset.Changed() {
+		t.Errorf("unexpected splits: %+v", res)
+	}
+}
+
+func TestSplitChaptersBetweenParagraphs(t *testing.T) {
+	res, err := SplitChapters(context.Background(), buildSplitBook(t), SplitOptions{MaxSize: 1500, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Splits) != 1 || len(res.Splits[0].Parts) < 6 || res.Splits[0].Oversized != 0 {
+		t.Errorf("splits = %+v", res.Splits)
+	}
+}
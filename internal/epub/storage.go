@@ -0,0 +1,415 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is a place books are read from and written to other than the
+// local disk, such as memory, an embedded fixture tree or an object store.
+// Every function that takes an input or output path accepts
+// "scheme://name" for a Storage its context's Env serves under scheme;
+// name is a slash-separated path, valid as fs.ValidPath requires. Each
+// method is given the caller's context, so that canceling a command stops
+// a download or upload under way.
+//
+// A Storage only serves the endpoints, the archives read and written. A
+// Volume is not backed by it: every book being read or edited is still
+// extracted to a temp directory on the local disk, so a call needs
+// somewhere to write one even when its input and output are in memory.
+//
+// ReadOnlyStorage adapts an fs.FS.
+type Storage interface {
+	// Open returns the book name for reading; ctx bounds the reads made
+	// while the file is open too. A file that implements io.ReaderAt is
+	// read in place; any other is buffered in memory, up to the extraction
+	// size limit.
+	Open(ctx context.Context, name string) (fs.File, error)
+	// ReadDir lists the directory name, sorted by name.
+	ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error)
+	// Create starts writing the book name; ctx bounds the writing, the
+	// upload on commit included. Nothing replaces an earlier book of that
+	// name until the writer commits.
+	Create(ctx context.Context, name string) (BookWriter, error)
+}
+
+// BookWriter receives a book as it is zipped.
+type BookWriter interface {
+	io.Writer
+	// Commit finishes the book and makes it visible under its name.
+	Commit() error
+	// Abort discards what was written.
+	Abort() error
+}
+
+// ErrReadOnly is matched by errors for writing to a Storage that only
+// reads.
+var ErrReadOnly = errors.New("storage is read-only")
+
+// Env is where a call finds the books it is given: the Storages serving
+// "scheme://" paths and the streams StreamPath reads and writes, and the
+// limits on unpacking them. Every function that reads or writes books
+// takes its Env from its context, set with WithEnv; without one, paths
+// name local files, StreamPath means the process's standard input and
+// output, and books are held to DefaultExtractLimits.
+type Env struct {
+	// Storages maps a URL scheme, in lower case, to the Storage serving
+	// it.
+	Storages map[string]Storage
+	// Stdin and Stdout are what StreamPath reads and writes; nil means
+	// os.Stdin and os.Stdout.
+	Stdin  io.Reader
+	Stdout io.Writer
+	// Limits bounds what loading a book may unpack; nil means
+	// DefaultExtractLimits.
+	Limits *ExtractLimits
+}
+
+type envKey struct{}
+
+// WithEnv returns a copy of ctx carrying env.
+func WithEnv(ctx context.Context, env Env) context.Context {
+	return context.WithValue(ctx, envKey{}, env)
+}
+
+// EnvFrom returns the Env ctx carries, or the zero Env.
+func EnvFrom(ctx context.Context) Env {
+	env, _ := ctx.Value(envKey{}).(Env)
+	return env
+}
+
+func (e Env) stdin() io.Reader {
+	if e.Stdin == nil {
+		return os.Stdin
+	}
+	return e.Stdin
+}
+
+func (e Env) stdout() io.Writer {
+	if e.Stdout == nil {
+		return os.Stdout
+	}
+	return e.Stdout
+}
+
+func (e Env) extractLimits() ExtractLimits {
+	if e.Limits == nil {
+		return DefaultExtractLimits
+	}
+	return *e.Limits
+}
+
+// storageFor returns the Storage a path names and the book's name within
+// it. ok is false for a path with no scheme env serves, which names a
+// local file.
+func (e Env) storageFor(p string) (s Storage, name string, ok bool, err error) {
+	scheme, rest, found := strings.Cut(p, "://")
+	if !found {
+		return nil, "", false, nil
+	}
+	s, ok = e.Storages[strings.ToLower(scheme)]
+	if !ok {
+		return nil, "", false, nil
+	}
+	if !fs.ValidPath(rest) || rest == "." {
+		return nil, "", true, fmt.Errorf("%s: not a valid book name in %s storage", p, scheme)
+	}
+	return s, rest, true, nil
+}
+
+// openFile opens p, in a Storage or on the local disk.
+func (e Env) openFile(ctx context.Context, p string) (fs.File, error) {
+	s, name, ok, err := e.storageFor(p)
+	switch {
+	case err != nil:
+		return nil, err
+	case ok:
+		return s.Open(ctx, name)
+	}
+	return os.Open(p)
+}
+
+// ReadDir lists dir, a local directory or a directory in a Storage of
+// ctx's Env, sorted by name.
+func ReadDir(ctx context.Context, dir string) ([]fs.DirEntry, error) {
+	s, name, ok, err := EnvFrom(ctx).storageFor(strings.TrimSuffix(dir, "/"))
+	switch {
+	case err != nil:
+		return nil, err
+	case ok:
+		return s.ReadDir(ctx, name)
+	}
+	return os.ReadDir(dir)
+}
+
+// JoinPath returns the path of name within dir, where dir may be in a
+// Storage of ctx's Env.
+func JoinPath(ctx context.Context, dir, name string) string {
+	if _, _, ok, _ := EnvFrom(ctx).storageFor(strings.TrimSuffix(dir, "/")); ok {
+		return strings.TrimSuffix(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// createBook starts writing the book at outPath: to Stdout for
+// StreamPath, to a Storage, or to a temp file next to outPath that is
+// renamed into place on commit, so that a failed or canceled write never
+// leaves a partial archive at outPath or truncates the book it replaces.
+func (e Env) createBook(ctx context.Context, outPath string) (BookWriter, error) {
+	if outPath == StreamPath {
+		return streamWriter{e.stdout()}, nil
+	}
+	s, name, ok, err := e.storageFor(outPath)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return s.Create(ctx, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := createTempFile(filepath.Dir(outPath), "novfmt-*.epub")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: f, path: outPath}, nil
+}
+
+// isLocalPath reports whether p names a file on the local disk rather than
+// StreamPath or a book in a Storage.
+func (e Env) isLocalPath(p string) bool {
+	if p == StreamPath {
+		return false
+	}
+	_, _, ok, _ := e.storageFor(p)
+	return !ok
+}
+
+// copyBook writes the local book at src to outPath through createBook.
+func (e Env) copyBook(ctx context.Context, src, outPath string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := e.createBook(ctx, outPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// fileWriter writes a local book through a temp file.
+type fileWriter struct {
+	*os.File
+	path string
+}
+
+func (w *fileWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := renameOver(w.Name(), w.path); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// createTempFile is os.CreateTemp, except that the file gets mode 0666
+// less the umask, as os.Create gives, rather than 0600, so that a temp file
+// renamed into place as a new file has the mode the user expects.
+func createTempFile(dir, pattern string) (*os.File, error) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// renameOver renames the temp file tmp to dst, giving it the mode of the
+// file it replaces.
+func renameOver(tmp, dst string) error {
+	if info, err := os.Stat(dst); err == nil {
+		if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+// streamWriter writes a book down a pipeline, where there is nothing to
+// take back.
+type streamWriter struct{ io.Writer }
+
+func (streamWriter) Commit() error { return nil }
+func (streamWriter) Abort() error  { return nil }
+
+// ReadOnlyStorage serves the books of fsys, such as an embed.FS of test
+// fixtures, and refuses writes.
+func ReadOnlyStorage(fsys fs.FS) Storage { return readOnlyStorage{fsys} }
+
+type readOnlyStorage struct{ fsys fs.FS }
+
+func (s readOnlyStorage) Open(ctx context.Context, name string) (fs.File, error) {
+	return s.fsys.Open(name)
+}
+
+func (s readOnlyStorage) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.fsys, name)
+}
+
+func (readOnlyStorage) Create(ctx context.Context, name string) (BookWriter, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: ErrReadOnly}
+}
+
+// MemStorage keeps books in memory. It is safe for concurrent use.
+type MemStorage struct {
+	mu    sync.Mutex
+	books map[string][]byte
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{books: map[string][]byte{}}
+}
+
+// Put stores data as the book name.
+func (m *MemStorage) Put(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.books[name] = data
+}
+
+// Get returns the book name.
+func (m *MemStorage) Get(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.books[name]
+	return data, ok
+}
+
+// Names lists the stored books in order.
+func (m *MemStorage) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.books))
+	for name := range m.books {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemStorage) Open(ctx context.Context, name string) (fs.File, error) {
+	data, ok := m.Get(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{Reader: bytes.NewReader(data), info: memInfo{name: path.Base(name), size: int64(len(data))}}, nil
+}
+
+// ReadDir lists the books under dir and the directories their names
+// imply.
+func (m *MemStorage) ReadDir(ctx context.Context, dir string) ([]fs.DirEntry, error) {
+	prefix := ""
+	if dir != "." {
+		prefix = dir + "/"
+	}
+	seen := map[string]bool{}
+	var entries []fs.DirEntry
+	for _, name := range m.Names() {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		base, _, isDir := strings.Cut(rest, "/")
+		if seen[base] {
+			continue
+		}
+		seen[base] = true
+		info := memInfo{name: base, dir: isDir}
+		if !isDir {
+			data, _ := m.Get(name)
+			info.size = int64(len(data))
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	if len(entries) == 0 && dir != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (m *MemStorage) Create(ctx context.Context, name string) (BookWriter, error) {
+	return &memWriter{store: m, name: name}, nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	store *MemStorage
+	name  string
+}
+
+func (w *memWriter) Commit() error {
+	w.store.Put(w.name, bytes.Clone(w.Bytes()))
+	return nil
+}
+
+func (w *memWriter) Abort() error { return nil }
+
+// memFile is an open MemStorage book.
+type memFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memInfo describes a MemStorage book or directory.
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
@@ -0,0 +1,126 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMemStorage(t *testing.T) {
+	input := buildTestEPUB(t, "Old Title", "en")
+	defer os.Remove(input)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := NewMemStorage()
+	mem.Put("in/book.epub", data)
+	ctx := WithEnv(context.Background(), Env{Storages: map[string]Storage{"mem": mem}})
+
+	title := "In Memory"
+	cs, err := EditEPUB(ctx, "mem://in/book.epub", EditOptions{OutPath: "mem://out/book.epub", MetadataPatch: MetadataPatch{Title: &title}})
+	if err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	if !cs.Written() {
+		t.Fatalf("changeset = %+v", cs)
+	}
+	if got := mem.Names(); len(got) != 2 || got[1] != "out/book.epub" {
+		t.Fatalf("names = %v", got)
+	}
+	vol, err := loadVolume(ctx, 0, "mem://out/book.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := firstDCValue(vol.PackageDoc.Metadata.Titles); got != title {
+		t.Fatalf("title = %q", got)
+	}
+	if _, err := HashFile(ctx, "mem://out/book.epub"); err != nil {
+		t.Fatalf("HashFile: %v", err)
+	}
+	if _, err := loadVolume(ctx, 0, "mem:///abs.epub"); err == nil {
+		t.Fatal("loaded an invalid book name")
+	}
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	input := buildTestEPUB(t, "Fixture", "en")
+	defer os.Remove(input)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithEnv(context.Background(), Env{Storages: map[string]Storage{
+		"fixture": ReadOnlyStorage(fstest.MapFS{"books/v1.epub": {Data: data}}),
+	}})
+
+	report, err := Validate(ctx, "fixture://books/v1.epub", ValidateOptions{})
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if !report.Valid() {
+		t.Fatalf("report = %+v", report.Issues)
+	}
+	title := "Changed"
+	_, err = EditEPUB(ctx, "fixture://books/v1.epub", EditOptions{MetadataPatch: MetadataPatch{Title: &title}})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("edit in place: %v", err)
+	}
+}
+
+func TestCreateBookFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+	dir := t.TempDir()
+	write := func(p string) os.FileMode {
+		t.Helper()
+		w, err := Env{}.createBook(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("book")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	// A new book gets the mode os.Create gives.
+	f, err := os.Create(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := write(filepath.Join(dir, "new.epub")); got != info.Mode().Perm() {
+		t.Fatalf("new book mode = %v, want %v", got, info.Mode().Perm())
+	}
+
+	// A replaced book keeps its mode.
+	old := filepath.Join(dir, "old.epub")
+	if err := os.WriteFile(old, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(old, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if got := write(old); got != 0o640 {
+		t.Fatalf("replaced book mode = %v, want 0640", got)
+	}
+}
@@ -0,0 +1,64 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// StreamPath, given as an input, reads the book from Env.Stdin; given as
+// an output, writes it to Env.Stdout. It lets a command sit in a pipeline.
+const StreamPath = "-"
+
+// openBook opens the book at source for reading: a local file, a book in
+// a Storage, or, for StreamPath, the one on Stdin, which is buffered. The
+// caller calls closeBook when done.
+func (e Env) openBook(ctx context.Context, source string) (r io.ReaderAt, size int64, closeBook func() error, err error) {
+	if source == StreamPath {
+		data, err := e.readStream(e.stdin(), "stdin")
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return bytes.NewReader(data), int64(len(data)), func() error { return nil }, nil
+	}
+	f, err := e.openFile(ctx, source)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("extract %s: %w", source, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, fmt.Errorf("extract %s: %w", source, err)
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return ra, info.Size(), f.Close, nil
+	}
+	data, err := e.readStream(f, source)
+	f.Close()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return bytes.NewReader(data), int64(len(data)), func() error { return nil }, nil
+}
+
+// readStream reads a whole book from r, which source names in errors; a
+// zip archive is read from its end, so it cannot be extracted as it
+// arrives. The extraction size limit also bounds what is buffered.
+func (e Env) readStream(r io.Reader, source string) ([]byte, error) {
+	max := e.extractLimits().MaxSize
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", source, err)
+	}
+	if max > 0 && int64(len(data)) > max {
+		return nil, fmt.Errorf("read %s: %w", source, limitError("more than %s", FormatByteSize(max)))
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("read %s: %w", source, invalidEPUB(fmt.Errorf("empty book")))
+	}
+	return data, nil
+}
@@ -0,0 +1,59 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+)
+
+// withStreams returns a context whose Env reads in as Stdin and collects
+// Stdout.
+func withStreams(in []byte) (context.Context, *bytes.Buffer) {
+	var out bytes.Buffer
+	return WithEnv(context.Background(), Env{Stdin: bytes.NewReader(in), Stdout: &out}), &out
+}
+
+func TestEditEPUBStream(t *testing.T) {
+	input := buildTestEPUB(t, "Old Title", "en")
+	defer os.Remove(input)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, out := withStreams(data)
+	title := "Piped"
+	cs, err := EditEPUB(ctx, StreamPath, EditOptions{MetadataPatch: MetadataPatch{Title: &title}})
+	if err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	if cs.OutPath != StreamPath || !cs.Written() {
+		t.Fatalf("changeset = %+v", cs)
+	}
+	vol, err := loadVolumeReader(ctx, 0, "stdout", bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("read piped book: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if got := firstDCValue(vol.PackageDoc.Metadata.Titles); got != title {
+		t.Fatalf("title = %q", got)
+	}
+
+	// An unchanged book still goes down the pipeline.
+	ctx, out = withStreams(data)
+	cs, err = EditEPUB(ctx, input, EditOptions{OutPath: StreamPath})
+	if err != nil {
+		t.Fatalf("EditEPUB: %v", err)
+	}
+	if !cs.Written() || out.Len() == 0 {
+		t.Fatalf("unchanged book not written: %+v, %d bytes", cs, out.Len())
+	}
+}
+
+func TestLoadVolumeEmptyStdin(t *testing.T) {
+	ctx, _ := withStreams(nil)
+	if _, err := loadVolume(ctx, 0, StreamPath); err == nil {
+		t.Fatal("loaded a book from empty stdin")
+	}
+}
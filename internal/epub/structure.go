@@ -0,0 +1,310 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// structuralActions are the actions a rule may take on the elements its
+// selectors match.
+var structuralActions = map[string]bool{
+	"remove":        true,
+	"unwrap":        true,
+	"wrap":          true,
+	"set-attribute": true,
+}
+
+// compileStructuralRule checks a rule with an Action and parses its
+// wrapper element.
+func compileStructuralRule(cr *compiledRule) error {
+	r := cr.raw
+	switch {
+	case !structuralActions[r.Action]:
+		return fmt.Errorf("rule %s: unknown action %q (want remove, unwrap, wrap or set-attribute)", r.Summary(), r.Action)
+	case r.Find != "" || r.Replace != "":
+		return fmt.Errorf("rule %s: an action rule has no find or replace", r.Summary())
+	case len(r.Selectors) == 0:
+		return fmt.Errorf("rule %s: an action rule needs selectors", r.Summary())
+	case r.Action == "set-attribute" && r.Attribute == "":
+		return fmt.Errorf("rule %s: set-attribute needs an attribute", r.Summary())
+	}
+	if r.Action != "wrap" {
+		if r.Element != "" {
+			return fmt.Errorf("rule %s: only wrap takes an element", r.Summary())
+		}
+		return nil
+	}
+	toks, err := parseXHTMLSnippet(r.Element)
+	if err != nil {
+		return fmt.Errorf("rule %s: element: %w", r.Summary(), err)
+	}
+	var kept []xml.Token
+	for _, tok := range toks {
+		if text, ok := tok.(xml.CharData); !ok || len(bytes.TrimSpace(text)) > 0 {
+			kept = append(kept, tok)
+		}
+	}
+	if len(kept) == 2 {
+		start, ok := kept[0].(xml.StartElement)
+		if _, end := kept[1].(xml.EndElement); ok && end {
+			cr.wrapper = &start
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %s: element %q is not one empty element such as <div class=\"box\"/>", r.Summary(), r.Element)
+}
+
+// Summary names the rule in reports: its find pattern, or for an action
+// rule its action and selectors, as in "remove span.ad".
+func (r RewriteRule) Summary() string {
+	if r.Action == "" {
+		return r.Find
+	}
+	return r.Action + " " + strings.Join(r.Selectors, ", ")
+}
+
+// structuralRules picks the action rules out of rules.
+func structuralRules(rules []compiledRule) []compiledRule {
+	var out []compiledRule
+	for _, r := range rules {
+		if r.raw.Action != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// structuralMatch reports whether an action rule applies to el inside
+// parent. A wrap rule skips elements its wrapper already holds, so running
+// it again changes nothing.
+func structuralMatch(rule compiledRule, el, parent xml.StartElement) bool {
+	if rule.raw.Bare && len(el.Attr) > 0 {
+		return false
+	}
+	if rule.raw.Nested && !strings.EqualFold(parent.Name.Local, el.Name.Local) {
+		return false
+	}
+	if rule.wrapper != nil && sameWrapper(parent, *rule.wrapper) {
+		return false
+	}
+	return matchSelectors(rule.selectors, el)
+}
+
+// sameWrapper reports whether el is named as wrapper and has all of its
+// attributes.
+func sameWrapper(el, wrapper xml.StartElement) bool {
+	if el.Name.Local != wrapper.Name.Local {
+		return false
+	}
+	for _, want := range wrapper.Attr {
+		found := false
+		for _, a := range el.Attr {
+			if a.Name.Local == want.Name.Local && a.Value == want.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applyStructuralRules applies action rules to an XHTML document, returning
+// nil data when nothing changed. Each change reports the start tag before
+// and after; a removed or unwrapped element's tag becomes empty. Rules are
+// matched against the document as read, so an element removed by one rule
+// is not seen by the rest, and the others all apply to it in order.
+func applyStructuralRules(data []byte, rules []compiledRule) ([]byte, []TextChange, error) {
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	// frame says what to do at an element's end tag.
+	type frame struct {
+		el     xml.StartElement
+		unwrap bool
+		wraps  []string
+	}
+	var (
+		stack    []frame
+		changes  []TextChange
+		removing int
+	)
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		if removing > 0 {
+			switch rt.tok.(type) {
+			case xml.StartElement:
+				removing++
+			case xml.EndElement:
+				removing--
+			}
+			continue
+		}
+
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			var parent xml.StartElement
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].el
+			}
+			f := frame{el: t}
+			// open holds the start tags of wrappers, tag the element's.
+			var open []byte
+			tag := rt.raw
+			var refs []RuleRef
+			removed := false
+			for _, rule := range rules {
+				if !structuralMatch(rule, t, parent) {
+					continue
+				}
+				refs = append(refs, rule.ref(1))
+				switch rule.raw.Action {
+				case "remove":
+					removed = true
+				case "unwrap":
+					f.unwrap = true
+				case "wrap":
+					start, end := wrapperTags(*rule.wrapper)
+					open = append([]byte(start), open...)
+					f.wraps = append(f.wraps, end)
+				case "set-attribute":
+					tag = setAttr(tag, t, rule.raw.Attribute, rule.raw.Value)
+				}
+				if removed {
+					break
+				}
+			}
+			if removed {
+				changes = append(changes, TextChange{Before: string(rt.raw), Rules: refs})
+				removing = 1
+				continue
+			}
+			if f.unwrap {
+				// A wrap still applies around the unwrapped content.
+				tag = nil
+			}
+			raw := append(open, tag...)
+			if len(refs) > 0 && !bytes.Equal(raw, rt.raw) {
+				changes = append(changes, TextChange{Before: string(rt.raw), After: string(raw), Rules: refs})
+			}
+			stack = append(stack, f)
+			if _, err := out.Write(raw); err != nil {
+				return nil, nil, err
+			}
+
+		case xml.EndElement:
+			if len(stack) == 0 {
+				if err := sp.copy(rt); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !f.unwrap {
+				if err := sp.copy(rt); err != nil {
+					return nil, nil, err
+				}
+			}
+			// Each wrapper went around the ones before it.
+			for _, end := range f.wraps {
+				if err := sp.writeRaw(end); err != nil {
+					return nil, nil, err
+				}
+			}
+
+		default:
+			if err := sp.copy(rt); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	return out.Bytes(), changes, nil
+}
+
+// wrapperTags returns the start and end tags of a wrap rule's element.
+func wrapperTags(el xml.StartElement) (string, string) {
+	name := qualifiedName(el.Name)
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for _, a := range el.Attr {
+		b.WriteString(" " + qualifiedName(a.Name) + `="`)
+		attrEscaper.WriteString(&b, a.Value)
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	return b.String(), "</" + name + ">"
+}
+
+// qualifiedName writes a name from a snippet back with its prefix; the
+// snippet declares no namespaces, so the decoder leaves prefixes as they
+// are.
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// setAttr returns the source of a start tag with the attribute name set to
+// value: replaced where the tag has it, appended otherwise.
+func setAttr(raw []byte, el xml.StartElement, name, value string) []byte {
+	prefix, local, ok := strings.Cut(name, ":")
+	if !ok {
+		prefix, local = "", name
+	}
+	for _, a := range el.Attr {
+		if a.Name.Local != local || (prefix == "") != (a.Name.Space == "") {
+			continue
+		}
+		if a.Value == value {
+			return raw
+		}
+		return withAttr(withoutAttr(raw, name), name, value)
+	}
+	return withAttr(raw, name, value)
+}
+
+// withoutAttr returns the source of a start tag without the attribute
+// name, which it must have.
+func withoutAttr(raw []byte, name string) []byte {
+	for i := 0; i < len(raw); i++ {
+		if !isXMLSpace(raw[i]) || !bytes.HasPrefix(raw[i+1:], []byte(name)) {
+			continue
+		}
+		j := i + 1 + len(name)
+		for j < len(raw) && isXMLSpace(raw[j]) {
+			j++
+		}
+		if j >= len(raw) || raw[j] != '=' {
+			continue
+		}
+		j++
+		for j < len(raw) && isXMLSpace(raw[j]) {
+			j++
+		}
+		if j >= len(raw) || raw[j] != '"' && raw[j] != '\'' {
+			continue
+		}
+		end := bytes.IndexByte(raw[j+1:], raw[j])
+		if end < 0 {
+			break
+		}
+		return append(append([]byte(nil), raw[:i]...), raw[j+1+end+1:]...)
+	}
+	return raw
+}
@@ -0,0 +1,75 @@
+package epub
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestApplyStructuralRules(t *testing.T) {
+	rules, err := compileRules([]RewriteRule{
+		{Action: "remove", Selectors: []string{"span.ad"}},
+		{Action: "unwrap", Selectors: []string{"div"}, Bare: true, Nested: true},
+		{Action: "set-attribute", Selectors: []string{"section.chapter"}, Attribute: "epub:type", Value: "chapter"},
+		{Action: "set-attribute", Selectors: []string{"img.deco"}, Attribute: "alt", Value: ""},
+		{Action: "wrap", Selectors: []string{"img.deco"}, Element: `<div class="ornament"/>`},
+		{Find: "Old", Replace: "New"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>` +
+		`<section class="chapter"><div><div><p>Old <span class="ad">Buy <b>now</b></span>text</p></div></div>` +
+		`<img class="deco" src="a.png" alt='flourish'/><div class="x"><div class="y">kept</div></div></section>` +
+		`</body></html>`
+	want := `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>` +
+		`<section class="chapter" epub:type="chapter"><div><p>Old text</p></div>` +
+		`<div class="ornament"><img class="deco" src="a.png" alt=""/></div><div class="x"><div class="y">kept</div></div></section>` +
+		`</body></html>`
+	out, changes, err := applyStructuralRules([]byte(in), structuralRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Fatalf("got  %s\nwant %s", out, want)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("changes = %+v", changes)
+	}
+	if ref := changes[2].Rules[0]; ref.Find != "remove span.ad" || changes[2].After != "" {
+		t.Fatalf("remove change = %+v", changes[2])
+	}
+
+	if out, changes, err := applyStructuralRules([]byte(want), structuralRules(rules)); err != nil || out != nil || changes != nil {
+		t.Fatalf("second pass changed %s, %+v, %v", out, changes, err)
+	}
+
+	for _, bad := range []RewriteRule{
+		{Action: "delete", Selectors: []string{"p"}},
+		{Action: "remove"},
+		{Action: "remove", Selectors: []string{"p"}, Find: "x"},
+		{Action: "set-attribute", Selectors: []string{"p"}},
+		{Action: "wrap", Selectors: []string{"p"}, Element: "<div><p/></div>"},
+		{Action: "unwrap", Selectors: []string{"p"}, Scope: "meta"},
+	} {
+		if _, err := compileRules([]RewriteRule{bad}); err == nil {
+			t.Errorf("rule %+v accepted", bad)
+		}
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	cases := []struct{ in, name, value, want string }{
+		{`<img src="a.png"/>`, "alt", "", `<img src="a.png" alt=""/>`},
+		{`<img alt = 'x' src="a.png"/>`, "alt", "", `<img src="a.png" alt=""/>`},
+		{`<img alt="" src="a.png" />`, "alt", "", `<img alt="" src="a.png" />`},
+	}
+	for _, c := range cases {
+		toks, err := parseXHTMLSnippet(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(setAttr([]byte(c.in), toks[0].(xml.StartElement), c.name, c.value)); got != c.want {
+			t.Errorf("setAttr(%s) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package epub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+type TextExportOptions struct {
+	// Ruby selects how ruby annotations appear in the text (see
+	// ParseRubyMode); empty means RubyStrip, since kept ruby would run the
+	// reading into the base text.
+	Ruby   string
+	Logger *slog.Logger
+}
+
+// ExportText writes the visible text of the spine documents to w in
+// reading order: one paragraph per line, with a blank line between
+// documents.
+func ExportText(ctx context.Context, input string, w io.Writer, opts TextExportOptions) error {
+	if input == "" {
+		return fmt.Errorf("input EPUB path is required")
+	}
+	if opts.Ruby == "" {
+		opts.Ruby = RubyStrip
+	}
+	ruby, err := ParseRubyMode(opts.Ruby)
+	if err != nil {
+		return err
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	bw := bufio.NewWriter(w)
+	first := true
+	for _, href := range spineHrefs(vol.PackageDoc) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return err
+		}
+		if converted, _ := convertRuby(data, ruby); converted != nil {
+			data = converted
+		}
+		paras, err := visibleParagraphs(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", href, err)
+		}
+		if len(paras) == 0 {
+			continue
+		}
+		if !first {
+			bw.WriteString("\n")
+		}
+		first = false
+		for _, p := range paras {
+			bw.WriteString(p)
+			bw.WriteString("\n")
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,152 @@
+package epub
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// titlePlaceholderRE matches a placeholder in a merged title template.
+var titlePlaceholderRE = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// volumeMarkerRE matches the volume number at the end of a title or file
+// name, with whatever introduces it: "Saga 3", "Saga, Vol. 3",
+// "Saga (Book 3)", "saga_v03", "サーガ 第3巻".
+var volumeMarkerRE = regexp.MustCompile(`(?i)[\s\-–—:,.#_(（\[]*(?:vol(?:ume)?\.?|v|book|part|no\.?|第)?\s*(\d+(?:\.\d+)?)\s*巻?[)）\]]?\s*$`)
+
+// checkTitleTemplate reports placeholders in a merged title template that
+// mergedTitle does not know.
+func checkTitleTemplate(tmpl string) error {
+	for _, m := range titlePlaceholderRE.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "series", "first", "last", "count", "title", "author":
+		default:
+			return fmt.Errorf("title %q: unknown placeholder {%s}", tmpl, m[1])
+		}
+	}
+	return nil
+}
+
+// titleSource is what a title template knows about one volume.
+type titleSource struct {
+	title, file   string
+	series, index string
+	// position counts volumes from 1 in the merged book; it stands in for
+	// a volume number the volume does not give.
+	position int
+}
+
+func titleSourceOf(vol *Volume) titleSource {
+	c := calibreFromPackage(vol.PackageDoc.Metadata)
+	title := c.Title
+	if title == "" {
+		title = vol.DisplayName
+	}
+	return titleSource{
+		title:    title,
+		file:     strings.TrimSuffix(filepath.Base(vol.SourcePath), filepath.Ext(vol.SourcePath)),
+		series:   c.Series,
+		index:    c.SeriesIndex,
+		position: vol.Index + 1,
+	}
+}
+
+// mergedTitle returns the title of a book made from srcs: tmpl expanded
+// when given, otherwise "{series} Vol. {first}-{last}" for volumes of a
+// recognisable series and the first volume's title for anything else.
+func mergedTitle(tmpl string, srcs []titleSource, author string) string {
+	if tmpl == "" {
+		if len(srcs) < 2 {
+			if len(srcs) == 1 {
+				return srcs[0].title
+			}
+			return ""
+		}
+		if titleSeries(srcs) == "" {
+			return srcs[0].title
+		}
+		tmpl = "{series} Vol. {first}-{last}"
+	}
+	return titlePlaceholderRE.ReplaceAllStringFunc(tmpl, func(m string) string {
+		switch m[1 : len(m)-1] {
+		case "series":
+			if s := titleSeries(srcs); s != "" {
+				return s
+			}
+			if len(srcs) > 0 {
+				return srcs[0].title
+			}
+		case "first":
+			if len(srcs) > 0 {
+				return volumeNumber(srcs[0])
+			}
+		case "last":
+			if len(srcs) > 0 {
+				return volumeNumber(srcs[len(srcs)-1])
+			}
+		case "count":
+			return strconv.Itoa(len(srcs))
+		case "title":
+			if len(srcs) > 0 {
+				return srcs[0].title
+			}
+		case "author":
+			return author
+		}
+		return ""
+	})
+}
+
+// titleSeries returns the series srcs belong to: the first series named
+// in their metadata, or else the part their titles, or file names, share
+// before a volume number.
+func titleSeries(srcs []titleSource) string {
+	for _, s := range srcs {
+		if s.series != "" {
+			return s.series
+		}
+	}
+	if stem := commonStem(srcs, func(s titleSource) string { return s.title }); stem != "" {
+		return stem
+	}
+	return commonStem(srcs, func(s titleSource) string { return s.file })
+}
+
+// commonStem returns the name every source gives before its volume number,
+// or "" when one has no number or the names differ.
+func commonStem(srcs []titleSource, name func(titleSource) string) string {
+	stem := ""
+	for i, s := range srcs {
+		n := name(s)
+		loc := volumeMarkerRE.FindStringIndex(n)
+		if loc == nil {
+			return ""
+		}
+		st := strings.TrimSpace(n[:loc[0]])
+		if st == "" || (i > 0 && !strings.EqualFold(st, stem)) {
+			return ""
+		}
+		if i == 0 {
+			stem = st
+		}
+	}
+	return stem
+}
+
+// volumeNumber returns the number of a volume: its series index, the
+// number ending its title or file name, or its position.
+func volumeNumber(s titleSource) string {
+	if f, err := strconv.ParseFloat(s.index, 64); err == nil && f >= 0 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	for _, n := range []string{s.title, s.file} {
+		if m := volumeMarkerRE.FindStringSubmatch(n); m != nil {
+			if f, err := strconv.ParseFloat(m[1], 64); err == nil {
+				return strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		}
+	}
+	return strconv.Itoa(s.position)
+}
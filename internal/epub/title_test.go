@@ -0,0 +1,84 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergedTitle(t *testing.T) {
+	titled := func(titles ...string) []titleSource {
+		var srcs []titleSource
+		for i, title := range titles {
+			srcs = append(srcs, titleSource{title: title, file: "book", position: i + 1})
+		}
+		return srcs
+	}
+	calibre := []titleSource{
+		{title: "The Beginning", series: "Saga", index: "4.0", position: 1},
+		{title: "The Middle", series: "Saga", index: "5", position: 2},
+	}
+	files := []titleSource{
+		{title: "Start", file: "saga_v07", position: 1},
+		{title: "End", file: "saga_v08", position: 2},
+	}
+	tests := []struct {
+		name string
+		tmpl string
+		srcs []titleSource
+		want string
+	}{
+		{"numbered titles", "", titled("Saga 1", "Saga 2", "Saga 3"), "Saga Vol. 1-3"},
+		{"vol markers", "", titled("Saga, Vol. 2", "Saga (Volume 3)"), "Saga Vol. 2-3"},
+		{"japanese", "", titled("サーガ 第1巻", "サーガ 第2巻"), "サーガ Vol. 1-2"},
+		{"unrelated", "", titled("Alpha", "Beta"), "Alpha"},
+		{"different stems", "", titled("Alpha 1", "Beta 2"), "Alpha 1"},
+		{"calibre series", "", calibre, "Saga Vol. 4-5"},
+		{"file names", "", files, "saga Vol. 7-8"},
+		{"single", "", titled("Saga 1"), "Saga 1"},
+		{"literal", "Omnibus", titled("Saga 1", "Saga 2"), "Omnibus"},
+		{"template", "{series} ({count} volumes) by {author}", titled("Saga 1", "Saga 2"), "Saga (2 volumes) by Ann"},
+		{"positions", "{title}: {first}-{last}", titled("Alpha", "Beta"), "Alpha: 1-2"},
+	}
+	for _, tt := range tests {
+		if got := mergedTitle(tt.tmpl, tt.srcs, "Ann"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if err := checkTitleTemplate("{series} {volume}"); err == nil {
+		t.Fatal("expected unknown placeholder to be rejected")
+	}
+}
+
+func TestMergeTitleTemplate(t *testing.T) {
+	ctx := context.Background()
+	vol1 := buildCatalogBook(t, "urn:test:v1", "Saga 1", "Ann Author", false)
+	vol2 := buildCatalogBook(t, "urn:test:v2", "Saga 2", "Ann Author", false)
+	vol3 := buildCatalogBook(t, "urn:test:v3", "Saga 3", "Ann Author", false)
+	out := filepath.Join(t.TempDir(), "saga.epub")
+	title := func() string {
+		t.Helper()
+		vol, err := loadVolume(ctx, 0, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(vol.TempDir)
+		return firstDCValue(vol.PackageDoc.Metadata.Titles)
+	}
+	if err := MergeEPUBs(ctx, []string{vol1, vol2}, MergeOptions{OutPath: out}); err != nil {
+		t.Fatal(err)
+	}
+	if got := title(); got != "Saga Vol. 1-2" {
+		t.Fatalf("default title = %q", got)
+	}
+	if err := AppendEPUBs(ctx, out, []string{vol3}, MergeOptions{Title: "{series} {first}–{last}"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := title(); got != "Saga 1–3" {
+		t.Fatalf("appended title = %q", got)
+	}
+	if err := MergeEPUBs(ctx, []string{vol1, vol2}, MergeOptions{OutPath: out, Title: "{volume}"}); err == nil {
+		t.Fatal("expected unknown placeholder to be rejected")
+	}
+}
@@ -0,0 +1,62 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// volumeTitlePageName is the file merge writes at the root of each volume's
+// directory when MergeOptions.VolumeTitlePages is set.
+const volumeTitlePageName = "novfmt-title.xhtml"
+
+// writeVolumeTitlePage writes a title page for vol (title, publication date
+// and, when coverHref is set, a cover thumbnail) under the volume's
+// directory in oebpsDir and returns its href in the merged book. coverHref
+// is relative to the merged package document.
+func writeVolumeTitlePage(vol *Volume, oebpsDir, coverHref string) (string, error) {
+	name := volumeTitlePageName
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(oebpsDir, filepath.FromSlash(path.Join(vol.Prefix, name)))); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("novfmt-title-%d.xhtml", n)
+	}
+	href := path.Join(vol.Prefix, name)
+
+	meta := vol.PackageDoc.Metadata
+	title := html.EscapeString(vol.DisplayName)
+	lang := html.EscapeString(strings.TrimSpace(firstDCValue(meta.Languages)))
+	date := strings.TrimSpace(pubDate(meta))
+	if len(date) > 10 && date[4] == '-' {
+		date = date[:10]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<!DOCTYPE html>\n")
+	buf.WriteString(`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"`)
+	if lang != "" {
+		buf.WriteString(` xml:lang="` + lang + `" lang="` + lang + `"`)
+	}
+	buf.WriteString(">\n<head><title>" + title + "</title></head>\n")
+	buf.WriteString(`<body epub:type="frontmatter">` + "\n")
+	buf.WriteString(`<section epub:type="titlepage" class="novfmt-volume-title" style="text-align: center">` + "\n")
+	if coverHref != "" {
+		src := html.EscapeString(relativeHref(vol.Prefix, coverHref))
+		buf.WriteString(`<p><img src="` + src + `" alt="" style="max-width: 60%; max-height: 60vh"/></p>` + "\n")
+	}
+	buf.WriteString("<h1>" + title + "</h1>\n")
+	if date != "" {
+		buf.WriteString("<p>" + html.EscapeString(date) + "</p>\n")
+	}
+	buf.WriteString("</section>\n</body>\n</html>\n")
+
+	if err := os.WriteFile(filepath.Join(oebpsDir, filepath.FromSlash(href)), buf.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return href, nil
+}
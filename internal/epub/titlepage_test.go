@@ -0,0 +1,67 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeVolumeTitlePages(t *testing.T) {
+	volume := func(title, date string) string {
+		return buildEPUBFromFiles(t, map[string]string{
+			"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:tp</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:language>ja</dc:language>
+    <dc:date>` + date + `</dc:date>
+  </metadata>
+  <manifest>
+    <item id="cover" href="Images/cover.jpg" media-type="image/jpeg" properties="cover-image"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+			"OEBPS/Images/cover.jpg": "jpeg",
+			"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head><body><p>text</p></body></html>
+`,
+		})
+	}
+	vols := []string{volume("Vol &amp; One", "2019-03-25T00:00:00Z"), volume("Vol Two", "")}
+	out := filepath.Join(t.TempDir(), "merged.epub")
+	if err := MergeEPUBs(context.Background(), vols, MergeOptions{OutPath: out, VolumeTitlePages: true}); err != nil {
+		t.Fatalf("MergeEPUBs: %v", err)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	var order []string
+	for _, ref := range vol.PackageDoc.Spine.Itemrefs {
+		order = append(order, ref.IDRef)
+	}
+	if got := strings.Join(order, " "); got != "v0001_novfmt-title v0001_ch1 v0002_novfmt-title v0002_ch1" {
+		t.Fatalf("spine = %s", got)
+	}
+	if len(vol.NavItems) != 2 || vol.NavItems[1].Href != "Volumes/v0002/novfmt-title.xhtml" {
+		t.Fatalf("nav = %+v", vol.NavItems)
+	}
+	page, err := os.ReadFile(filepath.Join(vol.PackageDir, "Volumes", "v0001", "novfmt-title.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<h1>Vol &amp; One</h1>", "<p>2019-03-25</p>", `src="Images/cover.jpg"`, `xml:lang="ja"`} {
+		if !strings.Contains(string(page), want) {
+			t.Fatalf("title page missing %s:\n%s", want, page)
+		}
+	}
+}
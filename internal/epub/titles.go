@@ -0,0 +1,171 @@
+package epub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Title is a dc:title with its EPUB 3 title-type: main, subtitle, short,
+// collection, edition or expanded. Type is empty for an untyped title.
+type Title struct {
+	Value string `json:"value"`
+	Type  string `json:"type,omitempty"`
+}
+
+// titleTypes are the title-type values EPUB 3 defines.
+var titleTypes = []string{"main", "subtitle", "short", "collection", "edition", "expanded"}
+
+func checkTitles(titles []Title) error {
+	for _, t := range titles {
+		if strings.TrimSpace(t.Value) == "" {
+			return fmt.Errorf("titles: empty title")
+		}
+		if t.Type != "" && !containsString(titleTypes, t.Type) {
+			return fmt.Errorf("titles: unknown type %q (want one of %s)", t.Type, strings.Join(titleTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// titlesOf returns the titles of meta with their types.
+func titlesOf(meta Metadata) []Title {
+	var out []Title
+	for _, dc := range meta.Titles {
+		t := Title{Value: strings.TrimSpace(dc.Value)}
+		if dc.ID != "" {
+			for _, node := range meta.Meta {
+				if node.Refines == "#"+dc.ID && node.Property == "title-type" {
+					t.Type = strings.TrimSpace(node.Value)
+				}
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// mainTitle returns the title of type main, or else the first title.
+func mainTitle(meta Metadata) string {
+	for _, t := range titlesOf(meta) {
+		if t.Type == "main" {
+			return t.Value
+		}
+	}
+	return firstDCValue(meta.Titles)
+}
+
+// setTitles replaces the titles of meta. In EPUB 3 each typed title is
+// refined with its title-type; EPUB 2 has no title types, so there the
+// main title goes first. A title that was already there, with the same
+// type or else the same value, keeps its id and other refinements.
+func setTitles(meta *Metadata, epub3 bool, titles []Title) {
+	old := titlesOf(*meta)
+	used := make([]bool, len(old))
+	reuse := func(match func(Title) bool) int {
+		for i, t := range old {
+			if !used[i] && meta.Titles[i].ID != "" && match(t) {
+				used[i] = true
+				return i
+			}
+		}
+		return -1
+	}
+	list := make([]DCMeta, len(titles))
+	for i, t := range titles {
+		list[i] = DCMeta{Value: t.Value}
+		j := -1
+		if t.Type != "" {
+			j = reuse(func(o Title) bool { return o.Type == t.Type })
+		}
+		if j < 0 {
+			j = reuse(func(o Title) bool { return o.Value == t.Value })
+		}
+		if j >= 0 {
+			list[i] = meta.Titles[j]
+			list[i].Value = t.Value
+		}
+	}
+
+	kept := map[string]bool{}
+	for _, dc := range list {
+		if dc.ID != "" {
+			kept["#"+dc.ID] = true
+		}
+	}
+	dropped := map[string]bool{}
+	for _, dc := range meta.Titles {
+		if dc.ID != "" && !kept["#"+dc.ID] {
+			dropped["#"+dc.ID] = true
+		}
+	}
+	metas := meta.Meta[:0]
+	for _, node := range meta.Meta {
+		switch {
+		case dropped[node.Refines]:
+		case kept[node.Refines] && node.Property == "title-type":
+		default:
+			metas = append(metas, node)
+		}
+	}
+	meta.Meta = metas
+
+	if !epub3 {
+		for i, t := range titles {
+			if t.Type == "main" && i > 0 {
+				main := list[i]
+				copy(list[1:i+1], list[:i])
+				list[0] = main
+				break
+			}
+		}
+		meta.Titles = list
+		return
+	}
+	ids := metadataIDs(meta)
+	for i, t := range titles {
+		if t.Type == "" {
+			continue
+		}
+		if list[i].ID == "" {
+			list[i].ID = newMetadataID(ids, "title")
+		}
+		meta.Meta = append(meta.Meta, MetaNode{Refines: "#" + list[i].ID, Property: "title-type", Value: t.Type})
+	}
+	meta.Titles = list
+}
+
+// setMainTitle replaces the main title of meta, or the first title when
+// none is typed main, and leaves the others.
+func setMainTitle(meta *Metadata, value string) {
+	if len(meta.Titles) == 0 {
+		meta.Titles = []DCMeta{{Value: value}}
+		return
+	}
+	for i, t := range titlesOf(*meta) {
+		if t.Type == "main" {
+			meta.Titles[i].Value = value
+			return
+		}
+	}
+	meta.Titles[0].Value = value
+}
+
+// setSubtitle replaces the subtitle of meta; an empty value removes it.
+// EPUB 2 cannot type titles, so there the subtitle is every title after
+// the first.
+func setSubtitle(meta *Metadata, epub3 bool, value string) {
+	titles := titlesOf(*meta)
+	out := make([]Title, 0, len(titles)+1)
+	for i, t := range titles {
+		if epub3 && t.Type != "subtitle" || !epub3 && i == 0 {
+			out = append(out, t)
+		}
+	}
+	if value != "" {
+		if len(out) == 1 && out[0].Type == "" {
+			out[0].Type = "main"
+		}
+		out = append(out, Title{Value: value, Type: "subtitle"})
+	}
+	setTitles(meta, epub3, out)
+}
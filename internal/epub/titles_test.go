@@ -0,0 +1,65 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestEditTitles(t *testing.T) {
+	ctx := context.Background()
+	input := buildRefinedBook(t)
+	edit := func(patch MetadataPatch) Metadata {
+		t.Helper()
+		if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: patch}); err != nil {
+			t.Fatal(err)
+		}
+		vol, err := loadVolume(ctx, 0, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(vol.TempDir)
+		return vol.PackageDoc.Metadata
+	}
+
+	titles := []Title{
+		{Value: "Saga Collection", Type: "collection"},
+		{Value: "サーガ", Type: "main"},
+		{Value: "The Beginning", Type: "subtitle"},
+	}
+	meta := edit(MetadataPatch{Titles: &titles})
+	if got := titlesOf(meta); len(got) != 3 || got[0] != titles[0] || got[2] != titles[2] {
+		t.Fatalf("titles = %+v", got)
+	}
+	if meta.Titles[1].ID != "t1" || len(refinementsOf(meta)["t1"]) != 2 {
+		t.Fatalf("main title lost its id or alternate script: %+v", meta.Titles[1])
+	}
+	if got := mainTitle(meta); got != "サーガ" {
+		t.Fatalf("main title = %q", got)
+	}
+
+	title, subtitle := "サーガ 新装版", "The End"
+	meta = edit(MetadataPatch{Title: &title, Subtitle: &subtitle})
+	if got := titlesOf(meta); len(got) != 3 || got[1].Value != title || got[2] != (Title{Value: "The End", Type: "subtitle"}) || got[0].Type != "collection" {
+		t.Fatalf("titles = %+v", got)
+	}
+
+	none := ""
+	meta = edit(MetadataPatch{Subtitle: &none})
+	if got := titlesOf(meta); len(got) != 2 {
+		t.Fatalf("subtitle not removed: %+v", got)
+	}
+
+	bad := []Title{{Value: "X", Type: "sub"}}
+	if _, err := EditEPUB(ctx, input, EditOptions{MetadataPatch: MetadataPatch{Titles: &bad}}); err == nil {
+		t.Fatal("expected an unknown title type to be rejected")
+	}
+}
+
+func TestSetSubtitleEPUB2(t *testing.T) {
+	meta := Metadata{Titles: []DCMeta{{Value: "Saga"}, {Value: "Old subtitle"}}}
+	setSubtitle(&meta, false, "New subtitle")
+	if len(meta.Titles) != 2 || meta.Titles[0].Value != "Saga" || meta.Titles[1].Value != "New subtitle" || len(meta.Meta) != 0 {
+		t.Fatalf("titles = %+v, meta = %+v", meta.Titles, meta.Meta)
+	}
+}
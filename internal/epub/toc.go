@@ -0,0 +1,426 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+type TOCOptions struct {
+	// MaxDepth limits how many heading levels are included, counted from the
+	// highest level present in the book (default 3).
+	MaxDepth int
+	// Headings decides which elements are headings.
+	Headings HeadingDetector
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+}
+
+// TOCResult is the table of contents RegenerateTOC built, with hrefs
+// relative to the package document, and what it changed.
+type TOCResult struct {
+	Items     []NavItem `json:"items"`
+	Changeset Changeset `json:"changeset"`
+}
+
+type tocHeading struct {
+	level int
+	title string
+	href  string
+}
+
+type tocNode struct {
+	level    int
+	item     NavItem
+	children []*tocNode
+}
+
+// RegenerateTOC rebuilds the nav table of contents from the headings
+// opts.Headings finds in the spine documents. Headings that need a fragment and have no id get
+// one. The toc nav element is replaced in place, so other navs (landmarks,
+// page-list) survive; books without a nav document get a new one.
+func RegenerateTOC(ctx context.Context, input string, opts TOCOptions) (TOCResult, error) {
+	var res TOCResult
+	if input == "" {
+		return res, fmt.Errorf("input EPUB path is required")
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 3
+	}
+	matcher, err := opts.Headings.compile()
+	if err != nil {
+		return res, err
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	var headings []tocHeading
+	for _, href := range spineHrefs(vol.PackageDoc) {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(href))
+		// Ids are assigned in dry runs too, so that the items and the
+		// changeset show what a real run would do.
+		found, rewritten, err := scanHeadings(src, href, matcher, true)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", href, err)
+		}
+		log.Debug("scanned headings", "href", href, "count", len(found))
+		if rewritten != nil {
+			if err := os.WriteFile(src, rewritten, 0o644); err != nil {
+				return res, err
+			}
+			res.Changeset.modified(href)
+		}
+		headings = append(headings, found...)
+	}
+
+	if len(headings) == 0 {
+		return res, fmt.Errorf("no headings found in spine documents")
+	}
+
+	res.Items = buildHeadingTree(headings, opts.MaxDepth)
+	if vol.NavHref == "" {
+		if err := installTOC(vol, res.Items); err != nil {
+			return res, err
+		}
+		res.Changeset.added(vol.NavHref)
+		res.Changeset.modified(packageHref(vol))
+	} else {
+		navPath := filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref))
+		before, err := os.ReadFile(navPath)
+		if err != nil {
+			return res, err
+		}
+		if err := installTOC(vol, res.Items); err != nil {
+			return res, err
+		}
+		after, err := os.ReadFile(navPath)
+		if err != nil {
+			return res, err
+		}
+		if !bytes.Equal(before, after) {
+			res.Changeset.modified(vol.NavHref)
+		}
+	}
+	if err := res.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, nil, log); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+func compileOptionalRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func headingLevel(name string) int {
+	if len(name) == 2 && name[0] == 'h' && name[1] >= '1' && name[1] <= '6' {
+		return int(name[1] - '0')
+	}
+	return 0
+}
+
+// scanHeadings returns the headings m finds in an XHTML document, with
+// hrefs relative to the package directory. When assignIDs is set, headings
+// other than the first that lack an id receive one, and the document is
+// returned with only those start tags changed.
+func scanHeadings(src, href string, m *headingMatcher, assignIDs bool) ([]tocHeading, []byte, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	var (
+		headings []tocHeading
+		current  *tocHeading
+		// pending holds the tokens of the current candidate until its text
+		// decides whether it is a heading and needs an id.
+		pending []rawToken
+		text    strings.Builder
+		depth   int
+		leading int
+		inBody  bool
+		hidden  int
+		added   bool
+	)
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		switch t := rt.tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case current != nil:
+				depth++
+			case name == "body":
+				inBody = true
+			case name == "script" || name == "style":
+				hidden++
+			case hidden == 0 && !(m.firstOnly && len(headings) > 0):
+				if lvl, ok := m.candidate(t, leading); ok {
+					current = &tocHeading{level: lvl, href: href}
+					text.Reset()
+				}
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case current != nil && depth > 0:
+				depth--
+			case current != nil:
+				title := normalizeSpace(text.String())
+				leading += utf8.RuneCountInString(title)
+				if m.accept(title) {
+					current.title = title
+					start := pending[0].tok.(xml.StartElement)
+					id := attrValue(start.Attr, "id")
+					switch {
+					case id != "":
+						current.href = href + "#" + id
+					case len(headings) > 0 && assignIDs:
+						id = fmt.Sprintf("novfmt-toc-%d", len(headings)+1)
+						pending[0].raw = withAttr(pending[0].raw, "id", id)
+						current.href = href + "#" + id
+						added = true
+					}
+					headings = append(headings, *current)
+				}
+				for _, p := range pending {
+					if err := sp.copy(p); err != nil {
+						return nil, nil, err
+					}
+				}
+				current, pending = nil, nil
+			case name == "script" || name == "style":
+				hidden--
+			}
+		case xml.CharData:
+			switch {
+			case current != nil:
+				text.Write(t)
+			case inBody && hidden == 0:
+				leading += utf8.RuneCountInString(strings.TrimSpace(string(t)))
+			}
+		}
+		if current != nil {
+			pending = append(pending, rt)
+			continue
+		}
+		if err := sp.copy(rt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !added {
+		return headings, nil, nil
+	}
+	return headings, out.Bytes(), nil
+}
+
+func attrValue(attrs []xml.Attr, local string) string {
+	for _, a := range attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// buildHeadingTree nests headings by level. Levels are relative to the
+// highest level present, so a book whose chapters use h2 still produces a
+// flat top level.
+func buildHeadingTree(headings []tocHeading, maxDepth int) []NavItem {
+	top := 6
+	for _, h := range headings {
+		top = min(top, h.level)
+	}
+
+	root := &tocNode{level: 0}
+	stack := []*tocNode{root}
+	for _, h := range headings {
+		rel := h.level - top + 1
+		if rel > maxDepth {
+			continue
+		}
+		for len(stack) > 1 && stack[len(stack)-1].level >= rel {
+			stack = stack[:len(stack)-1]
+		}
+		node := &tocNode{level: rel, item: NavItem{Title: h.title, Href: h.href}}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, node)
+		stack = append(stack, node)
+	}
+	return flattenTOCNodes(root.children)
+}
+
+func flattenTOCNodes(nodes []*tocNode) []NavItem {
+	out := make([]NavItem, 0, len(nodes))
+	for _, n := range nodes {
+		item := n.item
+		item.Children = flattenTOCNodes(n.children)
+		out = append(out, item)
+	}
+	return out
+}
+
+// installTOC writes items as the book's toc nav. Hrefs in items are relative
+// to the package directory and are rebased onto the nav document.
+func installTOC(vol *Volume, items []NavItem) error {
+	pkg := vol.PackageDoc
+	if vol.NavHref == "" {
+		href := "nav.xhtml"
+		for hasManifestHref(pkg, href) {
+			href = "novfmt-" + href
+		}
+		pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{
+			ID:         uniqueManifestID(pkg, "nav"),
+			Href:       href,
+			MediaType:  "application/xhtml+xml",
+			Properties: "nav",
+		})
+		vol.NavHref = href
+		return writeNavDocument(items, filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+	}
+
+	navDir := path.Dir(vol.NavHref)
+	rebased := rebaseNavItems(items, navDir)
+	navPath := filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref))
+	data, err := os.ReadFile(navPath)
+	if err != nil {
+		return err
+	}
+	start, end, err := findTOCNavRange(data)
+	if err != nil {
+		return writeNavDocument(rebased, navPath)
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:start])
+	writeTOCNav(&buf, rebased)
+	buf.Write(bytes.TrimLeft(data[end:], "\n"))
+	return os.WriteFile(navPath, buf.Bytes(), 0o644)
+}
+
+// findTOCNavRange returns the byte range of the toc nav element in a nav
+// document.
+func findTOCNavRange(data []byte) (int, int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	start, depth := -1, 0
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "nav" {
+				continue
+			}
+			if start >= 0 {
+				depth++
+			} else if hasTOCTypeAttr(t.Attr) {
+				start = offset
+			}
+		case xml.EndElement:
+			if t.Name.Local != "nav" || start < 0 {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			return start, int(dec.InputOffset()), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("toc nav not found")
+}
+
+func rebaseNavItems(items []NavItem, fromDir string) []NavItem {
+	out := make([]NavItem, 0, len(items))
+	for _, item := range items {
+		clone := NavItem{Title: item.Title, Href: relativeHref(fromDir, item.Href)}
+		if len(item.Children) > 0 {
+			clone.Children = rebaseNavItems(item.Children, fromDir)
+		}
+		out = append(out, clone)
+	}
+	return out
+}
+
+// relativeHref rewrites href (relative to the package directory) so it
+// resolves the same way from fromDir, also package-relative.
+func relativeHref(fromDir, href string) string {
+	if href == "" || fromDir == "" || fromDir == "." || strings.HasPrefix(href, "#") || strings.Contains(href, "://") {
+		return href
+	}
+	target, frag, hasFrag := strings.Cut(href, "#")
+	from := strings.Split(path.Clean(fromDir), "/")
+	to := strings.Split(path.Clean(target), "/")
+	i := 0
+	for i < len(from) && i < len(to)-1 && from[i] == to[i] {
+		i++
+	}
+	parts := make([]string, 0, len(from)-i+len(to)-i)
+	for range from[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[i:]...)
+	out := strings.Join(parts, "/")
+	if hasFrag {
+		out += "#" + frag
+	}
+	return out
+}
+
+func hasManifestHref(pkg *PackageDocument, href string) bool {
+	for _, item := range pkg.Manifest.Items {
+		if strings.EqualFold(normalizeEPUBPath(item.Href), normalizeEPUBPath(href)) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueManifestID(pkg *PackageDocument, base string) string {
+	used := make(map[string]bool, len(pkg.Manifest.Items))
+	for _, item := range pkg.Manifest.Items {
+		used[item.ID] = true
+	}
+	id := base
+	for n := 2; used[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
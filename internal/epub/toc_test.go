@@ -0,0 +1,130 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildHeadingTree(t *testing.T) {
+	headings := []tocHeading{
+		{level: 2, title: "Part 1", href: "a.xhtml"},
+		{level: 3, title: "Chapter 1", href: "a.xhtml#c1"},
+		{level: 4, title: "Scene", href: "a.xhtml#s1"},
+		{level: 3, title: "Chapter 2", href: "b.xhtml"},
+		{level: 2, title: "Part 2", href: "c.xhtml"},
+	}
+	items := buildHeadingTree(headings, 2)
+	if len(items) != 2 {
+		t.Fatalf("got %d top-level items", len(items))
+	}
+	if items[0].Title != "Part 1" || len(items[0].Children) != 2 {
+		t.Fatalf("unexpected first part %+v", items[0])
+	}
+	if len(items[0].Children[0].Children) != 0 {
+		t.Fatalf("depth limit not applied: %+v", items[0].Children[0])
+	}
+	if items[1].Title != "Part 2" || len(items[1].Children) != 0 {
+		t.Fatalf("unexpected second part %+v", items[1])
+	}
+}
+
+func TestRelativeHref(t *testing.T) {
+	cases := []struct {
+		from, href, want string
+	}{
+		{".", "Text/ch1.xhtml", "Text/ch1.xhtml"},
+		{"Text", "Text/ch1.xhtml#p", "ch1.xhtml#p"},
+		{"Nav", "Text/ch1.xhtml", "../Text/ch1.xhtml"},
+		{"a/b", "a/c/d.xhtml", "../c/d.xhtml"},
+	}
+	for _, tc := range cases {
+		if got := relativeHref(tc.from, tc.href); got != tc.want {
+			t.Fatalf("relativeHref(%q,%q)=%q want %q", tc.from, tc.href, got, tc.want)
+		}
+	}
+}
+
+func TestRegenerateTOC(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="nav" href="Nav/nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="a" href="Text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="Text/b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/Nav/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol><li><a href="../Text/a.xhtml">Broken</a></li></ol></nav>
+<nav epub:type="landmarks"><ol><li><a epub:type="bodymatter" href="../Text/a.xhtml">Start</a></li></ol></nav></body></html>`,
+		"OEBPS/Text/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Chapter <em>One</em></h1><p>x</p><h2>Interlude</h2><h2 id="s2">Scene 2</h2></body></html>`,
+		"OEBPS/Text/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Chapter Two</h1><h1>Afterword</h1></body></html>`,
+	})
+
+	res, err := RegenerateTOC(context.Background(), input, TOCOptions{Headings: HeadingDetector{Exclude: `^Afterword$`}})
+	if err != nil {
+		t.Fatalf("RegenerateTOC: %v", err)
+	}
+	items := res.Items
+	if len(items) != 2 || items[0].Title != "Chapter One" || items[1].Href != "Text/b.xhtml" {
+		t.Fatalf("unexpected items %+v", items)
+	}
+	if len(items[0].Children) != 2 || items[0].Children[1].Href != "Text/a.xhtml#s2" {
+		t.Fatalf("unexpected children %+v", items[0].Children)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	if len(vol.NavItems) != 2 || vol.NavItems[0].Href != "../Text/a.xhtml" {
+		t.Fatalf("nav not rebased: %+v", vol.NavItems)
+	}
+	if got := vol.NavItems[0].Children[0].Href; got != "../Text/a.xhtml#novfmt-toc-2" {
+		t.Fatalf("generated id href = %q", got)
+	}
+	nav, err := os.ReadFile(filepath.Join(vol.PackageDir, "Nav", "nav.xhtml"))
+	if err != nil {
+		t.Fatalf("read nav: %v", err)
+	}
+	if !strings.Contains(string(nav), `epub:type="landmarks"`) || strings.Contains(string(nav), "Broken") {
+		t.Fatalf("unexpected nav document:\n%s", nav)
+	}
+	chapter, err := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "a.xhtml"))
+	if err != nil {
+		t.Fatalf("read chapter: %v", err)
+	}
+	if !strings.Contains(string(chapter), `id="novfmt-toc-2"`) {
+		t.Fatalf("heading id not assigned:\n%s", chapter)
+	}
+}
+
+func TestRegenerateTOCCreatesNav(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h2>Only</h2></body></html>`,
+	})
+
+	if _, err := RegenerateTOC(context.Background(), input, TOCOptions{}); err != nil {
+		t.Fatalf("RegenerateTOC: %v", err)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	if vol.NavHref != "nav.xhtml" || len(vol.NavItems) != 1 || vol.NavItems[0].Title != "Only" {
+		t.Fatalf("nav not created: href=%q items=%+v", vol.NavHref, vol.NavItems)
+	}
+}
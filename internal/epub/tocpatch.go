@@ -0,0 +1,309 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A TOC file holds the nav table of contents as JSON: a list of NavItems,
+// each with a title, an href relative to the package document and
+// optional children. It is meant to be edited by hand and applied back.
+
+// dumpTOCFile writes the book's table of contents to dest as a TOC file.
+func dumpTOCFile(vol *Volume, dest string) error {
+	items, err := tocOf(vol)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureParentDir(dest); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, append(data, '\n'), 0o644)
+}
+
+// tocOf returns the table of contents of vol from its nav document or,
+// failing that, its NCX, with hrefs relative to the package document.
+func tocOf(vol *Volume) ([]NavItem, error) {
+	if vol.NavHref != "" {
+		items, err := parseNavFile(filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref)))
+		if err != nil {
+			return nil, err
+		}
+		return packageNavItems(items, path.Dir(vol.NavHref)), nil
+	}
+	if ncx := ncxHref(vol.PackageDoc); ncx != "" {
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, filepath.FromSlash(ncx)))
+		if err != nil {
+			return nil, err
+		}
+		items, err := parseNCXNavMap(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ncx, err)
+		}
+		return packageNavItems(items, path.Dir(ncx)), nil
+	}
+	return nil, fmt.Errorf("the book has neither a nav document nor an NCX")
+}
+
+// parseNCXNavMap returns the navPoints of an NCX as NavItems, with hrefs
+// relative to the NCX.
+func parseNCXNavMap(data []byte) ([]NavItem, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	var (
+		items  []NavItem
+		stack  []*NavItem
+		inText bool
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return items, nil
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "navPoint":
+				stack = append(stack, &NavItem{})
+			case "text":
+				inText = len(stack) > 0 && stack[len(stack)-1].Title == ""
+			case "content":
+				if len(stack) > 0 {
+					stack[len(stack)-1].Href = strings.TrimSpace(attrValue(t.Attr, "src"))
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "text":
+				inText = false
+			case "navPoint":
+				if len(stack) == 0 {
+					continue
+				}
+				item := *stack[len(stack)-1]
+				item.Title = normalizeSpace(item.Title)
+				stack = stack[:len(stack)-1]
+				if len(stack) > 0 {
+					parent := stack[len(stack)-1]
+					parent.Children = append(parent.Children, item)
+				} else {
+					items = append(items, item)
+				}
+			}
+		case xml.CharData:
+			if inText {
+				stack[len(stack)-1].Title += string(t)
+			}
+		}
+	}
+}
+
+// packageNavItems rewrites the hrefs of items, relative to navDir, to be
+// relative to the package document.
+func packageNavItems(items []NavItem, navDir string) []NavItem {
+	out := make([]NavItem, 0, len(items))
+	for _, item := range items {
+		clone := NavItem{Title: item.Title, Href: joinHref(navDir, item.Href)}
+		if len(item.Children) > 0 {
+			clone.Children = packageNavItems(item.Children, navDir)
+		}
+		out = append(out, clone)
+	}
+	return out
+}
+
+// readTOCFile reads a TOC file.
+func readTOCFile(src string) ([]NavItem, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("read toc: %w", err)
+	}
+	var items []NavItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("parse toc: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("parse toc: no entries")
+	}
+	return items, nil
+}
+
+// ReadTOC returns the book's table of contents with hrefs relative to
+// the package document, as -dump-toc writes it.
+func ReadTOC(ctx context.Context, input string) ([]NavItem, error) {
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	return tocOf(vol)
+}
+
+// applyTOC replaces the book's toc nav with items, after checking that
+// every entry has a title and points at a file in the book. Other navs
+// (landmarks, page-list) are kept. An NCX gets the same entries; a book
+// with neither gets a new nav document.
+func applyTOC(vol *Volume, items []NavItem, cs *Changeset) error {
+	if err := checkTOCItems(vol.PackageDoc, items); err != nil {
+		return err
+	}
+	ncx := ncxHref(vol.PackageDoc)
+	if vol.NavHref == "" && ncx == "" {
+		if err := installTOC(vol, items); err != nil {
+			return err
+		}
+		cs.added(vol.NavHref)
+		cs.modified(packageHref(vol))
+		return nil
+	}
+	if vol.NavHref != "" {
+		changed, err := rewriteFile(filepath.Join(vol.PackageDir, filepath.FromSlash(vol.NavHref)), func() error {
+			return installTOC(vol, items)
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			cs.modified(vol.NavHref)
+		}
+	}
+	if ncx != "" {
+		ncxPath := filepath.Join(vol.PackageDir, filepath.FromSlash(ncx))
+		changed, err := rewriteFile(ncxPath, func() error {
+			return writeNCXNavMap(ncxPath, rebaseNavItems(items, path.Dir(ncx)))
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", ncx, err)
+		}
+		if changed {
+			cs.modified(ncx)
+		}
+	}
+	return nil
+}
+
+// rewriteFile runs write, which rewrites the file at path, and reports
+// whether the file's content changed.
+func rewriteFile(path string, write func() error) (bool, error) {
+	before, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if err := write(); err != nil {
+		return false, err
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(before, after), nil
+}
+
+// ncxHref returns the href of the book's NCX, or "".
+func ncxHref(pkg *PackageDocument) string {
+	for _, item := range pkg.Manifest.Items {
+		if item.MediaType == "application/x-dtbncx+xml" {
+			return normalizeEPUBPath(item.Href)
+		}
+	}
+	return ""
+}
+
+// writeNCXNavMap replaces the navPoints of the NCX at ncxPath with items,
+// whose hrefs are relative to the NCX, and keeps the rest of the file.
+func writeNCXNavMap(ncxPath string, items []NavItem) error {
+	data, err := os.ReadFile(ncxPath)
+	if err != nil {
+		return err
+	}
+	start, end, err := findNavMapRange(data)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:start])
+	buf.WriteString("<navMap>\n")
+	order := 0
+	writeNCXNavPoints(&buf, items, &order, 1)
+	buf.WriteString("</navMap>")
+	buf.Write(data[end:])
+	return os.WriteFile(ncxPath, buf.Bytes(), 0o644)
+}
+
+func writeNCXNavPoints(buf *bytes.Buffer, items []NavItem, order *int, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, item := range items {
+		*order++
+		fmt.Fprintf(buf, "%s<navPoint id=\"navPoint-%d\" playOrder=\"%d\">\n", indent, *order, *order)
+		fmt.Fprintf(buf, "%s  <navLabel><text>%s</text></navLabel>\n", indent, html.EscapeString(item.Title))
+		fmt.Fprintf(buf, "%s  <content src=\"%s\"/>\n", indent, html.EscapeString(item.Href))
+		writeNCXNavPoints(buf, item.Children, order, depth+1)
+		buf.WriteString(indent + "</navPoint>\n")
+	}
+}
+
+// findNavMapRange returns the byte range of the navMap element of an NCX.
+func findNavMapRange(data []byte) (int, int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	start := -1
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "navMap" && start < 0 {
+				start = offset
+			}
+		case xml.EndElement:
+			if t.Name.Local == "navMap" && start >= 0 {
+				return start, int(dec.InputOffset()), nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("navMap not found")
+}
+
+func checkTOCItems(pkg *PackageDocument, items []NavItem) error {
+	for _, item := range items {
+		if strings.TrimSpace(item.Title) == "" {
+			return fmt.Errorf("toc: entry for %q has no title", item.Href)
+		}
+		target, _, _ := strings.Cut(item.Href, "#")
+		switch {
+		case item.Href == "":
+			return fmt.Errorf("toc: entry %q has no href", item.Title)
+		case strings.Contains(item.Href, "://"):
+		case target == "":
+			return fmt.Errorf("toc: entry %q: href %q names no file", item.Title, item.Href)
+		case !hasManifestHref(pkg, target):
+			return fmt.Errorf("toc: entry %q: %s is not in the book", item.Title, target)
+		}
+		if err := checkTOCItems(pkg, item.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
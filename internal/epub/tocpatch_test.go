@@ -0,0 +1,140 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpAndApplyTOC(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="nav" href="Nav/nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="a" href="Text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="Text/b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/Nav/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol><li><a href="../Text/a.xhtml">Chaptr 1</a><ol><li><a href="../Text/a.xhtml#s2">Scene</a></li></ol></li><li><a href="../Text/b.xhtml">Chapter 2</a></li></ol></nav>
+<nav epub:type="landmarks"><ol><li><a epub:type="bodymatter" href="../Text/a.xhtml">Start</a></li></ol></nav></body></html>`,
+		"OEBPS/Text/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Chapter 1</h1><h2 id="s2">Scene</h2></body></html>`,
+		"OEBPS/Text/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1>Chapter 2</h1></body></html>`,
+	})
+	dump := filepath.Join(t.TempDir(), "toc.json")
+	if _, err := EditEPUB(ctx, input, EditOptions{DumpTOCPath: dump}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []NavItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Href != "Text/a.xhtml" || items[0].Children[0].Href != "Text/a.xhtml#s2" {
+		t.Fatalf("dumped toc = %s", data)
+	}
+
+	// Fix the typo and put chapter 2 first.
+	items[0].Title = "Chapter 1"
+	items[0], items[1] = items[1], items[0]
+	data, _ = json.Marshal(items)
+	if err := os.WriteFile(dump, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := EditEPUB(ctx, input, EditOptions{ApplyTOCPath: dump})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.Files) != 1 || cs.Files[0].Href != "Nav/nav.xhtml" {
+		t.Fatalf("changes = %+v", cs.Files)
+	}
+
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	nav, err := os.ReadFile(filepath.Join(vol.PackageDir, "Nav", "nav.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseNavDocument(nav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Href != "../Text/b.xhtml" || got[1].Title != "Chapter 1" || got[1].Children[0].Href != "../Text/a.xhtml#s2" {
+		t.Fatalf("nav = %s", nav)
+	}
+	if !strings.Contains(string(nav), `epub:type="landmarks"`) {
+		t.Fatalf("landmarks lost: %s", nav)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(bad, []byte(`[{"title": "Gone", "href": "Text/c.xhtml"}]`), 0o644)
+	if _, err := EditEPUB(ctx, input, EditOptions{ApplyTOCPath: bad}); err == nil {
+		t.Fatal("expected an entry pointing outside the book to be rejected")
+	}
+}
+
+func TestApplyTOCRewritesNCX(t *testing.T) {
+	ctx := context.Background()
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier></metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="a" href="Text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="Text/b.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx"><itemref idref="a"/><itemref idref="b"/></spine>
+</package>`,
+		"OEBPS/toc.ncx": `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head><meta name="dtb:uid" content="urn:test"/></head>
+<docTitle><text>Book</text></docTitle>
+<navMap>
+<navPoint id="n1" playOrder="1"><navLabel><text>One</text></navLabel><content src="Text/a.xhtml"/>
+<navPoint id="n2" playOrder="2"><navLabel><text>Two</text></navLabel><content src="Text/b.xhtml"/></navPoint>
+</navPoint>
+</navMap>
+</ncx>`,
+		"OEBPS/Text/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>a</p></body></html>`,
+		"OEBPS/Text/b.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>b</p></body></html>`,
+	})
+
+	items, err := ReadTOC(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Title != "One" || len(items[0].Children) != 1 || items[0].Children[0].Href != "Text/b.xhtml" {
+		t.Fatalf("toc = %+v", items)
+	}
+
+	// Un-nest "Two" and rename it.
+	items = []NavItem{items[0], {Title: "Chapter <2>", Href: "Text/b.xhtml"}}
+	items[0].Children = nil
+	cs, err := EditEPUB(ctx, input, EditOptions{TOC: items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.Files) != 1 || cs.Files[0].Href != "toc.ncx" {
+		t.Fatalf("changes = %+v", cs.Files)
+	}
+	got, err := ReadTOC(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Title != "Chapter <2>" || len(got[0].Children) != 0 {
+		t.Fatalf("toc = %+v", got)
+	}
+}
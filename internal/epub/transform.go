@@ -0,0 +1,517 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transform is a content transform that can run in a transform chain.
+type Transform struct {
+	Name        string
+	Description string
+	// Arg documents the optional argument given as name:arg, or is empty
+	// when the transform takes none.
+	Arg string
+	// New prepares the transform for one book. arg is the text after the
+	// colon in the chain spec, or "".
+	New func(arg string, book TransformBook) (DocumentTransform, error)
+	// After names transforms that must run earlier in a chain that uses
+	// both, because running them later can undo this one's work.
+	After []string
+	// Check, if set, verifies this transform's postcondition on a document
+	// it has just produced.
+	Check func(arg string, data []byte) error
+}
+
+// TransformBook is what a Transform may need to know about the book.
+type TransformBook struct {
+	// Language is the book's first dc:language.
+	Language string
+	// Headings decides which elements are chapter headings.
+	Headings HeadingDetector
+	// ImageSize returns the pixel size of an image, href relative to the
+	// package document. It may be nil.
+	ImageSize func(href string) (width, height int, ok bool)
+}
+
+// DocumentTransform transforms one XHTML document; href is relative to
+// the package document.
+type DocumentTransform func(href string, data []byte) (TransformResult, error)
+
+type TransformResult struct {
+	// Data is the transformed document, or nil when nothing changed.
+	Data    []byte
+	Matches int
+	Changes []TextChange
+}
+
+// TransformStep is one entry of a chain spec such as "typo,ruby:strip".
+type TransformStep struct {
+	Name string
+	Arg  string
+}
+
+func (s TransformStep) String() string {
+	if s.Arg == "" {
+		return s.Name
+	}
+	return s.Name + ":" + s.Arg
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]Transform{}
+)
+
+// RegisterTransform adds t to the registry used by TransformEPUB, replacing
+// any transform with the same name.
+func RegisterTransform(t Transform) {
+	if t.Name == "" || t.New == nil {
+		panic("epub: RegisterTransform needs a name and a constructor")
+	}
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[t.Name] = t
+}
+
+// Transforms lists the registered transforms by name.
+func Transforms() []Transform {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	out := make([]Transform, 0, len(transforms))
+	for _, t := range transforms {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func lookupTransform(name string) (Transform, bool) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	t, ok := transforms[name]
+	return t, ok
+}
+
+// ParseTransformChain parses a comma-separated chain spec such as
+// "typo,ruby:strip,scene-breaks". Specs may be split across several
+// strings (repeated flags); order is kept.
+func ParseTransformChain(specs ...string) ([]TransformStep, error) {
+	var steps []TransformStep
+	for _, spec := range specs {
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(part, ":")
+			if _, ok := lookupTransform(name); !ok {
+				return nil, fmt.Errorf("unknown transform %q", name)
+			}
+			steps = append(steps, TransformStep{Name: name, Arg: arg})
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no transforms enabled")
+	}
+	return steps, nil
+}
+
+type TransformOptions struct {
+	Steps []TransformStep
+	// CheckIdempotent checks every document as CheckTransformChain does and
+	// fails before writing anything if a check does not hold.
+	CheckIdempotent bool
+	// RepairHTML repairs documents that are not well-formed XHTML before
+	// the chain runs; see RewriteOptions.RepairHTML.
+	RepairHTML bool
+	// Headings is the chapter heading detector transforms that look for
+	// chapters use.
+	Headings HeadingDetector
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// transformChain is a chain of steps prepared for one book.
+type transformChain struct {
+	steps []TransformStep
+	defs  []Transform
+	fns   []DocumentTransform
+}
+
+func newTransformChain(steps []TransformStep, book TransformBook) (*transformChain, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no transforms enabled")
+	}
+	c := &transformChain{steps: steps}
+	for _, step := range steps {
+		t, ok := lookupTransform(step.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", step.Name)
+		}
+		fn, err := t.New(step.Arg, book)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step, err)
+		}
+		c.defs = append(c.defs, t)
+		c.fns = append(c.fns, fn)
+	}
+	return c, nil
+}
+
+// run passes data through every step. out is nil when nothing changed.
+// With check set, each step's postcondition is verified on its output.
+func (c *transformChain) run(href string, data []byte, check bool) (out []byte, file RewriteFileResult, err error) {
+	file.Href = href
+	for i, fn := range c.fns {
+		res, err := fn(href, data)
+		if err != nil {
+			return nil, file, fmt.Errorf("%s: %s: %w", href, c.steps[i], err)
+		}
+		file.Matches += res.Matches
+		file.Changes = append(file.Changes, res.Changes...)
+		if res.Data != nil {
+			data, out = res.Data, res.Data
+		}
+		if check && c.defs[i].Check != nil {
+			if err := c.defs[i].Check(c.steps[i].Arg, data); err != nil {
+				return nil, file, fmt.Errorf("%s: %s: postcondition failed: %w", href, c.steps[i], err)
+			}
+		}
+	}
+	return out, file, nil
+}
+
+// checkOrder verifies every step's After declarations.
+func (c *transformChain) checkOrder() error {
+	pos := map[string]int{}
+	for i, step := range c.steps {
+		if _, seen := pos[step.Name]; !seen {
+			pos[step.Name] = i
+		}
+	}
+	for i, t := range c.defs {
+		for _, name := range t.After {
+			if j, ok := pos[name]; ok && j > i {
+				return fmt.Errorf("%s must run after %s", c.steps[i], c.steps[j])
+			}
+		}
+	}
+	return nil
+}
+
+// verify runs the chain over one document, checking postconditions, then
+// runs it again over the result and fails if the second run changes
+// anything. It returns the output of the first run, or nil.
+func (c *transformChain) verify(href string, data []byte) ([]byte, RewriteFileResult, error) {
+	out, file, err := c.run(href, data, true)
+	if err != nil {
+		return nil, file, err
+	}
+	again := data
+	if out != nil {
+		again = out
+	}
+	for i, fn := range c.fns {
+		res, err := fn(href, again)
+		if err != nil {
+			return nil, file, fmt.Errorf("%s: second run: %s: %w", href, c.steps[i], err)
+		}
+		if res.Data != nil && !bytes.Equal(res.Data, again) {
+			return nil, file, fmt.Errorf("%s: not idempotent: a second run of %s changed the document", href, c.steps[i])
+		}
+	}
+	return out, file, nil
+}
+
+// CheckTransformChain runs steps over one XHTML document the way
+// TransformOptions.CheckIdempotent does for a whole book: the chain must
+// respect every step's After declarations, every step's Check must hold on
+// its output, and running the chain a second time must not change the
+// result. It returns the transformed document, or data when nothing
+// changed. It is meant for tests of custom transforms and chains.
+func CheckTransformChain(steps []TransformStep, book TransformBook, href string, data []byte) ([]byte, error) {
+	c, err := newTransformChain(steps, book)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkOrder(); err != nil {
+		return nil, err
+	}
+	out, _, err := c.verify(href, data)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return data, nil
+	}
+	return out, nil
+}
+
+// TransformEPUB runs the chain of registered transforms over every XHTML
+// document (except the nav) in one pass: each document is read once, goes
+// through the steps in order, and is written once, and the book is unpacked
+// and zipped once.
+func TransformEPUB(ctx context.Context, input string, opts TransformOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	book := TransformBook{
+		Headings: opts.Headings,
+		ImageSize: func(href string) (int, int, bool) {
+			return imageFileSize(filepath.Join(vol.PackageDir, filepath.FromSlash(href)))
+		},
+	}
+	if len(pkg.Metadata.Languages) > 0 {
+		book.Language = strings.TrimSpace(pkg.Metadata.Languages[0].Value)
+	}
+	chain, err := newTransformChain(opts.Steps, book)
+	if err != nil {
+		return stats, err
+	}
+	if opts.CheckIdempotent {
+		if err := chain.checkOrder(); err != nil {
+			return stats, err
+		}
+	}
+
+	if opts.RepairHTML {
+		stats.RepairedHTML, err = repairContentMarkup(ctx, vol, nil, &stats.Changeset)
+		if err != nil {
+			return stats, err
+		}
+		for _, r := range stats.RepairedHTML {
+			log.Warn("repaired markup", "href", r.Href, "problem", r.Problem)
+		}
+	}
+
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" || hasProperty(item.Properties, "nav") {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return stats, err
+		}
+		var (
+			out  []byte
+			file RewriteFileResult
+		)
+		if opts.CheckIdempotent {
+			out, file, err = chain.verify(item.Href, data)
+		} else {
+			out, file, err = chain.run(item.Href, data, false)
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.MatchCount += file.Matches
+		if out == nil {
+			continue
+		}
+		log.Debug("transformed", "href", item.Href, "matches", file.Matches)
+		stats.FilesChanged++
+		stats.Changeset.modified(item.Href)
+		// EPUB 3 requires the svg property on documents with inline SVG.
+		if pkg.Version != "2.0" && setSVGProperty(&pkg.Manifest.Items[i], out) {
+			stats.Changeset.modified(packageHref(vol))
+		}
+		stats.Files = append(stats.Files, file)
+		if !opts.DryRun {
+			if err := os.WriteFile(src, out, 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// rubyAnnotationPattern finds the rt elements ruby:strip and ruby:paren
+// must not leave behind.
+var rubyAnnotationPattern = regexp.MustCompile(`(?i)<rt[\s/>]`)
+
+func init() {
+	RegisterTransform(Transform{
+		Name:        "typo",
+		Description: "smart quotes, dashes, ellipses and punctuation spacing (see typo)",
+		Arg:         "language, default: the book's",
+		New: func(arg string, book TransformBook) (DocumentTransform, error) {
+			lang := arg
+			if lang == "" {
+				lang = book.Language
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				res, err := typesetXHTML(data, lang, nil, TypoOptions{})
+				return TransformResult{Data: res.data, Matches: res.matches, Changes: res.changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "ruby",
+		Description: "convert ruby (furigana) annotations (see rewrite -ruby)",
+		Arg:         "strip, paren or keep, default: strip",
+		New: func(arg string, _ TransformBook) (DocumentTransform, error) {
+			if arg == "" {
+				arg = RubyStrip
+			}
+			mode, err := ParseRubyMode(arg)
+			if err != nil {
+				return nil, err
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				out, changes := convertRuby(data, mode)
+				return TransformResult{Data: out, Matches: len(changes), Changes: changes}, nil
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "scene-breaks",
+		Description: "replace scene separators with one canonical marker (see rewrite -scene-breaks)",
+		// Blank paragraphs cleanup removes can leave two markers side by
+		// side, which only a second scene-breaks run would merge.
+		After: []string{"cleanup"},
+		New: func(arg string, _ TransformBook) (DocumentTransform, error) {
+			if arg != "" {
+				return nil, fmt.Errorf("scene-breaks takes no argument")
+			}
+			sb, err := compileSceneBreak(&SceneBreakRule{})
+			if err != nil {
+				return nil, err
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				out, changes, err := normalizeSceneBreaks(data, sb)
+				return TransformResult{Data: out, Matches: len(changes), Changes: changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "quotes",
+		Description: "convert quotes and dashes between locale conventions (see quotes)",
+		Arg:         "target locale, or source/target such as ja/en; the source defaults to the book's language",
+		// typo turns straight quotes into the book's own style, which a
+		// conversion that already ran would miss.
+		After: []string{"typo"},
+		New: func(arg string, book TransformBook) (DocumentTransform, error) {
+			from, to, ok := strings.Cut(arg, "/")
+			if !ok {
+				from, to = book.Language, arg
+			}
+			if to == "" {
+				return nil, fmt.Errorf("quotes needs a target locale, e.g. quotes:en")
+			}
+			conv, err := newQuoteConverter(from, to, false, nil)
+			if err != nil {
+				return nil, err
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				res, err := conv.convert(data)
+				return TransformResult{Data: res.data, Matches: res.matches, Changes: res.changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "cleanup",
+		Description: "remove runs of blank and &nbsp;-only paragraphs (see cleanup)",
+		Arg:         "blank paragraphs to keep in a row, default: 1",
+		New: func(arg string, _ TransformBook) (DocumentTransform, error) {
+			opts := CleanupOptions{MaxBlank: 1}
+			if arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid blank paragraph count %q", arg)
+				}
+				opts.MaxBlank = n
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				out, changes, err := cleanupXHTML(data, opts)
+				return TransformResult{Data: out, Matches: len(changes), Changes: changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "headings",
+		Description: "set chapter headings to one level, volume titles one above (see the -headings detector)",
+		Arg:         "chapter level, default: 2; +bold also takes centered bold paragraphs for headings, as in 2+bold",
+		New: func(arg string, book TransformBook) (DocumentTransform, error) {
+			opts, err := parseHeadingLevelArg(arg, book.Headings)
+			if err != nil {
+				return nil, err
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				out, changes, err := normalizeHeadingLevels(data, opts)
+				return TransformResult{Data: out, Matches: len(changes), Changes: changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "image-pages",
+		Description: "show every full-page illustration or cover through one template, sized to the image",
+		Arg:         "svg (a full-page SVG wrapper) or img, default: svg",
+		New: func(arg string, book TransformBook) (DocumentTransform, error) {
+			template, err := ParseImagePageTemplate(arg)
+			if err != nil {
+				return nil, err
+			}
+			return func(href string, data []byte) (TransformResult, error) {
+				out, changes, err := normalizeImagePage(href, data, template, book.ImageSize)
+				return TransformResult{Data: out, Matches: len(changes), Changes: changes}, err
+			}, nil
+		},
+	})
+	RegisterTransform(Transform{
+		Name:        "invisible",
+		Description: "strip soft hyphens, zero-width and directional characters (see invisible)",
+		Arg:         "characters to keep joined with +, such as shy+bidi",
+		New: func(arg string, _ TransformBook) (DocumentTransform, error) {
+			var names []string
+			if arg != "" {
+				names = strings.Split(arg, "+")
+			}
+			keep, err := ParseInvisibleKeep(names)
+			if err != nil {
+				return nil, err
+			}
+			return func(_ string, data []byte) (TransformResult, error) {
+				out, counts, err := stripInvisible(data, keep)
+				n := 0
+				for _, c := range counts {
+					n += c
+				}
+				return TransformResult{Data: out, Matches: n}, err
+			}, nil
+		},
+	})
+}
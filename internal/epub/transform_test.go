@@ -0,0 +1,155 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransformChain(t *testing.T) {
+	RegisterTransform(Transform{
+		Name: "test-mark",
+		New: func(arg string, book TransformBook) (DocumentTransform, error) {
+			return func(_ string, data []byte) (TransformResult, error) {
+				// Runs after typo, so it must see the curly quotes.
+				if !bytes.Contains(data, []byte("“")) {
+					return TransformResult{}, nil
+				}
+				out := bytes.Replace(data, []byte("</body>"), []byte("<p>"+book.Language+arg+"</p></body>"), 1)
+				return TransformResult{Data: out, Matches: 1}, nil
+			}, nil
+		},
+	})
+
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:transform</dc:identifier>
+    <dc:title>T</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head>
+<body><p>"Hi," said <ruby>Kan<rt>kan</rt></ruby>.</p><p>***</p><p></p><p></p><p>End</p></body></html>
+`,
+	})
+
+	steps, err := ParseTransformChain("typo,ruby", "scene-breaks,cleanup:0,test-mark:!")
+	if err != nil {
+		t.Fatalf("ParseTransformChain: %v", err)
+	}
+	ctx := context.Background()
+	stats, err := TransformEPUB(ctx, input, TransformOptions{Steps: steps})
+	if err != nil {
+		t.Fatalf("TransformEPUB: %v", err)
+	}
+	if stats.FilesChanged != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, _ := os.ReadFile(filepath.Join(vol.PackageDir, "ch1.xhtml"))
+	doc := string(data)
+	for _, want := range []string{"“Hi,” said Kan.", `class="scene-break"`, "<p>en!</p>"} {
+		if !strings.Contains(doc, want) {
+			t.Fatalf("missing %q in:\n%s", want, doc)
+		}
+	}
+	if strings.Count(doc, "</p>") != 3 || strings.Contains(doc, "rt>") {
+		t.Fatalf("cleanup or ruby did not run:\n%s", doc)
+	}
+
+	if _, err := ParseTransformChain("typo,nope"); err == nil {
+		t.Fatalf("expected unknown transform to fail")
+	}
+	if _, err := TransformEPUB(ctx, input, TransformOptions{Steps: []TransformStep{{Name: "ruby", Arg: "bogus"}}}); err == nil {
+		t.Fatalf("expected bad argument to fail")
+	}
+}
+
+func TestCheckTransformChain(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>c</title></head>
+<body><p>"Wait..." -- <ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby></p>
+<p>* * *</p><p></p><p>&#160;</p><p>◇</p><p></p><p></p><p>End 'quote'</p></body></html>
+`
+	book := TransformBook{Language: "en"}
+	for _, chain := range []string{
+		"typo",
+		"ruby",
+		"ruby:paren",
+		"scene-breaks",
+		"cleanup",
+		"cleanup:0",
+		"typo,ruby:paren,cleanup:0,scene-breaks",
+	} {
+		steps, err := ParseTransformChain(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CheckTransformChain(steps, book, "ch1.xhtml", []byte(doc)); err != nil {
+			t.Errorf("%s: %v", chain, err)
+		}
+	}
+
+	// Cleanup after scene-breaks can leave two markers side by side.
+	steps, _ := ParseTransformChain("scene-breaks,cleanup:0")
+	if _, err := CheckTransformChain(steps, book, "ch1.xhtml", []byte(doc)); err == nil || !strings.Contains(err.Error(), "must run after") {
+		t.Fatalf("order error = %v", err)
+	}
+
+	RegisterTransform(Transform{
+		Name: "test-append",
+		New: func(string, TransformBook) (DocumentTransform, error) {
+			return func(_ string, data []byte) (TransformResult, error) {
+				return TransformResult{Data: append(bytes.Clone(data), '\n'), Matches: 1}, nil
+			}, nil
+		},
+	})
+	steps, _ = ParseTransformChain("typo,test-append")
+	if _, err := CheckTransformChain(steps, book, "ch1.xhtml", []byte(doc)); err == nil || !strings.Contains(err.Error(), "not idempotent") {
+		t.Fatalf("idempotency error = %v", err)
+	}
+
+	RegisterTransform(Transform{
+		Name: "test-noop",
+		New: func(string, TransformBook) (DocumentTransform, error) {
+			return func(string, []byte) (TransformResult, error) { return TransformResult{}, nil }, nil
+		},
+		Check: func(string, []byte) error { return fmt.Errorf("always fails") },
+	})
+	steps, _ = ParseTransformChain("test-noop")
+	if _, err := CheckTransformChain(steps, book, "ch1.xhtml", []byte(doc)); err == nil || !strings.Contains(err.Error(), "postcondition") {
+		t.Fatalf("postcondition error = %v", err)
+	}
+
+	input := buildTestEPUB(t, "T", "en")
+	before, _ := os.ReadFile(input)
+	_, err := TransformEPUB(context.Background(), input, TransformOptions{
+		Steps:           []TransformStep{{Name: "test-append"}},
+		CheckIdempotent: true,
+	})
+	if err == nil {
+		t.Fatalf("expected -check-idempotent to fail")
+	}
+	if after, _ := os.ReadFile(input); !bytes.Equal(before, after) {
+		t.Fatalf("book was written despite a failed check")
+	}
+}
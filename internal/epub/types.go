@@ -1,6 +1,9 @@
 package epub
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"log/slog"
+)
 
 const (
 	nsDC  = "http://purl.org/dc/elements/1.1/"
@@ -20,6 +23,7 @@ type PackageDocument struct {
 	Metadata Metadata `xml:"metadata"`
 	Manifest Manifest `xml:"manifest"`
 	Spine    Spine    `xml:"spine"`
+	Guide    *Guide   `xml:"guide,omitempty"`
 }
 
 type Metadata struct {
@@ -29,18 +33,76 @@ type Metadata struct {
 	Languages    []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ language"`
 	Identifiers  []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ identifier"`
 	Descriptions []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ description"`
+	Dates        []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Subjects     []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Publishers   []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ publisher"`
+	Sources      []DCMeta   `xml:"http://purl.org/dc/elements/1.1/ source"`
 	Meta         []MetaNode `xml:"meta"`
 }
 
 type DCMeta struct {
 	ID     string `xml:"id,attr,omitempty"`
+	Lang   string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Dir    string `xml:"dir,attr,omitempty"`
 	Role   string `xml:"opf:role,attr,omitempty"`
 	FileAs string `xml:"opf:file-as,attr,omitempty"`
+	Scheme string `xml:"opf:scheme,attr,omitempty"`
+	Event  string `xml:"opf:event,attr,omitempty"`
 	Value  string `xml:",chardata"`
 }
 
+// UnmarshalXML reads the opf attributes, which the struct tags can only
+// write: encoding/xml matches attributes by namespace, not prefix.
+func (m *DCMeta) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain DCMeta
+	var p plain
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+	*m = DCMeta(p)
+	for _, attr := range start.Attr {
+		if attr.Name.Space != nsOPF && attr.Name.Space != "opf" {
+			continue
+		}
+		switch attr.Name.Local {
+		case "role":
+			m.Role = attr.Value
+		case "file-as":
+			m.FileAs = attr.Value
+		case "scheme":
+			m.Scheme = attr.Value
+		case "event":
+			m.Event = attr.Value
+		}
+	}
+	return nil
+}
+
+// dcElements returns every Dublin Core element list of meta.
+func (meta *Metadata) dcElements() [][]DCMeta {
+	return [][]DCMeta{meta.Titles, meta.Creators, meta.Languages, meta.Identifiers, meta.Descriptions, meta.Dates, meta.Subjects, meta.Publishers, meta.Sources}
+}
+
+// hasOPFAttrs reports whether any dc element of meta carries an opf
+// attribute.
+func (meta *Metadata) hasOPFAttrs() bool {
+	for _, list := range meta.dcElements() {
+		for _, dc := range list {
+			if dc.Role != "" || dc.FileAs != "" || dc.Scheme != "" || dc.Event != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type MetaNode struct {
+	ID       string `xml:"id,attr,omitempty"`
+	Refines  string `xml:"refines,attr,omitempty"`
 	Property string `xml:"property,attr,omitempty"`
+	Scheme   string `xml:"scheme,attr,omitempty"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Dir      string `xml:"dir,attr,omitempty"`
 	Name     string `xml:"name,attr,omitempty"`
 	Content  string `xml:"content,attr,omitempty"`
 	Value    string `xml:",chardata"`
@@ -56,6 +118,9 @@ type ManifestItem struct {
 	MediaType  string `xml:"media-type,attr"`
 	Properties string `xml:"properties,attr,omitempty"`
 	Fallback   string `xml:"fallback,attr,omitempty"`
+	// MediaOverlay is the id of the SMIL media overlay that reads the
+	// document aloud.
+	MediaOverlay string `xml:"media-overlay,attr,omitempty"`
 }
 
 type Spine struct {
@@ -67,6 +132,22 @@ type Spine struct {
 type SpineItemRef struct {
 	IDRef  string `xml:"idref,attr"`
 	Linear string `xml:"linear,attr,omitempty"`
+	// Properties holds the item's own settings, such as
+	// rendition:page-spread-left or a rendition:layout-pre-paginated
+	// override.
+	Properties string `xml:"properties,attr,omitempty"`
+}
+
+// Guide is the EPUB 2 guide, which EPUB 3 replaces with the landmarks
+// nav.
+type Guide struct {
+	References []GuideReference `xml:"reference"`
+}
+
+type GuideReference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr,omitempty"`
+	Href  string `xml:"href,attr"`
 }
 
 type containerRoot struct {
@@ -78,8 +159,100 @@ type rootfile struct {
 }
 
 type MergeOptions struct {
-	OutPath  string
+	OutPath string
+	// Title is the merged book's title. It may be a template such as
+	// "{series} Vol. {first}-{last}". Placeholders: {series}, the series
+	// named in the volumes' metadata or shared by their titles or file
+	// names; {first} and {last}, the first and last volume numbers; {count},
+	// the number of volumes; {title}, the first volume's title; and
+	// {author}, the first creator. Without a title, volumes of a recognisable
+	// series are titled "{series} Vol. {first}-{last}" and anything else
+	// takes the first volume's title.
 	Title    string
 	Language string
 	Creators []string
+	// Layout is the path template that places each volume's files in the
+	// merged book, such as "vol{v:02}/{orig}" or "v{v}/{name}" (default
+	// DefaultMergeLayout). Placeholders: {v} or {v:NN}, the volume number,
+	// zero-padded to NN digits; {orig}, {dir}, {name}, {base} and {ext},
+	// the file's path relative to its package document and its parts; and
+	// {type}, one of text, styles, images, fonts, audio, video or misc.
+	// Links between the files are rewritten to match.
+	Layout string
+	// StripMatter, when set, drops the title pages, copyright pages and
+	// other repeated matter it selects from every volume but the first.
+	StripMatter *MatterFilter
+	// MixedLayout lets fixed-layout and reflowable volumes merge into a
+	// reflowable book whose fixed-layout pages keep their layout through
+	// spine item overrides. Without it such a merge fails.
+	MixedLayout bool
+	// NonLinear says what happens to spine items a volume marks
+	// linear="no", such as illustration or advertisement pages readers
+	// skip: NonLinearKeep (default), NonLinearLinear or NonLinearDrop.
+	NonLinear string
+	// Illustrations, when set, gathers the illustration pages it selects
+	// (colour plates, inserts) from every volume, and IllustrationsAt
+	// says where they go: IllustrationsBook (default) or
+	// IllustrationsVolume. Their own table of contents entries give way
+	// to one "Illustrations" entry.
+	Illustrations   *MatterFilter
+	IllustrationsAt string
+	// InsertPages are pages of one's own, such as a dedication or a
+	// translator's credit, added to the book with the files they use.
+	// They are not listed in the table of contents.
+	InsertPages []InsertPage
+	// VolumeTitlePages starts each volume with a generated page showing its
+	// title, publication date and cover, which the volume's nav entry
+	// points to.
+	VolumeTitlePages bool
+	// ShareResources stores a stylesheet, image or font that several
+	// volumes keep at the same path only once. When the copies differ,
+	// ConflictResolver decides what happens (default: ConflictRename).
+	ShareResources   bool
+	ConflictResolver ConflictResolver
+	// DedupeCSS keeps a single copy of stylesheets that are byte-identical
+	// across volumes and logs selector conflicts between the remaining ones.
+	DedupeCSS bool
+	// Stylesheet, when set, is a CSS file that replaces the stylesheets of
+	// every volume; all chapters link to it alone.
+	Stylesheet string
+	// StripCSS, KeepCSS and UserCSS restyle the merged book like the
+	// matching RestyleOptions fields.
+	StripCSS bool
+	KeepCSS  []string
+	UserCSS  string
+	// WritingMode, when set, converts every volume to one presentation
+	// (see SetWritingMode).
+	WritingMode string
+	// Ruby, when set, converts ruby annotations in every volume (see
+	// ParseRubyMode), since sources often treat furigana differently.
+	Ruby string
+	// ChapterHashes embeds per-chapter SHA-256 hashes in the output (see
+	// ChapterHashesFile).
+	ChapterHashes bool
+	// Checksums embeds a SHA-256 checksum of every file in the output (see
+	// ChecksumsFile).
+	Checksums bool
+	// NavBuilder, when set, replaces the default navigation document (see
+	// DefaultNavBuilder).
+	NavBuilder NavBuilder
+	// TextDecoder converts volumes in Shift_JIS or GBK to UTF-8 (default
+	// ExternalTextDecoder). Every volume's text is converted to UTF-8 in
+	// NFC before merging, so volumes in different encodings do not mix.
+	TextDecoder TextDecoder
+	// MaxSize, when positive, is a byte budget for the output file. An
+	// output over it is removed and merge fails with a *SizeBudgetError
+	// naming the largest files, unless ShrinkToFit brings it under. A
+	// book written to StreamPath or a Storage is checked in a temp file
+	// first, so only a book that fits is written there.
+	MaxSize int64
+	// ShrinkToFit stores byte-identical resources once and then re-encodes
+	// JPEG images, and at last opaque PNGs, at falling quality until the
+	// output fits MaxSize.
+	ShrinkToFit bool
+	// StatePath is where MergeIfChanged records its last merge (default
+	// MergeStatePath(OutPath)).
+	StatePath string
+	Logger    *slog.Logger
+	Progress  ProgressFunc
 }
@@ -0,0 +1,512 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type TypoOptions struct {
+	// Language selects the conventions to apply (e.g. "en", "fr", "ja") and
+	// overrides the book's dc:language. Elements carrying their own lang or
+	// xml:lang attribute always use that instead.
+	Language string
+
+	NoQuotes   bool
+	NoDashes   bool
+	NoEllipsis bool
+	NoSpacing  bool
+
+	// SkipSelectors protects matching elements in addition to code, pre and
+	// similar elements, which are always left alone.
+	SkipSelectors []string
+	OutPath       string
+	DryRun        bool
+	Logger        *slog.Logger
+	Progress      ProgressFunc
+}
+
+type typoLang int
+
+const (
+	// typoGeneric only applies language-neutral fixes; quote styles and
+	// punctuation spacing vary too much to guess.
+	typoGeneric typoLang = iota
+	typoEnglish
+	typoFrench
+	typoJapanese
+)
+
+const (
+	nbsp       = '\u00a0'
+	narrowNBSP = '\u202f'
+)
+
+var (
+	typoSkipTags = map[string]bool{
+		"code": true, "pre": true, "kbd": true, "samp": true, "tt": true,
+		"var": true, "script": true, "style": true, "math": true, "svg": true,
+	}
+	// typoBlockTags reset quote context: a quote at the start of a block
+	// always opens.
+	typoBlockTags = map[string]bool{
+		"p": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true,
+		"h5": true, "h6": true, "li": true, "td": true, "th": true, "dt": true,
+		"dd": true, "blockquote": true, "section": true, "br": true,
+		"body": true, "title": true, "figcaption": true,
+	}
+	typoDashPattern     = regexp.MustCompile(`-{2,}`)
+	typoEllipsisPattern = regexp.MustCompile(`\.{3,}`)
+)
+
+// NormalizeTypography converts straight quotes to curly ones, -- and --- to
+// dashes, ... to an ellipsis, and tidies spaces around punctuation in every
+// XHTML document, following the conventions of each element's language.
+func NormalizeTypography(ctx context.Context, input string, opts TypoOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+	skip := parseSelectors(opts.SkipSelectors)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	pkg := vol.PackageDoc
+	lang := opts.Language
+	if lang == "" && len(pkg.Metadata.Languages) > 0 {
+		lang = strings.TrimSpace(pkg.Metadata.Languages[0].Value)
+	}
+	log.Debug("typography language", "lang", lang)
+
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		opts.Progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		src := filepath.Join(vol.PackageDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return stats, err
+		}
+		res, err := typesetXHTML(data, lang, skip, opts)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", item.Href, err)
+		}
+		stats.MatchCount += res.matches
+		if res.data == nil {
+			continue
+		}
+		log.Debug("normalized typography", "href", item.Href, "fixes", res.matches)
+		stats.FilesChanged++
+		stats.Changeset.modified(item.Href)
+		stats.Files = append(stats.Files, RewriteFileResult{Href: item.Href, Matches: res.matches, Changes: res.changes})
+		if !opts.DryRun {
+			if err := os.WriteFile(src, res.data, 0o644); err != nil {
+				return stats, err
+			}
+		}
+	}
+	opts.Progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func typesetXHTML(data []byte, lang string, skip []compiledSelector, opts TypoOptions) (xhtmlRewrite, error) {
+	var res xhtmlRewrite
+	var out bytes.Buffer
+	sp := newXMLSplicer(bytes.NewReader(data), &out)
+
+	var (
+		langStack []string
+		skipStack []bool
+		skipping  int
+		// prev is the last character written in the current block.
+		prev rune
+		tp   = &typographer{opts: opts}
+	)
+	currentLang := func() string {
+		if n := len(langStack); n > 0 {
+			return langStack[n-1]
+		}
+		return lang
+	}
+
+	for {
+		rt, err := sp.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return res, err
+		}
+		tok := rt.tok
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			l := attrValue(t.Attr, "lang")
+			if l == "" {
+				l = currentLang()
+			}
+			langStack = append(langStack, l)
+			s := typoSkipTags[name] || (len(skip) > 0 && matchSelectors(skip, t))
+			skipStack = append(skipStack, s)
+			if s {
+				skipping++
+			}
+			if typoBlockTags[name] {
+				prev, tp.open = 0, 0
+			}
+		case xml.EndElement:
+			if n := len(langStack); n > 0 {
+				langStack = langStack[:n-1]
+			}
+			if n := len(skipStack); n > 0 {
+				if skipStack[n-1] {
+					skipping--
+				}
+				skipStack = skipStack[:n-1]
+			}
+			if typoBlockTags[strings.ToLower(t.Name.Local)] {
+				prev, tp.open = 0, 0
+			}
+		case xml.CharData:
+			if skipping > 0 {
+				break
+			}
+			orig := string(t)
+			tp.lang = typoLanguage(currentLang())
+			text, n := tp.fix(orig, prev)
+			if n > 0 {
+				res.matches += n
+				res.changes = append(res.changes, TextChange{Before: orig, After: text})
+				tok = xml.CharData(text)
+			}
+			if text != "" {
+				rs := []rune(text)
+				prev = rs[len(rs)-1]
+			}
+		}
+		if err := sp.emit(rt, tok); err != nil {
+			return res, err
+		}
+	}
+	if len(res.changes) > 0 {
+		res.data = out.Bytes()
+	}
+	return res, nil
+}
+
+func typoLanguage(tag string) typoLang {
+	primary, _, _ := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+	switch strings.ToLower(strings.TrimSpace(primary)) {
+	case "en":
+		return typoEnglish
+	case "fr":
+		return typoFrench
+	case "ja":
+		return typoJapanese
+	default:
+		return typoGeneric
+	}
+}
+
+type typographer struct {
+	lang typoLang
+	opts TypoOptions
+	// open counts Japanese quotes opened in the current block. Without
+	// spaces between words the preceding character says nothing about
+	// whether a quote opens or closes.
+	open int
+}
+
+// fix applies every enabled pass to s. prev is the character preceding s in
+// the same block, or 0 at the start of a block.
+func (t *typographer) fix(s string, prev rune) (string, int) {
+	total := 0
+	var n int
+	if !t.opts.NoDashes {
+		s, n = t.dashes(s)
+		total += n
+	}
+	if !t.opts.NoEllipsis {
+		s, n = t.ellipses(s)
+		total += n
+	}
+	if !t.opts.NoQuotes && t.lang != typoGeneric {
+		s, n = t.quotes(s, prev)
+		total += n
+	}
+	if !t.opts.NoSpacing {
+		s, n = t.spacing(s, prev)
+		total += n
+	}
+	return s, total
+}
+
+// dashes turns -- into an en dash and --- into an em dash (a Japanese
+// double dash for ja). Longer runs are usually rules drawn in text and are
+// left alone.
+func (t typographer) dashes(s string) (string, int) {
+	if !strings.Contains(s, "--") {
+		return s, 0
+	}
+	n := 0
+	out := typoDashPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if len(m) > 3 {
+			return m
+		}
+		n++
+		switch {
+		case t.lang == typoJapanese:
+			return "――"
+		case len(m) == 2:
+			return "–"
+		default:
+			return "—"
+		}
+	})
+	return out, n
+}
+
+func (t typographer) ellipses(s string) (string, int) {
+	if !strings.Contains(s, "...") {
+		return s, 0
+	}
+	n := 0
+	out := typoEllipsisPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if len(m) != 3 {
+			return m
+		}
+		n++
+		if t.lang == typoJapanese {
+			return "……"
+		}
+		return "…"
+	})
+	return out, n
+}
+
+func (t *typographer) quotes(s string, prev rune) (string, int) {
+	if !strings.ContainsAny(s, `"'`) {
+		return s, 0
+	}
+	out := make([]rune, 0, len(s))
+	last := func() rune {
+		if len(out) > 0 {
+			return out[len(out)-1]
+		}
+		return prev
+	}
+	n := 0
+	skipSpaces := false
+	for _, r := range s {
+		if skipSpaces && r == ' ' {
+			continue
+		}
+		skipSpaces = false
+		switch r {
+		case '"':
+			n++
+			opening := opensQuote(last())
+			switch t.lang {
+			case typoFrench:
+				if opening {
+					out = append(out, '«', nbsp)
+					skipSpaces = true
+				} else {
+					out = trimTrailingSpaces(out)
+					out = append(out, nbsp, '»')
+				}
+			case typoJapanese:
+				if t.open > 0 {
+					out = append(out, '」')
+					t.open--
+				} else {
+					out = append(out, '「')
+					t.open++
+				}
+			default:
+				out = append(out, pick(opening, '“', '”'))
+			}
+		case '\'':
+			n++
+			out = append(out, pick(opensQuote(last()), '‘', '’'))
+		default:
+			out = append(out, r)
+		}
+	}
+	return string(out), n
+}
+
+// spacing collapses runs of spaces inside a line and applies the language's
+// rules for spaces next to punctuation. Leading and trailing runs are kept
+// since they may separate s from neighbouring inline elements.
+func (t typographer) spacing(s string, prev rune) (string, int) {
+	rs := []rune(s)
+	out := make([]rune, 0, len(rs))
+	last := func() rune {
+		if len(out) > 0 {
+			return out[len(out)-1]
+		}
+		return prev
+	}
+	n := 0
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		if r == ' ' {
+			j := i
+			for j < len(rs) && rs[j] == ' ' {
+				j++
+			}
+			before := last()
+			var after, afterNext rune
+			if j < len(rs) {
+				after = rs[j]
+			}
+			if j+1 < len(rs) {
+				afterNext = rs[j+1]
+			}
+			interior := before != 0 && !unicode.IsSpace(before) && after != 0 && !unicode.IsSpace(after)
+			if !interior {
+				out = append(out, rs[i:j]...)
+				i = j - 1
+				continue
+			}
+			if repl, ok := t.spaceBefore(before, after, afterNext); ok {
+				if repl != 0 {
+					out = append(out, repl)
+				}
+				n++
+				i = j - 1
+				continue
+			}
+			if j-i > 1 {
+				n++
+			}
+			out = append(out, ' ')
+			i = j - 1
+			continue
+		}
+
+		switch t.lang {
+		case typoFrench:
+			var next rune
+			if i+1 < len(rs) {
+				next = rs[i+1]
+			}
+			if sp := frenchSpaceFor(r, last(), next); sp != 0 {
+				out = append(out, sp)
+				n++
+			}
+		case typoJapanese:
+			if (r == '!' || r == '?') && isCJK(last()) {
+				out = append(out, pick(r == '!', '！', '？'))
+				n++
+				continue
+			}
+		}
+		out = append(out, r)
+		if t.lang == typoFrench && r == '«' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			out = append(out, nbsp)
+			n++
+		}
+	}
+	return string(out), n
+}
+
+// spaceBefore decides what replaces a run of spaces between before and
+// after. ok is false when the run should become a single plain space; a
+// zero replacement drops the run.
+func (t typographer) spaceBefore(before, after, afterNext rune) (rune, bool) {
+	endsWord := afterNext == 0 || !(unicode.IsLetter(afterNext) || unicode.IsDigit(afterNext))
+	switch t.lang {
+	case typoEnglish:
+		if strings.ContainsRune(",.;:!?", after) && endsWord {
+			return 0, true
+		}
+	case typoFrench:
+		switch {
+		case strings.ContainsRune(",.", after) && endsWord:
+			return 0, true
+		case strings.ContainsRune(";!?", after):
+			return narrowNBSP, true
+		case after == ':' || after == '»':
+			return nbsp, true
+		}
+	case typoJapanese:
+		if isCJKPunct(before) || isCJKPunct(after) {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// frenchSpaceFor returns the space French typography requires before r when
+// it directly follows last, or 0.
+func frenchSpaceFor(r, last, next rune) rune {
+	if last == 0 || unicode.IsSpace(last) {
+		return 0
+	}
+	wordEnd := unicode.IsLetter(last) || unicode.IsDigit(last) || last == '»' || last == ')'
+	switch r {
+	case ';', '!', '?':
+		if wordEnd {
+			return narrowNBSP
+		}
+	case ':':
+		// Leave times (10:30) and URLs (http://) alone.
+		if unicode.IsLetter(last) && next != '/' {
+			return nbsp
+		}
+	case '»':
+		return nbsp
+	}
+	return 0
+}
+
+func opensQuote(prev rune) bool {
+	return prev == 0 || unicode.IsSpace(prev) || strings.ContainsRune("([{<‘“«「『—–-/", prev)
+}
+
+func pick(cond bool, a, b rune) rune {
+	if cond {
+		return a
+	}
+	return b
+}
+
+func trimTrailingSpaces(rs []rune) []rune {
+	for len(rs) > 0 && (rs[len(rs)-1] == ' ' || rs[len(rs)-1] == nbsp) {
+		rs = rs[:len(rs)-1]
+	}
+	return rs
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) || r == 'ー'
+}
+
+func isCJKPunct(r rune) bool {
+	return strings.ContainsRune("、。，．！？「」『』（）【】…―・：；", r)
+}
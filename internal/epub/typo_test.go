@@ -0,0 +1,87 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTypographerFix(t *testing.T) {
+	cases := []struct {
+		lang typoLang
+		in   string
+		want string
+	}{
+		{typoEnglish, `"Don't go," she said -- and left...`, "“Don’t go,” she said – and left…"},
+		{typoEnglish, `He paused---"'Tis late."`, "He paused—“‘Tis late.”"},
+		{typoEnglish, "Wait  here , please .", "Wait here, please."},
+		{typoEnglish, "Use .NET now", "Use .NET now"},
+		{typoEnglish, "a ---- rule", "a ---- rule"},
+		{typoFrench, `Il dit "Bonjour" ?`, "Il dit « Bonjour » ?"},
+		{typoFrench, "Quoi? Voici: 10:30 http://x", "Quoi ? Voici : 10:30 http://x"},
+		{typoJapanese, `彼は"そう"と言った... 本当? はい`, "彼は「そう」と言った……本当？はい"},
+		{typoJapanese, "待って--", "待って――"},
+		{typoGeneric, `"Hallo"  --  Welt...`, `"Hallo" – Welt…`},
+	}
+	for _, tc := range cases {
+		tp := &typographer{lang: tc.lang}
+		got, n := tp.fix(tc.in, 0)
+		if got != tc.want {
+			t.Errorf("fix(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if (n == 0) != (tc.in == tc.want) {
+			t.Errorf("fix(%q) reported %d changes", tc.in, n)
+		}
+	}
+}
+
+func TestTypographerQuoteContextAcrossNodes(t *testing.T) {
+	tp := &typographer{lang: typoEnglish}
+	if got, _ := tp.fix(`" he said.`, 'd'); got != "” he said." {
+		t.Fatalf("quote after a word should close, got %q", got)
+	}
+	if got, _ := tp.fix(`"Hi`, ' '); got != "“Hi" {
+		t.Fatalf("quote after a space should open, got %q", got)
+	}
+}
+
+func TestNormalizeTypography(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="id">urn:test</dc:identifier><dc:language>en</dc:language></metadata>
+  <manifest><item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="a"/></spine>
+</package>`,
+		"OEBPS/a.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>"It's <em>mine</em>," he said.</p><p lang="fr">"Oui"</p><pre>x -- "y"</pre></body></html>`,
+	})
+
+	stats, err := NormalizeTypography(context.Background(), input, TypoOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if stats.FilesChanged != 1 || len(stats.Files[0].Changes) != 3 {
+		t.Fatalf("unexpected dry-run stats %+v", stats)
+	}
+
+	if _, err := NormalizeTypography(context.Background(), input, TypoOptions{}); err != nil {
+		t.Fatalf("NormalizeTypography: %v", err)
+	}
+	vol, err := loadVolume(context.Background(), 0, input)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	data, err := os.ReadFile(filepath.Join(vol.PackageDir, "a.xhtml"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	s := string(data)
+	for _, want := range []string{"“It’s <em", "mine</em>,” he", "« Oui »", `x -- "y"`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in %s", want, s)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package epub
 
-import "strings"
+import (
+	"log/slog"
+	"strings"
+)
 
 func hasProperty(props, target string) bool {
 	for _, token := range strings.Fields(props) {
@@ -23,3 +26,20 @@ func addProperty(props, target string) string {
 	}
 	return props + " " + target
 }
+
+func removeProperty(props, target string) string {
+	var kept []string
+	for _, token := range strings.Fields(props) {
+		if token != target {
+			kept = append(kept, token)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func loggerOrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return l
+}
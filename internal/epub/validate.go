@@ -0,0 +1,225 @@
+package epub
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+type ValidateOptions struct {
+	// Fix repairs what can be repaired mechanically and saves the book.
+	Fix bool
+	// StripScripts removes scripting, for books from untrusted sources:
+	// <script> elements, event handler attributes and javascript: links
+	// in content documents, JavaScript files, and the scripted property.
+	// Each removal is reported as a fixed issue, and the book is saved as
+	// with Fix.
+	StripScripts bool
+	OutPath      string
+	DryRun       bool
+	// TextDecoder converts Shift_JIS and GBK text (default
+	// ExternalTextDecoder).
+	TextDecoder TextDecoder
+	Logger      *slog.Logger
+	Progress    ProgressFunc
+}
+
+type ValidationIssue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	// Href is relative to the package document and empty for book-level
+	// issues.
+	Href    string `json:"href,omitempty"`
+	Message string `json:"message"`
+	// Fixed is set when Fix repaired the issue (or, in a dry run, would).
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+type ValidationReport struct {
+	// Errors and Warnings count the issues left unfixed.
+	Errors    int               `json:"errors"`
+	Warnings  int               `json:"warnings"`
+	Issues    []ValidationIssue `json:"issues"`
+	Changeset Changeset         `json:"changeset"`
+}
+
+// Valid reports whether no errors are left.
+func (r ValidationReport) Valid() bool { return r.Errors == 0 }
+
+func (r *ValidationReport) add(check, severity, href string, fixed bool, format string, args ...any) {
+	r.Issues = append(r.Issues, ValidationIssue{Check: check, Severity: severity, Href: href, Message: fmt.Sprintf(format, args...), Fixed: fixed})
+	if fixed {
+		return
+	}
+	switch severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	}
+}
+
+// Validate checks the structure of a book: the container, text encodings,
+// the manifest (missing and unlisted files, unsafe file names, media types
+// that do not match the content), well-formed content documents, scripts,
+// the spine and the navigation. With
+// opts.Fix what can be repaired is repaired and the book saved; a save
+// rewrites the archive, so container problems are always fixed.
+func Validate(ctx context.Context, input string, opts ValidateOptions) (ValidationReport, error) {
+	report := ValidationReport{Issues: []ValidationIssue{}}
+	if input == "" {
+		return report, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	r, size, closeBook, err := EnvFrom(ctx).openBook(ctx, input)
+	if err != nil {
+		return report, err
+	}
+	container, err := inspectMimetype(r, size)
+	if err != nil {
+		closeBook()
+		return report, err
+	}
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolumeReader(ctx, 0, input, r, size)
+	closeBook()
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	pkg := vol.PackageDoc
+
+	if len(container) > 0 {
+		href := "mimetype"
+		if rel, err := filepath.Rel(vol.PackageDir, filepath.Join(vol.RootDir, "mimetype")); err == nil {
+			href = filepath.ToSlash(rel)
+		}
+		for _, problem := range container {
+			report.add("mimetype", SeverityError, "", opts.Fix, "%s", problem)
+		}
+		if opts.Fix {
+			report.Changeset.modified(href)
+		}
+	}
+	for _, fix := range vol.Repairs {
+		report.add("manifest", SeverityWarning, "", opts.Fix, "%s", fix)
+	}
+	// The repairs are already in the extracted package; saving keeps them.
+	packageChanged := len(vol.Repairs) > 0 && opts.Fix
+
+	v := &validator{vol: vol, report: &report, fix: opts.Fix, packageChanged: packageChanged, decoder: opts.TextDecoder}
+	if err := v.checkEncodings(ctx, opts.Progress); err != nil {
+		return report, err
+	}
+	v.checkMissingFiles()
+	if err := v.checkFileNames(); err != nil {
+		return report, err
+	}
+	if err := v.checkUnlistedFiles(); err != nil {
+		return report, err
+	}
+	if err := v.checkMediaTypes(); err != nil {
+		return report, err
+	}
+	if err := v.checkMarkup(); err != nil {
+		return report, err
+	}
+	if err := v.checkNavProperty(); err != nil {
+		return report, err
+	}
+	if err := v.checkScripts(opts.StripScripts); err != nil {
+		return report, err
+	}
+
+	ids := map[string]bool{}
+	hasNCX := false
+	for _, item := range pkg.Manifest.Items {
+		ids[item.ID] = true
+		if item.MediaType == "application/x-dtbncx+xml" {
+			hasNCX = true
+		}
+	}
+	for _, ref := range pkg.Spine.Itemrefs {
+		if !ids[ref.IDRef] {
+			report.add("spine", SeverityError, "", false, "the spine refers to %q, which is not in the manifest", ref.IDRef)
+		}
+	}
+	if vol.NavHref == "" && !hasNCX && !v.navFound {
+		report.add("toc", SeverityError, "", false, "the book has neither a navigation document nor an NCX")
+	}
+	if v.packageChanged {
+		report.Changeset.modified(packageHref(vol))
+	}
+
+	if err := report.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun || !opts.Fix && !opts.StripScripts, opts.Progress, log); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// inspectMimetype describes how the archive's mimetype entry breaks the OCF
+// rules: it must be the first entry, stored uncompressed, without an extra
+// field and with its sizes in the local header, and hold exactly
+// application/epub+zip. Readers that sniff the first bytes of the file
+// rely on all of that.
+func inspectMimetype(book io.ReaderAt, size int64) ([]string, error) {
+	r, err := zip.NewReader(book, size)
+	if err != nil {
+		return nil, invalidEPUB(err)
+	}
+
+	index := -1
+	for i, f := range r.File {
+		if f.Name == "mimetype" {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return []string{"the archive has no mimetype entry"}, nil
+	}
+	f := r.File[index]
+	var problems []string
+	if index > 0 {
+		problems = append(problems, fmt.Sprintf("mimetype is entry %d of the archive; it must be the first", index+1))
+	}
+	if f.Method != zip.Store {
+		problems = append(problems, "mimetype is compressed; it must be stored")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, 1024))
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	if string(data) != epubMimeType {
+		problems = append(problems, fmt.Sprintf("mimetype holds %q instead of %q", data, epubMimeType))
+	}
+	if index > 0 {
+		return problems, nil
+	}
+
+	// Only the local header says whether the sizes follow the data and
+	// what extra field the entry has.
+	var header [30]byte
+	if _, err := book.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(header[6:])&0x8 != 0 {
+		problems = append(problems, "mimetype's sizes follow its data instead of its header")
+	}
+	if binary.LittleEndian.Uint16(header[28:]) != 0 {
+		problems = append(problems, "mimetype has an extra field in its header")
+	}
+	return problems, nil
+}
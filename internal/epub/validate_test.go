@@ -0,0 +1,205 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteZipMimetype(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"mimetype":          "application/epub+zip\n",
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"/>`,
+	})
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data[30:58]); got != "mimetype"+epubMimeType {
+		t.Fatalf("bytes 30-58 = %q", got)
+	}
+	problems, err := inspectMimetype(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("problems in writeZip output: %q", problems)
+	}
+}
+
+func TestValidateFixesMimetype(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "bad.epub")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range [][2]string{
+		{"META-INF/container.xml", `<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"mimetype", "application/epub+zip\n"},
+		{"OEBPS/content.opf", `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>V</dc:title></metadata><manifest><item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/><item id="ch" href="ch.xhtml" media-type="application/xhtml+xml"/><item id="ch" href="gone.xhtml" media-type="application/xhtml+xml"/></manifest><spine><itemref idref="ch"/><itemref idref="missing"/></spine></package>`},
+		{"OEBPS/nav.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><body><nav xmlns:epub="http://www.idpf.org/2007/ops" epub:type="toc"><ol><li><a href="ch.xhtml">C</a></li></ol></nav></body></html>`},
+		{"OEBPS/ch.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>x</p></body></html>`},
+	} {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	report, err := Validate(context.Background(), input, ValidateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, issue := range report.Issues {
+		counts[issue.Check+" "+issue.Severity]++
+	}
+	// mimetype: not first, compressed, wrong content. manifest: the
+	// renamed duplicate id, and gone.xhtml missing. spine: "missing".
+	want := map[string]int{"mimetype error": 3, "manifest warning": 1, "manifest error": 1, "spine error": 1}
+	for k, n := range want {
+		if counts[k] != n {
+			t.Errorf("%s: %d issues, want %d (%+v)", k, counts[k], n, report.Issues)
+		}
+	}
+	if report.Errors != 5 || report.Changeset.Outcome != OutcomeDryRun {
+		t.Fatalf("errors = %d, outcome = %s", report.Errors, report.Changeset.Outcome)
+	}
+
+	out := filepath.Join(t.TempDir(), "fixed.epub")
+	report, err = Validate(context.Background(), input, ValidateOptions{Fix: true, OutPath: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 1 || report.Warnings != 0 || !report.Changeset.Written() {
+		t.Fatalf("after fix: errors = %d, warnings = %d, outcome = %s", report.Errors, report.Warnings, report.Changeset.Outcome)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := inspectMimetype(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("fixed book still has problems: %s", strings.Join(problems, "; "))
+	}
+}
+
+func TestValidateFixesStructure(t *testing.T) {
+	latin1 := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>t</title></head><body><p>Caf\xe9 \x93quoted\x94</p><p><a href=\"My%20Chapter.xhtml#x\">next</a></p></body></html>"
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:validate</dc:identifier>
+    <dc:title>Validate</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="toc" href="toc.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="My%20Chapter.xhtml" media-type="application/xhtml+xml"/>
+    <item id="pic" href="pic.jpg" media-type="image/jpeg"/>
+    <item id="gone" href="gone.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+    <itemref idref="gone"/>
+  </spine>
+</package>
+`,
+		"OEBPS/toc.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc"><ol><li><a href="ch1.xhtml">One</a></li><li><a href="My Chapter.xhtml">Two</a></li></ol></nav>
+</body></html>`,
+		"OEBPS/ch1.xhtml":         latin1,
+		"OEBPS/My Chapter.xhtml":  `<html xmlns="http://www.w3.org/1999/xhtml"><body><p id="x">Two & more<br></p><img src="pic.jpg" alt=""></body></html>`,
+		"OEBPS/pic.jpg":           "\x89PNG\r\n\x1a\n",
+		"OEBPS/Styles/extra.css":  "p { margin: 0 }",
+		"OEBPS/notes/readme.data": "?",
+	})
+
+	out := filepath.Join(t.TempDir(), "fixed.epub")
+	report, err := Validate(context.Background(), input, ValidateOptions{Fix: true, OutPath: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := map[string]int{}
+	for _, issue := range report.Issues {
+		if issue.Fixed {
+			fixed[issue.Check]++
+		}
+	}
+	want := map[string]int{"encoding": 1, "manifest": 2, "file-name": 1, "media-type": 1, "markup": 1, "nav": 1}
+	for check, n := range want {
+		if fixed[check] != n {
+			t.Errorf("%s: %d fixed, want %d (%+v)", check, fixed[check], n, report.Issues)
+		}
+	}
+	// notes/readme.data has no known media type.
+	if report.Errors != 0 || report.Warnings != 1 {
+		t.Fatalf("errors = %d, warnings = %d: %+v", report.Errors, report.Warnings, report.Issues)
+	}
+
+	report, err = Validate(context.Background(), out, ValidateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 0 || report.Warnings != 1 {
+		t.Fatalf("fixed book: %+v", report.Issues)
+	}
+
+	vol, err := loadVolume(context.Background(), 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+	read := func(href string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(vol.PackageDir, href))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if ch1 := read("ch1.xhtml"); !strings.Contains(ch1, `encoding="UTF-8"`) || !strings.Contains(ch1, "Café “quoted”") || !strings.Contains(ch1, `href="My_Chapter.xhtml#x"`) {
+		t.Errorf("ch1.xhtml not converted:\n%s", ch1)
+	}
+	if ch2 := read("My_Chapter.xhtml"); !strings.Contains(ch2, `<p id="x">Two &amp; more<br/></p><img src="pic.jpg" alt=""/>`) {
+		t.Errorf("My_Chapter.xhtml not repaired:\n%s", ch2)
+	}
+	if toc := read("toc.xhtml"); !strings.Contains(toc, `href="My_Chapter.xhtml"`) {
+		t.Errorf("toc.xhtml links not updated:\n%s", toc)
+	}
+	types := map[string]string{}
+	for _, item := range vol.PackageDoc.Manifest.Items {
+		types[item.Href] = item.MediaType + " " + item.Properties
+	}
+	for href, typ := range map[string]string{
+		"toc.xhtml":        "application/xhtml+xml nav",
+		"My_Chapter.xhtml": "application/xhtml+xml ",
+		"pic.jpg":          "image/png ",
+		"Styles/extra.css": "text/css ",
+	} {
+		if types[href] != typ {
+			t.Errorf("%s: %q, want %q (%v)", href, types[href], typ, types)
+		}
+	}
+	if _, ok := types["gone.xhtml"]; ok || len(vol.PackageDoc.Spine.Itemrefs) != 2 {
+		t.Errorf("missing item not dropped: %v, %d itemrefs", types, len(vol.PackageDoc.Spine.Itemrefs))
+	}
+}
@@ -0,0 +1,492 @@
+package epub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// validator runs the Validate checks that ValidateOptions.Fix can repair.
+// Each check reports its issues as fixed when fix is set and makes the
+// repair in the extracted book.
+type validator struct {
+	vol            *Volume
+	report         *ValidationReport
+	fix            bool
+	packageChanged bool
+	// navFound is set when checkNavProperty found an unmarked navigation
+	// document.
+	navFound bool
+	decoder  TextDecoder
+}
+
+// itemPath returns the file an href names, relative to the package. Hrefs
+// are URLs, so "My%20Chapter.xhtml" names "My Chapter.xhtml"; an href that
+// is not escaped is taken as it is.
+func (v *validator) itemPath(href string) string {
+	if _, err := os.Stat(filepath.Join(v.vol.PackageDir, filepath.FromSlash(href))); err == nil {
+		return href
+	}
+	if name, err := url.PathUnescape(href); err == nil {
+		return normalizeEPUBPath(name)
+	}
+	return href
+}
+
+// textMediaTypes are the manifest types checkEncodings reads as text.
+var textMediaTypes = []string{"application/xhtml+xml", "text/html", "text/css", "application/x-dtbncx+xml", "image/svg+xml"}
+
+var (
+	xmlDeclEncodingRE = regexp.MustCompile(`(?i)(<\?xml[^>]*?\bencoding\s*=\s*["'])([^"']+)(["'])`)
+	metaCharsetRE     = regexp.MustCompile(`(?i)(<meta\b[^>]*?\bcharset\s*=\s*["']?)([-\w:.]+)`)
+	cssCharsetRE      = regexp.MustCompile(`(?i)^(\s*@charset\s*["'])([^"']+)(["'])`)
+)
+
+// checkEncodings finds text files that are not UTF-8 and converts them:
+// UTF-16 and UTF-8 with a byte order mark, Windows-1252 (which also
+// covers the ISO-8859-1 and US-ASCII labels as browsers read them), and
+// Shift_JIS and GBK through the TextDecoder. Undeclared bytes that are
+// not valid UTF-8 are sniffed. The encoding declarations are updated to
+// match, and text not in Unicode Normalization Form C is normalized.
+func (v *validator) checkEncodings(ctx context.Context, progress ProgressFunc) error {
+	pkg := v.vol.PackageDoc
+	lang := ""
+	if len(pkg.Metadata.Languages) > 0 {
+		lang = strings.TrimSpace(pkg.Metadata.Languages[0].Value)
+	}
+	items := pkg.Manifest.Items
+	for i, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(StageRewrite, i, len(items), item.Href)
+		if !containsString(textMediaTypes, item.MediaType) {
+			continue
+		}
+		p := filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href)))
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		out, from, nfc, err := normalizeTextFile(ctx, data, lang, v.decoder)
+		switch {
+		case err != nil:
+			v.report.add("encoding", SeverityError, item.Href, false, "the file is in %s; only UTF-8 is allowed, and validate cannot convert it: %v", from, err)
+			continue
+		case out == nil:
+			continue
+		}
+		if from != "" {
+			v.report.add("encoding", SeverityError, item.Href, v.fix, "the file is in %s; only UTF-8 is allowed", from)
+		}
+		if nfc {
+			v.report.add("unicode", SeverityWarning, item.Href, v.fix, "the text is not in Unicode Normalization Form C")
+		}
+		if !v.fix {
+			continue
+		}
+		if err := os.WriteFile(p, out, 0o644); err != nil {
+			return err
+		}
+		v.report.Changeset.modified(item.Href)
+	}
+	progress.report(StageRewrite, len(items), len(items), "")
+	return nil
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// windows1252 maps the bytes 0x80–0x9F, where Windows-1252 differs from
+// ISO-8859-1. The five unassigned bytes keep their C1 control code point.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		switch {
+		case c >= 0x80 && c < 0xA0:
+			b.WriteRune(windows1252[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// declareUTF8 points the XML declaration, meta charset and @charset rule
+// of text at UTF-8.
+func declareUTF8(text string) string {
+	text = xmlDeclEncodingRE.ReplaceAllString(text, "${1}UTF-8${3}")
+	text = metaCharsetRE.ReplaceAllString(text, "${1}UTF-8")
+	return cssCharsetRE.ReplaceAllString(text, "${1}UTF-8${3}")
+}
+
+// checkMissingFiles drops manifest items whose file is not in the book,
+// along with their spine entries and fallbacks to them.
+func (v *validator) checkMissingFiles() {
+	pkg := v.vol.PackageDoc
+	missing := map[string]bool{}
+	kept := pkg.Manifest.Items[:0]
+	for _, item := range pkg.Manifest.Items {
+		if _, err := os.Stat(filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href)))); os.IsNotExist(err) {
+			v.report.add("manifest", SeverityError, item.Href, v.fix, "the manifest lists %s but the book does not contain it", item.Href)
+			if v.fix {
+				missing[item.ID] = true
+				continue
+			}
+		}
+		kept = append(kept, item)
+	}
+	pkg.Manifest.Items = kept
+	if len(missing) == 0 {
+		return
+	}
+	v.packageChanged = true
+	refs := pkg.Spine.Itemrefs[:0]
+	for _, ref := range pkg.Spine.Itemrefs {
+		if !missing[ref.IDRef] {
+			refs = append(refs, ref)
+		}
+	}
+	pkg.Spine.Itemrefs = refs
+	for i := range pkg.Manifest.Items {
+		if missing[pkg.Manifest.Items[i].Fallback] {
+			pkg.Manifest.Items[i].Fallback = ""
+		}
+	}
+}
+
+// safeFileName replaces the characters of name that are not letters,
+// digits, '.', '_' or '-' with '_'. Spaces, '%', '#', '?' and the like
+// break links in readers that do not escape hrefs properly.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// checkFileNames renames files whose hrefs have unsafe characters, or are
+// percent-encoded, and rewrites the references to them.
+func (v *validator) checkFileNames() error {
+	pkg := v.vol.PackageDoc
+	taken := map[string]bool{}
+	for _, item := range pkg.Manifest.Items {
+		taken[strings.ToLower(v.itemPath(item.Href))] = true
+	}
+	renamed := map[string]string{}
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		segments := strings.Split(item.Href, "/")
+		unsafe := false
+		for _, seg := range segments {
+			if seg != ".." && safeFileName(seg) != seg {
+				unsafe = true
+			}
+		}
+		if !unsafe {
+			continue
+		}
+		old := v.itemPath(item.Href)
+		segments = strings.Split(old, "/")
+		for j, seg := range segments {
+			if seg != ".." {
+				segments[j] = safeFileName(seg)
+			}
+		}
+		newHref := strings.Join(segments, "/")
+		if newHref != old && taken[strings.ToLower(newHref)] {
+			newHref = uniqueName(newHref, func(s string) bool { return taken[strings.ToLower(s)] })
+		}
+		v.report.add("file-name", SeverityWarning, item.Href, v.fix, "%q has characters readers mishandle in links; rename it %q", item.Href, newHref)
+		if !v.fix {
+			continue
+		}
+		if newHref != old {
+			dst := filepath.Join(v.vol.PackageDir, filepath.FromSlash(newHref))
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(v.vol.PackageDir, filepath.FromSlash(old)), dst); err != nil {
+				return err
+			}
+			taken[strings.ToLower(newHref)] = true
+			v.report.Changeset.removed(old)
+			v.report.Changeset.added(newHref)
+		}
+		renamed[old] = newHref
+		if item.Href == v.vol.NavHref {
+			v.vol.NavHref = newHref
+		}
+		item.Href = newHref
+		v.packageChanged = true
+	}
+	if len(renamed) == 0 {
+		return nil
+	}
+	changed, err := rewriteReferences(v.vol.PackageDir, pkg, func(target string) (string, bool) {
+		if newHref, ok := renamed[target]; ok {
+			return newHref, true
+		}
+		if name, err := url.PathUnescape(target); err == nil {
+			newHref, ok := renamed[normalizeEPUBPath(name)]
+			return newHref, ok
+		}
+		return "", false
+	})
+	if err != nil {
+		return err
+	}
+	for _, href := range changed {
+		v.report.Changeset.modified(href)
+	}
+	return nil
+}
+
+// checkUnlistedFiles adds files of the package directory that the
+// manifest does not list, when their media type is known.
+func (v *validator) checkUnlistedFiles() error {
+	pkg := v.vol.PackageDoc
+	listed := map[string]bool{packageHref(v.vol): true}
+	ids := map[string]bool{}
+	for _, item := range pkg.Manifest.Items {
+		listed[v.itemPath(item.Href)] = true
+		ids[item.ID] = true
+	}
+	var unlisted []string
+	err := filepath.Walk(v.vol.PackageDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(v.vol.PackageDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "mimetype" || strings.HasPrefix(rel, "META-INF/") || listed[rel] {
+			return nil
+		}
+		unlisted = append(unlisted, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(unlisted)
+	for _, href := range unlisted {
+		data, err := os.ReadFile(filepath.Join(v.vol.PackageDir, filepath.FromSlash(href)))
+		if err != nil {
+			return err
+		}
+		mediaType := sniffMediaType(data)
+		if mediaType == "" {
+			mediaType = extensionMediaTypes[strings.ToLower(path.Ext(href))]
+		}
+		if mediaType == "" {
+			v.report.add("manifest", SeverityWarning, href, false, "%s is not in the manifest, and its media type is unknown", href)
+			continue
+		}
+		v.report.add("manifest", SeverityWarning, href, v.fix, "%s is not in the manifest; add it as %s", href, mediaType)
+		if !v.fix {
+			continue
+		}
+		id := manifestID(path.Base(href))
+		for n := 2; ids[id]; n++ {
+			id = fmt.Sprintf("%s-%d", manifestID(path.Base(href)), n)
+		}
+		ids[id] = true
+		pkg.Manifest.Items = append(pkg.Manifest.Items, ManifestItem{ID: id, Href: href, MediaType: mediaType})
+		v.packageChanged = true
+	}
+	return nil
+}
+
+// manifestID turns a file name into an XML id.
+func manifestID(name string) string {
+	id := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-') {
+			return r
+		}
+		return '_'
+	}, name)
+	if id == "" || !unicode.IsLetter(rune(id[0])) && id[0] != '_' {
+		id = "item-" + id
+	}
+	return id
+}
+
+var extensionMediaTypes = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".html":  "application/xhtml+xml",
+	".htm":   "application/xhtml+xml",
+	".css":   "text/css",
+	".ncx":   "application/x-dtbncx+xml",
+	".js":    "application/javascript",
+	".smil":  "application/smil+xml",
+	".mp3":   "audio/mpeg",
+	".m4a":   "audio/mp4",
+	".mp4":   "video/mp4",
+}
+
+// sniffMediaType identifies images and fonts by their first bytes and
+// returns "" for anything else.
+func sniffMediaType(data []byte) string {
+	head := data[:min(len(data), 512)]
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "image/gif"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "image/webp"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && (string(head[8:12]) == "avif" || string(head[8:12]) == "avis"):
+		return "image/avif"
+	case bytes.HasPrefix(head, []byte("OTTO")):
+		return "font/otf"
+	case bytes.HasPrefix(head, []byte{0, 1, 0, 0}), bytes.HasPrefix(head, []byte("true")):
+		return "font/ttf"
+	case bytes.HasPrefix(head, []byte("wOFF")):
+		return "font/woff"
+	case bytes.HasPrefix(head, []byte("wOF2")):
+		return "font/woff2"
+	case bytes.Contains(head, []byte("<svg")) && !bytes.Contains(head, []byte("<html")):
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// checkMediaTypes compares the declared media type of images and fonts
+// with their content. Font types have several names in use, so any font
+// type is accepted for a font.
+func (v *validator) checkMediaTypes() error {
+	pkg := v.vol.PackageDoc
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		data, err := os.ReadFile(filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href))))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sniffed := sniffMediaType(data)
+		switch {
+		case sniffed == "" || sniffed == item.MediaType:
+			continue
+		case strings.HasPrefix(sniffed, "font/") && isFontItem(ManifestItem{MediaType: item.MediaType}):
+			continue
+		case sniffed == "image/svg+xml" && !strings.HasPrefix(item.MediaType, "image/"):
+			// An XHTML page may embed SVG.
+			continue
+		}
+		v.report.add("media-type", SeverityError, item.Href, v.fix, "declared as %s but the content is %s", item.MediaType, sniffed)
+		if v.fix {
+			item.MediaType = sniffed
+			v.packageChanged = true
+		}
+	}
+	return nil
+}
+
+// checkMarkup finds XHTML documents that are not well-formed XML, which
+// reading systems refuse to open, and repairs them by parsing them as
+// HTML.
+func (v *validator) checkMarkup() error {
+	for _, item := range v.vol.PackageDoc.Manifest.Items {
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		p := filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href)))
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		problem := checkWellFormed(data)
+		if problem == nil {
+			continue
+		}
+		fixed := repairHTML(data)
+		fixable := checkWellFormed(fixed) == nil
+		v.report.add("markup", SeverityError, item.Href, v.fix && fixable, "not well-formed XHTML: %v", problem)
+		if !v.fix || !fixable {
+			continue
+		}
+		if err := os.WriteFile(p, fixed, 0o644); err != nil {
+			return err
+		}
+		v.report.Changeset.modified(item.Href)
+	}
+	return nil
+}
+
+var tocNavRE = regexp.MustCompile(`(?is)<nav\b[^>]*\bepub:type\s*=\s*["'][^"']*\btoc\b`)
+
+// checkNavProperty looks for the navigation document of an EPUB 3 book
+// whose manifest does not mark it with the nav property.
+func (v *validator) checkNavProperty() error {
+	pkg := v.vol.PackageDoc
+	if v.vol.NavHref != "" || !strings.HasPrefix(strings.TrimSpace(pkg.Version), "3") {
+		return nil
+	}
+	for i := range pkg.Manifest.Items {
+		item := &pkg.Manifest.Items[i]
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(v.vol.PackageDir, filepath.FromSlash(v.itemPath(item.Href))))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !tocNavRE.Match(data) {
+			continue
+		}
+		v.report.add("nav", SeverityError, item.Href, v.fix, "%s holds the table of contents but lacks the nav property", item.Href)
+		v.navFound = true
+		if v.fix {
+			item.Properties = addProperty(item.Properties, "nav")
+			v.vol.NavHref = item.Href
+			v.packageChanged = true
+		}
+		return nil
+	}
+	return nil
+}
@@ -6,11 +6,16 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// Volume is a book extracted to a temp directory on the local disk, which
+// commands read and edit in place. It is not backed by an fs.FS; only the
+// archive it came from may be in a Storage.
 type Volume struct {
 	Index       int
 	SourcePath  string
@@ -23,15 +28,32 @@ type Volume struct {
 	NavItems    []NavItem
 	DisplayName string
 	Prefix      string
-	FirstHref   string
-	CoverID     string
+	// Paths maps the files of the volume, relative to its package
+	// document, to their paths in a merged book.
+	Paths     map[string]string
+	FirstHref string
+	CoverID   string
+	// Repairs describes fixes made to the package while loading.
+	Repairs []string
 }
 
+// loadVolume extracts the book at source, or the one on the Env's Stdin
+// when source is StreamPath, into a temp directory.
 func loadVolume(ctx context.Context, idx int, source string) (*Volume, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	r, size, closeBook, err := EnvFrom(ctx).openBook(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBook()
+	return loadVolumeReader(ctx, idx, source, r, size)
+}
 
+// loadVolumeReader is loadVolume for a book of size bytes read from r;
+// source names it in errors and becomes its SourcePath.
+func loadVolumeReader(ctx context.Context, idx int, source string, r io.ReaderAt, size int64) (*Volume, error) {
 	tmpDir, err := os.MkdirTemp("", "novfmt-volume-*")
 	if err != nil {
 		return nil, fmt.Errorf("mktemp: %w", err)
@@ -46,8 +68,17 @@ func loadVolume(ctx context.Context, idx int, source string) (*Volume, error) {
 		return cleanup(err)
 	}
 
-	if err := unzip(source, tmpDir); err != nil {
-		return cleanup(fmt.Errorf("extract %s: %w", source, err))
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return cleanup(fmt.Errorf("extract %s: %w", source, invalidEPUB(err)))
+	}
+	extracted, err := unzip(ctx, zr, tmpDir)
+	if err != nil {
+		return cleanup(fmt.Errorf("extract %s: %w", source, invalidEPUB(err)))
+	}
+
+	if err := checkDRM(tmpDir); err != nil {
+		return cleanup(fmt.Errorf("%s: %w", source, err))
 	}
 
 	containerPath := filepath.Join(tmpDir, "META-INF", "container.xml")
@@ -57,32 +88,60 @@ func loadVolume(ctx context.Context, idx int, source string) (*Volume, error) {
 
 	data, err := os.ReadFile(containerPath)
 	if err != nil {
-		return cleanup(fmt.Errorf("read container.xml: %w", err))
+		return cleanup(invalidEPUBError{fmt.Errorf("read container.xml: %w", err)})
 	}
 
 	var root containerRoot
 	if err := xml.Unmarshal(data, &root); err != nil {
-		return cleanup(fmt.Errorf("parse container.xml: %w", err))
+		return cleanup(invalidEPUBError{fmt.Errorf("parse container.xml: %w", err)})
 	}
 
 	if len(root.Rootfiles) == 0 {
-		return cleanup(fmt.Errorf("container missing rootfile"))
+		return cleanup(invalidEPUBError{fmt.Errorf("container missing rootfile")})
 	}
 
 	pkgRel := filepath.Clean(root.Rootfiles[0].FullPath)
 	pkgPath := filepath.Join(tmpDir, filepath.FromSlash(pkgRel))
+	if !insideDir(tmpDir, pkgPath) || pkgPath == tmpDir {
+		return cleanup(invalidEPUBError{fmt.Errorf("container rootfile %q points outside the book", root.Rootfiles[0].FullPath)})
+	}
 	if err := ctx.Err(); err != nil {
 		return cleanup(err)
 	}
 
 	pkgBytes, err := os.ReadFile(pkgPath)
 	if err != nil {
-		return cleanup(fmt.Errorf("read package %s: %w", pkgRel, err))
+		return cleanup(invalidEPUBError{fmt.Errorf("read package %s: %w", pkgRel, err)})
 	}
 
 	var pkg PackageDocument
 	if err := xml.Unmarshal(pkgBytes, &pkg); err != nil {
-		return cleanup(fmt.Errorf("parse package: %w", err))
+		return cleanup(invalidEPUBError{fmt.Errorf("parse package: %w", err)})
+	}
+
+	// Every later read and write goes through the hrefs, the nav's too.
+	if err := checkManifestHrefs(tmpDir, filepath.Dir(pkgPath), pkg.Manifest.Items); err != nil {
+		return cleanup(invalidEPUBError{err})
+	}
+
+	// Renamed entries, relative to the package document.
+	pkgDirRel := path.Dir(filepath.ToSlash(pkgRel))
+	renamed := map[string]string{}
+	for from, to := range extracted {
+		if pkgDirRel == "." {
+			renamed[from] = to
+		} else if rel, ok := strings.CutPrefix(from, pkgDirRel+"/"); ok {
+			renamed[rel] = strings.TrimPrefix(to, pkgDirRel+"/")
+		}
+	}
+	repairs, err := repairManifest(&pkg, filepath.Dir(pkgPath), renamed)
+	if err != nil {
+		return cleanup(fmt.Errorf("repair package: %w", err))
+	}
+	if len(repairs) > 0 {
+		if err := writePackage(&pkg, pkgPath); err != nil {
+			return cleanup(err)
+		}
 	}
 
 	var navHref string
@@ -136,52 +195,109 @@ func loadVolume(ctx context.Context, idx int, source string) (*Volume, error) {
 		NavItems:    navItems,
 		DisplayName: display,
 		CoverID:     coverID,
+		Repairs:     repairs,
 	}, nil
 }
 
-func unzip(src, dst string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
+// saveVolume zips the extracted tree of vol to outPath. The archive is built
+// in a temp file next to outPath and renamed into place, so an in-place edit
+// never leaves a truncated book behind. An embedded chapter hash sidecar and
+// checksum manifest are refreshed first.
+func saveVolume(ctx context.Context, vol *Volume, outPath string, progress ProgressFunc) error {
+	if err := refreshChapterHashes(vol); err != nil {
+		return err
+	}
+	if err := refreshChecksums(vol.RootDir); err != nil {
 		return err
 	}
-	defer r.Close()
+	return writeZipProgress(ctx, vol.RootDir, outPath, progress)
+}
+
+// packageRel returns the package document path relative to the container root.
+func (v *Volume) packageRel() string {
+	rel, err := filepath.Rel(v.RootDir, v.PackagePath)
+	if err != nil {
+		return filepath.Base(v.PackagePath)
+	}
+	return rel
+}
+
+// unzip extracts r into dst. Entries whose names differ from an earlier
+// entry only by case would overwrite it on case-insensitive filesystems, so
+// they are extracted under a suffixed name on every platform; the returned
+// map holds those renames (container-relative, original to new).
+func unzip(ctx context.Context, r *zip.Reader, dst string) (map[string]string, error) {
+	limits := EnvFrom(ctx).extractLimits()
+	if err := checkArchive(r.File, limits); err != nil {
+		return nil, err
+	}
+	budget := limits.MaxSize
+	if budget <= 0 {
+		budget = math.MaxInt64
+	}
+
+	taken := make(map[string]bool, len(r.File))
+	for _, f := range r.File {
+		taken[strings.ToLower(path.Clean(f.Name))] = true
+	}
+	seen := make(map[string]bool, len(r.File))
+	renames := map[string]string{}
 
 	for _, f := range r.File {
-		target := filepath.Join(dst, filepath.FromSlash(f.Name))
-		if !strings.HasPrefix(target, dst) {
-			return fmt.Errorf("zip entry %s escapes destination", f.Name)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := path.Clean(f.Name)
+		if !f.FileInfo().IsDir() {
+			if fold := strings.ToLower(name); seen[fold] {
+				newName := uniqueName(name, func(s string) bool { return taken[strings.ToLower(s)] })
+				taken[strings.ToLower(newName)] = true
+				renames[name] = newName
+				name = newName
+			} else {
+				seen[fold] = true
+			}
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if !insideDir(dst, target) {
+			return nil, fmt.Errorf("zip entry %s escapes destination", f.Name)
 		}
 
 		if f.FileInfo().IsDir() {
 			if err := os.MkdirAll(target, 0o755); err != nil {
-				return err
+				return nil, err
 			}
 			continue
 		}
 
 		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-			return err
+			return nil, err
 		}
 
 		rc, err := f.Open()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
+		// O_EXCL keeps extraction from writing through a link that was
+		// already there; entries are never links themselves.
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
 		if err != nil {
 			rc.Close()
-			return err
+			return nil, err
 		}
 
-		if _, err := io.Copy(out, rc); err != nil {
+		w := &limitedWriter{w: out, budget: budget}
+		if _, err := io.Copy(w, rc); err != nil {
 			rc.Close()
 			out.Close()
-			return err
+			return nil, err
 		}
+		budget = w.budget
 		rc.Close()
 		out.Close()
 	}
 
-	return nil
+	return renames, nil
 }
@@ -0,0 +1,190 @@
+package epub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VolumeManifestFile is the container-relative path of the record merge
+// keeps of where each volume went.
+const VolumeManifestFile = "META-INF/novfmt-manifest.json"
+
+// volumeManifestVersion is the format version of VolumeManifestFile.
+const volumeManifestVersion = 1
+
+// ErrNoVolumeManifest is returned when a book has no volume manifest.
+var ErrNoVolumeManifest = errors.New("book has no volume manifest")
+
+// VolumeManifest records which volumes a merged book was made from and
+// which of its files and spine items came from each.
+type VolumeManifest struct {
+	Version int                `json:"version"`
+	Volumes []VolumeProvenance `json:"volumes"`
+}
+
+// VolumeProvenance is one volume of a merged book.
+type VolumeProvenance struct {
+	// Number counts volumes from 1 in reading order.
+	Number     int    `json:"number"`
+	Title      string `json:"title"`
+	Identifier string `json:"identifier,omitempty"`
+	// Source is the file name of the EPUB the volume came from and
+	// SourceSHA256 its checksum.
+	Source       string    `json:"source"`
+	SourceSHA256 string    `json:"source_sha256"`
+	Added        time.Time `json:"added"`
+	// SpineStart and SpineEnd delimit the volume's spine items, counted
+	// from 0 with SpineEnd excluded, as they were when the record was
+	// written; Spine lists their hrefs for finding them after later edits.
+	SpineStart int      `json:"spine_start"`
+	SpineEnd   int      `json:"spine_end"`
+	Spine      []string `json:"spine"`
+	// Files lists every file of the volume, relative to the package
+	// document.
+	Files []string `json:"files"`
+}
+
+// ReadVolumeManifest returns the volume manifest of a merged book.
+func ReadVolumeManifest(ctx context.Context, input string) (*VolumeManifest, error) {
+	if input == "" {
+		return nil, fmt.Errorf("input EPUB path is required")
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	return readVolumeManifest(vol.RootDir)
+}
+
+func readVolumeManifest(rootDir string) (*VolumeManifest, error) {
+	data, err := os.ReadFile(filepath.Join(rootDir, filepath.FromSlash(VolumeManifestFile)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoVolumeManifest
+		}
+		return nil, err
+	}
+	var m VolumeManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", VolumeManifestFile, err)
+	}
+	if m.Version > volumeManifestVersion {
+		return nil, fmt.Errorf("%s has version %d; this novfmt reads up to %d", VolumeManifestFile, m.Version, volumeManifestVersion)
+	}
+	return &m, nil
+}
+
+func writeVolumeManifest(rootDir string, m *VolumeManifest) error {
+	m.Version = volumeManifestVersion
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(rootDir, filepath.FromSlash(VolumeManifestFile))
+	if err := ensureParentDir(dest); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, append(data, '\n'), 0o644)
+}
+
+// mergedVolumeManifest records vols as merged into pkg, where each one's
+// manifest items have ids starting with v<number>_ (see mergeEPUBs). sums
+// holds the checksum of each volume's source.
+func mergedVolumeManifest(pkg *PackageDocument, vols []*Volume, sums []string, added time.Time) *VolumeManifest {
+	m := &VolumeManifest{}
+	for i, vol := range vols {
+		prefix := fmt.Sprintf("v%04d_", vol.Index+1)
+		m.Volumes = append(m.Volumes, provenanceOf(pkg, vol, sums[i], added, func(id string) bool { return strings.HasPrefix(id, prefix) }))
+	}
+	return m
+}
+
+// hashSources returns the checksum of every volume's source file.
+func hashSources(ctx context.Context, vols []*Volume) ([]string, error) {
+	env := EnvFrom(ctx)
+	sums := make([]string, len(vols))
+	for i, vol := range vols {
+		sum, err := env.hashFile(ctx, vol.SourcePath)
+		if err != nil {
+			return nil, err
+		}
+		sums[i] = sum
+	}
+	return sums, nil
+}
+
+// provenanceOf describes vol, whose source has checksum sum, as the
+// manifest items of pkg that owns selects.
+func provenanceOf(pkg *PackageDocument, vol *Volume, sum string, added time.Time, owns func(id string) bool) VolumeProvenance {
+	p := VolumeProvenance{
+		Number:       vol.Index + 1,
+		Title:        vol.DisplayName,
+		Identifier:   primaryIdentifier(vol.PackageDoc),
+		Source:       filepath.Base(vol.SourcePath),
+		SourceSHA256: sum,
+		Added:        added.UTC().Truncate(time.Second),
+		SpineStart:   -1,
+		Spine:        []string{},
+		Files:        []string{},
+	}
+	hrefs := map[string]string{}
+	for _, item := range pkg.Manifest.Items {
+		if owns(item.ID) {
+			hrefs[item.ID] = normalizeEPUBPath(item.Href)
+			p.Files = append(p.Files, normalizeEPUBPath(item.Href))
+		}
+	}
+	for i, ref := range pkg.Spine.Itemrefs {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		if p.SpineStart < 0 {
+			p.SpineStart = i
+		}
+		p.SpineEnd = i + 1
+		p.Spine = append(p.Spine, href)
+	}
+	if p.SpineStart < 0 {
+		p.SpineStart = 0
+	}
+	return p
+}
+
+// appendVolumeManifest adds volumes, just appended to book, to its volume
+// manifest. A book novfmt did not merge is recorded as volume 1, made of
+// the manifest items in existing. A merged book without a manifest, made
+// by a novfmt that did not write one, is left without one.
+func appendVolumeManifest(ctx context.Context, book *Volume, volumes []*Volume, existing map[string]bool, merged bool, log *slog.Logger) error {
+	now := time.Now()
+	m, err := readVolumeManifest(book.RootDir)
+	switch {
+	case errors.Is(err, ErrNoVolumeManifest) && merged:
+		log.Info("book has no volume manifest; not starting one partway", "path", book.SourcePath)
+		return nil
+	case errors.Is(err, ErrNoVolumeManifest):
+		sum, err := EnvFrom(ctx).hashFile(ctx, book.SourcePath)
+		if err != nil {
+			return err
+		}
+		m = &VolumeManifest{Volumes: []VolumeProvenance{
+			provenanceOf(book.PackageDoc, book, sum, now, func(id string) bool { return existing[id] }),
+		}}
+	case err != nil:
+		return err
+	}
+	sums, err := hashSources(ctx, volumes)
+	if err != nil {
+		return err
+	}
+	m.Volumes = append(m.Volumes, mergedVolumeManifest(book.PackageDoc, volumes, sums, now).Volumes...)
+	return writeVolumeManifest(book.RootDir, m)
+}
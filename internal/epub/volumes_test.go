@@ -0,0 +1,68 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeManifest(t *testing.T) {
+	ctx := context.Background()
+	vol1 := buildCatalogBook(t, "urn:test:v1", "Saga 1", "Ann Author", true)
+	vol2 := buildCatalogBook(t, "urn:test:v2", "Saga 2", "Ann Author", false)
+	vol3 := buildCatalogBook(t, "urn:test:v3", "Saga 3", "Ann Author", false)
+	omnibus := filepath.Join(t.TempDir(), "saga.epub")
+	if err := MergeEPUBs(ctx, []string{vol1, vol2}, MergeOptions{OutPath: omnibus, VolumeTitlePages: true}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadVolumeManifest(ctx, omnibus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Volumes) != 2 {
+		t.Fatalf("volumes = %+v", m.Volumes)
+	}
+	second := m.Volumes[1]
+	if second.Number != 2 || second.Title != "Saga 2" || second.Identifier != "urn:test:v2" || second.Source != filepath.Base(vol2) {
+		t.Fatalf("volume 2 = %+v", second)
+	}
+	if sum, _ := HashFile(ctx, vol2); second.SourceSHA256 != sum {
+		t.Fatalf("volume 2 checksum = %q, want %q", second.SourceSHA256, sum)
+	}
+	// Each volume has a title page and one chapter.
+	if m.Volumes[0].SpineStart != 0 || m.Volumes[0].SpineEnd != 2 || second.SpineStart != 2 || second.SpineEnd != 4 {
+		t.Fatalf("spine ranges = %d-%d, %d-%d", m.Volumes[0].SpineStart, m.Volumes[0].SpineEnd, second.SpineStart, second.SpineEnd)
+	}
+	if len(second.Spine) != 2 || second.Spine[1] != "Volumes/v0002/ch1.xhtml" {
+		t.Fatalf("volume 2 spine = %v", second.Spine)
+	}
+	if !containsString(m.Volumes[0].Files, "Volumes/v0001/cover.jpg") || containsString(second.Files, "Volumes/v0001/cover.jpg") {
+		t.Fatalf("files = %v, %v", m.Volumes[0].Files, second.Files)
+	}
+
+	if err := AppendEPUBs(ctx, omnibus, []string{vol3}, MergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = ReadVolumeManifest(ctx, omnibus); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Volumes) != 3 || m.Volumes[2].Number != 3 || m.Volumes[2].SpineStart != 4 || m.Volumes[2].SpineEnd != 5 {
+		t.Fatalf("after append = %+v", m.Volumes)
+	}
+
+	single := buildTestEPUB(t, "Standalone", "en")
+	if _, err := ReadVolumeManifest(ctx, single); !errors.Is(err, ErrNoVolumeManifest) {
+		t.Fatalf("unmerged book: err = %v", err)
+	}
+	both := filepath.Join(t.TempDir(), "both.epub")
+	if err := AppendEPUBs(ctx, single, []string{vol3}, MergeOptions{OutPath: both}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = ReadVolumeManifest(ctx, both); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Volumes) != 2 || m.Volumes[0].Title != "Standalone" || len(m.Volumes[0].Spine) != 1 || m.Volumes[1].SpineStart != 1 {
+		t.Fatalf("appended to single book = %+v", m.Volumes)
+	}
+}
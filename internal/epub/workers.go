@@ -0,0 +1,135 @@
+package epub
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// streamCost is what a file costs to process when it is streamed rather
+// than read whole: decoder and encoder buffers plus the text node at hand.
+const streamCost = 1 << 20
+
+// memBudget bounds the memory that concurrent file jobs claim. A claim
+// larger than the whole budget is cut to it, so such a job runs alone.
+type memBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newMemBudget(limit int64) *memBudget {
+	b := &memBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes are free and claims them. It returns the
+// amount claimed, to pass to release.
+func (b *memBudget) acquire(n int64) int64 {
+	if b.limit <= 0 || n <= 0 {
+		return 0
+	}
+	n = min(n, b.limit)
+	b.mu.Lock()
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+	return n
+}
+
+func (b *memBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// runFileJobs runs work for the files 0..n-1 on up to workers goroutines
+// (GOMAXPROCS when workers is 0), each first claiming cost(i) bytes of a
+// maxMemory budget (unbounded when 0). done is called for each file in
+// order, on the calling goroutine, once it and every file before it have
+// finished, so that results are reported as a sequential run would. The
+// first error cancels the files not yet started.
+func runFileJobs(ctx context.Context, n, workers int, maxMemory int64, cost func(i int) int64, work func(i int) error, done func(i int) error) error {
+	if n == 0 {
+		return ctx.Err()
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	budget := newMemBudget(maxMemory)
+
+	type result struct {
+		i   int
+		err error
+	}
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := ctx.Err()
+				if err == nil {
+					claim := budget.acquire(cost(i))
+					err = work(i)
+					budget.release(claim)
+				}
+				results <- result{i, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range n {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	finished := make([]bool, n)
+	next := 0
+	var firstErr error
+	for r := range results {
+		if firstErr != nil {
+			continue
+		}
+		if r.err != nil {
+			firstErr = r.err
+			cancel()
+			continue
+		}
+		finished[r.i] = true
+		for next < n && finished[next] {
+			if err := done(next); err != nil {
+				firstErr = err
+				cancel()
+				break
+			}
+			next++
+		}
+	}
+	if firstErr == nil && next < n {
+		// Canceled before every file was handed out.
+		return ctx.Err()
+	}
+	return firstErr
+}
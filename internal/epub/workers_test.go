@@ -0,0 +1,88 @@
+package epub
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestRunFileJobsOrderAndBudget(t *testing.T) {
+	ctx := context.Background()
+	const n, limit = 40, 100
+	var (
+		mu         sync.Mutex
+		inUse, top int64
+	)
+	cost := func(i int) int64 { return int64(10 + i%5*20) }
+	work := func(i int) error {
+		mu.Lock()
+		inUse += cost(i)
+		top = max(top, inUse)
+		mu.Unlock()
+		runtime.Gosched()
+		mu.Lock()
+		inUse -= cost(i)
+		mu.Unlock()
+		return nil
+	}
+	var order []int
+	done := func(i int) error {
+		order = append(order, i)
+		return nil
+	}
+	if err := runFileJobs(ctx, n, 8, limit, cost, work, done); err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("done order = %v", order)
+		}
+	}
+	if len(order) != n || top > limit {
+		t.Fatalf("%d files done, peak claim %d over limit %d", len(order), top, limit)
+	}
+
+	boom := errors.New("boom")
+	err := runFileJobs(ctx, n, 4, 0, cost, func(i int) error {
+		if i == 7 {
+			return boom
+		}
+		return nil
+	}, func(int) error { return nil })
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := runFileJobs(canceled, n, 4, 0, cost, work, done); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestRewriteConcurrentMatchesSequential(t *testing.T) {
+	ctx := context.Background()
+	rules := []RewriteRule{{Find: "the", Replace: "THE"}}
+	var results []RewriteStats
+	for _, opts := range []RewriteOptions{
+		{Rules: rules, Workers: 1},
+		{Rules: rules, Workers: 8, MaxMemory: 2 * streamCost},
+	} {
+		book := filepath.Join(t.TempDir(), "book.epub")
+		if err := GenerateEPUB(ctx, GenerateOptions{OutPath: book, Chapters: 12, WordsPerChapter: 300}); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := RewriteEPUB(ctx, book, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, stats)
+	}
+	if results[0].MatchCount == 0 || !reflect.DeepEqual(results[0].Files, results[1].Files) {
+		t.Fatalf("concurrent rewrite differs: %d vs %d matches", results[0].MatchCount, results[1].MatchCount)
+	}
+}
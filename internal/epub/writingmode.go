@@ -0,0 +1,238 @@
+package epub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	WritingModeVertical   = "vertical-rl"
+	WritingModeHorizontal = "horizontal-tb"
+)
+
+// WritingModeStylesheetHref is the stylesheet that sets vertical writing on
+// every document, relative to the package document.
+const WritingModeStylesheetHref = "Styles/novfmt-writing-mode.css"
+
+const writingModeCSS = `html {
+  -epub-writing-mode: vertical-rl;
+  -webkit-writing-mode: vertical-rl;
+  writing-mode: vertical-rl;
+}
+`
+
+var writingModeDeclRE = regexp.MustCompile(`(?i)((?:-epub-|-webkit-)?writing-mode\s*:\s*)(horizontal-tb|vertical-rl|vertical-lr|sideways-rl|sideways-lr|lr-tb|tb-rl|lr|rl|tb)`)
+
+type WritingModeOptions struct {
+	// Mode is WritingModeVertical or WritingModeHorizontal; see
+	// ParseWritingMode.
+	Mode     string
+	OutPath  string
+	DryRun   bool
+	Logger   *slog.Logger
+	Progress ProgressFunc
+}
+
+// ParseWritingMode accepts "vertical"/"vertical-rl" and
+// "horizontal"/"horizontal-tb".
+func ParseWritingMode(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "vertical", "vertical-rl", "tate":
+		return WritingModeVertical, nil
+	case "horizontal", "horizontal-tb", "yoko":
+		return WritingModeHorizontal, nil
+	}
+	return "", fmt.Errorf("unknown writing mode %q (want vertical or horizontal)", s)
+}
+
+// SetWritingMode converts a book between vertical-rl and horizontal-tb
+// presentation: writing-mode declarations in stylesheets, <style> elements
+// and style attributes are switched, a stylesheet applying vertical-rl to
+// every document is added (vertical) or removed (horizontal), and the spine
+// page-progression-direction and primary-writing-mode metadata are set to
+// match. Without OutPath the input is modified in place.
+func SetWritingMode(ctx context.Context, input string, opts WritingModeOptions) (RewriteStats, error) {
+	var stats RewriteStats
+	if input == "" {
+		return stats, fmt.Errorf("input EPUB path is required")
+	}
+	log := loggerOrDiscard(opts.Logger)
+
+	log.Info("loading book", "path", input)
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(vol.TempDir)
+	logRepairs(log, vol)
+
+	stats, err = applyWritingMode(ctx, vol.PackageDir, vol.PackageDoc, opts.Mode, opts.Progress, log)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range stats.Files {
+		if f.Href == packagePseudoHref {
+			stats.Changeset.modified(packageHref(vol))
+		}
+	}
+	if err := stats.Changeset.commit(ctx, vol, input, opts.OutPath, opts.DryRun, opts.Progress, log); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// packagePseudoHref stands for the package document in the stats of
+// helpers that do not know its file name.
+const packagePseudoHref = "(package)"
+
+// applyWritingMode converts the tree under pkgDir described by pkg; the
+// caller writes pkg afterwards. Package changes are reported under the
+// pseudo href "(package)".
+func applyWritingMode(ctx context.Context, pkgDir string, pkg *PackageDocument, mode string, progress ProgressFunc, log *slog.Logger) (RewriteStats, error) {
+	var stats RewriteStats
+	mode, err := ParseWritingMode(mode)
+	if err != nil {
+		return stats, err
+	}
+	vertical := mode == WritingModeVertical
+	record := func(href string, n int, kind string) {
+		if n == 0 {
+			return
+		}
+		stats.FilesChanged++
+		stats.MatchCount += n
+		stats.Files = append(stats.Files, RewriteFileResult{Href: href, Matches: n})
+		if href != packagePseudoHref {
+			stats.Changeset.record(href, kind)
+		}
+	}
+
+	pkgEdits := 0
+	direction := "ltr"
+	if vertical {
+		direction = "rtl"
+	}
+	if pkg.Spine.PageProgressionDirection != direction {
+		pkg.Spine.PageProgressionDirection = direction
+		pkgEdits++
+	}
+	primary := "horizontal-lr"
+	if vertical {
+		primary = "vertical-rl"
+	}
+	found := false
+	for i := range pkg.Metadata.Meta {
+		m := &pkg.Metadata.Meta[i]
+		if m.Name != "primary-writing-mode" {
+			continue
+		}
+		found = true
+		if m.Content != primary {
+			m.Content = primary
+			pkgEdits++
+		}
+	}
+	if !found {
+		pkg.Metadata.Meta = append(pkg.Metadata.Meta, MetaNode{Name: "primary-writing-mode", Content: primary})
+		pkgEdits++
+	}
+
+	sheet := filepath.Join(pkgDir, filepath.FromSlash(WritingModeStylesheetHref))
+	if vertical {
+		kind := ChangeModified
+		if !hasManifestHref(pkg, WritingModeStylesheetHref) {
+			kind = ChangeAdded
+		}
+		ensureManifestItem(&pkg.Manifest, "novfmt-writing-mode", WritingModeStylesheetHref, "text/css")
+		if existing, err := os.ReadFile(sheet); err != nil || string(existing) != writingModeCSS {
+			if err := ensureParentDir(sheet); err != nil {
+				return stats, err
+			}
+			if err := os.WriteFile(sheet, []byte(writingModeCSS), 0o644); err != nil {
+				return stats, err
+			}
+			record(WritingModeStylesheetHref, 1, kind)
+		}
+	} else {
+		kept := pkg.Manifest.Items[:0]
+		for _, item := range pkg.Manifest.Items {
+			if normalizeEPUBPath(item.Href) == WritingModeStylesheetHref {
+				if err := os.Remove(sheet); err != nil && !os.IsNotExist(err) {
+					return stats, err
+				}
+				stats.Changeset.removed(WritingModeStylesheetHref)
+				pkgEdits++
+				continue
+			}
+			kept = append(kept, item)
+		}
+		pkg.Manifest.Items = kept
+	}
+	record(packagePseudoHref, pkgEdits, ChangeModified)
+
+	for i, item := range pkg.Manifest.Items {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		progress.report(StageRewrite, i, len(pkg.Manifest.Items), item.Href)
+		if normalizeEPUBPath(item.Href) == WritingModeStylesheetHref {
+			continue
+		}
+		isDoc := item.MediaType == "application/xhtml+xml"
+		if !isDoc && item.MediaType != "text/css" {
+			continue
+		}
+		p := filepath.Join(pkgDir, filepath.FromSlash(item.Href))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return stats, err
+		}
+		n := 0
+		out := writingModeDeclRE.ReplaceAllStringFunc(string(data), func(m string) string {
+			sub := writingModeDeclRE.FindStringSubmatch(m)
+			if strings.EqualFold(sub[2], mode) {
+				return m
+			}
+			n++
+			return sub[1] + mode
+		})
+		if isDoc && !hasProperty(item.Properties, "nav") {
+			dir := path.Dir(normalizeEPUBPath(item.Href))
+			link := relativeHref(dir, WritingModeStylesheetHref)
+			linked := linksStylesheet(out, link)
+			switch {
+			case vertical && !linked:
+				var ok bool
+				if out, ok = addStylesheetLink(out, link); ok {
+					n++
+				} else {
+					log.Warn("document has no head; writing-mode stylesheet not linked", "href", item.Href)
+				}
+			case !vertical && linked:
+				out = linkTagPattern.ReplaceAllStringFunc(out, func(tag string) string {
+					if isStylesheetLink(tag) && linkTarget(tag) == link {
+						n++
+						return ""
+					}
+					return tag
+				})
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		log.Debug("switched writing mode", "href", item.Href, "edits", n)
+		if err := os.WriteFile(p, []byte(out), 0o644); err != nil {
+			return stats, err
+		}
+		record(item.Href, n, ChangeModified)
+	}
+	progress.report(StageRewrite, len(pkg.Manifest.Items), len(pkg.Manifest.Items), "")
+	return stats, nil
+}
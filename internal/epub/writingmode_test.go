@@ -0,0 +1,101 @@
+package epub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetWritingModeRoundTrip(t *testing.T) {
+	input := buildEPUBFromFiles(t, map[string]string{
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:test:wm</dc:identifier>
+    <dc:title>WM</dc:title>
+    <dc:language>ja</dc:language>
+  </metadata>
+  <manifest>
+    <item id="css" href="Styles/main.css" media-type="text/css"/>
+    <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine page-progression-direction="ltr">
+    <itemref idref="ch1"/>
+  </spine>
+</package>
+`,
+		"OEBPS/Styles/main.css": "body { -webkit-writing-mode: horizontal-tb; writing-mode: horizontal-tb; margin: 0 }\n",
+		"OEBPS/Text/ch1.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>x</title>
+<link rel="stylesheet" type="text/css" href="../Styles/main.css"/>
+</head><body><p>本文</p></body></html>
+`,
+	})
+	ctx := context.Background()
+
+	if _, err := SetWritingMode(ctx, input, WritingModeOptions{Mode: "vertical"}); err != nil {
+		t.Fatalf("SetWritingMode vertical: %v", err)
+	}
+	vol, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol.TempDir)
+
+	if got := vol.PackageDoc.Spine.PageProgressionDirection; got != "rtl" {
+		t.Fatalf("page-progression-direction = %q, want rtl", got)
+	}
+	if !hasMeta(vol.PackageDoc, "primary-writing-mode", "vertical-rl") {
+		t.Fatalf("primary-writing-mode not set: %+v", vol.PackageDoc.Metadata.Meta)
+	}
+	css, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Styles", "main.css"))
+	if strings.Contains(string(css), "horizontal-tb") || strings.Count(string(css), "vertical-rl") != 2 {
+		t.Fatalf("stylesheet not switched:\n%s", css)
+	}
+	doc, _ := os.ReadFile(filepath.Join(vol.PackageDir, "Text", "ch1.xhtml"))
+	if !strings.Contains(string(doc), `href="../`+WritingModeStylesheetHref+`"`) {
+		t.Fatalf("writing-mode stylesheet not linked:\n%s", doc)
+	}
+
+	// Converting again is a no-op.
+	stats, err := SetWritingMode(ctx, input, WritingModeOptions{Mode: "vertical-rl", DryRun: true})
+	if err != nil || stats.FilesChanged != 0 {
+		t.Fatalf("second vertical run changed %d files (%v): %+v", stats.FilesChanged, err, stats.Files)
+	}
+
+	if _, err := SetWritingMode(ctx, input, WritingModeOptions{Mode: "horizontal"}); err != nil {
+		t.Fatalf("SetWritingMode horizontal: %v", err)
+	}
+	vol2, err := loadVolume(ctx, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vol2.TempDir)
+	if got := vol2.PackageDoc.Spine.PageProgressionDirection; got != "ltr" {
+		t.Fatalf("page-progression-direction = %q, want ltr", got)
+	}
+	for _, item := range vol2.PackageDoc.Manifest.Items {
+		if item.Href == WritingModeStylesheetHref {
+			t.Fatalf("writing-mode stylesheet should be removed")
+		}
+	}
+	doc, _ = os.ReadFile(filepath.Join(vol2.PackageDir, "Text", "ch1.xhtml"))
+	if strings.Contains(string(doc), "novfmt-writing-mode") {
+		t.Fatalf("link should be removed:\n%s", doc)
+	}
+	css, _ = os.ReadFile(filepath.Join(vol2.PackageDir, "Styles", "main.css"))
+	if strings.Contains(string(css), "vertical-rl") {
+		t.Fatalf("stylesheet not switched back:\n%s", css)
+	}
+}
+
+func hasMeta(pkg *PackageDocument, name, content string) bool {
+	for _, m := range pkg.Metadata.Meta {
+		if m.Name == name && m.Content == content {
+			return true
+		}
+	}
+	return false
+}